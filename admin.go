@@ -0,0 +1,702 @@
+package aperture
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/proxy"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// adminPathPrefix is the prefix of all admin API endpoints.
+	adminPathPrefix = "/admin/v1"
+
+	// adminTokenPath is the path of the endpoint that issues admin API
+	// LSATs.
+	adminTokenPath = adminPathPrefix + "/token"
+
+	// adminTokensPath is the prefix of the paths of the endpoints that
+	// manage single LSATs. It is followed by the token ID.
+	adminTokensPath = adminPathPrefix + "/tokens/"
+
+	// adminSecretHeader is the header clients of the admin API need to
+	// send the configured shared secret in.
+	adminSecretHeader = "X-Aperture-Admin-Secret"
+
+	// defaultMacaroonDrainPeriod is the default time we keep the invoice
+	// subscription of an lnd connection running after its macaroon was
+	// rotated.
+	defaultMacaroonDrainPeriod = time.Minute
+)
+
+// adminContextKey is the type of the keys of the values the admin API stores
+// in the context of a request.
+type adminContextKey string
+
+// adminTokenIDKey is the context key of the ID of the admin API LSAT a request
+// was authenticated with.
+const adminTokenIDKey adminContextKey = "admin_token_id"
+
+// AdminConfig is the configuration of the admin API that allows operators to
+// manage a running aperture instance.
+type AdminConfig struct {
+	// ListenAddr is the address the admin API listens on. The admin API is
+	// disabled if this is empty.
+	ListenAddr string `long:"listenaddr" description:"The interface the admin API should listen on. Should not be reachable from the outside world. Leave empty to disable the admin API."`
+
+	// Secret is the shared secret clients need to send in the
+	// X-Aperture-Admin-Secret header.
+	Secret string `long:"secret" description:"The shared secret clients of the admin API need to send in the X-Aperture-Admin-Secret header."`
+
+	// LSATAuth denotes whether clients can authenticate with LSATs that
+	// carry the admin capability caveat. These LSATs are issued to clients
+	// that present the macaroon of the lnd node operator.
+	LSATAuth bool `long:"lsatauth" description:"Accept LSATs with an admin=true caveat for authentication. They are issued at /admin/v1/token to clients presenting a macaroon of the lnd node with the macaroon:read permission, like the admin macaroon."`
+
+	// MacaroonDrainPeriod is the time the invoice subscription of an lnd
+	// connection is kept running after its macaroon was rotated.
+	MacaroonDrainPeriod time.Duration `long:"macaroondrainperiod" description:"The time the invoice subscription of an lnd connection is kept running after its macaroon was rotated."`
+
+	// ClientCAPath is the path to the certificate of the CA that signs the
+	// client certificates of admin API users. If set, clients must present
+	// a certificate signed by it and its common name is recorded as the
+	// user making changes.
+	ClientCAPath string `long:"clientcapath" description:"Path to the CA certificate client certificates of admin API users must be signed by. The common name of the client certificate is recorded as the user making changes."`
+
+	// ServiceHistorySize is the number of service configuration revisions
+	// that are kept for rolling back.
+	ServiceHistorySize int `long:"servicehistorysize" description:"The number of service configuration revisions kept for rolling back."`
+
+	// LSATExpiry is the time an admin API LSAT grants access to the admin
+	// API for after it was issued.
+	LSATExpiry time.Duration `long:"lsatexpiry" description:"The time an admin API LSAT grants access to the admin API for after it was issued. Defaults to 24h."`
+}
+
+// validate makes sure the admin API isn't enabled without authentication.
+func (c *AdminConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if c.ListenAddr != "" && c.Secret == "" && !c.LSATAuth {
+		return errors.New("admin API requires a secret or LSAT " +
+			"authentication")
+	}
+
+	if c.ServiceHistorySize < 0 {
+		return errors.New("service history size cannot be negative")
+	}
+
+	if c.LSATExpiry < 0 {
+		return errors.New("admin LSAT expiry cannot be negative")
+	}
+
+	return nil
+}
+
+// adminServer serves the admin API on its own listener, separate from the
+// proxy.
+type adminServer struct {
+	cfg      *AdminConfig
+	aperture *Aperture
+	history  *serviceHistory
+	budgets  *budgetStore
+	tokens   *tokenStore
+
+	// revoker revokes the LSATs minted by the proxy.
+	revoker *mint.Mint
+
+	// minter mints the LSATs used to authenticate to the admin API and
+	// adminAuth verifies them. Both are nil if LSAT authentication is
+	// disabled.
+	minter    *mint.Mint
+	adminAuth *auth.AdminAuthenticator
+
+	// verifyOperator checks that a macaroon presented to get an admin API
+	// LSAT belongs to the lnd node operator.
+	verifyOperator operatorVerifier
+
+	// tokenLimiter limits the rate of requests for an admin API LSAT, as
+	// each of them is verified by lnd.
+	tokenLimiter *rate.Limiter
+
+	// servicesMtx serializes changes to the service configuration.
+	servicesMtx sync.Mutex
+
+	server *http.Server
+}
+
+// newAdminServer creates a new admin API server for the given aperture
+// instance. If tlsConfig is nil, the server doesn't use TLS.
+func newAdminServer(cfg *AdminConfig, a *Aperture,
+	tlsConfig *tls.Config) *adminServer {
+
+	s := &adminServer{
+		cfg:      cfg,
+		aperture: a,
+		history: newServiceHistory(
+			a.etcdClient, cfg.ServiceHistorySize,
+		),
+		budgets: newBudgetStore(a.etcdClient),
+		tokens:  newTokenStore(a.etcdClient),
+		revoker: mint.New(&mint.Config{
+			Secrets: a.secretStore(),
+		}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(
+		adminPathPrefix+"/lnd/rotate-macaroon", s.rotateMacaroon,
+	)
+	mux.HandleFunc(adminConfigPath, s.getConfig)
+	mux.HandleFunc(adminPathPrefix+"/services", s.services)
+	mux.HandleFunc(
+		adminPathPrefix+"/services/history", s.servicesHistory,
+	)
+	mux.HandleFunc(
+		adminPathPrefix+"/services/rollback", s.rollbackServices,
+	)
+	mux.HandleFunc(adminPathPrefix+"/tokens", s.listTokens)
+	mux.HandleFunc(adminTokensPath, s.revokeToken)
+
+	// The token endpoint authenticates its clients with the lnd
+	// operator's macaroon instead, so it isn't wrapped.
+	var handler http.Handler = s.authenticate(mux)
+	if cfg.LSATAuth {
+		s.minter = mint.New(&mint.Config{
+			Secrets: a.secretStore(),
+		})
+		s.adminAuth = auth.NewAdminAuthenticator(s.minter)
+		s.verifyOperator = newLndOperatorVerifier(a)
+		s.tokenLimiter = rate.NewLimiter(
+			rate.Every(adminTokenRequestInterval),
+			adminTokenRequestBurst,
+		)
+
+		tokenMux := http.NewServeMux()
+		tokenMux.HandleFunc(adminTokenPath, s.issueToken)
+		tokenMux.Handle("/", handler)
+		handler = tokenMux
+	}
+
+	s.server = &http.Server{
+		Addr:      cfg.ListenAddr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+
+	return s
+}
+
+// newAdminTLSConfig creates the TLS config of the admin API from the TLS config
+// of the proxy and the given settings. Unless configured otherwise, the
+// minimum TLS version of the proxy is used. If a client CA is configured,
+// clients are required to present a certificate signed by it.
+func newAdminTLSConfig(cfg *AdminConfig, settings *TLSSettings,
+	proxyTLSConfig *tls.Config) (*tls.Config, error) {
+
+	if proxyTLSConfig == nil {
+		if cfg.ClientCAPath != "" {
+			return nil, errors.New("admin API client certificates " +
+				"require TLS")
+		}
+
+		return nil, nil
+	}
+
+	tlsConfig := proxyTLSConfig.Clone()
+	minVersion, err := settings.minVersion(tlsConfig.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.MinVersion = minVersion
+
+	if cfg.ClientCAPath == "" {
+		return tlsConfig, nil
+	}
+
+	caCert, err := ioutil.ReadFile(cfg.ClientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read admin client CA: %v",
+			err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("invalid admin client CA certificate")
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return tlsConfig, nil
+}
+
+// serve starts serving the admin API and blocks until the server is closed.
+func (s *adminServer) serve() error {
+	listener, err := listenTCP(s.server.Addr)
+	if err != nil {
+		return err
+	}
+
+	if s.server.TLSConfig != nil {
+		return s.server.ServeTLS(listener, "", "")
+	}
+
+	return s.server.Serve(listener)
+}
+
+// authenticate wraps the given handler so only requests that carry the
+// configured shared secret or, if enabled, an admin API LSAT are passed on.
+func (s *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(adminSecretHeader)
+		if s.cfg.Secret != "" && subtle.ConstantTimeCompare(
+			[]byte(secret), []byte(s.cfg.Secret),
+		) == 1 {
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if s.adminAuth != nil {
+			tokenID, ok := s.adminAuth.Accept(&r.Header)
+			if ok {
+				ctx := context.WithValue(
+					r.Context(), adminTokenIDKey, tokenID,
+				)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		}
+
+		log.Warnf("Rejecting unauthenticated admin API request from "+
+			"%s to %s", r.RemoteAddr, r.URL.Path)
+		writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+	})
+}
+
+// rotateMacaroonRequest is the body of a macaroon rotation request.
+type rotateMacaroonRequest struct {
+	// Macaroon is the base64 encoded new macaroon.
+	Macaroon string `json:"macaroon"`
+
+	// LndHost optionally selects the lnd node whose macaroon should be
+	// rotated. The primary node is used if it is empty.
+	LndHost string `json:"lndhost"`
+}
+
+// rotateMacaroon handles requests to replace the macaroon the challenger uses
+// to connect to lnd.
+func (s *adminServer) rotateMacaroon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(
+			w, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	challenger := s.aperture.challenger
+	if challenger == nil {
+		writeAdminError(
+			w, http.StatusConflict, "lnd authentication disabled",
+		)
+		return
+	}
+
+	var req rotateMacaroonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(
+			w, http.StatusBadRequest, "invalid request body",
+		)
+		return
+	}
+	macaroon, err := base64.StdEncoding.DecodeString(req.Macaroon)
+	if err != nil || len(macaroon) == 0 {
+		writeAdminError(w, http.StatusBadRequest, "invalid macaroon")
+		return
+	}
+
+	drainPeriod := s.cfg.MacaroonDrainPeriod
+	if drainPeriod == 0 {
+		drainPeriod = defaultMacaroonDrainPeriod
+	}
+
+	err = challenger.RotateMacaroon(req.LndHost, macaroon, drainPeriod)
+	if err != nil {
+		log.Errorf("Unable to rotate lnd macaroon: %v", err)
+		writeAdminError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, struct{}{})
+}
+
+// adminUser returns the user making the given request, which is the common
+// name of the client certificate the request was authenticated with or, if
+// there is none, the ID of the admin API LSAT.
+func adminUser(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if tokenID, ok := r.Context().Value(adminTokenIDKey).(lsat.TokenID); ok {
+		return "lsat:" + tokenID.String()
+	}
+
+	return "unknown"
+}
+
+// services handles requests to list and to replace the service configuration.
+func (s *adminServer) services(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listServices(w, r)
+
+	case http.MethodPost:
+		s.updateServices(w, r)
+
+	default:
+		writeAdminError(
+			w, http.StatusMethodNotAllowed, "method not allowed",
+		)
+	}
+}
+
+// listServices handles requests to list the services the proxy currently uses,
+// with the same option names as in the configuration file. The values of their
+// headers are redacted.
+func (s *adminServer) listServices(w http.ResponseWriter, r *http.Request) {
+	var services []*proxy.Service
+	s.servicesMtx.Lock()
+	if s.aperture.proxy != nil {
+		services = s.aperture.proxy.Services()
+	}
+	s.servicesMtx.Unlock()
+
+	encoded, err := encodeConfig(redactServices(services))
+	if err != nil {
+		log.Errorf("Unable to encode services: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, encoded)
+}
+
+// updateServices handles requests to replace the service configuration. The
+// body holds the new services in the same YAML format that is used in the
+// services section of the configuration file.
+func (s *adminServer) updateServices(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeAdminError(
+			w, http.StatusBadRequest, "invalid request body",
+		)
+		return
+	}
+	services, err := decodeServices(body)
+	if err != nil {
+		writeAdminError(
+			w, http.StatusBadRequest, "invalid services: "+err.Error(),
+		)
+		return
+	}
+
+	s.applyServices(w, r, services, 0)
+}
+
+// servicesHistory handles requests to list the revisions of the service
+// configuration.
+func (s *adminServer) servicesHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(
+			w, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	revisions, err := s.history.revisions(r.Context())
+	if err != nil {
+		log.Errorf("Unable to list service revisions: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, revisions)
+}
+
+// tokenInfo is an LSAT listed by the admin API.
+type tokenInfo struct {
+	// tokenRecord holds the details of the LSAT recorded when it was
+	// minted. Only the token ID is known of LSATs minted before they were
+	// recorded.
+	tokenRecord
+
+	// Budget and Remaining are the request budget of the LSAT and how
+	// many requests it can still be used for. They are only set for
+	// LSATs with a budget that were used at least once.
+	Budget    *uint32 `json:"budget,omitempty"`
+	Remaining *uint32 `json:"remaining,omitempty"`
+}
+
+// listTokens handles requests to list the LSATs that weren't revoked, along
+// with their request budget and how many requests they can still be used for.
+func (s *adminServer) listTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(
+			w, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	records, err := s.tokens.Tokens(r.Context())
+	if err != nil {
+		log.Errorf("Unable to list LSATs: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	budgets, err := s.budgets.Budgets(r.Context())
+	if err != nil {
+		log.Errorf("Unable to list LSAT budgets: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tokens := make([]*tokenInfo, 0, len(records))
+	byID := make(map[string]*tokenInfo, len(records))
+	for _, record := range records {
+		info := &tokenInfo{tokenRecord: *record}
+		tokens = append(tokens, info)
+		byID[record.TokenID] = info
+	}
+	for _, budget := range budgets {
+		info, ok := byID[budget.TokenID]
+		if !ok {
+			info = &tokenInfo{
+				tokenRecord: tokenRecord{
+					TokenID: budget.TokenID,
+				},
+			}
+			tokens = append(tokens, info)
+		}
+		info.Budget = &budget.Budget
+		info.Remaining = &budget.Remaining
+	}
+
+	writeAdminJSON(w, http.StatusOK, tokens)
+}
+
+// revokeToken handles requests to revoke the LSAT whose token ID follows the
+// tokens path. Revoked LSATs are rejected from then on.
+func (s *adminServer) revokeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeAdminError(
+			w, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	tokenID, err := lsat.MakeIDFromString(
+		strings.TrimPrefix(r.URL.Path, adminTokensPath),
+	)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid token ID")
+		return
+	}
+
+	ctx := r.Context()
+	record, err := s.tokens.Token(ctx, tokenID)
+	switch {
+	case err == errTokenNotFound:
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+
+	case err != nil:
+		log.Errorf("Unable to look up LSAT %v: %v", tokenID, err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	id, err := record.identifier()
+	if err == nil {
+		err = s.revoker.RevokeLSAT(ctx, id)
+	}
+	if err == nil {
+		err = s.tokens.RemoveToken(ctx, tokenID)
+	}
+	if err != nil {
+		log.Errorf("Unable to revoke LSAT %v: %v", tokenID, err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The LSAT may still be cached as verified, which would let it be
+	// used until its entry expires. Other instances evict it once they
+	// see its record removed.
+	if s.aperture.proxy != nil {
+		s.aperture.proxy.InvalidateToken(tokenID)
+	}
+
+	log.Infof("LSAT %v revoked by %s", tokenID, adminUser(r))
+
+	writeAdminJSON(w, http.StatusOK, struct{}{})
+}
+
+// rollbackServices handles requests to revert the service configuration to
+// the revision given in the revision query parameter. The rollback is
+// recorded as a new revision.
+func (s *adminServer) rollbackServices(w http.ResponseWriter,
+	r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		writeAdminError(
+			w, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	number, err := strconv.ParseUint(r.URL.Query().Get("revision"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid revision")
+		return
+	}
+
+	revision, err := s.history.revision(r.Context(), number)
+	switch {
+	case err == errRevisionNotFound:
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+
+	case err != nil:
+		log.Errorf("Unable to look up service revision %d: %v", number,
+			err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	services, err := revision.decodeServices()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.applyServices(w, r, services, number)
+}
+
+// applyServices makes the proxy use the given services and records them as a
+// new revision in the service history. If the revision can't be recorded, the
+// previous services are restored so the history always reflects the services
+// in use.
+func (s *adminServer) applyServices(w http.ResponseWriter, r *http.Request,
+	services []*proxy.Service, rollbackOf uint64) {
+
+	s.servicesMtx.Lock()
+	defer s.servicesMtx.Unlock()
+
+	ctx := r.Context()
+	prev, err := s.history.latest(ctx)
+	if err != nil {
+		log.Errorf("Unable to look up latest service revision: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Before the first change, we record the services loaded from the
+	// config file so it is possible to roll back to them.
+	if prev == nil {
+		encoded, err := encodeServices(s.aperture.cfg.Services)
+		if err == nil {
+			prev, err = s.history.add(
+				ctx, nil, serviceHistoryConfigUser, encoded, 0,
+			)
+		}
+		if err != nil {
+			log.Errorf("Unable to record initial services: %v",
+				err)
+			writeAdminError(
+				w, http.StatusInternalServerError, err.Error(),
+			)
+			return
+		}
+	}
+
+	// We need to encode the services before applying them, as that
+	// replaces the file directives in their headers with the actual file
+	// content.
+	encoded, err := encodeServices(services)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.aperture.UpdateServices(services); err != nil {
+		writeAdminError(
+			w, http.StatusBadRequest, "invalid services: "+err.Error(),
+		)
+		return
+	}
+
+	user := adminUser(r)
+	revision, err := s.history.add(ctx, prev, user, encoded, rollbackOf)
+	if err != nil {
+		log.Errorf("Unable to record service revision, restoring "+
+			"previous services: %v", err)
+
+		prevServices, decodeErr := prev.decodeServices()
+		if decodeErr == nil {
+			decodeErr = s.aperture.UpdateServices(prevServices)
+		}
+		if decodeErr != nil {
+			log.Errorf("Unable to restore previous services: %v",
+				decodeErr)
+		}
+
+		status := http.StatusInternalServerError
+		if err == errRevisionConflict {
+			status = http.StatusConflict
+		}
+		writeAdminError(w, status, err.Error())
+		return
+	}
+
+	log.Infof("Service configuration revision %d applied by %s",
+		revision.Revision, user)
+
+	writeAdminJSON(w, http.StatusOK, revision)
+}
+
+// adminError is the body of an admin API error response.
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// writeAdminError writes an error response with the given status and message.
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdminJSON(w, status, &adminError{Error: msg})
+}
+
+// writeAdminJSON writes the given value as a JSON response with the given
+// status.
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Unable to write admin API response: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package aperture
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// adminConfigPath is the path of the endpoint that returns the active
+	// configuration.
+	adminConfigPath = adminPathPrefix + "/config"
+
+	// redactedValue replaces the values of sensitive configuration options
+	// unless the full configuration is requested.
+	redactedValue = "[REDACTED]"
+)
+
+// getConfig handles requests for the active configuration. Sensitive values
+// are redacted unless the full query parameter is set to true. The services
+// are the ones the proxy currently uses, which may differ from the ones in the
+// configuration file if they were changed through the admin API.
+func (s *adminServer) getConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(
+			w, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	full := false
+	if value := r.URL.Query().Get("full"); value != "" {
+		var err error
+		full, err = strconv.ParseBool(value)
+		if err != nil {
+			writeAdminError(
+				w, http.StatusBadRequest,
+				"invalid full parameter",
+			)
+			return
+		}
+	}
+
+	cfg := *s.aperture.cfg
+
+	s.servicesMtx.Lock()
+	if s.aperture.proxy != nil {
+		cfg.Services = s.aperture.proxy.Services()
+	}
+	s.servicesMtx.Unlock()
+
+	if full {
+		log.Infof("Full configuration requested by %s", adminUser(r))
+	} else {
+		redactConfig(&cfg)
+	}
+
+	encoded, err := encodeConfig(&cfg)
+	if err != nil {
+		log.Errorf("Unable to encode configuration: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, encoded)
+}
+
+// redactConfig replaces the values of all sensitive options of the given
+// configuration. Sub-configurations that contain sensitive options are copied
+// first so the active configuration isn't modified.
+func redactConfig(cfg *Config) {
+	redact := func(value *string) {
+		if *value != "" {
+			*value = redactedValue
+		}
+	}
+
+	if cfg.Etcd != nil {
+		etcd := *cfg.Etcd
+		redact(&etcd.Password)
+		cfg.Etcd = &etcd
+	}
+
+	if cfg.Redis != nil {
+		redis := *cfg.Redis
+		redact(&redis.Password)
+		cfg.Redis = &redis
+	}
+
+	if cfg.Admin != nil {
+		admin := *cfg.Admin
+		redact(&admin.Secret)
+		cfg.Admin = &admin
+	}
+
+	if cfg.PagerDuty != nil {
+		pagerDuty := *cfg.PagerDuty
+		redact(&pagerDuty.IntegrationKey)
+		cfg.PagerDuty = &pagerDuty
+	}
+
+	// Webhook URLs commonly contain an access token.
+	redact(&cfg.WebhookURL)
+	if cfg.Webhook != nil {
+		webhook := *cfg.Webhook
+		redact(&webhook.URL)
+		redact(&webhook.Secret)
+		cfg.Webhook = &webhook
+	}
+	redact(&cfg.ServicesPassword)
+	redact(&cfg.ServicesToken)
+
+	cfg.Services = redactServices(cfg.Services)
+}
+
+// redactServices returns copies of the given services with the values of their
+// headers replaced, as they usually authenticate aperture to the backend.
+func redactServices(services []*proxy.Service) []*proxy.Service {
+	redacted := make([]*proxy.Service, len(services))
+	for i, service := range services {
+		service := *service
+		headers := make(map[string]string, len(service.Headers))
+		for name := range service.Headers {
+			headers[name] = redactedValue
+		}
+		service.Headers = headers
+		redacted[i] = &service
+	}
+
+	return redacted
+}
+
+// encodeConfig encodes the given configuration, or a part of it, with the same
+// option names that are used in the configuration file into a value that can
+// be serialized as JSON.
+func encodeConfig(cfg interface{}) (interface{}, error) {
+	encoded, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded interface{}
+	if err := yaml.Unmarshal(encoded, &decoded); err != nil {
+		return nil, err
+	}
+
+	return jsonCompatible(decoded), nil
+}
+
+// jsonCompatible converts the maps with interface keys the YAML decoder creates
+// into maps with string keys that can be serialized as JSON.
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			converted[fmt.Sprint(key)] = jsonCompatible(elem)
+		}
+		return converted
+
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = jsonCompatible(elem)
+		}
+		return v
+
+	default:
+		return v
+	}
+}
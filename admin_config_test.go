@@ -0,0 +1,120 @@
+package aperture
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAdminConfig makes sure the active configuration is returned with its
+// sensitive values redacted unless the full configuration is requested.
+func TestAdminConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := NewConfig()
+	cfg.ListenAddr = "localhost:8081"
+	cfg.Etcd.Password = "etcd-password"
+	cfg.Redis.Password = "redis-password"
+	cfg.Admin.Secret = "admin-secret"
+	cfg.WebhookURL = "https://hooks.example.com/token"
+
+	// The proxy uses different services than the configuration file to
+	// make sure the live ones are returned.
+	prxy, err := proxy.New(auth.NewMockAuthenticator(), []*proxy.Service{{
+		Name:       "live",
+		Address:    "127.0.0.1:10009",
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "off",
+		Headers: map[string]string{
+			"Authorization": "Bearer backend-token",
+		},
+	}})
+	require.NoError(t, err)
+
+	s := newAdminServer(
+		cfg.Admin, &Aperture{cfg: cfg, proxy: prxy}, nil,
+	)
+
+	request := func(target string) map[string]interface{} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set(adminSecretHeader, "admin-secret")
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var encoded map[string]interface{}
+		err := json.NewDecoder(rec.Body).Decode(&encoded)
+		require.NoError(t, err)
+
+		return encoded
+	}
+	section := func(encoded map[string]interface{},
+		name string) map[string]interface{} {
+
+		return encoded[name].(map[string]interface{})
+	}
+	service := func(
+		encoded map[string]interface{}) map[string]interface{} {
+
+		services := encoded["services"].([]interface{})
+		require.Len(t, services, 1)
+
+		return services[0].(map[string]interface{})
+	}
+
+	encoded := request(adminConfigPath)
+	require.Equal(t, "localhost:8081", encoded["listenaddr"])
+	require.Equal(t, redactedValue, encoded["webhookurl"])
+	require.Equal(t, redactedValue, section(encoded, "etcd")["password"])
+	require.Equal(t, redactedValue, section(encoded, "redis")["password"])
+	require.Equal(t, redactedValue, section(encoded, "admin")["secret"])
+	require.Equal(t, "live", service(encoded)["name"])
+	require.Equal(
+		t, redactedValue,
+		section(service(encoded), "headers")["Authorization"],
+	)
+
+	// The services are listed with their headers redacted as well.
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(
+		http.MethodGet, adminPathPrefix+"/services", nil,
+	)
+	req.Header.Set(adminSecretHeader, "admin-secret")
+	s.server.Handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var services []map[string]interface{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&services))
+	require.Len(t, services, 1)
+	require.Equal(t, "live", services[0]["name"])
+	require.Equal(
+		t, redactedValue,
+		services[0]["headers"].(map[string]interface{})["Authorization"],
+	)
+
+	// The active configuration must not be modified by redacting it.
+	require.Equal(t, "etcd-password", cfg.Etcd.Password)
+	require.Equal(t, "redis-password", cfg.Redis.Password)
+	require.Equal(
+		t, "Bearer backend-token",
+		prxy.Services()[0].Headers["Authorization"],
+	)
+
+	encoded = request(adminConfigPath + "?full=true")
+	require.Equal(
+		t, "https://hooks.example.com/token", encoded["webhookurl"],
+	)
+	require.Equal(
+		t, "etcd-password", section(encoded, "etcd")["password"],
+	)
+	require.Equal(
+		t, "Bearer backend-token",
+		section(service(encoded), "headers")["Authorization"],
+	)
+}
@@ -0,0 +1,128 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// lndMacaroonHeader is the header the token endpoint of the admin API
+	// expects the hex encoded macaroon of the lnd node operator in. It is
+	// the same header lnd's own REST API uses.
+	lndMacaroonHeader = "Grpc-Metadata-Macaroon"
+
+	// defaultAdminLSATExpiry is the default time an admin API LSAT grants
+	// access to the admin API for.
+	defaultAdminLSATExpiry = 24 * time.Hour
+
+	// adminTokenRequestInterval is the interval at which requests for an
+	// admin API LSAT are accepted once the burst below is used up. Every
+	// request makes lnd verify a macaroon, so they can't be allowed to
+	// arrive at an arbitrary rate.
+	adminTokenRequestInterval = time.Second
+
+	// adminTokenRequestBurst is the number of requests for an admin API
+	// LSAT that are accepted at once.
+	adminTokenRequestBurst = 5
+)
+
+// operatorVerifier checks that the given hex encoded macaroon belongs to the
+// operator of the lnd node.
+type operatorVerifier func(ctx context.Context, macHex string) error
+
+// newLndOperatorVerifier returns an operator verifier that lets the lnd nodes
+// of the given aperture instance's challenger verify the macaroons, reusing
+// its connection to them.
+func newLndOperatorVerifier(a *Aperture) operatorVerifier {
+	return func(ctx context.Context, macHex string) error {
+		if a.challenger == nil {
+			return errors.New("lnd isn't available")
+		}
+
+		return a.challenger.VerifyOperatorMacaroon(ctx, macHex)
+	}
+}
+
+// adminTokenResponse is the body of a successful admin token request.
+type adminTokenResponse struct {
+	// TokenID is the hex encoded ID of the issued LSAT.
+	TokenID string `json:"token_id"`
+
+	// Authorization is the value of the Authorization header clients need
+	// to send to authenticate to the admin API with the issued LSAT.
+	Authorization string `json:"authorization"`
+}
+
+// issueToken handles requests for a new admin API LSAT. Instead of the usual
+// admin API authentication, the request must carry the macaroon of the lnd
+// node operator.
+func (s *adminServer) issueToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(
+			w, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	if !s.tokenLimiter.Allow() {
+		writeAdminError(
+			w, http.StatusTooManyRequests, "too many requests",
+		)
+		return
+	}
+
+	macHex := r.Header.Get(lndMacaroonHeader)
+	if _, err := hex.DecodeString(macHex); err != nil || macHex == "" {
+		writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if err := s.verifyOperator(r.Context(), macHex); err != nil {
+		log.Warnf("Rejecting admin token request from %s, lnd didn't "+
+			"accept the macaroon: %v", r.RemoteAddr, err)
+		writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	expiry := s.cfg.LSATExpiry
+	if expiry == 0 {
+		expiry = defaultAdminLSATExpiry
+	}
+	mac, preimage, err := s.minter.MintAdminAPILSAT(
+		r.Context(), time.Now().Add(expiry),
+	)
+	if err != nil {
+		log.Errorf("Unable to mint admin API LSAT: %v", err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Infof("Issued admin API LSAT %s to %s", id.TokenID.String(),
+		r.RemoteAddr)
+
+	writeAdminJSON(w, http.StatusOK, &adminTokenResponse{
+		TokenID: id.TokenID.String(),
+		Authorization: fmt.Sprintf(
+			"LSAT %s:%s", base64.StdEncoding.EncodeToString(
+				macBytes,
+			), preimage,
+		),
+	})
+}
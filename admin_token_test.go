@@ -0,0 +1,88 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestAdminTokenAuth makes sure admin API LSATs are only issued to clients
+// presenting the lnd operator's macaroon, at a limited rate, and grant access
+// to the admin API.
+func TestAdminTokenAuth(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	a := &Aperture{
+		cfg: &Config{
+			Authenticator: &AuthConfig{},
+		},
+		etcdClient: etcdClient,
+	}
+	s := newAdminServer(&AdminConfig{LSATAuth: true}, a, nil)
+	s.verifyOperator = func(_ context.Context, macHex string) error {
+		if macHex != "aabb" {
+			return errors.New("permission denied")
+		}
+
+		return nil
+	}
+
+	request := func(method, path string,
+		header http.Header) *httptest.ResponseRecorder {
+
+		req := httptest.NewRequest(method, path, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	// Without any authentication, the admin API must be closed.
+	historyPath := adminPathPrefix + "/services/history"
+	rec := request(http.MethodGet, historyPath, nil)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// A macaroon lnd doesn't accept must not get a token.
+	rec = request(http.MethodPost, adminTokenPath, http.Header{
+		lndMacaroonHeader: []string{"ccdd"},
+	})
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = request(http.MethodPost, adminTokenPath, http.Header{
+		lndMacaroonHeader: []string{"aabb"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var token adminTokenResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&token))
+	require.NotEmpty(t, token.TokenID)
+
+	// The issued token grants access to the admin API.
+	rec = request(http.MethodGet, historyPath, http.Header{
+		"Authorization": []string{token.Authorization},
+	})
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// Requests for tokens are rate limited, as each of them is verified by
+	// lnd, no matter whether they carry a valid macaroon.
+	for i := 2; i < adminTokenRequestBurst; i++ {
+		rec = request(http.MethodPost, adminTokenPath, http.Header{
+			lndMacaroonHeader: []string{"ccdd"},
+		})
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	rec = request(http.MethodPost, adminTokenPath, http.Header{
+		lndMacaroonHeader: []string{"aabb"},
+	})
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+}
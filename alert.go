@@ -0,0 +1,160 @@
+package aperture
+
+import (
+	"errors"
+	"net/http"
+)
+
+const (
+	// alertKeyLndConnection is the deduplication key used for alerts about
+	// the connection to the backing lnd node.
+	alertKeyLndConnection = "aperture-lnd-connection"
+
+	// alertKeyLndNodePrefix is the prefix of the deduplication keys used
+	// for alerts about the connection to a single lnd node. The node's host
+	// is appended to it.
+	alertKeyLndNodePrefix = "aperture-lnd-node-"
+
+	// alertKeyGeneric is the deduplication key used for all errors we
+	// don't know how to classify.
+	alertKeyGeneric = "aperture-error"
+)
+
+// alertSeverity is the severity of an operational alert. The values map
+// directly to the severities understood by the PagerDuty Events API v2.
+type alertSeverity string
+
+const (
+	// severityCritical is used for conditions that render aperture unable
+	// to serve paid requests.
+	severityCritical alertSeverity = "critical"
+
+	// severityError is used for errors that need an operator's attention
+	// but don't necessarily take the whole service down.
+	severityError alertSeverity = "error"
+
+	// severityWarning is used for degraded states that might turn into an
+	// error if not taken care of.
+	severityWarning alertSeverity = "warning"
+
+	// severityInfo is used for purely informational events.
+	severityInfo alertSeverity = "info"
+)
+
+// alert is a single operational event that should be brought to the attention
+// of an operator.
+type alert struct {
+	// key identifies the condition the alert is about. Triggering the same
+	// key multiple times is de-duplicated by the alerting backend and the
+	// key is used to resolve the alert once the condition clears.
+	key string
+
+	// summary is a short, human readable description of the event.
+	summary string
+
+	// severity is the severity of the event.
+	severity alertSeverity
+}
+
+// alerter is the interface all backends that can notify operators about
+// critical operational events need to implement.
+type alerter interface {
+	// Start starts the alerter's background work.
+	Start() error
+
+	// Stop shuts down the alerter, trying to deliver all queued events
+	// first.
+	Stop()
+
+	// Trigger notifies the operator about the given alert.
+	Trigger(*alert)
+
+	// Resolve signals that the condition identified by the given key has
+	// cleared.
+	Resolve(key string)
+}
+
+// alertFromError classifies an error that was emitted on the main error
+// channel and turns it into an alert. If the error isn't worth alerting on,
+// nil is returned.
+func alertFromError(err error) *alert {
+	var lndErr *lndConnectionError
+
+	switch {
+	case err == nil, errors.Is(err, http.ErrServerClosed):
+		return nil
+
+	// If the challenger reports a connection error on the main error
+	// channel, there's no lnd node left to fail over to.
+	case errors.As(err, &lndErr):
+		return &alert{
+			key:      alertKeyLndConnection,
+			summary:  lndErr.Error(),
+			severity: severityCritical,
+		}
+
+	default:
+		return &alert{
+			key:      alertKeyGeneric,
+			summary:  err.Error(),
+			severity: severityError,
+		}
+	}
+}
+
+// triggerAlert sends the given alert to all configured alerting backends.
+func (a *Aperture) triggerAlert(al *alert) {
+	if al == nil {
+		return
+	}
+
+	log.Warnf("Triggering %s alert %s: %s", al.severity, al.key,
+		al.summary)
+
+	for _, alerter := range a.alerters {
+		alerter.Trigger(al)
+	}
+}
+
+// resolveAlert signals all configured alerting backends that the condition
+// identified by the given key has cleared.
+func (a *Aperture) resolveAlert(key string) {
+	for _, alerter := range a.alerters {
+		alerter.Resolve(key)
+	}
+}
+
+// interceptErrors returns a channel that can be handed to all components that
+// report fatal errors. Every error sent to that channel is turned into an alert
+// before being forwarded to the given main error channel. If no alerters are
+// configured, the main error channel is returned as is.
+func (a *Aperture) interceptErrors(errChan chan error) chan error {
+	if len(a.alerters) == 0 {
+		return errChan
+	}
+
+	interceptChan := make(chan error)
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		for {
+			select {
+			case err := <-interceptChan:
+				a.triggerAlert(alertFromError(err))
+
+				select {
+				case errChan <- err:
+				case <-a.quit:
+					return
+				}
+
+			case <-a.quit:
+				return
+			}
+		}
+	}()
+
+	return interceptChan
+}
@@ -3,14 +3,17 @@ package aperture
 import (
 	"context"
 	"crypto/tls"
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,18 +21,21 @@ import (
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	gateway "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	flags "github.com/jessevdk/go-flags"
+	"github.com/jrick/logrotate/rotator"
+	"github.com/lightninglabs/aperture/aperturerpc"
 	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightninglabs/aperture/store/sqlite"
 	"github.com/lightninglabs/lightning-node-connect/hashmailrpc"
 	"github.com/lightningnetwork/lnd"
 	"github.com/lightningnetwork/lnd/build"
-	"github.com/lightningnetwork/lnd/cert"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/signal"
 	"github.com/lightningnetwork/lnd/tor"
+	"github.com/pires/go-proxyproto"
+	"github.com/redis/go-redis/v9"
 	clientv3 "go.etcd.io/etcd/client/v3"
-	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
@@ -51,6 +57,15 @@ const (
 	// represent a path-like structure.
 	etcdKeyDelimeter = "/"
 
+	// defaultMemberRefreshInterval is the default interval at which we
+	// query the etcd cluster for its members to update the endpoints of
+	// our client.
+	defaultMemberRefreshInterval = 5 * time.Minute
+
+	// etcdRPCTimeout is the maximum time we wait for a single call to the
+	// etcd cluster to complete.
+	etcdRPCTimeout = 10 * time.Second
+
 	// selfSignedCertOrganization is the static string that we encode in the
 	// organization field of a certificate if we create it ourselves.
 	selfSignedCertOrganization = "aperture autogenerated cert"
@@ -68,6 +83,14 @@ const (
 	// be refreshed on a routine server restart.
 	selfSignedCertExpiryMargin = selfSignedCertValidity / 2
 
+	// defaultCertReloadInterval is the default interval at which the TLS
+	// certificate is checked for changes.
+	defaultCertReloadInterval = time.Hour
+
+	// proxyProtocolHeaderTimeout is the maximum time we wait for the
+	// PROXY protocol header after a connection was accepted.
+	proxyProtocolHeaderTimeout = 5 * time.Second
+
 	// hashMailGRPCPrefix is the prefix a gRPC request URI has when it is
 	// meant for the hashmailrpc server to be handled.
 	hashMailGRPCPrefix = "/hashmailrpc.HashMail/"
@@ -138,6 +161,12 @@ func run() error {
 		return fmt.Errorf("unable to set up logging: %v", err)
 	}
 
+	// In a dry run we only check whether we could start, without opening
+	// any listeners.
+	if cfg.DryRun {
+		return dryRun(cfg, os.Stdout)
+	}
+
 	errChan := make(chan error)
 	a := NewAperture(cfg)
 	if err := a.Start(errChan); err != nil {
@@ -160,12 +189,37 @@ func run() error {
 type Aperture struct {
 	cfg *Config
 
-	etcdClient    *clientv3.Client
-	challenger    *LndChallenger
-	httpsServer   *http.Server
-	torHTTPServer *http.Server
-	proxy         *proxy.Proxy
-	proxyCleanup  func()
+	etcdClient     *clientv3.Client
+	redisClient    *redis.Client
+	sqliteDB       *sql.DB
+	challenger     *LndChallenger
+	mockChallenger *MockChallenger
+	lndMonitor     *lndMonitor
+	canaries       *canaryController
+	services       *remoteServices
+	etcdServices   *etcdServices
+	httpsServer    *http.Server
+	http3Server    *http3Server
+	torHTTPServer  *http.Server
+	adminServer    *adminServer
+	proxy          *proxy.Proxy
+	proxyCleanup   func(context.Context)
+
+	// limiter provides the restrictions of the LSATs of the services the
+	// proxy currently uses.
+	limiter *serviceLimiter
+
+	// readiness answers readiness probes and is marked as ready once all
+	// our dependencies are reachable.
+	readiness *readinessGate
+
+	// alerters is the list of backends that are notified about critical
+	// operational events.
+	alerters []alerter
+
+	// tokenWebhook posts the events in the life of an LSAT to the
+	// configured webhook. It is nil if no webhook is configured.
+	tokenWebhook *tokenWebhook
 
 	wg   sync.WaitGroup
 	quit chan struct{}
@@ -174,11 +228,20 @@ type Aperture struct {
 // NewAperture creates a new instance of the Aperture service.
 func NewAperture(cfg *Config) *Aperture {
 	return &Aperture{
-		cfg:  cfg,
-		quit: make(chan struct{}),
+		cfg:       cfg,
+		readiness: newReadinessGate(),
+		quit:      make(chan struct{}),
 	}
 }
 
+// Ready returns a channel that is closed once aperture verified that etcd, the
+// secret store and, if enabled, lnd are reachable and it is ready to serve
+// requests. Fatal errors are still reported on the error channel passed to
+// Start.
+func (a *Aperture) Ready() <-chan struct{} {
+	return a.readiness.ready
+}
+
 // Start sets up the proxy server and starts it.
 func (a *Aperture) Start(errChan chan error) error {
 	// Start the prometheus exporter.
@@ -209,47 +272,331 @@ func (a *Aperture) Start(errChan chan error) error {
 		}()
 	}
 
-	// Initialize our etcd client.
+	// Set up the backends that alert operators about critical errors. All
+	// errors reported by our components are routed through them before
+	// being passed on to the caller.
+	if a.cfg.PagerDuty != nil && a.cfg.PagerDuty.IntegrationKey != "" {
+		a.alerters = append(
+			a.alerters, newPagerDutyAlerter(a.cfg.PagerDuty),
+		)
+	}
+	if a.cfg.WebhookURL != "" {
+		a.alerters = append(
+			a.alerters, newWebhookAlerter(a.cfg.WebhookURL),
+		)
+	}
+	for _, alerter := range a.alerters {
+		if err := alerter.Start(); err != nil {
+			return fmt.Errorf("unable to start alerter: %v", err)
+		}
+	}
+	errChan = a.interceptErrors(errChan)
+
+	// The services need to be known before any of the components that
+	// depend on them are created, so we load them from the remote URL
+	// first if it is configured.
+	if a.cfg.ServicesURL != "" {
+		a.services = newRemoteServices(a.cfg)
+		a.cfg.Services, err = a.services.load()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Initialize our etcd client. The client keeps its endpoints in sync
+	// with the members of the etcd cluster, so it survives members being
+	// replaced.
+	memberRefreshInterval := a.cfg.Etcd.MemberRefreshInterval
+	if memberRefreshInterval == 0 {
+		memberRefreshInterval = defaultMemberRefreshInterval
+	}
 	a.etcdClient, err = clientv3.New(clientv3.Config{
-		Endpoints:   []string{a.cfg.Etcd.Host},
-		DialTimeout: 5 * time.Second,
-		Username:    a.cfg.Etcd.User,
-		Password:    a.cfg.Etcd.Password,
+		Endpoints:        []string{a.cfg.Etcd.Host},
+		AutoSyncInterval: memberRefreshInterval,
+		DialTimeout:      5 * time.Second,
+		Username:         a.cfg.Etcd.User,
+		Password:         a.cfg.Etcd.Password,
 	})
 	if err != nil {
 		return fmt.Errorf("unable to connect to etcd: %v", err)
 	}
 
+	// The LSAT secrets and onion service keys are stored in Redis instead
+	// of etcd if it is configured.
+	if a.cfg.Redis.enabled() {
+		a.redisClient, err = newRedisClient(a.cfg.Redis)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Or in a SQLite database if its path is set, so no additional server
+	// is needed to store them.
+	if a.cfg.SQLitePath != "" {
+		a.sqliteDB, err = sqlite.Open(a.cfg.SQLitePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// If any service wants routing fees to be added to its price, we need
+	// to be able to query lnd for routes. Without the read-only macaroon
+	// only the configured percentage is added.
+	var estimator *feeEstimator
+	if a.cfg.Authenticator.lndEnabled() && hasDynamicFeePricing(a.cfg) {
+		estimator, err = newFeeEstimator(a.cfg.Authenticator)
+		if err != nil {
+			log.Warnf("Unable to create fee estimator, routing "+
+				"fees won't be estimated: %v", err)
+		}
+	}
+
 	// Create our challenger that uses our backing lnd node to create
 	// invoices and check their settlement status.
-	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
-		return &lnrpc.Invoice{
-			Memo:  "LSAT",
-			Value: price,
+	asset, err := a.cfg.Authenticator.asset()
+	if err != nil {
+		return err
+	}
+	genInvoiceReq := func(ctx context.Context,
+		price int64) (*InvoiceRequest, error) {
+
+		// Asset invoices are priced in units of the asset, tapd
+		// determines their value in satoshis.
+		if asset != nil {
+			return &InvoiceRequest{
+				Invoice:     &lnrpc.Invoice{Memo: "LSAT"},
+				AssetID:     asset.ID[:],
+				AssetAmount: asset.Amount,
+			}, nil
+		}
+
+		return &InvoiceRequest{
+			Invoice: &lnrpc.Invoice{
+				Memo:  "LSAT",
+				Value: price + feeBuffer(ctx, estimator, price),
+			},
 		}, nil
 	}
 
-	if !a.cfg.Authenticator.Disable {
+	// Integration tests and CI pipelines without an lnd node can use mock
+	// invoices instead, which are never actually paid.
+	if !a.cfg.Authenticator.Disable && a.cfg.Authenticator.Mock {
+		log.Warnf("Issuing mock invoices, LSATs are granted without " +
+			"any payment!")
+		a.mockChallenger = NewMockChallenger(
+			a.cfg.Authenticator.MockFailSettlements,
+		)
+	}
+
+	if a.cfg.Authenticator.lndEnabled() {
+		// The primary node is always tried first, the backup nodes
+		// are only used if it becomes unavailable.
+		lndCfgs := append(
+			[]*AuthConfig{a.cfg.Authenticator},
+			a.cfg.BackupAuthenticators...,
+		)
+		opts := []ChallengerOption{
+			RecordSettlements(newSettlementStore(a.etcdClient)),
+		}
+		if a.cfg.Authenticator.PreimageLock {
+			opts = append(opts, PreimageLock(
+				newPreimageStore(a.etcdClient),
+			))
+		}
+		if a.cfg.Webhook.enabled() {
+			a.tokenWebhook = newTokenWebhook(a.cfg.Webhook)
+			opts = append(opts, NotifySettlements(a.tokenWebhook))
+		}
+		// Proof-of-work challenges are only issued while no lnd node
+		// is available, which must not shut us down.
+		if a.cfg.Authenticator.FallbackToPoW {
+			opts = append(opts, ReconnectOnOutage())
+		}
+		if asset != nil {
+			tapd, err := newTapdClient(a.cfg.Authenticator)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, AssetInvoices(tapd))
+		}
 		a.challenger, err = NewLndChallenger(
-			a.cfg.Authenticator, genInvoiceReq, errChan,
+			lndCfgs, genInvoiceReq, errChan, opts...,
 		)
 		if err != nil {
 			return err
 		}
+
+		// Alert the operator about every single lnd node we lose the
+		// connection to, even if we can fail over to another one.
+		a.challenger.OnDisconnect = func(err error) {
+			var host string
+			if connErr, ok := err.(*lndConnectionError); ok {
+				host = connErr.host
+			}
+			a.triggerAlert(&alert{
+				key:      alertKeyLndNodePrefix + host,
+				summary:  err.Error(),
+				severity: severityCritical,
+			})
+		}
+		a.challenger.OnReconnect = func(host string) {
+			a.resolveAlert(alertKeyLndNodePrefix + host)
+		}
+
 		err = a.challenger.Start()
 		if err != nil {
 			return err
 		}
+
+		// We're connected to lnd, so any previous alert about losing
+		// the connection can be resolved.
+		a.resolveAlert(alertKeyLndConnection)
+
+		// Invoices settled while we couldn't record them, for example
+		// because of an unclean shutdown, are reconciled in the
+		// background.
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+
+			a.reconcileSettlements()
+		}()
+
+		// Keep an eye on the node's channels if the operator wants
+		// to be warned about running low on capacity or watchtower
+		// sessions or wants to export the node's metrics.
+		var metricsInterval time.Duration
+		if a.cfg.Prometheus != nil && a.cfg.Prometheus.Enabled {
+			metricsInterval = a.cfg.Prometheus.LNDMetricsInterval
+		}
+		if a.cfg.Authenticator.MinOutboundCapacitySat > 0 ||
+			a.cfg.Authenticator.MinWatchtowerSessions > 0 ||
+			metricsInterval > 0 {
+
+			a.lndMonitor, err = newLndMonitor(
+				a.cfg.Authenticator, metricsInterval,
+				a.triggerAlert, a.resolveAlert,
+			)
+			if err != nil {
+				return err
+			}
+			if err := a.lndMonitor.Start(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// If any service issues LSATs that only become valid at a certain
+	// block height, we need to know the current height to verify them.
+	var blockHeights auth.BlockHeightSource
+	if a.cfg.Authenticator.lndEnabled() && hasValidAfterBlock(a.cfg) {
+		blockHeights, err = newBlockHeightCache(a.cfg.Authenticator)
+		if err != nil {
+			return fmt.Errorf("unable to create block height "+
+				"cache: %v", err)
+		}
+	}
+
+	// A Unix socket can only be reached locally, usually by a reverse proxy
+	// that terminates TLS in front of us, so we don't serve TLS on it. This
+	// needs to be known before the proxy is created, as the hashmail REST
+	// proxy connects to our own listen address.
+	socketPath, isUnixSocket := unixSocketPath(a.cfg.ListenAddr)
+	if isUnixSocket && !a.cfg.Insecure {
+		log.Warnf("Listening on Unix socket %s, disabling TLS for "+
+			"incoming connections", socketPath)
+		a.cfg.Insecure = true
 	}
 
-	// Create the proxy and connect it to lnd.
+	// Create the proxy and connect it to lnd, or the mock challenger.
+	var challenger proxyChallenger
+	switch {
+	case a.mockChallenger != nil:
+		challenger = a.mockChallenger
+
+	case a.challenger != nil:
+		challenger = a.challenger
+	}
+
+	// Clients that know the pre-image of an invoice must have paid it, so
+	// the operator can choose to accept it as the proof of payment.
+	if challenger != nil && a.cfg.Authenticator.PaymentVerification ==
+		PaymentVerificationPreimage {
+
+		challenger = NewPreimageChallenger(challenger)
+	}
+	a.limiter, err = newServiceLimiter(a.cfg.Services)
+	if err != nil {
+		return err
+	}
 	a.proxy, a.proxyCleanup, err = createProxy(
-		a.cfg, a.challenger, a.etcdClient,
+		a.cfg, challenger, a.limiter, a.etcdClient, a.secretStore(),
+		blockHeights, a.tokenWebhook,
 	)
 	if err != nil {
 		return err
 	}
-	handler := http.HandlerFunc(a.proxy.ServeHTTP)
+
+	// The request budgets of LSATs are kept in etcd until the LSATs
+	// expire.
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		a.removeExpiredBudgets()
+	}()
+
+	// Verified LSATs that are cached must be evicted once they are
+	// revoked, which can happen through the admin API of any instance.
+	if a.cfg.Authenticator.TokenCacheSize > 0 {
+		tokens := newTokenStore(a.etcdClient)
+
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+
+			tokens.watchRemovedTokens(
+				a.quit, a.proxy.InvalidateToken,
+				a.proxy.InvalidateTokens,
+			)
+		}()
+	}
+
+	// Keep evaluating the canary backends of the services so they can be
+	// promoted or removed automatically.
+	a.canaries = newCanaryController(
+		a.proxy, a.UpdateServices, a.triggerAlert,
+	)
+	a.canaries.Start()
+
+	// Keep the services in sync with the remote URL they were loaded
+	// from.
+	if a.services != nil {
+		if err := a.services.Start(a.UpdateServices); err != nil {
+			return fmt.Errorf("unable to start services refresh: "+
+				"%v", err)
+		}
+	}
+
+	// Alternatively, an external controller can manage the services by
+	// writing their definitions to etcd, if the operator opted in to it.
+	if a.cfg.Etcd.WatchServices {
+		a.etcdServices = newEtcdServices(a.etcdClient)
+		a.etcdServices.Start(a.UpdateServices)
+	}
+
+	var handler http.Handler = http.HandlerFunc(a.proxy.ServeHTTP)
+	if a.cfg.MaxConcurrentRequests > 0 {
+		queue := newRequestQueue(
+			a.cfg.MaxConcurrentRequests, a.cfg.MaxPendingRequests,
+			a.cfg.MaxQueueWait,
+		)
+		handler = queue.wrap(handler)
+	}
+
+	// Readiness and liveness probes are answered before any request is
+	// queued so they always get a quick response.
+	handler = a.readiness.wrap(handler)
 	a.httpsServer = &http.Server{
 		Addr:         a.cfg.ListenAddr,
 		Handler:      handler,
@@ -260,28 +607,92 @@ func (a *Aperture) Start(errChan chan error) error {
 
 	// Create TLS configuration by either creating new self-signed certs or
 	// trying to obtain one through Let's Encrypt.
-	var serveFn func() error
 	if a.cfg.Insecure {
 		// Normally, HTTP/2 only works with TLS. But there is a special
 		// version called HTTP/2 Cleartext (h2c) that some clients
 		// support and that gRPC uses when the grpc.WithInsecure()
 		// option is used. The default HTTP handler doesn't support it
 		// though so we need to add a special h2c handler here.
-		serveFn = a.httpsServer.ListenAndServe
 		a.httpsServer.Handler = h2c.NewHandler(handler, &http2.Server{})
 	} else {
-		a.httpsServer.TLSConfig, err = getTLSConfig(
-			a.cfg.ServerName, a.cfg.BaseDir, a.cfg.AutoCert,
+		certManager, err := NewCertManager(
+			a.cfg.ServerName, a.cfg.BaseDir, a.cfg.CertDir,
+			a.cfg.AutoCert,
+		)
+		if err != nil {
+			return err
+		}
+		a.httpsServer.TLSConfig, err = certManager.TLSConfig(
+			a.cfg.TLS.listener(),
+		)
+		if err != nil {
+			return err
+		}
+
+		reloadInterval := a.cfg.CertReloadInterval
+		if reloadInterval == 0 {
+			reloadInterval = defaultCertReloadInterval
+		}
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+
+			certManager.WatchDefaultCert(reloadInterval, a.quit)
+		}()
+
+		// As we do the TLS handshakes ourselves, HTTP/2 needs to be
+		// offered explicitly.
+		a.httpsServer.TLSConfig.NextProtos = []string{
+			"h2", "http/1.1",
+		}
+
+		// HTTP/3 is served with the same certificates on the UDP port
+		// of our listen address, which we tell the clients of the TLS
+		// listener about.
+		if a.cfg.HTTP3 {
+			a.http3Server, err = newHTTP3Server(
+				a.cfg.ListenAddr, a.httpsServer.TLSConfig,
+				handler,
+			)
+			if err != nil {
+				return err
+			}
+			a.httpsServer.Handler = a.http3Server.advertise(handler)
+		}
+	}
+
+	// We create the listener ourselves instead of letting the server do
+	// it, so we can listen on a Unix socket or choose between dual-stack
+	// and IPv6 only TCP listeners.
+	serveFn := func() error {
+		var (
+			listener net.Listener
+			err      error
 		)
+		if isUnixSocket {
+			listener, err = listenUnixSocket(socketPath)
+		} else {
+			listener, err = listenTCP(a.cfg.ListenAddr)
+		}
 		if err != nil {
 			return err
 		}
-		serveFn = func() error {
-			// The httpsServer.TLSConfig contains certificates at
-			// this point so we don't need to pass in certificate
-			// and key file names.
-			return a.httpsServer.ListenAndServeTLS("", "")
+
+		// The PROXY protocol header is sent before the TLS handshake,
+		// so it's parsed first.
+		if a.cfg.ProxyProtocol {
+			listener = newProxyProtocolListener(listener)
 		}
+
+		if a.cfg.Insecure {
+			return a.httpsServer.Serve(listener)
+		}
+
+		// The TLS handshakes are done by the listener so we can
+		// record metrics about them.
+		return a.httpsServer.Serve(newTLSMetricsListener(
+			listener, a.httpsServer.TLSConfig,
+		))
 	}
 
 	// Finally run the server.
@@ -297,6 +708,86 @@ func (a *Aperture) Start(errChan chan error) error {
 		}
 	}()
 
+	if a.http3Server != nil {
+		log.Infof("Serving HTTP/3, listening on %s/udp.",
+			a.cfg.ListenAddr)
+
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+
+			select {
+			case errChan <- a.http3Server.serve():
+			case <-a.quit:
+			}
+		}()
+	}
+
+	// Only report that we're ready once we know all our dependencies are
+	// reachable. Until then, and whenever one of them becomes unavailable
+	// later on, readiness probes are answered with 503. Losing one of them
+	// later on also triggers an alert.
+	checks := []readinessCheck{
+		etcdReadinessCheck(a.etcdClient),
+	}
+	switch {
+	case a.sqliteDB != nil:
+		checks = append(checks, sqliteReadinessCheck(a.sqliteDB))
+
+	case a.redisClient != nil:
+		checks = append(checks, redisReadinessCheck(a.redisClient))
+
+	default:
+		checks = append(
+			checks, secretStoreReadinessCheck(a.etcdClient),
+		)
+	}
+	if a.challenger != nil {
+		checks = append(checks, lndReadinessCheck(append(
+			[]*AuthConfig{a.cfg.Authenticator},
+			a.cfg.BackupAuthenticators...,
+		)))
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		if !a.readiness.wait(checks, a.quit) {
+			return
+		}
+		log.Infof("Ready to serve requests.")
+
+		a.readiness.monitor(
+			checks, a.triggerAlert, a.resolveAlert, a.quit,
+		)
+	}()
+
+	// Start the admin API on its own listener if enabled. It uses the
+	// same certificate as the proxy.
+	if a.cfg.Admin != nil && a.cfg.Admin.ListenAddr != "" {
+		adminTLSConfig, err := newAdminTLSConfig(
+			a.cfg.Admin, a.cfg.TLS.admin(),
+			a.httpsServer.TLSConfig,
+		)
+		if err != nil {
+			return err
+		}
+		a.adminServer = newAdminServer(a.cfg.Admin, a, adminTLSConfig)
+
+		log.Infof("Starting the admin API, listening on %s.",
+			a.cfg.Admin.ListenAddr)
+
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+
+			select {
+			case errChan <- a.adminServer.serve():
+			case <-a.quit:
+			}
+		}()
+	}
+
 	// If we need to listen over Tor as well, we'll set up the onion
 	// services now. We're not able to use TLS for onion services since they
 	// can't be verified, so we'll spin up an additional HTTP/2 server
@@ -305,7 +796,7 @@ func (a *Aperture) Start(errChan chan error) error {
 	// provide encryption, so running this additional HTTP server should be
 	// relatively safe.
 	if a.cfg.Tor.V2 || a.cfg.Tor.V3 {
-		torController, err := initTorListener(a.cfg, a.etcdClient)
+		torController, err := initTorListener(a.cfg, a.onionStore())
 		if err != nil {
 			return err
 		}
@@ -314,15 +805,26 @@ func (a *Aperture) Start(errChan chan error) error {
 		}()
 
 		a.torHTTPServer = &http.Server{
-			Addr:    fmt.Sprintf("localhost:%d", a.cfg.Tor.ListenPort),
-			Handler: h2c.NewHandler(handler, &http2.Server{}),
+			Addr: torListenAddr(a.cfg.Tor),
+			Handler: h2c.NewHandler(
+				proxy.OnionHandler(handler), &http2.Server{},
+			),
+		}
+		serveTorFn := func() error {
+			listener, err := listenTCP(a.torHTTPServer.Addr)
+			if err != nil {
+				return err
+			}
+
+			return a.torHTTPServer.Serve(listener)
 		}
+
 		a.wg.Add(1)
 		go func() {
 			defer a.wg.Done()
 
 			select {
-			case errChan <- a.torHTTPServer.ListenAndServe():
+			case errChan <- serveTorFn():
 			case <-a.quit:
 			}
 		}()
@@ -333,39 +835,167 @@ func (a *Aperture) Start(errChan chan error) error {
 
 // UpdateServices instructs the proxy to re-initialize its internal
 // configuration of backend services. This can be used to add or remove backends
-// at run time or enable/disable authentication on the fly.
+// at run time or enable/disable authentication on the fly. The restrictions of
+// the LSATs of the services, like their required caveats, expiry and budget,
+// apply to the LSATs minted and verified from then on.
 func (a *Aperture) UpdateServices(services []*proxy.Service) error {
-	return a.proxy.UpdateServices(services)
+	// The restrictions of the LSATs of the services are created first, so
+	// neither the proxy nor the limiter are updated if they are invalid.
+	restrictions, err := newServiceRestrictions(services)
+	if err != nil {
+		return err
+	}
+
+	if err := a.proxy.UpdateServices(services); err != nil {
+		return err
+	}
+	a.limiter.setRestrictions(restrictions)
+
+	return nil
 }
 
-// Stop gracefully shuts down the Aperture service.
+// Stop gracefully shuts down the Aperture service. Requests that are in flight
+// are given up to the configured shutdown timeout to complete before their
+// connections are closed forcefully.
 func (a *Aperture) Stop() error {
 	var returnErr error
 
+	shutdownTimeout := a.cfg.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(
+		context.Background(), shutdownTimeout,
+	)
+	defer cancel()
+
+	// Clients waiting for an invoice to settle would hold up the drain
+	// below until the timeout expires, so they are told first that they
+	// won't be notified anymore.
 	if a.challenger != nil {
-		a.challenger.Stop()
+		a.challenger.closeSubscribers()
 	}
 
-	// Stop everything that was started alongside the proxy, for example the
-	// gRPC and REST servers.
+	// Stop accepting new requests and wait for the ones in flight first,
+	// as they still need everything else to complete. The gRPC servers are
+	// served through the HTTP servers but need to be drained on their own,
+	// so all of them are shut down at the same time. This should cause
+	// the server goroutines to quit.
+	var (
+		drainWg  sync.WaitGroup
+		errMu    sync.Mutex
+		shutdown = func(server *http.Server, returnsErr bool) {
+			defer drainWg.Done()
+
+			err := shutdownServer(ctx, server)
+			if err == nil {
+				return
+			}
+			if !returnsErr {
+				log.Errorf("Error closing server: %v", err)
+				return
+			}
+
+			errMu.Lock()
+			returnErr = err
+			errMu.Unlock()
+		}
+	)
 	if a.proxyCleanup != nil {
-		a.proxyCleanup()
-	}
+		drainWg.Add(1)
+		go func() {
+			defer drainWg.Done()
 
-	// Shut down our client and server connections now. This should cause
-	// the first goroutine to quit.
-	cleanup(a.etcdClient, a.httpsServer, a.proxy)
+			a.proxyCleanup(ctx)
+		}()
+	}
+	if a.httpsServer != nil {
+		drainWg.Add(1)
+		go shutdown(a.httpsServer, false)
+	}
+	if a.http3Server != nil {
+		drainWg.Add(1)
+		go func() {
+			defer drainWg.Done()
 
-	// If we started a tor server as well, shut it down now too to cause the
-	// second goroutine to quit.
+			err := a.http3Server.shutdown(ctx)
+			if err != nil {
+				log.Errorf("Error closing HTTP/3 server: %v",
+					err)
+			}
+		}()
+	}
 	if a.torHTTPServer != nil {
-		returnErr = a.torHTTPServer.Close()
+		drainWg.Add(1)
+		go shutdown(a.torHTTPServer, true)
+	}
+	if a.adminServer != nil {
+		drainWg.Add(1)
+		go shutdown(a.adminServer.server, true)
+	}
+	drainWg.Wait()
+
+	if a.canaries != nil {
+		a.canaries.Stop()
+	}
+
+	if a.services != nil {
+		a.services.Stop()
+	}
+
+	if a.etcdServices != nil {
+		a.etcdServices.Stop()
+	}
+
+	if a.lndMonitor != nil {
+		a.lndMonitor.Stop()
+	}
+
+	if a.challenger != nil {
+		a.challenger.Stop()
+	}
+
+	if a.redisClient != nil {
+		if err := a.redisClient.Close(); err != nil {
+			log.Errorf("Error terminating redis client: %v", err)
+		}
+	}
+
+	if a.sqliteDB != nil {
+		if err := a.sqliteDB.Close(); err != nil {
+			log.Errorf("Error closing sqlite database: %v", err)
+		}
 	}
 
-	// Now we wait for the goroutines to exit before we return. The defers
-	// will take care of the rest of our started resources.
+	// Shut down our client connections now.
+	cleanup(a.etcdClient, a.proxy)
+
+	// Now we wait for the goroutines to exit before we return, but not for
+	// longer than we waited for the requests. The defers will take care
+	// of the rest of our started resources.
 	close(a.quit)
-	a.wg.Wait()
+	exited := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-ctx.Done():
+		log.Warnf("Timed out waiting for aperture to shut down")
+	}
+
+	// Pending token events are delivered once nothing can issue or
+	// settle LSATs anymore.
+	if a.tokenWebhook != nil {
+		a.tokenWebhook.Stop()
+	}
+
+	// Only stop the alerters after all other goroutines have exited so
+	// any last alerts can still be delivered.
+	for _, alerter := range a.alerters {
+		alerter.Stop()
+	}
 
 	return returnErr
 }
@@ -416,8 +1046,21 @@ func getConfig() (*Config, error) {
 	// default location.
 	b, err := ioutil.ReadFile(configFile)
 	switch {
-	// If the file was found, unmarshal it.
+	// If the file was found, unmarshal it. Files of older schema versions
+	// are migrated first.
 	case err == nil:
+		var upgraded bool
+		b, upgraded, err = upgradeConfigFile(b)
+		if err != nil {
+			return nil, err
+		}
+		if upgraded {
+			_, _ = fmt.Fprintf(os.Stderr, "Config file %s was "+
+				"written for an older schema and is migrated "+
+				"on every start, upgrade it with "+
+				"aperture-migrate-config\n", configFile)
+		}
+
 		err = yaml.Unmarshal(b, cfg)
 		if err != nil {
 			return nil, err
@@ -443,16 +1086,34 @@ func getConfig() (*Config, error) {
 
 	// Clean and expand our base dir, cert and macaroon paths.
 	cfg.BaseDir = lnd.CleanAndExpandPath(cfg.BaseDir)
+	cfg.CertDir = lnd.CleanAndExpandPath(cfg.CertDir)
 	cfg.Authenticator.TLSPath = lnd.CleanAndExpandPath(
 		cfg.Authenticator.TLSPath,
 	)
 	cfg.Authenticator.MacDir = lnd.CleanAndExpandPath(
 		cfg.Authenticator.MacDir,
 	)
+	if cfg.RequestSampling != nil {
+		cfg.RequestSampling.LogFile = lnd.CleanAndExpandPath(
+			cfg.RequestSampling.LogFile,
+		)
+	}
+	cfg.SQLitePath = lnd.CleanAndExpandPath(cfg.SQLitePath)
+	cfg.AuditLogFile = lnd.CleanAndExpandPath(cfg.AuditLogFile)
+	for _, backup := range cfg.BackupAuthenticators {
+		backup.TLSPath = lnd.CleanAndExpandPath(backup.TLSPath)
+		backup.MacDir = lnd.CleanAndExpandPath(backup.MacDir)
+	}
 
 	// Then check the configuration that we got from the config file, all
-	// required values need to be set at this point.
+	// required values need to be set at this point. If a service setting
+	// is invalid, we point the operator to where it is in the file.
 	if err := cfg.validate(); err != nil {
+		var validationErr *proxy.ValidationError
+		if errors.As(err, &validationErr) && b != nil {
+			locateServiceField(b, validationErr)
+		}
+
 		return nil, err
 	}
 
@@ -465,161 +1126,60 @@ func setupLogging(cfg *Config, interceptor signal.Interceptor) error {
 		cfg.DebugLevel = defaultLogLevel
 	}
 
-	// Now initialize the logger and set the log level.
-	SetupLoggers(logWriter, interceptor)
-
 	// Use our default data dir unless a base dir is set.
 	logFile := filepath.Join(apertureDataDir, defaultLogFilename)
 	if cfg.BaseDir != "" {
 		logFile = filepath.Join(cfg.BaseDir, defaultLogFilename)
 	}
 
-	err := logWriter.InitLogRotator(
-		logFile, defaultMaxLogFileSize, defaultMaxLogFiles,
-	)
-	if err != nil {
-		return err
-	}
-	return build.ParseAndSetDebugLevels(cfg.DebugLevel, logWriter)
-}
-
-// getTLSConfig returns a TLS configuration for either a self-signed certificate
-// or one obtained through Let's Encrypt.
-func getTLSConfig(serverName, baseDir string, autoCert bool) (
-	*tls.Config, error) {
-
-	// Use our default data dir unless a base dir is set.
-	apertureDir := apertureDataDir
-	if baseDir != "" {
-		apertureDir = baseDir
-	}
-
-	// If requested, use the autocert library that will create a new
-	// certificate through Let's Encrypt as soon as the first client HTTP
-	// request on the server using the TLS config comes in. Unfortunately
-	// you cannot tell the library to create a certificate on startup for a
-	// specific host.
-	if autoCert {
-		serverName := serverName
-		if serverName == "" {
-			return nil, fmt.Errorf("servername option is " +
-				"required for secure operation")
-		}
-
-		certDir := filepath.Join(apertureDir, "autocert")
-		log.Infof("Configuring autocert for server %v with cache dir "+
-			"%v", serverName, certDir)
-
-		manager := autocert.Manager{
-			Cache:      autocert.DirCache(certDir),
-			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(serverName),
-		}
-
-		go func() {
-			err := http.ListenAndServe(
-				":http", manager.HTTPHandler(nil),
-			)
-			if err != nil {
-				log.Errorf("autocert http: %v", err)
-			}
-		}()
-		return &tls.Config{
-			GetCertificate: manager.GetCertificate,
-			CipherSuites:   http2TLSCipherSuites,
-			MinVersion:     tls.VersionTLS10,
-		}, nil
-	}
+	// Now initialize the loggers of the configured format and set the log
+	// level.
+	var err error
+	switch cfg.LogFormat {
+	case logFormatJSON:
+		setupJSONLoggers(logWriter, interceptor)
+		err = jsonLogs.initLogRotator(
+			logFile, defaultMaxLogFileSize, defaultMaxLogFiles,
+		)
 
-	// If we're not using autocert, we want to create self-signed TLS certs
-	// and save them at the specified location (if they don't already
-	// exist).
-	tlsKeyFile := filepath.Join(apertureDir, defaultTLSKeyFilename)
-	tlsCertFile := filepath.Join(apertureDir, defaultTLSCertFilename)
-	tlsExtraDomains := []string{serverName}
-	if !fileExists(tlsCertFile) && !fileExists(tlsKeyFile) {
-		log.Infof("Generating TLS certificates...")
-		err := cert.GenCertPair(
-			selfSignedCertOrganization, tlsCertFile, tlsKeyFile,
-			nil, tlsExtraDomains, false, selfSignedCertValidity,
+	default:
+		SetupLoggers(logWriter, interceptor)
+		err = logWriter.InitLogRotator(
+			logFile, defaultMaxLogFileSize, defaultMaxLogFiles,
 		)
-		if err != nil {
-			return nil, err
-		}
-		log.Infof("Done generating TLS certificates")
 	}
-
-	// Load the certs now so we can inspect it and return a complete TLS
-	// config later.
-	certData, parsedCert, err := cert.LoadCert(tlsCertFile, tlsKeyFile)
 	if err != nil {
-		return nil, err
-	}
-
-	// The margin is negative, so adding it to the expiry date should give
-	// us a date in about the middle of it's validity period.
-	expiryWithMargin := parsedCert.NotAfter.Add(
-		-1 * selfSignedCertExpiryMargin,
-	)
-
-	// We only want to renew a certificate that we created ourselves. If
-	// we are using a certificate that was passed to us (perhaps created by
-	// an externally running Let's Encrypt process) we aren't going to try
-	// to replace it.
-	isSelfSigned := len(parsedCert.Subject.Organization) > 0 &&
-		parsedCert.Subject.Organization[0] == selfSignedCertOrganization
-
-	// If the certificate expired or it was outdated, delete it and the TLS
-	// key and generate a new pair.
-	if isSelfSigned && time.Now().After(expiryWithMargin) {
-		log.Info("TLS certificate will expire soon, generating a " +
-			"new one")
-
-		err := os.Remove(tlsCertFile)
-		if err != nil {
-			return nil, err
-		}
-
-		err = os.Remove(tlsKeyFile)
-		if err != nil {
-			return nil, err
-		}
-
-		log.Infof("Renewing TLS certificates...")
-		err = cert.GenCertPair(
-			selfSignedCertOrganization, tlsCertFile, tlsKeyFile,
-			nil, nil, false, selfSignedCertValidity,
-		)
-		if err != nil {
-			return nil, err
-		}
-		log.Infof("Done renewing TLS certificates")
-
-		// Reload the certificate data.
-		certData, _, err = cert.LoadCert(tlsCertFile, tlsKeyFile)
-		if err != nil {
-			return nil, err
-		}
+		return err
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{certData},
-		CipherSuites: http2TLSCipherSuites,
-		MinVersion:   tls.VersionTLS10,
-	}, nil
+	return build.ParseAndSetDebugLevels(cfg.DebugLevel, logWriter)
 }
 
 // initTorListener initiates a Tor controller instance with the Tor server
 // specified in the config. Onion services will be created over which the proxy
 // can be reached at.
-func initTorListener(cfg *Config, etcd *clientv3.Client) (*tor.Controller, error) {
+func initTorListener(cfg *Config, store tor.OnionStore) (*tor.Controller,
+	error) {
+
 	// Establish a controller connection with the backing Tor server and
 	// proceed to create the requested onion services.
 	onionCfg := tor.AddOnionConfig{
 		VirtualPort: int(cfg.Tor.VirtualPort),
 		TargetPorts: []int{int(cfg.Tor.ListenPort)},
-		Store:       newOnionStore(etcd),
+		Store:       store,
+	}
+	// Tor needs to forward connections to the address we listen on, which
+	// defaults to 127.0.0.1 if none is given. IPv6 addresses need to be
+	// enclosed in brackets.
+	var targetIPAddress string
+	if cfg.Tor.ListenHost != "" {
+		targetIPAddress = cfg.Tor.ListenHost
+		if strings.Contains(targetIPAddress, ":") {
+			targetIPAddress = "[" + targetIPAddress + "]"
+		}
 	}
-	torController := tor.NewController(cfg.Tor.Control, "", "")
+	torController := tor.NewController(
+		cfg.Tor.Control, targetIPAddress, "",
+	)
 	if err := torController.Start(); err != nil {
 		return nil, err
 	}
@@ -647,33 +1207,259 @@ func initTorListener(cfg *Config, etcd *clientv3.Client) (*tor.Controller, error
 	return torController, nil
 }
 
+// listenUnixSocket listens on the Unix domain socket at the given path. A
+// socket file left behind by a previous run that wasn't shut down cleanly is
+// removed first, any other file at the path is left untouched.
+func listenUnixSocket(path string) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode()&os.ModeSocket != 0:
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale Unix "+
+				"socket %s: %v", path, err)
+		}
+
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on Unix socket %s: %v",
+			path, err)
+	}
+
+	return listener, nil
+}
+
+// openSamplesFile opens the file the details of sampled requests are appended
+// to.
+func openSamplesFile(cfg *Config) (*os.File, error) {
+	path := cfg.RequestSampling.LogFile
+	if path == "" {
+		dir := apertureDataDir
+		if cfg.BaseDir != "" {
+			dir = cfg.BaseDir
+		}
+		path = filepath.Join(dir, defaultSamplesFilename)
+	}
+
+	file, err := os.OpenFile(
+		path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open sampled requests log: "+
+			"%v", err)
+	}
+
+	return file, nil
+}
+
+// openAuditLog opens the audit log file, which is rotated like the main log
+// file.
+func openAuditLog(path string) (*rotator.Rotator, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create audit log directory: "+
+			"%v", err)
+	}
+
+	auditLog, err := rotator.New(
+		path, int64(defaultMaxLogFileSize*1024), false,
+		defaultMaxLogFiles,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %v", err)
+	}
+
+	return auditLog, nil
+}
+
+// listenTCP listens on the given TCP address. An address with an empty or
+// unspecified IPv4 host is listened on through both IPv4 and IPv6 if the system
+// supports it, while an IPv6 host restricts the listener to IPv6 only.
+func listenTCP(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %s: %v", addr,
+			err)
+	}
+
+	network := "tcp"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		network = "tcp6"
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %v", addr, err)
+	}
+
+	return listener, nil
+}
+
+// newProxyProtocolListener wraps the given listener so the PROXY protocol
+// header load balancers send on every connection is parsed. The connections
+// report the address of the client it carries as their remote address, so the
+// requests have it as their RemoteAddr, and connections without the header are
+// rejected.
+func newProxyProtocolListener(listener net.Listener) net.Listener {
+	return &proxyproto.Listener{
+		Listener: listener,
+		Policy: func(net.Addr) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		},
+		ReadHeaderTimeout: proxyProtocolHeaderTimeout,
+	}
+}
+
+// torListenAddr returns the local address we listen on for client requests
+// that reach us through the onion services.
+func torListenAddr(cfg *TorConfig) string {
+	host := cfg.ListenHost
+	if host == "" {
+		host = "localhost"
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(cfg.ListenPort)))
+}
+
+// secretStore returns the store of LSAT secrets to use: SQLite or Redis if
+// either is configured, etcd otherwise.
+func (a *Aperture) secretStore() mint.SecretStore {
+	switch {
+	case a.sqliteDB != nil:
+		return sqlite.NewSQLiteSecretStore(a.sqliteDB)
+
+	case a.redisClient != nil:
+		return newRedisSecretStore(
+			a.redisClient, a.cfg.Redis.SecretExpiry,
+		)
+
+	default:
+		return newSecretStore(a.etcdClient)
+	}
+}
+
+// onionStore returns the store of onion service private keys to use: SQLite
+// or Redis if either is configured, etcd otherwise.
+func (a *Aperture) onionStore() tor.OnionStore {
+	switch {
+	case a.sqliteDB != nil:
+		return sqlite.NewSQLiteOnionStore(a.sqliteDB)
+
+	case a.redisClient != nil:
+		return newRedisOnionStore(a.redisClient)
+
+	default:
+		return newOnionStore(a.etcdClient)
+	}
+}
+
+// proxyChallenger is a challenger that issues the invoices of LSATs and
+// verifies their settlement for the proxy.
+type proxyChallenger interface {
+	mint.Challenger
+	auth.InvoiceChecker
+	InvoiceStateSubscriber
+
+	// Available returns true if new invoices can be created.
+	Available() bool
+}
+
 // createProxy creates the proxy with all the services it needs.
-func createProxy(cfg *Config, challenger *LndChallenger,
-	etcdClient *clientv3.Client) (*proxy.Proxy, func(), error) {
+func createProxy(cfg *Config, challenger proxyChallenger,
+	limiter *serviceLimiter, etcdClient *clientv3.Client,
+	secrets mint.SecretStore, blockHeights auth.BlockHeightSource,
+	tokenWebhook *tokenWebhook) (*proxy.Proxy, func(context.Context),
+	error) {
 
+	// Only invoices created by lnd can be paid with an asset.
+	var (
+		asset *mint.Asset
+		err   error
+	)
+	if cfg.Authenticator.lndEnabled() {
+		asset, err = cfg.Authenticator.asset()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	minter := mint.New(&mint.Config{
 		Challenger:     challenger,
-		Secrets:        newSecretStore(etcdClient),
-		ServiceLimiter: newStaticServiceLimiter(cfg.Services),
+		Secrets:        secrets,
+		ServiceLimiter: limiter,
+		Quotas:         newQuotaStore(etcdClient),
+		Budgets:        newBudgetStore(etcdClient),
+		Tokens:         newTokenStore(etcdClient),
+		Asset:          asset,
 	})
-	authenticator := auth.NewLsatAuthenticator(minter, challenger)
+	authenticator := auth.NewLsatAuthenticator(
+		minter, challenger, blockHeights,
+	)
+	if cfg.ReplayProtection.enabled() {
+		window := cfg.ReplayProtection.NonceWindow
+		if window == 0 {
+			window = defaultNonceWindow
+		}
+		authenticator.EnableReplayProtection(
+			newNonceStore(etcdClient), window,
+		)
+	}
+	if cfg.Authenticator.CookieName != "" {
+		authenticator.EnableCookieAuth(cfg.Authenticator.CookieName)
+	}
+	if tokenWebhook != nil {
+		authenticator.EnableTokenNotifier(tokenWebhook)
+	}
+	if cfg.Authenticator.TokenCacheSize > 0 {
+		ttl := cfg.Authenticator.TokenCacheTTL
+		if ttl == 0 {
+			ttl = auth.DefaultTokenCacheTTL
+		}
+		err := authenticator.EnableTokenCache(
+			cfg.Authenticator.TokenCacheSize, ttl,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if cfg.Authenticator.FallbackToPoW && challenger != nil {
+		err := authenticator.EnablePoWFallback(
+			challenger.Available, cfg.Authenticator.powDifficulty(),
+			newPoWStore(etcdClient),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
 	// By default the static file server only returns 404 answers for
-	// security reasons. Serving files from the staticRoot directory has to
+	// security reasons. Serving files from the static root directory has to
 	// be enabled intentionally.
+	// The files can also be served from an S3 bucket, which is more
+	// practical than a local directory in containerized deployments.
 	staticServer := http.NotFoundHandler()
-	if cfg.ServeStatic {
-		if len(strings.TrimSpace(cfg.StaticRoot)) == 0 {
-			return nil, nil, fmt.Errorf("staticroot cannot be " +
+	switch {
+	case cfg.Static == nil || !cfg.Static.Enabled:
+
+	case cfg.Static.S3Bucket != "":
+		staticServer, err = newS3StaticServer(cfg.Static)
+		if err != nil {
+			return nil, nil, err
+		}
+
+	default:
+		if len(strings.TrimSpace(cfg.Static.Root)) == 0 {
+			return nil, nil, fmt.Errorf("static.root cannot be " +
 				"empty, must contain path to directory that " +
 				"contains index.html")
 		}
-		staticServer = http.FileServer(http.Dir(cfg.StaticRoot))
+		staticServer = http.FileServer(http.Dir(cfg.Static.Root))
 	}
 
 	var (
 		localServices []proxy.LocalService
-		proxyCleanup  = func() {}
+		proxyCleanup  = func(context.Context) {}
 	)
 
 	if cfg.HashMail.Enabled {
@@ -686,6 +1472,54 @@ func createProxy(cfg *Config, challenger *LndChallenger,
 		proxyCleanup = cleanup
 	}
 
+	// Clients can only wait for invoices to settle if we create them.
+	// Browsers can do so through a WebSocket, all other clients through
+	// our own gRPC server.
+	if challenger != nil {
+		streamTimeout := cfg.PaymentStreamTimeout
+		if streamTimeout == 0 {
+			streamTimeout = defaultPaymentStreamTimeout
+		}
+
+		paymentStream := newPaymentStreamServer(
+			challenger, streamTimeout,
+		)
+		localServices = append(localServices, proxy.NewLocalService(
+			proxy.NewMultiProtocolMux(
+				nil, paymentStream, paymentStream,
+			),
+			paymentStream.isHandling,
+		))
+
+		apertureGRPC := grpc.NewServer()
+		aperturerpc.RegisterApertureServiceServer(
+			apertureGRPC, newRPCServer(challenger, streamTimeout),
+		)
+		apertureDrainer := newGRPCDrainer(apertureGRPC)
+		localServices = append(localServices, proxy.NewLocalService(
+			proxy.NewMultiProtocolMux(apertureDrainer, nil, nil),
+			func(r *http.Request) bool {
+				return strings.HasPrefix(
+					r.URL.Path, apertureGRPCPrefix,
+				)
+			},
+		))
+
+		hashMailCleanup := proxyCleanup
+		proxyCleanup = func(ctx context.Context) {
+			apertureDrainer.GracefulStop(ctx)
+			hashMailCleanup(ctx)
+		}
+	}
+
+	// The refresh endpoint is only served while LSATs of at least one of
+	// the current services can be refreshed, so it doesn't shadow the path
+	// of any backend otherwise.
+	refreshServer := newRefreshServer(minter, limiter.refreshable)
+	localServices = append(localServices, proxy.NewLocalService(
+		refreshServer, refreshServer.isHandling,
+	))
+
 	// The static file server must be last since it will match all calls
 	// that make it to it.
 	localServices = append(localServices, proxy.NewLocalService(
@@ -695,19 +1529,150 @@ func createProxy(cfg *Config, challenger *LndChallenger,
 	))
 
 	prxy, err := proxy.New(authenticator, cfg.Services, localServices...)
-	return prxy, proxyCleanup, err
+	if err != nil {
+		return nil, proxyCleanup, err
+	}
+
+	// Latency is only injected into responses in debug mode to make sure
+	// it is never enabled in production by accident.
+	if cfg.Debug {
+		log.Warnf("Debug mode enabled, never use this in production!")
+		prxy.EnableLatencyInjection()
+	}
+	for _, service := range cfg.Services {
+		if service.LatencyInjection != nil && !cfg.Debug {
+			log.Warnf("Ignoring latency injection of service %s, "+
+				"debug mode is disabled", service.Name)
+		}
+	}
+
+	// Requests are only processed asynchronously for services that
+	// support it.
+	for _, service := range cfg.Services {
+		if service.SupportPreferAsync {
+			prxy.EnableAsyncJobs(newAsyncJobStore(etcdClient))
+			break
+		}
+	}
+
+	// The rate limits of services that are scaled horizontally are shared
+	// by all instances through etcd.
+	for _, service := range cfg.Services {
+		if service.RateLimitDistributed {
+			prxy.EnableDistributedRateLimits(
+				newRateLimitStore(etcdClient),
+			)
+			break
+		}
+	}
+
+	if cfg.RequestSampling != nil && cfg.RequestSampling.Rate > 0 {
+		samplesFile, err := openSamplesFile(cfg)
+		if err != nil {
+			return nil, proxyCleanup, err
+		}
+		prxy.EnableRequestSampling(cfg.RequestSampling.Rate, samplesFile)
+
+		log.Infof("Logging the details of %.2f%% of the requests to %s",
+			cfg.RequestSampling.Rate*100, samplesFile.Name())
+
+		samplingCleanup := proxyCleanup
+		proxyCleanup = func(ctx context.Context) {
+			samplingCleanup(ctx)
+			_ = samplesFile.Close()
+		}
+	}
+
+	if cfg.PathPrefix != "" {
+		prxy.EnablePathPrefix(cfg.PathPrefix)
+	}
+
+	if cfg.Authenticator.CookieName != "" {
+		prxy.EnableAuthCookie(cfg.Authenticator.CookieName)
+	}
+
+	if cfg.JWT != nil && cfg.JWT.JWKSURL != "" {
+		prxy.EnableJWTAuth(auth.NewJWTAuthenticator(cfg.JWT))
+	}
+
+	backendTLSVersion, err := cfg.TLS.backend().minVersion(0)
+	if err != nil {
+		return nil, proxyCleanup, err
+	}
+	if backendTLSVersion != 0 {
+		err := prxy.SetBackendTLSMinVersion(backendTLSVersion)
+		if err != nil {
+			return nil, proxyCleanup, err
+		}
+	}
+
+	if cfg.AccessLogLevel != "" {
+		if err := prxy.EnableAccessLog(cfg.AccessLogLevel); err != nil {
+			return nil, proxyCleanup, err
+		}
+	}
+
+	if cfg.AuditLogFile != "" {
+		auditLog, err := openAuditLog(cfg.AuditLogFile)
+		if err != nil {
+			return nil, proxyCleanup, err
+		}
+		prxy.EnableAuditLog(auditLog)
+
+		log.Infof("Writing the audit log to %s", cfg.AuditLogFile)
+
+		auditCleanup := proxyCleanup
+		proxyCleanup = func(ctx context.Context) {
+			auditCleanup(ctx)
+			_ = auditLog.Close()
+		}
+	}
+
+	if cfg.MaxResponseHeaderBytes > 0 {
+		err := prxy.SetMaxResponseHeaderBytes(cfg.MaxResponseHeaderBytes)
+		if err != nil {
+			return nil, proxyCleanup, err
+		}
+	}
+
+	if cfg.ForwardProxy != nil && cfg.ForwardProxy.Enabled {
+		if err := prxy.EnableForwardProxy(cfg.ForwardProxy); err != nil {
+			return nil, proxyCleanup, err
+		}
+
+		log.Infof("Forwarding requests to %d allowed hosts",
+			len(cfg.ForwardProxy.AllowedHosts))
+	}
+
+	if cfg.Hooks.enabled() {
+		hooks, err := newGRPCRequestHooks(cfg.Hooks)
+		if err != nil {
+			return nil, proxyCleanup, err
+		}
+		prxy.EnableRequestHooks(hooks)
+
+		hooksCleanup := proxyCleanup
+		proxyCleanup = func(ctx context.Context) {
+			hooksCleanup(ctx)
+			hooks.close()
+		}
+	}
+
+	return prxy, proxyCleanup, nil
 }
 
 // createHashMailServer creates the gRPC server for the hash mail message
 // gateway and an additional REST and WebSocket capable proxy for that gRPC
 // server.
-func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
-	var localServices []proxy.LocalService
+func createHashMailServer(cfg *Config) ([]proxy.LocalService,
+	func(context.Context), error) {
 
 	serverOpts := []grpc.ServerOption{
 		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
 			MinTime: time.Minute,
 		}),
+		grpc.MaxRecvMsgSize(cfg.HashMail.maxRecvMsgSize()),
+		grpc.MaxSendMsgSize(cfg.HashMail.maxSendMsgSize()),
 	}
 
 	// Before we register both servers, we'll also ensure that the collector
@@ -733,11 +1698,6 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 	})
 	hashMailGRPC := grpc.NewServer(serverOpts...)
 	hashmailrpc.RegisterHashMailServer(hashMailGRPC, hashMailServer)
-	localServices = append(localServices, proxy.NewLocalService(
-		hashMailGRPC, func(r *http.Request) bool {
-			return strings.HasPrefix(r.URL.Path, hashMailGRPCPrefix)
-		}),
-	)
 
 	// Export the gRPC information for the public gRPC server.
 	if cfg.Prometheus != nil && cfg.Prometheus.Enabled {
@@ -761,8 +1721,12 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 	// We'll also create and start an accompanying proxy to serve clients
 	// through REST.
 	ctxc, cancel := context.WithCancel(context.Background())
-	proxyCleanup := func() {
+	hashMailDrainer := newGRPCDrainer(hashMailGRPC)
+	proxyCleanup := func(ctx context.Context) {
+		// The mailbox streams are long lived, so they're torn down
+		// before draining the RPCs reading from and writing to them.
 		hashMailServer.Stop()
+		hashMailDrainer.GracefulStop(ctx)
 		cancel()
 	}
 
@@ -778,14 +1742,28 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 		restProxyTLSOpt = grpc.WithInsecure()
 	}
 
-	mux := gateway.NewServeMux(customMarshalerOption)
+	mux := gateway.NewServeMux(
+		customMarshalerOption,
+		gateway.WithForwardResponseOption(encodeBinaryMetadata),
+	)
 	err := hashmailrpc.RegisterHashMailHandlerFromEndpoint(
 		ctxc, mux, cfg.ListenAddr, []grpc.DialOption{
 			restProxyTLSOpt,
+
+			// The REST proxy shouldn't be more restrictive than
+			// the gRPC server it relays to.
+			grpc.WithDefaultCallOptions(
+				grpc.MaxCallRecvMsgSize(
+					cfg.HashMail.maxSendMsgSize(),
+				),
+				grpc.MaxCallSendMsgSize(
+					cfg.HashMail.maxRecvMsgSize(),
+				),
+			),
 		},
 	)
 	if err != nil {
-		proxyCleanup()
+		proxyCleanup(ctxc)
 
 		return nil, nil, err
 	}
@@ -799,32 +1777,38 @@ func createHashMailServer(cfg *Config) ([]proxy.LocalService, func(), error) {
 	// through the following chain:
 	// req ---> CORS handler --> WS proxy ---> REST proxy --> gRPC endpoint
 	corsHandler := allowCORS(restHandler, []string{"*"})
-	localServices = append(localServices, proxy.NewLocalService(
-		corsHandler, func(r *http.Request) bool {
-			return strings.HasPrefix(r.URL.Path, hashMailRESTPrefix)
-		},
-	))
 
-	return localServices, proxyCleanup, nil
+	// Both the gRPC server and the REST proxy are served under their own
+	// prefix, gRPC calls are dispatched to the gRPC server directly while
+	// REST and WebSocket clients go through the proxy chain above.
+	return []proxy.LocalService{proxy.NewLocalService(
+		proxy.NewMultiProtocolMux(
+			hashMailDrainer, corsHandler, corsHandler,
+		),
+		func(r *http.Request) bool {
+			return strings.HasPrefix(r.URL.Path, hashMailGRPCPrefix) ||
+				strings.HasPrefix(r.URL.Path, hashMailRESTPrefix)
+		},
+	)}, proxyCleanup, nil
 }
 
-// cleanup closes the given server and shuts down the log rotator.
-func cleanup(etcdClient io.Closer, server io.Closer, proxy io.Closer) {
+// cleanup closes the given proxy and etcd client and shuts down the log
+// rotator.
+func cleanup(etcdClient io.Closer, proxy io.Closer) {
 	if err := proxy.Close(); err != nil {
 		log.Errorf("Error terminating proxy: %v", err)
 	}
 	if err := etcdClient.Close(); err != nil {
 		log.Errorf("Error terminating etcd client: %v", err)
 	}
-	err := server.Close()
-	if err != nil {
-		log.Errorf("Error closing server: %v", err)
-	}
 	log.Info("Shutdown complete")
-	err = logWriter.Close()
+	err := logWriter.Close()
 	if err != nil {
 		log.Errorf("Could not close log rotator: %v", err)
 	}
+	if err := jsonLogs.Close(); err != nil {
+		log.Errorf("Could not close JSON log rotator: %v", err)
+	}
 }
 
 // allowCORS wraps the given http.Handler with a function that adds the
@@ -0,0 +1,174 @@
+package aperture
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/require"
+)
+
+// TestListenUnixSocket makes sure requests can be served over a Unix socket,
+// that a stale socket is replaced and that no other file is ever removed.
+func TestListenUnixSocket(t *testing.T) {
+	path, ok := unixSocketPath("unix:///tmp/aperture.sock")
+	require.True(t, ok)
+	require.Equal(t, "/tmp/aperture.sock", path)
+	_, ok = unixSocketPath("localhost:8081")
+	require.False(t, ok)
+
+	tempDir, err := ioutil.TempDir("", "aperture")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// A file that isn't a socket must not be touched.
+	filePath := filepath.Join(tempDir, "file")
+	require.NoError(t, ioutil.WriteFile(filePath, []byte("x"), 0600))
+	_, err = listenUnixSocket(filePath)
+	require.Error(t, err)
+	_, err = os.Stat(filePath)
+	require.NoError(t, err)
+
+	// A socket left behind by a previous listener should be replaced.
+	socketPath := filepath.Join(tempDir, "aperture.sock")
+	stale, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	listener, err := listenUnixSocket(socketPath)
+	require.NoError(t, err)
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			_ *http.Request) {
+
+			w.WriteHeader(http.StatusTeapot)
+		}),
+	}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _,
+				_ string) (net.Conn, error) {
+
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	resp, err := client.Get("http://aperture/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTeapot, resp.StatusCode)
+}
+
+// TestListenTCP makes sure addresses without a host or with an IPv4 host are
+// listened on through the dual-stack network while IPv6 hosts are restricted to
+// IPv6 only.
+func TestListenTCP(t *testing.T) {
+	_, err := listenTCP("localhost")
+	require.Error(t, err)
+
+	require.Equal(t, "localhost:8082", torListenAddr(&TorConfig{
+		ListenPort: 8082,
+	}))
+	require.Equal(t, "[::1]:8082", torListenAddr(&TorConfig{
+		ListenHost: "::1",
+		ListenPort: 8082,
+	}))
+
+	listener, err := listenTCP("127.0.0.1:0")
+	require.NoError(t, err)
+	require.Equal(t, "tcp", listener.Addr().Network())
+	require.NoError(t, listener.Close())
+
+	// Not every test environment supports IPv6.
+	listener, err = listenTCP("[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	defer listener.Close()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	_, err = net.Dial("tcp4", net.JoinHostPort("127.0.0.1", port))
+	require.Error(t, err)
+
+	conn, err := net.Dial("tcp6", listener.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+}
+
+// TestProxyProtocolListener makes sure the requests on connections of a load
+// balancer speaking the PROXY protocol carry the address of the client and that
+// connections without a PROXY protocol header are rejected.
+func TestProxyProtocolListener(t *testing.T) {
+	listener, err := listenTCP("127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+
+			_, _ = w.Write([]byte(r.RemoteAddr))
+		}),
+	}
+	go func() {
+		_ = server.Serve(newProxyProtocolListener(listener))
+	}()
+	defer server.Close()
+
+	// request sends a request after the given header and returns the
+	// remote address the server saw.
+	request := func(header []byte) string {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write(header)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n" +
+			"Connection: close\r\n\r\n"))
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return ""
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// Both versions of the protocol are understood.
+	remoteAddr := request(
+		[]byte("PROXY TCP4 203.0.113.7 127.0.0.1 4711 8081\r\n"),
+	)
+	require.Equal(t, "203.0.113.7:4711", remoteAddr)
+
+	header, err := proxyproto.HeaderProxyFromAddrs(2, &net.TCPAddr{
+		IP: net.ParseIP("2001:db8::1"), Port: 4712,
+	}, &net.TCPAddr{
+		IP: net.ParseIP("2001:db8::2"), Port: 8081,
+	}).Format()
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:4712", request(header))
+
+	// Clients connecting directly can't be told apart from the load
+	// balancer, so they aren't served.
+	require.Empty(t, request(nil))
+}
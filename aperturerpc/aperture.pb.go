@@ -0,0 +1,293 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.27.1
+// 	protoc        (unknown)
+// source: aperturerpc/aperture.proto
+
+package aperturerpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type PaymentState int32
+
+const (
+	// The invoice hasn't been paid yet.
+	PaymentState_PENDING PaymentState = 0
+	// The invoice was paid, the LSAT can be used now.
+	PaymentState_SETTLED PaymentState = 1
+	// The invoice was canceled, expired or wasn't settled with the
+	// expected pre-image. The LSAT can't be used.
+	PaymentState_FAILED PaymentState = 2
+)
+
+// Enum value maps for PaymentState.
+var (
+	PaymentState_name = map[int32]string{
+		0: "PENDING",
+		1: "SETTLED",
+		2: "FAILED",
+	}
+	PaymentState_value = map[string]int32{
+		"PENDING": 0,
+		"SETTLED": 1,
+		"FAILED":  2,
+	}
+)
+
+func (x PaymentState) Enum() *PaymentState {
+	p := new(PaymentState)
+	*p = x
+	return p
+}
+
+func (x PaymentState) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (PaymentState) Descriptor() protoreflect.EnumDescriptor {
+	return file_aperturerpc_aperture_proto_enumTypes[0].Descriptor()
+}
+
+func (PaymentState) Type() protoreflect.EnumType {
+	return &file_aperturerpc_aperture_proto_enumTypes[0]
+}
+
+func (x PaymentState) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use PaymentState.Descriptor instead.
+func (PaymentState) EnumDescriptor() ([]byte, []int) {
+	return file_aperturerpc_aperture_proto_rawDescGZIP(), []int{0}
+}
+
+type PaymentStatusRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The payment hash of the invoice to stream the status of.
+	PaymentHash []byte `protobuf:"bytes,1,opt,name=payment_hash,json=paymentHash,proto3" json:"payment_hash,omitempty"`
+}
+
+func (x *PaymentStatusRequest) Reset() {
+	*x = PaymentStatusRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_aperturerpc_aperture_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PaymentStatusRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PaymentStatusRequest) ProtoMessage() {}
+
+func (x *PaymentStatusRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_aperturerpc_aperture_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PaymentStatusRequest.ProtoReflect.Descriptor instead.
+func (*PaymentStatusRequest) Descriptor() ([]byte, []int) {
+	return file_aperturerpc_aperture_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PaymentStatusRequest) GetPaymentHash() []byte {
+	if x != nil {
+		return x.PaymentHash
+	}
+	return nil
+}
+
+type PaymentStatusEvent struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// The payment hash of the invoice.
+	PaymentHash []byte `protobuf:"bytes,1,opt,name=payment_hash,json=paymentHash,proto3" json:"payment_hash,omitempty"`
+	// The state of the invoice.
+	State PaymentState `protobuf:"varint,2,opt,name=state,proto3,enum=aperturerpc.PaymentState" json:"state,omitempty"`
+}
+
+func (x *PaymentStatusEvent) Reset() {
+	*x = PaymentStatusEvent{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_aperturerpc_aperture_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PaymentStatusEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PaymentStatusEvent) ProtoMessage() {}
+
+func (x *PaymentStatusEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_aperturerpc_aperture_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PaymentStatusEvent.ProtoReflect.Descriptor instead.
+func (*PaymentStatusEvent) Descriptor() ([]byte, []int) {
+	return file_aperturerpc_aperture_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *PaymentStatusEvent) GetPaymentHash() []byte {
+	if x != nil {
+		return x.PaymentHash
+	}
+	return nil
+}
+
+func (x *PaymentStatusEvent) GetState() PaymentState {
+	if x != nil {
+		return x.State
+	}
+	return PaymentState_PENDING
+}
+
+var File_aperturerpc_aperture_proto protoreflect.FileDescriptor
+
+var file_aperturerpc_aperture_proto_rawDesc = []byte{
+	0x0a, 0x1a, 0x61, 0x70, 0x65, 0x72, 0x74, 0x75, 0x72, 0x65, 0x72, 0x70, 0x63, 0x2f, 0x61, 0x70,
+	0x65, 0x72, 0x74, 0x75, 0x72, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0b, 0x61, 0x70,
+	0x65, 0x72, 0x74, 0x75, 0x72, 0x65, 0x72, 0x70, 0x63, 0x22, 0x39, 0x0a, 0x14, 0x50, 0x61, 0x79,
+	0x6d, 0x65, 0x6e, 0x74, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x12, 0x21, 0x0a, 0x0c, 0x70, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x5f, 0x68, 0x61, 0x73,
+	0x68, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0b, 0x70, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74,
+	0x48, 0x61, 0x73, 0x68, 0x22, 0x68, 0x0a, 0x12, 0x50, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x53,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x21, 0x0a, 0x0c, 0x70, 0x61,
+	0x79, 0x6d, 0x65, 0x6e, 0x74, 0x5f, 0x68, 0x61, 0x73, 0x68, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x0b, 0x70, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x48, 0x61, 0x73, 0x68, 0x12, 0x2f, 0x0a,
+	0x05, 0x73, 0x74, 0x61, 0x74, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x19, 0x2e, 0x61,
+	0x70, 0x65, 0x72, 0x74, 0x75, 0x72, 0x65, 0x72, 0x70, 0x63, 0x2e, 0x50, 0x61, 0x79, 0x6d, 0x65,
+	0x6e, 0x74, 0x53, 0x74, 0x61, 0x74, 0x65, 0x52, 0x05, 0x73, 0x74, 0x61, 0x74, 0x65, 0x2a, 0x34,
+	0x0a, 0x0c, 0x50, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x0b,
+	0x0a, 0x07, 0x50, 0x45, 0x4e, 0x44, 0x49, 0x4e, 0x47, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x53,
+	0x45, 0x54, 0x54, 0x4c, 0x45, 0x44, 0x10, 0x01, 0x12, 0x0a, 0x0a, 0x06, 0x46, 0x41, 0x49, 0x4c,
+	0x45, 0x44, 0x10, 0x02, 0x32, 0x6e, 0x0a, 0x0f, 0x41, 0x70, 0x65, 0x72, 0x74, 0x75, 0x72, 0x65,
+	0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x5b, 0x0a, 0x13, 0x53, 0x74, 0x72, 0x65, 0x61,
+	0x6d, 0x50, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x21,
+	0x2e, 0x61, 0x70, 0x65, 0x72, 0x74, 0x75, 0x72, 0x65, 0x72, 0x70, 0x63, 0x2e, 0x50, 0x61, 0x79,
+	0x6d, 0x65, 0x6e, 0x74, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x1f, 0x2e, 0x61, 0x70, 0x65, 0x72, 0x74, 0x75, 0x72, 0x65, 0x72, 0x70, 0x63, 0x2e,
+	0x50, 0x61, 0x79, 0x6d, 0x65, 0x6e, 0x74, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x45, 0x76, 0x65,
+	0x6e, 0x74, 0x30, 0x01, 0x42, 0x2f, 0x5a, 0x2d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63,
+	0x6f, 0x6d, 0x2f, 0x6c, 0x69, 0x67, 0x68, 0x74, 0x6e, 0x69, 0x6e, 0x67, 0x6c, 0x61, 0x62, 0x73,
+	0x2f, 0x61, 0x70, 0x65, 0x72, 0x74, 0x75, 0x72, 0x65, 0x2f, 0x61, 0x70, 0x65, 0x72, 0x74, 0x75,
+	0x72, 0x65, 0x72, 0x70, 0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_aperturerpc_aperture_proto_rawDescOnce sync.Once
+	file_aperturerpc_aperture_proto_rawDescData = file_aperturerpc_aperture_proto_rawDesc
+)
+
+func file_aperturerpc_aperture_proto_rawDescGZIP() []byte {
+	file_aperturerpc_aperture_proto_rawDescOnce.Do(func() {
+		file_aperturerpc_aperture_proto_rawDescData = protoimpl.X.CompressGZIP(file_aperturerpc_aperture_proto_rawDescData)
+	})
+	return file_aperturerpc_aperture_proto_rawDescData
+}
+
+var file_aperturerpc_aperture_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_aperturerpc_aperture_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_aperturerpc_aperture_proto_goTypes = []interface{}{
+	(PaymentState)(0),            // 0: aperturerpc.PaymentState
+	(*PaymentStatusRequest)(nil), // 1: aperturerpc.PaymentStatusRequest
+	(*PaymentStatusEvent)(nil),   // 2: aperturerpc.PaymentStatusEvent
+}
+var file_aperturerpc_aperture_proto_depIdxs = []int32{
+	0, // 0: aperturerpc.PaymentStatusEvent.state:type_name -> aperturerpc.PaymentState
+	1, // 1: aperturerpc.ApertureService.StreamPaymentStatus:input_type -> aperturerpc.PaymentStatusRequest
+	2, // 2: aperturerpc.ApertureService.StreamPaymentStatus:output_type -> aperturerpc.PaymentStatusEvent
+	2, // [2:3] is the sub-list for method output_type
+	1, // [1:2] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_aperturerpc_aperture_proto_init() }
+func file_aperturerpc_aperture_proto_init() {
+	if File_aperturerpc_aperture_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_aperturerpc_aperture_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PaymentStatusRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_aperturerpc_aperture_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PaymentStatusEvent); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_aperturerpc_aperture_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_aperturerpc_aperture_proto_goTypes,
+		DependencyIndexes: file_aperturerpc_aperture_proto_depIdxs,
+		EnumInfos:         file_aperturerpc_aperture_proto_enumTypes,
+		MessageInfos:      file_aperturerpc_aperture_proto_msgTypes,
+	}.Build()
+	File_aperturerpc_aperture_proto = out.File
+	file_aperturerpc_aperture_proto_rawDesc = nil
+	file_aperturerpc_aperture_proto_goTypes = nil
+	file_aperturerpc_aperture_proto_depIdxs = nil
+}
@@ -0,0 +1,140 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: aperturerpc/aperture.proto
+
+package aperturerpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ApertureServiceClient is the client API for ApertureService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ApertureServiceClient interface {
+	// StreamPaymentStatus streams the status of the invoice of an LSAT
+	// challenge. Unless the invoice is already settled, a PENDING event
+	// is sent as soon as the subscription is active. Once the invoice
+	// settles or fails, a final event is sent and the stream ends.
+	StreamPaymentStatus(ctx context.Context, in *PaymentStatusRequest, opts ...grpc.CallOption) (ApertureService_StreamPaymentStatusClient, error)
+}
+
+type apertureServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewApertureServiceClient(cc grpc.ClientConnInterface) ApertureServiceClient {
+	return &apertureServiceClient{cc}
+}
+
+func (c *apertureServiceClient) StreamPaymentStatus(ctx context.Context, in *PaymentStatusRequest, opts ...grpc.CallOption) (ApertureService_StreamPaymentStatusClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ApertureService_ServiceDesc.Streams[0], "/aperturerpc.ApertureService/StreamPaymentStatus", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &apertureServiceStreamPaymentStatusClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ApertureService_StreamPaymentStatusClient interface {
+	Recv() (*PaymentStatusEvent, error)
+	grpc.ClientStream
+}
+
+type apertureServiceStreamPaymentStatusClient struct {
+	grpc.ClientStream
+}
+
+func (x *apertureServiceStreamPaymentStatusClient) Recv() (*PaymentStatusEvent, error) {
+	m := new(PaymentStatusEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ApertureServiceServer is the server API for ApertureService service.
+// All implementations must embed UnimplementedApertureServiceServer
+// for forward compatibility
+type ApertureServiceServer interface {
+	// StreamPaymentStatus streams the status of the invoice of an LSAT
+	// challenge. Unless the invoice is already settled, a PENDING event
+	// is sent as soon as the subscription is active. Once the invoice
+	// settles or fails, a final event is sent and the stream ends.
+	StreamPaymentStatus(*PaymentStatusRequest, ApertureService_StreamPaymentStatusServer) error
+	mustEmbedUnimplementedApertureServiceServer()
+}
+
+// UnimplementedApertureServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedApertureServiceServer struct {
+}
+
+func (UnimplementedApertureServiceServer) StreamPaymentStatus(*PaymentStatusRequest, ApertureService_StreamPaymentStatusServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamPaymentStatus not implemented")
+}
+func (UnimplementedApertureServiceServer) mustEmbedUnimplementedApertureServiceServer() {}
+
+// UnsafeApertureServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ApertureServiceServer will
+// result in compilation errors.
+type UnsafeApertureServiceServer interface {
+	mustEmbedUnimplementedApertureServiceServer()
+}
+
+func RegisterApertureServiceServer(s grpc.ServiceRegistrar, srv ApertureServiceServer) {
+	s.RegisterService(&ApertureService_ServiceDesc, srv)
+}
+
+func _ApertureService_StreamPaymentStatus_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PaymentStatusRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ApertureServiceServer).StreamPaymentStatus(m, &apertureServiceStreamPaymentStatusServer{stream})
+}
+
+type ApertureService_StreamPaymentStatusServer interface {
+	Send(*PaymentStatusEvent) error
+	grpc.ServerStream
+}
+
+type apertureServiceStreamPaymentStatusServer struct {
+	grpc.ServerStream
+}
+
+func (x *apertureServiceStreamPaymentStatusServer) Send(m *PaymentStatusEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// ApertureService_ServiceDesc is the grpc.ServiceDesc for ApertureService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ApertureService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "aperturerpc.ApertureService",
+	HandlerType: (*ApertureServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamPaymentStatus",
+			Handler:       _ApertureService_StreamPaymentStatus_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "aperturerpc/aperture.proto",
+}
@@ -0,0 +1,151 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: aperturerpc/hooks.proto
+
+package aperturerpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// HookServiceClient is the client API for HookService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type HookServiceClient interface {
+	// PreRequest is called before a request is forwarded to the backend
+	// of a service. If it returns DENY, the request is rejected with a
+	// 403 error.
+	PreRequest(ctx context.Context, in *PreRequestHookRequest, opts ...grpc.CallOption) (*PreRequestHookResponse, error)
+	// PostResponse is called with the backend's response before it is
+	// sent to the client and can modify the response header.
+	PostResponse(ctx context.Context, in *PostResponseHookRequest, opts ...grpc.CallOption) (*PostResponseHookResponse, error)
+}
+
+type hookServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewHookServiceClient(cc grpc.ClientConnInterface) HookServiceClient {
+	return &hookServiceClient{cc}
+}
+
+func (c *hookServiceClient) PreRequest(ctx context.Context, in *PreRequestHookRequest, opts ...grpc.CallOption) (*PreRequestHookResponse, error) {
+	out := new(PreRequestHookResponse)
+	err := c.cc.Invoke(ctx, "/aperturerpc.HookService/PreRequest", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *hookServiceClient) PostResponse(ctx context.Context, in *PostResponseHookRequest, opts ...grpc.CallOption) (*PostResponseHookResponse, error) {
+	out := new(PostResponseHookResponse)
+	err := c.cc.Invoke(ctx, "/aperturerpc.HookService/PostResponse", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// HookServiceServer is the server API for HookService service.
+// All implementations must embed UnimplementedHookServiceServer
+// for forward compatibility
+type HookServiceServer interface {
+	// PreRequest is called before a request is forwarded to the backend
+	// of a service. If it returns DENY, the request is rejected with a
+	// 403 error.
+	PreRequest(context.Context, *PreRequestHookRequest) (*PreRequestHookResponse, error)
+	// PostResponse is called with the backend's response before it is
+	// sent to the client and can modify the response header.
+	PostResponse(context.Context, *PostResponseHookRequest) (*PostResponseHookResponse, error)
+	mustEmbedUnimplementedHookServiceServer()
+}
+
+// UnimplementedHookServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedHookServiceServer struct {
+}
+
+func (UnimplementedHookServiceServer) PreRequest(context.Context, *PreRequestHookRequest) (*PreRequestHookResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PreRequest not implemented")
+}
+func (UnimplementedHookServiceServer) PostResponse(context.Context, *PostResponseHookRequest) (*PostResponseHookResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PostResponse not implemented")
+}
+func (UnimplementedHookServiceServer) mustEmbedUnimplementedHookServiceServer() {}
+
+// UnsafeHookServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to HookServiceServer will
+// result in compilation errors.
+type UnsafeHookServiceServer interface {
+	mustEmbedUnimplementedHookServiceServer()
+}
+
+func RegisterHookServiceServer(s grpc.ServiceRegistrar, srv HookServiceServer) {
+	s.RegisterService(&HookService_ServiceDesc, srv)
+}
+
+func _HookService_PreRequest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PreRequestHookRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HookServiceServer).PreRequest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/aperturerpc.HookService/PreRequest",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HookServiceServer).PreRequest(ctx, req.(*PreRequestHookRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HookService_PostResponse_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PostResponseHookRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HookServiceServer).PostResponse(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/aperturerpc.HookService/PostResponse",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HookServiceServer).PostResponse(ctx, req.(*PostResponseHookRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// HookService_ServiceDesc is the grpc.ServiceDesc for HookService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var HookService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "aperturerpc.HookService",
+	HandlerType: (*HookServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PreRequest",
+			Handler:    _HookService_PreRequest_Handler,
+		},
+		{
+			MethodName: "PostResponse",
+			Handler:    _HookService_PostResponse_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "aperturerpc/hooks.proto",
+}
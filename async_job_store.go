@@ -0,0 +1,280 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const (
+	// asyncJobsPrefix is the key we'll use to prefix all asynchronous job
+	// IDs with when storing the jobs in an etcd cluster.
+	asyncJobsPrefix = "asyncjobs"
+
+	// asyncJobTTL is the time an asynchronous job is kept in etcd before
+	// it is removed, whether its response was retrieved or not.
+	asyncJobTTL = 24 * time.Hour
+
+	// asyncJobClaimsPrefix is the key we'll use to prefix the claims of
+	// pending asynchronous jobs with. A job is claimed by the aperture
+	// instance processing it as long as that instance is running.
+	asyncJobClaimsPrefix = "asyncjobclaims"
+
+	// asyncJobClaimTTL is the time after which the claims of an aperture
+	// instance that stopped unexpectedly expire, so its pending jobs can
+	// be resumed by another instance.
+	asyncJobClaimTTL = 30 * time.Second
+)
+
+// asyncJobKey returns the full key to store the asynchronous job with the given
+// ID under.
+//
+// The resulting path of the job ID bff4ee83 within etcd would look like:
+//
+//	lsat/proxy/asyncjobs/bff4ee83
+func asyncJobKey(id string) string {
+	return strings.Join(
+		[]string{topLevelKey, asyncJobsPrefix, id}, etcdKeyDelimeter,
+	)
+}
+
+// asyncJobClaimKey returns the full key the claim of the asynchronous job with
+// the given ID is stored under.
+//
+// The resulting path of the job ID bff4ee83 within etcd would look like:
+//
+//	lsat/proxy/asyncjobclaims/bff4ee83
+func asyncJobClaimKey(id string) string {
+	return strings.Join(
+		[]string{topLevelKey, asyncJobClaimsPrefix, id},
+		etcdKeyDelimeter,
+	)
+}
+
+// asyncJobStore persists asynchronously processed requests and their
+// responses in an etcd cluster. Pending jobs are claimed with a lease that is
+// kept alive while this instance is running, so each job is only processed by
+// a single instance.
+type asyncJobStore struct {
+	*clientv3.Client
+
+	sessionMtx sync.Mutex
+	session    *concurrency.Session
+}
+
+// A compile-time constraint to ensure asyncJobStore implements
+// proxy.AsyncJobStore.
+var _ proxy.AsyncJobStore = (*asyncJobStore)(nil)
+
+// newAsyncJobStore instantiates a new asynchronous job store backed by an etcd
+// cluster.
+func newAsyncJobStore(client *clientv3.Client) *asyncJobStore {
+	return &asyncJobStore{Client: client}
+}
+
+// claimLease returns the lease the claims of this instance are attached to. It
+// is kept alive until the etcd client is closed.
+func (s *asyncJobStore) claimLease() (clientv3.LeaseID, error) {
+	s.sessionMtx.Lock()
+	defer s.sessionMtx.Unlock()
+
+	// A session whose lease expired, for example because etcd wasn't
+	// reachable for too long, is replaced.
+	if s.session != nil {
+		select {
+		case <-s.session.Done():
+			s.session = nil
+		default:
+		}
+	}
+
+	if s.session == nil {
+		session, err := concurrency.NewSession(
+			s.Client, concurrency.WithTTL(
+				int(asyncJobClaimTTL.Seconds()),
+			),
+		)
+		if err != nil {
+			return 0, fmt.Errorf("unable to create session: %v",
+				err)
+		}
+		s.session = session
+	}
+
+	return s.session.Lease(), nil
+}
+
+// AddAsyncJob stores a new pending job and claims it for this instance. It is
+// removed after asyncJobTTL.
+//
+// NOTE: This is part of the proxy.AsyncJobStore interface.
+func (s *asyncJobStore) AddAsyncJob(ctx context.Context,
+	job *proxy.AsyncJob) error {
+
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	claimLease, err := s.claimLease()
+	if err != nil {
+		return err
+	}
+
+	lease, err := s.Grant(ctx, int64(asyncJobTTL.Seconds()))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Txn(ctx).Then(
+		clientv3.OpPut(
+			asyncJobKey(job.ID), string(value),
+			clientv3.WithLease(lease.ID),
+		),
+		clientv3.OpPut(
+			asyncJobClaimKey(job.ID), "",
+			clientv3.WithLease(claimLease),
+		),
+	).Commit()
+	return err
+}
+
+// ClaimPendingAsyncJobs returns all jobs that are still pending and not
+// claimed by any running instance, claiming them for this one.
+//
+// NOTE: This is part of the proxy.AsyncJobStore interface.
+func (s *asyncJobStore) ClaimPendingAsyncJobs(
+	ctx context.Context) ([]*proxy.AsyncJob, error) {
+
+	claimLease, err := s.claimLease()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Get(ctx, asyncJobKey(""), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*proxy.AsyncJob
+	for _, kv := range resp.Kvs {
+		var job proxy.AsyncJob
+		if err := json.Unmarshal(kv.Value, &job); err != nil {
+			return nil, err
+		}
+		if job.Response != nil {
+			continue
+		}
+
+		// Only claim the job if nobody else did and it didn't change
+		// in the meantime.
+		claimKey := asyncJobClaimKey(job.ID)
+		txnResp, err := s.Txn(ctx).If(
+			clientv3.Compare(
+				clientv3.CreateRevision(claimKey), "=", 0,
+			),
+			clientv3.Compare(
+				clientv3.ModRevision(string(kv.Key)), "=",
+				kv.ModRevision,
+			),
+		).Then(
+			clientv3.OpPut(
+				claimKey, "", clientv3.WithLease(claimLease),
+			),
+		).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if txnResp.Succeeded {
+			jobs = append(jobs, &job)
+		}
+	}
+
+	return jobs, nil
+}
+
+// ReleaseAsyncJobs revokes the lease the claims of this instance are attached
+// to, so the jobs it didn't complete can be resumed right away by the next
+// instance that starts.
+//
+// NOTE: This is part of the proxy.AsyncJobStore interface.
+func (s *asyncJobStore) ReleaseAsyncJobs(ctx context.Context) error {
+	s.sessionMtx.Lock()
+	defer s.sessionMtx.Unlock()
+
+	if s.session == nil {
+		return nil
+	}
+
+	_, err := s.Revoke(ctx, s.session.Lease())
+	s.session.Orphan()
+	s.session = nil
+
+	return err
+}
+
+// CompleteAsyncJob stores the response of the pending job with the given ID.
+//
+// NOTE: This is part of the proxy.AsyncJobStore interface.
+func (s *asyncJobStore) CompleteAsyncJob(ctx context.Context, id string,
+	resp *proxy.AsyncResponse) error {
+
+	job, err := s.AsyncJob(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// The request isn't needed anymore once the job completed.
+	job.Body = nil
+	job.Header = nil
+	job.Response = resp
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Txn(ctx).Then(
+		clientv3.OpPut(
+			asyncJobKey(id), string(value),
+			clientv3.WithIgnoreLease(),
+		),
+		clientv3.OpDelete(asyncJobClaimKey(id)),
+	).Commit()
+	return err
+}
+
+// AsyncJob returns the job with the given ID. If there is none,
+// proxy.ErrAsyncJobNotFound is returned.
+//
+// NOTE: This is part of the proxy.AsyncJobStore interface.
+func (s *asyncJobStore) AsyncJob(ctx context.Context,
+	id string) (*proxy.AsyncJob, error) {
+
+	// IDs are hex encoded, so they can't contain the key delimiter, but
+	// let's make sure no other key can be read.
+	if id == "" || strings.Contains(id, etcdKeyDelimeter) {
+		return nil, proxy.ErrAsyncJobNotFound
+	}
+
+	resp, err := s.Get(ctx, asyncJobKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, proxy.ErrAsyncJobNotFound
+	}
+
+	var job proxy.AsyncJob
+	if err := json.Unmarshal(resp.Kvs[0].Value, &job); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
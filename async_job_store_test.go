@@ -0,0 +1,101 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAsyncJobStore makes sure asynchronous jobs are stored with their request
+// body until they complete and with their response afterwards.
+func TestAsyncJobStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	store := newAsyncJobStore(etcdClient)
+
+	_, err := store.AsyncJob(ctx, "aabb")
+	require.Equal(t, proxy.ErrAsyncJobNotFound, err)
+
+	job := &proxy.AsyncJob{
+		ID:      "aabb",
+		Service: "jobs",
+		Created: time.Unix(1000, 0).UTC(),
+		Method:  http.MethodPost,
+		URL:     "/jobs",
+		Header:  http.Header{"X-Job": []string{"aabb"}},
+		Body:    []byte("request"),
+	}
+	require.NoError(t, store.AddAsyncJob(ctx, job))
+
+	stored, err := store.AsyncJob(ctx, "aabb")
+	require.NoError(t, err)
+	require.Equal(t, job, stored)
+
+	// The job is processed by this instance, so it can't be claimed.
+	jobs, err := store.ClaimPendingAsyncJobs(ctx)
+	require.NoError(t, err)
+	require.Empty(t, jobs)
+
+	// A pending job whose instance stopped can only be claimed once, even
+	// by different instances.
+	orphan := &proxy.AsyncJob{
+		ID:      "ccdd",
+		Service: "jobs",
+		Created: time.Unix(1000, 0).UTC(),
+		Body:    []byte("orphan"),
+	}
+	value, err := json.Marshal(orphan)
+	require.NoError(t, err)
+	_, err = etcdClient.Put(ctx, asyncJobKey("ccdd"), string(value))
+	require.NoError(t, err)
+
+	jobs, err = store.ClaimPendingAsyncJobs(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []*proxy.AsyncJob{orphan}, jobs)
+
+	otherStore := newAsyncJobStore(etcdClient)
+	jobs, err = otherStore.ClaimPendingAsyncJobs(ctx)
+	require.NoError(t, err)
+	require.Empty(t, jobs)
+
+	// Once the instance stopped, its jobs can be claimed right away.
+	require.NoError(t, store.ReleaseAsyncJobs(ctx))
+	jobs, err = otherStore.ClaimPendingAsyncJobs(ctx)
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	require.NoError(t, otherStore.ReleaseAsyncJobs(ctx))
+
+	resp := &proxy.AsyncResponse{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		Body:       []byte("response"),
+	}
+	require.NoError(t, store.CompleteAsyncJob(ctx, "aabb", resp))
+
+	stored, err = store.AsyncJob(ctx, "aabb")
+	require.NoError(t, err)
+	require.Equal(t, resp, stored.Response)
+	require.Empty(t, stored.Body)
+	require.Empty(t, stored.Header)
+
+	// Its claim is released along with the request.
+	claim, err := etcdClient.Get(ctx, asyncJobClaimKey("aabb"))
+	require.NoError(t, err)
+	require.Empty(t, claim.Kvs)
+
+	// Other keys can't be read through the store.
+	_, err = store.AsyncJob(ctx, "../secrets")
+	require.Equal(t, proxy.ErrAsyncJobNotFound, err)
+
+	// Jobs that don't exist can't be completed.
+	err = store.CompleteAsyncJob(ctx, "eeff", resp)
+	require.Equal(t, proxy.ErrAsyncJobNotFound, err)
+}
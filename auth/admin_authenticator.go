@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+)
+
+// AdminAuthenticator is an authenticator that authenticates requests to the
+// admin API with LSATs that carry the admin capability caveat. Admin LSATs are
+// issued to the node operator and aren't paid for, so no invoice is checked.
+type AdminAuthenticator struct {
+	minter Minter
+}
+
+// NewAdminAuthenticator creates a new authenticator that authenticates
+// requests based on admin LSATs minted by the given minter.
+func NewAdminAuthenticator(minter Minter) *AdminAuthenticator {
+	return &AdminAuthenticator{
+		minter: minter,
+	}
+}
+
+// Accept returns whether or not the header contains a valid admin LSAT. If it
+// does, the ID of the LSAT is returned as well.
+func (a *AdminAuthenticator) Accept(header *http.Header) (lsat.TokenID,
+	bool) {
+
+	mac, preimage, err := lsat.FromHeader(header)
+	if err != nil {
+		log.Debugf("Deny admin: %v", err)
+		return lsat.TokenID{}, false
+	}
+
+	verificationParams := &mint.VerificationParams{
+		Macaroon: mac,
+		Preimage: preimage,
+		AdminAPI: true,
+	}
+	err = a.minter.VerifyLSAT(context.Background(), verificationParams)
+	if err != nil {
+		log.Debugf("Deny admin: LSAT validation failed: %v", err)
+		return lsat.TokenID{}, false
+	}
+
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		log.Debugf("Deny admin: Invalid LSAT identifier: %v", err)
+		return lsat.TokenID{}, false
+	}
+
+	return id.TokenID, true
+}
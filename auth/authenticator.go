@@ -3,19 +3,56 @@ package auth
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/metrics"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// HeaderLSATError is the header that tells a client why the LSAT it
+	// presented wasn't accepted, if there is a reason it can act on.
+	HeaderLSATError = "X-LSAT-Error"
+
+	// LSATErrorExpiredToken is the value of the LSAT error header if the
+	// presented LSAT expired and the client needs to pay for a new one.
+	LSATErrorExpiredToken = "EXPIRED_TOKEN"
 )
 
 // LsatAuthenticator is an authenticator that uses the LSAT protocol to
 // authenticate requests.
 type LsatAuthenticator struct {
-	minter  Minter
-	checker InvoiceChecker
+	minter       Minter
+	checker      InvoiceChecker
+	blockHeights BlockHeightSource
+
+	// nonces keeps track of the nonces used with each LSAT. It is nil if
+	// replay protection isn't enabled.
+	nonces      NonceStore
+	nonceWindow time.Duration
+
+	// pow issues proof-of-work challenges while no LSATs can be minted.
+	// It is nil if the proof-of-work fallback isn't enabled.
+	pow *powFallback
+
+	// cookieName is the name of the cookie browser clients send their
+	// LSAT in. It is empty if LSATs are only accepted in header fields.
+	cookieName string
+
+	// tokenCache remembers the LSATs that were recently verified. It is
+	// nil if caching isn't enabled.
+	tokenCache *tokenCache
+
+	// tokenNotifier is notified about every LSAT that is issued. It is
+	// nil if nobody is interested in them.
+	tokenNotifier TokenNotifier
 }
 
 // A compile time flag to ensure the LsatAuthenticator satisfies the
@@ -23,13 +60,16 @@ type LsatAuthenticator struct {
 var _ Authenticator = (*LsatAuthenticator)(nil)
 
 // NewLsatAuthenticator creates a new authenticator that authenticates requests
-// based on LSAT tokens.
-func NewLsatAuthenticator(minter Minter,
-	checker InvoiceChecker) *LsatAuthenticator {
+// based on LSAT tokens. The block height source is only consulted for LSATs
+// that aren't valid before a certain block height. If it is nil, those LSATs
+// are always denied.
+func NewLsatAuthenticator(minter Minter, checker InvoiceChecker,
+	blockHeights BlockHeightSource) *LsatAuthenticator {
 
 	return &LsatAuthenticator{
-		minter:  minter,
-		checker: checker,
+		minter:       minter,
+		checker:      checker,
+		blockHeights: blockHeights,
 	}
 }
 
@@ -38,23 +78,71 @@ func NewLsatAuthenticator(minter Minter,
 //
 // NOTE: This is part of the Authenticator interface.
 func (l *LsatAuthenticator) Accept(header *http.Header, serviceName string) bool {
+	// Clients that solved a proof-of-work challenge don't carry an LSAT.
+	if challenge, nonce, ok := powFromHeader(header); ok && l.pow != nil {
+		err := l.pow.verify(challenge, nonce, serviceName)
+		if err != nil {
+			log.Debugf("Deny: %v", err)
+			return false
+		}
+
+		return true
+	}
+
 	// Try reading the macaroon and preimage from the HTTP header. This can
 	// be in different header fields depending on the implementation and/or
 	// protocol.
-	mac, preimage, err := lsat.FromHeader(header)
+	mac, preimage, err := l.fromHeader(header)
 	if err != nil {
 		log.Debugf("Deny: %v", err)
 		return false
 	}
 
-	verificationParams := &mint.VerificationParams{
-		Macaroon:      mac,
-		Preimage:      preimage,
-		TargetService: serviceName,
+	if !l.verifyCached(mac, preimage, serviceName) {
+		return false
 	}
-	err = l.minter.VerifyLSAT(context.Background(), verificationParams)
+
+	// Only count the request against the LSAT's budget once we know it is
+	// going to be served.
+	err = l.minter.ConsumeBudget(context.Background(), mac)
 	if err != nil {
-		log.Debugf("Deny: LSAT validation failed: %v", err)
+		log.Debugf("Deny: Unable to consume LSAT budget: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// verifyCached verifies the given LSAT for the given service and makes sure its
+// invoice was settled, unless it was verified recently and is still cached.
+func (l *LsatAuthenticator) verifyCached(mac *macaroon.Macaroon,
+	preimage lntypes.Preimage, serviceName string) bool {
+
+	var (
+		cacheKey tokenCacheKey
+		err      error
+	)
+	if l.tokenCache != nil {
+		cacheKey, err = l.tokenCache.key(mac, preimage, serviceName)
+		if err != nil {
+			log.Debugf("Deny: Unable to serialize LSAT: %v", err)
+			return false
+		}
+		if l.tokenCache.contains(cacheKey) {
+			return true
+		}
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.LSATVerificationDuration.Observe(
+			time.Since(start).Seconds(),
+		)
+	}()
+
+	err = l.verifyLSAT(mac, preimage, serviceName)
+	if err != nil {
+		log.Debugf("Deny: %v", err)
 		return false
 	}
 
@@ -68,9 +156,51 @@ func (l *LsatAuthenticator) Accept(header *http.Header, serviceName string) bool
 		return false
 	}
 
+	if l.tokenCache != nil {
+		l.tokenCache.add(cacheKey, mac, serviceName)
+	}
+
 	return true
 }
 
+// verifyLSAT verifies the given LSAT for the given service.
+func (l *LsatAuthenticator) verifyLSAT(mac *macaroon.Macaroon,
+	preimage lntypes.Preimage, serviceName string) error {
+
+	// We only need to know the current block height if the LSAT isn't
+	// valid before a certain block. That way we don't query the backing
+	// node for every request.
+	var (
+		blockHeight uint32
+		err         error
+	)
+	if _, ok := lsat.HasCaveat(mac, lsat.CondValidAfterBlock); ok {
+		if l.blockHeights == nil {
+			return errors.New("block height unknown")
+		}
+
+		blockHeight, err = l.blockHeights.BlockHeight(
+			context.Background(),
+		)
+		if err != nil {
+			return fmt.Errorf("unable to get block height: %v", err)
+		}
+	}
+
+	verificationParams := &mint.VerificationParams{
+		Macaroon:      mac,
+		Preimage:      preimage,
+		TargetService: serviceName,
+		BlockHeight:   blockHeight,
+	}
+	err = l.minter.VerifyLSAT(context.Background(), verificationParams)
+	if err != nil {
+		return fmt.Errorf("LSAT validation failed: %v", err)
+	}
+
+	return nil
+}
+
 // FreshChallengeHeader returns a header containing a challenge for the user to
 // complete.
 //
@@ -78,18 +208,31 @@ func (l *LsatAuthenticator) Accept(header *http.Header, serviceName string) bool
 func (l *LsatAuthenticator) FreshChallengeHeader(r *http.Request,
 	serviceName string, servicePrice int64) (http.Header, error) {
 
+	// While the Lightning backend is unavailable, clients can prove their
+	// work instead of paying.
+	if l.pow != nil && !l.pow.available() {
+		return l.pow.challengeHeader(r, serviceName)
+	}
+
 	service := lsat.Service{
 		Name:  serviceName,
 		Tier:  lsat.BaseTier,
 		Price: servicePrice,
 	}
-	mac, paymentRequest, err := l.minter.MintLSAT(
-		context.Background(), service,
-	)
+	start := time.Now()
+	mac, paymentRequest, err := l.minter.MintLSAT(r.Context(), service)
+	if err != nil && l.pow != nil {
+		log.Warnf("Error minting LSAT, falling back to proof of "+
+			"work: %v", err)
+		return l.pow.challengeHeader(r, serviceName)
+	}
 	if err != nil {
 		log.Errorf("Error minting LSAT: %v", err)
 		return nil, err
 	}
+	metrics.LSATIssuanceDuration.Observe(time.Since(start).Seconds())
+	l.notifyIssued(mac, service)
+
 	macBytes, err := mac.MarshalBinary()
 	if err != nil {
 		log.Errorf("Error serializing LSAT: %v", err)
@@ -100,6 +243,35 @@ func (l *LsatAuthenticator) FreshChallengeHeader(r *http.Request,
 	header := r.Header
 	header.Set("WWW-Authenticate", str)
 
+	// Let the client know if it needs to pay again because its LSAT
+	// expired, rather than leaving it to guess why it was rejected.
+	if l.tokenExpired(r, serviceName) {
+		header.Set(HeaderLSATError, LSATErrorExpiredToken)
+	}
+
 	log.Debugf("Created new challenge header: [%s]", str)
 	return header, nil
 }
+
+// tokenExpired returns true if the request carries an LSAT for the given
+// service that was valid but has expired.
+func (l *LsatAuthenticator) tokenExpired(r *http.Request,
+	serviceName string) bool {
+
+	mac, preimage, err := l.fromHeader(&r.Header)
+	if err != nil {
+		return false
+	}
+
+	// Most LSATs don't expire, so there's no need to verify them again.
+	if _, ok := lsat.HasCaveat(mac, mint.CondExpiresAt); !ok {
+		return false
+	}
+
+	err = l.minter.VerifyLSAT(r.Context(), &mint.VerificationParams{
+		Macaroon:      mac,
+		Preimage:      preimage,
+		TargetService: serviceName,
+	})
+	return err == mint.ErrTokenExpired
+}
@@ -1,19 +1,23 @@
 package auth_test
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
 	"gopkg.in/macaroon.v2"
 )
 
 // createDummyMacHex creates a valid macaroon with dummy content for our tests.
-func createDummyMacHex(preimage string) string {
+func createDummyMacHex(preimage string, caveats ...lsat.Caveat) string {
 	dummyMac, err := macaroon.New(
 		[]byte("aabbccddeeff00112233445566778899"), []byte("AA=="),
 		"aperture", macaroon.LatestVersion,
@@ -22,7 +26,8 @@ func createDummyMacHex(preimage string) string {
 		panic(err)
 	}
 	preimageCaveat := lsat.Caveat{Condition: lsat.PreimageKey, Value: preimage}
-	err = lsat.AddFirstPartyCaveats(dummyMac, preimageCaveat)
+	caveats = append([]lsat.Caveat{preimageCaveat}, caveats...)
+	err = lsat.AddFirstPartyCaveats(dummyMac, caveats...)
 	if err != nil {
 		panic(err)
 	}
@@ -45,10 +50,11 @@ func TestLsatAuthenticator(t *testing.T) {
 			testMacBytes,
 		)
 		headerTests = []struct {
-			id       string
-			header   *http.Header
-			checkErr error
-			result   bool
+			id        string
+			header    *http.Header
+			checkErr  error
+			budgetErr error
+			result    bool
 		}{
 			{
 				id:     "empty header",
@@ -117,6 +123,32 @@ func TestLsatAuthenticator(t *testing.T) {
 					}},
 				result: true,
 			},
+			{
+				id: "valid macaroon metadata header, other " +
+					"auth header",
+				header: &http.Header{
+					lsat.HeaderAuthorization: []string{
+						"Bearer foo",
+					},
+					lsat.HeaderMacaroonMD: []string{
+						testMacHex,
+					},
+				},
+				result: true,
+			},
+			{
+				id: "invalid LSAT auth header, valid " +
+					"macaroon metadata header",
+				header: &http.Header{
+					lsat.HeaderAuthorization: []string{
+						"LSAT foo",
+					},
+					lsat.HeaderMacaroonMD: []string{
+						testMacHex,
+					},
+				},
+				result: false,
+			},
 			{
 				id: "valid macaroon header",
 				header: &http.Header{
@@ -136,13 +168,25 @@ func TestLsatAuthenticator(t *testing.T) {
 				checkErr: fmt.Errorf("nope"),
 				result:   false,
 			},
+			{
+				id: "valid macaroon header, budget exhausted",
+				header: &http.Header{
+					lsat.HeaderMacaroon: []string{
+						testMacHex,
+					},
+				},
+				budgetErr: mint.ErrBudgetExhausted,
+				result:    false,
+			},
 		}
 	)
 
 	c := &mockChecker{}
-	a := auth.NewLsatAuthenticator(&mockMint{}, c)
+	m := &mockMint{}
+	a := auth.NewLsatAuthenticator(m, c, nil)
 	for _, testCase := range headerTests {
 		c.err = testCase.checkErr
+		m.budgetErr = testCase.budgetErr
 		result := a.Accept(testCase.header, "test")
 		if result != testCase.result {
 			t.Fatalf("test case %s failed. got %v expected %v",
@@ -150,3 +194,253 @@ func TestLsatAuthenticator(t *testing.T) {
 		}
 	}
 }
+
+// TestExpiredTokenChallenge tests that a fresh challenge tells the client its
+// LSAT expired if it presented one that did.
+func TestExpiredTokenChallenge(t *testing.T) {
+	var (
+		testPreimage = "49349dfea4abed3cd14f6d356afa83de" +
+			"9787b609f088c8df09bacc7b4bd21b39"
+		plainMacHex    = createDummyMacHex(testPreimage)
+		expiringMacHex = createDummyMacHex(
+			testPreimage, mint.NewExpiresAtCaveat(
+				time.Now().Add(-time.Minute),
+			),
+		)
+	)
+
+	newRequest := func(macHex string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(lsat.HeaderMacaroon, macHex)
+		return r
+	}
+
+	m := &mockMint{verifyErr: mint.ErrTokenExpired}
+	a := auth.NewLsatAuthenticator(m, &mockChecker{}, nil)
+
+	// An LSAT without an expiry caveat can't have expired.
+	header, err := a.FreshChallengeHeader(
+		newRequest(plainMacHex), "test", 1,
+	)
+	if err != nil {
+		t.Fatalf("unable to create challenge: %v", err)
+	}
+	if header.Get(auth.HeaderLSATError) != "" {
+		t.Fatal("unexpected LSAT error header for LSAT without expiry")
+	}
+
+	// An expired LSAT should be reported as such.
+	header, err = a.FreshChallengeHeader(
+		newRequest(expiringMacHex), "test", 1,
+	)
+	if err != nil {
+		t.Fatalf("unable to create challenge: %v", err)
+	}
+	if header.Get(auth.HeaderLSATError) != auth.LSATErrorExpiredToken {
+		t.Fatalf("expected expired token error header, got %q",
+			header.Get(auth.HeaderLSATError))
+	}
+
+	// An LSAT that was rejected for another reason should not be.
+	m.verifyErr = fmt.Errorf("nope")
+	header, err = a.FreshChallengeHeader(
+		newRequest(expiringMacHex), "test", 1,
+	)
+	if err != nil {
+		t.Fatalf("unable to create challenge: %v", err)
+	}
+	if header.Get(auth.HeaderLSATError) != "" {
+		t.Fatal("unexpected LSAT error header for unexpired LSAT")
+	}
+}
+
+// TestVerifyNonce tests that requests carrying an LSAT are only accepted once
+// with the same recent nonce if replay protection is enabled.
+func TestVerifyNonce(t *testing.T) {
+	testPreimage := "49349dfea4abed3cd14f6d356afa83de" +
+		"9787b609f088c8df09bacc7b4bd21b39"
+
+	// The nonces are tracked by the token ID, so we need a macaroon with
+	// a proper identifier.
+	var id bytes.Buffer
+	err := lsat.EncodeIdentifier(&id, &lsat.Identifier{
+		Version: lsat.LatestVersion,
+		TokenID: lsat.TokenID{1},
+	})
+	if err != nil {
+		t.Fatalf("unable to encode identifier: %v", err)
+	}
+	mac, err := macaroon.New(
+		[]byte("aabbccddeeff00112233445566778899"), id.Bytes(),
+		"aperture", macaroon.LatestVersion,
+	)
+	if err != nil {
+		t.Fatalf("unable to create macaroon: %v", err)
+	}
+	err = lsat.AddFirstPartyCaveats(mac, lsat.Caveat{
+		Condition: lsat.PreimageKey,
+		Value:     testPreimage,
+	})
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unable to serialize macaroon: %v", err)
+	}
+
+	newHeader := func(nonce string) *http.Header {
+		header := &http.Header{}
+		header.Set(lsat.HeaderMacaroon, hex.EncodeToString(macBytes))
+		if nonce != "" {
+			header.Set(lsat.HeaderNonce, nonce)
+		}
+		return header
+	}
+	newNonce := func(created time.Time) string {
+		nonce, err := lsat.NewNonce(created)
+		if err != nil {
+			t.Fatalf("unable to create nonce: %v", err)
+		}
+		return nonce
+	}
+
+	m := &mockMint{}
+	store := &mockNonceStore{used: make(map[string]time.Duration)}
+	a := auth.NewLsatAuthenticator(m, &mockChecker{}, nil)
+
+	// Without replay protection, nonces aren't required.
+	if err := a.VerifyNonce(newHeader(""), "test"); err != nil {
+		t.Fatalf("expected no nonce to be required, got %v", err)
+	}
+
+	a.EnableReplayProtection(store, time.Minute)
+
+	// Requests without an LSAT don't need a nonce, they are denied
+	// anyway.
+	if err := a.VerifyNonce(&http.Header{}, "test"); err != nil {
+		t.Fatalf("expected request without LSAT to pass, got %v", err)
+	}
+
+	nonce := newNonce(time.Now())
+	testCases := []struct {
+		id     string
+		header *http.Header
+		err    error
+	}{{
+		id:     "no nonce",
+		header: newHeader(""),
+		err:    auth.ErrInvalidNonce,
+	}, {
+		id:     "malformed nonce",
+		header: newHeader("foo"),
+		err:    auth.ErrInvalidNonce,
+	}, {
+		id:     "expired nonce",
+		header: newHeader(newNonce(time.Now().Add(-2 * time.Minute))),
+		err:    auth.ErrInvalidNonce,
+	}, {
+		id:     "nonce from the future",
+		header: newHeader(newNonce(time.Now().Add(2 * time.Minute))),
+		err:    auth.ErrInvalidNonce,
+	}, {
+		id:     "fresh nonce",
+		header: newHeader(nonce),
+	}, {
+		id:     "reused nonce",
+		header: newHeader(nonce),
+		err:    auth.ErrNonceReused,
+	}, {
+		id:     "other fresh nonce",
+		header: newHeader(newNonce(time.Now())),
+	}}
+	for _, testCase := range testCases {
+		err := a.VerifyNonce(testCase.header, "test")
+		if err != testCase.err {
+			t.Fatalf("test case %s failed. got %v expected %v",
+				testCase.id, err, testCase.err)
+		}
+	}
+
+	// Used nonces only need to be remembered until they expire.
+	for _, ttl := range store.used {
+		if ttl <= 0 || ttl > time.Minute {
+			t.Fatalf("unexpected nonce TTL %v", ttl)
+		}
+	}
+
+	// Invalid LSATs are left for Accept to deny.
+	m.verifyErr = fmt.Errorf("invalid")
+	if err := a.VerifyNonce(newHeader(nonce), "test"); err != nil {
+		t.Fatalf("expected invalid LSAT to pass, got %v", err)
+	}
+}
+
+// TestCookieAuth tests that LSATs sent in a cookie are only accepted if cookie
+// authentication is enabled.
+func TestCookieAuth(t *testing.T) {
+	var (
+		testPreimage = "49349dfea4abed3cd14f6d356afa83de" +
+			"9787b609f088c8df09bacc7b4bd21b39"
+		testMacBytes, _ = hex.DecodeString(
+			createDummyMacHex(testPreimage),
+		)
+		testMacBase64 = base64.StdEncoding.EncodeToString(
+			testMacBytes,
+		)
+	)
+
+	newHeader := func(cookie string) *http.Header {
+		return &http.Header{"Cookie": []string{cookie}}
+	}
+	validCookie := "theme=dark; lsat=" + testMacBase64 + ":" +
+		testPreimage
+
+	a := auth.NewLsatAuthenticator(&mockMint{}, &mockChecker{}, nil)
+	if a.Accept(newHeader(validCookie), "test") {
+		t.Fatal("cookie accepted without cookie auth enabled")
+	}
+
+	a.EnableCookieAuth("lsat")
+	if !a.Accept(newHeader(validCookie), "test") {
+		t.Fatal("valid cookie not accepted")
+	}
+
+	invalidCookies := []string{
+		"other=" + testMacBase64 + ":" + testPreimage,
+		"lsat=" + testMacBase64,
+		"lsat=foo:" + testPreimage,
+	}
+	for _, cookie := range invalidCookies {
+		if a.Accept(newHeader(cookie), "test") {
+			t.Fatalf("invalid cookie %q accepted", cookie)
+		}
+	}
+}
+
+// TestVerifySession tests that the LSATs of long-lived connections are verified
+// again without checking their invoice.
+func TestVerifySession(t *testing.T) {
+	testPreimage := "49349dfea4abed3cd14f6d356afa83de" +
+		"9787b609f088c8df09bacc7b4bd21b39"
+	header := &http.Header{
+		lsat.HeaderMacaroon: []string{createDummyMacHex(testPreimage)},
+	}
+
+	m := &mockMint{}
+	checker := &mockChecker{err: fmt.Errorf("invoice not settled")}
+	a := auth.NewLsatAuthenticator(m, checker, nil)
+
+	if err := a.VerifySession(header, "test"); err != nil {
+		t.Fatalf("valid session rejected: %v", err)
+	}
+	if err := a.VerifySession(&http.Header{}, "test"); err == nil {
+		t.Fatal("session without LSAT accepted")
+	}
+
+	// Once the LSAT expired or was revoked, the session is rejected.
+	m.verifyErr = mint.ErrTokenExpired
+	if err := a.VerifySession(header, "test"); err == nil {
+		t.Fatal("session with expired LSAT accepted")
+	}
+}
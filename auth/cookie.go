@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+// EnableCookieAuth accepts LSATs sent in the cookie with the given name by
+// clients that don't send one in the header fields. Browser clients can't set
+// the Authorization header for cross-origin requests, but they can send
+// cookies.
+func (l *LsatAuthenticator) EnableCookieAuth(name string) {
+	l.cookieName = name
+}
+
+// fromHeader extracts the LSAT from the given header fields, falling back to
+// the auth cookie if it is enabled.
+func (l *LsatAuthenticator) fromHeader(header *http.Header) (
+	*macaroon.Macaroon, lntypes.Preimage, error) {
+
+	mac, preimage, err := lsat.FromHeader(header)
+	if err == nil || l.cookieName == "" {
+		return mac, preimage, err
+	}
+
+	return lsat.FromCookie(header, l.cookieName)
+}
@@ -38,6 +38,18 @@ type Minter interface {
 
 	// VerifyLSAT attempts to verify an LSAT with the given parameters.
 	VerifyLSAT(context.Context, *mint.VerificationParams) error
+
+	// ConsumeBudget uses up one request of the budget of a verified LSAT.
+	// LSATs without a budget can be used for an unlimited number of
+	// requests.
+	ConsumeBudget(context.Context, *macaroon.Macaroon) error
+}
+
+// BlockHeightSource is an entity that is able to tell the current block height
+// of the chain.
+type BlockHeightSource interface {
+	// BlockHeight returns the current block height of the chain.
+	BlockHeight(context.Context) (uint32, error)
 }
 
 // InvoiceChecker is an entity that is able to check the status of an invoice,
@@ -0,0 +1,586 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	// Register the hash functions of the supported signature algorithms.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+const (
+	// DefaultJWKSCacheTTL is the default time the key set fetched from
+	// the JWKS URL is cached for.
+	DefaultJWKSCacheTTL = time.Hour
+
+	// bearerScheme is the authentication scheme of JSON Web Tokens in the
+	// Authorization header.
+	bearerScheme = "Bearer"
+
+	// jwksFetchTimeout is the maximum time we wait for the key set to be
+	// fetched.
+	jwksFetchTimeout = 10 * time.Second
+
+	// jwksMaxSize is the maximum size of a key set we accept.
+	jwksMaxSize = 1 << 20
+
+	// jwksMinRefreshInterval is the minimum time between two fetches of
+	// the key set because a token was signed with an unknown key, so
+	// clients can't make us hammer the JWKS URL.
+	jwksMinRefreshInterval = time.Minute
+
+	// jwksRetryInterval is the time we wait after failing to fetch the key
+	// set before we try again.
+	jwksRetryInterval = 10 * time.Second
+
+	// jwtLeeway is the clock skew tolerated when checking the expiry and
+	// not-before times of tokens.
+	jwtLeeway = 30 * time.Second
+)
+
+var (
+	// errNoBearerToken is returned if a request doesn't carry a JSON Web
+	// Token.
+	errNoBearerToken = errors.New("no bearer token provided")
+
+	// jwtAlgorithms are the supported signature algorithms. Only
+	// asymmetric algorithms are supported, as the keys are public.
+	jwtAlgorithms = map[string]jwtAlgorithm{
+		"RS256": {hash: crypto.SHA256, keyType: "RSA"},
+		"RS384": {hash: crypto.SHA384, keyType: "RSA"},
+		"RS512": {hash: crypto.SHA512, keyType: "RSA"},
+		"PS256": {hash: crypto.SHA256, keyType: "RSA"},
+		"PS384": {hash: crypto.SHA384, keyType: "RSA"},
+		"PS512": {hash: crypto.SHA512, keyType: "RSA"},
+		"ES256": {hash: crypto.SHA256, keyType: "EC", curve: "P-256"},
+		"ES384": {hash: crypto.SHA384, keyType: "EC", curve: "P-384"},
+		"ES512": {hash: crypto.SHA512, keyType: "EC", curve: "P-521"},
+	}
+)
+
+// jwtAlgorithm is a signature algorithm of JSON Web Tokens.
+type jwtAlgorithm struct {
+	// hash is the hash function the algorithm uses.
+	hash crypto.Hash
+
+	// keyType is the type of the keys the algorithm signs with.
+	keyType string
+
+	// curve is the curve of the EC keys the algorithm signs with.
+	curve string
+}
+
+// JWTConfig is the configuration of the authentication of requests with JSON
+// Web Tokens issued by an external identity provider.
+type JWTConfig struct {
+	// JWKSURL is the URL the JSON Web Key Set with the public keys of the
+	// token issuer is fetched from.
+	JWKSURL string `long:"jwksurl" description:"The URL of the JSON Web Key Set with the public keys the tokens of services with authmode jwt must be signed with"`
+
+	// CacheTTL is the time the fetched key set is cached for before it is
+	// fetched again.
+	CacheTTL time.Duration `long:"cachettl" description:"The time the key set is cached for. Keys the tokens are signed with that aren't in the cached set are fetched at most once a minute. Defaults to 1h."`
+
+	// Issuer, if set, is the issuer tokens must be issued by.
+	Issuer string `long:"issuer" description:"If set, only tokens with this issuer (iss claim) are accepted"`
+
+	// Audience, if set, is the audience tokens must be issued for.
+	Audience string `long:"audience" description:"If set, only tokens issued for this audience (aud claim) are accepted"`
+}
+
+// jwtHeader is the JOSE header of a JSON Web Token.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jwtClaims are the registered claims of a JSON Web Token we check.
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+}
+
+// hasAudience returns true if the audience claim, which is either a single
+// string or an array of strings, contains the given audience.
+func (c *jwtClaims) hasAudience(audience string) bool {
+	var single string
+	if err := json.Unmarshal(c.Audience, &single); err == nil {
+		return single == audience
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(c.Audience, &multiple); err != nil {
+		return false
+	}
+	for _, aud := range multiple {
+		if aud == audience {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jsonWebKey is a public key of a JSON Web Key Set.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+
+	// N and E are the modulus and exponent of RSA keys.
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// Curve, X and Y are the curve and coordinates of EC keys.
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+// verificationKey is a key of the key set tokens are verified with.
+type verificationKey struct {
+	// key is the parsed public key.
+	key crypto.PublicKey
+
+	// jwk is the key as found in the key set.
+	jwk jsonWebKey
+}
+
+// allows returns an error if tokens signed with the given algorithm can't be
+// verified with the key. The algorithm must match the type and curve of the
+// key, as well as the algorithm the key is restricted to, if any.
+func (k *verificationKey) allows(alg string) error {
+	algorithm, ok := jwtAlgorithms[alg]
+	switch {
+	case !ok:
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+
+	case algorithm.keyType != k.jwk.KeyType ||
+		algorithm.curve != "" && algorithm.curve != k.jwk.Curve:
+
+		return fmt.Errorf("algorithm %q can't be used with %s key %q",
+			alg, k.jwk.KeyType, k.jwk.KeyID)
+
+	case k.jwk.Algorithm != "" && k.jwk.Algorithm != alg:
+		return fmt.Errorf("key %q is restricted to algorithm %q",
+			k.jwk.KeyID, k.jwk.Algorithm)
+	}
+
+	return nil
+}
+
+// publicKey parses the public key.
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch k.KeyType {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %v", err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() ||
+			exponent.Int64() > 1<<31-1 {
+
+			return nil, errors.New("invalid RSA key")
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exponent.Int64()),
+		}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %v", err)
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %v", err)
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point not on curve")
+		}
+
+		return key, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
+
+// JWTAuthenticator authenticates requests with JSON Web Tokens sent in the
+// Authorization header as bearer tokens. The tokens must be signed with one of
+// the keys of the JSON Web Key Set fetched from the configured URL. It is meant
+// for services that only need their requests authenticated and don't charge
+// for them.
+type JWTAuthenticator struct {
+	cfg JWTConfig
+
+	client *http.Client
+
+	// now returns the current time. It can be replaced in tests.
+	now func() time.Time
+
+	// mtx guards the cached key set and the state of fetching it. It is
+	// not held while the key set is fetched, so requests can keep using
+	// the cached keys while the JWKS URL is slow to respond.
+	mtx         sync.Mutex
+	keys        map[string]*verificationKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetchErr    error
+
+	// fetchDone is closed once the fetch of the key set that is currently
+	// in progress finished. It is nil if no fetch is in progress.
+	fetchDone chan struct{}
+}
+
+// A compile time flag to ensure the JWTAuthenticator satisfies the
+// Authenticator and SessionVerifier interfaces.
+var _ Authenticator = (*JWTAuthenticator)(nil)
+var _ SessionVerifier = (*JWTAuthenticator)(nil)
+
+// NewJWTAuthenticator creates a new authenticator that accepts the JSON Web
+// Tokens signed with the keys of the key set found at the configured URL. The
+// key set is fetched lazily, the first time a token is verified.
+func NewJWTAuthenticator(cfg *JWTConfig) *JWTAuthenticator {
+	authCfg := *cfg
+	if authCfg.CacheTTL == 0 {
+		authCfg.CacheTTL = DefaultJWKSCacheTTL
+	}
+
+	return &JWTAuthenticator{
+		cfg:    authCfg,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		now:    time.Now,
+	}
+}
+
+// Accept returns whether or not the header contains a valid JSON Web Token.
+// The same tokens are accepted for all services.
+//
+// NOTE: This is part of the Authenticator interface.
+func (j *JWTAuthenticator) Accept(header *http.Header, _ string) bool {
+	if err := j.VerifySession(header, ""); err != nil {
+		log.Debugf("Deny: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// FreshChallengeHeader returns a header asking the client to authenticate with
+// a bearer token. Clients can't get a token from us, they need to obtain one
+// from the token issuer.
+//
+// NOTE: This is part of the Authenticator interface.
+func (j *JWTAuthenticator) FreshChallengeHeader(r *http.Request,
+	serviceName string, _ int64) (http.Header, error) {
+
+	challenge := fmt.Sprintf("%s realm=%q", bearerScheme, serviceName)
+	if _, err := bearerToken(&r.Header); err == nil {
+		challenge += `, error="invalid_token"`
+	}
+
+	header := make(http.Header)
+	header.Set("WWW-Authenticate", challenge)
+
+	return header, nil
+}
+
+// VerifySession returns an error if the header doesn't contain a valid JSON Web
+// Token, for example because it expired in the meantime.
+//
+// NOTE: This is part of the SessionVerifier interface.
+func (j *JWTAuthenticator) VerifySession(header *http.Header, _ string) error {
+	token, err := bearerToken(header)
+	if err != nil {
+		return err
+	}
+
+	return j.verify(token)
+}
+
+// bearerToken extracts the bearer token from the Authorization header.
+func bearerToken(header *http.Header) (string, error) {
+	parts := strings.SplitN(header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], bearerScheme) {
+		return "", errNoBearerToken
+	}
+
+	token := strings.TrimSpace(parts[1])
+	if token == "" {
+		return "", errNoBearerToken
+	}
+
+	return token, nil
+}
+
+// verify checks the signature and the claims of the given compact serialized
+// JSON Web Token.
+func (j *JWTAuthenticator) verify(token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("invalid token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid token signature: %v", err)
+	}
+
+	key, err := j.key(header.KeyID)
+	if err != nil {
+		return err
+	}
+	if err := key.allows(header.Algorithm); err != nil {
+		return err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	err = verifySignature(header.Algorithm, key.key, signed, signature)
+	if err != nil {
+		return err
+	}
+
+	// Only look at the claims once we know we issued them.
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return fmt.Errorf("invalid token claims: %v", err)
+	}
+
+	now := j.now()
+	switch {
+	case claims.ExpiresAt == nil:
+		return errors.New("token has no expiry")
+
+	case now.Add(-jwtLeeway).Unix() >= *claims.ExpiresAt:
+		return errors.New("token expired")
+
+	case claims.NotBefore != nil &&
+		now.Add(jwtLeeway).Unix() < *claims.NotBefore:
+
+		return errors.New("token not valid yet")
+
+	case j.cfg.Issuer != "" && claims.Issuer != j.cfg.Issuer:
+		return fmt.Errorf("unexpected token issuer %q", claims.Issuer)
+
+	case j.cfg.Audience != "" && !claims.hasAudience(j.cfg.Audience):
+		return errors.New("token not issued for our audience")
+	}
+
+	return nil
+}
+
+// decodeSegment decodes the base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks the signature of a token signed with the given
+// algorithm. The algorithm must be allowed for the key.
+func verifySignature(alg string, key crypto.PublicKey, signed,
+	signature []byte) error {
+
+	hash := jwtAlgorithms[alg].hash
+	hasher := hash.New()
+	_, _ = hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	errInvalid := errors.New("invalid token signature")
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(pub, hash, digest, signature, nil)
+		default:
+			return fmt.Errorf("algorithm %q can't be used with "+
+				"RSA key", alg)
+		}
+		if err != nil {
+			return errInvalid
+		}
+
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return errInvalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errInvalid
+		}
+
+	default:
+		return errInvalid
+	}
+
+	return nil
+}
+
+// key returns the key with the given ID from the key set. The key set is
+// fetched again once the cached one expired, or if it doesn't contain the key,
+// as the issuer might have rotated its keys. After a failed attempt to fetch
+// it, we wait for jwksRetryInterval before trying again.
+func (j *JWTAuthenticator) key(keyID string) (*verificationKey, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	now := j.now()
+	key, ok := j.keys[keyID]
+	switch {
+	// Another request is fetching the key set already. We only wait for
+	// it if we don't have any keys yet.
+	case j.fetchDone != nil:
+		if j.keys == nil {
+			done := j.fetchDone
+			j.mtx.Unlock()
+			<-done
+			j.mtx.Lock()
+		}
+
+	// We recently failed to fetch the key set, so we back off and keep
+	// using the keys we have.
+	case j.fetchErr != nil && now.Sub(j.attemptedAt) < jwksRetryInterval:
+
+	case j.keys == nil || now.Sub(j.fetchedAt) >= j.cfg.CacheTTL ||
+		(!ok && now.Sub(j.attemptedAt) >= jwksMinRefreshInterval):
+
+		j.refreshKeys(now)
+	}
+
+	key, ok = j.keys[keyID]
+	switch {
+	case ok:
+		return key, nil
+
+	case j.keys == nil:
+		return nil, fmt.Errorf("unable to fetch JWKS: %v", j.fetchErr)
+
+	default:
+		return nil, fmt.Errorf("unknown signing key %q", keyID)
+	}
+}
+
+// refreshKeys fetches the key set and caches it. We keep using the keys we
+// have while the JWKS URL can't be reached.
+//
+// NOTE: The mtx must be held when calling this method. It is released while
+// the key set is fetched.
+func (j *JWTAuthenticator) refreshKeys(now time.Time) {
+	done := make(chan struct{})
+	j.fetchDone = done
+	j.attemptedAt = now
+
+	j.mtx.Unlock()
+	keys, err := j.fetchKeys()
+	j.mtx.Lock()
+
+	close(done)
+	j.fetchDone = nil
+	j.fetchErr = err
+
+	switch {
+	case err != nil && j.keys != nil:
+		log.Errorf("Unable to refresh JWKS: %v", err)
+
+	case err == nil:
+		j.keys = keys
+		j.fetchedAt = now
+	}
+}
+
+// fetchKeys fetches the key set from the configured URL. Keys of unsupported
+// types and keys that aren't meant for signatures are skipped.
+func (j *JWTAuthenticator) fetchKeys() (map[string]*verificationKey, error) {
+	resp, err := j.client.Get(j.cfg.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return nil, fmt.Errorf("invalid key set: %v", err)
+	}
+
+	keys := make(map[string]*verificationKey, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Warnf("Skipping JWKS key %q: %v", jwk.KeyID, err)
+			continue
+		}
+		keys[jwk.KeyID] = &verificationKey{key: key, jwk: jwk}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,342 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// b64 encodes the given data in unpadded base64url.
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken creates a JSON Web Token with the given claims, signed with the
+// given key.
+func signToken(t *testing.T, alg, kid string, key crypto.Signer,
+	claims map[string]interface{}) string {
+
+	header, err := json.Marshal(map[string]string{
+		"alg": alg, "kid": kid, "typ": "JWT",
+	})
+	if err != nil {
+		t.Fatalf("unable to encode header: %v", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("unable to encode claims: %v", err)
+	}
+
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(
+			rand.Reader, k, crypto.SHA256, digest[:],
+		)
+
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	if err != nil {
+		t.Fatalf("unable to sign token: %v", err)
+	}
+
+	return signed + "." + b64(signature)
+}
+
+// TestJWTAuthenticator makes sure only tokens signed with a key of the key set
+// that carry the expected claims are accepted.
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate EC key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate EC key: %v", err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate EC key: %v", err)
+	}
+
+	var fetches int32
+	jwks := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kty": "RSA",
+					"kid": "rsa",
+					"use": "sig",
+					"n":   b64(rsaKey.N.Bytes()),
+					"e": b64(big.NewInt(
+						int64(rsaKey.E),
+					).Bytes()),
+				}, {
+					"kty": "RSA",
+					"kid": "rsa-pss",
+					"alg": "PS256",
+					"n":   b64(rsaKey.N.Bytes()),
+					"e": b64(big.NewInt(
+						int64(rsaKey.E),
+					).Bytes()),
+				}, {
+					"kty": "EC",
+					"kid": "ec",
+					"crv": "P-256",
+					"x":   b64(ecKey.X.Bytes()),
+					"y":   b64(ecKey.Y.Bytes()),
+				}, {
+					"kty": "EC",
+					"kid": "p384",
+					"crv": "P-384",
+					"x":   b64(p384Key.X.Bytes()),
+					"y":   b64(p384Key.Y.Bytes()),
+				}},
+			})
+		},
+	))
+	defer jwks.Close()
+
+	authenticator := auth.NewJWTAuthenticator(&auth.JWTConfig{
+		JWKSURL:  jwks.URL,
+		Issuer:   "issuer",
+		Audience: "aperture",
+	})
+
+	type claimSet = map[string]interface{}
+
+	now := time.Now()
+	claims := func(modify func(claimSet)) claimSet {
+		c := claimSet{
+			"iss": "issuer",
+			"aud": []string{"other", "aperture"},
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+
+	testCases := []struct {
+		name   string
+		token  string
+		accept bool
+	}{{
+		name:   "valid RSA token",
+		token:  signToken(t, "RS256", "rsa", rsaKey, claims(nil)),
+		accept: true,
+	}, {
+		name:   "valid EC token",
+		token:  signToken(t, "ES256", "ec", ecKey, claims(nil)),
+		accept: true,
+	}, {
+		name:  "unknown key",
+		token: signToken(t, "ES256", "other", otherKey, claims(nil)),
+	}, {
+		name:  "wrong key",
+		token: signToken(t, "ES256", "ec", otherKey, claims(nil)),
+	}, {
+		name:  "algorithm mismatch",
+		token: signToken(t, "ES256", "rsa", ecKey, claims(nil)),
+	}, {
+		name:  "algorithm of other curve",
+		token: signToken(t, "ES256", "p384", p384Key, claims(nil)),
+	}, {
+		name:  "key restricted to other algorithm",
+		token: signToken(t, "RS256", "rsa-pss", rsaKey, claims(nil)),
+	}, {
+		name: "expired",
+		token: signToken(t, "RS256", "rsa", rsaKey, claims(
+			func(c claimSet) {
+				c["exp"] = now.Add(-time.Hour).Unix()
+			},
+		)),
+	}, {
+		name: "no expiry",
+		token: signToken(t, "RS256", "rsa", rsaKey, claims(
+			func(c claimSet) {
+				delete(c, "exp")
+			},
+		)),
+	}, {
+		name: "not valid yet",
+		token: signToken(t, "RS256", "rsa", rsaKey, claims(
+			func(c claimSet) {
+				c["nbf"] = now.Add(time.Hour).Unix()
+			},
+		)),
+	}, {
+		name: "wrong issuer",
+		token: signToken(t, "RS256", "rsa", rsaKey, claims(
+			func(c claimSet) {
+				c["iss"] = "mallory"
+			},
+		)),
+	}, {
+		name: "wrong audience",
+		token: signToken(t, "RS256", "rsa", rsaKey, claims(
+			func(c claimSet) {
+				c["aud"] = "other"
+			},
+		)),
+	}, {
+		name: "unsigned",
+		token: b64([]byte(`{"alg":"none"}`)) + "." +
+			b64([]byte(`{}`)) + ".",
+	}}
+
+	for _, tc := range testCases {
+		header := http.Header{}
+		header.Set("Authorization", "Bearer "+tc.token)
+
+		accept := authenticator.Accept(&header, "service")
+		if accept != tc.accept {
+			t.Fatalf("%s: expected accept %v, got %v", tc.name,
+				tc.accept, accept)
+		}
+	}
+
+	// The key set is cached, and tokens signed with an unknown key only
+	// cause it to be fetched again once in a while.
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("expected key set to be fetched once, got %d", n)
+	}
+
+	// Requests without a token are challenged to send one, those with an
+	// invalid one are told so.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	header, err := authenticator.FreshChallengeHeader(req, "service", 0)
+	if err != nil {
+		t.Fatalf("unable to create challenge: %v", err)
+	}
+	expected := `Bearer realm="service"`
+	if challenge := header.Get("WWW-Authenticate"); challenge != expected {
+		t.Fatalf("unexpected challenge %q", challenge)
+	}
+
+	req.Header.Set("Authorization", "Bearer invalid")
+	header, err = authenticator.FreshChallengeHeader(req, "service", 0)
+	if err != nil {
+		t.Fatalf("unable to create challenge: %v", err)
+	}
+	expected += `, error="invalid_token"`
+	if challenge := header.Get("WWW-Authenticate"); challenge != expected {
+		t.Fatalf("unexpected challenge %q", challenge)
+	}
+}
+
+// TestJWTAuthenticatorJWKSOutage makes sure the cached keys keep being used
+// without delay while the JWKS URL is slow or unreachable, and that it isn't
+// fetched on every request after a failure.
+func TestJWTAuthenticatorJWKSOutage(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate EC key: %v", err)
+	}
+
+	var fetches int32
+	block := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Only the first fetch succeeds, the next one hangs
+			// until it is unblocked and then fails.
+			if atomic.AddInt32(&fetches, 1) > 1 {
+				<-block
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kty": "EC",
+					"kid": "ec",
+					"crv": "P-256",
+					"x":   b64(key.X.Bytes()),
+					"y":   b64(key.Y.Bytes()),
+				}},
+			})
+		},
+	))
+	defer jwks.Close()
+
+	authenticator := auth.NewJWTAuthenticator(&auth.JWTConfig{
+		JWKSURL:  jwks.URL,
+		CacheTTL: 100 * time.Millisecond,
+	})
+	token := signToken(t, "ES256", "ec", key, map[string]interface{}{
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	accept := func() bool {
+		header := http.Header{}
+		header.Set("Authorization", "Bearer "+token)
+
+		return authenticator.Accept(&header, "service")
+	}
+
+	if !accept() {
+		t.Fatal("valid token not accepted")
+	}
+
+	// Once the cache expired, one request fetches the key set again. All
+	// others are accepted with the cached keys in the meantime.
+	time.Sleep(100 * time.Millisecond)
+	refreshed := make(chan bool)
+	go func() {
+		refreshed <- accept()
+	}()
+	for atomic.LoadInt32(&fetches) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if !accept() {
+			t.Fatal("valid token not accepted during refresh")
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("requests blocked by key set refresh")
+	}
+
+	// The failed refresh doesn't reject the token, and we back off before
+	// fetching the key set again.
+	close(block)
+	if !<-refreshed {
+		t.Fatal("valid token not accepted after failed refresh")
+	}
+	for i := 0; i < 10; i++ {
+		if !accept() {
+			t.Fatal("valid token not accepted after failed refresh")
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("expected key set to be fetched twice, got %d", n)
+	}
+}
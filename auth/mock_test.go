@@ -2,6 +2,7 @@ package auth_test
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/lightninglabs/aperture/auth"
@@ -13,6 +14,12 @@ import (
 )
 
 type mockMint struct {
+	verifyErr error
+	budgetErr error
+
+	// verifyDelay simulates the time a lookup in the secret store takes.
+	verifyDelay time.Duration
+	verifyCalls int32
 }
 
 var _ auth.Minter = (*mockMint)(nil)
@@ -20,11 +27,21 @@ var _ auth.Minter = (*mockMint)(nil)
 func (m *mockMint) MintLSAT(_ context.Context,
 	services ...lsat.Service) (*macaroon.Macaroon, string, error) {
 
-	return nil, "", nil
+	mac, err := macaroon.New(
+		[]byte("aabbccddeeff00112233445566778899"), []byte("AA=="),
+		"aperture", macaroon.LatestVersion,
+	)
+	return mac, "lnsb1...", err
 }
 
 func (m *mockMint) VerifyLSAT(_ context.Context, p *mint.VerificationParams) error {
-	return nil
+	atomic.AddInt32(&m.verifyCalls, 1)
+	time.Sleep(m.verifyDelay)
+	return m.verifyErr
+}
+
+func (m *mockMint) ConsumeBudget(context.Context, *macaroon.Macaroon) error {
+	return m.budgetErr
 }
 
 type mockChecker struct {
@@ -38,3 +55,50 @@ func (m *mockChecker) VerifyInvoiceStatus(lntypes.Hash,
 
 	return m.err
 }
+
+type mockNonceStore struct {
+	used map[string]time.Duration
+}
+
+var _ auth.NonceStore = (*mockNonceStore)(nil)
+
+func (m *mockNonceStore) UseNonce(_ context.Context, id lsat.TokenID,
+	nonce string, ttl time.Duration) error {
+
+	key := id.String() + "/" + nonce
+	if _, ok := m.used[key]; ok {
+		return auth.ErrNonceReused
+	}
+	m.used[key] = ttl
+
+	return nil
+}
+
+type mockPoWStore struct {
+	secret [32]byte
+	used   map[string]time.Duration
+}
+
+var _ auth.PoWStore = (*mockPoWStore)(nil)
+
+func newMockPoWStore() *mockPoWStore {
+	return &mockPoWStore{
+		secret: [32]byte{1, 2, 3},
+		used:   make(map[string]time.Duration),
+	}
+}
+
+func (m *mockPoWStore) PoWSecret(context.Context) ([32]byte, error) {
+	return m.secret, nil
+}
+
+func (m *mockPoWStore) UsePoWChallenge(_ context.Context, challenge string,
+	ttl time.Duration) error {
+
+	if _, ok := m.used[challenge]; ok {
+		return auth.ErrPoWReused
+	}
+	m.used[challenge] = ttl
+
+	return nil
+}
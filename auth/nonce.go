@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+var (
+	// ErrNonceReused is returned if a request carries a nonce that was
+	// already used with the same LSAT, which means the request is being
+	// replayed.
+	ErrNonceReused = errors.New("nonce reuse")
+
+	// ErrInvalidNonce is returned if a request carries an LSAT but no
+	// nonce or one that is malformed or outside of the nonce window.
+	ErrInvalidNonce = errors.New("invalid nonce")
+)
+
+// NonceStore is an entity that keeps track of the nonces that were used with
+// each LSAT.
+type NonceStore interface {
+	// UseNonce records the nonce as used with the LSAT with the given ID
+	// for the given duration. If it was already used, ErrNonceReused is
+	// returned.
+	UseNonce(context.Context, lsat.TokenID, string, time.Duration) error
+}
+
+// NonceVerifier is an authenticator that protects LSATs from being replayed by
+// requiring a unique nonce with every request.
+type NonceVerifier interface {
+	// VerifyNonce makes sure the nonce of a request carrying an LSAT for
+	// the given service wasn't used before and records it as used.
+	VerifyNonce(*http.Header, string) error
+}
+
+// A compile time flag to ensure the LsatAuthenticator satisfies the
+// NonceVerifier interface.
+var _ NonceVerifier = (*LsatAuthenticator)(nil)
+
+// EnableReplayProtection requires every request carrying an LSAT to also carry
+// a nonce that is used only once. Nonces are accepted for the given window
+// around the time they were created at and remembered in the store for as long
+// as they would be accepted.
+func (l *LsatAuthenticator) EnableReplayProtection(store NonceStore,
+	window time.Duration) {
+
+	l.nonces = store
+	l.nonceWindow = window
+}
+
+// VerifyNonce makes sure the nonce of a request carrying an LSAT for the given
+// service wasn't used before and records it as used. Requests without a valid
+// LSAT are left for Accept to deny.
+//
+// NOTE: This is part of the NonceVerifier interface.
+func (l *LsatAuthenticator) VerifyNonce(header *http.Header,
+	serviceName string) error {
+
+	if l.nonces == nil {
+		return nil
+	}
+
+	mac, preimage, err := l.fromHeader(header)
+	if err != nil {
+		return nil
+	}
+
+	// Only remember the nonces of genuine LSATs, so clients can't fill
+	// the store with made up ones.
+	if err := l.verifyLSAT(mac, preimage, serviceName); err != nil {
+		return nil
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return nil
+	}
+
+	nonce := header.Get(lsat.HeaderNonce)
+	if nonce == "" {
+		log.Debugf("Deny: No nonce provided")
+		return ErrInvalidNonce
+	}
+	created, err := lsat.ParseNonce(nonce)
+	if err != nil {
+		log.Debugf("Deny: %v", err)
+		return ErrInvalidNonce
+	}
+
+	// A nonce needs to be remembered until it expires, which also covers
+	// nonces of clients whose clock is slightly ahead of ours.
+	now := time.Now()
+	expiry := created.Add(l.nonceWindow)
+	if created.After(now.Add(l.nonceWindow)) || !now.Before(expiry) {
+		log.Debugf("Deny: Nonce created at %v outside of window",
+			created)
+		return ErrInvalidNonce
+	}
+
+	return l.nonces.UseNonce(
+		context.Background(), id.TokenID, nonce, expiry.Sub(now),
+	)
+}
@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPoWDifficulty is the default number of leading zero bits the
+	// hash of a proof-of-work solution must have. Finding a solution takes
+	// about a million hashes.
+	DefaultPoWDifficulty = 20
+
+	// MaxPoWDifficulty is the highest supported proof-of-work difficulty.
+	MaxPoWDifficulty = 40
+
+	// powScheme is the authentication scheme of proof-of-work challenges
+	// and their solutions.
+	powScheme = "PoW"
+
+	// powChallengeTimeout is the time a client has to solve a
+	// proof-of-work challenge and use the solution.
+	powChallengeTimeout = 5 * time.Minute
+
+	// powRandomSize is the number of random bytes that make every
+	// proof-of-work challenge unique.
+	powRandomSize = 16
+
+	// powMACSize is the number of bytes of the MAC that authenticates a
+	// proof-of-work challenge.
+	powMACSize = 16
+
+	// powPayloadSize is the size of the signed part of a proof-of-work
+	// challenge: the random bytes, the expiry and the difficulty.
+	powPayloadSize = powRandomSize + 8 + 1
+)
+
+var (
+	// ErrPoWReused is returned if the solution of a proof-of-work
+	// challenge was already used.
+	ErrPoWReused = errors.New("proof-of-work solution already used")
+
+	// errInvalidPoW is returned if a proof-of-work solution isn't valid.
+	errInvalidPoW = errors.New("invalid proof of work")
+)
+
+// PoWStore is an entity that keeps the state of the proof-of-work fallback, so
+// it is shared by all aperture instances.
+type PoWStore interface {
+	// PoWSecret returns the secret that authenticates proof-of-work
+	// challenges, creating it if there is none yet.
+	PoWSecret(context.Context) ([32]byte, error)
+
+	// UsePoWChallenge records the solution of the given challenge as used
+	// for the given duration. If it was already used, ErrPoWReused is
+	// returned.
+	UsePoWChallenge(context.Context, string, time.Duration) error
+}
+
+// powFallback issues hashcash-style proof-of-work challenges instead of LSAT
+// challenges while the Lightning backend is unavailable, so services stay
+// accessible during brief outages.
+//
+// A challenge is a random value with an expiry and a difficulty that is signed
+// for a single service with a secret shared by all aperture instances, so any
+// of them can verify it. A client solves it
+// by finding a nonce for which the SHA-256 hash of "<challenge>:<nonce>" starts
+// with the given number of zero bits. Every solution grants access for exactly
+// one request.
+type powFallback struct {
+	// available returns true if LSAT challenges can be issued.
+	available func() bool
+
+	difficulty uint8
+
+	// secret is the key of the MACs that authenticate the challenges we
+	// issued.
+	secret [32]byte
+
+	// store keeps the solutions that were used.
+	store PoWStore
+
+	// now returns the current time. It can be replaced in tests.
+	now func() time.Time
+}
+
+// EnablePoWFallback issues proof-of-work challenges of the given difficulty,
+// the number of leading zero bits the hash of a solution must have, instead of
+// LSAT challenges while the given function reports the Lightning backend as
+// unavailable or an LSAT can't be minted. Solved challenges are accepted for a
+// single request. The secret of the challenges and their used solutions are
+// kept in the given store.
+func (l *LsatAuthenticator) EnablePoWFallback(available func() bool,
+	difficulty uint8, store PoWStore) error {
+
+	if difficulty == 0 || difficulty > MaxPoWDifficulty {
+		return fmt.Errorf("proof-of-work difficulty must be between 1 "+
+			"and %d", MaxPoWDifficulty)
+	}
+
+	secret, err := store.PoWSecret(context.Background())
+	if err != nil {
+		return fmt.Errorf("unable to get proof-of-work secret: %v", err)
+	}
+	l.pow = &powFallback{
+		available:  available,
+		difficulty: difficulty,
+		secret:     secret,
+		store:      store,
+		now:        time.Now,
+	}
+
+	return nil
+}
+
+// mac returns the MAC of the given challenge payload for the given service.
+func (p *powFallback) mac(payload []byte, serviceName string) []byte {
+	h := hmac.New(sha256.New, p.secret[:])
+	_, _ = h.Write(payload)
+	_, _ = h.Write([]byte(serviceName))
+
+	return h.Sum(nil)[:powMACSize]
+}
+
+// newChallenge returns a new challenge for the given service.
+func (p *powFallback) newChallenge(serviceName string) (string, error) {
+	payload := make([]byte, powPayloadSize)
+	if _, err := rand.Read(payload[:powRandomSize]); err != nil {
+		return "", err
+	}
+	expiry := p.now().Add(powChallengeTimeout).Unix()
+	binary.BigEndian.PutUint64(payload[powRandomSize:], uint64(expiry))
+	payload[powPayloadSize-1] = p.difficulty
+
+	challenge := append(payload, p.mac(payload, serviceName)...)
+	return base64.RawURLEncoding.EncodeToString(challenge), nil
+}
+
+// challengeHeader returns the header of a new challenge for the given service.
+func (p *powFallback) challengeHeader(r *http.Request,
+	serviceName string) (http.Header, error) {
+
+	challenge, err := p.newChallenge(serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create proof-of-work "+
+			"challenge: %v", err)
+	}
+
+	str := fmt.Sprintf("%s challenge=\"%s\", difficulty=\"%d\"",
+		powScheme, challenge, p.difficulty)
+	header := r.Header
+	header.Set("WWW-Authenticate", str)
+
+	log.Debugf("Created new proof-of-work challenge header: [%s]", str)
+	return header, nil
+}
+
+// powFromHeader extracts a proof-of-work challenge and the nonce solving it
+// from the Authorization header field of the form "PoW <challenge>:<nonce>".
+func powFromHeader(header *http.Header) (string, string, bool) {
+	value := header.Get("Authorization")
+	if !strings.HasPrefix(value, powScheme+" ") {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(
+		strings.TrimPrefix(value, powScheme+" "), ":", 2,
+	)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// verify makes sure the given nonce solves the given challenge we issued for
+// the given service and that the solution wasn't used before.
+func (p *powFallback) verify(challenge, nonce, serviceName string) error {
+	raw, err := base64.RawURLEncoding.DecodeString(challenge)
+	if err != nil || len(raw) != powPayloadSize+powMACSize {
+		return errInvalidPoW
+	}
+
+	payload := raw[:powPayloadSize]
+	if !hmac.Equal(raw[powPayloadSize:], p.mac(payload, serviceName)) {
+		return errInvalidPoW
+	}
+
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(
+		payload[powRandomSize:],
+	)), 0)
+	now := p.now()
+	if !now.Before(expiry) {
+		return fmt.Errorf("proof-of-work challenge expired")
+	}
+
+	difficulty := int(payload[powPayloadSize-1])
+	hash := sha256.Sum256([]byte(challenge + ":" + nonce))
+	if leadingZeroBits(hash[:]) < difficulty {
+		return errInvalidPoW
+	}
+
+	// The solution must be remembered until the challenge expires.
+	return p.store.UsePoWChallenge(
+		context.Background(), challenge, expiry.Sub(now),
+	)
+}
+
+// leadingZeroBits returns the number of leading zero bits of the given data.
+func leadingZeroBits(data []byte) int {
+	zeros := 0
+	for _, b := range data {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+
+	return zeros
+}
+
+// SolvePoW returns a nonce that solves the given proof-of-work challenge of
+// the given difficulty. It is meant for clients and tests.
+func SolvePoW(challenge string, difficulty int) string {
+	var buf bytes.Buffer
+	for nonce := uint64(0); ; nonce++ {
+		buf.Reset()
+		fmt.Fprintf(&buf, "%s:%d", challenge, nonce)
+
+		hash := sha256.Sum256(buf.Bytes())
+		if leadingZeroBits(hash[:]) >= difficulty {
+			return fmt.Sprintf("%d", nonce)
+		}
+	}
+}
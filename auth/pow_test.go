@@ -0,0 +1,111 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// powChallengeRegexp matches the proof-of-work challenge header.
+var powChallengeRegexp = regexp.MustCompile(
+	`^PoW challenge="([^"]+)", difficulty="(\d+)"$`,
+)
+
+// TestPoWFallback tests that proof-of-work challenges are only issued while
+// the Lightning backend is unavailable and that each solution is accepted for
+// a single request to the service it was issued for.
+func TestPoWFallback(t *testing.T) {
+	a := auth.NewLsatAuthenticator(&mockMint{}, &mockChecker{}, nil)
+
+	available := true
+	store := newMockPoWStore()
+	err := a.EnablePoWFallback(func() bool { return available }, 0, store)
+	if err == nil {
+		t.Fatal("expected error for zero difficulty")
+	}
+	err = a.EnablePoWFallback(func() bool { return available }, 8, store)
+	if err != nil {
+		t.Fatalf("unable to enable proof-of-work fallback: %v", err)
+	}
+
+	challenge := func() (string, int) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		header, err := a.FreshChallengeHeader(r, "test", 1)
+		if err != nil {
+			t.Fatalf("unable to create challenge: %v", err)
+		}
+
+		value := header.Get("WWW-Authenticate")
+		matches := powChallengeRegexp.FindStringSubmatch(value)
+		if matches == nil {
+			return "", 0
+		}
+		difficulty, _ := strconv.Atoi(matches[2])
+
+		return matches[1], difficulty
+	}
+	solution := func(c, nonce string) *http.Header {
+		return &http.Header{
+			"Authorization": []string{"PoW " + c + ":" + nonce},
+		}
+	}
+
+	// While the backend is available, LSAT challenges are issued.
+	if c, _ := challenge(); c != "" {
+		t.Fatal("unexpected proof-of-work challenge")
+	}
+
+	available = false
+	c, difficulty := challenge()
+	if c == "" || difficulty != 8 {
+		t.Fatalf("expected proof-of-work challenge of difficulty 8, "+
+			"got %q of %d", c, difficulty)
+	}
+	nonce := auth.SolvePoW(c, difficulty)
+
+	// A solution for another service isn't accepted.
+	if a.Accept(solution(c, nonce), "other") {
+		t.Fatal("solution accepted for other service")
+	}
+
+	// SolvePoW returns the smallest solution, so all smaller nonces are
+	// wrong.
+	n, _ := strconv.Atoi(nonce)
+	if n > 0 && a.Accept(solution(c, strconv.Itoa(n-1)), "test") {
+		t.Fatal("wrong nonce accepted")
+	}
+	tampered := "A" + c[1:]
+	if c[0] == 'A' {
+		tampered = "B" + c[1:]
+	}
+	if a.Accept(solution(tampered, auth.SolvePoW(tampered, 8)), "test") {
+		t.Fatal("tampered challenge accepted")
+	}
+
+	// The solution is accepted exactly once, by any instance sharing the
+	// store.
+	other := auth.NewLsatAuthenticator(&mockMint{}, &mockChecker{}, nil)
+	err = other.EnablePoWFallback(
+		func() bool { return available }, 8, store,
+	)
+	if err != nil {
+		t.Fatalf("unable to enable proof-of-work fallback: %v", err)
+	}
+	if !other.Accept(solution(c, nonce), "test") {
+		t.Fatal("valid solution not accepted by other instance")
+	}
+	if a.Accept(solution(c, nonce), "test") {
+		t.Fatal("solution accepted twice")
+	}
+
+	// Once the backend recovers, no more proof-of-work challenges are
+	// issued.
+	available = true
+	if c, _ := challenge(); c != "" {
+		t.Fatal("unexpected proof-of-work challenge after recovery")
+	}
+}
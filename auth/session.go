@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"net/http"
+)
+
+// SessionVerifier is an authenticator that can check whether the credentials
+// of a long-lived connection, like a WebSocket, are still valid after the
+// request that opened it was accepted.
+type SessionVerifier interface {
+	// VerifySession returns an error if the header no longer
+	// authenticates the user to the given backend service.
+	VerifySession(*http.Header, string) error
+}
+
+// A compile time flag to ensure the LsatAuthenticator satisfies the
+// SessionVerifier interface.
+var _ SessionVerifier = (*LsatAuthenticator)(nil)
+
+// VerifySession returns an error if the LSAT in the header is no longer valid
+// for the given service, because it expired or was revoked. Unlike Accept, it
+// doesn't check the invoice again, which was settled when the connection was
+// opened, and doesn't use up the LSAT's budget.
+//
+// NOTE: This is part of the SessionVerifier interface.
+func (l *LsatAuthenticator) VerifySession(header *http.Header,
+	serviceName string) error {
+
+	// A solved proof-of-work challenge grants access for the single
+	// request that opened the connection.
+	if _, _, ok := powFromHeader(header); ok && l.pow != nil {
+		return nil
+	}
+
+	mac, preimage, err := l.fromHeader(header)
+	if err != nil {
+		return err
+	}
+
+	return l.verifyLSAT(mac, preimage, serviceName)
+}
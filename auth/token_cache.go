@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// DefaultTokenCacheTTL is the default time a verified LSAT is accepted
+	// for without verifying it again.
+	DefaultTokenCacheTTL = time.Minute
+)
+
+// ServiceInvalidator is an authenticator that keeps state for the services it
+// authenticates requests to, which must be dropped once a service is removed
+// or changed.
+type ServiceInvalidator interface {
+	// InvalidateService drops all state kept for the service with the
+	// given name and its resources.
+	InvalidateService(string)
+}
+
+// TokenInvalidator is an authenticator that keeps state for the LSATs it
+// verified, which must be dropped once an LSAT is revoked.
+type TokenInvalidator interface {
+	// InvalidateToken drops all state kept for the LSAT with the given
+	// token ID.
+	InvalidateToken(lsat.TokenID)
+
+	// InvalidateTokens drops the state kept for all LSATs.
+	InvalidateTokens()
+}
+
+// A compile time flag to ensure the LsatAuthenticator satisfies the
+// ServiceInvalidator and TokenInvalidator interfaces.
+var _ ServiceInvalidator = (*LsatAuthenticator)(nil)
+var _ TokenInvalidator = (*LsatAuthenticator)(nil)
+
+// tokenCacheKey is the key of a verified LSAT in the token cache.
+type tokenCacheKey [sha256.Size]byte
+
+// tokenCacheEntry is an LSAT that was verified for a service.
+type tokenCacheEntry struct {
+	key         tokenCacheKey
+	tokenID     lsat.TokenID
+	serviceName string
+	expiry      time.Time
+}
+
+// tokenCache is an LRU cache of the LSATs that were recently verified for a
+// service, so requests of busy clients don't need to verify their LSAT against
+// the secret store and lnd every time.
+type tokenCache struct {
+	// hmacKey is the random key of the HMAC the cache keys are created
+	// with, so the raw LSATs are never kept in memory.
+	hmacKey [32]byte
+
+	maxSize int
+	ttl     time.Duration
+
+	// now returns the current time. It can be replaced in tests.
+	now func() time.Time
+
+	mtx     sync.Mutex
+	order   *list.List
+	entries map[tokenCacheKey]*list.Element
+}
+
+// newTokenCache creates a cache that keeps up to the given number of verified
+// LSATs for the given time.
+func newTokenCache(maxSize int, ttl time.Duration) (*tokenCache, error) {
+	c := &tokenCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		now:     time.Now,
+		order:   list.New(),
+		entries: make(map[tokenCacheKey]*list.Element),
+	}
+	if _, err := rand.Read(c.hmacKey[:]); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// key returns the cache key of the given LSAT for the given service.
+func (c *tokenCache) key(mac *macaroon.Macaroon, preimage lntypes.Preimage,
+	serviceName string) (tokenCacheKey, error) {
+
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		return tokenCacheKey{}, err
+	}
+
+	h := hmac.New(sha256.New, c.hmacKey[:])
+	_, _ = h.Write(macBytes)
+	_, _ = h.Write(preimage[:])
+	_, _ = h.Write([]byte(serviceName))
+
+	var key tokenCacheKey
+	copy(key[:], h.Sum(nil))
+	return key, nil
+}
+
+// contains returns true if the LSAT with the given key was verified and its
+// entry didn't expire yet. The entry becomes the most recently used one.
+func (c *tokenCache) contains(key tokenCacheKey) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+
+	entry := elem.Value.(*tokenCacheEntry)
+	if !c.now().Before(entry.expiry) {
+		c.remove(elem)
+		return false
+	}
+
+	c.order.MoveToFront(elem)
+	return true
+}
+
+// add records the given LSAT as verified for the given service. The entry
+// expires after the TTL of the cache or when the LSAT itself expires,
+// whichever comes first. The least recently used entry is evicted if the
+// cache is full.
+func (c *tokenCache) add(key tokenCacheKey, mac *macaroon.Macaroon,
+	serviceName string) {
+
+	// Entries are tracked by the token ID of their LSAT, so they can be
+	// dropped once it is revoked.
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return
+	}
+
+	expiry := c.now().Add(c.ttl)
+	if value, ok := lsat.HasCaveat(mac, mint.CondExpiresAt); ok {
+		timestamp, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return
+		}
+		tokenExpiry := time.Unix(timestamp, 0)
+		if tokenExpiry.Before(expiry) {
+			expiry = tokenExpiry
+		}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.order.Len() >= c.maxSize {
+		c.remove(c.order.Back())
+	}
+
+	c.entries[key] = c.order.PushFront(&tokenCacheEntry{
+		key:         key,
+		tokenID:     id.TokenID,
+		serviceName: serviceName,
+		expiry:      expiry,
+	})
+}
+
+// invalidateService removes the entries of the LSATs verified for the given
+// service or one of its resources, which are named after the service followed
+// by their path.
+func (c *tokenCache) invalidateService(serviceName string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	resourcePrefix := serviceName + "/"
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+
+		entry := elem.Value.(*tokenCacheEntry)
+		if entry.serviceName == serviceName ||
+			strings.HasPrefix(entry.serviceName, resourcePrefix) {
+
+			c.remove(elem)
+		}
+
+		elem = next
+	}
+}
+
+// invalidateToken removes the entries of the LSAT with the given token ID.
+func (c *tokenCache) invalidateToken(id lsat.TokenID) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+
+		if elem.Value.(*tokenCacheEntry).tokenID == id {
+			c.remove(elem)
+		}
+
+		elem = next
+	}
+}
+
+// clear removes all entries from the cache.
+func (c *tokenCache) clear() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[tokenCacheKey]*list.Element)
+}
+
+// remove removes the given entry from the cache.
+//
+// NOTE: The caller must hold mtx.
+func (c *tokenCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*tokenCacheEntry)
+	delete(c.entries, entry.key)
+}
+
+// EnableTokenCache makes the authenticator remember up to the given number of
+// LSATs it verified for a service, and accept them for the given time without
+// verifying them against the secret store and the invoice status again. Their
+// budget is still consumed with every request. Cached LSATs must be
+// invalidated once they are revoked or the services they were verified for
+// change, so they are verified again.
+func (l *LsatAuthenticator) EnableTokenCache(maxSize int,
+	ttl time.Duration) error {
+
+	cache, err := newTokenCache(maxSize, ttl)
+	if err != nil {
+		return err
+	}
+
+	l.tokenCache = cache
+	return nil
+}
+
+// InvalidateService drops the cached LSATs verified for the service with the
+// given name and its resources, so they need to be verified again against the
+// service's current restrictions.
+//
+// NOTE: This is part of the ServiceInvalidator interface.
+func (l *LsatAuthenticator) InvalidateService(serviceName string) {
+	if l.tokenCache == nil {
+		return
+	}
+
+	l.tokenCache.invalidateService(serviceName)
+}
+
+// InvalidateToken drops the cached verifications of the LSAT with the given
+// token ID, so it is verified again on its next request.
+//
+// NOTE: This is part of the TokenInvalidator interface.
+func (l *LsatAuthenticator) InvalidateToken(id lsat.TokenID) {
+	if l.tokenCache == nil {
+		return
+	}
+
+	l.tokenCache.invalidateToken(id)
+}
+
+// InvalidateTokens drops the cached verifications of all LSATs.
+//
+// NOTE: This is part of the TokenInvalidator interface.
+func (l *LsatAuthenticator) InvalidateTokens() {
+	if l.tokenCache == nil {
+		return
+	}
+
+	l.tokenCache.clear()
+}
@@ -0,0 +1,189 @@
+package auth_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+const testCachePreimage = "49349dfea4abed3cd14f6d356afa83de" +
+	"9787b609f088c8df09bacc7b4bd21b39"
+
+// lsatHeader returns a header carrying an LSAT with the given caveats.
+func lsatHeader(caveats ...lsat.Caveat) *http.Header {
+	return tokenHeader(lsat.TokenID{1}, caveats...)
+}
+
+// tokenHeader returns a header carrying an LSAT with the given token ID and
+// caveats.
+func tokenHeader(tokenID lsat.TokenID, caveats ...lsat.Caveat) *http.Header {
+	var id bytes.Buffer
+	err := lsat.EncodeIdentifier(&id, &lsat.Identifier{
+		Version: lsat.LatestVersion,
+		TokenID: tokenID,
+	})
+	if err != nil {
+		panic(err)
+	}
+	mac, err := macaroon.New(
+		[]byte("aabbccddeeff00112233445566778899"), id.Bytes(),
+		"aperture", macaroon.LatestVersion,
+	)
+	if err != nil {
+		panic(err)
+	}
+	caveats = append([]lsat.Caveat{{
+		Condition: lsat.PreimageKey,
+		Value:     testCachePreimage,
+	}}, caveats...)
+	if err := lsat.AddFirstPartyCaveats(mac, caveats...); err != nil {
+		panic(err)
+	}
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+
+	return &http.Header{
+		lsat.HeaderMacaroon: []string{hex.EncodeToString(macBytes)},
+	}
+}
+
+// TestTokenCache makes sure verified LSATs are accepted without verifying
+// them again until they are evicted, expire, are revoked or their service is
+// removed or changed.
+func TestTokenCache(t *testing.T) {
+	m := &mockMint{}
+	a := auth.NewLsatAuthenticator(m, &mockChecker{}, nil)
+	require.NoError(t, a.EnableTokenCache(1, time.Hour))
+
+	verifyCalls := func() int32 {
+		return atomic.LoadInt32(&m.verifyCalls)
+	}
+
+	// Only the first request of an LSAT is verified.
+	header := lsatHeader()
+	require.True(t, a.Accept(header, "service1"))
+	require.True(t, a.Accept(header, "service1"))
+	require.EqualValues(t, 1, verifyCalls())
+
+	// The LSAT is verified for each service on its own, and only one
+	// entry fits into the cache.
+	require.True(t, a.Accept(header, "service2"))
+	require.True(t, a.Accept(header, "service1"))
+	require.EqualValues(t, 3, verifyCalls())
+
+	// The budget is still consumed with every request.
+	m.budgetErr = mint.ErrBudgetExhausted
+	require.False(t, a.Accept(header, "service1"))
+	require.EqualValues(t, 3, verifyCalls())
+	m.budgetErr = nil
+
+	// Removing a service drops the LSATs cached for it and its resources.
+	a.InvalidateService("service2")
+	require.True(t, a.Accept(header, "service1"))
+	require.EqualValues(t, 3, verifyCalls())
+	a.InvalidateService("service1")
+	require.True(t, a.Accept(header, "service1"))
+	require.EqualValues(t, 4, verifyCalls())
+
+	// Revoking an LSAT drops its cached verifications, but not the ones
+	// of other LSATs.
+	a.InvalidateToken(lsat.TokenID{2})
+	require.True(t, a.Accept(header, "service1"))
+	require.EqualValues(t, 4, verifyCalls())
+	a.InvalidateToken(lsat.TokenID{1})
+	require.True(t, a.Accept(header, "service1"))
+	require.EqualValues(t, 5, verifyCalls())
+	a.InvalidateTokens()
+	require.True(t, a.Accept(header, "service1"))
+	require.EqualValues(t, 6, verifyCalls())
+
+	// LSATs aren't cached beyond their own expiry.
+	expired := lsatHeader(mint.NewExpiresAtCaveat(
+		time.Now().Add(-time.Minute),
+	))
+	require.True(t, a.Accept(expired, "service1"))
+	require.True(t, a.Accept(expired, "service1"))
+	require.EqualValues(t, 8, verifyCalls())
+
+	// Failed verifications are never cached.
+	m.verifyErr = mint.ErrTokenExpired
+	require.False(t, a.Accept(lsatHeader(), "service3"))
+	require.False(t, a.Accept(lsatHeader(), "service3"))
+	require.EqualValues(t, 10, verifyCalls())
+}
+
+// BenchmarkTokenCache compares the throughput of requests of a busy client
+// authenticated through an HTTP server with and without the token cache, with
+// every verification taking as long as a lookup in a remote secret store.
+func BenchmarkTokenCache(b *testing.B) {
+	run := func(b *testing.B, cacheSize int) {
+		m := &mockMint{verifyDelay: time.Millisecond}
+		a := auth.NewLsatAuthenticator(m, &mockChecker{}, nil)
+		if cacheSize > 0 {
+			err := a.EnableTokenCache(cacheSize, time.Hour)
+			require.NoError(b, err)
+		}
+
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if !a.Accept(&r.Header, "service1") {
+					w.WriteHeader(
+						http.StatusPaymentRequired,
+					)
+				}
+			},
+		))
+		defer server.Close()
+
+		header := lsatHeader()
+		start := time.Now()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			client := server.Client()
+			for pb.Next() {
+				req, err := http.NewRequest(
+					http.MethodGet, server.URL, nil,
+				)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				req.Header = header.Clone()
+
+				resp, err := client.Do(req)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				_ = resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					b.Errorf("unexpected status %d",
+						resp.StatusCode)
+					return
+				}
+			}
+		})
+		b.ReportMetric(
+			float64(b.N)/time.Since(start).Seconds(), "req/s",
+		)
+	}
+
+	b.Run("uncached", func(b *testing.B) {
+		run(b, 0)
+	})
+	b.Run("cached", func(b *testing.B) {
+		run(b, 10000)
+	})
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"bytes"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"gopkg.in/macaroon.v2"
+)
+
+// TokenNotifier is an entity that wants to be notified about every LSAT an
+// authenticator issues.
+type TokenNotifier interface {
+	// TokenIssued is called after a new LSAT with the given identifier
+	// was minted for the given service. It must not block.
+	TokenIssued(*lsat.Identifier, lsat.Service)
+}
+
+// EnableTokenNotifier makes the authenticator notify the given notifier about
+// every LSAT it issues in a payment challenge.
+func (l *LsatAuthenticator) EnableTokenNotifier(notifier TokenNotifier) {
+	l.tokenNotifier = notifier
+}
+
+// notifyIssued notifies the token notifier, if there is one, about the given
+// LSAT that was just minted for the given service.
+func (l *LsatAuthenticator) notifyIssued(mac *macaroon.Macaroon,
+	service lsat.Service) {
+
+	if l.tokenNotifier == nil {
+		return
+	}
+
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		log.Errorf("Unable to decode identifier of issued LSAT: %v",
+			err)
+		return
+	}
+
+	l.tokenNotifier.TokenIssued(id, service)
+}
@@ -0,0 +1,93 @@
+package aperture
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+const (
+	// blockHeightCacheTTL is the time we consider the last block height
+	// lnd told us about to be current. Blocks are found every ten minutes
+	// on average, so this is short enough to not be noticeably behind.
+	blockHeightCacheTTL = 30 * time.Second
+)
+
+// hasValidAfterBlock returns true if any of the configured services issues
+// LSATs that only become valid at a certain block height.
+func hasValidAfterBlock(cfg *Config) bool {
+	for _, service := range cfg.Services {
+		if service.ValidAfterBlock > 0 {
+			return true
+		}
+		if _, ok := service.Constraints[lsat.CondValidAfterBlock]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blockHeightCache is a source of the current block height that only queries
+// lnd if the last known height is older than the cache's TTL. This avoids a
+// call to lnd for every request that needs to know the block height.
+type blockHeightCache struct {
+	client InfoClient
+	ttl    time.Duration
+
+	mtx        sync.Mutex
+	height     uint32
+	lastUpdate time.Time
+}
+
+// A compile-time constraint to ensure blockHeightCache implements
+// auth.BlockHeightSource.
+var _ auth.BlockHeightSource = (*blockHeightCache)(nil)
+
+// newBlockHeightCache creates a new block height cache for the lnd node
+// described by the given config. The read-only macaroon is used to connect to
+// the node.
+func newBlockHeightCache(cfg *AuthConfig) (*blockHeightCache, error) {
+	client, err := lndclient.NewBasicClient(
+		cfg.LndHost, cfg.TLSPath, cfg.MacDir, cfg.Network,
+		lndclient.MacFilename(readonlyMacaroonName),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blockHeightCache{
+		client: client,
+		ttl:    blockHeightCacheTTL,
+	}, nil
+}
+
+// BlockHeight returns the current block height of the chain.
+//
+// NOTE: This is part of the auth.BlockHeightSource interface.
+func (c *blockHeightCache) BlockHeight(ctx context.Context) (uint32, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if time.Since(c.lastUpdate) < c.ttl {
+		return c.height, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lndRPCTimeout)
+	defer cancel()
+
+	info, err := c.client.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return 0, err
+	}
+
+	c.height = info.BlockHeight
+	c.lastUpdate = time.Now()
+
+	return c.height, nil
+}
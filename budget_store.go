@@ -0,0 +1,237 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// budgetsPrefix is the key we'll use to prefix all LSAT token IDs with
+	// when storing how many requests they were used for in an etcd
+	// cluster.
+	budgetsPrefix = "budgets"
+
+	// budgetRemovalInterval is the interval at which the budgets of
+	// expired LSATs are removed.
+	budgetRemovalInterval = time.Hour
+
+	// budgetRemovalTimeout is the maximum time removing the budgets of
+	// expired LSATs may take.
+	budgetRemovalTimeout = time.Minute
+)
+
+// budgetsKey returns the full key to store the request budget of the LSAT with
+// the given token ID under.
+//
+// The resulting path of the token ID bff4ee83 within etcd would look like:
+//
+//	lsat/proxy/budgets/bff4ee83
+func budgetsKey(id lsat.TokenID) string {
+	return strings.Join(
+		[]string{topLevelKey, budgetsPrefix, id.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// tokenBudget is the request budget of an LSAT and how much of it is left.
+type tokenBudget struct {
+	// TokenID is the hex encoded ID of the LSAT.
+	TokenID string `json:"token_id"`
+
+	// Budget is the number of requests the LSAT can be used for.
+	Budget uint32 `json:"budget"`
+
+	// Remaining is the number of requests the LSAT can still be used for.
+	Remaining uint32 `json:"remaining"`
+}
+
+// budgetStore keeps track of the request budgets of LSATs in an etcd cluster,
+// so they survive restarts and are shared by all aperture instances.
+type budgetStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure budgetStore implements mint.BudgetStore.
+var _ mint.BudgetStore = (*budgetStore)(nil)
+
+// newBudgetStore instantiates a new LSAT request budget store backed by an
+// etcd cluster.
+func newBudgetStore(client *clientv3.Client) *budgetStore {
+	return &budgetStore{Client: client}
+}
+
+// ConsumeBudget uses up one request of the budget of the LSAT with the given
+// ID. If the LSAT was already used for budget requests, mint.ErrBudgetExhausted
+// is returned.
+//
+// NOTE: This is part of the mint.BudgetStore interface.
+func (s *budgetStore) ConsumeBudget(ctx context.Context, id lsat.TokenID,
+	budget uint32) error {
+
+	key := budgetsKey(id)
+	for {
+		resp, err := s.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		// The budget is only stored once the LSAT is used for the
+		// first time, so it starts out with its full budget.
+		stored := &tokenBudget{
+			TokenID:   id.String(),
+			Budget:    budget,
+			Remaining: budget,
+		}
+		var revision int64
+		if len(resp.Kvs) > 0 {
+			err := json.Unmarshal(resp.Kvs[0].Value, stored)
+			if err != nil {
+				return err
+			}
+			revision = resp.Kvs[0].ModRevision
+		}
+
+		// The budget of an LSAT can be lowered by adding another
+		// caveat, which also reduces what's left of it.
+		if budget < stored.Budget {
+			used := stored.Budget - stored.Remaining
+			stored.Budget = budget
+			stored.Remaining = 0
+			if used < budget {
+				stored.Remaining = budget - used
+			}
+		}
+		if stored.Remaining == 0 {
+			return mint.ErrBudgetExhausted
+		}
+		stored.Remaining--
+
+		value, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+
+		// Only count the request if no concurrent one was counted
+		// since we looked, otherwise try again.
+		txnResp, err := s.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+			Then(clientv3.OpPut(key, string(value))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txnResp.Succeeded {
+			return nil
+		}
+	}
+}
+
+// RemoveExpired removes the budgets of all LSATs that expired before the given
+// time. The expiry is taken from the records of the token store, as the
+// caveats of an LSAT can be attenuated by its holder. Budgets of LSATs without
+// a record are kept, since we can't tell whether they expired.
+func (s *budgetStore) RemoveExpired(ctx context.Context, tokens *tokenStore,
+	now time.Time) error {
+
+	budgets, err := s.Budgets(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, budget := range budgets {
+		id, err := lsat.MakeIDFromString(budget.TokenID)
+		if err != nil {
+			return err
+		}
+
+		tokenKey := tokensKey(id)
+		resp, err := tokens.Get(ctx, tokenKey)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			continue
+		}
+
+		var record tokenRecord
+		if err := json.Unmarshal(resp.Kvs[0].Value, &record); err != nil {
+			return err
+		}
+		if record.ExpiresAt == nil || record.ExpiresAt.After(now) {
+			continue
+		}
+
+		// The LSAT might be refreshed concurrently, which extends its
+		// expiry, so the budget is only removed if the record is
+		// unchanged.
+		revision := resp.Kvs[0].ModRevision
+		_, err = s.Txn(ctx).
+			If(clientv3.Compare(
+				clientv3.ModRevision(tokenKey), "=", revision,
+			)).
+			Then(clientv3.OpDelete(budgetsKey(id))).
+			Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Budgets returns the request budgets of all LSATs that were used at least
+// once.
+func (s *budgetStore) Budgets(ctx context.Context) ([]*tokenBudget, error) {
+	prefix := strings.Join(
+		[]string{topLevelKey, budgetsPrefix, ""}, etcdKeyDelimeter,
+	)
+	resp, err := s.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	budgets := make([]*tokenBudget, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var budget tokenBudget
+		if err := json.Unmarshal(kv.Value, &budget); err != nil {
+			return nil, err
+		}
+		budgets = append(budgets, &budget)
+	}
+
+	return budgets, nil
+}
+
+// removeExpiredBudgets periodically removes the request budgets of expired
+// LSATs until aperture shuts down.
+func (a *Aperture) removeExpiredBudgets() {
+	budgets := newBudgetStore(a.etcdClient)
+	tokens := newTokenStore(a.etcdClient)
+
+	ticker := time.NewTicker(budgetRemovalInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.quit:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(
+			context.Background(), budgetRemovalTimeout,
+		)
+		err := budgets.RemoveExpired(ctx, tokens, time.Now())
+		cancel()
+		if err != nil {
+			log.Errorf("Unable to remove expired LSAT budgets: %v",
+				err)
+		}
+	}
+}
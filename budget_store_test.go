@@ -0,0 +1,172 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBudgetStore ensures LSATs can only be used for as many requests as their
+// budget allows and that the remaining budgets are listed.
+func TestBudgetStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	store := newBudgetStore(etcdClient)
+
+	id := lsat.TokenID{1}
+	require.NoError(t, store.ConsumeBudget(ctx, id, 3))
+	require.NoError(t, store.ConsumeBudget(ctx, id, 3))
+
+	// Lowering the budget reduces what's left of it.
+	require.Equal(
+		t, mint.ErrBudgetExhausted, store.ConsumeBudget(ctx, id, 2),
+	)
+	require.NoError(t, store.ConsumeBudget(ctx, id, 3))
+	require.Equal(
+		t, mint.ErrBudgetExhausted, store.ConsumeBudget(ctx, id, 3),
+	)
+
+	// Another LSAT has its own budget. A store backed by the same etcd
+	// cluster, like after a restart, sees the same counter.
+	otherID := lsat.TokenID{2}
+	require.NoError(t, store.ConsumeBudget(ctx, otherID, 5))
+	restarted := newBudgetStore(etcdClient)
+	require.NoError(t, restarted.ConsumeBudget(ctx, otherID, 5))
+
+	budgets, err := restarted.Budgets(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []*tokenBudget{{
+		TokenID:   id.String(),
+		Budget:    3,
+		Remaining: 0,
+	}, {
+		TokenID:   otherID.String(),
+		Budget:    5,
+		Remaining: 3,
+	}}, budgets)
+}
+
+// TestBudgetStoreRemoveExpired ensures the budgets of LSATs are only removed
+// once the expiry the mint issued them with has passed, no matter which expiry
+// the LSATs were used with.
+func TestBudgetStoreRemoveExpired(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	service := &proxy.Service{
+		Name:          "service",
+		RequestBudget: 1,
+		TokenExpiry:   time.Hour,
+	}
+	limiter, err := newServiceLimiter([]*proxy.Service{service})
+	require.NoError(t, err)
+	budgets := newBudgetStore(etcdClient)
+	tokens := newTokenStore(etcdClient)
+	minter := mint.New(&mint.Config{
+		Secrets:        newSecretStore(etcdClient),
+		Challenger:     NewMockChallenger(false),
+		ServiceLimiter: limiter,
+		Budgets:        budgets,
+		Tokens:         tokens,
+	})
+
+	mac, invoice, err := minter.MintLSAT(ctx, lsat.Service{
+		Name: service.Name,
+		Tier: lsat.BaseTier,
+	})
+	require.NoError(t, err)
+	preimage, err := MockInvoicePreimage(invoice)
+	require.NoError(t, err)
+
+	// The holder uses up the budget with a copy that expires in a second.
+	attenuated := mac.Clone()
+	soon := time.Now().Add(time.Second)
+	require.NoError(t, lsat.AddFirstPartyCaveats(
+		attenuated, mint.NewExpiresAtCaveat(soon),
+	))
+	require.NoError(t, minter.VerifyLSAT(ctx, &mint.VerificationParams{
+		Macaroon:      attenuated,
+		Preimage:      preimage,
+		TargetService: service.Name,
+	}))
+	require.NoError(t, minter.ConsumeBudget(ctx, attenuated))
+
+	// Once the copy expired, the budget of the original LSAT is still
+	// used up.
+	require.NoError(t, budgets.RemoveExpired(
+		ctx, tokens, soon.Add(time.Minute),
+	))
+	require.Equal(
+		t, mint.ErrBudgetExhausted, minter.ConsumeBudget(ctx, mac),
+	)
+
+	// Only once the original LSAT expired, its budget is removed.
+	require.NoError(t, budgets.RemoveExpired(
+		ctx, tokens, time.Now().Add(2*time.Hour),
+	))
+	remaining, err := budgets.Budgets(ctx)
+	require.NoError(t, err)
+	require.Empty(t, remaining)
+}
+
+// TestBudgetStoreRefresh ensures the budget of an LSAT stays used up after it
+// was refreshed, even once the expiry of the old LSAT passed.
+func TestBudgetStoreRefresh(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	newMinter := func(expiry time.Duration) *mint.Mint {
+		limiter, err := newServiceLimiter([]*proxy.Service{{
+			Name:          "service",
+			RequestBudget: 1,
+			TokenExpiry:   expiry,
+			RefreshQuota:  1,
+		}})
+		require.NoError(t, err)
+
+		return mint.New(&mint.Config{
+			Secrets:        newSecretStore(etcdClient),
+			Challenger:     NewMockChallenger(false),
+			ServiceLimiter: limiter,
+			Quotas:         newQuotaStore(etcdClient),
+			Budgets:        newBudgetStore(etcdClient),
+			Tokens:         newTokenStore(etcdClient),
+		})
+	}
+
+	minter := newMinter(time.Hour)
+	mac, invoice, err := minter.MintLSAT(ctx, lsat.Service{
+		Name: "service",
+		Tier: lsat.BaseTier,
+	})
+	require.NoError(t, err)
+	preimage, err := MockInvoicePreimage(invoice)
+	require.NoError(t, err)
+	require.NoError(t, minter.ConsumeBudget(ctx, mac))
+
+	// The refreshed LSAT expires an hour later than the old one.
+	refreshed, err := newMinter(2*time.Hour).Refresh(ctx, mac, preimage)
+	require.NoError(t, err)
+
+	budgets := newBudgetStore(etcdClient)
+	tokens := newTokenStore(etcdClient)
+	require.NoError(t, budgets.RemoveExpired(
+		ctx, tokens, time.Now().Add(90*time.Minute),
+	))
+	require.Equal(
+		t, mint.ErrBudgetExhausted,
+		minter.ConsumeBudget(ctx, refreshed),
+	)
+}
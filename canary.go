@@ -0,0 +1,296 @@
+package aperture
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+)
+
+const (
+	// canaryCheckInterval is the interval at which the error rates of the
+	// primary and canary backends are compared.
+	canaryCheckInterval = 10 * time.Second
+
+	// canaryMinRequests is the minimum number of requests the canary must
+	// have received within a check interval for its error rate to be
+	// compared, and during the whole analysis for it to be promoted.
+	canaryMinRequests = 10
+
+	// defaultCanaryErrorRateThreshold is the default amount by which the
+	// canary's error rate may exceed the primary's.
+	defaultCanaryErrorRateThreshold = 0.05
+
+	// defaultCanaryAnalysisDuration is the default time a canary is
+	// evaluated for.
+	defaultCanaryAnalysisDuration = 10 * time.Minute
+
+	// alertKeyCanaryPrefix is the prefix of the deduplication key used for
+	// alerts about a canary being removed. The service name is appended.
+	alertKeyCanaryPrefix = "aperture-canary-"
+)
+
+// canaryAnalysis is the state of the evaluation of a single canary backend.
+type canaryAnalysis struct {
+	// address is the address of the canary backend being evaluated.
+	address string
+
+	// start is the time the analysis started.
+	start time.Time
+
+	// divergingSince is the time the canary's error rate started to exceed
+	// the primary's by more than the threshold. It is zero if it doesn't.
+	divergingSince time.Time
+
+	// canaryRequests is the number of requests the canary received since
+	// the analysis started.
+	canaryRequests float64
+
+	// lastPrimary and lastCanary are the backend statistics of the last
+	// check.
+	lastPrimary proxy.BackendStats
+	lastCanary  proxy.BackendStats
+}
+
+// canaryController periodically compares the error rates and latencies of the
+// primary and canary backends of all services with a canary. A canary whose
+// error rate exceeds the primary's by more than the configured threshold for
+// the whole analysis duration is removed from rotation and an alert is
+// triggered. Otherwise it is promoted to be the primary backend once the
+// analysis duration has passed.
+type canaryController struct {
+	// services returns the services currently used by the proxy.
+	services func() []*proxy.Service
+
+	// updateServices replaces the services used by the proxy.
+	updateServices func([]*proxy.Service) error
+
+	// readStats returns the statistics of a backend of a service.
+	readStats func(service, backend string) proxy.BackendStats
+
+	triggerAlert func(*alert)
+
+	// analyses holds the state of the analysis of each canary, keyed by
+	// service name.
+	analyses map[string]*canaryAnalysis
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newCanaryController creates a new canary controller for the services of the
+// given proxy.
+func newCanaryController(p *proxy.Proxy,
+	updateServices func([]*proxy.Service) error,
+	triggerAlert func(*alert)) *canaryController {
+
+	return &canaryController{
+		services:       p.Services,
+		updateServices: updateServices,
+		readStats:      proxy.ReadBackendStats,
+		triggerAlert:   triggerAlert,
+		analyses:       make(map[string]*canaryAnalysis),
+		quit:           make(chan struct{}),
+	}
+}
+
+// Start starts the goroutine that periodically evaluates the canaries.
+func (c *canaryController) Start() {
+	c.wg.Add(1)
+	go c.run()
+}
+
+// Stop shuts down the controller.
+func (c *canaryController) Stop() {
+	close(c.quit)
+	c.wg.Wait()
+}
+
+// run evaluates the canaries every time the check interval elapses.
+//
+// NOTE: This must be run as a goroutine.
+func (c *canaryController) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(canaryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.check(time.Now()); err != nil {
+				log.Errorf("Unable to evaluate canaries: %v",
+					err)
+			}
+
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// check evaluates the canaries of all services and removes or promotes them
+// if the analysis came to a conclusion.
+func (c *canaryController) check(now time.Time) error {
+	services := c.services()
+
+	var (
+		changed    bool
+		updated    = make([]*proxy.Service, len(services))
+		withCanary = make(map[string]struct{})
+	)
+	for idx, service := range services {
+		updated[idx] = service
+		if service.CanaryAddress == "" {
+			continue
+		}
+		withCanary[service.Name] = struct{}{}
+
+		// A new canary, or a canary that was replaced by another one,
+		// starts a fresh analysis.
+		analysis, ok := c.analyses[service.Name]
+		if !ok || analysis.address != service.CanaryAddress {
+			c.analyses[service.Name] = &canaryAnalysis{
+				address: service.CanaryAddress,
+				start:   now,
+				lastPrimary: c.readStats(
+					service.Name, proxy.BackendPrimary,
+				),
+				lastCanary: c.readStats(
+					service.Name, proxy.BackendCanary,
+				),
+			}
+
+			log.Infof("Starting analysis of canary %s of service "+
+				"%s", service.CanaryAddress, service.Name)
+			continue
+		}
+
+		promote, remove := c.evaluate(service, analysis, now)
+		if !promote && !remove {
+			continue
+		}
+
+		// We never modify the services in use, the proxy might be
+		// reading them concurrently.
+		newService := *service
+		if promote {
+			newService.Address = service.CanaryAddress
+		}
+		newService.CanaryAddress = ""
+		newService.CanaryWeight = 0
+		updated[idx] = &newService
+		changed = true
+
+		delete(c.analyses, service.Name)
+	}
+
+	// Forget about the analyses of canaries that were removed in the
+	// meantime.
+	for name := range c.analyses {
+		if _, ok := withCanary[name]; !ok {
+			delete(c.analyses, name)
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return c.updateServices(updated)
+}
+
+// evaluate compares the error rates of the primary and canary backend of the
+// given service since the last check and returns whether the canary should be
+// promoted or removed.
+func (c *canaryController) evaluate(service *proxy.Service,
+	analysis *canaryAnalysis, now time.Time) (bool, bool) {
+
+	threshold := service.CanaryErrorRateThreshold
+	if threshold == 0 {
+		threshold = defaultCanaryErrorRateThreshold
+	}
+	duration := service.CanaryAnalysisDuration
+	if duration == 0 {
+		duration = defaultCanaryAnalysisDuration
+	}
+
+	primary := c.readStats(service.Name, proxy.BackendPrimary)
+	canary := c.readStats(service.Name, proxy.BackendCanary)
+	primaryRate, primaryLatency := backendRates(
+		analysis.lastPrimary, primary,
+	)
+	canaryRate, canaryLatency := backendRates(analysis.lastCanary, canary)
+	canaryRequests := canary.Requests - analysis.lastCanary.Requests
+
+	analysis.lastPrimary = primary
+	analysis.lastCanary = canary
+	analysis.canaryRequests += canaryRequests
+
+	log.Debugf("Canary analysis of service %s: primary error rate %.3f, "+
+		"latency %v; canary error rate %.3f, latency %v", service.Name,
+		primaryRate, primaryLatency, canaryRate, canaryLatency)
+
+	// Too few requests don't tell us anything, so we neither start nor
+	// end a period of diverging error rates.
+	if canaryRequests >= canaryMinRequests {
+		switch {
+		case canaryRate-primaryRate <= threshold:
+			analysis.divergingSince = time.Time{}
+
+		case analysis.divergingSince.IsZero():
+			analysis.divergingSince = now
+		}
+	}
+
+	if !analysis.divergingSince.IsZero() &&
+		now.Sub(analysis.divergingSince) >= duration {
+
+		log.Warnf("Removing canary %s of service %s, its error rate "+
+			"of %.3f exceeded the primary's error rate of %.3f by "+
+			"more than %.3f for %v", service.CanaryAddress,
+			service.Name, canaryRate, primaryRate, threshold,
+			duration)
+
+		c.triggerAlert(&alert{
+			key: alertKeyCanaryPrefix + service.Name,
+			summary: fmt.Sprintf("Canary %s of service %s removed, "+
+				"error rate %.3f vs. %.3f of the primary, "+
+				"latency %v vs. %v", service.CanaryAddress,
+				service.Name, canaryRate, primaryRate,
+				canaryLatency, primaryLatency),
+			severity: severityWarning,
+		})
+
+		return false, true
+	}
+
+	if analysis.divergingSince.IsZero() &&
+		now.Sub(analysis.start) >= duration &&
+		analysis.canaryRequests >= canaryMinRequests {
+
+		log.Infof("Promoting canary %s of service %s to primary "+
+			"backend", service.CanaryAddress, service.Name)
+
+		return true, false
+	}
+
+	return false, false
+}
+
+// backendRates returns the error rate and the average latency of a backend
+// between the two given statistics.
+func backendRates(prev, cur proxy.BackendStats) (float64, time.Duration) {
+	requests := cur.Requests - prev.Requests
+	if requests <= 0 {
+		return 0, 0
+	}
+
+	errorRate := (cur.Errors - prev.Errors) / requests
+	latency := time.Duration(
+		(cur.LatencySum - prev.LatencySum) / requests * float64(time.Second),
+	)
+
+	return errorRate, latency
+}
@@ -0,0 +1,118 @@
+package aperture
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCanaryController creates a canary controller for a single service
+// whose backend statistics are taken from the given map.
+func newTestCanaryController(service *proxy.Service,
+	stats map[string]*proxy.BackendStats) (*canaryController,
+	*[]*proxy.Service, *[]*alert) {
+
+	var (
+		services = []*proxy.Service{service}
+		alerts   []*alert
+	)
+	c := &canaryController{
+		services: func() []*proxy.Service {
+			return services
+		},
+		updateServices: func(s []*proxy.Service) error {
+			services = s
+			return nil
+		},
+		readStats: func(_, backend string) proxy.BackendStats {
+			return *stats[backend]
+		},
+		triggerAlert: func(al *alert) {
+			alerts = append(alerts, al)
+		},
+		analyses: make(map[string]*canaryAnalysis),
+	}
+
+	return c, &services, &alerts
+}
+
+// TestCanaryControllerRemove makes sure a canary whose error rate exceeds the
+// primary's for the whole analysis duration is removed and an alert is
+// triggered.
+func TestCanaryControllerRemove(t *testing.T) {
+	t.Parallel()
+
+	stats := map[string]*proxy.BackendStats{
+		proxy.BackendPrimary: {},
+		proxy.BackendCanary:  {},
+	}
+	c, services, alerts := newTestCanaryController(&proxy.Service{
+		Name:                     "service",
+		Address:                  "primary:8080",
+		CanaryAddress:            "canary:8080",
+		CanaryWeight:             0.1,
+		CanaryErrorRateThreshold: 0.1,
+		CanaryAnalysisDuration:   time.Minute,
+	}, stats)
+
+	now := time.Unix(1000000, 0)
+	require.NoError(t, c.check(now))
+
+	// The canary fails half of its requests while the primary doesn't
+	// fail at all.
+	step := func() {
+		stats[proxy.BackendPrimary].Requests += 100
+		stats[proxy.BackendCanary].Requests += 10
+		stats[proxy.BackendCanary].Errors += 5
+		now = now.Add(canaryCheckInterval)
+		require.NoError(t, c.check(now))
+	}
+	for i := 0; i < 6; i++ {
+		step()
+	}
+	require.Equal(t, "canary:8080", (*services)[0].CanaryAddress)
+	require.Empty(t, *alerts)
+
+	// Once the error rate diverged for the whole analysis duration, the
+	// canary is removed.
+	step()
+	require.Equal(t, "", (*services)[0].CanaryAddress)
+	require.Equal(t, "primary:8080", (*services)[0].Address)
+	require.Len(t, *alerts, 1)
+	require.Equal(t, alertKeyCanaryPrefix+"service", (*alerts)[0].key)
+}
+
+// TestCanaryControllerPromote makes sure a canary that performs as well as the
+// primary is promoted once the analysis duration has passed.
+func TestCanaryControllerPromote(t *testing.T) {
+	t.Parallel()
+
+	stats := map[string]*proxy.BackendStats{
+		proxy.BackendPrimary: {},
+		proxy.BackendCanary:  {},
+	}
+	c, services, alerts := newTestCanaryController(&proxy.Service{
+		Name:                   "service",
+		Address:                "primary:8080",
+		CanaryAddress:          "canary:8080",
+		CanaryWeight:           0.1,
+		CanaryAnalysisDuration: time.Minute,
+	}, stats)
+
+	now := time.Unix(1000000, 0)
+	require.NoError(t, c.check(now))
+
+	for i := 0; i < 6; i++ {
+		stats[proxy.BackendPrimary].Requests += 100
+		stats[proxy.BackendPrimary].Errors += 1
+		stats[proxy.BackendCanary].Requests += 10
+		now = now.Add(canaryCheckInterval)
+		require.NoError(t, c.check(now))
+	}
+
+	require.Equal(t, "", (*services)[0].CanaryAddress)
+	require.Equal(t, "canary:8080", (*services)[0].Address)
+	require.Empty(t, *alerts)
+}
@@ -0,0 +1,430 @@
+package aperture
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/cert"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// hostCertFilename is the name of the certificate file in the
+	// directory of a hostname within the certificate directory.
+	hostCertFilename = "cert.pem"
+
+	// hostKeyFilename is the name of the key file in the directory of a
+	// hostname within the certificate directory.
+	hostKeyFilename = "key.pem"
+)
+
+// defaultCertFiles returns the paths of the default certificate and its key in
+// the given aperture directory.
+func defaultCertFiles(apertureDir string) (string, string) {
+	return filepath.Join(apertureDir, defaultTLSCertFilename),
+		filepath.Join(apertureDir, defaultTLSKeyFilename)
+}
+
+// hostCert is a certificate loaded from the certificate directory.
+type hostCert struct {
+	cert *tls.Certificate
+
+	// modTime is the modification time of the certificate file when it
+	// was loaded. The certificate is loaded again once it changes.
+	modTime time.Time
+}
+
+// CertManager manages the TLS certificates served by the proxy. If a
+// certificate directory is configured, clients are served the certificate of
+// the hostname they request through SNI from it. The certificate directory
+// contains one directory per hostname, named after the hostname, which
+// contains a cert.pem and key.pem file. Certificates that are added or
+// replaced are picked up on the next TLS handshake for their hostname. All
+// other clients are served either a self-signed certificate or one obtained
+// through Let's Encrypt. The default certificate is reloaded once its file
+// changes, or renewed if it is a self-signed one about to expire, while
+// WatchDefaultCert runs.
+type CertManager struct {
+	serverName  string
+	apertureDir string
+	certDir     string
+
+	// autoCert is the Let's Encrypt certificate manager. If it is nil,
+	// the self-signed default certificate is served instead.
+	autoCert *autocert.Manager
+
+	mu sync.Mutex
+
+	// defaultCert is the self-signed certificate that is served if no
+	// other certificate matches.
+	defaultCert *tls.Certificate
+
+	// defaultModTime is the modification time of the default certificate
+	// file when it was loaded.
+	defaultModTime time.Time
+
+	// defaultRenewAt is the time the default certificate needs to be
+	// renewed at. It is zero if we didn't create the certificate, as we
+	// never replace certificates that were passed to us.
+	defaultRenewAt time.Time
+
+	certs map[string]*hostCert
+}
+
+// NewCertManager creates a new certificate manager that serves certificates
+// from the given certificate directory if it is set, and either a self-signed
+// certificate or one obtained through Let's Encrypt for the server name
+// otherwise.
+func NewCertManager(serverName, baseDir, certDir string,
+	autoCert bool) (*CertManager, error) {
+
+	// Use our default data dir unless a base dir is set.
+	apertureDir := apertureDataDir
+	if baseDir != "" {
+		apertureDir = baseDir
+	}
+
+	m := &CertManager{
+		serverName:  serverName,
+		apertureDir: apertureDir,
+		certDir:     certDir,
+		certs:       make(map[string]*hostCert),
+	}
+
+	// If requested, use the autocert library that will create a new
+	// certificate through Let's Encrypt as soon as the first client HTTP
+	// request on the server using the TLS config comes in. Unfortunately
+	// you cannot tell the library to create a certificate on startup for a
+	// specific host.
+	if autoCert {
+		serverName := serverName
+		if serverName == "" {
+			return nil, fmt.Errorf("servername option is " +
+				"required for secure operation")
+		}
+
+		autoCertDir := filepath.Join(apertureDir, "autocert")
+		log.Infof("Configuring autocert for server %v with cache dir "+
+			"%v", serverName, autoCertDir)
+
+		m.autoCert = &autocert.Manager{
+			Cache:      autocert.DirCache(autoCertDir),
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(serverName),
+		}
+
+		go func() {
+			err := http.ListenAndServe(
+				":http", m.autoCert.HTTPHandler(nil),
+			)
+			if err != nil {
+				log.Errorf("autocert http: %v", err)
+			}
+		}()
+	} else if err := m.loadDefaultCert(); err != nil {
+		return nil, err
+	}
+
+	// Load all certificates that are already there, so any invalid ones
+	// are noticed on startup.
+	if certDir != "" {
+		entries, err := ioutil.ReadDir(certDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read certificate "+
+				"directory: %v", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+
+			hostname := entry.Name()
+			if _, err := m.hostCertificate(hostname); err != nil {
+				return nil, fmt.Errorf("unable to load "+
+					"certificate for %s: %v", hostname, err)
+			}
+			log.Infof("Loaded TLS certificate for %s", hostname)
+		}
+	}
+
+	return m, nil
+}
+
+// TLSConfig returns a TLS config that serves the certificates of the manager
+// with the given settings. Unless configured otherwise, TLS 1.0 is the minimum
+// version.
+func (m *CertManager) TLSConfig(settings *TLSSettings) (*tls.Config, error) {
+	minVersion, err := settings.minVersion(tls.VersionTLS10)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		CipherSuites:   http2TLSCipherSuites,
+		MinVersion:     minVersion,
+	}, nil
+}
+
+// GetCertificate returns the certificate for the hostname the client requested
+// through SNI. If there is none, the default certificate is returned.
+func (m *CertManager) GetCertificate(
+	hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	hostname := strings.ToLower(hello.ServerName)
+	if m.certDir != "" && hostname != "" {
+		hostCert, err := m.hostCertificate(hostname)
+		if err != nil {
+			log.Errorf("Unable to load TLS certificate for %s: %v",
+				hostname, err)
+		}
+		if hostCert != nil {
+			return hostCert, nil
+		}
+	}
+
+	if m.autoCert != nil {
+		return m.autoCert.GetCertificate(hello)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.defaultCert, nil
+}
+
+// loadDefaultCert loads the default certificate, creating or renewing it if
+// necessary.
+func (m *CertManager) loadDefaultCert() error {
+	certFile, _ := defaultCertFiles(m.apertureDir)
+
+	defaultCert, renewAt, err := loadSelfSignedCert(
+		m.serverName, m.apertureDir,
+	)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(certFile)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.defaultCert = defaultCert
+	m.defaultModTime = info.ModTime()
+	m.defaultRenewAt = renewAt
+
+	return nil
+}
+
+// reloadDefaultCert loads the default certificate again if its file changed
+// since it was last loaded or if it needs to be renewed. It returns true if
+// the certificate was reloaded.
+func (m *CertManager) reloadDefaultCert() (bool, error) {
+	certFile, _ := defaultCertFiles(m.apertureDir)
+	info, err := os.Stat(certFile)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	changed := !info.ModTime().Equal(m.defaultModTime)
+	renew := !m.defaultRenewAt.IsZero() && time.Now().After(
+		m.defaultRenewAt,
+	)
+	m.mu.Unlock()
+
+	if !changed && !renew {
+		return false, nil
+	}
+
+	// Keep serving the previous certificate if the new one can't be
+	// loaded, for example because it is only partially written.
+	if err := m.loadDefaultCert(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// WatchDefaultCert checks whether the default certificate needs to be reloaded
+// at the given interval until the quit channel is closed. New connections are
+// served the reloaded certificate, existing ones are kept open.
+func (m *CertManager) WatchDefaultCert(interval time.Duration,
+	quit <-chan struct{}) {
+
+	// Let's Encrypt certificates are renewed by the autocert manager.
+	if m.autoCert != nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		reloaded, err := m.reloadDefaultCert()
+		switch {
+		case err != nil:
+			log.Errorf("Unable to reload TLS certificate: %v", err)
+
+		case reloaded:
+			log.Infof("Reloaded TLS certificate")
+		}
+	}
+}
+
+// hostCertificate returns the certificate for the given hostname from the
+// certificate directory, loading it if it wasn't loaded before or changed
+// since. If there is no certificate for the hostname, nil is returned.
+func (m *CertManager) hostCertificate(hostname string) (*tls.Certificate,
+	error) {
+
+	// The hostname is chosen by the client, so it must never lead us
+	// outside of the certificate directory.
+	if hostname != filepath.Base(hostname) ||
+		strings.HasPrefix(hostname, ".") {
+
+		return nil, nil
+	}
+
+	hostDir := filepath.Join(m.certDir, hostname)
+	certFile := filepath.Join(hostDir, hostCertFilename)
+	info, err := os.Stat(certFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cached, ok := m.certs[hostname]
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.cert, nil
+	}
+
+	certData, err := tls.LoadX509KeyPair(
+		certFile, filepath.Join(hostDir, hostKeyFilename),
+	)
+	if err != nil {
+		// Keep serving the previous certificate if the new one can't
+		// be loaded, for example because it is only partially
+		// written.
+		if ok {
+			return cached.cert, err
+		}
+
+		return nil, err
+	}
+
+	m.certs[hostname] = &hostCert{
+		cert:    &certData,
+		modTime: info.ModTime(),
+	}
+
+	return &certData, nil
+}
+
+// loadSelfSignedCert loads the self-signed certificate from the aperture
+// directory, creating it if it doesn't exist and renewing it if it is about
+// to expire. The time it needs to be renewed at is returned as well, which is
+// zero if we didn't create the certificate.
+func loadSelfSignedCert(serverName, apertureDir string) (*tls.Certificate,
+	time.Time, error) {
+
+	// We want to create self-signed TLS certs and save them at the
+	// specified location (if they don't already exist).
+	tlsCertFile, tlsKeyFile := defaultCertFiles(apertureDir)
+	tlsExtraDomains := []string{serverName}
+	if !fileExists(tlsCertFile) && !fileExists(tlsKeyFile) {
+		log.Infof("Generating TLS certificates...")
+		err := cert.GenCertPair(
+			selfSignedCertOrganization, tlsCertFile, tlsKeyFile,
+			nil, tlsExtraDomains, false, selfSignedCertValidity,
+		)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		log.Infof("Done generating TLS certificates")
+	}
+
+	// Load the certs now so we can inspect them.
+	certData, parsedCert, err := cert.LoadCert(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// The margin is negative, so adding it to the expiry date should give
+	// us a date in about the middle of it's validity period.
+	expiryWithMargin := parsedCert.NotAfter.Add(
+		-1 * selfSignedCertExpiryMargin,
+	)
+
+	// We only want to renew a certificate that we created ourselves. If
+	// we are using a certificate that was passed to us (perhaps created by
+	// an externally running Let's Encrypt process) we aren't going to try
+	// to replace it.
+	isSelfSigned := len(parsedCert.Subject.Organization) > 0 &&
+		parsedCert.Subject.Organization[0] == selfSignedCertOrganization
+
+	// If the certificate expired or it was outdated, delete it and the TLS
+	// key and generate a new pair.
+	if isSelfSigned && time.Now().After(expiryWithMargin) {
+		log.Info("TLS certificate will expire soon, generating a " +
+			"new one")
+
+		err := os.Remove(tlsCertFile)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		err = os.Remove(tlsKeyFile)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		log.Infof("Renewing TLS certificates...")
+		err = cert.GenCertPair(
+			selfSignedCertOrganization, tlsCertFile, tlsKeyFile,
+			nil, nil, false, selfSignedCertValidity,
+		)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		log.Infof("Done renewing TLS certificates")
+
+		// Reload the certificate data.
+		certData, parsedCert, err = cert.LoadCert(
+			tlsCertFile, tlsKeyFile,
+		)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		expiryWithMargin = parsedCert.NotAfter.Add(
+			-1 * selfSignedCertExpiryMargin,
+		)
+	}
+
+	if !isSelfSigned {
+		return &certData, time.Time{}, nil
+	}
+
+	return &certData, expiryWithMargin, nil
+}
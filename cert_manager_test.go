@@ -0,0 +1,160 @@
+package aperture
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/cert"
+	"github.com/stretchr/testify/require"
+)
+
+// genHostCert generates a certificate for the given hostname in its directory
+// within the certificate directory.
+func genHostCert(t *testing.T, certDir, hostname string) {
+	t.Helper()
+
+	hostDir := filepath.Join(certDir, hostname)
+	require.NoError(t, os.MkdirAll(hostDir, 0700))
+	require.NoError(t, cert.GenCertPair(
+		"test", filepath.Join(hostDir, hostCertFilename),
+		filepath.Join(hostDir, hostKeyFilename), nil,
+		[]string{hostname}, false, selfSignedCertValidity,
+	))
+}
+
+// certHosts returns the DNS names of the given certificate.
+func certHosts(t *testing.T, certificate *tls.Certificate) []string {
+	t.Helper()
+
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+
+	return parsed.DNSNames
+}
+
+// TestCertManager makes sure clients are served the certificate of the
+// hostname they request, that new certificates are picked up and that all
+// other clients get the default certificate.
+func TestCertManager(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "aperture")
+	require.NoError(t, err)
+	defer os.RemoveAll(baseDir)
+
+	certDir := filepath.Join(baseDir, "certs")
+	genHostCert(t, certDir, "a.example.com")
+
+	m, err := NewCertManager("default.example.com", baseDir, certDir, false)
+	require.NoError(t, err)
+
+	getHosts := func(serverName string) []string {
+		certificate, err := m.GetCertificate(&tls.ClientHelloInfo{
+			ServerName: serverName,
+		})
+		require.NoError(t, err)
+
+		return certHosts(t, certificate)
+	}
+
+	require.Contains(t, getHosts("a.example.com"), "a.example.com")
+	require.Contains(t, getHosts("A.EXAMPLE.COM"), "a.example.com")
+
+	// Unknown hostnames and those trying to escape the certificate
+	// directory get the default certificate.
+	require.Contains(t, getHosts("b.example.com"), "default.example.com")
+	require.Contains(t, getHosts("../certs"), "default.example.com")
+	require.Contains(t, getHosts(""), "default.example.com")
+
+	// A certificate added while running is served right away.
+	genHostCert(t, certDir, "b.example.com")
+	require.Contains(t, getHosts("b.example.com"), "b.example.com")
+}
+
+// TestCertManagerReloadDefaultCert makes sure a replaced default certificate
+// is served to new connections without dropping the existing ones.
+func TestCertManagerReloadDefaultCert(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "aperture")
+	require.NoError(t, err)
+	defer os.RemoveAll(baseDir)
+
+	m, err := NewCertManager("old.example.com", baseDir, "", false)
+	require.NoError(t, err)
+
+	tlsConfig, err := m.TLSConfig(&TLSSettings{})
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	// The test server only asks the manager for a certificate if the
+	// client sends a server name.
+	newClient := func() *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName:         "aperture",
+				InsecureSkipVerify: true,
+			},
+		}}
+	}
+	getHosts := func(client *http.Client) []string {
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		_, _ = ioutil.ReadAll(resp.Body)
+		require.NoError(t, resp.Body.Close())
+
+		return resp.TLS.PeerCertificates[0].DNSNames
+	}
+
+	oldClient := newClient()
+	require.Contains(t, getHosts(oldClient), "old.example.com")
+
+	// Nothing is reloaded as long as the certificate doesn't change.
+	reloaded, err := m.reloadDefaultCert()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	// Replace the certificate, making sure its modification time changes
+	// even on file systems with a coarse resolution.
+	certFile, keyFile := defaultCertFiles(baseDir)
+	require.NoError(t, cert.GenCertPair(
+		selfSignedCertOrganization, certFile, keyFile, nil,
+		[]string{"new.example.com"}, false, selfSignedCertValidity,
+	))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		m.WatchDefaultCert(time.Millisecond, quit)
+	}()
+	defer func() {
+		close(quit)
+		<-done
+	}()
+
+	// New connections are served the new certificate, while the existing
+	// connection keeps working.
+	require.Eventually(t, func() bool {
+		for _, host := range getHosts(newClient()) {
+			if host == "new.example.com" {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Contains(t, getHosts(oldClient), "old.example.com")
+}
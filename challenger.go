@@ -1,7 +1,11 @@
 package aperture
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -12,14 +16,32 @@ import (
 	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lncfg"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/lntypes"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 // InvoiceRequestGenerator is a function type that returns a new request for the
-// lnrpc.AddInvoice call.
-type InvoiceRequestGenerator func(price int64) (*lnrpc.Invoice, error)
+// lnrpc.AddInvoice call. The context is the one of the request the invoice is
+// created for.
+type InvoiceRequestGenerator func(ctx context.Context,
+	price int64) (*InvoiceRequest, error)
+
+// InvoiceRequest is a request to create a new invoice. If the asset fields are
+// set, the invoice is paid with a Taproot Asset instead of satoshis and is
+// created through tapd, which determines its value in satoshis.
+type InvoiceRequest struct {
+	*lnrpc.Invoice
+
+	// AssetID is the ID of the Taproot Asset the invoice is paid with.
+	AssetID []byte
+
+	// AssetAmount is the number of units of the asset the invoice asks
+	// for.
+	AssetAmount uint64
+}
 
 // InvoiceClient is an interface that only implements part of a full lnd client,
 // namely the part around the invoices we need for the challenger to work.
@@ -38,19 +60,221 @@ type InvoiceClient interface {
 		opts ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error)
 }
 
-// LndChallenger is a challenger that uses an lnd backend to create new LSAT
-// payment challenges.
+// AssetInvoiceClient is an interface that only implements the part of a tapd
+// client we need to create invoices that are paid with Taproot Assets.
+type AssetInvoiceClient interface {
+	// AddAssetInvoice adds a new invoice for the given amount of the
+	// asset with the given ID to the lnd node tapd is connected to.
+	AddAssetInvoice(ctx context.Context, assetID []byte, assetAmount uint64,
+		invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error)
+}
+
+// PreimageStore is a store for the pre-images the challenger commits to when
+// creating invoices in pre-image lock mode.
+type PreimageStore interface {
+	// StorePreimage commits to the given pre-image, keyed by its hash.
+	StorePreimage(ctx context.Context, preimage lntypes.Preimage) error
+
+	// GetPreimages returns the pre-images committed to for the given
+	// payment hashes. Hashes without a commitment are missing from the
+	// returned map.
+	GetPreimages(ctx context.Context,
+		hashes []lntypes.Hash) (map[lntypes.Hash]lntypes.Preimage, error)
+
+	// DeletePreimage removes the pre-image commitment for the given
+	// payment hash.
+	DeletePreimage(ctx context.Context, hash lntypes.Hash) error
+}
+
+// SettlementStore is a store the challenger records the settled invoices in,
+// so their settlement is known to all aperture instances.
+type SettlementStore interface {
+	// MarkSettled records the invoice with the given payment hash as
+	// settled at the given time. It returns true if the invoice wasn't
+	// recorded as settled before.
+	MarkSettled(ctx context.Context, hash lntypes.Hash,
+		settleDate time.Time) (bool, error)
+}
+
+// SettlementNotifier is an entity that wants to be notified about every
+// invoice of an LSAT that is settled.
+type SettlementNotifier interface {
+	// TokenSettled is called once the invoice with the given payment
+	// hash was settled. It must not block.
+	TokenSettled(lntypes.Hash, *lnrpc.Invoice)
+}
+
+// ChallengerOption is a functional option that changes the behavior of the
+// LndChallenger.
+type ChallengerOption func(*LndChallenger)
+
+// PreimageLock is a challenger option that makes the challenger generate the
+// pre-image of each invoice itself and commit to it in the given store before
+// the invoice is created. An invoice is only regarded as settled if it was
+// settled with the pre-image we committed to. This makes sure the payment and
+// the access it grants are atomically linked, the same way the hash lock of an
+// atomic swap links both of its sides.
+func PreimageLock(store PreimageStore) ChallengerOption {
+	return func(l *LndChallenger) {
+		l.preimageStore = store
+	}
+}
+
+// RecordSettlements is a challenger option that makes the challenger record
+// every invoice it sees being settled in the given store.
+func RecordSettlements(store SettlementStore) ChallengerOption {
+	return func(l *LndChallenger) {
+		l.settlementStore = store
+	}
+}
+
+// NotifySettlements is a challenger option that makes the challenger notify
+// the given notifier about every invoice it sees being settled. If settlements
+// are recorded as well, only invoices that weren't recorded as settled before
+// are notified about, so every settlement is notified about once across all
+// aperture instances sharing the store.
+func NotifySettlements(notifier SettlementNotifier) ChallengerOption {
+	return func(l *LndChallenger) {
+		l.settlementNotifier = notifier
+	}
+}
+
+// AssetInvoices is a challenger option that makes the challenger create the
+// invoices of requests for an asset through the given client. The invoices are
+// only tracked if tapd is connected to one of the challenger's lnd nodes.
+func AssetInvoices(client AssetInvoiceClient) ChallengerOption {
+	return func(l *LndChallenger) {
+		l.assetClient = client
+	}
+}
+
+// ReconnectOnOutage is a challenger option that makes the challenger keep
+// trying to reconnect to its lnd nodes in the background once it lost the
+// connection to all of them, instead of signaling a fatal error. This lets
+// another way of challenging clients take over while no node is available.
+func ReconnectOnOutage() ChallengerOption {
+	return func(l *LndChallenger) {
+		l.reconnectOnOutage = true
+	}
+}
+
+// lndConnectionError is the error the challenger reports if the connection to
+// a backing lnd node is lost.
+type lndConnectionError struct {
+	host string
+	err  error
+}
+
+// Error returns the error as a human readable string.
+func (e *lndConnectionError) Error() string {
+	return fmt.Sprintf("lost connection to lnd %s: %v", e.host, e.err)
+}
+
+// Unwrap returns the underlying error.
+func (e *lndConnectionError) Unwrap() error {
+	return e.err
+}
+
+// lndNode is a single lnd node the challenger is connected to.
+type lndNode struct {
+	// host is the host:port of the node, used to identify it in logs.
+	host string
+
+	// cfg is the connection config of the node. It is nil for nodes that
+	// weren't created from a config, which can't rotate their macaroon.
+	cfg *AuthConfig
+
+	client InvoiceClient
+
+	// conn is the connection the client uses. It is closed once the
+	// client is replaced or the challenger shuts down.
+	conn io.Closer
+
+	// operatorConn is the connection operator macaroons are verified
+	// with. It is nil until the first one is verified.
+	operatorConn *grpc.ClientConn
+
+	// healthy is true if the node's invoice subscription is currently
+	// running.
+	healthy bool
+
+	// degraded is true if creating an invoice on the node failed even
+	// though its invoice subscription is running. Degraded nodes are only
+	// used to create invoices if no other node is available.
+	degraded bool
+
+	// sub is the node's current invoice subscription.
+	sub *invoiceSubscription
+}
+
+// invoiceSubscription is a single invoice subscription to an lnd node.
+type invoiceSubscription struct {
+	// cancel aborts the subscription.
+	cancel func()
+}
+
+// LndChallenger is a challenger that uses one or more lnd backends to create
+// new LSAT payment challenges. All nodes are subscribed to at the same time so
+// invoices settled on any of them are accepted, but new invoices are only
+// created on the active node. The active node is always the first healthy
+// node in the list, so if the primary node becomes unavailable we fail over to
+// the next one and fail back once the primary recovers. If creating an invoice
+// fails, it is created on the next node instead.
 type LndChallenger struct {
-	client        InvoiceClient
+	nodes             []*lndNode
+	activeNode        int
+	nodesMtx          sync.Mutex
+	reconnectInterval time.Duration
+
 	genInvoiceReq InvoiceRequestGenerator
 
-	invoiceStates  map[lntypes.Hash]lnrpc.Invoice_InvoiceState
-	invoicesMtx    *sync.Mutex
-	invoicesCancel func()
-	invoicesCond   *sync.Cond
+	// reconnectOnOutage is true if we keep reconnecting to our nodes once
+	// we lost the connection to all of them instead of signaling a fatal
+	// error.
+	reconnectOnOutage bool
+
+	// preimageStore is the store pre-image commitments are kept in. It is
+	// nil if pre-image lock mode isn't enabled.
+	preimageStore PreimageStore
+
+	// settlementStore is the store settled invoices are recorded in. It
+	// is nil if settlements aren't recorded.
+	settlementStore SettlementStore
+
+	// settlementNotifier is notified about settled invoices. It is nil if
+	// nobody is interested in them.
+	settlementNotifier SettlementNotifier
+
+	// assetClient creates the invoices that are paid with an asset. It is
+	// nil if asset invoices aren't supported.
+	assetClient AssetInvoiceClient
+
+	invoiceStates map[lntypes.Hash]lnrpc.Invoice_InvoiceState
+	invoicesMtx   *sync.Mutex
+	invoicesCond  *sync.Cond
+
+	// invoiceSubscribers are the channels that are notified once an
+	// invoice reaches a final state, keyed by payment hash and
+	// subscriber ID. They are guarded by invoicesMtx.
+	invoiceSubscribers map[lntypes.Hash]map[uint64]chan lnrpc.Invoice_InvoiceState
+	nextSubscriberID   uint64
+	numSubscribers     int
+	subscribersClosed  bool
 
 	errChan chan<- error
 
+	// OnDisconnect is called whenever the connection to one of the lnd
+	// nodes is lost and we fail over to another one. If no node is left,
+	// the error is only sent to the error channel, so the loss isn't
+	// reported twice. The error is always a *lndConnectionError. The
+	// callback must not block.
+	OnDisconnect func(err error)
+
+	// OnReconnect is called whenever the connection to an lnd node that
+	// was previously lost could be re-established. The callback must not
+	// block.
+	OnReconnect func(host string)
+
 	quit chan struct{}
 	wg   sync.WaitGroup
 }
@@ -64,42 +288,177 @@ const (
 	// invoiceMacaroonName is the name of the invoice macaroon belonging
 	// to the target lnd node.
 	invoiceMacaroonName = "invoice.macaroon"
+
+	// defaultReconnectInterval is the initial interval at which we try
+	// to re-subscribe to the invoices of an lnd node we lost the
+	// connection to, or check whether a degraded node recovered.
+	defaultReconnectInterval = 10 * time.Second
+
+	// maxReconnectInterval is the interval the reconnect interval is
+	// doubled up to after every failed attempt.
+	maxReconnectInterval = 5 * time.Minute
+
+	// macaroonVerifyTimeout is the maximum time we wait for lnd to accept
+	// a new macaroon when rotating it.
+	macaroonVerifyTimeout = 10 * time.Second
+
+	// defaultLndRPCPort is the port we connect to if the host of an lnd
+	// node doesn't specify one.
+	defaultLndRPCPort = "10009"
+
+	// maxSubscribersPerInvoice is the maximum number of subscribers that
+	// can wait for the final state of a single invoice.
+	maxSubscribersPerInvoice = 10
+
+	// maxInvoiceSubscribers is the maximum number of subscribers that can
+	// wait for the final state of any invoice at the same time.
+	maxInvoiceSubscribers = 10000
+
+	// preimageLookupTimeout is the maximum time we wait for a pre-image
+	// commitment to be looked up.
+	preimageLookupTimeout = 5 * time.Second
+
+	// preimageLookupAttempts is the number of times we try to look up the
+	// pre-image commitments of settled invoices before we give up and
+	// skip the check.
+	preimageLookupAttempts = 3
+
+	// settlementRecordTimeout is the maximum time we wait for a settled
+	// invoice to be recorded.
+	settlementRecordTimeout = 5 * time.Second
 )
 
 // NewLndChallenger creates a new challenger that uses the given connection
-// details to connect to an lnd backend to create payment challenges.
-func NewLndChallenger(cfg *AuthConfig, genInvoiceReq InvoiceRequestGenerator,
-	errChan chan<- error) (*LndChallenger, error) {
+// details to connect to one or more lnd backends to create payment
+// challenges. The first config describes the primary node, all others are
+// used for failover in the given order.
+func NewLndChallenger(cfgs []*AuthConfig,
+	genInvoiceReq InvoiceRequestGenerator, errChan chan<- error,
+	opts ...ChallengerOption) (*LndChallenger, error) {
 
 	if genInvoiceReq == nil {
 		return nil, fmt.Errorf("genInvoiceReq cannot be nil")
 	}
 
+	if len(cfgs) == 0 {
+		return nil, fmt.Errorf("at least one lnd node is required")
+	}
+
+	nodes := make([]*lndNode, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		if err := verifyLndVersion(cfg); err != nil {
+			return nil, err
+		}
+
+		conn, err := lndclient.NewBasicConn(
+			cfg.LndHost, cfg.TLSPath, cfg.MacDir, cfg.Network,
+			lndclient.MacFilename(invoiceMacaroonName),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to lnd %s: "+
+				"%v", cfg.LndHost, err)
+		}
+
+		nodes = append(nodes, &lndNode{
+			host:   cfg.LndHost,
+			cfg:    cfg,
+			client: lnrpc.NewLightningClient(conn),
+			conn:   conn,
+		})
+	}
+
+	invoicesMtx := &sync.Mutex{}
+	challenger := &LndChallenger{
+		nodes:             nodes,
+		reconnectInterval: defaultReconnectInterval,
+		genInvoiceReq:     genInvoiceReq,
+		invoiceStates:     make(map[lntypes.Hash]lnrpc.Invoice_InvoiceState),
+		invoicesMtx:       invoicesMtx,
+		invoicesCond:      sync.NewCond(invoicesMtx),
+		invoiceSubscribers: make(
+			map[lntypes.Hash]map[uint64]chan lnrpc.Invoice_InvoiceState,
+		),
+		quit:    make(chan struct{}),
+		errChan: errChan,
+	}
+	for _, opt := range opts {
+		opt(challenger)
+	}
+
+	return challenger, nil
+}
+
+// verifyLndVersion makes sure the lnd node described by the given config runs
+// a supported version. Querying the version requires the read-only macaroon
+// since the invoice macaroon lacks the permission to do so. If the version
+// can't be queried, a warning is logged but no error is returned, as the node
+// might just be temporarily unavailable.
+func verifyLndVersion(cfg *AuthConfig) error {
 	client, err := lndclient.NewBasicClient(
 		cfg.LndHost, cfg.TLSPath, cfg.MacDir, cfg.Network,
-		lndclient.MacFilename(invoiceMacaroonName),
+		lndclient.MacFilename(readonlyMacaroonName),
 	)
 	if err != nil {
-		return nil, err
+		log.Warnf("Unable to check version of lnd %s: %v", cfg.LndHost,
+			err)
+		return nil
 	}
 
-	invoicesMtx := &sync.Mutex{}
-	return &LndChallenger{
-		client:        client,
-		genInvoiceReq: genInvoiceReq,
-		invoiceStates: make(map[lntypes.Hash]lnrpc.Invoice_InvoiceState),
-		invoicesMtx:   invoicesMtx,
-		invoicesCond:  sync.NewCond(invoicesMtx),
-		quit:          make(chan struct{}),
-		errChan:       errChan,
-	}, nil
+	ctx, cancel := context.WithTimeout(context.Background(), lndRPCTimeout)
+	defer cancel()
+
+	version, err := queryLndVersion(ctx, client)
+	if err != nil {
+		log.Warnf("Unable to check version of lnd %s: %v", cfg.LndHost,
+			err)
+		return nil
+	}
+
+	return checkLndVersion(cfg.LndHost, version)
 }
 
 // Start starts the challenger's main work which is to keep track of all
-// invoices and their states. For that the backing lnd node is queried for all
-// invoices on startup and the a subscription to all subsequent invoice updates
-// is created.
+// invoices and their states. For that all backing lnd nodes are queried for
+// all invoices on startup and a subscription to all subsequent invoice updates
+// is created. Starting only fails if none of the nodes can be reached, nodes
+// that are unavailable are reconnected to in the background.
 func (l *LndChallenger) Start() error {
+	var lastErr error
+	for idx, node := range l.nodes {
+		lastErr = l.subscribeNode(idx)
+		if lastErr == nil {
+			continue
+		}
+
+		log.Errorf("Unable to subscribe to invoices of lnd %s: %v",
+			node.host, lastErr)
+
+		l.wg.Add(1)
+		go l.reconnectNode(idx)
+	}
+
+	l.nodesMtx.Lock()
+	defer l.nodesMtx.Unlock()
+
+	active, ok := l.firstHealthyNode()
+	if !ok {
+		return lastErr
+	}
+	l.activeNode = active
+
+	log.Infof("Using lnd %s to create invoices", l.nodes[active].host)
+
+	return nil
+}
+
+// subscribeNode queries the lnd node with the given index for all its
+// invoices, adds them to our cache and then subscribes to all subsequent
+// invoice updates. The node is marked as healthy if this succeeds.
+func (l *LndChallenger) subscribeNode(idx int) error {
+	l.nodesMtx.Lock()
+	client := l.nodes[idx].client
+	l.nodesMtx.Unlock()
+
 	// These are the default values for the subscription. In case there are
 	// no invoices yet, this will instruct lnd to just send us all updates.
 	// If there are existing invoices, these indices will be updated to
@@ -111,7 +470,7 @@ func (l *LndChallenger) Start() error {
 	// cache. We need to keep track of all invoices, even quite old ones to
 	// make sure tokens are valid. But to save space we only keep track of
 	// an invoice's state.
-	invoiceResp, err := l.client.ListInvoices(
+	invoiceResp, err := client.ListInvoices(
 		context.Background(), &lnrpc.ListInvoiceRequest{
 			NumMaxInvoices: math.MaxUint64,
 		},
@@ -120,6 +479,11 @@ func (l *LndChallenger) Start() error {
 		return err
 	}
 
+	// Find out which of the settled invoices weren't settled with the
+	// pre-image we committed to before we acquire the lock, as this might
+	// require a lot of lookups.
+	mismatches := l.preimageMismatches(invoiceResp.Invoices)
+
 	// Advance our indices to the latest known one so we'll only receive
 	// updates for new invoices and/or newly settled invoices.
 	l.invoicesMtx.Lock()
@@ -136,19 +500,26 @@ func (l *LndChallenger) Start() error {
 			return fmt.Errorf("error parsing invoice hash: %v", err)
 		}
 
-		// Don't track the state of canceled or expired invoices.
+		// Don't track the state of canceled or expired invoices, nor
+		// the state of invoices settled with an unexpected pre-image.
 		if invoiceIrrelevant(invoice) {
 			continue
 		}
+		if _, ok := mismatches[hash]; ok {
+			continue
+		}
 		l.invoiceStates[hash] = invoice.State
 	}
+
+	// A node that is reconnected to might have settled invoices while we
+	// weren't subscribed, so wake up everyone waiting for an update.
+	l.invoicesCond.Broadcast()
 	l.invoicesMtx.Unlock()
 
 	// We need to be able to cancel any subscription we make.
 	ctxc, cancel := context.WithCancel(context.Background())
-	l.invoicesCancel = cancel
 
-	subscriptionResp, err := l.client.SubscribeInvoices(
+	subscriptionResp, err := client.SubscribeInvoices(
 		ctxc, &lnrpc.InvoiceSubscription{
 			AddIndex:    addIndex,
 			SettleIndex: settleIndex,
@@ -159,20 +530,31 @@ func (l *LndChallenger) Start() error {
 		return err
 	}
 
+	sub := &invoiceSubscription{
+		cancel: cancel,
+	}
+
+	l.nodesMtx.Lock()
+	l.nodes[idx].sub = sub
+	l.nodes[idx].healthy = true
+	l.nodes[idx].degraded = false
+	l.nodesMtx.Unlock()
+
 	l.wg.Add(1)
 	go func() {
 		defer l.wg.Done()
 		defer cancel()
 
-		l.readInvoiceStream(subscriptionResp)
+		l.readInvoiceStream(idx, sub, subscriptionResp)
 	}()
 
 	return nil
 }
 
-// readInvoiceStream reads the invoice update messages sent on the stream until
-// the stream is aborted or the challenger is shutting down.
-func (l *LndChallenger) readInvoiceStream(
+// readInvoiceStream reads the invoice update messages sent on the stream of
+// the given subscription to the node with the given index until the stream is
+// aborted or the challenger is shutting down.
+func (l *LndChallenger) readInvoiceStream(idx int, sub *invoiceSubscription,
 	stream lnrpc.Lightning_SubscribeInvoicesClient) {
 
 	for {
@@ -191,14 +573,9 @@ func (l *LndChallenger) readInvoiceStream(
 		switch {
 
 		case err == io.EOF:
-			// The connection is shutting down, we can't continue
-			// to function properly. Signal the error to the main
-			// goroutine to force a shutdown/restart.
-			select {
-			case l.errChan <- err:
-			case <-l.quit:
-			default:
-			}
+			// The connection is shutting down, this node can't be
+			// used anymore.
+			l.handleNodeFailure(idx, sub, err)
 
 			return
 
@@ -212,17 +589,12 @@ func (l *LndChallenger) readInvoiceStream(
 			return
 
 		case err != nil:
-			log.Errorf("Received error from invoice subscription: "+
-				"%v", err)
-
-			// The connection is faulty, we can't continue to
-			// function properly. Signal the error to the main
-			// goroutine to force a shutdown/restart.
-			select {
-			case l.errChan <- err:
-			case <-l.quit:
-			default:
-			}
+			log.Errorf("Received error from invoice subscription "+
+				"of lnd %s: %v", l.nodes[idx].host, err)
+
+			// The connection is faulty, this node can't be used
+			// anymore.
+			l.handleNodeFailure(idx, sub, err)
 
 			return
 
@@ -235,44 +607,643 @@ func (l *LndChallenger) readInvoiceStream(
 			return
 		}
 
+		mismatch := l.preimageMismatch(invoice)
+
 		l.invoicesMtx.Lock()
-		if invoiceIrrelevant(invoice) {
-			// Don't keep the state of canceled or expired invoices.
+		if invoiceIrrelevant(invoice) || mismatch {
+			// Don't keep the state of canceled or expired invoices
+			// and don't regard invoices settled with an unexpected
+			// pre-image as settled.
 			delete(l.invoiceStates, hash)
 		} else {
 			l.invoiceStates[hash] = invoice.State
 		}
 
+		// Subscribers are only interested in whether the invoice was
+		// paid or not. An invoice settled with an unexpected pre-image
+		// is treated as failed.
+		switch {
+		case mismatch || invoice.State == lnrpc.Invoice_CANCELED:
+			l.notifySubscribers(hash, lnrpc.Invoice_CANCELED)
+
+		case invoice.State == lnrpc.Invoice_SETTLED:
+			l.notifySubscribers(hash, lnrpc.Invoice_SETTLED)
+		}
+
 		// Before releasing the lock, notify our conditions that listen
 		// for updates on the invoice state.
 		l.invoicesCond.Broadcast()
 		l.invoicesMtx.Unlock()
+
+		if invoice.State == lnrpc.Invoice_SETTLED && !mismatch &&
+			l.recordSettlement(hash, invoice) {
+
+			l.notifySettled(hash, invoice)
+		}
+	}
+}
+
+// recordSettlement records the given settled invoice in the settlement store,
+// if there is one. Failures are only logged, the invoice is recorded by the
+// reconciliation on the next start. It returns false if the invoice is known
+// to have been recorded as settled before.
+func (l *LndChallenger) recordSettlement(hash lntypes.Hash,
+	invoice *lnrpc.Invoice) bool {
+
+	if l.settlementStore == nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), settlementRecordTimeout,
+	)
+	defer cancel()
+
+	added, err := l.settlementStore.MarkSettled(
+		ctx, hash, time.Unix(invoice.SettleDate, 0),
+	)
+	if err != nil {
+		log.Errorf("Unable to record settlement of invoice %v: %v",
+			hash, err)
+
+		// Notifying about a settlement twice is better than not at
+		// all.
+		return true
+	}
+
+	return added
+}
+
+// notifySettled notifies the settlement notifier, if there is one, about the
+// given settled invoice.
+func (l *LndChallenger) notifySettled(hash lntypes.Hash,
+	invoice *lnrpc.Invoice) {
+
+	if l.settlementNotifier == nil {
+		return
+	}
+
+	l.settlementNotifier.TokenSettled(hash, invoice)
+}
+
+// handleNodeFailure marks the node with the given index as unhealthy after
+// its invoice subscription failed. If there is another healthy node, we fail
+// over to it, notify the OnDisconnect callback and try to reconnect to the
+// failed node in the background. If no healthy node is left, we can't continue
+// to function properly and signal the error to the main goroutine to force a
+// shutdown/restart, unless we were told to keep reconnecting during an outage.
+func (l *LndChallenger) handleNodeFailure(idx int, sub *invoiceSubscription,
+	err error) {
+
+	connErr := &lndConnectionError{host: l.nodes[idx].host, err: err}
+
+	l.nodesMtx.Lock()
+
+	// A subscription that has already been replaced, for example after
+	// rotating the macaroon, doesn't say anything about the node's health.
+	failed := l.nodes[idx]
+	if failed.sub != sub {
+		l.nodesMtx.Unlock()
+
+		log.Debugf("Replaced invoice subscription of lnd %s ended: %v",
+			failed.host, err)
+		return
+	}
+	failed.healthy = false
+
+	active, failover := l.firstUsableNode()
+	reconnect := failover || l.reconnectOnOutage
+	switch {
+	case failover:
+		if idx == l.activeNode {
+			log.Warnf("Lost connection to lnd %s, failing over "+
+				"to lnd %s", failed.host, l.nodes[active].host)
+		}
+		l.activeNode = active
+
+	case l.reconnectOnOutage:
+		log.Warnf("Lost connection to lnd %s, no lnd node left, "+
+			"reconnecting in the background", failed.host)
+
+	default:
+		select {
+		case l.errChan <- connErr:
+		case <-l.quit:
+		default:
+		}
+	}
+	if reconnect {
+		l.wg.Add(1)
+		go l.reconnectNode(idx)
+	}
+	l.nodesMtx.Unlock()
+
+	if reconnect && l.OnDisconnect != nil {
+		l.OnDisconnect(connErr)
+	}
+}
+
+// reconnectNode periodically tries to re-subscribe to the invoices of the
+// node with the given index until it succeeds or the challenger is shutting
+// down. The interval between the attempts is doubled every time, up to
+// maxReconnectInterval. Once the node is healthy again and has a higher
+// priority than the currently active node, we fail back to it.
+//
+// NOTE: This must be run as a goroutine.
+func (l *LndChallenger) reconnectNode(idx int) {
+	defer l.wg.Done()
+
+	node := l.nodes[idx]
+	interval := l.reconnectInterval
+	for {
+		select {
+		case <-time.After(interval):
+		case <-l.quit:
+			return
+		}
+
+		if err := l.subscribeNode(idx); err != nil {
+			log.Debugf("Unable to reconnect to lnd %s: %v",
+				node.host, err)
+			interval = nextReconnectInterval(interval)
+			continue
+		}
+
+		l.nodesMtx.Lock()
+		if active, _ := l.firstUsableNode(); active != l.activeNode {
+			log.Infof("Reconnected to lnd %s, failing back from "+
+				"lnd %s", node.host, l.nodes[l.activeNode].host)
+
+			l.activeNode = active
+		} else {
+			log.Infof("Reconnected to lnd %s", node.host)
+		}
+		l.nodesMtx.Unlock()
+
+		if l.OnReconnect != nil {
+			l.OnReconnect(node.host)
+		}
+
+		return
+	}
+}
+
+// degradeNode marks the node with the given index as degraded after creating
+// an invoice on it failed, fails over to the next node and starts checking the
+// node's health in the background.
+func (l *LndChallenger) degradeNode(idx int) {
+	l.nodesMtx.Lock()
+	defer l.nodesMtx.Unlock()
+
+	node := l.nodes[idx]
+	if node.degraded || !node.healthy {
+		return
+	}
+	node.degraded = true
+
+	if active, _ := l.firstUsableNode(); active != l.activeNode {
+		log.Warnf("Unable to create invoices on lnd %s, failing over "+
+			"to lnd %s", node.host, l.nodes[active].host)
+
+		l.activeNode = active
+	}
+
+	l.wg.Add(1)
+	go l.checkDegradedNode(idx)
+}
+
+// checkDegradedNode periodically checks whether the degraded node with the
+// given index responds again, until it does or the challenger is shutting
+// down. The interval between the checks is doubled every time, up to
+// maxReconnectInterval. Once the node recovered and has a higher priority than
+// the currently active node, we fail back to it.
+//
+// NOTE: This must be run as a goroutine.
+func (l *LndChallenger) checkDegradedNode(idx int) {
+	defer l.wg.Done()
+
+	node := l.nodes[idx]
+	interval := l.reconnectInterval
+	for {
+		select {
+		case <-time.After(interval):
+		case <-l.quit:
+			return
+		}
+
+		// The node is no longer degraded if we reconnected to it in
+		// the meantime.
+		l.nodesMtx.Lock()
+		client, degraded := node.client, node.degraded
+		l.nodesMtx.Unlock()
+		if !degraded {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(
+			context.Background(), lndRPCTimeout,
+		)
+		_, err := client.ListInvoices(ctx, &lnrpc.ListInvoiceRequest{
+			NumMaxInvoices: 1,
+		})
+		cancel()
+		if err != nil {
+			log.Debugf("Degraded lnd %s still unavailable: %v",
+				node.host, err)
+			interval = nextReconnectInterval(interval)
+			continue
+		}
+
+		l.nodesMtx.Lock()
+		node.degraded = false
+		if active, _ := l.firstUsableNode(); active != l.activeNode {
+			log.Infof("Lnd %s recovered, failing back from lnd %s",
+				node.host, l.nodes[l.activeNode].host)
+
+			l.activeNode = active
+		} else {
+			log.Infof("Lnd %s recovered", node.host)
+		}
+		l.nodesMtx.Unlock()
+
+		return
+	}
+}
+
+// nextReconnectInterval returns the interval to wait for after an attempt to
+// reach a node failed following the given interval.
+func nextReconnectInterval(interval time.Duration) time.Duration {
+	interval *= 2
+	if interval > maxReconnectInterval {
+		return maxReconnectInterval
+	}
+
+	return interval
+}
+
+// firstHealthyNode returns the index of the first healthy node.
+//
+// NOTE: The nodesMtx must be held when calling this method.
+func (l *LndChallenger) firstHealthyNode() (int, bool) {
+	for idx, node := range l.nodes {
+		if node.healthy {
+			return idx, true
+		}
+	}
+
+	return 0, false
+}
+
+// firstUsableNode returns the index of the first healthy node that isn't
+// degraded. If all healthy nodes are degraded, the first healthy one is
+// returned.
+//
+// NOTE: The nodesMtx must be held when calling this method.
+func (l *LndChallenger) firstUsableNode() (int, bool) {
+	for idx, node := range l.nodes {
+		if node.healthy && !node.degraded {
+			return idx, true
+		}
+	}
+
+	return l.firstHealthyNode()
+}
+
+// Available returns true if at least one node is healthy, so new invoices can
+// be created.
+func (l *LndChallenger) Available() bool {
+	l.nodesMtx.Lock()
+	defer l.nodesMtx.Unlock()
+
+	_, ok := l.firstHealthyNode()
+	return ok
+}
+
+// invoiceNodes returns the indices of the nodes new invoices should be created
+// on, in the order they should be tried: the active node first, then all other
+// healthy nodes by priority, degraded ones last.
+func (l *LndChallenger) invoiceNodes() []int {
+	l.nodesMtx.Lock()
+	defer l.nodesMtx.Unlock()
+
+	idxs := []int{l.activeNode}
+	for _, degraded := range []bool{false, true} {
+		for idx, node := range l.nodes {
+			if idx == l.activeNode || !node.healthy ||
+				node.degraded != degraded {
+
+				continue
+			}
+			idxs = append(idxs, idx)
+		}
+	}
+
+	return idxs
+}
+
+// addInvoice creates the given invoice on the active node. If that fails, the
+// node is marked as degraded and the invoice is created on the next node
+// instead, until it could be created or all nodes failed.
+func (l *LndChallenger) addInvoice(ctx context.Context,
+	invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+
+	var lastErr error
+	for _, idx := range l.invoiceNodes() {
+		l.nodesMtx.Lock()
+		node := l.nodes[idx]
+		client := node.client
+		l.nodesMtx.Unlock()
+
+		response, err := client.AddInvoice(ctx, invoice)
+		if err == nil {
+			return response, nil
+		}
+		lastErr = err
+
+		// The request being canceled doesn't tell us anything about
+		// the node.
+		if ctx.Err() != nil {
+			break
+		}
+
+		log.Warnf("Error adding invoice on lnd %s: %v", node.host,
+			err)
+		l.degradeNode(idx)
 	}
+
+	return nil, lastErr
+}
+
+// addAssetInvoice adds a new invoice that is paid with an asset through tapd.
+// Unlike other invoices, it isn't failed over to another node, as it can only
+// be paid through the asset channels of tapd's lnd node.
+func (l *LndChallenger) addAssetInvoice(ctx context.Context,
+	req *InvoiceRequest) (*lnrpc.AddInvoiceResponse, error) {
+
+	if l.assetClient == nil {
+		return nil, errors.New("asset invoices not supported")
+	}
+
+	return l.assetClient.AddAssetInvoice(
+		ctx, req.AssetID, req.AssetAmount, req.Invoice,
+	)
 }
 
 // Stop shuts down the challenger.
 func (l *LndChallenger) Stop() {
-	l.invoicesCancel()
+	// Signal shutdown first so a subscription that is started by a
+	// concurrent reconnect attempt exits right away.
 	close(l.quit)
+
+	l.nodesMtx.Lock()
+	for _, node := range l.nodes {
+		if node.sub != nil {
+			node.sub.cancel()
+		}
+	}
+	l.nodesMtx.Unlock()
+
 	l.wg.Wait()
+
+	l.closeSubscribers()
+
+	for _, node := range l.nodes {
+		if node.operatorConn != nil {
+			_ = node.operatorConn.Close()
+		}
+
+		if node.conn == nil {
+			continue
+		}
+
+		if err := node.conn.Close(); err != nil {
+			log.Errorf("Error closing connection to lnd %s: %v",
+				node.host, err)
+		}
+	}
+}
+
+// closeSubscribers lets all subscribers to invoice states know they won't
+// receive any update anymore. Later subscriptions are closed right away. This
+// is done before the in-flight requests are drained on shutdown, so clients
+// waiting for an invoice don't hold up the shutdown, while new challenges can
+// still be issued until the challenger is stopped.
+func (l *LndChallenger) closeSubscribers() {
+	l.invoicesMtx.Lock()
+	defer l.invoicesMtx.Unlock()
+
+	for hash, subscribers := range l.invoiceSubscribers {
+		for _, subscriber := range subscribers {
+			close(subscriber)
+		}
+		delete(l.invoiceSubscribers, hash)
+	}
+	l.numSubscribers = 0
+	l.subscribersClosed = true
+}
+
+// RotateMacaroon replaces the macaroon used to connect to the lnd node with the
+// given host, or the primary node if the host is empty. A new connection using
+// the new macaroon is established and verified first. Only if that succeeds,
+// new invoices are created and subscribed to through the new connection. The
+// subscription of the old connection is kept running for the given drain
+// period so no updates are missed, then the old connection is closed.
+func (l *LndChallenger) RotateMacaroon(host string, macaroon []byte,
+	drainPeriod time.Duration) error {
+
+	idx := -1
+	for i, node := range l.nodes {
+		if host == "" || node.host == host {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("unknown lnd node %s", host)
+	}
+
+	node := l.nodes[idx]
+	if node.cfg == nil {
+		return fmt.Errorf("lnd node %s doesn't support macaroon "+
+			"rotation", node.host)
+	}
+
+	conn, err := lndclient.NewBasicConn(
+		node.cfg.LndHost, node.cfg.TLSPath, "", node.cfg.Network,
+		lndclient.MacaroonData(hex.EncodeToString(macaroon)),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to connect to lnd %s: %v", node.host,
+			err)
+	}
+	client := lnrpc.NewLightningClient(conn)
+
+	// Make sure the new macaroon is valid and has the permissions we need
+	// before we start using it.
+	ctx, cancel := context.WithTimeout(
+		context.Background(), macaroonVerifyTimeout,
+	)
+	defer cancel()
+	_, err = client.ListInvoices(ctx, &lnrpc.ListInvoiceRequest{
+		NumMaxInvoices: 1,
+	})
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("unable to verify new macaroon: %v", err)
+	}
+
+	l.nodesMtx.Lock()
+	oldClient, oldConn, oldSub := node.client, node.conn, node.sub
+	node.client, node.conn = client, conn
+	l.nodesMtx.Unlock()
+
+	// Subscribing replaces the node's current subscription, which causes
+	// any error on the old one to be ignored from now on.
+	if err := l.subscribeNode(idx); err != nil {
+		l.nodesMtx.Lock()
+		node.client, node.conn = oldClient, oldConn
+		l.nodesMtx.Unlock()
+
+		_ = conn.Close()
+		return fmt.Errorf("unable to subscribe to invoices with new "+
+			"macaroon: %v", err)
+	}
+
+	log.Infof("Rotated macaroon of lnd %s, draining old connection for %v",
+		node.host, drainPeriod)
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		select {
+		case <-time.After(drainPeriod):
+		case <-l.quit:
+		}
+
+		if oldSub != nil {
+			oldSub.cancel()
+		}
+		if oldConn != nil {
+			if err := oldConn.Close(); err != nil {
+				log.Errorf("Error closing old connection to "+
+					"lnd %s: %v", node.host, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// VerifyOperatorMacaroon checks that the given hex encoded macaroon belongs to
+// the operator of the active lnd node by listing the node's macaroon IDs with
+// it. Only macaroons with the macaroon:read permission, which by default is
+// only granted to the admin macaroon, are allowed to do so. All checks share a
+// single connection to the node that doesn't carry a macaroon of its own.
+func (l *LndChallenger) VerifyOperatorMacaroon(ctx context.Context,
+	macHex string) error {
+
+	conn, err := l.operatorConn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lndRPCTimeout)
+	defer cancel()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "macaroon", macHex)
+	_, err = lnrpc.NewLightningClient(conn).ListMacaroonIDs(
+		ctx, &lnrpc.ListMacaroonIDsRequest{},
+	)
+	return err
+}
+
+// operatorConn returns the connection to the active lnd node that operator
+// macaroons are verified with, connecting to the node if necessary.
+func (l *LndChallenger) operatorConn() (*grpc.ClientConn, error) {
+	l.nodesMtx.Lock()
+	defer l.nodesMtx.Unlock()
+
+	node := l.nodes[l.activeNode]
+	if node.operatorConn != nil {
+		return node.operatorConn, nil
+	}
+	if node.cfg == nil {
+		return nil, fmt.Errorf("lnd node %s doesn't support operator "+
+			"verification", node.host)
+	}
+
+	creds, err := lndclient.GetTLSCredentials(
+		"", node.cfg.TLSPath, false, false,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection is only established once it is used, so this
+	// doesn't block even if the node is down.
+	conn, err := grpc.Dial(
+		node.cfg.LndHost, grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(
+			lncfg.ClientAddressDialer(defaultLndRPCPort),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to lnd %s: %v",
+			node.host, err)
+	}
+	node.operatorConn = conn
+
+	return conn, nil
 }
 
 // NewChallenge creates a new LSAT payment challenge, returning a payment
 // request (invoice) and the corresponding payment hash.
 //
 // NOTE: This is part of the mint.Challenger interface.
-func (l *LndChallenger) NewChallenge(price int64) (string, lntypes.Hash, error) {
+func (l *LndChallenger) NewChallenge(ctx context.Context,
+	price int64) (string, lntypes.Hash, error) {
+
 	// Obtain a new invoice from lnd first. We need to know the payment hash
 	// so we can add it as a caveat to the macaroon.
-	invoice, err := l.genInvoiceReq(price)
+	invoice, err := l.genInvoiceReq(ctx, price)
 	if err != nil {
 		log.Errorf("Error generating invoice request: %v", err)
 		return "", lntypes.ZeroHash, err
 	}
-	ctx := context.Background()
-	response, err := l.client.AddInvoice(ctx, invoice)
+	// In pre-image lock mode, we choose the pre-image ourselves and
+	// commit to it before the invoice even exists.
+	var preimage *lntypes.Preimage
+	if l.preimageStore != nil {
+		preimage = &lntypes.Preimage{}
+		if _, err := rand.Read(preimage[:]); err != nil {
+			log.Errorf("Error generating preimage: %v", err)
+			return "", lntypes.ZeroHash, err
+		}
+		invoice.RPreimage = preimage[:]
+
+		err := l.preimageStore.StorePreimage(ctx, *preimage)
+		if err != nil {
+			log.Errorf("Error storing preimage commitment: %v", err)
+			return "", lntypes.ZeroHash, err
+		}
+	}
+
+	var response *lnrpc.AddInvoiceResponse
+	if len(invoice.AssetID) > 0 {
+		response, err = l.addAssetInvoice(ctx, invoice)
+	} else {
+		response, err = l.addInvoice(ctx, invoice.Invoice)
+	}
 	if err != nil {
 		log.Errorf("Error adding invoice: %v", err)
+
+		// Clean up the commitment of the invoice that was never
+		// created.
+		if preimage != nil {
+			_ = l.preimageStore.DeletePreimage(ctx, preimage.Hash())
+		}
+
 		return "", lntypes.ZeroHash, err
 	}
 	paymentHash, err := lntypes.MakeHash(response.RHash)
@@ -281,6 +1252,14 @@ func (l *LndChallenger) NewChallenge(price int64) (string, lntypes.Hash, error)
 		return "", lntypes.ZeroHash, err
 	}
 
+	// Track the invoice right away, so the client can subscribe to its
+	// state before lnd notified us about it.
+	l.invoicesMtx.Lock()
+	if _, ok := l.invoiceStates[paymentHash]; !ok {
+		l.invoiceStates[paymentHash] = lnrpc.Invoice_OPEN
+	}
+	l.invoicesMtx.Unlock()
+
 	return response.PaymentRequest, paymentHash, nil
 }
 
@@ -368,6 +1347,183 @@ func (l *LndChallenger) VerifyInvoiceStatus(hash lntypes.Hash,
 	}
 }
 
+// SubscribeInvoiceState subscribes to the final state of the invoice with the
+// given payment hash. Exactly one state is sent on the returned channel, either
+// lnrpc.Invoice_SETTLED or lnrpc.Invoice_CANCELED, if the invoice is already
+// settled or as soon as it settles or fails. The channel is closed without a
+// state if the challenger shuts down first. Up to maxSubscribersPerInvoice
+// subscribers can wait for the same invoice. Invoices we don't know, including
+// ones that were canceled, expired or settled with an unexpected pre-image,
+// can't be subscribed to. The returned function must be called to cancel the
+// subscription once the caller isn't interested in the state anymore.
+func (l *LndChallenger) SubscribeInvoiceState(
+	hash lntypes.Hash) (<-chan lnrpc.Invoice_InvoiceState, func(), error) {
+
+	l.invoicesMtx.Lock()
+	defer l.invoicesMtx.Unlock()
+
+	// The channel is buffered so we never block on a slow subscriber
+	// while holding the lock.
+	stateChan := make(chan lnrpc.Invoice_InvoiceState, 1)
+	state, ok := l.invoiceStates[hash]
+	switch {
+	case l.subscribersClosed:
+		close(stateChan)
+		return stateChan, func() {}, nil
+
+	case !ok:
+		return nil, nil, ErrUnknownInvoice
+
+	case state == lnrpc.Invoice_SETTLED:
+		stateChan <- lnrpc.Invoice_SETTLED
+		return stateChan, func() {}, nil
+
+	case len(l.invoiceSubscribers[hash]) >= maxSubscribersPerInvoice,
+		l.numSubscribers >= maxInvoiceSubscribers:
+
+		return nil, nil, ErrTooManySubscribers
+	}
+
+	id := l.nextSubscriberID
+	l.nextSubscriberID++
+
+	if l.invoiceSubscribers[hash] == nil {
+		l.invoiceSubscribers[hash] = make(
+			map[uint64]chan lnrpc.Invoice_InvoiceState,
+		)
+	}
+	l.invoiceSubscribers[hash][id] = stateChan
+	l.numSubscribers++
+
+	cancel := func() {
+		l.invoicesMtx.Lock()
+		defer l.invoicesMtx.Unlock()
+
+		subscribers, ok := l.invoiceSubscribers[hash]
+		if !ok {
+			return
+		}
+		if _, ok := subscribers[id]; !ok {
+			return
+		}
+		delete(subscribers, id)
+		l.numSubscribers--
+		if len(subscribers) == 0 {
+			delete(l.invoiceSubscribers, hash)
+		}
+	}
+
+	return stateChan, cancel, nil
+}
+
+// notifySubscribers sends the given final state to all subscribers of the
+// invoice with the given payment hash and removes them.
+//
+// NOTE: The invoicesMtx must be held when calling this method.
+func (l *LndChallenger) notifySubscribers(hash lntypes.Hash,
+	state lnrpc.Invoice_InvoiceState) {
+
+	for _, subscriber := range l.invoiceSubscribers[hash] {
+		subscriber <- state
+		l.numSubscribers--
+	}
+	delete(l.invoiceSubscribers, hash)
+}
+
+// preimageMismatch returns true if pre-image lock mode is enabled and the given
+// invoice was settled with a pre-image other than the one we committed to.
+func (l *LndChallenger) preimageMismatch(invoice *lnrpc.Invoice) bool {
+	mismatches := l.preimageMismatches([]*lnrpc.Invoice{invoice})
+	return len(mismatches) > 0
+}
+
+// preimageMismatches returns the payment hashes of the given invoices that
+// were settled with a pre-image other than the one we committed to, if
+// pre-image lock mode is enabled. The commitments are looked up in batches.
+// Invoices we don't have a commitment for, for example because they were
+// created before pre-image lock mode was enabled, are never a mismatch. Neither
+// are invoices whose commitments can't be looked up.
+func (l *LndChallenger) preimageMismatches(
+	invoices []*lnrpc.Invoice) map[lntypes.Hash]struct{} {
+
+	mismatches := make(map[lntypes.Hash]struct{})
+	if l.preimageStore == nil {
+		return mismatches
+	}
+
+	settled := make(map[lntypes.Hash]*lnrpc.Invoice)
+	hashes := make([]lntypes.Hash, 0, len(invoices))
+	for _, invoice := range invoices {
+		if invoice.State != lnrpc.Invoice_SETTLED {
+			continue
+		}
+
+		hash, err := lntypes.MakeHash(invoice.RHash)
+		if err != nil {
+			continue
+		}
+		settled[hash] = invoice
+		hashes = append(hashes, hash)
+	}
+	if len(hashes) == 0 {
+		return mismatches
+	}
+
+	// An invoice can only be settled with the pre-image of its payment
+	// hash, so failing to look up the commitments must never cost a client
+	// the LSAT it paid for. If the lookup keeps failing, we skip the check.
+	committed, err := l.lookupPreimages(hashes)
+	if err != nil {
+		log.Warnf("Unable to look up preimage commitments of %d "+
+			"settled invoices, not checking their preimages: %v",
+			len(hashes), err)
+
+		return mismatches
+	}
+
+	for hash, preimage := range committed {
+		invoice := settled[hash]
+		if bytes.Equal(preimage[:], invoice.RPreimage) {
+			continue
+		}
+
+		log.Errorf("Invoice %v was settled with preimage %x instead of "+
+			"the committed one, not accepting it", hash,
+			invoice.RPreimage)
+		mismatches[hash] = struct{}{}
+	}
+
+	return mismatches
+}
+
+// lookupPreimages looks up the pre-image commitments of the given payment
+// hashes, retrying a failed lookup up to preimageLookupAttempts times.
+func (l *LndChallenger) lookupPreimages(
+	hashes []lntypes.Hash) (map[lntypes.Hash]lntypes.Preimage, error) {
+
+	// Every batch of commitments gets the full lookup timeout.
+	batches := (len(hashes) + preimageBatchSize - 1) / preimageBatchSize
+	timeout := time.Duration(batches) * preimageLookupTimeout
+
+	var err error
+	for i := 0; i < preimageLookupAttempts; i++ {
+		var committed map[lntypes.Hash]lntypes.Preimage
+		ctx, cancel := context.WithTimeout(
+			context.Background(), timeout,
+		)
+		committed, err = l.preimageStore.GetPreimages(ctx, hashes)
+		cancel()
+		if err == nil {
+			return committed, nil
+		}
+
+		log.Debugf("Preimage commitment lookup attempt %d failed: %v",
+			i+1, err)
+	}
+
+	return nil, err
+}
+
 // invoiceIrrelevant returns true if an invoice is nil, canceled or non-settled
 // and expired.
 func invoiceIrrelevant(invoice *lnrpc.Invoice) bool {
@@ -2,6 +2,7 @@ package aperture
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
@@ -45,6 +46,30 @@ type mockInvoiceClient struct {
 	quit       chan struct{}
 
 	lastAddIndex uint64
+
+	// unavailable makes all calls but SubscribeInvoices fail if set.
+	unavailableMtx sync.Mutex
+	unavailable    bool
+}
+
+// setUnavailable makes the calls to the node fail or succeed again.
+func (m *mockInvoiceClient) setUnavailable(unavailable bool) {
+	m.unavailableMtx.Lock()
+	defer m.unavailableMtx.Unlock()
+
+	m.unavailable = unavailable
+}
+
+// checkAvailable returns an error if the node is unavailable.
+func (m *mockInvoiceClient) checkAvailable() error {
+	m.unavailableMtx.Lock()
+	defer m.unavailableMtx.Unlock()
+
+	if m.unavailable {
+		return fmt.Errorf("node unavailable")
+	}
+
+	return nil
 }
 
 // ListInvoices returns a paginated list of all invoices known to lnd.
@@ -52,6 +77,10 @@ func (m *mockInvoiceClient) ListInvoices(_ context.Context,
 	_ *lnrpc.ListInvoiceRequest,
 	_ ...grpc.CallOption) (*lnrpc.ListInvoiceResponse, error) {
 
+	if err := m.checkAvailable(); err != nil {
+		return nil, err
+	}
+
 	return &lnrpc.ListInvoiceResponse{
 		Invoices: m.invoices,
 	}, nil
@@ -75,6 +104,10 @@ func (m *mockInvoiceClient) SubscribeInvoices(_ context.Context,
 func (m *mockInvoiceClient) AddInvoice(_ context.Context, in *lnrpc.Invoice,
 	_ ...grpc.CallOption) (*lnrpc.AddInvoiceResponse, error) {
 
+	if err := m.checkAvailable(); err != nil {
+		return nil, err
+	}
+
 	m.invoices = append(m.invoices, in)
 
 	return &lnrpc.AddInvoiceResponse{
@@ -88,27 +121,55 @@ func (m *mockInvoiceClient) stop() {
 	close(m.quit)
 }
 
-func newChallenger() (*LndChallenger, *mockInvoiceClient, chan error) {
-	mockClient := &mockInvoiceClient{
+func newMockInvoiceClient() *mockInvoiceClient {
+	return &mockInvoiceClient{
 		updateChan: make(chan *lnrpc.Invoice),
 		errChan:    make(chan error, 1),
 		quit:       make(chan struct{}),
 	}
-	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
-		return newInvoice(lntypes.ZeroHash, 99, lnrpc.Invoice_OPEN),
-			nil
+}
+
+func newChallenger() (*LndChallenger, *mockInvoiceClient, chan error) {
+	mockClient := newMockInvoiceClient()
+	c, mainErrChan := newMultiNodeChallenger(mockClient)
+
+	return c, mockClient, mainErrChan
+}
+
+func newMultiNodeChallenger(
+	clients ...*mockInvoiceClient) (*LndChallenger, chan error) {
+
+	genInvoiceReq := func(context.Context, int64) (*InvoiceRequest, error) {
+		return &InvoiceRequest{
+			Invoice: newInvoice(
+				lntypes.ZeroHash, 99, lnrpc.Invoice_OPEN,
+			),
+		}, nil
+	}
+	nodes := make([]*lndNode, len(clients))
+	for idx, client := range clients {
+		nodes[idx] = &lndNode{
+			host:   fmt.Sprintf("node%d", idx),
+			client: client,
+		}
 	}
 	invoicesMtx := &sync.Mutex{}
 	mainErrChan := make(chan error)
 	return &LndChallenger{
-		client:        mockClient,
-		genInvoiceReq: genInvoiceReq,
-		invoiceStates: make(map[lntypes.Hash]lnrpc.Invoice_InvoiceState),
-		quit:          make(chan struct{}),
-		invoicesMtx:   invoicesMtx,
-		invoicesCond:  sync.NewCond(invoicesMtx),
-		errChan:       mainErrChan,
-	}, mockClient, mainErrChan
+		nodes:             nodes,
+		reconnectInterval: defaultReconnectInterval,
+		genInvoiceReq:     genInvoiceReq,
+		invoiceStates: make(
+			map[lntypes.Hash]lnrpc.Invoice_InvoiceState,
+		),
+		invoiceSubscribers: make(
+			map[lntypes.Hash]map[uint64]chan lnrpc.Invoice_InvoiceState,
+		),
+		quit:         make(chan struct{}),
+		invoicesMtx:  invoicesMtx,
+		invoicesCond: sync.NewCond(invoicesMtx),
+		errChan:      mainErrChan,
+	}, mainErrChan
 }
 
 func newInvoice(hash lntypes.Hash, addIndex uint64,
@@ -138,7 +199,7 @@ func TestLndChallenger(t *testing.T) {
 	c, invoiceMock, mainErrChan := newChallenger()
 
 	// Creating a new challenge should add an invoice to the lnd backend.
-	req, hash, err := c.NewChallenge(1337)
+	req, hash, err := c.NewChallenge(context.Background(), 1337)
 	require.NoError(t, err)
 	require.Equal(t, "foo", req)
 	require.Equal(t, lntypes.ZeroHash, hash)
@@ -251,3 +312,596 @@ func TestLndChallenger(t *testing.T) {
 	invoiceMock.stop()
 	c.Stop()
 }
+
+func TestLndChallengerFailover(t *testing.T) {
+	t.Parallel()
+
+	primary := newMockInvoiceClient()
+	backup := newMockInvoiceClient()
+	c, mainErrChan := newMultiNodeChallenger(primary, backup)
+	c.reconnectInterval = defaultTimeout
+
+	disconnected := make(chan error, 1)
+	reconnected := make(chan string, 1)
+	c.OnDisconnect = func(err error) {
+		disconnected <- err
+	}
+	c.OnReconnect = func(host string) {
+		reconnected <- host
+	}
+
+	activeNode := func() int {
+		c.nodesMtx.Lock()
+		defer c.nodesMtx.Unlock()
+
+		return c.activeNode
+	}
+
+	// With both nodes healthy, invoices should be created on the primary.
+	require.NoError(t, c.Start())
+	require.Equal(t, 0, activeNode())
+	_, _, err := c.NewChallenge(context.Background(), 1337)
+	require.NoError(t, err)
+	require.Len(t, primary.invoices, 1)
+	require.Empty(t, backup.invoices)
+
+	// Invoices settled on the backup node should be accepted as well.
+	hash := lntypes.Hash{1, 2, 3}
+	backup.updateChan <- newInvoice(hash, 1, lnrpc.Invoice_SETTLED)
+	require.NoError(t, c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, defaultTimeout,
+	))
+
+	// Break the primary's subscription. We should fail over to the backup
+	// node without signaling an error to the main goroutine.
+	primary.errChan <- fmt.Errorf("an expected error")
+	select {
+	case err := <-disconnected:
+		require.Contains(t, err.Error(), "node0")
+
+	case <-time.After(defaultTimeout):
+		t.Fatalf("disconnect callback not called")
+	}
+	require.Eventually(t, func() bool {
+		return activeNode() == 1
+	}, defaultTimeout, time.Millisecond)
+
+	_, _, err = c.NewChallenge(context.Background(), 1337)
+	require.NoError(t, err)
+	require.Len(t, backup.invoices, 1)
+
+	select {
+	case err := <-mainErrChan:
+		t.Fatalf("unexpected error on main chan: %v", err)
+	default:
+	}
+
+	// The mock's subscription succeeds right away, so once the reconnect
+	// interval has passed we should fail back to the primary.
+	require.Eventually(t, func() bool {
+		return activeNode() == 0
+	}, 5*defaultTimeout, time.Millisecond)
+	require.Equal(t, "node0", <-reconnected)
+
+	primary.stop()
+	backup.stop()
+	c.Stop()
+}
+
+// TestLndChallengerReconnectOnOutage makes sure the challenger keeps
+// reconnecting to its only node in the background after losing it, without
+// signaling a fatal error, if told so.
+func TestLndChallengerReconnectOnOutage(t *testing.T) {
+	t.Parallel()
+
+	c, invoiceMock, mainErrChan := newChallenger()
+	ReconnectOnOutage()(c)
+	c.reconnectInterval = defaultTimeout / 10
+	require.NoError(t, c.Start())
+	defer func() {
+		invoiceMock.stop()
+		c.Stop()
+	}()
+	require.True(t, c.Available())
+
+	// While the node can't be reached, no invoices can be created.
+	invoiceMock.setUnavailable(true)
+	invoiceMock.errChan <- fmt.Errorf("an expected error")
+	require.Eventually(t, func() bool {
+		return !c.Available()
+	}, defaultTimeout, time.Millisecond)
+
+	select {
+	case err := <-mainErrChan:
+		t.Fatalf("unexpected error on main chan: %v", err)
+
+	case <-time.After(defaultTimeout):
+	}
+
+	// Once the node is back, we reconnect to it.
+	invoiceMock.setUnavailable(false)
+	require.Eventually(t, c.Available, 10*defaultTimeout, time.Millisecond)
+}
+
+type mockPreimageStore struct {
+	sync.Mutex
+	preimages map[lntypes.Hash]lntypes.Preimage
+	lookupErr error
+}
+
+func (m *mockPreimageStore) StorePreimage(_ context.Context,
+	preimage lntypes.Preimage) error {
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.preimages[preimage.Hash()] = preimage
+	return nil
+}
+
+func (m *mockPreimageStore) GetPreimages(_ context.Context,
+	hashes []lntypes.Hash) (map[lntypes.Hash]lntypes.Preimage, error) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.lookupErr != nil {
+		return nil, m.lookupErr
+	}
+
+	preimages := make(map[lntypes.Hash]lntypes.Preimage)
+	for _, hash := range hashes {
+		if preimage, ok := m.preimages[hash]; ok {
+			preimages[hash] = preimage
+		}
+	}
+	return preimages, nil
+}
+
+func (m *mockPreimageStore) DeletePreimage(_ context.Context,
+	hash lntypes.Hash) error {
+
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.preimages, hash)
+	return nil
+}
+
+// TestLndChallengerPreimageLock makes sure invoices are only regarded as
+// settled if they were settled with the pre-image we committed to.
+// TestLndChallengerInvoiceFailover makes sure invoices are created on the next
+// node if creating them on the active node fails, and that we fail back to the
+// node once it recovered.
+func TestLndChallengerInvoiceFailover(t *testing.T) {
+	t.Parallel()
+
+	primary := newMockInvoiceClient()
+	backup := newMockInvoiceClient()
+	c, mainErrChan := newMultiNodeChallenger(primary, backup)
+	c.reconnectInterval = defaultTimeout
+
+	activeNode := func() int {
+		c.nodesMtx.Lock()
+		defer c.nodesMtx.Unlock()
+
+		return c.activeNode
+	}
+
+	require.NoError(t, c.Start())
+	require.Equal(t, 0, activeNode())
+
+	// The invoice subscription of the primary keeps running, but it can't
+	// create invoices. They should be created on the backup instead.
+	primary.setUnavailable(true)
+	_, _, err := c.NewChallenge(context.Background(), 1337)
+	require.NoError(t, err)
+	require.Empty(t, primary.invoices)
+	require.Len(t, backup.invoices, 1)
+	require.Equal(t, 1, activeNode())
+
+	_, _, err = c.NewChallenge(context.Background(), 1337)
+	require.NoError(t, err)
+	require.Len(t, backup.invoices, 2)
+
+	// Once the primary responds again, we fail back to it.
+	primary.setUnavailable(false)
+	require.Eventually(t, func() bool {
+		return activeNode() == 0
+	}, 5*defaultTimeout, time.Millisecond)
+
+	_, _, err = c.NewChallenge(context.Background(), 1337)
+	require.NoError(t, err)
+	require.Len(t, primary.invoices, 1)
+
+	// If no node can create invoices, the error is returned.
+	primary.setUnavailable(true)
+	backup.setUnavailable(true)
+	_, _, err = c.NewChallenge(context.Background(), 1337)
+	require.Error(t, err)
+
+	select {
+	case err := <-mainErrChan:
+		t.Fatalf("unexpected error on main chan: %v", err)
+	default:
+	}
+
+	primary.stop()
+	backup.stop()
+	c.Stop()
+}
+
+// TestNextReconnectInterval makes sure the reconnect interval is doubled up to
+// the maximum.
+func TestNextReconnectInterval(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, 20*time.Second, nextReconnectInterval(10*time.Second))
+	require.Equal(
+		t, maxReconnectInterval,
+		nextReconnectInterval(maxReconnectInterval-time.Second),
+	)
+}
+
+func TestLndChallengerPreimageLock(t *testing.T) {
+	t.Parallel()
+
+	store := &mockPreimageStore{
+		preimages: make(map[lntypes.Hash]lntypes.Preimage),
+	}
+	c, invoiceMock, _ := newChallenger()
+	PreimageLock(store)(c)
+
+	// Creating a new challenge should generate a pre-image and commit to
+	// it before the invoice is added.
+	_, _, err := c.NewChallenge(context.Background(), 1337)
+	require.NoError(t, err)
+	require.Len(t, invoiceMock.invoices, 1)
+	require.Len(t, store.preimages, 1)
+
+	preimage, err := lntypes.MakePreimage(invoiceMock.invoices[0].RPreimage)
+	require.NoError(t, err)
+	hash := preimage.Hash()
+	require.Equal(t, preimage, store.preimages[hash])
+
+	require.NoError(t, c.Start())
+	defer func() {
+		invoiceMock.stop()
+		c.Stop()
+	}()
+
+	// An invoice settled with a different pre-image must not be accepted.
+	invoice := newInvoice(hash, 100, lnrpc.Invoice_SETTLED)
+	invoice.RPreimage = make([]byte, lntypes.PreimageSize)
+	invoiceMock.updateChan <- invoice
+	require.Error(t, c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, defaultTimeout,
+	))
+
+	// Settled with the committed pre-image, it is accepted.
+	invoice = newInvoice(hash, 100, lnrpc.Invoice_SETTLED)
+	invoice.RPreimage = preimage[:]
+	invoiceMock.updateChan <- invoice
+	require.NoError(t, c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, defaultTimeout,
+	))
+
+	// Invoices we have no commitment for are accepted as before.
+	otherHash := lntypes.Hash{1, 2, 3}
+	invoiceMock.updateChan <- newInvoice(
+		otherHash, 101, lnrpc.Invoice_SETTLED,
+	)
+	require.NoError(t, c.VerifyInvoiceStatus(
+		otherHash, lnrpc.Invoice_SETTLED, defaultTimeout,
+	))
+}
+
+// TestLndChallengerPreimageLookupError makes sure invoices are regarded as
+// settled if their pre-image commitments can't be looked up.
+func TestLndChallengerPreimageLookupError(t *testing.T) {
+	t.Parallel()
+
+	store := &mockPreimageStore{
+		preimages: make(map[lntypes.Hash]lntypes.Preimage),
+		lookupErr: errors.New("etcd unavailable"),
+	}
+	c, invoiceMock, _ := newChallenger()
+	PreimageLock(store)(c)
+
+	_, hash, err := c.NewChallenge(context.Background(), 1337)
+	require.NoError(t, err)
+	preimage := store.preimages[hash]
+
+	require.NoError(t, c.Start())
+	defer func() {
+		invoiceMock.stop()
+		c.Stop()
+	}()
+
+	// Clients wait for the invoice while it's open. Once it settles, they
+	// must not be told it failed just because the commitment lookup did.
+	invoiceMock.updateChan <- newInvoice(hash, 100, lnrpc.Invoice_OPEN)
+	require.NoError(t, c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_OPEN, defaultTimeout,
+	))
+	stateChan, cancel, err := c.SubscribeInvoiceState(hash)
+	require.NoError(t, err)
+	defer cancel()
+
+	invoice := newInvoice(hash, 100, lnrpc.Invoice_SETTLED)
+	invoice.RPreimage = preimage[:]
+	invoiceMock.updateChan <- invoice
+
+	select {
+	case state := <-stateChan:
+		require.Equal(t, lnrpc.Invoice_SETTLED, state)
+
+	case <-time.After(defaultTimeout):
+		t.Fatal("no invoice state received")
+	}
+	require.NoError(t, c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, defaultTimeout,
+	))
+}
+
+var testAssetInvoiceHash = lntypes.Hash{4, 5, 6}
+
+type mockAssetInvoiceClient struct {
+	assetIDs     [][]byte
+	assetAmounts []uint64
+	invoices     []*lnrpc.Invoice
+}
+
+func (m *mockAssetInvoiceClient) AddAssetInvoice(_ context.Context,
+	assetID []byte, assetAmount uint64,
+	invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+
+	m.assetIDs = append(m.assetIDs, assetID)
+	m.assetAmounts = append(m.assetAmounts, assetAmount)
+	m.invoices = append(m.invoices, invoice)
+
+	return &lnrpc.AddInvoiceResponse{
+		RHash:          testAssetInvoiceHash[:],
+		PaymentRequest: "asset",
+	}, nil
+}
+
+// TestLndChallengerAssetInvoices makes sure invoice requests for an asset are
+// created through the asset client and tracked like any other invoice.
+func TestLndChallengerAssetInvoices(t *testing.T) {
+	t.Parallel()
+
+	c, invoiceMock, _ := newChallenger()
+	assetID := []byte{1, 2, 3}
+	c.genInvoiceReq = func(context.Context, int64) (*InvoiceRequest,
+		error) {
+
+		return &InvoiceRequest{
+			Invoice:     &lnrpc.Invoice{Memo: "LSAT"},
+			AssetID:     assetID,
+			AssetAmount: 100,
+		}, nil
+	}
+
+	// Without an asset client, asset invoices can't be created.
+	_, _, err := c.NewChallenge(context.Background(), 1337)
+	require.Error(t, err)
+
+	assetClient := &mockAssetInvoiceClient{}
+	AssetInvoices(assetClient)(c)
+	paymentRequest, hash, err := c.NewChallenge(
+		context.Background(), 1337,
+	)
+	require.NoError(t, err)
+	require.Equal(t, "asset", paymentRequest)
+	require.Equal(t, testAssetInvoiceHash, hash)
+	require.Equal(t, [][]byte{assetID}, assetClient.assetIDs)
+	require.Equal(t, []uint64{100}, assetClient.assetAmounts)
+	require.Empty(t, invoiceMock.invoices)
+
+	require.NoError(t, c.Start())
+	defer func() {
+		invoiceMock.stop()
+		c.Stop()
+	}()
+
+	// The invoice is settled in lnd once tapd received the asset.
+	invoiceMock.updateChan <- newInvoice(hash, 100, lnrpc.Invoice_SETTLED)
+	require.NoError(t, c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, defaultTimeout,
+	))
+}
+
+// TestLndChallengerSubscribeInvoiceState makes sure all subscribers of an
+// invoice are notified once it reaches a final state.
+func TestLndChallengerSubscribeInvoiceState(t *testing.T) {
+	t.Parallel()
+
+	c, invoiceMock, _ := newChallenger()
+	require.NoError(t, c.Start())
+
+	receive := func(stateChan <-chan lnrpc.Invoice_InvoiceState) (
+		lnrpc.Invoice_InvoiceState, bool) {
+
+		select {
+		case state, ok := <-stateChan:
+			return state, ok
+
+		case <-time.After(defaultTimeout):
+			t.Fatalf("invoice state not received")
+			return 0, false
+		}
+	}
+
+	subscribe := func(hash lntypes.Hash) (
+		<-chan lnrpc.Invoice_InvoiceState, func()) {
+
+		stateChan, cancel, err := c.SubscribeInvoiceState(hash)
+		require.NoError(t, err)
+
+		return stateChan, cancel
+	}
+
+	// Invoices we don't know can't be subscribed to.
+	hash := lntypes.Hash{1, 2, 3}
+	_, _, err := c.SubscribeInvoiceState(hash)
+	require.ErrorIs(t, err, ErrUnknownInvoice)
+
+	// Once the invoices were created, they can.
+	otherHash := lntypes.Hash{4, 5, 6}
+	pendingHash := lntypes.Hash{7}
+	invoiceMock.updateChan <- newInvoice(hash, 1, lnrpc.Invoice_OPEN)
+	invoiceMock.updateChan <- newInvoice(otherHash, 2, lnrpc.Invoice_OPEN)
+	invoiceMock.updateChan <- newInvoice(pendingHash, 3, lnrpc.Invoice_OPEN)
+	require.Eventually(t, func() bool {
+		_, _, err := c.SubscribeInvoiceState(pendingHash)
+		return err == nil
+	}, defaultTimeout, time.Millisecond)
+
+	// Multiple subscribers of the same invoice should all be notified
+	// once it settles, a canceled subscriber and subscribers of other
+	// invoices shouldn't.
+	first, cancelFirst := subscribe(hash)
+	defer cancelFirst()
+	second, cancelSecond := subscribe(hash)
+	defer cancelSecond()
+	canceled, cancel := subscribe(hash)
+	cancel()
+	other, cancelOther := subscribe(otherHash)
+
+	// Only a limited number of subscribers can wait for the same invoice.
+	for i := 2; i < maxSubscribersPerInvoice; i++ {
+		_, cancel := subscribe(hash)
+		defer cancel()
+	}
+	_, _, err = c.SubscribeInvoiceState(hash)
+	require.ErrorIs(t, err, ErrTooManySubscribers)
+
+	invoiceMock.updateChan <- newInvoice(hash, 1, lnrpc.Invoice_SETTLED)
+
+	for _, stateChan := range []<-chan lnrpc.Invoice_InvoiceState{
+		first, second,
+	} {
+		state, ok := receive(stateChan)
+		require.True(t, ok)
+		require.Equal(t, lnrpc.Invoice_SETTLED, state)
+	}
+	require.Empty(t, canceled)
+	require.Empty(t, other)
+
+	// Subscribing to an invoice that is already settled should return
+	// the state right away.
+	settled, cancelSettled := subscribe(hash)
+	defer cancelSettled()
+	state, ok := receive(settled)
+	require.True(t, ok)
+	require.Equal(t, lnrpc.Invoice_SETTLED, state)
+
+	// A canceled invoice should be reported as such, and can't be
+	// subscribed to anymore.
+	invoiceMock.updateChan <- newInvoice(
+		otherHash, 2, lnrpc.Invoice_CANCELED,
+	)
+	state, ok = receive(other)
+	require.True(t, ok)
+	require.Equal(t, lnrpc.Invoice_CANCELED, state)
+	cancelOther()
+	_, _, err = c.SubscribeInvoiceState(otherHash)
+	require.ErrorIs(t, err, ErrUnknownInvoice)
+
+	// Subscribers that are still waiting when the challenger shuts down
+	// should have their channel closed, even before it is stopped.
+	pending, cancelPending := subscribe(pendingHash)
+	defer cancelPending()
+	c.closeSubscribers()
+	_, ok = receive(pending)
+	require.False(t, ok)
+
+	// Later subscribers are told right away.
+	pending, cancelPending = subscribe(pendingHash)
+	defer cancelPending()
+	_, ok = receive(pending)
+	require.False(t, ok)
+
+	invoiceMock.stop()
+	c.Stop()
+}
+
+type mockSettlementStore struct {
+	sync.Mutex
+	settled map[lntypes.Hash]time.Time
+}
+
+func (m *mockSettlementStore) MarkSettled(_ context.Context,
+	hash lntypes.Hash, settleDate time.Time) (bool, error) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.settled[hash]; ok {
+		return false, nil
+	}
+	m.settled[hash] = settleDate
+	return true, nil
+}
+
+func (m *mockSettlementStore) isSettled(hash lntypes.Hash) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	_, ok := m.settled[hash]
+	return ok
+}
+
+// TestLndChallengerReconcileSettlements makes sure settled invoices are
+// recorded as they are settled and that the reconciliation records the recent
+// ones that were missed.
+func TestLndChallengerReconcileSettlements(t *testing.T) {
+	t.Parallel()
+
+	store := &mockSettlementStore{
+		settled: make(map[lntypes.Hash]time.Time),
+	}
+	c, invoiceMock, _ := newChallenger()
+	RecordSettlements(store)(c)
+
+	// One invoice was settled recently while we weren't running, the
+	// other one too long ago to be reconciled. Open invoices are ignored.
+	now := time.Now()
+	missed := newInvoice(lntypes.Hash{1}, 1, lnrpc.Invoice_SETTLED)
+	missed.SettleDate = now.Add(-time.Hour).Unix()
+	old := newInvoice(lntypes.Hash{2}, 2, lnrpc.Invoice_SETTLED)
+	old.SettleDate = now.Add(-48 * time.Hour).Unix()
+	pending := newInvoice(lntypes.Hash{3}, 3, lnrpc.Invoice_OPEN)
+	invoiceMock.invoices = []*lnrpc.Invoice{missed, old, pending}
+
+	require.NoError(t, c.Start())
+	defer func() {
+		invoiceMock.stop()
+		c.Stop()
+	}()
+
+	missing, err := c.ReconcileSettlements(
+		context.Background(), now.Add(-reconciliationWindow),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []lntypes.Hash{{1}}, missing)
+	require.False(t, store.isSettled(lntypes.Hash{2}))
+
+	// A second reconciliation doesn't find anything new.
+	missing, err = c.ReconcileSettlements(
+		context.Background(), now.Add(-reconciliationWindow),
+	)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// Invoices settling while we're running are recorded right away.
+	hash := lntypes.Hash{4}
+	invoiceMock.updateChan <- newInvoice(hash, 4, lnrpc.Invoice_SETTLED)
+	require.NoError(t, c.VerifyInvoiceStatus(
+		hash, lnrpc.Invoice_SETTLED, defaultTimeout,
+	))
+	require.Eventually(t, func() bool {
+		return store.isSettled(hash)
+	}, defaultTimeout, 10*time.Millisecond)
+}
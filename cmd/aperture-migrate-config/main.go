@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/lightninglabs/aperture"
+)
+
+// config is the configuration of the config migration tool.
+type config struct {
+	FromVersion int `long:"from-version" description:"The schema version of the input config. Read from the input if not set, where configs without a version are version 1."`
+
+	Input string `long:"input" description:"The config file to migrate." required:"true"`
+
+	Output string `long:"output" description:"The file to write the migrated config to." required:"true"`
+}
+
+func main() {
+	if err := run(); err != nil {
+		var flagErr *flags.Error
+		if errors.As(err, &flagErr) && flagErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run migrates a config file of an older schema version to the current one.
+func run() error {
+	cfg := &config{}
+	if _, err := flags.Parse(cfg); err != nil {
+		return err
+	}
+
+	encoded, err := ioutil.ReadFile(cfg.Input)
+	if err != nil {
+		return fmt.Errorf("unable to read config: %v", err)
+	}
+
+	migrated, warnings, err := aperture.MigrateConfig(
+		encoded, cfg.FromVersion,
+	)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		_, _ = fmt.Fprintf(os.Stderr, "WARNING: %s\n", warning)
+	}
+
+	// The config can contain passwords, so it must not be readable by
+	// anyone else.
+	if err := ioutil.WriteFile(cfg.Output, migrated, 0600); err != nil {
+		return fmt.Errorf("unable to write config: %v", err)
+	}
+
+	fmt.Printf("Migrated config to version %d and wrote it to %s\n",
+		aperture.CurrentConfigVersion, cfg.Output)
+
+	return nil
+}
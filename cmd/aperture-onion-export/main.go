@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/lightninglabs/aperture"
+	"golang.org/x/term"
+)
+
+// config is the configuration of the onion key export tool.
+type config struct {
+	Etcd *aperture.EtcdConfig `group:"etcd" namespace:"etcd"`
+
+	OnionType string `long:"type" description:"The version of the onion service whose private key should be exported." choice:"v2" choice:"v3"`
+
+	Output string `long:"output" description:"The file to write the backup to." required:"true"`
+
+	Unencrypted bool `long:"unencrypted" description:"Export the private key without encrypting it. Anyone with access to the backup can impersonate the onion service!"`
+}
+
+func main() {
+	if err := run(); err != nil {
+		var flagErr *flags.Error
+		if errors.As(err, &flagErr) && flagErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run exports the onion service private key stored in etcd to a backup file.
+func run() error {
+	cfg := &config{
+		Etcd:      &aperture.EtcdConfig{Host: "localhost:2379"},
+		OnionType: "v3",
+	}
+	if _, err := flags.Parse(cfg); err != nil {
+		return err
+	}
+
+	onionType, err := aperture.ParseOnionType(cfg.OnionType)
+	if err != nil {
+		return err
+	}
+
+	var password []byte
+	if cfg.Unencrypted {
+		_, _ = fmt.Fprintln(os.Stderr, "WARNING: EXPORTING THE ONION "+
+			"SERVICE PRIVATE KEY WITHOUT ENCRYPTION!\nWARNING: "+
+			"ANYONE WITH ACCESS TO THE BACKUP FILE CAN "+
+			"IMPERSONATE THE ONION SERVICE. STORE IT SECURELY!")
+	} else {
+		password, err = readNewPassword()
+		if err != nil {
+			return err
+		}
+	}
+
+	store, cleanup, err := aperture.NewEtcdOnionStore(cfg.Etcd)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	backup, err := aperture.ExportOnionKey(store, onionType, password)
+	if err != nil {
+		return err
+	}
+
+	// The backup must not be readable by anyone else, even if it is
+	// encrypted.
+	if err := ioutil.WriteFile(cfg.Output, backup, 0600); err != nil {
+		return fmt.Errorf("unable to write backup: %v", err)
+	}
+
+	fmt.Printf("Exported %s onion private key to %s\n", cfg.OnionType,
+		cfg.Output)
+
+	return nil
+}
+
+// readNewPassword asks for the password to encrypt the backup with twice to
+// make sure it wasn't mistyped.
+func readNewPassword() ([]byte, error) {
+	password, err := readPassword("Backup password: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(password) == 0 {
+		return nil, errors.New("password cannot be empty, use " +
+			"--unencrypted to export the key without encryption")
+	}
+
+	confirmation, err := readPassword("Confirm backup password: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(password, confirmation) {
+		return nil, errors.New("passwords don't match")
+	}
+
+	return password, nil
+}
+
+// readPassword reads a password from the terminal without echoing it.
+func readPassword(prompt string) ([]byte, error) {
+	_, _ = fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	_, _ = fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read password: %v", err)
+	}
+
+	return password, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/lightninglabs/aperture"
+	"golang.org/x/term"
+)
+
+// config is the configuration of the onion key import tool.
+type config struct {
+	Etcd *aperture.EtcdConfig `group:"etcd" namespace:"etcd"`
+
+	Input string `long:"input" description:"The backup file to import the private key from." required:"true"`
+
+	Overwrite bool `long:"overwrite" description:"Replace an existing onion service private key of the same version. The onion address of the replaced key is lost unless it was backed up!"`
+}
+
+func main() {
+	if err := run(); err != nil {
+		var flagErr *flags.Error
+		if errors.As(err, &flagErr) && flagErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run imports an onion service private key from a backup file into etcd.
+func run() error {
+	cfg := &config{
+		Etcd: &aperture.EtcdConfig{Host: "localhost:2379"},
+	}
+	if _, err := flags.Parse(cfg); err != nil {
+		return err
+	}
+
+	backup, err := ioutil.ReadFile(cfg.Input)
+	if err != nil {
+		return fmt.Errorf("unable to read backup: %v", err)
+	}
+
+	encrypted, err := aperture.OnionBackupEncrypted(backup)
+	if err != nil {
+		return err
+	}
+
+	var password []byte
+	if encrypted {
+		_, _ = fmt.Fprint(os.Stderr, "Backup password: ")
+		password, err = term.ReadPassword(int(os.Stdin.Fd()))
+		_, _ = fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return fmt.Errorf("unable to read password: %v", err)
+		}
+	} else {
+		_, _ = fmt.Fprintln(os.Stderr, "WARNING: THE BACKUP IS NOT "+
+			"ENCRYPTED! ANYONE WHO HAD ACCESS TO IT CAN "+
+			"IMPERSONATE THE ONION SERVICE.")
+	}
+
+	store, cleanup, err := aperture.NewEtcdOnionStore(cfg.Etcd)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	_, err = aperture.ImportOnionKey(store, backup, password, cfg.Overwrite)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported onion private key from %s\n", cfg.Input)
+
+	return nil
+}
@@ -1,14 +1,25 @@
 package aperture
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/btcsuite/btcd/btcutil"
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightninglabs/aperture/proxy"
 )
 
+const (
+	// unixSocketPrefix is the prefix of a listen address that refers to a
+	// Unix domain socket.
+	unixSocketPrefix = "unix://"
+)
+
 var (
 	apertureDataDir        = btcutil.AppDataDir("aperture", false)
 	defaultConfigFilename  = "aperture.yaml"
@@ -16,6 +27,7 @@ var (
 	defaultTLSCertFilename = "tls.cert"
 	defaultLogLevel        = "info"
 	defaultLogFilename     = "aperture.log"
+	defaultSamplesFilename = "sampled_requests.log"
 	defaultMaxLogFiles     = 3
 	defaultMaxLogFileSize  = 10
 )
@@ -24,6 +36,14 @@ type EtcdConfig struct {
 	Host     string `long:"host" description:"host:port of an active etcd instance"`
 	User     string `long:"user" description:"user authorized to access the etcd host"`
 	Password string `long:"password" description:"password of the etcd user"`
+
+	// MemberRefreshInterval is the interval at which the members of the
+	// etcd cluster are listed to update the endpoints of the client.
+	MemberRefreshInterval time.Duration `long:"memberrefreshinterval" description:"The interval at which the etcd cluster members are listed to update the client's endpoints after membership changes. Defaults to 5 minutes."`
+
+	// WatchServices denotes whether the services are managed by an
+	// external controller that writes their definitions to etcd.
+	WatchServices bool `long:"watchservices" description:"Load the services from the definitions an external controller writes to etcd under lsat/proxy/services/ and apply their changes while running. Can't be used together with servicesurl."`
 }
 
 type AuthConfig struct {
@@ -37,48 +57,302 @@ type AuthConfig struct {
 	Network string `long:"network" description:"The network LND is connected to." choice:"regtest" choice:"simnet" choice:"testnet" choice:"mainnet"`
 
 	Disable bool `long:"disable" description:"Whether to disable LND auth."`
+
+	// MinOutboundCapacitySat is the minimum total remote balance of all
+	// active channels of the LND node. That is the amount the node's peers
+	// can still send to it and therefore the amount that can still be paid
+	// for new invoices. Monitoring is disabled if this is zero.
+	MinOutboundCapacitySat int64 `long:"minoutboundcapacitysat" description:"Warn if the total remote balance of LND's active channels, which is the amount LND's peers can still send to pay invoices, drops below this many satoshis. Requires the readonly.macaroon to be present in macdir. Set to 0 to disable."`
+
+	// CapacityCheckInterval is the interval at which the channel capacity
+	// and the watchtower sessions of the LND node are checked.
+	CapacityCheckInterval time.Duration `long:"capacitycheckinterval" description:"The interval at which LND's channel capacity and watchtower sessions are checked."`
+
+	// MinWatchtowerSessions is the minimum number of active watchtower
+	// sessions the LND node needs to back up its channel states with.
+	// Monitoring is disabled if this is zero.
+	MinWatchtowerSessions int `long:"minwatchtowersessions" description:"Warn if LND has fewer active watchtower sessions than this or if its backups aren't acknowledged, and only report aperture as ready once LND has that many. Requires the readonly.macaroon to be present in macdir and LND to be built with the wtclientrpc tag. Set to 0 to disable."`
+
+	// ReconciliationAlert denotes whether an alert is triggered if the
+	// reconciliation on startup finds settled invoices that weren't
+	// recorded in etcd.
+	ReconciliationAlert bool `long:"reconciliationalert" description:"Trigger an alert if the reconciliation on startup finds invoices settled in LND within the last 24 hours that weren't recorded in etcd. Discrepancies are always logged."`
+
+	// PreimageLock denotes whether aperture generates the pre-images of
+	// its invoices itself and commits to them in etcd before the invoices
+	// are created.
+	PreimageLock bool `long:"preimagelock" description:"Generate the pre-image of every invoice in aperture and commit to it in etcd before the invoice is created. An invoice is only accepted as paid if it was settled with the committed pre-image."`
+
+	// PaymentVerification is the way the payment of an LSAT is verified,
+	// either by looking up its invoice or by its pre-image alone.
+	PaymentVerification string `long:"paymentverification" description:"How the payment of an LSAT is verified: invoice to look up the settlement of its invoice in lnd, or preimage to only check the pre-image the client sends in the Authorization header against the payment hash of the LSAT, for invoices that weren't created by this node. Defaults to invoice."`
+
+	// AssetID is the hex encoded ID of the Taproot Asset the invoices of
+	// LSATs are paid with. LSATs are paid for in satoshis if it is empty.
+	AssetID string `long:"assetid" description:"The hex encoded ID of a Taproot Asset the invoices of LSATs are paid with instead of satoshis. The invoices are created through tapd, which must be connected to lnd. Leave empty to issue invoices in satoshis."`
+
+	// AssetAmount is the number of units of the asset the invoice of
+	// every LSAT asks for.
+	AssetAmount uint64 `long:"assetamount" description:"The number of units of the Taproot Asset the invoice of every LSAT asks for, regardless of the price of its services. Requires assetid to be set."`
+
+	// TapdHost is the host:port of tapd's REST API.
+	TapdHost string `long:"tapdhost" description:"host:port of the REST API of the tapd instance that creates the asset invoices"`
+
+	// TapdTLSPath is the path to tapd's TLS certificate.
+	TapdTLSPath string `long:"tapdtlspath" description:"Path to tapd's TLS certificate"`
+
+	// TapdMacaroonPath is the path to the macaroon used to create invoices
+	// through tapd.
+	TapdMacaroonPath string `long:"tapdmacaroonpath" description:"Path to the tapd macaroon used to create asset invoices"`
+
+	// FallbackToPoW denotes whether clients are challenged to solve a
+	// proof of work instead of paying an invoice while no LND node is
+	// available.
+	FallbackToPoW bool `long:"fallbacktopow" description:"Issue hashcash-style proof-of-work challenges instead of invoices while no LND node is available. Each solved challenge grants access for a single request."`
+
+	// PoWDifficulty is the number of leading zero bits the hash of a
+	// proof-of-work solution must have.
+	PoWDifficulty int `long:"powdifficulty" description:"The number of leading zero bits the hash of a proof-of-work solution must have, between 1 and 40. Defaults to 20."`
+
+	// CookieName is the name of the cookie browser clients can send their
+	// LSAT in if they can't set the Authorization header.
+	CookieName string `long:"cookiename" description:"The name of a cookie that is checked for an LSAT, in the format <macBase64>:<preimageHex>, if none is sent in the request headers. The cookie is never forwarded to the backends."`
+
+	// TokenCacheSize is the maximum number of verified LSATs that are
+	// cached. Caching is disabled if it is zero.
+	TokenCacheSize int `long:"tokencachesize" description:"The maximum number of verified LSATs that are accepted again without verifying them against the secret store and LND. Set to 0 to disable the cache."`
+
+	// TokenCacheTTL is the time a verified LSAT is cached for.
+	TokenCacheTTL time.Duration `long:"tokencachettl" description:"The time a verified LSAT is cached for. LSATs are dropped from the cache when they are revoked. Defaults to 1m."`
+
+	// Mock denotes whether deterministic mock invoices are issued instead
+	// of connecting to lnd.
+	Mock bool `long:"mock" description:"Don't connect to lnd and issue deterministic mock invoices that are always reported as settled instead. Each payment request is lnmock1 followed by the hex encoded pre-image. Only meant for integration tests and CI pipelines without an lnd node."`
+
+	// MockFailSettlements denotes whether the mock invoices are never
+	// reported as settled, to test how clients handle unpaid LSATs.
+	MockFailSettlements bool `long:"mockfailsettlements" description:"Never report the mock invoices as settled, to test how clients handle unpaid LSATs. Requires mock to be set."`
+}
+
+// lndEnabled returns true if LSATs are issued and verified with invoices of an
+// actual lnd node.
+func (a *AuthConfig) lndEnabled() bool {
+	return !a.Disable && !a.Mock
 }
 
 func (a *AuthConfig) validate() error {
+	if strings.ContainsAny(a.CookieName, " \t;,=\"") {
+		return fmt.Errorf("invalid cookie name %q", a.CookieName)
+	}
+
+	switch a.PaymentVerification {
+	case "", PaymentVerificationInvoice, PaymentVerificationPreimage:
+	default:
+		return fmt.Errorf("unknown payment verification %q, must be "+
+			"%s or %s", a.PaymentVerification,
+			PaymentVerificationInvoice, PaymentVerificationPreimage)
+	}
+
+	if a.MockFailSettlements && !a.Mock {
+		return errors.New("mock settlement failures require mock " +
+			"invoices to be enabled")
+	}
+
+	if _, err := a.asset(); err != nil {
+		return err
+	}
+
 	// If we're disabled, we don't mind what these values are.
 	if a.Disable {
 		return nil
 	}
 
-	if a.LndHost == "" {
-		return errors.New("lnd host required")
+	// Mock invoices are issued without ever connecting to lnd.
+	if !a.Mock {
+		if a.LndHost == "" {
+			return errors.New("lnd host required")
+		}
+
+		if a.TLSPath == "" {
+			return errors.New("lnd tls required")
+		}
+
+		if a.MacDir == "" {
+			return errors.New("lnd mac dir required")
+		}
+	} else if a.AssetID != "" {
+		return errors.New("asset invoices can't be mocked")
+	}
+
+	if a.AssetID != "" {
+		if a.TapdHost == "" || a.TapdTLSPath == "" ||
+			a.TapdMacaroonPath == "" {
+
+			return errors.New("tapd host, tls and macaroon " +
+				"required for asset invoices")
+		}
+	}
+
+	if a.MinOutboundCapacitySat < 0 {
+		return errors.New("min outbound capacity cannot be negative")
 	}
 
-	if a.TLSPath == "" {
-		return errors.New("lnd tls required")
+	if a.MinWatchtowerSessions < 0 {
+		return errors.New("min watchtower sessions cannot be negative")
 	}
 
-	if a.MacDir == "" {
-		return errors.New("lnd mac dir required")
+	if a.TokenCacheSize < 0 || a.TokenCacheTTL < 0 {
+		return errors.New("token cache size and TTL cannot be " +
+			"negative")
+	}
+
+	if a.PoWDifficulty < 0 || a.PoWDifficulty > auth.MaxPoWDifficulty {
+		return fmt.Errorf("proof-of-work difficulty must be between 1 "+
+			"and %d", auth.MaxPoWDifficulty)
 	}
 
 	return nil
 }
 
+// asset returns the Taproot Asset the invoices of LSATs are paid with, or nil
+// if they are paid in satoshis.
+func (a *AuthConfig) asset() (*mint.Asset, error) {
+	if a.AssetID == "" {
+		if a.AssetAmount != 0 {
+			return nil, errors.New("asset amount requires asset " +
+				"id to be set")
+		}
+
+		return nil, nil
+	}
+
+	id, err := hex.DecodeString(a.AssetID)
+	if err != nil || len(id) != mint.AssetIDSize {
+		return nil, fmt.Errorf("invalid asset id %q, must be %d hex "+
+			"encoded bytes", a.AssetID, mint.AssetIDSize)
+	}
+	if a.AssetAmount == 0 {
+		return nil, errors.New("asset amount must be positive")
+	}
+
+	asset := &mint.Asset{Amount: a.AssetAmount}
+	copy(asset.ID[:], id)
+
+	return asset, nil
+}
+
+// powDifficulty returns the configured proof-of-work difficulty or the default
+// if none is configured.
+func (a *AuthConfig) powDifficulty() uint8 {
+	if a.PoWDifficulty == 0 {
+		return auth.DefaultPoWDifficulty
+	}
+
+	return uint8(a.PoWDifficulty)
+}
+
 type HashMailConfig struct {
 	Enabled               bool          `long:"enabled"`
 	MessageRate           time.Duration `long:"messagerate" description:"The average minimum time that should pass between each message."`
 	MessageBurstAllowance int           `long:"messageburstallowance" description:"The burst rate we allow for messages."`
 	StaleTimeout          time.Duration `long:"staletimeout" description:"The time after the last activity that a mailbox should be removed. Set to -1s to disable. "`
+	MaxGRPCMessageBytes   int           `long:"maxgrpcmessagebytes" description:"The maximum size in bytes of a gRPC message the mailbox server receives from clients. Defaults to 4MB."`
+	MaxSendMessageBytes   int           `long:"maxsendmessagebytes" description:"The maximum size in bytes of a gRPC message the mailbox server sends to clients. Defaults to 4MB."`
+}
+
+// maxRecvMsgSize returns the maximum size of the gRPC messages the mailbox
+// server receives.
+func (h *HashMailConfig) maxRecvMsgSize() int {
+	if h == nil || h.MaxGRPCMessageBytes == 0 {
+		return DefaultMaxMsgSize
+	}
+
+	return h.MaxGRPCMessageBytes
+}
+
+// maxSendMsgSize returns the maximum size of the gRPC messages the mailbox
+// server sends.
+func (h *HashMailConfig) maxSendMsgSize() int {
+	if h == nil || h.MaxSendMessageBytes == 0 {
+		return DefaultMaxMsgSize
+	}
+
+	return h.MaxSendMessageBytes
+}
+
+// validate makes sure the mailbox server settings are valid.
+func (h *HashMailConfig) validate() error {
+	if h == nil {
+		return nil
+	}
+
+	if h.MaxGRPCMessageBytes < 0 || h.MaxSendMessageBytes < 0 {
+		return errors.New("hashmail message size limits cannot be " +
+			"negative")
+	}
+
+	return nil
 }
 
 type TorConfig struct {
 	Control     string `long:"control" description:"The host:port of the Tor instance."`
+	ListenHost  string `long:"listenhost" description:"The local IP address we should listen on for client requests over Tor, for example ::1 to use IPv6. Defaults to localhost."`
 	ListenPort  uint16 `long:"listenport" description:"The port we should listen on for client requests over Tor. Note that this port should not be exposed to the outside world, it is only intended to be reached by clients through the onion service."`
 	VirtualPort uint16 `long:"virtualport" description:"The port through which the onion services created can be reached at."`
 	V2          bool   `long:"v2" description:"Whether we should listen for client requests through a v2 onion service."`
 	V3          bool   `long:"v3" description:"Whether we should listen for client requests through a v3 onion service."`
 }
 
+// StaticConfig is the configuration of the static content that is served for
+// requests that don't match any service, either from a local directory or
+// from a bucket of an S3-compatible object store.
+type StaticConfig struct {
+	// Enabled defines if static content should be served from the
+	// directory defined by Root or the bucket defined by S3Bucket.
+	Enabled bool `long:"enabled" description:"Flag to enable or disable static content serving."`
+
+	// Root is the folder where the static content served by the proxy is
+	// located.
+	Root string `long:"root" description:"The folder where the static content is located."`
+
+	// S3Bucket is the bucket of an S3-compatible object store the static
+	// content is served from instead of Root.
+	S3Bucket string `long:"s3bucket" description:"The bucket of an S3-compatible object store to serve the static content from instead of root. The credentials are loaded like the AWS CLI does, for example from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables."`
+
+	// S3Region is the region of the bucket.
+	S3Region string `long:"s3region" description:"The region of the static content bucket. Defaults to the region of the AWS config, like the AWS_REGION environment variable."`
+
+	// S3Endpoint is the URL of the object store if it isn't AWS S3.
+	S3Endpoint string `long:"s3endpoint" description:"The URL of the S3-compatible object store, like http://minio:9000, if it isn't AWS S3. The bucket is addressed in the path instead of the host name."`
+}
+
+type RequestSamplingConfig struct {
+	// Rate is the fraction of requests, between 0 and 1, whose full
+	// details are logged.
+	Rate float64 `long:"rate" description:"The fraction of requests between 0 and 1 whose full request and response details are logged; set to 0 to disable"`
+
+	// LogFile is the file the details of sampled requests are appended to.
+	LogFile string `long:"logfile" description:"The file the details of sampled requests are logged to. Defaults to sampled_requests.log in the base directory."`
+}
+
 type Config struct {
+	// ConfigVersion is the version of the schema the config file was
+	// written for. Files without a version are treated as version 1.
+	ConfigVersion int `long:"configversion" description:"The version of the config file schema. Config files of older versions can be upgraded with aperture-migrate-config."`
+
 	// ListenAddr is the listening address that we should use to allow Aperture
-	// to listen for requests.
-	ListenAddr string `long:"listenaddr" description:"The interface we should listen on for client requests."`
+	// to listen for requests. It can either be a host:port or the path of
+	// a Unix domain socket in the form unix:///path/to/aperture.sock.
+	ListenAddr string `long:"listenaddr" description:"The interface we should listen on for client requests. Use unix:///path/to/aperture.sock to listen on a Unix domain socket, which disables TLS."`
+
+	// ProxyProtocol can be set if aperture is behind a load balancer that
+	// sends the address of the client in a PROXY protocol header on every
+	// connection.
+	ProxyProtocol bool `long:"proxyprotocol" description:"Require a PROXY protocol v1 or v2 header on every connection, as sent by load balancers like AWS ELB or HAProxy, and use the client address it carries instead of the load balancer's."`
+
+	// HTTP3 can be set to serve requests over HTTP/3 on the UDP port of the
+	// listen address as well.
+	HTTP3 bool `long:"http3" description:"Serve requests over HTTP/3 (QUIC) on the UDP port of the listen address as well, and advertise it to HTTP/1.1 and HTTP/2 clients through the Alt-Svc header. Requires TLS and can't be used on a Unix socket or with the PROXY protocol."`
 
 	// ServerName can be set to a fully qualifying domain name that should
 	// be used while creating a certificate through Let's Encrypt.
@@ -88,27 +362,102 @@ type Config struct {
 	// certificate through Let's Encrypt using ServerName.
 	AutoCert bool `long:"autocert" description:"Automatically create a Let's Encrypt cert using ServerName."`
 
+	// CertDir is the directory the certificates of the hostnames served by
+	// aperture are loaded from. It contains a directory named after each
+	// hostname with a cert.pem and key.pem file in it.
+	CertDir string `long:"certdir" description:"Directory with a sub-directory named after each hostname that contains its cert.pem and key.pem files. Clients are served the certificate of the hostname they request through SNI. New certificates are picked up without a restart."`
+
+	// CertReloadInterval is the interval at which the default TLS
+	// certificate is checked for changes and reloaded.
+	CertReloadInterval time.Duration `long:"certreloadinterval" description:"The interval at which the TLS certificate in the base directory is reloaded if its file changed, or renewed if it is a self-signed one about to expire. New connections are served the new certificate without a restart. Defaults to 1h."`
+
+	// PathPrefix is the path prefix a reverse proxy in front of aperture
+	// serves it under.
+	PathPrefix string `long:"pathprefix" description:"The path prefix, like /aperture, a reverse proxy in front of aperture serves it under. It is removed from request paths that still carry it and added to the URLs sent to clients, like redirect locations."`
+
 	// Insecure can be set to disable TLS on incoming connections.
 	Insecure bool `long:"insecure" description:"Listen on an insecure connection, disabling TLS for incoming connections."`
 
-	// StaticRoot is the folder where the static content served by the proxy
-	// is located.
-	StaticRoot string `long:"staticroot" description:"The folder where the static content is located."`
+	// DryRun can be set to only validate the configuration and the
+	// connections to etcd, lnd and the backend services and exit without
+	// serving any traffic.
+	DryRun bool `long:"dry-run" description:"Validate the configuration and make sure etcd, LND and all backend services can be reached, print a summary of what would be served and exit without serving any traffic."`
 
-	// ServeStatic defines if static content should be served from the
-	// directory defined by StaticRoot.
-	ServeStatic bool `long:"servestatic" description:"Flag to enable or disable static content serving."`
+	// ShutdownTimeout is the maximum time in-flight requests are given to
+	// complete when shutting down before their connections are closed.
+	ShutdownTimeout time.Duration `long:"shutdowntimeout" description:"The maximum time in-flight requests are given to complete on shutdown before their connections are closed forcefully. Defaults to 30 seconds."`
+
+	// PaymentStreamTimeout is the maximum time clients can wait for the
+	// invoice of a challenge to settle on the payment stream endpoints.
+	PaymentStreamTimeout time.Duration `long:"paymentstreamtimeout" description:"The maximum time a client can wait for an invoice to settle on the WebSocket and gRPC payment stream endpoints before the stream is closed. Defaults to 10 minutes."`
+
+	// MaxConcurrentRequests is the number of client requests that are
+	// handled concurrently. Requests arriving while that many are being
+	// handled wait in the request queue. The number of requests isn't
+	// limited if this is zero.
+	MaxConcurrentRequests int `long:"maxconcurrentrequests" description:"The maximum number of client requests handled concurrently, long-lived streams count for their whole lifetime; set to 0 to disable the limit"`
+
+	// MaxPendingRequests is the number of requests that can wait in the
+	// request queue for one of the MaxConcurrentRequests to complete.
+	// Requests arriving while the queue is full are rejected.
+	MaxPendingRequests int `long:"maxpendingrequests" description:"The maximum number of requests waiting for a worker once maxconcurrentrequests are being handled; requests arriving while the queue is full receive a 503 error"`
+
+	// MaxQueueWait is the maximum time a request waits in the request
+	// queue before it is rejected.
+	MaxQueueWait time.Duration `long:"maxqueuewait" description:"The maximum time a request waits in the queue before it receives a 503 error. Defaults to 10 seconds."`
+
+	// MaxResponseHeaderBytes is the maximum number of bytes of the
+	// response headers read from the backends. Requests to backends
+	// exceeding it are answered with 502 Bad Gateway.
+	MaxResponseHeaderBytes int64 `long:"maxresponseheaderbytes" description:"The maximum size of the response headers read from the backends in bytes, larger responses are answered with 502 Bad Gateway. Defaults to 10MB."`
+
+	// Static is the configuration of the static content that is served
+	// for requests that don't match any service.
+	Static *StaticConfig `group:"static" namespace:"static" description:"Configuration of the static content served for requests that don't match any service."`
 
 	Etcd *EtcdConfig `group:"etcd" namespace:"etcd"`
 
+	// Redis, if its host is set, is used instead of etcd to store the
+	// LSAT secrets and the onion service private keys. All other state is
+	// still kept in etcd.
+	Redis *RedisConfig `group:"redis" namespace:"redis"`
+
+	// SQLitePath, if set, is the path of a SQLite database that is used
+	// instead of etcd or Redis to store the LSAT secrets and the onion
+	// service private keys. All other state is still kept in etcd.
+	SQLitePath string `long:"sqlitepath" description:"The path of a SQLite database to store the LSAT secrets and onion service private keys in instead of etcd. All other state is still kept in etcd."`
+
 	Authenticator *AuthConfig `group:"authenticator" namespace:"authenticator"`
 
+	// BackupAuthenticators is a list of additional LND nodes that are
+	// failed over to, in the given order, if the primary node configured
+	// in Authenticator becomes unavailable.
+	BackupAuthenticators []*AuthConfig `long:"backupauthenticator" description:"Configurations for backup LND nodes that are used if the primary LND node becomes unavailable."`
+
 	Tor *TorConfig `group:"tor" namespace:"tor"`
 
 	// Services is a list of JSON objects in string format, which specify
 	// each backend service to Aperture.
 	Services []*proxy.Service `long:"service" description:"Configurations for each Aperture backend service."`
 
+	// ServicesURL is the URL the services are loaded from instead of the
+	// configuration file. It is fetched again every refresh interval to
+	// apply changes without a restart.
+	ServicesURL string `long:"servicesurl" description:"URL to load the services from instead of the configuration file, in the same YAML format as the services section. Fetched again every servicesrefreshinterval to apply changes."`
+
+	// ServicesRefreshInterval is the interval at which the services are
+	// fetched from ServicesURL again.
+	ServicesRefreshInterval time.Duration `long:"servicesrefreshinterval" description:"The interval at which the services are fetched from servicesurl again. Defaults to 1m."`
+
+	// ServicesUser and ServicesPassword are the credentials for basic
+	// authentication to ServicesURL.
+	ServicesUser     string `long:"servicesuser" description:"User name for basic authentication to servicesurl."`
+	ServicesPassword string `long:"servicespassword" description:"Password for basic authentication to servicesurl."`
+
+	// ServicesToken is the bearer token to authenticate to ServicesURL
+	// with.
+	ServicesToken string `long:"servicestoken" description:"Bearer token to authenticate to servicesurl with."`
+
 	// HashMail is the configuration section for configuring the Lightning
 	// Node Connect mailbox server.
 	HashMail *HashMailConfig `group:"hashmail" namespace:"hashmail" description:"Configuration for the Lightning Node Connect mailbox server."`
@@ -117,10 +466,68 @@ type Config struct {
 	// server to scrape metrics from.
 	Prometheus *PrometheusConfig `group:"prometheus" namespace:"prometheus" description:"Configuration setting up an endpoint that a Prometheus server can scrape."`
 
+	// Admin is the configuration of the admin API that allows managing a
+	// running aperture instance.
+	Admin *AdminConfig `group:"admin" namespace:"admin" description:"Configuration for the admin API."`
+
+	// WebhookURL is the URL critical operational events, like losing the
+	// connection to LND, are posted to as JSON.
+	WebhookURL string `long:"webhookurl" description:"URL to post critical operational events, like losing the connection to LND, to as JSON. Leave empty to disable."`
+
+	// Webhook is the configuration of the webhook the events in the life
+	// of an LSAT, like it being issued or settled, are posted to.
+	Webhook *WebhookConfig `group:"webhook" namespace:"webhook" description:"Configuration for posting events in the life of an LSAT to a webhook."`
+
+	// PagerDuty is the configuration for sending critical operational
+	// events to PagerDuty.
+	PagerDuty *PagerDutyConfig `group:"pagerduty" namespace:"pagerduty" description:"Configuration for sending critical operational events to PagerDuty."`
+
+	// RequestSampling is the configuration for logging the full details of
+	// a random fraction of the requests for debugging.
+	RequestSampling *RequestSamplingConfig `group:"requestsampling" namespace:"requestsampling" description:"Configuration for logging the full details of a random fraction of the requests."`
+
+	// Hooks is the configuration of the gRPC services operators can run
+	// custom logic on requests with.
+	Hooks *HooksConfig `group:"hooks" namespace:"hooks" description:"Configuration of the gRPC hook services that are called before forwarding requests and after receiving responses."`
+
+	// TLS is the configuration of the TLS connections aperture accepts and
+	// makes.
+	TLS *TLSConfig `group:"tls" namespace:"tls" description:"Configuration of the TLS versions used by the proxy listener, the admin API and the connections to the service backends."`
+
+	// ReplayProtection is the configuration of the protection against
+	// clients replaying requests with intercepted LSATs.
+	ReplayProtection *ReplayProtectionConfig `group:"replayprotection" namespace:"replayprotection" description:"Configuration for rejecting requests that replay an intercepted LSAT."`
+
+	// ForwardProxy is the configuration of aperture acting as an HTTP
+	// forward proxy in addition to proxying for the services.
+	ForwardProxy *proxy.ForwardProxyConfig `group:"forwardproxy" namespace:"forwardproxy" description:"Configuration for forwarding requests to the hosts named by the clients."`
+
+	// JWT is the configuration of the authentication of requests to the
+	// services with authmode jwt.
+	JWT *auth.JWTConfig `group:"jwt" namespace:"jwt" description:"Configuration for authenticating the requests to services with authmode jwt with JSON Web Tokens."`
+
 	// DebugLevel is a string defining the log level for the service either
 	// for all subsystems the same or individual level by subsystem.
 	DebugLevel string `long:"debuglevel" description:"Debug level for the Aperture application and its subsystems."`
 
+	// LogFormat is the format of the log lines, either text or json.
+	LogFormat string `long:"logformat" description:"Format of the log lines: text, or json to write every line as a JSON object with the time, level, subsystem and message, plus the service and request_id of request logs."`
+
+	// AccessLogLevel is the log level at which an access log entry is
+	// written for every request. The access log is disabled if it is
+	// empty.
+	AccessLogLevel string `long:"accessloglevel" description:"Write a JSON access log entry for every request to the main log at this level: trace, debug or info. Leave empty to disable."`
+
+	// AuditLogFile is the file the access log entry of every request is
+	// written to, separate from the main log. The audit log is disabled
+	// if it is empty.
+	AuditLogFile string `long:"auditlogfile" description:"The file to write a JSON audit log entry for every request to, with its time, client IP, method, path, service, LSAT token ID, response status and latency. It is rotated like the main log file. Leave empty to disable."`
+
+	// Debug enables features that help with testing clients against
+	// aperture, like the latency injection of services. It must never be
+	// enabled in production.
+	Debug bool `long:"debug" description:"Enable debugging features like the latency injection of services. Never enable this in production!"`
+
 	// ConfigFile points aperture to an alternative config file.
 	ConfigFile string `long:"configfile" description:"Custom path to a config file."`
 
@@ -132,24 +539,296 @@ type Config struct {
 }
 
 func (c *Config) validate() error {
+	// Config files of older versions are migrated when they are loaded,
+	// so only versions we don't know are left.
+	if c.ConfigVersion < 0 || c.ConfigVersion > CurrentConfigVersion {
+		return fmt.Errorf("unsupported config version %d, run "+
+			"aperture-migrate-config or upgrade aperture",
+			c.ConfigVersion)
+	}
+
 	if err := c.Authenticator.validate(); err != nil {
 		return err
 	}
 
+	for _, backup := range c.BackupAuthenticators {
+		if !c.Authenticator.lndEnabled() || !backup.lndEnabled() {
+			return errors.New("backup authenticators cannot be " +
+				"used with disabled LND auth or mock invoices")
+		}
+
+		if err := backup.validate(); err != nil {
+			return fmt.Errorf("invalid backup authenticator: %v",
+				err)
+		}
+	}
+
+	if err := c.HashMail.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Redis.validate(); err != nil {
+		return err
+	}
+
+	if c.SQLitePath != "" && c.Redis.enabled() {
+		return fmt.Errorf("sqlitepath and redis can't be used together")
+	}
+
+	if err := c.validateServicesURL(); err != nil {
+		return err
+	}
+
 	if c.ListenAddr == "" {
 		return fmt.Errorf("missing listen address for server")
 	}
 
+	if path, ok := unixSocketPath(c.ListenAddr); ok && path == "" {
+		return fmt.Errorf("missing path of Unix socket listen address")
+	}
+
+	if err := c.validateHTTP3(); err != nil {
+		return err
+	}
+
+	if c.PathPrefix != "" && !strings.HasPrefix(c.PathPrefix, "/") {
+		return fmt.Errorf("path prefix must start with /")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown timeout cannot be negative")
+	}
+
+	if c.PaymentStreamTimeout < 0 {
+		return fmt.Errorf("payment stream timeout cannot be negative")
+	}
+
+	if c.CertReloadInterval < 0 {
+		return fmt.Errorf("cert reload interval cannot be negative")
+	}
+
+	if c.MaxConcurrentRequests < 0 || c.MaxPendingRequests < 0 ||
+		c.MaxQueueWait < 0 {
+
+		return fmt.Errorf("request queue limits cannot be negative")
+	}
+
+	if c.MaxPendingRequests > 0 && c.MaxConcurrentRequests == 0 {
+		return fmt.Errorf("max pending requests requires max " +
+			"concurrent requests to be set")
+	}
+
+	switch c.LogFormat {
+	case "", logFormatText, logFormatJSON:
+
+	default:
+		return fmt.Errorf("unknown log format %q", c.LogFormat)
+	}
+
+	switch c.AccessLogLevel {
+	case "", proxy.AccessLogTrace, proxy.AccessLogDebug,
+		proxy.AccessLogInfo:
+
+	default:
+		return fmt.Errorf("unknown access log level %q",
+			c.AccessLogLevel)
+	}
+
+	if c.MaxResponseHeaderBytes < 0 {
+		return fmt.Errorf("max response header bytes cannot be " +
+			"negative")
+	}
+
+	if c.RequestSampling != nil && (c.RequestSampling.Rate < 0 ||
+		c.RequestSampling.Rate > 1) {
+
+		return fmt.Errorf("request sampling rate must be between 0 " +
+			"and 1")
+	}
+
+	if c.Hooks != nil && c.Hooks.Timeout < 0 {
+		return fmt.Errorf("hook timeout cannot be negative")
+	}
+
+	if c.ReplayProtection != nil && c.ReplayProtection.NonceWindow < 0 {
+		return fmt.Errorf("nonce window cannot be negative")
+	}
+
+	if c.Etcd != nil && c.Etcd.MemberRefreshInterval < 0 {
+		return fmt.Errorf("etcd member refresh interval cannot be " +
+			"negative")
+	}
+
+	if c.Etcd != nil && c.Etcd.WatchServices && c.ServicesURL != "" {
+		return fmt.Errorf("etcd watchservices and servicesurl can't " +
+			"be used together")
+	}
+
+	if err := c.Admin.validate(); err != nil {
+		return err
+	}
+
+	if err := c.TLS.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Webhook.validate(); err != nil {
+		return err
+	}
+
+	if err := validateStaticS3(c.Static); err != nil {
+		return err
+	}
+
+	// Admin API LSATs are only issued to the operator of the lnd node, so
+	// we need to be able to connect to it.
+	if c.Admin != nil && c.Admin.LSATAuth &&
+		!c.Authenticator.lndEnabled() {
+
+		return fmt.Errorf("admin API LSAT authentication requires " +
+			"lnd authentication to be enabled")
+	}
+
+	if err := validateJWT(c.JWT, c.Services); err != nil {
+		return err
+	}
+
+	// LSATs for the forward proxy must not be valid for a service as well.
+	if c.ForwardProxy != nil && c.ForwardProxy.Enabled {
+		for _, service := range c.Services {
+			if service.Name == proxy.ForwardProxyServiceName {
+				return fmt.Errorf("service name %s is reserved "+
+					"for the forward proxy",
+					proxy.ForwardProxyServiceName)
+			}
+		}
+	}
+
+	return proxy.ValidateServices(c.Services)
+}
+
+// validateServicesURL makes sure the options for loading the services from a
+// remote URL are sane.
+func (c *Config) validateServicesURL() error {
+	if c.ServicesURL == "" {
+		if c.ServicesUser != "" || c.ServicesToken != "" {
+			return fmt.Errorf("services credentials require a " +
+				"services URL")
+		}
+		return nil
+	}
+
+	u, err := url.Parse(c.ServicesURL)
+	if err != nil {
+		return fmt.Errorf("invalid services URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("services URL must be an http or https URL")
+	}
+
+	if len(c.Services) > 0 {
+		return fmt.Errorf("services can't be configured when they " +
+			"are loaded from a services URL")
+	}
+
+	if c.ServicesRefreshInterval < 0 {
+		return fmt.Errorf("services refresh interval cannot be " +
+			"negative")
+	}
+
+	if c.ServicesUser != "" && c.ServicesToken != "" {
+		return fmt.Errorf("services user and token can't be used " +
+			"together")
+	}
+
 	return nil
 }
 
+// unixSocketPath returns the path of the Unix domain socket the given listen
+// address refers to and true, or false if it isn't a Unix socket address.
+func unixSocketPath(listenAddr string) (string, bool) {
+	if !strings.HasPrefix(listenAddr, unixSocketPrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(listenAddr, unixSocketPrefix), true
+}
+
 // NewConfig initializes a new Config variable.
 func NewConfig() *Config {
 	return &Config{
-		Etcd:          &EtcdConfig{},
-		Authenticator: &AuthConfig{},
-		Tor:           &TorConfig{},
-		HashMail:      &HashMailConfig{},
-		Prometheus:    &PrometheusConfig{},
+		Etcd:             &EtcdConfig{},
+		Redis:            &RedisConfig{},
+		Authenticator:    &AuthConfig{},
+		Tor:              &TorConfig{},
+		Static:           &StaticConfig{},
+		HashMail:         &HashMailConfig{},
+		Prometheus:       &PrometheusConfig{},
+		Admin:            &AdminConfig{},
+		PagerDuty:        &PagerDutyConfig{},
+		Webhook:          &WebhookConfig{},
+		RequestSampling:  &RequestSamplingConfig{},
+		Hooks:            &HooksConfig{},
+		ReplayProtection: &ReplayProtectionConfig{},
+		ForwardProxy:     &proxy.ForwardProxyConfig{},
+		JWT:              &auth.JWTConfig{},
+		TLS: &TLSConfig{
+			Listener: &TLSSettings{},
+			Admin:    &TLSSettings{},
+			Backend:  &TLSSettings{},
+		},
+	}
+}
+
+// validateJWT makes sure the JWT authentication is configured if any of the
+// services uses it.
+func validateJWT(cfg *auth.JWTConfig, services []*proxy.Service) error {
+	if cfg != nil && cfg.JWKSURL != "" {
+		u, err := url.Parse(cfg.JWKSURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") ||
+			u.Host == "" {
+
+			return fmt.Errorf("invalid JWKS URL %q", cfg.JWKSURL)
+		}
+	}
+	if cfg != nil && cfg.CacheTTL < 0 {
+		return fmt.Errorf("JWKS cache TTL cannot be negative")
+	}
+
+	for _, service := range services {
+		if service.AuthMode != proxy.AuthModeJWT {
+			continue
+		}
+		if cfg == nil || cfg.JWKSURL == "" {
+			return fmt.Errorf("service %s uses authmode %s, but no "+
+				"JWKS URL is configured", service.Name,
+				proxy.AuthModeJWT)
+		}
 	}
+
+	return nil
+}
+
+// validateHTTP3 makes sure HTTP/3 is only enabled on a TCP listen address with
+// TLS, as QUIC always encrypts its connections and its UDP packets can't carry
+// a PROXY protocol header.
+func (c *Config) validateHTTP3() error {
+	if !c.HTTP3 {
+		return nil
+	}
+
+	switch {
+	case c.Insecure:
+		return fmt.Errorf("http3 requires TLS and can't be used with " +
+			"insecure")
+
+	case c.ProxyProtocol:
+		return fmt.Errorf("http3 can't be used with proxyprotocol")
+	}
+
+	if _, ok := unixSocketPath(c.ListenAddr); ok {
+		return fmt.Errorf("http3 can't be used on a Unix socket")
+	}
+
+	return nil
 }
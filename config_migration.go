@@ -0,0 +1,369 @@
+package aperture
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// CurrentConfigVersion is the version of the config file schema this
+	// version of aperture understands.
+	CurrentConfigVersion = 2
+
+	// legacyConfigVersion is the version of config files that don't
+	// specify one, which were written before the schema was versioned.
+	legacyConfigVersion = 1
+
+	// configVersionKey is the key of the schema version in a config file.
+	configVersionKey = "configversion"
+)
+
+// configMigration transforms a config file of one schema version into the
+// next version.
+type configMigration struct {
+	// from is the version the migration upgrades from.
+	from int
+
+	// migrate transforms the given config in place and returns warnings
+	// about anything the operator should look at.
+	migrate func(cfg yaml.MapSlice) (yaml.MapSlice, []string, error)
+}
+
+// configMigrations are all migrations in the order they need to be applied.
+// There must be exactly one migration from every version older than the
+// current one.
+var configMigrations = []configMigration{
+	{
+		from:    1,
+		migrate: migrateConfigV1,
+	},
+}
+
+// staticConfigKeysV1 maps the top-level options of the static content of
+// version 1 configs to their keys in the static section of version 2.
+var staticConfigKeysV1 = map[string]string{
+	"servestatic":      "enabled",
+	"staticroot":       "root",
+	"statics3bucket":   "s3bucket",
+	"statics3region":   "s3region",
+	"statics3endpoint": "s3endpoint",
+}
+
+// migrateConfigV1 upgrades an unversioned config. Version 2 moved the options
+// of the static content from the top level into the static section.
+func migrateConfigV1(cfg yaml.MapSlice) (yaml.MapSlice, []string, error) {
+	return moveIntoSection(cfg, "static", staticConfigKeysV1)
+}
+
+// moveIntoSection moves the top-level options of the given config with one of
+// the given keys into the given section under their new key. The section is
+// created where the first of the options was if it doesn't exist yet.
+func moveIntoSection(cfg yaml.MapSlice, section string,
+	keys map[string]string) (yaml.MapSlice, []string, error) {
+
+	var (
+		migrated yaml.MapSlice
+		moved    yaml.MapSlice
+		existing = -1
+		insertAt = -1
+	)
+	for _, item := range cfg {
+		key := fmt.Sprint(item.Key)
+		if key == section {
+			existing = len(migrated)
+		}
+
+		newKey, ok := keys[key]
+		if !ok {
+			migrated = append(migrated, item)
+			continue
+		}
+
+		if insertAt == -1 {
+			insertAt = len(migrated)
+		}
+		moved = append(moved, yaml.MapItem{
+			Key:   newKey,
+			Value: item.Value,
+		})
+	}
+	if len(moved) == 0 {
+		return cfg, nil, nil
+	}
+
+	var warnings []string
+	for _, item := range moved {
+		warnings = append(warnings, fmt.Sprintf("moved setting %s "+
+			"to %s.%s", oldConfigKey(keys, item.Key), section,
+			item.Key))
+	}
+
+	// The section might already have been added by hand, in which case
+	// the options are added to it unless they are set twice.
+	if existing != -1 {
+		current, ok := migrated[existing].Value.(yaml.MapSlice)
+		if !ok && migrated[existing].Value != nil {
+			return nil, nil, fmt.Errorf("%s must be a section",
+				section)
+		}
+
+		for _, item := range moved {
+			if hasConfigKey(current, item.Key) {
+				return nil, nil, fmt.Errorf("setting %s is "+
+					"set both as %s and %s.%s",
+					item.Key, oldConfigKey(keys, item.Key),
+					section, item.Key)
+			}
+			current = append(current, item)
+		}
+		migrated[existing].Value = current
+
+		return migrated, warnings, nil
+	}
+
+	migrated = append(migrated[:insertAt], append(yaml.MapSlice{{
+		Key:   section,
+		Value: moved,
+	}}, migrated[insertAt:]...)...)
+
+	return migrated, warnings, nil
+}
+
+// oldConfigKey returns the key the option with the given new key had before it
+// was moved.
+func oldConfigKey(keys map[string]string, newKey interface{}) string {
+	for oldKey, key := range keys {
+		if key == newKey {
+			return oldKey
+		}
+	}
+
+	return fmt.Sprint(newKey)
+}
+
+// hasConfigKey returns true if the given config section contains the given
+// key.
+func hasConfigKey(section yaml.MapSlice, key interface{}) bool {
+	for _, item := range section {
+		if item.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MigrateConfig upgrades the given config file of the given schema version to
+// the current version. If the version is zero, it is read from the file. The
+// migrated config is returned along with warnings about settings that aren't
+// part of the current schema and were carried over without being understood.
+// Comments of the original file are not preserved.
+func MigrateConfig(encoded []byte, fromVersion int) ([]byte, []string,
+	error) {
+
+	var cfg yaml.MapSlice
+	if err := yaml.Unmarshal(encoded, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse config: %v", err)
+	}
+
+	fileVersion, err := configFileVersion(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case fromVersion == 0:
+		fromVersion = fileVersion
+
+	case fileVersion != legacyConfigVersion && fileVersion != fromVersion:
+		return nil, nil, fmt.Errorf("config file has version %d, not "+
+			"%d", fileVersion, fromVersion)
+	}
+
+	if fromVersion < legacyConfigVersion ||
+		fromVersion > CurrentConfigVersion {
+
+		return nil, nil, fmt.Errorf("unknown config version %d, "+
+			"expected %d to %d", fromVersion, legacyConfigVersion,
+			CurrentConfigVersion)
+	}
+
+	var warnings []string
+	for _, migration := range configMigrations {
+		if migration.from < fromVersion {
+			continue
+		}
+
+		var migrationWarnings []string
+		cfg, migrationWarnings, err = migration.migrate(cfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to migrate config "+
+				"from version %d: %v", migration.from, err)
+		}
+		warnings = append(warnings, migrationWarnings...)
+	}
+
+	cfg = setConfigVersion(cfg, CurrentConfigVersion)
+	warnings = append(warnings, unknownConfigKeys(
+		cfg, reflect.TypeOf(Config{}), "",
+	)...)
+
+	migrated, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Make sure aperture is able to read the result.
+	if err := yaml.Unmarshal(migrated, NewConfig()); err != nil {
+		return nil, nil, fmt.Errorf("migrated config is invalid: %v",
+			err)
+	}
+
+	return migrated, warnings, nil
+}
+
+// configFileVersion returns the schema version of the given config file.
+func configFileVersion(cfg yaml.MapSlice) (int, error) {
+	for _, item := range cfg {
+		if item.Key != configVersionKey {
+			continue
+		}
+
+		version, ok := item.Value.(int)
+		if !ok {
+			return 0, errors.New("config version must be an " +
+				"integer")
+		}
+
+		return version, nil
+	}
+
+	return legacyConfigVersion, nil
+}
+
+// setConfigVersion sets the schema version of the given config file, adding it
+// as the first key if it isn't present yet.
+func setConfigVersion(cfg yaml.MapSlice, version int) yaml.MapSlice {
+	for i := range cfg {
+		if cfg[i].Key == configVersionKey {
+			cfg[i].Value = version
+			return cfg
+		}
+	}
+
+	return append(yaml.MapSlice{{
+		Key:   configVersionKey,
+		Value: version,
+	}}, cfg...)
+}
+
+// unknownConfigKeys returns a warning for every key of the given config
+// section that has no corresponding field in the given type.
+func unknownConfigKeys(section yaml.MapSlice, t reflect.Type,
+	path string) []string {
+
+	fields := configFields(t)
+
+	var warnings []string
+	for _, item := range section {
+		key := fmt.Sprint(item.Key)
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+
+		field, ok := fields[key]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("unknown "+
+				"setting %s carried over unchanged", keyPath))
+			continue
+		}
+
+		warnings = append(warnings, unknownValueKeys(
+			item.Value, field, keyPath,
+		)...)
+	}
+
+	return warnings
+}
+
+// unknownValueKeys descends into the given value if it is a section or a list
+// of sections of the given type and returns warnings about its unknown keys.
+func unknownValueKeys(value interface{}, t reflect.Type,
+	path string) []string {
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+
+		return unknownConfigKeys(v, t, path)
+
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+
+		var warnings []string
+		for i, elem := range v {
+			warnings = append(warnings, unknownValueKeys(
+				elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i),
+			)...)
+		}
+
+		return warnings
+
+	default:
+		return nil
+	}
+}
+
+// configFields returns the types of the exported fields of the given struct,
+// keyed by the lowercase name they have in a config file.
+func configFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		fields[strings.ToLower(field.Name)] = field.Type
+	}
+
+	return fields
+}
+
+// upgradeConfigFile migrates the given config file to the current schema in
+// memory if it was written for an older version, so aperture can still be
+// started with it. True is returned if the file was migrated, as it should
+// then be migrated with aperture-migrate-config to persist the change.
+func upgradeConfigFile(encoded []byte) ([]byte, bool, error) {
+	var cfg yaml.MapSlice
+	if err := yaml.Unmarshal(encoded, &cfg); err != nil {
+		return nil, false, err
+	}
+
+	version, err := configFileVersion(cfg)
+	if err != nil {
+		return nil, false, err
+	}
+	if version >= CurrentConfigVersion {
+		return encoded, false, nil
+	}
+
+	migrated, _, err := MigrateConfig(encoded, version)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return migrated, true, nil
+}
@@ -0,0 +1,104 @@
+package aperture
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+// TestMigrateConfig makes sure old config files are upgraded to the current
+// schema and unknown settings are reported.
+func TestMigrateConfig(t *testing.T) {
+	t.Parallel()
+
+	legacy := []byte(`
+listenaddr: "localhost:8081"
+staticroot: "./static"
+servestatic: true
+statics3bucket: "bucket"
+authenticator:
+  lndhost: "localhost:10009"
+  unknownauth: true
+services:
+  - name: "service1"
+    price: 10
+    headers:
+      X-Custom: "value"
+  - name: "service2"
+    bogus: 1
+unknowntoplevel: "foo"
+`)
+
+	migrated, warnings, err := MigrateConfig(legacy, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"moved setting staticroot to static.root",
+		"moved setting servestatic to static.enabled",
+		"moved setting statics3bucket to static.s3bucket",
+		"unknown setting authenticator.unknownauth carried over " +
+			"unchanged",
+		"unknown setting services[1].bogus carried over unchanged",
+		"unknown setting unknowntoplevel carried over unchanged",
+	}, warnings)
+
+	cfg := NewConfig()
+	require.NoError(t, yaml.Unmarshal(migrated, cfg))
+	require.Equal(t, CurrentConfigVersion, cfg.ConfigVersion)
+	require.Equal(t, "localhost:8081", cfg.ListenAddr)
+	require.Equal(t, &StaticConfig{
+		Enabled:  true,
+		Root:     "./static",
+		S3Bucket: "bucket",
+	}, cfg.Static)
+	require.Equal(t, "localhost:10009", cfg.Authenticator.LndHost)
+	require.Len(t, cfg.Services, 2)
+	require.Equal(t, "value", cfg.Services[0].Headers["X-Custom"])
+
+	// Migrating a current config doesn't change it.
+	again, warnings, err := MigrateConfig(migrated, CurrentConfigVersion)
+	require.NoError(t, err)
+	require.Len(t, warnings, 3)
+	require.Equal(t, migrated, again)
+
+	// The static options are moved into the section where the first of
+	// them was.
+	var sections yaml.MapSlice
+	require.NoError(t, yaml.Unmarshal(migrated, &sections))
+	keys := make([]interface{}, 0, len(sections))
+	for _, item := range sections {
+		keys = append(keys, item.Key)
+	}
+	require.Equal(t, []interface{}{
+		configVersionKey, "listenaddr", "static", "authenticator",
+		"services", "unknowntoplevel",
+	}, keys)
+
+	// Options set both at the top level and in the section of a legacy
+	// config are a conflict the operator has to resolve.
+	_, _, err = MigrateConfig([]byte(`
+staticroot: "./static"
+static:
+  root: "./other"
+`), 0)
+	require.Error(t, err)
+
+	// Legacy configs are migrated when they are loaded.
+	upgraded, ok, err := upgradeConfigFile(legacy)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, migrated, upgraded)
+
+	current, ok, err := upgradeConfigFile(migrated)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, migrated, current)
+
+	// The given version must match the one of the file.
+	_, _, err = MigrateConfig(migrated, legacyConfigVersion)
+	require.Error(t, err)
+
+	// Unknown versions are rejected.
+	_, _, err = MigrateConfig([]byte("configversion: 99\n"), 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package aperture
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/lightninglabs/aperture/proxy"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// servicesKey is the key of the list of services in a config file.
+const servicesKey = "services"
+
+// locateServiceField sets the line and column of the invalid service setting
+// described by the given error to its position in the given config file. If
+// the setting itself isn't in the file, for example because it is missing, the
+// position of the closest setting it would be part of is used. The error is
+// left unchanged if the file can't be parsed.
+func locateServiceField(encoded []byte,
+	validationErr *proxy.ValidationError) {
+
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(encoded, &doc); err != nil ||
+		len(doc.Content) == 0 {
+
+		return
+	}
+
+	services, _ := mappingValue(doc.Content[0], servicesKey)
+	if services == nil || services.Kind != yamlv3.SequenceNode ||
+		validationErr.Index >= len(services.Content) {
+
+		return
+	}
+
+	node := services.Content[validationErr.Index]
+	validationErr.Line, validationErr.Column = node.Line, node.Column
+
+	if validationErr.Field == "" {
+		return
+	}
+	for _, segment := range strings.Split(validationErr.Field, ".") {
+		key, index := splitFieldIndex(segment)
+
+		value, keyNode := mappingValue(node, key)
+		if value == nil {
+			return
+		}
+		node = value
+		validationErr.Line = keyNode.Line
+		validationErr.Column = keyNode.Column
+
+		if index < 0 {
+			continue
+		}
+		if node.Kind != yamlv3.SequenceNode ||
+			index >= len(node.Content) {
+
+			return
+		}
+		node = node.Content[index]
+		validationErr.Line = node.Line
+		validationErr.Column = node.Column
+	}
+}
+
+// mappingValue returns the value and key nodes of the given key in the given
+// mapping node, or nil if the node isn't a mapping or doesn't contain the key.
+func mappingValue(node *yamlv3.Node, key string) (*yamlv3.Node,
+	*yamlv3.Node) {
+
+	if node.Kind != yamlv3.MappingNode {
+		return nil, nil
+	}
+
+	// The content of a mapping node alternates between keys and values.
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1], node.Content[i]
+		}
+	}
+
+	return nil, nil
+}
+
+// splitFieldIndex splits a segment of a field path like authwhitelistpaths[1]
+// into its key and list index. The index is -1 if the segment has none.
+func splitFieldIndex(segment string) (string, int) {
+	start := strings.Index(segment, "[")
+	if start < 0 || !strings.HasSuffix(segment, "]") {
+		return segment, -1
+	}
+
+	index, err := strconv.Atoi(segment[start+1 : len(segment)-1])
+	if err != nil {
+		return segment, -1
+	}
+
+	return segment[:start], index
+}
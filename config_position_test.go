@@ -0,0 +1,89 @@
+package aperture
+
+import (
+	"testing"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// testServicesConfig is a config file with an invalid setting in its second
+// service.
+const testServicesConfig = `listenaddr: "localhost:8081"
+services:
+  - name: "first"
+    hostregexp: ".*"
+  - name: "second"
+    hostregexp: ".*"
+    authwhitelistpaths:
+      - "^/ok$"
+      - "^/bad/("
+    dynamicprice:
+      enabled: true
+    latencyinjection:
+      delayms: -1
+`
+
+// TestLocateServiceField makes sure invalid service settings are located in
+// the config file they were read from.
+func TestLocateServiceField(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		field  string
+		line   int
+		column int
+	}{{
+		name:   "nested field",
+		field:  "latencyinjection.delayms",
+		line:   13,
+		column: 7,
+	}, {
+		name:   "list entry",
+		field:  "authwhitelistpaths[1]",
+		line:   9,
+		column: 9,
+	}, {
+		name:   "missing field",
+		field:  "dynamicprice.grpcaddress",
+		line:   10,
+		column: 5,
+	}, {
+		name:   "no field",
+		line:   5,
+		column: 5,
+	}}
+
+	for _, tc := range testCases {
+		validationErr := &proxy.ValidationError{
+			Service: "second",
+			Index:   1,
+			Field:   tc.field,
+		}
+		locateServiceField([]byte(testServicesConfig), validationErr)
+
+		require.Equal(t, tc.line, validationErr.Line, tc.name)
+		require.Equal(t, tc.column, validationErr.Column, tc.name)
+	}
+
+	// A service that isn't in the file can't be located.
+	validationErr := &proxy.ValidationError{Index: 2, Field: "price"}
+	locateServiceField([]byte(testServicesConfig), validationErr)
+	require.Zero(t, validationErr.Line)
+}
+
+// TestConfigValidateServices makes sure invalid service settings are reported
+// by the config validation.
+func TestConfigValidateServices(t *testing.T) {
+	t.Parallel()
+
+	cfg := NewConfig()
+	cfg.ListenAddr = "localhost:8081"
+	cfg.Authenticator.Disable = true
+	cfg.Services = []*proxy.Service{{Name: "svc", Price: -1}}
+
+	err := cfg.validate()
+	require.IsType(t, &proxy.ValidationError{}, err)
+	require.Equal(t, "price", err.(*proxy.ValidationError).Field)
+}
@@ -0,0 +1,35 @@
+package aperture
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestConfigValidateOptionalSections makes sure a config that doesn't set the
+// optional sections, as it can happen if aperture is used as a library, can
+// be validated.
+func TestConfigValidateOptionalSections(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{
+		ListenAddr:    "localhost:8081",
+		Authenticator: &AuthConfig{Disable: true},
+	}
+	require.NoError(t, cfg.validate())
+
+	// The sections are still validated if they are set.
+	cfg.Etcd = &EtcdConfig{MemberRefreshInterval: -1}
+	require.Error(t, cfg.validate())
+
+	// The services can't be loaded from a URL and etcd at the same time.
+	cfg.Etcd = &EtcdConfig{WatchServices: true}
+	require.NoError(t, cfg.validate())
+	cfg.ServicesURL = "https://example.com/services.yaml"
+	require.Error(t, cfg.validate())
+	cfg.ServicesURL = ""
+
+	cfg.Etcd = nil
+	cfg.Admin = &AdminConfig{LSATAuth: true}
+	require.Error(t, cfg.validate())
+}
@@ -0,0 +1,316 @@
+package aperture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightninglabs/aperture/store/sqlite"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// dryRunDialTimeout is the maximum time we wait for a connection to
+	// etcd or a backend service to be established during a dry run.
+	dryRunDialTimeout = 5 * time.Second
+)
+
+// errDryRunFailed is returned if any of the checks of a dry run failed.
+var errDryRunFailed = errors.New("dry run failed")
+
+// dryRunCheck is a single check performed during a dry run.
+type dryRunCheck struct {
+	// name describes what is checked.
+	name string
+
+	// check performs the check and returns an error if it failed.
+	check func() error
+}
+
+// dryRun validates the given config and makes sure etcd, lnd and all backend
+// services can be reached without opening any listeners. A summary of what
+// would be served and the result of each check is written to the given
+// writer. If any check failed, errDryRunFailed is returned.
+func dryRun(cfg *Config, w io.Writer) error {
+	var checks []dryRunCheck
+
+	// Preparing the services validates their configuration the same way
+	// as starting the proxy does, without serving anything.
+	checks = append(checks, dryRunCheck{
+		name: "service configuration",
+		check: func() error {
+			prxy, err := proxy.New(nil, cfg.Services)
+			if err != nil {
+				return err
+			}
+
+			return prxy.Close()
+		},
+	})
+
+	checks = append(checks, dryRunCheck{
+		name: fmt.Sprintf("etcd %s", cfg.Etcd.Host),
+		check: func() error {
+			return checkEtcd(cfg.Etcd)
+		},
+	})
+
+	if cfg.Redis.enabled() {
+		checks = append(checks, dryRunCheck{
+			name: fmt.Sprintf("redis %s", cfg.Redis.Host),
+			check: func() error {
+				client, err := newRedisClient(cfg.Redis)
+				if err != nil {
+					return err
+				}
+
+				return client.Close()
+			},
+		})
+	}
+
+	if cfg.SQLitePath != "" {
+		checks = append(checks, dryRunCheck{
+			name: fmt.Sprintf("sqlite %s", cfg.SQLitePath),
+			check: func() error {
+				db, err := sqlite.Open(cfg.SQLitePath)
+				if err != nil {
+					return err
+				}
+
+				return db.Close()
+			},
+		})
+	}
+
+	if cfg.Authenticator.lndEnabled() {
+		lndCfgs := append(
+			[]*AuthConfig{cfg.Authenticator},
+			cfg.BackupAuthenticators...,
+		)
+		for _, lndCfg := range lndCfgs {
+			lndCfg := lndCfg
+			checks = append(checks, dryRunCheck{
+				name: fmt.Sprintf("lnd %s", lndCfg.LndHost),
+				check: func() error {
+					return checkLnd(lndCfg)
+				},
+			})
+		}
+	}
+
+	for _, service := range cfg.Services {
+		// Services with a static response don't have a backend.
+		if service.StaticResponse != nil {
+			continue
+		}
+
+		// Backends discovered through an SRV record only fall back to
+		// their static address, if there is one.
+		var addresses []string
+		if srvName := service.Backend.SRVName; srvName != "" {
+			checks = append(checks, dryRunCheck{
+				name: fmt.Sprintf("SRV record %s of service %s",
+					srvName, service.Name),
+				check: func() error {
+					return checkSRV(srvName)
+				},
+			})
+		}
+		if service.Address != "" || service.Backend.SRVName == "" {
+			addresses = append(addresses, service.Address)
+		}
+		if service.CanaryAddress != "" {
+			addresses = append(addresses, service.CanaryAddress)
+		}
+
+		for _, address := range addresses {
+			address, protocol := address, service.Protocol
+			checks = append(checks, dryRunCheck{
+				name: fmt.Sprintf("backend %s of service %s",
+					address, service.Name),
+				check: func() error {
+					return checkBackend(address, protocol)
+				},
+			})
+		}
+	}
+
+	printDryRunSummary(cfg, w)
+
+	_, _ = fmt.Fprintln(w, "\nChecks:")
+	failed := false
+	for _, check := range checks {
+		if err := check.check(); err != nil {
+			_, _ = fmt.Fprintf(w, "  [FAIL] %s: %v\n", check.name,
+				err)
+			failed = true
+			continue
+		}
+
+		_, _ = fmt.Fprintf(w, "  [OK]   %s\n", check.name)
+	}
+
+	if failed {
+		return errDryRunFailed
+	}
+
+	return nil
+}
+
+// printDryRunSummary writes a summary of what aperture would serve with the
+// given config to the writer.
+func printDryRunSummary(cfg *Config, w io.Writer) {
+	tlsMode := "self-signed certificate"
+	switch {
+	case cfg.Insecure:
+		tlsMode = "disabled"
+
+	case cfg.AutoCert:
+		tlsMode = fmt.Sprintf("Let's Encrypt for %s", cfg.ServerName)
+	}
+	if _, isUnixSocket := unixSocketPath(cfg.ListenAddr); isUnixSocket {
+		tlsMode = "disabled"
+	}
+	if tlsMode != "disabled" && cfg.CertDir != "" {
+		tlsMode += fmt.Sprintf(", hostname certificates from %s",
+			cfg.CertDir)
+	}
+
+	_, _ = fmt.Fprintf(w, "Listen address: %s\n", cfg.ListenAddr)
+	_, _ = fmt.Fprintf(w, "TLS: %s\n", tlsMode)
+	_, _ = fmt.Fprintf(w, "LSAT authentication: %v\n",
+		!cfg.Authenticator.Disable)
+	if !cfg.Authenticator.Disable && cfg.Authenticator.Mock {
+		_, _ = fmt.Fprintf(w, "Mock invoices: enabled, settlement "+
+			"failures simulated: %v\n",
+			cfg.Authenticator.MockFailSettlements)
+	}
+
+	_, _ = fmt.Fprintf(w, "Services (%d):\n", len(cfg.Services))
+	for _, service := range cfg.Services {
+		if service.StaticResponse != nil {
+			_, _ = fmt.Fprintf(w, "  %s: host %q, path %q -> "+
+				"static response\n", service.Name,
+				service.HostRegexp, service.PathRegexp)
+			continue
+		}
+
+		backend := service.Address
+		if service.Backend.SRVName != "" {
+			backend = fmt.Sprintf("SRV %s", service.Backend.SRVName)
+		}
+		_, _ = fmt.Fprintf(w, "  %s: host %q, path %q -> %s://%s, "+
+			"auth %q, price %d sat\n", service.Name,
+			service.HostRegexp, service.PathRegexp,
+			service.Protocol, backend, service.Auth,
+			service.Price)
+	}
+
+	if cfg.HashMail != nil && cfg.HashMail.Enabled {
+		_, _ = fmt.Fprintln(w, "Hashmail: enabled")
+	}
+	if cfg.Admin != nil && cfg.Admin.ListenAddr != "" {
+		_, _ = fmt.Fprintf(w, "Admin API: %s\n", cfg.Admin.ListenAddr)
+	}
+	if cfg.Tor != nil && (cfg.Tor.V2 || cfg.Tor.V3) {
+		_, _ = fmt.Fprintf(w, "Tor: v2 %v, v3 %v\n", cfg.Tor.V2,
+			cfg.Tor.V3)
+	}
+}
+
+// checkEtcd connects to etcd and reads from it.
+func checkEtcd(cfg *EtcdConfig) error {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{cfg.Host},
+		DialTimeout: dryRunDialTimeout,
+		Username:    cfg.User,
+		Password:    cfg.Password,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), etcdRPCTimeout,
+	)
+	defer cancel()
+
+	_, err = client.Get(ctx, topLevelKey, clientv3.WithCountOnly())
+	return err
+}
+
+// checkLnd makes sure the lnd node runs a supported version and that invoices
+// can be listed with the invoice macaroon, as the challenger does.
+func checkLnd(cfg *AuthConfig) error {
+	if err := verifyLndVersion(cfg); err != nil {
+		return err
+	}
+
+	conn, err := lndclient.NewBasicConn(
+		cfg.LndHost, cfg.TLSPath, cfg.MacDir, cfg.Network,
+		lndclient.MacFilename(invoiceMacaroonName),
+	)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), lndRPCTimeout)
+	defer cancel()
+
+	_, err = lnrpc.NewLightningClient(conn).ListInvoices(
+		ctx, &lnrpc.ListInvoiceRequest{NumMaxInvoices: 1},
+	)
+	return err
+}
+
+// checkBackend makes sure a TCP connection can be established to the given
+// backend address. If the address has no port, the default port of the
+// protocol is used.
+func checkBackend(address, protocol string) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "80"
+		if protocol == "https" {
+			port = "443"
+		}
+
+		// JoinHostPort adds the brackets of IPv6 addresses itself.
+		host := strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+		address = net.JoinHostPort(host, port)
+	}
+
+	conn, err := net.DialTimeout("tcp", address, dryRunDialTimeout)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// checkSRV makes sure the SRV record with the given name resolves to at least
+// one target.
+func checkSRV(name string) error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), dryRunDialTimeout,
+	)
+	defer cancel()
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no targets found")
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package aperture
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDryRun makes sure a dry run reports every check and only succeeds if all
+// of them pass.
+func TestDryRun(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	cfg := NewConfig()
+	cfg.ListenAddr = "localhost:8081"
+	cfg.Etcd.Host = etcdClient.Endpoints()[0]
+	cfg.Authenticator.Disable = true
+	cfg.Services = []*proxy.Service{{
+		Name:     "service1",
+		Address:  backend.Addr().String(),
+		Protocol: "http",
+	}}
+
+	var out bytes.Buffer
+	require.NoError(t, dryRun(cfg, &out))
+	require.Contains(t, out.String(), "service1")
+	require.Contains(t, out.String(), "[OK]   etcd")
+	require.NotContains(t, out.String(), "[FAIL]")
+
+	// Once the backend goes away, the dry run must fail.
+	require.NoError(t, backend.Close())
+	out.Reset()
+	require.Equal(t, errDryRunFailed, dryRun(cfg, &out))
+	require.Contains(t, out.String(), "[FAIL] backend")
+}
@@ -0,0 +1,226 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// servicesPrefix is the key we'll use to prefix all service
+	// definitions written to an etcd cluster by an external controller.
+	servicesPrefix = "services"
+
+	// servicesSettleTime is the time we wait for further changes of the
+	// service definitions in etcd before applying them, so a controller
+	// writing several definitions at once only causes a single update.
+	servicesSettleTime = 500 * time.Millisecond
+
+	// servicesLoadTimeout is the maximum time loading the service
+	// definitions from etcd can take.
+	servicesLoadTimeout = 10 * time.Second
+)
+
+// servicesKeyPrefix returns the prefix of all service definition keys.
+//
+// The resulting path of the definition of service1 within etcd would look
+// like:
+//
+//	lsat/proxy/services/service1
+func servicesKeyPrefix() string {
+	return strings.Join(
+		[]string{topLevelKey, servicesPrefix, ""}, etcdKeyDelimeter,
+	)
+}
+
+// etcdServices watches the service definitions an external controller writes
+// to an etcd cluster and updates the services whenever they change. Each key
+// holds a single service in the same YAML format as the entries of the
+// services section of the configuration file. While there are no keys, the
+// services aren't managed through etcd and are left alone.
+type etcdServices struct {
+	client *clientv3.Client
+
+	// settleTime is the time we wait for further changes before applying
+	// them.
+	settleTime time.Duration
+
+	// update is called with the new services whenever they changed.
+	update func([]*proxy.Service) error
+
+	// last holds the values of the keys we applied last, so we only update
+	// the services if they actually changed.
+	last []byte
+
+	ctx    context.Context
+	cancel func()
+	wg     sync.WaitGroup
+}
+
+// newEtcdServices creates a new watcher of the service definitions in the
+// given etcd cluster.
+func newEtcdServices(client *clientv3.Client) *etcdServices {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &etcdServices{
+		client:     client,
+		settleTime: servicesSettleTime,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Start applies the service definitions currently in etcd, if there are any,
+// and starts the goroutine that watches them for changes and calls the given
+// function with the new services.
+func (e *etcdServices) Start(update func([]*proxy.Service) error) {
+	e.update = update
+
+	// Invalid definitions are only logged, just like the ones written
+	// while we're running, so they can be fixed without a restart.
+	revision, err := e.refresh()
+	if err != nil {
+		log.Errorf("Unable to load services from etcd: %v", err)
+	}
+
+	log.Infof("Watching etcd for changes of the services at %s",
+		servicesKeyPrefix())
+
+	e.wg.Add(1)
+	go e.watchServices(revision)
+}
+
+// Stop shuts down the watch of the service definitions.
+func (e *etcdServices) Stop() {
+	e.cancel()
+	e.wg.Wait()
+}
+
+// watchServices watches the service definitions for changes made after the
+// given etcd revision, or from now on if it is zero, and applies them once no
+// further changes were made for the settle time.
+//
+// NOTE: This must be run as a goroutine.
+func (e *etcdServices) watchServices(revision int64) {
+	defer e.wg.Done()
+
+	watch := func(opts ...clientv3.OpOption) clientv3.WatchChan {
+		opts = append(opts, clientv3.WithPrefix())
+		return e.client.Watch(e.ctx, servicesKeyPrefix(), opts...)
+	}
+	watchChan := watch()
+	if revision > 0 {
+		watchChan = watch(clientv3.WithRev(revision + 1))
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case resp, ok := <-watchChan:
+			// The watch is canceled if the etcd cluster can't
+			// keep the changes we missed or the connection is
+			// lost. We start a new one and load the definitions
+			// again to pick up anything we missed in between.
+			if !ok || resp.Err() != nil {
+				err := resp.Err()
+				if !ok {
+					err = fmt.Errorf("watch closed")
+				}
+				log.Warnf("Watch of services in etcd failed, "+
+					"restarting: %v", err)
+
+				select {
+				case <-time.After(e.settleTime):
+				case <-e.ctx.Done():
+					return
+				}
+
+				watchChan = watch()
+				settled = time.After(e.settleTime)
+				continue
+			}
+
+			// Every change extends the settle time, so a batch
+			// of changes is applied at once.
+			if len(resp.Events) > 0 {
+				settled = time.After(e.settleTime)
+			}
+
+		case <-settled:
+			settled = nil
+
+			if _, err := e.refresh(); err != nil {
+				log.Errorf("Unable to update services from "+
+					"etcd: %v", err)
+			}
+
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh loads the service definitions from etcd and updates the services if
+// they changed since they were applied last. The current services are kept if
+// the new ones are invalid or there are none. The etcd revision the
+// definitions were loaded at is returned.
+func (e *etcdServices) refresh() (int64, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, servicesLoadTimeout)
+	defer cancel()
+
+	resp, err := e.client.Get(
+		ctx, servicesKeyPrefix(), clientv3.WithPrefix(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	revision := resp.Header.Revision
+
+	if len(resp.Kvs) == 0 {
+		if e.last != nil {
+			log.Warnf("No services left in etcd, keeping the " +
+				"current services")
+		}
+		e.last = nil
+
+		return revision, nil
+	}
+
+	var (
+		encoded  [][]byte
+		services = make([]*proxy.Service, 0, len(resp.Kvs))
+	)
+	for _, kv := range resp.Kvs {
+		var service proxy.Service
+		if err := yaml.UnmarshalStrict(kv.Value, &service); err != nil {
+			return revision, fmt.Errorf("invalid service at %s: %v",
+				kv.Key, err)
+		}
+
+		encoded = append(encoded, kv.Key, kv.Value)
+		services = append(services, &service)
+	}
+
+	// The keys are returned in order, so the same definitions are always
+	// encoded the same way.
+	current := bytes.Join(encoded, []byte{0})
+	if bytes.Equal(current, e.last) {
+		return revision, nil
+	}
+
+	log.Infof("Services in etcd changed, updating %d services",
+		len(services))
+	if err := e.update(services); err != nil {
+		return revision, fmt.Errorf("unable to update services: %v",
+			err)
+	}
+	e.last = current
+
+	return revision, nil
+}
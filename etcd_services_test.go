@@ -0,0 +1,91 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestEtcdServices makes sure the service definitions in etcd are applied on
+// start and whenever they change, with a batch of changes only causing a
+// single update.
+func TestEtcdServices(t *testing.T) {
+	client, cleanup := etcdSetup(t)
+	defer client.Close()
+	defer cleanup()
+
+	ctx := context.Background()
+	put := func(name, definition string) {
+		_, err := client.Put(ctx, servicesKeyPrefix()+name, definition)
+		require.NoError(t, err)
+	}
+	put("service1", "name: service1\nhostregexp: service1.com")
+
+	updates := make(chan []*proxy.Service, 10)
+	e := newEtcdServices(client)
+	e.settleTime = 200 * time.Millisecond
+	e.Start(func(services []*proxy.Service) error {
+		updates <- services
+		return nil
+	})
+	defer e.Stop()
+
+	names := func(services []*proxy.Service) []string {
+		var names []string
+		for _, service := range services {
+			names = append(names, service.Name)
+		}
+		return names
+	}
+	receive := func() []*proxy.Service {
+		select {
+		case services := <-updates:
+			return services
+		case <-time.After(5 * time.Second):
+			t.Fatal("services weren't updated")
+			return nil
+		}
+	}
+	requireNoUpdate := func() {
+		select {
+		case services := <-updates:
+			t.Fatalf("unexpected update: %v", names(services))
+		case <-time.After(4 * e.settleTime):
+		}
+	}
+
+	// The definitions already in etcd are applied right away.
+	require.Equal(t, []string{"service1"}, names(<-updates))
+
+	// Several changes in a row are applied at once.
+	put("service2", "name: service2\nhostregexp: service2.com")
+	put("service3", "name: service3\nhostregexp: service3.com")
+	_, err := client.Delete(ctx, servicesKeyPrefix()+"service1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"service2", "service3"}, names(receive()))
+	requireNoUpdate()
+
+	// Writing the same definitions again doesn't update the services.
+	put("service2", "name: service2\nhostregexp: service2.com")
+	requireNoUpdate()
+
+	// Invalid definitions are ignored until they are fixed.
+	put("service4", "name: service4\nunknown: true")
+	requireNoUpdate()
+	put("service4", "name: service4\nhostregexp: service4.com")
+	require.Equal(
+		t, []string{"service2", "service3", "service4"},
+		names(receive()),
+	)
+
+	// Removing all definitions keeps the current services.
+	_, err = client.Delete(
+		ctx, servicesKeyPrefix(), clientv3.WithPrefix(),
+	)
+	require.NoError(t, err)
+	requireNoUpdate()
+}
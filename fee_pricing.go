@@ -0,0 +1,108 @@
+package aperture
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+)
+
+// RouteClient is an interface that only implements part of a full lnd client,
+// namely the part we need to estimate routing fees.
+type RouteClient interface {
+	// QueryRoutes attempts to query the daemon's Channel Router for
+	// possible routes to a target destination.
+	QueryRoutes(ctx context.Context, in *lnrpc.QueryRoutesRequest,
+		opts ...grpc.CallOption) (*lnrpc.QueryRoutesResponse, error)
+}
+
+// feeEstimator estimates the routing fees for paying an amount to a node.
+type feeEstimator struct {
+	client RouteClient
+}
+
+// newFeeEstimator creates a new fee estimator for the lnd node described by
+// the given config. The read-only macaroon is used to connect to the node.
+func newFeeEstimator(cfg *AuthConfig) (*feeEstimator, error) {
+	client, err := lndclient.NewBasicClient(
+		cfg.LndHost, cfg.TLSPath, cfg.MacDir, cfg.Network,
+		lndclient.MacFilename(readonlyMacaroonName),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &feeEstimator{client: client}, nil
+}
+
+// estimateFee returns the routing fee in satoshis, rounded up, for sending the
+// given amount to the node with the given public key.
+func (f *feeEstimator) estimateFee(ctx context.Context, pubKey []byte,
+	amt int64) (int64, error) {
+
+	resp, err := f.client.QueryRoutes(ctx, &lnrpc.QueryRoutesRequest{
+		PubKey: hex.EncodeToString(pubKey),
+		Amt:    amt,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// To be on the safe side, we use the most expensive route lnd found.
+	var feeMsat int64
+	for _, route := range resp.Routes {
+		if route.TotalFeesMsat > feeMsat {
+			feeMsat = route.TotalFeesMsat
+		}
+	}
+
+	return (feeMsat + 999) / 1000, nil
+}
+
+// hasDynamicFeePricing returns true if dynamic fee pricing is enabled for any
+// of the configured services.
+func hasDynamicFeePricing(cfg *Config) bool {
+	for _, service := range cfg.Services {
+		if service.DynamicFeePricing {
+			return true
+		}
+	}
+
+	return false
+}
+
+// feeBuffer returns the amount that is added to the given base price if
+// dynamic fee pricing is enabled for the request the context belongs to. The
+// buffer consists of the configured percentage of the base price plus, if the
+// client told us its node, the estimated routing fee to that node.
+func feeBuffer(ctx context.Context, estimator *feeEstimator,
+	price int64) int64 {
+
+	pricing := proxy.FeePricingFromContext(ctx)
+	if pricing == nil {
+		return 0
+	}
+
+	buffer := (price*int64(pricing.BufferPercent) + 99) / 100
+
+	if pricing.BuyerNode == nil || estimator == nil {
+		return buffer
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lndRPCTimeout)
+	defer cancel()
+
+	fee, err := estimator.estimateFee(ctx, pricing.BuyerNode, price)
+	if err != nil {
+		// Not finding a route is nothing unusual, the buyer might for
+		// example only have private channels.
+		log.Debugf("Unable to estimate routing fee to %x: %v",
+			pricing.BuyerNode, err)
+		return buffer
+	}
+
+	return buffer + fee
+}
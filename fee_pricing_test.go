@@ -0,0 +1,64 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+type mockRouteClient struct {
+	feesMsat []int64
+}
+
+func (m *mockRouteClient) QueryRoutes(context.Context,
+	*lnrpc.QueryRoutesRequest, ...grpc.CallOption) (
+	*lnrpc.QueryRoutesResponse, error) {
+
+	resp := &lnrpc.QueryRoutesResponse{}
+	for _, fee := range m.feesMsat {
+		resp.Routes = append(resp.Routes, &lnrpc.Route{
+			TotalFeesMsat: fee,
+		})
+	}
+
+	return resp, nil
+}
+
+// TestFeeBuffer makes sure the fee buffer is only added if dynamic fee pricing
+// is enabled and that it includes the estimated routing fee if possible.
+func TestFeeBuffer(t *testing.T) {
+	estimator := &feeEstimator{
+		client: &mockRouteClient{feesMsat: []int64{1500, 2001}},
+	}
+	withPricing := func(pricing *proxy.FeePricing) context.Context {
+		return lsat.AddToContext(
+			context.Background(), proxy.KeyFeePricing, pricing,
+		)
+	}
+
+	// Without fee pricing in the context, nothing is added.
+	require.EqualValues(t, 0, feeBuffer(
+		context.Background(), estimator, 1000,
+	))
+
+	// Without a buyer node, only the percentage is added, rounded up.
+	ctx := withPricing(&proxy.FeePricing{BufferPercent: 5})
+	require.EqualValues(t, 50, feeBuffer(ctx, estimator, 1000))
+	require.EqualValues(t, 1, feeBuffer(ctx, estimator, 1))
+
+	// With a buyer node, the most expensive route's fee is added as well,
+	// rounded up to full satoshis.
+	ctx = withPricing(&proxy.FeePricing{
+		BuyerNode:     []byte{0x02},
+		BufferPercent: 5,
+	})
+	require.EqualValues(t, 53, feeBuffer(ctx, estimator, 1000))
+
+	// If we're not able to estimate fees, only the percentage is added.
+	require.EqualValues(t, 50, feeBuffer(ctx, nil, 1000))
+}
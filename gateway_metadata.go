@@ -0,0 +1,64 @@
+package aperture
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	gateway "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/protobuf/proto"
+)
+
+// encodeBinaryMetadata is a forward response option for the REST proxy that
+// base64 encodes the values of binary gRPC metadata before they are written to
+// the response. The gRPC client of the REST proxy hands them over decoded, so
+// without this their raw bytes would end up in the HTTP header and trailer
+// fields, where anything that isn't printable ASCII gets mangled.
+func encodeBinaryMetadata(ctx context.Context, w http.ResponseWriter,
+	_ proto.Message) error {
+
+	md, ok := gateway.ServerMetadataFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	// The header fields were already added to the response at this point,
+	// so we replace them there.
+	for key, values := range md.HeaderMD {
+		if !strings.HasSuffix(key, "-bin") {
+			continue
+		}
+
+		name := http.CanonicalHeaderKey(
+			gateway.MetadataHeaderPrefix + key,
+		)
+		if _, ok := w.Header()[name]; !ok {
+			continue
+		}
+
+		w.Header()[name] = encodeBinaryValues(values)
+	}
+
+	// The trailer fields are only written after the response body, so we
+	// can encode them in place.
+	for key, values := range md.TrailerMD {
+		if !strings.HasSuffix(key, "-bin") {
+			continue
+		}
+
+		md.TrailerMD[key] = encodeBinaryValues(values)
+	}
+
+	return nil
+}
+
+// encodeBinaryValues base64 encodes the given binary metadata values.
+func encodeBinaryValues(values []string) []string {
+	encoded := make([]string, len(values))
+	for i, value := range values {
+		encoded[i] = base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	return encoded
+}
@@ -0,0 +1,38 @@
+package aperture
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+
+	gateway "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+// TestEncodeBinaryMetadata makes sure binary metadata is base64 encoded in the
+// responses of the REST proxy while other metadata is left alone.
+func TestEncodeBinaryMetadata(t *testing.T) {
+	t.Parallel()
+
+	value := string([]byte{0x00, 0xff, '\r', '\n'})
+	md := gateway.ServerMetadata{
+		HeaderMD: metadata.Pairs(
+			"details-bin", value, "plain", "text",
+		),
+		TrailerMD: metadata.Pairs("trailer-bin", value),
+	}
+	ctx := gateway.NewServerMetadataContext(context.Background(), md)
+
+	rec := httptest.NewRecorder()
+	rec.Header().Add("Grpc-Metadata-details-bin", value)
+	rec.Header().Add("Grpc-Metadata-plain", "text")
+
+	require.NoError(t, encodeBinaryMetadata(ctx, rec, nil))
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(value))
+	require.Equal(t, encoded, rec.Header().Get("Grpc-Metadata-Details-Bin"))
+	require.Equal(t, "text", rec.Header().Get("Grpc-Metadata-Plain"))
+	require.Equal(t, []string{encoded}, md.TrailerMD["trailer-bin"])
+}
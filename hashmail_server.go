@@ -32,6 +32,10 @@ const (
 	// down if neither of its streams are occupied.
 	DefaultStaleTimeout = time.Hour
 
+	// DefaultMaxMsgSize is the default maximum size in bytes of the gRPC
+	// messages the mailbox server receives and sends.
+	DefaultMaxMsgSize = 4 * 1024 * 1024
+
 	// DefaultBufSize is the default number of bytes that are read in a
 	// single operation.
 	DefaultBufSize = 4096
@@ -381,12 +385,13 @@ func (h *hashMailServer) Stop() {
 	h.Lock()
 	defer h.Unlock()
 
-	for _, stream := range h.streams {
+	for id, stream := range h.streams {
 		if err := stream.tearDown(); err != nil {
 			log.Warnf("unable to tear down stream: %v", err)
 		}
+		delete(h.streams, id)
 	}
-
+	mailboxCount.Set(0)
 }
 
 // tearDownStaleStream can be used to tear down a stale mailbox stream.
@@ -505,3 +505,25 @@ func recvFromStream(client hashmailrpc.HashMailClient) error {
 
 	return nil
 }
+
+// TestHashMailMessageSizeLimits makes sure the gRPC message size limits of the
+// mailbox server default to 4MB and can't be negative.
+func TestHashMailMessageSizeLimits(t *testing.T) {
+	var nilCfg *HashMailConfig
+	require.Equal(t, DefaultMaxMsgSize, nilCfg.maxRecvMsgSize())
+	require.Equal(t, DefaultMaxMsgSize, nilCfg.maxSendMsgSize())
+	require.NoError(t, nilCfg.validate())
+
+	cfg := &HashMailConfig{}
+	require.Equal(t, 4*1024*1024, cfg.maxRecvMsgSize())
+	require.Equal(t, 4*1024*1024, cfg.maxSendMsgSize())
+
+	cfg.MaxGRPCMessageBytes = 1024
+	cfg.MaxSendMessageBytes = 2048
+	require.NoError(t, cfg.validate())
+	require.Equal(t, 1024, cfg.maxRecvMsgSize())
+	require.Equal(t, 2048, cfg.maxSendMsgSize())
+
+	cfg.MaxSendMessageBytes = -1
+	require.Error(t, cfg.validate())
+}
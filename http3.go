@@ -0,0 +1,216 @@
+package aperture
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// http3DrainPollInterval is the interval at which we check whether the
+	// HTTP/3 requests in flight completed when shutting down.
+	http3DrainPollInterval = 100 * time.Millisecond
+
+	// http3CloseDelay is the time we give the responses of the last
+	// requests to reach their clients before closing the connections when
+	// shutting down.
+	http3CloseDelay = 500 * time.Millisecond
+
+	// http3AltSvcMaxAge is the number of seconds clients may remember that
+	// we can be reached over HTTP/3.
+	http3AltSvcMaxAge = 24 * 60 * 60
+)
+
+// http3Server serves requests over HTTP/3 on a QUIC listener next to the TLS
+// listener, using the same handler and certificates.
+type http3Server struct {
+	addr      string
+	altSvc    string
+	server    *http3.Server
+	conn      net.PacketConn
+	transport *quic.Transport
+	listener  *quic.EarlyListener
+
+	// inFlight is the number of requests currently being served.
+	inFlight int64
+
+	connsMtx sync.Mutex
+	conns    map[quic.Connection]struct{}
+}
+
+// newHTTP3Server creates a QUIC listener on the UDP port of the given address
+// that serves the given handler over HTTP/3. Addresses with an empty or
+// unspecified IPv4 host are listened on through both IPv4 and IPv6, like the
+// TCP listener.
+func newHTTP3Server(addr string, tlsConfig *tls.Config,
+	handler http.Handler) (*http3Server, error) {
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %s: %v", addr,
+			err)
+	}
+
+	network := "udp"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		network = "udp6"
+	}
+
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s/udp: %v", addr,
+			err)
+	}
+
+	// We use our own transport so closing the listener only stops new
+	// connections from being accepted, while the open ones are kept until
+	// their requests completed.
+	transport := &quic.Transport{Conn: conn}
+	listener, err := transport.ListenEarly(
+		http3.ConfigureTLSConfig(tlsConfig), &quic.Config{},
+	)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("unable to listen for QUIC connections "+
+			"on %s: %v", addr, err)
+	}
+
+	_, port, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	s := &http3Server{
+		addr: addr,
+		altSvc: fmt.Sprintf(`h3=":%s"; ma=%d`, port,
+			http3AltSvcMaxAge),
+		conn:      conn,
+		transport: transport,
+		listener:  listener,
+		conns:     make(map[quic.Connection]struct{}),
+	}
+	s.server = &http3.Server{
+		Handler: http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt64(&s.inFlight, 1)
+				defer atomic.AddInt64(&s.inFlight, -1)
+
+				handler.ServeHTTP(w, r)
+
+				// Hand the whole response to the connection
+				// before the request is no longer counted.
+				if flusher, ok := w.(http.Flusher); ok {
+					flusher.Flush()
+				}
+			},
+		),
+	}
+
+	return s, nil
+}
+
+// serve accepts new connections and serves their requests until the server
+// is shut down.
+func (s *http3Server) serve() error {
+	for {
+		conn, err := s.listener.Accept(context.Background())
+		if err == quic.ErrServerClosed {
+			return http.ErrServerClosed
+		}
+		if err != nil {
+			return err
+		}
+
+		s.connsMtx.Lock()
+		s.conns[conn] = struct{}{}
+		s.connsMtx.Unlock()
+
+		go func() {
+			err := s.server.ServeQUICConn(conn)
+			if err != nil {
+				log.Debugf("Error serving HTTP/3 connection "+
+					"from %v: %v", conn.RemoteAddr(), err)
+			}
+
+			s.connsMtx.Lock()
+			delete(s.conns, conn)
+			s.connsMtx.Unlock()
+		}()
+	}
+}
+
+// advertise wraps the given handler so its responses carry an Alt-Svc header
+// that tells clients they can reach us over HTTP/3 as well.
+func (s *http3Server) advertise(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Alt-Svc", s.altSvc)
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// shutdown stops accepting new connections and waits for the requests in
+// flight to complete before closing the connections. If they don't complete
+// before the context is done, the connections are closed anyway, which
+// cancels the requests.
+func (s *http3Server) shutdown(ctx context.Context) error {
+	// Closing the listener makes serve return, but the connections stay
+	// open as long as the transport is.
+	err := s.listener.Close()
+
+	ticker := time.NewTicker(http3DrainPollInterval)
+	defer ticker.Stop()
+
+	drained := true
+	for atomic.LoadInt64(&s.inFlight) > 0 {
+		select {
+		case <-ticker.C:
+			continue
+
+		case <-ctx.Done():
+		}
+
+		log.Warnf("Timed out waiting for HTTP/3 requests to %s to "+
+			"complete, closing their connections", s.addr)
+		drained = false
+		break
+	}
+
+	// Closing a connection discards the data that wasn't acknowledged
+	// yet, so we give the last responses a moment to be delivered.
+	if drained {
+		select {
+		case <-time.After(http3CloseDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	// Tell the clients we're closing the connections, so they don't wait
+	// for them to time out.
+	s.connsMtx.Lock()
+	for conn := range s.conns {
+		_ = conn.CloseWithError(
+			quic.ApplicationErrorCode(http3.ErrCodeNoError),
+			"server shutting down",
+		)
+	}
+	s.connsMtx.Unlock()
+
+	if closeErr := s.transport.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := s.conn.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	return err
+}
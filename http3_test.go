@@ -0,0 +1,142 @@
+package aperture
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHTTP3Server makes sure requests are served over HTTP/3, that the QUIC
+// listener is advertised through the Alt-Svc header and that requests in
+// flight are completed when shutting down.
+func TestHTTP3Server(t *testing.T) {
+	certDir := t.TempDir()
+	genHostCert(t, certDir, "localhost")
+	certificate, err := tls.LoadX509KeyPair(
+		filepath.Join(certDir, "localhost", hostCertFilename),
+		filepath.Join(certDir, "localhost", hostKeyFilename),
+	)
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				close(started)
+				<-release
+			}
+			_, _ = w.Write([]byte(r.Proto))
+		},
+	)
+
+	s, err := newHTTP3Server("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+	}, handler)
+	require.NoError(t, err)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.serve()
+	}()
+
+	addr := s.listener.Addr().String()
+	client := &http.Client{
+		Transport: &http3.RoundTripper{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	get := func(path string) (string, error) {
+		resp, err := client.Get("https://" + addr + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	body, err := get("/")
+	require.NoError(t, err)
+	require.Equal(t, "HTTP/3.0", body)
+
+	// Responses of the TLS listener advertise the UDP port.
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	s.advertise(handler).ServeHTTP(
+		rec, httptest.NewRequest(http.MethodGet, "/", nil),
+	)
+	require.Equal(
+		t, `h3=":`+port+`"; ma=86400`, rec.Header().Get("Alt-Svc"),
+	)
+
+	// A request in flight completes before the server shuts down.
+	slowResult := make(chan string, 1)
+	go func() {
+		body, err := get("/slow")
+		if err != nil {
+			body = err.Error()
+		}
+		slowResult <- body
+	}()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.shutdown(context.Background())
+	}()
+	select {
+	case err := <-serveErr:
+		require.Equal(t, http.ErrServerClosed, err)
+	case <-time.After(defaultTimeout):
+		t.Fatal("server didn't stop accepting connections")
+	}
+	select {
+	case <-shutdownErr:
+		t.Fatal("shutdown didn't wait for the request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	require.Equal(t, "HTTP/3.0", <-slowResult)
+	require.NoError(t, <-shutdownErr)
+
+	// The connections are closed forcefully once the context is done.
+	s, err = newHTTP3Server("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+	}, handler)
+	require.NoError(t, err)
+	go func() {
+		_ = s.serve()
+	}()
+	addr = s.listener.Addr().String()
+
+	started = make(chan struct{})
+	release = make(chan struct{})
+	defer close(release)
+	go func() {
+		_, err := get("/slow")
+		slowResult <- err.Error()
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 100*time.Millisecond,
+	)
+	defer cancel()
+	require.NoError(t, s.shutdown(ctx))
+	require.NotEmpty(t, <-slowResult)
+}
@@ -0,0 +1,151 @@
+package aperture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// alertKeyInvoiceReconciliation is the deduplication key used for
+	// alerts about settled invoices that weren't recorded in etcd.
+	alertKeyInvoiceReconciliation = "aperture-invoice-reconciliation"
+
+	// reconciliationWindow is how far back we look for settled invoices
+	// that weren't recorded when reconciling on startup.
+	reconciliationWindow = 24 * time.Hour
+
+	// reconciliationTimeout is the maximum time the reconciliation on
+	// startup can take.
+	reconciliationTimeout = 5 * time.Minute
+)
+
+// ReconcileSettlements makes sure all invoices settled on the healthy lnd
+// nodes since the given time are recorded in the settlement store. The
+// payment hashes of the invoices that weren't recorded before are returned and
+// the settlement notifier is notified about them.
+func (l *LndChallenger) ReconcileSettlements(ctx context.Context,
+	since time.Time) ([]lntypes.Hash, error) {
+
+	if l.settlementStore == nil {
+		return nil, errors.New("settlements aren't recorded")
+	}
+
+	l.nodesMtx.Lock()
+	var clients []InvoiceClient
+	for _, node := range l.nodes {
+		if node.healthy {
+			clients = append(clients, node.client)
+		}
+	}
+	l.nodesMtx.Unlock()
+
+	var missing []lntypes.Hash
+	for _, client := range clients {
+		invoiceResp, err := client.ListInvoices(
+			ctx, &lnrpc.ListInvoiceRequest{
+				NumMaxInvoices: math.MaxUint64,
+			},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list invoices: %v",
+				err)
+		}
+
+		var settled []*lnrpc.Invoice
+		for _, invoice := range invoiceResp.Invoices {
+			settleDate := time.Unix(invoice.SettleDate, 0)
+			if invoice.State != lnrpc.Invoice_SETTLED ||
+				settleDate.Before(since) {
+
+				continue
+			}
+			settled = append(settled, invoice)
+		}
+
+		// Invoices settled with an unexpected pre-image were never
+		// regarded as settled.
+		mismatches := l.preimageMismatches(settled)
+
+		for _, invoice := range settled {
+			hash, err := lntypes.MakeHash(invoice.RHash)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing invoice "+
+					"hash: %v", err)
+			}
+			if _, ok := mismatches[hash]; ok {
+				continue
+			}
+
+			settleDate := time.Unix(invoice.SettleDate, 0)
+
+			added, err := l.settlementStore.MarkSettled(
+				ctx, hash, settleDate,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("unable to record "+
+					"settlement of invoice %v: %v", hash,
+					err)
+			}
+			if added {
+				missing = append(missing, hash)
+				l.notifySettled(hash, invoice)
+			}
+		}
+	}
+
+	return missing, nil
+}
+
+// reconcileSettlements records the invoices settled in lnd within the
+// reconciliation window that weren't recorded in etcd, for example because
+// aperture shut down uncleanly right after they were settled. Every
+// discrepancy is logged and, if configured, an alert is triggered.
+func (a *Aperture) reconcileSettlements() {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), reconciliationTimeout,
+	)
+	defer cancel()
+
+	// Don't hold up the shutdown if it happens while we're still busy.
+	go func() {
+		select {
+		case <-a.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	missing, err := a.challenger.ReconcileSettlements(
+		ctx, time.Now().Add(-reconciliationWindow),
+	)
+	if err != nil {
+		log.Errorf("Unable to reconcile settled invoices: %v", err)
+		return
+	}
+
+	if len(missing) == 0 {
+		log.Infof("All invoices settled in the last %v are recorded",
+			reconciliationWindow)
+		return
+	}
+
+	for _, hash := range missing {
+		log.Warnf("Invoice %v was settled in lnd but not recorded in "+
+			"etcd, recorded it now", hash)
+	}
+
+	if a.cfg.Authenticator.ReconciliationAlert {
+		a.triggerAlert(&alert{
+			key: alertKeyInvoiceReconciliation,
+			summary: fmt.Sprintf("%d invoices settled in lnd "+
+				"weren't recorded in etcd", len(missing)),
+			severity: severityWarning,
+		})
+	}
+}
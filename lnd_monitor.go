@@ -0,0 +1,292 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/wtclientrpc"
+	"google.golang.org/grpc"
+)
+
+const (
+	// readonlyMacaroonName is the name of the read-only macaroon belonging
+	// to the target lnd node. The invoice macaroon isn't allowed to query
+	// any information about channels.
+	readonlyMacaroonName = "readonly.macaroon"
+
+	// defaultCapacityCheckInterval is the default interval at which we
+	// query lnd for the capacity of its channels.
+	defaultCapacityCheckInterval = 5 * time.Minute
+
+	// alertKeyLndCapacity is the deduplication key used for alerts about
+	// the lnd node running low on capacity to receive payments.
+	alertKeyLndCapacity = "aperture-lnd-capacity"
+
+	// lndRPCTimeout is the maximum time we wait for a single monitoring
+	// call to lnd to complete.
+	lndRPCTimeout = 30 * time.Second
+)
+
+// ChannelClient is an interface that only implements part of a full lnd
+// client, namely the part we need to monitor the node's channels.
+type ChannelClient interface {
+	// ListChannels returns a description of all the open channels of the
+	// node.
+	ListChannels(ctx context.Context, in *lnrpc.ListChannelsRequest,
+		opts ...grpc.CallOption) (*lnrpc.ListChannelsResponse, error)
+}
+
+// lndMonitorClient is the part of a full lnd client the monitor needs.
+type lndMonitorClient interface {
+	ChannelClient
+	InfoClient
+}
+
+// lndMonitor periodically queries the lnd node backing the challenger for the
+// state of its channels and alerts the operator if the node is about to become
+// unable to receive payments or if its channel states aren't backed up to
+// enough watchtowers. It also exports general information about the node as
+// Prometheus metrics.
+type lndMonitor struct {
+	client lndMonitorClient
+	towers WatchtowerClient
+
+	minCapacity           int64
+	minWatchtowerSessions int
+	checkInterval         time.Duration
+
+	// metricsInterval is the interval at which the node's metrics are
+	// updated. Metrics are disabled if this is zero.
+	metricsInterval time.Duration
+
+	// lowCapacity is true if the last check found the capacity to be below
+	// the configured minimum. It is used to only trigger an alert once
+	// and to resolve it again once the capacity recovers.
+	lowCapacity bool
+
+	// watchtowersUnhealthy is true if the last check found too few active
+	// watchtower sessions or stale backups.
+	watchtowersUnhealthy bool
+
+	// lastTowerStats are the watchtower statistics of the last check.
+	lastTowerStats *wtclientrpc.StatsResponse
+
+	triggerAlert func(*alert)
+	resolveAlert func(string)
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newLndMonitor creates a new monitor for the lnd node described by the given
+// config. The read-only macaroon is used to connect to the node.
+func newLndMonitor(cfg *AuthConfig, metricsInterval time.Duration,
+	triggerAlert func(*alert),
+	resolveAlert func(string)) (*lndMonitor, error) {
+
+	conn, err := lndclient.NewBasicConn(
+		cfg.LndHost, cfg.TLSPath, cfg.MacDir, cfg.Network,
+		lndclient.MacFilename(readonlyMacaroonName),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	towers := wtclientrpc.NewWatchtowerClientClient(conn)
+
+	checkInterval := cfg.CapacityCheckInterval
+	if checkInterval == 0 {
+		checkInterval = defaultCapacityCheckInterval
+	}
+
+	return &lndMonitor{
+		client:                lnrpc.NewLightningClient(conn),
+		towers:                towers,
+		minCapacity:           cfg.MinOutboundCapacitySat,
+		minWatchtowerSessions: cfg.MinWatchtowerSessions,
+		checkInterval:         checkInterval,
+		metricsInterval:       metricsInterval,
+		triggerAlert:          triggerAlert,
+		resolveAlert:          resolveAlert,
+		quit:                  make(chan struct{}),
+	}, nil
+}
+
+// Start starts the goroutines that periodically check the channel capacity and
+// the watchtower sessions and update the node's metrics, if enabled.
+func (m *lndMonitor) Start() error {
+	if m.minCapacity > 0 {
+		log.Infof("Starting lnd capacity monitor, alerting if remote "+
+			"balance drops below %d sat", m.minCapacity)
+
+		m.wg.Add(1)
+		go m.monitorCapacity()
+	}
+
+	if m.minWatchtowerSessions > 0 {
+		log.Infof("Starting lnd watchtower monitor, alerting if there "+
+			"are less than %d active sessions",
+			m.minWatchtowerSessions)
+
+		m.wg.Add(1)
+		go m.monitorWatchtowers()
+	}
+
+	if m.metricsInterval > 0 {
+		log.Infof("Exporting lnd metrics every %v", m.metricsInterval)
+
+		m.wg.Add(1)
+		go m.monitorMetrics()
+	}
+
+	return nil
+}
+
+// Stop shuts down the monitor.
+func (m *lndMonitor) Stop() {
+	close(m.quit)
+	m.wg.Wait()
+}
+
+// monitorCapacity checks the capacity once on startup and then again every
+// time the check interval elapses.
+//
+// NOTE: This must be run as a goroutine.
+func (m *lndMonitor) monitorCapacity() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.checkCapacity(); err != nil {
+			log.Errorf("Unable to check lnd channel capacity: %v",
+				err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// checkCapacity queries lnd for all active channels and compares their total
+// remote balance to the configured minimum. The remote balance is what limits
+// the amount that can still be paid to the node, so if it runs out, newly
+// created invoices can't be paid anymore.
+func (m *lndMonitor) checkCapacity() error {
+	ctx, cancel := context.WithTimeout(context.Background(), lndRPCTimeout)
+	defer cancel()
+
+	resp, err := m.client.ListChannels(ctx, &lnrpc.ListChannelsRequest{
+		ActiveOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	var remoteBalance int64
+	for _, channel := range resp.Channels {
+		remoteBalance += channel.RemoteBalance
+	}
+	lndRemoteBalance.Set(float64(remoteBalance))
+
+	if remoteBalance >= m.minCapacity {
+		if m.lowCapacity {
+			log.Infof("lnd remote balance of %d sat is above the "+
+				"minimum of %d sat again", remoteBalance,
+				m.minCapacity)
+
+			m.lowCapacity = false
+			m.resolveAlert(alertKeyLndCapacity)
+		}
+
+		return nil
+	}
+
+	log.Warnf("lnd remote balance of %d sat across %d active channels "+
+		"is below the minimum of %d sat, payments for new invoices "+
+		"might fail", remoteBalance, len(resp.Channels),
+		m.minCapacity)
+	lndLowCapacityCount.Inc()
+
+	if !m.lowCapacity {
+		m.lowCapacity = true
+		m.triggerAlert(&alert{
+			key: alertKeyLndCapacity,
+			summary: fmt.Sprintf("lnd remote balance of %d sat is "+
+				"below the minimum of %d sat", remoteBalance,
+				m.minCapacity),
+			severity: severityWarning,
+		})
+	}
+
+	return nil
+}
+
+// monitorMetrics updates the node's metrics once on startup and then again
+// every time the metrics interval elapses.
+//
+// NOTE: This must be run as a goroutine.
+func (m *lndMonitor) monitorMetrics() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.metricsInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.updateMetrics(); err != nil {
+			log.Errorf("Unable to update lnd metrics: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// updateMetrics queries lnd for its general information and channels and
+// updates the Prometheus gauges labeled with the node's public key.
+func (m *lndMonitor) updateMetrics() error {
+	ctx, cancel := context.WithTimeout(context.Background(), lndRPCTimeout)
+	defer cancel()
+
+	info, err := m.client.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return err
+	}
+
+	resp, err := m.client.ListChannels(ctx, &lnrpc.ListChannelsRequest{})
+	if err != nil {
+		return err
+	}
+
+	var totalCapacity int64
+	for _, channel := range resp.Channels {
+		totalCapacity += channel.Capacity
+	}
+
+	syncedToChain := 0.0
+	if info.SyncedToChain {
+		syncedToChain = 1
+	}
+
+	pubKey := info.IdentityPubkey
+	lndActiveChannels.WithLabelValues(pubKey).Set(
+		float64(info.NumActiveChannels),
+	)
+	lndActivePeers.WithLabelValues(pubKey).Set(float64(info.NumPeers))
+	lndTotalCapacity.WithLabelValues(pubKey).Set(float64(totalCapacity))
+	lndSyncedToChain.WithLabelValues(pubKey).Set(syncedToChain)
+	lndBlockHeight.WithLabelValues(pubKey).Set(float64(info.BlockHeight))
+
+	return nil
+}
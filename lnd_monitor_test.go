@@ -0,0 +1,201 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/wtclientrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+type mockChannelClient struct {
+	channels []*lnrpc.Channel
+	info     *lnrpc.GetInfoResponse
+}
+
+func (m *mockChannelClient) GetInfo(context.Context, *lnrpc.GetInfoRequest,
+	...grpc.CallOption) (*lnrpc.GetInfoResponse, error) {
+
+	return m.info, nil
+}
+
+func (m *mockChannelClient) ListChannels(context.Context,
+	*lnrpc.ListChannelsRequest, ...grpc.CallOption) (
+	*lnrpc.ListChannelsResponse, error) {
+
+	return &lnrpc.ListChannelsResponse{Channels: m.channels}, nil
+}
+
+// TestLndMonitorCapacity makes sure an alert is triggered once the remote
+// balance drops below the minimum and resolved once it recovers.
+func TestLndMonitorCapacity(t *testing.T) {
+	var (
+		client    = &mockChannelClient{}
+		triggered []*alert
+		resolved  []string
+	)
+	monitor := &lndMonitor{
+		client:      client,
+		minCapacity: 1000,
+		triggerAlert: func(al *alert) {
+			triggered = append(triggered, al)
+		},
+		resolveAlert: func(key string) {
+			resolved = append(resolved, key)
+		},
+	}
+
+	// With enough remote balance across all channels, nothing should
+	// happen.
+	client.channels = []*lnrpc.Channel{
+		{RemoteBalance: 600},
+		{RemoteBalance: 400},
+	}
+	require.NoError(t, monitor.checkCapacity())
+	require.Empty(t, triggered)
+	require.Empty(t, resolved)
+
+	// Dropping below the minimum should trigger a single alert, no matter
+	// how many times we check.
+	client.channels = []*lnrpc.Channel{{RemoteBalance: 999}}
+	require.NoError(t, monitor.checkCapacity())
+	require.NoError(t, monitor.checkCapacity())
+	require.Len(t, triggered, 1)
+	require.Equal(t, alertKeyLndCapacity, triggered[0].key)
+	require.Equal(t, severityWarning, triggered[0].severity)
+	require.Empty(t, resolved)
+
+	// Once the balance recovers, the alert should be resolved.
+	client.channels = []*lnrpc.Channel{{RemoteBalance: 1000}}
+	require.NoError(t, monitor.checkCapacity())
+	require.Len(t, triggered, 1)
+	require.Equal(t, []string{alertKeyLndCapacity}, resolved)
+}
+
+type mockWatchtowerClient struct {
+	towers []*wtclientrpc.Tower
+	stats  *wtclientrpc.StatsResponse
+}
+
+func (m *mockWatchtowerClient) ListTowers(context.Context,
+	*wtclientrpc.ListTowersRequest, ...grpc.CallOption) (
+	*wtclientrpc.ListTowersResponse, error) {
+
+	return &wtclientrpc.ListTowersResponse{Towers: m.towers}, nil
+}
+
+func (m *mockWatchtowerClient) Stats(context.Context,
+	*wtclientrpc.StatsRequest, ...grpc.CallOption) (
+	*wtclientrpc.StatsResponse, error) {
+
+	return m.stats, nil
+}
+
+// TestLndMonitorWatchtowers makes sure an alert is triggered if there are too
+// few active watchtower sessions or backups aren't acknowledged and resolved
+// once that recovers.
+func TestLndMonitorWatchtowers(t *testing.T) {
+	var (
+		towers = &mockWatchtowerClient{
+			stats: &wtclientrpc.StatsResponse{},
+		}
+		triggered []*alert
+		resolved  []string
+	)
+	monitor := &lndMonitor{
+		towers:                towers,
+		minWatchtowerSessions: 2,
+		triggerAlert: func(al *alert) {
+			triggered = append(triggered, al)
+		},
+		resolveAlert: func(key string) {
+			resolved = append(resolved, key)
+		},
+	}
+
+	// Exhausted sessions and those of towers that aren't used for new
+	// backups don't count.
+	towers.towers = []*wtclientrpc.Tower{{
+		ActiveSessionCandidate: true,
+		Sessions: []*wtclientrpc.TowerSession{
+			{NumBackups: 10, MaxBackups: 1024},
+			{NumBackups: 1000, NumPendingBackups: 24,
+				MaxBackups: 1024},
+		},
+	}, {
+		ActiveSessionCandidate: false,
+		Sessions: []*wtclientrpc.TowerSession{
+			{MaxBackups: 1024},
+		},
+	}}
+	require.NoError(t, monitor.checkWatchtowers())
+	require.NoError(t, monitor.checkWatchtowers())
+	require.Equal(t, 1.0, testutil.ToFloat64(lndWatchtowerSessions))
+	require.Len(t, triggered, 1)
+	require.Equal(t, alertKeyLndWatchtower, triggered[0].key)
+	require.Empty(t, resolved)
+
+	// Once there are enough active sessions, the alert is resolved.
+	towers.towers = append(towers.towers, &wtclientrpc.Tower{
+		ActiveSessionCandidate: true,
+		Sessions: []*wtclientrpc.TowerSession{
+			{MaxBackups: 1024},
+		},
+	})
+	towers.stats = &wtclientrpc.StatsResponse{
+		NumBackups:        10,
+		NumPendingBackups: 1,
+	}
+	require.NoError(t, monitor.checkWatchtowers())
+	require.Len(t, triggered, 1)
+	require.Equal(t, []string{alertKeyLndWatchtower}, resolved)
+
+	// Backups that stay pending without any being acknowledged are stale.
+	require.NoError(t, monitor.checkWatchtowers())
+	require.Len(t, triggered, 2)
+	require.Equal(
+		t, 1.0, testutil.ToFloat64(lndWatchtowerPendingBackups),
+	)
+
+	towers.stats = &wtclientrpc.StatsResponse{
+		NumBackups:        11,
+		NumPendingBackups: 1,
+	}
+	require.NoError(t, monitor.checkWatchtowers())
+	require.Len(t, resolved, 2)
+}
+
+// TestLndMonitorMetrics makes sure the node's metrics are labeled with its
+// public key.
+func TestLndMonitorMetrics(t *testing.T) {
+	client := &mockChannelClient{
+		channels: []*lnrpc.Channel{
+			{Capacity: 100000},
+			{Capacity: 250000},
+		},
+		info: &lnrpc.GetInfoResponse{
+			IdentityPubkey:    "02abcd",
+			NumActiveChannels: 2,
+			NumPeers:          3,
+			SyncedToChain:     true,
+			BlockHeight:       700000,
+		},
+	}
+	monitor := &lndMonitor{
+		client: client,
+	}
+	require.NoError(t, monitor.updateMetrics())
+
+	gaugeValue := func(g *prometheus.GaugeVec) float64 {
+		return testutil.ToFloat64(g.WithLabelValues("02abcd"))
+	}
+	require.Equal(t, 2.0, gaugeValue(lndActiveChannels))
+	require.Equal(t, 3.0, gaugeValue(lndActivePeers))
+	require.Equal(t, 350000.0, gaugeValue(lndTotalCapacity))
+	require.Equal(t, 1.0, gaugeValue(lndSyncedToChain))
+	require.Equal(t, 700000.0, gaugeValue(lndBlockHeight))
+}
@@ -0,0 +1,124 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+)
+
+const (
+	// lndUpgradeURL points to the instructions on how to upgrade lnd.
+	lndUpgradeURL = "https://github.com/lightningnetwork/lnd/blob/master/" +
+		"docs/INSTALL.md"
+)
+
+var (
+	// minLndVersion is the oldest lnd version aperture is able to work
+	// with at all. Older versions lack RPCs we rely on.
+	minLndVersion = lndVersion{major: 0, minor: 11, patch: 0}
+
+	// recommendedLndVersion is the oldest lnd version aperture is tested
+	// with. Older versions should work but might show unexpected
+	// behavior.
+	recommendedLndVersion = lndVersion{major: 0, minor: 14, patch: 0}
+
+	// lndVersionRegex matches the semantic version at the start of the
+	// version string lnd reports, for example "0.14.2-beta commit=...".
+	lndVersionRegex = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)`)
+)
+
+// InfoClient is an interface that only implements part of a full lnd client,
+// namely the part we need to query the node's basic information.
+type InfoClient interface {
+	// GetInfo returns general information concerning the lightning node.
+	GetInfo(ctx context.Context, in *lnrpc.GetInfoRequest,
+		opts ...grpc.CallOption) (*lnrpc.GetInfoResponse, error)
+}
+
+// lndVersion is the semantic version of an lnd node.
+type lndVersion struct {
+	major uint32
+	minor uint32
+	patch uint32
+}
+
+// String returns the version in its usual dotted notation.
+func (v lndVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+// less returns true if the version is older than the given one.
+func (v lndVersion) less(other lndVersion) bool {
+	if v.major != other.major {
+		return v.major < other.major
+	}
+	if v.minor != other.minor {
+		return v.minor < other.minor
+	}
+
+	return v.patch < other.patch
+}
+
+// parseLndVersion parses the version string returned by lnd's GetInfo call.
+func parseLndVersion(version string) (lndVersion, error) {
+	matches := lndVersionRegex.FindStringSubmatch(version)
+	if matches == nil {
+		return lndVersion{}, fmt.Errorf("invalid lnd version %q",
+			version)
+	}
+
+	var parts [3]uint32
+	for i := range parts {
+		part, err := strconv.ParseUint(matches[i+1], 10, 32)
+		if err != nil {
+			return lndVersion{}, fmt.Errorf("invalid lnd version "+
+				"%q: %v", version, err)
+		}
+		parts[i] = uint32(part)
+	}
+
+	return lndVersion{
+		major: parts[0],
+		minor: parts[1],
+		patch: parts[2],
+	}, nil
+}
+
+// queryLndVersion queries the version of the lnd node behind the given client.
+func queryLndVersion(ctx context.Context, client InfoClient) (lndVersion,
+	error) {
+
+	info, err := client.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return lndVersion{}, err
+	}
+
+	return parseLndVersion(info.Version)
+}
+
+// checkLndVersion makes sure the given version of the lnd node with the given
+// host is supported. If it is older than the recommended version, a warning is
+// logged. If it is older than the minimum version, an error is returned.
+func checkLndVersion(host string, version lndVersion) error {
+	switch {
+	case version.less(minLndVersion):
+		return fmt.Errorf("lnd %s runs version %s but at least "+
+			"version %s is required, please upgrade lnd, see %s",
+			host, version, minLndVersion, lndUpgradeURL)
+
+	case version.less(recommendedLndVersion):
+		log.Warnf("!!! lnd %s runs version %s which is older than "+
+			"the recommended version %s, some features might not "+
+			"work as expected. Please upgrade lnd, see %s", host,
+			version, recommendedLndVersion, lndUpgradeURL)
+
+	default:
+		log.Infof("lnd %s runs version %s", host, version)
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package aperture
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLndVersion makes sure lnd version strings are parsed and checked
+// correctly.
+func TestLndVersion(t *testing.T) {
+	testCases := []struct {
+		version  string
+		expected lndVersion
+		parseErr bool
+		tooOld   bool
+	}{{
+		version:  "0.14.2-beta commit=v0.14.2-beta",
+		expected: lndVersion{major: 0, minor: 14, patch: 2},
+	}, {
+		version:  "v0.15.0-beta.rc1",
+		expected: lndVersion{major: 0, minor: 15, patch: 0},
+	}, {
+		version:  "0.13.4-beta",
+		expected: lndVersion{major: 0, minor: 13, patch: 4},
+	}, {
+		version:  "0.10.4-beta",
+		expected: lndVersion{major: 0, minor: 10, patch: 4},
+		tooOld:   true,
+	}, {
+		version:  "1.0.0",
+		expected: lndVersion{major: 1, minor: 0, patch: 0},
+	}, {
+		version:  "beta",
+		parseErr: true,
+	}, {
+		version:  "0.14",
+		parseErr: true,
+	}}
+
+	for _, tc := range testCases {
+		version, err := parseLndVersion(tc.version)
+		if tc.parseErr {
+			require.Error(t, err, tc.version)
+			continue
+		}
+		require.NoError(t, err, tc.version)
+		require.Equal(t, tc.expected, version)
+
+		err = checkLndVersion("localhost", version)
+		if tc.tooOld {
+			require.Error(t, err, tc.version)
+		} else {
+			require.NoError(t, err, tc.version)
+		}
+	}
+}
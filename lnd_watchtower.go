@@ -0,0 +1,155 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc/wtclientrpc"
+	"google.golang.org/grpc"
+)
+
+const (
+	// alertKeyLndWatchtower is the deduplication key used for alerts about
+	// the channel states of the lnd node not being backed up to enough
+	// watchtowers.
+	alertKeyLndWatchtower = "aperture-lnd-watchtower"
+)
+
+// WatchtowerClient is an interface that only implements part of a full lnd
+// watchtower client, namely the part we need to monitor the node's watchtower
+// sessions.
+type WatchtowerClient interface {
+	// ListTowers returns the watchtowers the node backs up its channel
+	// states to.
+	ListTowers(ctx context.Context, in *wtclientrpc.ListTowersRequest,
+		opts ...grpc.CallOption) (*wtclientrpc.ListTowersResponse,
+		error)
+
+	// Stats returns the statistics of the node's backups to all of its
+	// watchtowers.
+	Stats(ctx context.Context, in *wtclientrpc.StatsRequest,
+		opts ...grpc.CallOption) (*wtclientrpc.StatsResponse, error)
+}
+
+// activeWatchtowerSessions returns the number of sessions the node can still
+// back up channel states with. Those are the sessions of towers that are used
+// for new backups and that aren't exhausted yet.
+func activeWatchtowerSessions(ctx context.Context,
+	client WatchtowerClient) (int, error) {
+
+	resp, err := client.ListTowers(ctx, &wtclientrpc.ListTowersRequest{
+		IncludeSessions: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var active int
+	for _, tower := range resp.Towers {
+		if !tower.ActiveSessionCandidate {
+			continue
+		}
+
+		for _, session := range tower.Sessions {
+			used := session.NumBackups + session.NumPendingBackups
+			if used < session.MaxBackups {
+				active++
+			}
+		}
+	}
+
+	return active, nil
+}
+
+// monitorWatchtowers checks the watchtower sessions once on startup and then
+// again every time the check interval elapses.
+//
+// NOTE: This must be run as a goroutine.
+func (m *lndMonitor) monitorWatchtowers() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.checkWatchtowers(); err != nil {
+			log.Errorf("Unable to check lnd watchtower sessions: "+
+				"%v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// checkWatchtowers queries lnd for its active watchtower sessions and the
+// statistics of its backups. If there are fewer active sessions than the
+// configured minimum or backups that were pending during the last check still
+// haven't been acknowledged by any tower, channel states might not be
+// protected while the node is offline.
+func (m *lndMonitor) checkWatchtowers() error {
+	ctx, cancel := context.WithTimeout(context.Background(), lndRPCTimeout)
+	defer cancel()
+
+	active, err := activeWatchtowerSessions(ctx, m.towers)
+	if err != nil {
+		return err
+	}
+	stats, err := m.towers.Stats(ctx, &wtclientrpc.StatsRequest{})
+	if err != nil {
+		return err
+	}
+	lndWatchtowerSessions.Set(float64(active))
+	lndWatchtowerPendingBackups.Set(float64(stats.NumPendingBackups))
+
+	// Backups are stale if they were already pending during the last
+	// check and not a single one was acknowledged since.
+	prev := m.lastTowerStats
+	m.lastTowerStats = stats
+	stale := prev != nil && prev.NumPendingBackups > 0 &&
+		stats.NumPendingBackups > 0 &&
+		stats.NumBackups == prev.NumBackups
+
+	var problem string
+	switch {
+	case active < m.minWatchtowerSessions:
+		problem = fmt.Sprintf("lnd has %d active watchtower sessions, "+
+			"less than the minimum of %d", active,
+			m.minWatchtowerSessions)
+
+	case stale:
+		problem = fmt.Sprintf("lnd has %d channel state backups that "+
+			"no watchtower acknowledged within %v",
+			stats.NumPendingBackups, m.checkInterval)
+	}
+
+	if problem == "" {
+		if m.watchtowersUnhealthy {
+			log.Infof("lnd has %d active watchtower sessions and "+
+				"its backups are acknowledged again", active)
+
+			m.watchtowersUnhealthy = false
+			m.resolveAlert(alertKeyLndWatchtower)
+		}
+
+		return nil
+	}
+
+	log.Warnf("%s, channel states might not be protected while lnd is "+
+		"offline", problem)
+
+	if !m.watchtowersUnhealthy {
+		m.watchtowersUnhealthy = true
+		m.triggerAlert(&alert{
+			key:      alertKeyLndWatchtower,
+			summary:  problem,
+			severity: severityWarning,
+		})
+	}
+
+	return nil
+}
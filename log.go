@@ -16,20 +16,51 @@ const Subsystem = "APER"
 var (
 	logWriter = build.NewRotatingLogWriter()
 	log       = build.NewSubLogger(Subsystem, nil)
+
+	// jsonLogs writes the log lines of all subsystems if the JSON log
+	// format is used.
+	jsonLogs = newJSONLogWriter()
 )
 
 // SetupLoggers initializes all package-global logger variables.
 func SetupLoggers(root *build.RotatingLogWriter, intercept signal.Interceptor) {
-	genLogger := genSubLogger(root, intercept)
+	setupLoggers(root, genSubLogger(root, intercept))
+}
+
+// setupJSONLoggers initializes all package-global logger variables with
+// loggers that write JSON lines. The loggers are still registered with the
+// root log writer, so their levels can be set like the ones of text loggers.
+func setupJSONLoggers(root *build.RotatingLogWriter,
+	intercept signal.Interceptor) {
+
+	setupLoggers(root, jsonLogs.genSubLogger(intercept))
+}
+
+// setupLoggers creates the loggers of all subsystems with the given function
+// and registers them with the root log writer.
+func setupLoggers(root *build.RotatingLogWriter,
+	genLogger func(string) btclog.Logger) {
 
 	logWriter = root
 	log = build.NewSubLogger(Subsystem, genLogger)
 
 	lnd.SetSubLogger(root, Subsystem, log)
-	lnd.AddSubLogger(root, auth.Subsystem, intercept, auth.UseLogger)
-	lnd.AddSubLogger(root, lsat.Subsystem, intercept, lsat.UseLogger)
-	lnd.AddSubLogger(root, proxy.Subsystem, intercept, proxy.UseLogger)
-	lnd.AddSubLogger(root, "LNDC", intercept, lndclient.UseLogger)
+	subLoggers := []struct {
+		subsystem string
+		useLogger func(btclog.Logger)
+	}{
+		{auth.Subsystem, auth.UseLogger},
+		{lsat.Subsystem, lsat.UseLogger},
+		{proxy.Subsystem, proxy.UseLogger},
+		{"LNDC", lndclient.UseLogger},
+	}
+	for _, sub := range subLoggers {
+		lnd.SetSubLogger(
+			root, sub.subsystem,
+			build.NewSubLogger(sub.subsystem, genLogger),
+			sub.useLogger,
+		)
+	}
 }
 
 // genSubLogger creates a logger for a subsystem. We provide an instance of
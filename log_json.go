@@ -0,0 +1,346 @@
+package aperture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btclog"
+	"github.com/jrick/logrotate/rotator"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/build"
+	"github.com/lightningnetwork/lnd/signal"
+)
+
+const (
+	// logFormatText is the log format of lnd and the other Lightning Labs
+	// daemons, one line of text per entry.
+	logFormatText = "text"
+
+	// logFormatJSON writes every log entry as a JSON object on a line of
+	// its own, which log aggregators can ingest without parsing the text.
+	logFormatJSON = "json"
+)
+
+// jsonLogWriter writes JSON log lines to stdout and the log file, which it
+// rotates like the text log writer.
+type jsonLogWriter struct {
+	// mtx makes sure the lines of concurrent loggers aren't interleaved.
+	mtx    sync.Mutex
+	writer io.Writer
+
+	logWriter  *build.LogWriter
+	logRotator *rotator.Rotator
+}
+
+// newJSONLogWriter creates a new JSON log writer. Until initLogRotator is
+// called, it only writes to stdout.
+func newJSONLogWriter() *jsonLogWriter {
+	logWriter := &build.LogWriter{}
+	return &jsonLogWriter{
+		writer:    logWriter,
+		logWriter: logWriter,
+	}
+}
+
+// initLogRotator starts writing the log lines to the given file, which is
+// rotated once it reaches the given size in KB.
+func (w *jsonLogWriter) initLogRotator(logFile string, maxLogFileSize,
+	maxLogFiles int) error {
+
+	logDir, _ := filepath.Split(logFile)
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		return fmt.Errorf("failed to create log directory: %v", err)
+	}
+
+	var err error
+	w.logRotator, err = rotator.New(
+		logFile, int64(maxLogFileSize*1024), false, maxLogFiles,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create file rotator: %v", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		if err := w.logRotator.Run(pr); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "failed to run file "+
+				"rotator: %v\n", err)
+		}
+	}()
+
+	w.mtx.Lock()
+	w.logWriter.RotatorPipe = pw
+	w.mtx.Unlock()
+
+	return nil
+}
+
+// Close closes the log rotator if it was started.
+func (w *jsonLogWriter) Close() error {
+	if w.logRotator != nil {
+		return w.logRotator.Close()
+	}
+	return nil
+}
+
+// write writes a single log line.
+func (w *jsonLogWriter) write(line []byte) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	_, _ = w.writer.Write(line)
+}
+
+// genSubLogger returns a function that creates the JSON logger of a subsystem.
+// Critical errors request a shutdown from the given interceptor.
+func (w *jsonLogWriter) genSubLogger(
+	interceptor signal.Interceptor) func(string) btclog.Logger {
+
+	shutdown := func() {
+		if !interceptor.Listening() {
+			return
+		}
+
+		interceptor.RequestShutdown()
+	}
+
+	return func(tag string) btclog.Logger {
+		return &jsonLogger{
+			writer:    w,
+			subsystem: tag,
+			level:     new(uint32),
+			shutdown:  shutdown,
+			now:       time.Now,
+		}
+	}
+}
+
+// jsonLogger is a logger that writes every entry as a JSON object with the
+// time, level, subsystem and message, plus the structured fields attached to
+// the logger, like the service and request ID of request logs.
+type jsonLogger struct {
+	writer    *jsonLogWriter
+	subsystem string
+
+	// fields are the additional key-value pairs of every entry, sorted by
+	// key.
+	fields [][2]string
+
+	// level is shared by the logger of the subsystem and the ones derived
+	// from it with WithField, so they all follow level changes.
+	level *uint32
+
+	shutdown func()
+
+	// now returns the current time. It can be replaced in tests.
+	now func() time.Time
+}
+
+// A compile-time constraint to ensure jsonLogger implements proxy.FieldLogger.
+var _ proxy.FieldLogger = (*jsonLogger)(nil)
+
+// jsonLevels are the names of the log levels in JSON entries.
+var jsonLevels = map[btclog.Level]string{
+	btclog.LevelTrace:    "trace",
+	btclog.LevelDebug:    "debug",
+	btclog.LevelInfo:     "info",
+	btclog.LevelWarn:     "warn",
+	btclog.LevelError:    "error",
+	btclog.LevelCritical: "critical",
+}
+
+// WithField returns a logger that attaches the given field to every entry it
+// logs, in addition to the fields of this logger.
+//
+// NOTE: This is part of the proxy.FieldLogger interface.
+func (l *jsonLogger) WithField(key, value string) proxy.FieldLogger {
+	fields := make([][2]string, 0, len(l.fields)+1)
+	for _, field := range l.fields {
+		if field[0] != key {
+			fields = append(fields, field)
+		}
+	}
+	fields = append(fields, [2]string{key, value})
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i][0] < fields[j][0]
+	})
+
+	derived := *l
+	derived.fields = fields
+	return &derived
+}
+
+// log writes an entry with the given message if the level is enabled.
+func (l *jsonLogger) log(level btclog.Level, msg string) {
+	if level < l.Level() {
+		return
+	}
+
+	var buf bytes.Buffer
+	writeField := func(key, value string) {
+		if buf.Len() == 0 {
+			buf.WriteByte('{')
+		} else {
+			buf.WriteByte(',')
+		}
+
+		// Marshaling a string can't fail.
+		encodedKey, _ := json.Marshal(key)
+		encodedValue, _ := json.Marshal(value)
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		buf.Write(encodedValue)
+	}
+
+	writeField("time", l.now().UTC().Format(time.RFC3339Nano))
+	writeField("level", jsonLevels[level])
+	writeField("subsystem", l.subsystem)
+	writeField("msg", msg)
+	for _, field := range l.fields {
+		writeField(field[0], field[1])
+	}
+	buf.WriteString("}\n")
+
+	l.writer.write(buf.Bytes())
+}
+
+// logf formats the message according to the format specifier and logs it.
+func (l *jsonLogger) logf(level btclog.Level, format string,
+	params ...interface{}) {
+
+	if level < l.Level() {
+		return
+	}
+	l.log(level, fmt.Sprintf(format, params...))
+}
+
+// logln formats the message like the text logger and logs it.
+func (l *jsonLogger) logln(level btclog.Level, v ...interface{}) {
+	if level < l.Level() {
+		return
+	}
+	l.log(level, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// Tracef formats message according to format specifier and writes to log with
+// LevelTrace.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Tracef(format string, params ...interface{}) {
+	l.logf(btclog.LevelTrace, format, params...)
+}
+
+// Debugf formats message according to format specifier and writes to log with
+// LevelDebug.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Debugf(format string, params ...interface{}) {
+	l.logf(btclog.LevelDebug, format, params...)
+}
+
+// Infof formats message according to format specifier and writes to log with
+// LevelInfo.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Infof(format string, params ...interface{}) {
+	l.logf(btclog.LevelInfo, format, params...)
+}
+
+// Warnf formats message according to format specifier and writes to log with
+// LevelWarn.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Warnf(format string, params ...interface{}) {
+	l.logf(btclog.LevelWarn, format, params...)
+}
+
+// Errorf formats message according to format specifier and writes to log with
+// LevelError.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Errorf(format string, params ...interface{}) {
+	l.logf(btclog.LevelError, format, params...)
+}
+
+// Criticalf formats message according to format specifier and writes to log
+// with LevelCritical. It then requests a shutdown.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Criticalf(format string, params ...interface{}) {
+	l.logf(btclog.LevelCritical, format, params...)
+	l.log(btclog.LevelInfo, "Sending request for shutdown")
+	l.shutdown()
+}
+
+// Trace formats message using the default formats for its operands and writes
+// to log with LevelTrace.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Trace(v ...interface{}) {
+	l.logln(btclog.LevelTrace, v...)
+}
+
+// Debug formats message using the default formats for its operands and writes
+// to log with LevelDebug.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Debug(v ...interface{}) {
+	l.logln(btclog.LevelDebug, v...)
+}
+
+// Info formats message using the default formats for its operands and writes
+// to log with LevelInfo.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Info(v ...interface{}) {
+	l.logln(btclog.LevelInfo, v...)
+}
+
+// Warn formats message using the default formats for its operands and writes
+// to log with LevelWarn.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Warn(v ...interface{}) {
+	l.logln(btclog.LevelWarn, v...)
+}
+
+// Error formats message using the default formats for its operands and writes
+// to log with LevelError.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Error(v ...interface{}) {
+	l.logln(btclog.LevelError, v...)
+}
+
+// Critical formats message using the default formats for its operands and
+// writes to log with LevelCritical. It then requests a shutdown.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Critical(v ...interface{}) {
+	l.logln(btclog.LevelCritical, v...)
+	l.log(btclog.LevelInfo, "Sending request for shutdown")
+	l.shutdown()
+}
+
+// Level returns the current logging level.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) Level() btclog.Level {
+	return btclog.Level(atomic.LoadUint32(l.level))
+}
+
+// SetLevel changes the logging level to the passed level.
+//
+// NOTE: This is part of the btclog.Logger interface.
+func (l *jsonLogger) SetLevel(level btclog.Level) {
+	atomic.StoreUint32(l.level, uint32(level))
+}
@@ -0,0 +1,90 @@
+package aperture
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btclog"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/signal"
+	"github.com/stretchr/testify/require"
+)
+
+// TestJSONLogger makes sure the JSON logger writes every line as a JSON object
+// with the expected fields, respects the log level and attaches the fields of
+// request logs.
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	writer := newJSONLogWriter()
+	writer.writer = &buf
+
+	genLogger := writer.genSubLogger(signal.Interceptor{})
+	logger := genLogger("PRXY").(*jsonLogger)
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	logger.now = func() time.Time {
+		return now
+	}
+
+	// readLines returns the lines written since the last call.
+	readLines := func() []map[string]string {
+		var lines []map[string]string
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if line == "" {
+				continue
+			}
+
+			var fields map[string]string
+			err := json.Unmarshal([]byte(line), &fields)
+			require.NoError(t, err)
+			lines = append(lines, fields)
+		}
+		buf.Reset()
+		return lines
+	}
+
+	logger.SetLevel(btclog.LevelInfo)
+	logger.Debugf("not logged")
+	logger.Infof("hello %s", "world")
+	logger.Warn("multiple", "values", 1)
+	require.Equal(t, []map[string]string{{
+		"time":      "2022-03-01T12:00:00Z",
+		"level":     "info",
+		"subsystem": "PRXY",
+		"msg":       "hello world",
+	}, {
+		"time":      "2022-03-01T12:00:00Z",
+		"level":     "warn",
+		"subsystem": "PRXY",
+		"msg":       "multiple values 1",
+	}}, readLines())
+
+	// Request logs get the remote IP, request ID and service as fields
+	// instead of a prefix of the message. Loggers derived from the
+	// subsystem's logger follow its level.
+	_, prefixLog := proxy.NewRemoteIPPrefixLog(logger, "127.0.0.1:1234")
+	prefixLog = prefixLog.WithField("request_id", "abc")
+	prefixLog = prefixLog.WithField("service", "service1")
+	logger.SetLevel(btclog.LevelDebug)
+	prefixLog.Debugf("quote \"%s\"", "me")
+	require.Equal(t, []map[string]string{{
+		"time":       "2022-03-01T12:00:00Z",
+		"level":      "debug",
+		"subsystem":  "PRXY",
+		"msg":        "quote \"me\"",
+		"remote_ip":  "127.0.0.1",
+		"request_id": "abc",
+		"service":    "service1",
+	}}, readLines())
+
+	// The subsystem's logger itself is unaffected by the derived ones.
+	logger.Errorf("failed")
+	require.Equal(t, []map[string]string{{
+		"time":      "2022-03-01T12:00:00Z",
+		"level":     "error",
+		"subsystem": "PRXY",
+		"msg":       "failed",
+	}}, readLines())
+}
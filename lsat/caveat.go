@@ -3,6 +3,7 @@ package lsat
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"gopkg.in/macaroon.v2"
@@ -11,6 +12,15 @@ import (
 const (
 	// PreimageKey is the key used for a payment preimage caveat.
 	PreimageKey = "preimage"
+
+	// CondValidAfterBlock is the condition used for a caveat that only
+	// makes an LSAT valid once the chain has reached a certain block
+	// height.
+	CondValidAfterBlock = "valid_after_block"
+
+	// CondAdmin is the condition used for the capability caveat of LSATs
+	// that grant access to the admin API.
+	CondAdmin = "admin"
 )
 
 var (
@@ -38,6 +48,24 @@ func NewCaveat(condition string, value string) Caveat {
 	return Caveat{Condition: condition, Value: value}
 }
 
+// NewAdminCaveat creates a new caveat that grants an LSAT access to the admin
+// API.
+func NewAdminCaveat() Caveat {
+	return Caveat{
+		Condition: CondAdmin,
+		Value:     "true",
+	}
+}
+
+// NewValidAfterBlockCaveat creates a new caveat that only makes an LSAT valid
+// once the chain has reached the given block height.
+func NewValidAfterBlockCaveat(height uint32) Caveat {
+	return Caveat{
+		Condition: CondValidAfterBlock,
+		Value:     strconv.FormatUint(uint64(height), 10),
+	}
+}
+
 // String returns a user-friendly view of a caveat.
 func (c Caveat) String() string {
 	return EncodeCaveat(c)
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -337,11 +338,14 @@ func testInterceptor(t *testing.T, tc interceptTestCase,
 
 	backendWg.Wait()
 	if tc.expectMacaroonCall1 {
-		require.Len(t, callMD, 1)
+		require.Len(t, callMD, 2)
 
 		// We expect the sent macaroon to be larger than the bare
 		// macaroon as it should contain the preimage now.
 		require.Greater(t, len(callMD["macaroon"]), len(testMacHex))
+		nonce := callMD[strings.ToLower(HeaderNonce)]
+		_, err := ParseNonce(nonce)
+		require.NoError(t, err)
 	}
 
 	// Do we expect more calls? Then make sure we will wait for completion
@@ -396,7 +400,7 @@ func testInterceptor(t *testing.T, tc interceptTestCase,
 		require.Equal(t, ErrNoToken, err)
 	}
 	if tc.expectMacaroonCall2 {
-		require.Len(t, callMD, 1)
+		require.Len(t, callMD, 2)
 
 		// We expect the sent macaroon to be larger than the bare
 		// macaroon as it should contain the preimage now.
@@ -0,0 +1,83 @@
+package lsat
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+// FromCookie tries to extract the LSAT from the cookie with the given name.
+// Browser clients can't set the Authorization header cross-origin, so they
+// send the LSAT in a cookie instead, in the same format as in the
+// Authorization header but without the scheme:
+//
+//	<name>=<macBase64>:<preimageHex>
+func FromCookie(header *http.Header, name string) (*macaroon.Macaroon,
+	lntypes.Preimage, error) {
+
+	req := http.Request{Header: *header}
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return nil, lntypes.Preimage{}, fmt.Errorf("no auth cookie "+
+			"provided: %v", err)
+	}
+
+	idx := strings.LastIndex(cookie.Value, ":")
+	if idx < 0 {
+		return nil, lntypes.Preimage{}, fmt.Errorf("invalid auth "+
+			"cookie format: %s", cookie.Value)
+	}
+	macBase64, preimageHex := cookie.Value[:idx], cookie.Value[idx+1:]
+
+	macBytes, err := base64.StdEncoding.DecodeString(macBase64)
+	if err != nil {
+		return nil, lntypes.Preimage{}, fmt.Errorf("base64 decode of "+
+			"macaroon failed: %v", err)
+	}
+	mac := &macaroon.Macaroon{}
+	if err := mac.UnmarshalBinary(macBytes); err != nil {
+		return nil, lntypes.Preimage{}, fmt.Errorf("unable to "+
+			"unmarshal macaroon: %v", err)
+	}
+	preimage, err := lntypes.MakePreimageFromStr(preimageHex)
+	if err != nil {
+		return nil, lntypes.Preimage{}, fmt.Errorf("hex decode of "+
+			"preimage failed: %v", err)
+	}
+
+	return mac, preimage, nil
+}
+
+// RemoveCookie removes the cookie with the given name from the Cookie header
+// fields, leaving all other cookies untouched.
+func RemoveCookie(header *http.Header, name string) {
+	values := header.Values("Cookie")
+	if len(values) == 0 {
+		return
+	}
+
+	var kept []string
+	for _, value := range values {
+		var pairs []string
+		for _, pair := range strings.Split(value, ";") {
+			pair = strings.TrimSpace(pair)
+			pairName := strings.SplitN(pair, "=", 2)[0]
+			if pair == "" || strings.TrimSpace(pairName) == name {
+				continue
+			}
+			pairs = append(pairs, pair)
+		}
+		if len(pairs) > 0 {
+			kept = append(kept, strings.Join(pairs, "; "))
+		}
+	}
+
+	header.Del("Cookie")
+	for _, value := range kept {
+		header.Add("Cookie", value)
+	}
+}
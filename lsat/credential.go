@@ -3,6 +3,8 @@ package lsat
 import (
 	"context"
 	"encoding/hex"
+	"strings"
+	"time"
 
 	"gopkg.in/macaroon.v2"
 )
@@ -27,7 +29,8 @@ func (m MacaroonCredential) RequireTransportSecurity() bool {
 // GetRequestMetadata implements the PerRPCCredentials interface. This method
 // is required in order to pass the wrapped macaroon into the gRPC context.
 // With this, the macaroon will be available within the request handling scope
-// of the ultimate gRPC server implementation.
+// of the ultimate gRPC server implementation. A fresh nonce is sent along with
+// it, so servers that protect against replayed LSATs accept the call.
 func (m MacaroonCredential) GetRequestMetadata(_ context.Context,
 	_ ...string) (map[string]string, error) {
 
@@ -36,8 +39,14 @@ func (m MacaroonCredential) GetRequestMetadata(_ context.Context,
 		return nil, err
 	}
 
+	nonce, err := NewNonce(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
 	md := make(map[string]string)
 	md["macaroon"] = hex.EncodeToString(macBytes)
+	md[strings.ToLower(HeaderNonce)] = nonce
 	return md, nil
 }
 
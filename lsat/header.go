@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strings"
 
 	"github.com/lightningnetwork/lnd/lntypes"
 	"gopkg.in/macaroon.v2"
@@ -24,6 +25,10 @@ const (
 	// HeaderMacaroon is the HTTP header field name that is used to send the
 	// LSAT by our own gRPC clients.
 	HeaderMacaroon = "Macaroon"
+
+	// lsatScheme is the prefix of an Authorization header field value
+	// that contains an LSAT.
+	lsatScheme = "LSAT "
 )
 
 var (
@@ -38,14 +43,18 @@ var (
 //    2.      Grpc-Metadata-Macaroon: <macHex>
 //    3.      Macaroon: <macHex>
 // If only the macaroon is sent in header 2 or three then it is expected to have
-// a caveat with the preimage attached to it.
+// a caveat with the preimage attached to it. REST clients going through a
+// grpc-gateway may send an Authorization header that doesn't contain an LSAT
+// along with header 2, in which case header 2 is used.
 func FromHeader(header *http.Header) (*macaroon.Macaroon, lntypes.Preimage, error) {
 	var authHeader string
 
 	switch {
 	// Header field 1 contains the macaroon and the preimage as distinct
 	// values separated by a colon.
-	case header.Get(HeaderAuthorization) != "":
+	case header.Get(HeaderAuthorization) != "" &&
+		(isLSATAuthorization(header) || !hasMacaroonHeader(header)):
+
 		// Parse the content of the header field and check that it is in
 		// the correct format.
 		authHeader = header.Get(HeaderAuthorization)
@@ -124,6 +133,19 @@ func FromHeader(header *http.Header) (*macaroon.Macaroon, lntypes.Preimage, erro
 	return mac, preimage, nil
 }
 
+// isLSATAuthorization returns true if the Authorization header field uses the
+// LSAT scheme.
+func isLSATAuthorization(header *http.Header) bool {
+	return strings.HasPrefix(header.Get(HeaderAuthorization), lsatScheme)
+}
+
+// hasMacaroonHeader returns true if a macaroon is sent in one of the header
+// fields that only contain the macaroon.
+func hasMacaroonHeader(header *http.Header) bool {
+	return header.Get(HeaderMacaroonMD) != "" ||
+		header.Get(HeaderMacaroon) != ""
+}
+
 // SetHeader sets the provided authentication elements as the default/standard
 // HTTP header for the LSAT protocol.
 func SetHeader(header *http.Header, mac *macaroon.Macaroon,
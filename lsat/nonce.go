@@ -0,0 +1,64 @@
+package lsat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderNonce is the HTTP header field name clients send a unique
+	// nonce in with every request, so a server can detect LSATs being
+	// replayed.
+	HeaderNonce = "X-Request-Nonce"
+
+	// nonceRandomSize is the number of random bytes of a nonce.
+	nonceRandomSize = 16
+
+	// nonceDelimiter separates the timestamp of a nonce from its random
+	// part.
+	nonceDelimiter = "-"
+)
+
+// NewNonce creates a new nonce for a request sent at the given time. The nonce
+// has the format <unixTimestamp>-<randomHex>, so a server only needs to
+// remember the nonces that are recent enough to be accepted.
+func NewNonce(now time.Time) (string, error) {
+	var random [nonceRandomSize]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(now.Unix(), 10) + nonceDelimiter +
+		hex.EncodeToString(random[:]), nil
+}
+
+// ParseNonce parses the given nonce and returns the time it was created at.
+func ParseNonce(nonce string) (time.Time, error) {
+	parts := strings.Split(nonce, nonceDelimiter)
+	if len(parts) != 2 {
+		return time.Time{}, fmt.Errorf("invalid nonce format: %s",
+			nonce)
+	}
+
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid nonce timestamp: %v",
+			err)
+	}
+
+	random, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("hex decode of nonce failed: %v",
+			err)
+	}
+	if len(random) != nonceRandomSize {
+		return time.Time{}, fmt.Errorf("invalid nonce length %d",
+			len(random))
+	}
+
+	return time.Unix(timestamp, 0), nil
+}
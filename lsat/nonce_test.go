@@ -0,0 +1,43 @@
+package lsat
+
+import (
+	"testing"
+	"time"
+)
+
+// TestNonce ensures the creation time of a nonce can be parsed from it and that
+// malformed nonces are rejected.
+func TestNonce(t *testing.T) {
+	t.Parallel()
+
+	created := time.Unix(1600000000, 0)
+	nonce, err := NewNonce(created)
+	if err != nil {
+		t.Fatalf("unable to create nonce: %v", err)
+	}
+	parsed, err := ParseNonce(nonce)
+	if err != nil {
+		t.Fatalf("unable to parse nonce: %v", err)
+	}
+	if !parsed.Equal(created) {
+		t.Fatalf("expected creation time %v, got %v", created, parsed)
+	}
+
+	other, err := NewNonce(created)
+	if err != nil {
+		t.Fatalf("unable to create nonce: %v", err)
+	}
+	if other == nonce {
+		t.Fatalf("expected nonces to be unique")
+	}
+
+	invalid := []string{
+		"", "1600000000", "foo-abcd", "1600000000-xyz",
+		"1600000000-abcd", nonce + "-abcd",
+	}
+	for _, nonce := range invalid {
+		if _, err := ParseNonce(nonce); err == nil {
+			t.Fatalf("expected nonce %q to be invalid", nonce)
+		}
+	}
+}
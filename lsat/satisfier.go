@@ -2,6 +2,7 @@ package lsat
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -115,3 +116,78 @@ func NewCapabilitiesSatisfier(service string, targetCapability string) Satisfier
 		},
 	}
 }
+
+// NewValidAfterBlockSatisfier implements a satisfier to determine whether an
+// LSAT is already valid at the given current block height.
+func NewValidAfterBlockSatisfier(currentHeight uint32) Satisfier {
+	return Satisfier{
+		Condition: CondValidAfterBlock,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			prevHeight, err := parseBlockHeight(prev.Value)
+			if err != nil {
+				return err
+			}
+			curHeight, err := parseBlockHeight(cur.Value)
+			if err != nil {
+				return err
+			}
+
+			// The caveat can only push the height at which the
+			// LSAT becomes valid further out.
+			if curHeight < prevHeight {
+				return fmt.Errorf("valid after block %d not "+
+					"previously allowed", curHeight)
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			height, err := parseBlockHeight(c.Value)
+			if err != nil {
+				return err
+			}
+			if currentHeight < height {
+				return fmt.Errorf("LSAT not valid before block "+
+					"%d, current height is %d", height,
+					currentHeight)
+			}
+
+			return nil
+		},
+	}
+}
+
+// NewAdminSatisfier implements a satisfier to determine whether an LSAT grants
+// access to the admin API. Once an admin caveat revoked that access, it can't
+// be granted again.
+func NewAdminSatisfier() Satisfier {
+	return Satisfier{
+		Condition: CondAdmin,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			if prev.Value != "true" && cur.Value == "true" {
+				return fmt.Errorf("admin access not previously " +
+					"allowed")
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			if c.Value != "true" {
+				return fmt.Errorf("LSAT doesn't grant admin " +
+					"access")
+			}
+
+			return nil
+		},
+	}
+}
+
+// parseBlockHeight parses the block height value of a caveat.
+func parseBlockHeight(value string) (uint32, error) {
+	height, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid block height %q: %v", value, err)
+	}
+
+	return uint32(height), nil
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+
+	"gopkg.in/macaroon.v2"
 )
 
 const (
@@ -63,6 +65,18 @@ func NewServicesCaveat(services ...Service) (Caveat, error) {
 	}, nil
 }
 
+// ServicesFromMacaroon returns the services the given macaroon grants access
+// to. If it contains multiple services caveats, the last one is used, which is
+// the most restrictive one for any valid LSAT.
+func ServicesFromMacaroon(m *macaroon.Macaroon) ([]Service, error) {
+	value, ok := HasCaveat(m, CondServices)
+	if !ok {
+		return nil, ErrNoServices
+	}
+
+	return decodeServicesCaveatValue(value)
+}
+
 // encodeServicesCaveatValue encodes a list of services into the expected format
 // of a services caveat's value.
 func encodeServicesCaveatValue(services ...Service) (string, error) {
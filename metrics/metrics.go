@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// ServiceLabel is the label of the request metrics that holds the name
+	// of the service a request was matched to.
+	ServiceLabel = "service"
+
+	// StatusCodeLabel is the label of the request metrics that holds the
+	// HTTP status code of the response.
+	StatusCodeLabel = "status_code"
+)
+
+var (
+	// LSATIssuanceDuration tracks the time it takes to mint a new LSAT,
+	// which includes creating its invoice.
+	LSATIssuanceDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "lsat_issuance_duration_seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	// LSATVerificationDuration tracks the time it takes to verify the LSAT
+	// presented by a client, which includes checking its invoice is
+	// settled.
+	LSATVerificationDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "lsat_verification_duration_seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	// ProxyRequestDuration tracks the time it takes to respond to the
+	// requests for each service, labeled by the status code of the
+	// response.
+	ProxyRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "proxy_request_duration_seconds",
+			Buckets: prometheus.DefBuckets,
+		}, []string{ServiceLabel, StatusCodeLabel},
+	)
+)
+
+// Collectors returns the metrics of this package so they can be registered
+// with the exporter.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		LSATIssuanceDuration, LSATVerificationDuration,
+		ProxyRequestDuration,
+	}
+}
+
+// ObserveProxyRequest records the duration of a request to the given service
+// that was received at the given time and answered with the given status code.
+func ObserveProxyRequest(service string, statusCode int, start time.Time) {
+	ProxyRequestDuration.WithLabelValues(
+		service, strconv.Itoa(statusCode),
+	).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,132 @@
+package mint
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// CondAssetID is the condition used for a caveat that records the ID
+	// of the Taproot Asset the invoice of an LSAT is paid with. The value
+	// is the hex encoded asset ID.
+	CondAssetID = "asset_id"
+
+	// CondAssetAmount is the condition used for a caveat that records the
+	// number of units of the Taproot Asset the invoice of an LSAT is paid
+	// with.
+	CondAssetAmount = "asset_amount"
+
+	// AssetIDSize is the size of the ID of a Taproot Asset.
+	AssetIDSize = 32
+)
+
+// Asset is a Taproot Asset the invoices of LSATs are paid with instead of
+// satoshis.
+type Asset struct {
+	// ID is the ID of the asset.
+	ID [AssetIDSize]byte
+
+	// Amount is the number of units of the asset an invoice asks for.
+	Amount uint64
+}
+
+// NewAssetCaveats creates the caveats that record the asset the invoice of an
+// LSAT is paid with.
+func NewAssetCaveats(asset *Asset) []lsat.Caveat {
+	return []lsat.Caveat{{
+		Condition: CondAssetID,
+		Value:     hex.EncodeToString(asset.ID[:]),
+	}, {
+		Condition: CondAssetAmount,
+		Value:     strconv.FormatUint(asset.Amount, 10),
+	}}
+}
+
+// NewAssetSatisfiers implements the satisfiers to determine whether the asset
+// caveats of an LSAT are valid. The asset an LSAT was paid with can't be
+// changed by later caveats.
+func NewAssetSatisfiers() []lsat.Satisfier {
+	return []lsat.Satisfier{
+		newAssetSatisfier(CondAssetID, func(value string) error {
+			_, err := parseAssetID(value)
+			return err
+		}),
+		newAssetSatisfier(CondAssetAmount, func(value string) error {
+			_, err := parseAssetAmount(value)
+			return err
+		}),
+	}
+}
+
+// newAssetSatisfier creates a satisfier for the given asset condition that
+// only accepts values that parse and never change.
+func newAssetSatisfier(condition string,
+	parse func(string) error) lsat.Satisfier {
+
+	return lsat.Satisfier{
+		Condition: condition,
+		SatisfyPrevious: func(prev, cur lsat.Caveat) error {
+			if cur.Value != prev.Value {
+				return fmt.Errorf("%s %q not previously "+
+					"allowed", condition, cur.Value)
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c lsat.Caveat) error {
+			return parse(c.Value)
+		},
+	}
+}
+
+// AssetFromMacaroon returns the asset the invoice of the LSAT was paid with,
+// or nil if it was paid in satoshis.
+func AssetFromMacaroon(mac *macaroon.Macaroon) (*Asset, error) {
+	idValue, hasID := lsat.HasCaveat(mac, CondAssetID)
+	amountValue, hasAmount := lsat.HasCaveat(mac, CondAssetAmount)
+	switch {
+	case !hasID && !hasAmount:
+		return nil, nil
+
+	case !hasID || !hasAmount:
+		return nil, fmt.Errorf("LSAT must carry both %s and %s "+
+			"caveats", CondAssetID, CondAssetAmount)
+	}
+
+	id, err := parseAssetID(idValue)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseAssetAmount(amountValue)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Asset{ID: id, Amount: amount}, nil
+}
+
+// parseAssetID parses the value of an asset ID caveat.
+func parseAssetID(value string) ([AssetIDSize]byte, error) {
+	var id [AssetIDSize]byte
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != AssetIDSize {
+		return id, fmt.Errorf("invalid asset ID %q", value)
+	}
+	copy(id[:], b)
+
+	return id, nil
+}
+
+// parseAssetAmount parses the value of an asset amount caveat.
+func parseAssetAmount(value string) (uint64, error) {
+	amount, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || amount == 0 {
+		return 0, fmt.Errorf("invalid asset amount %q", value)
+	}
+
+	return amount, nil
+}
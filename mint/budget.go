@@ -0,0 +1,117 @@
+package mint
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// CondBudget is the condition used for a caveat that limits the number
+	// of requests an LSAT can be used for.
+	CondBudget = "budget"
+)
+
+var (
+	// ErrBudgetExhausted is returned when using an LSAT that was already
+	// used for as many requests as its budget allows.
+	ErrBudgetExhausted = errors.New("LSAT request budget exhausted")
+
+	// errBudgetsUnsupported is returned when verifying an LSAT with a
+	// budget while no budget store is configured.
+	errBudgetsUnsupported = errors.New("LSAT request budgets not " +
+		"supported")
+)
+
+// BudgetStore is the store responsible for keeping track of how many requests
+// each LSAT with a budget was used for.
+type BudgetStore interface {
+	// ConsumeBudget uses up one request of the budget of the LSAT with the
+	// given ID. If the LSAT was already used for budget requests,
+	// ErrBudgetExhausted is returned.
+	ConsumeBudget(ctx context.Context, id lsat.TokenID, budget uint32) error
+}
+
+// NewBudgetCaveat creates a new caveat that limits the number of requests an
+// LSAT can be used for.
+func NewBudgetCaveat(budget uint32) lsat.Caveat {
+	return lsat.Caveat{
+		Condition: CondBudget,
+		Value:     strconv.FormatUint(uint64(budget), 10),
+	}
+}
+
+// NewBudgetSatisfier implements a satisfier to determine whether the budget
+// caveats of an LSAT are valid. A budget can only be lowered by later
+// caveats. Whether the budget is exhausted is tracked by a BudgetStore.
+func NewBudgetSatisfier() lsat.Satisfier {
+	return lsat.Satisfier{
+		Condition: CondBudget,
+		SatisfyPrevious: func(prev, cur lsat.Caveat) error {
+			prevBudget, err := parseBudget(prev.Value)
+			if err != nil {
+				return err
+			}
+			curBudget, err := parseBudget(cur.Value)
+			if err != nil {
+				return err
+			}
+
+			if curBudget > prevBudget {
+				return fmt.Errorf("budget %d not previously "+
+					"allowed", curBudget)
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c lsat.Caveat) error {
+			_, err := parseBudget(c.Value)
+			return err
+		},
+	}
+}
+
+// parseBudget parses the value of a budget caveat.
+func parseBudget(value string) (uint32, error) {
+	budget, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid budget %q: %v", value, err)
+	}
+
+	return uint32(budget), nil
+}
+
+// ConsumeBudget uses up one request of the budget of the given LSAT, which
+// must have been verified before. LSATs without a budget caveat can be used
+// for an unlimited number of requests. If the budget is exhausted,
+// ErrBudgetExhausted is returned.
+func (m *Mint) ConsumeBudget(ctx context.Context,
+	mac *macaroon.Macaroon) error {
+
+	// The last budget caveat is the lowest one, as the satisfier makes
+	// sure a budget can only be lowered.
+	value, ok := lsat.HasCaveat(mac, CondBudget)
+	if !ok {
+		return nil
+	}
+
+	if m.cfg.Budgets == nil {
+		return errBudgetsUnsupported
+	}
+
+	budget, err := parseBudget(value)
+	if err != nil {
+		return err
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return err
+	}
+
+	return m.cfg.Budgets.ConsumeBudget(ctx, id.TokenID, budget)
+}
@@ -0,0 +1,100 @@
+package mint
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// CondExpiresAt is the condition used for a caveat that makes an LSAT
+	// expire at a certain time. The value is a unix timestamp in seconds.
+	CondExpiresAt = "expires_at"
+)
+
+var (
+	// ErrTokenExpired is returned when verifying an LSAT whose expiry time
+	// has passed.
+	ErrTokenExpired = errors.New("LSAT expired")
+)
+
+// NewExpiresAtCaveat creates a new caveat that makes an LSAT expire at the
+// given time.
+func NewExpiresAtCaveat(expiry time.Time) lsat.Caveat {
+	return lsat.Caveat{
+		Condition: CondExpiresAt,
+		Value:     strconv.FormatInt(expiry.Unix(), 10),
+	}
+}
+
+// NewExpiresAtSatisfier implements a satisfier to determine whether an LSAT is
+// still valid at the given time. If it expired, ErrTokenExpired is returned.
+func NewExpiresAtSatisfier(now time.Time) lsat.Satisfier {
+	return lsat.Satisfier{
+		Condition: CondExpiresAt,
+		SatisfyPrevious: func(prev, cur lsat.Caveat) error {
+			prevExpiry, err := parseExpiry(prev.Value)
+			if err != nil {
+				return err
+			}
+			curExpiry, err := parseExpiry(cur.Value)
+			if err != nil {
+				return err
+			}
+
+			// The caveat can only make the LSAT expire earlier.
+			if curExpiry.After(prevExpiry) {
+				return fmt.Errorf("expiry %v not previously "+
+					"allowed", curExpiry)
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c lsat.Caveat) error {
+			expiry, err := parseExpiry(c.Value)
+			if err != nil {
+				return err
+			}
+			if !now.Before(expiry) {
+				return ErrTokenExpired
+			}
+
+			return nil
+		},
+	}
+}
+
+// parseExpiry parses the unix timestamp value of an expiry caveat.
+func parseExpiry(value string) (time.Time, error) {
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry %q: %v", value,
+			err)
+	}
+
+	return time.Unix(timestamp, 0), nil
+}
+
+// issuedExpiry returns the earliest expiry of the given caveats, or the zero
+// time if none of them makes the LSAT expire.
+func issuedExpiry(caveats []lsat.Caveat) (time.Time, error) {
+	var earliest time.Time
+	for _, caveat := range caveats {
+		if caveat.Condition != CondExpiresAt {
+			continue
+		}
+
+		expiry, err := parseExpiry(caveat.Value)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if earliest.IsZero() || expiry.Before(earliest) {
+			earliest = expiry
+		}
+	}
+
+	return earliest, nil
+}
@@ -7,6 +7,8 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightningnetwork/lnd/lntypes"
@@ -17,6 +19,10 @@ var (
 	// ErrSecretNotFound is an error returned when we attempt to retrieve a
 	// secret by its key but it is not found.
 	ErrSecretNotFound = errors.New("secret not found")
+
+	// ErrQuotaExhausted is an error returned when attempting to refresh an
+	// LSAT that was already refreshed as often as its services allow.
+	ErrQuotaExhausted = errors.New("LSAT refresh quota exhausted")
 )
 
 // Challenger is an interface used to present requesters of LSATs with a
@@ -26,8 +32,10 @@ type Challenger interface {
 	// NewChallenge returns a new challenge in the form of a Lightning
 	// payment request. The payment hash is also returned as a convenience
 	// to avoid having to decode the payment request in order to retrieve
-	// its payment hash.
-	NewChallenge(price int64) (string, lntypes.Hash, error)
+	// its payment hash. The context carries request specific values that
+	// might influence the challenge.
+	NewChallenge(ctx context.Context, price int64) (string, lntypes.Hash,
+		error)
 }
 
 // SecretStore is the store responsible for storing LSAT secrets. These secrets
@@ -60,6 +68,24 @@ type ServiceLimiter interface {
 	// enforces additional constraints on a particular service/service
 	// capability.
 	ServiceConstraints(context.Context, ...lsat.Service) ([]lsat.Caveat, error)
+
+	// ServiceCaveats returns the custom caveats, like claims about the
+	// tier of the user, that LSATs for each service must carry. They are
+	// added when minting and verified when an LSAT is used.
+	ServiceCaveats(context.Context, ...lsat.Service) ([]lsat.Caveat, error)
+
+	// ServiceRefreshQuota returns the number of times an LSAT for all of
+	// the given services can be refreshed without being paid for again.
+	ServiceRefreshQuota(context.Context, ...lsat.Service) (uint32, error)
+}
+
+// QuotaStore is the store responsible for keeping track of how often each LSAT
+// was refreshed.
+type QuotaStore interface {
+	// ConsumeQuota uses up one refresh of the LSAT with the given ID. If
+	// the LSAT was already refreshed quota times, ErrQuotaExhausted is
+	// returned.
+	ConsumeQuota(ctx context.Context, id lsat.TokenID, quota uint32) error
 }
 
 // Config packages all of the required dependencies to instantiate a new LSAT
@@ -76,6 +102,23 @@ type Config struct {
 	// ServiceLimiter provides us with how we should limit a new LSAT based
 	// on its target services.
 	ServiceLimiter ServiceLimiter
+
+	// Quotas keeps track of how often LSATs were refreshed. If it isn't
+	// set, LSATs can't be refreshed.
+	Quotas QuotaStore
+
+	// Budgets keeps track of how many requests LSATs with a budget were
+	// used for. If it isn't set, LSATs with a budget are rejected.
+	Budgets BudgetStore
+
+	// Tokens keeps a record of the minted LSATs. If it isn't set, no
+	// record is kept.
+	Tokens TokenStore
+
+	// Asset is the Taproot Asset the invoices of new LSATs are paid with.
+	// It must match the invoices the challenger creates. If it isn't set,
+	// LSATs are paid for in satoshis.
+	Asset *Asset
 }
 
 // Mint is an entity that is able to mint and verify LSATs for a set of
@@ -99,7 +142,9 @@ func (m *Mint) MintLSAT(ctx context.Context,
 
 	// We'll start by retrieving a new challenge in the form of a Lightning
 	// payment request to present the requester of the LSAT with.
-	paymentRequest, paymentHash, err := m.cfg.Challenger.NewChallenge(price)
+	paymentRequest, paymentHash, err := m.cfg.Challenger.NewChallenge(
+		ctx, price,
+	)
 	if err != nil {
 		return nil, "", err
 	}
@@ -138,15 +183,184 @@ func (m *Mint) MintLSAT(ctx context.Context,
 			return nil, "", err
 		}
 	}
+	if m.cfg.Asset != nil {
+		caveats = append(caveats, NewAssetCaveats(m.cfg.Asset)...)
+	}
 	if err := lsat.AddFirstPartyCaveats(mac, caveats...); err != nil {
 		// Attempt to revoke the secret to save space.
 		_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
 		return nil, "", err
 	}
 
+	// An LSAT we don't have a record of couldn't be revoked by the
+	// operator, so we don't hand it out. The record keeps the expiry we
+	// issued, as holders can add earlier ones to their copies.
+	expiry, err := issuedExpiry(caveats)
+	if err != nil {
+		_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
+		return nil, "", err
+	}
+	if err := m.recordToken(ctx, id, services, expiry); err != nil {
+		_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
+		return nil, "", err
+	}
+
 	return mac, paymentRequest, nil
 }
 
+// Refresh issues a new LSAT in place of a still valid one without requiring
+// another payment. The new LSAT has the same identifier and root secret as the
+// old one, so the old pre-image remains valid for it. It carries all caveats of
+// the old LSAT, including the ones its holder added to attenuate it, except for
+// its expiry, which is set anew. Each refresh uses up one of the refreshes
+// granted by the LSAT's services. Once there are none left,
+// ErrQuotaExhausted is returned.
+func (m *Mint) Refresh(ctx context.Context, mac *macaroon.Macaroon,
+	preimage lntypes.Preimage) (*macaroon.Macaroon, error) {
+
+	if m.cfg.Quotas == nil {
+		return nil, errors.New("LSAT refresh not supported")
+	}
+
+	// Only LSATs that were paid for and are still valid can be refreshed.
+	// Whether one is valid at the current block height doesn't matter, the
+	// new LSAT will be restricted by the same caveat.
+	services, err := lsat.ServicesFromMacaroon(mac)
+	if err != nil {
+		return nil, err
+	}
+	err = m.VerifyLSAT(ctx, &VerificationParams{
+		Macaroon:      mac,
+		Preimage:      preimage,
+		TargetService: services[0].Name,
+		BlockHeight:   math.MaxUint32,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	quota, err := m.cfg.ServiceLimiter.ServiceRefreshQuota(
+		ctx, services...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return nil, err
+	}
+	if err := m.cfg.Quotas.ConsumeQuota(ctx, id.TokenID, quota); err != nil {
+		return nil, err
+	}
+
+	secret, err := m.cfg.Secrets.GetSecret(ctx, sha256.Sum256(mac.Id()))
+	if err != nil {
+		return nil, err
+	}
+	refreshed, err := macaroon.New(
+		secret[:], mac.Id(), "lsat", macaroon.LatestVersion,
+	)
+	if err != nil {
+		return nil, err
+	}
+	// Attenuating an LSAT must never be undone by refreshing it, so all
+	// caveats of the old LSAT are kept, including the asset it was paid
+	// with. Only its expiry is replaced.
+	for _, rawCaveat := range mac.Caveats() {
+		caveat, err := lsat.DecodeCaveat(string(rawCaveat.Id))
+		if err == nil && caveat.Condition == CondExpiresAt {
+			continue
+		}
+		if err := refreshed.AddFirstPartyCaveat(rawCaveat.Id); err != nil {
+			return nil, err
+		}
+	}
+	serviceCaveats, err := m.caveatsForServices(ctx, services...)
+	if err != nil {
+		return nil, err
+	}
+	var caveats []lsat.Caveat
+	for _, caveat := range serviceCaveats {
+		if caveat.Condition == CondExpiresAt {
+			caveats = append(caveats, caveat)
+		}
+	}
+	if err := lsat.AddFirstPartyCaveats(refreshed, caveats...); err != nil {
+		return nil, err
+	}
+
+	// The state kept for the LSAT, like its budget, must now be kept
+	// until its new expiry.
+	if m.cfg.Tokens != nil {
+		expiry, err := issuedExpiry(caveats)
+		if err != nil {
+			return nil, err
+		}
+		err = m.cfg.Tokens.RenewToken(ctx, id.TokenID, expiry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return refreshed, nil
+}
+
+// MintAdminAPILSAT mints a new LSAT that grants access to the admin API until
+// the given expiry, or indefinitely if it is the zero time. These LSATs aren't
+// paid for, so the pre-image is generated by us and returned alongside the
+// macaroon.
+//
+// Anyone holding an LSAT can add first-party caveats to it, including an admin
+// caveat. That's why the secret of an admin API LSAT is stored under a
+// different key than the secret of a regular LSAT, so only LSATs minted by
+// this method can pass the verification of admin API LSATs.
+func (m *Mint) MintAdminAPILSAT(ctx context.Context,
+	expiry time.Time) (*macaroon.Macaroon, lntypes.Preimage, error) {
+
+	var preimage lntypes.Preimage
+	if _, err := rand.Read(preimage[:]); err != nil {
+		return nil, lntypes.Preimage{}, err
+	}
+
+	id, err := createUniqueIdentifier(preimage.Hash())
+	if err != nil {
+		return nil, lntypes.Preimage{}, err
+	}
+	idHash := adminSecretKey(id)
+	secret, err := m.cfg.Secrets.NewSecret(ctx, idHash)
+	if err != nil {
+		return nil, lntypes.Preimage{}, err
+	}
+
+	mac, err := macaroon.New(
+		secret[:], id, "lsat", macaroon.LatestVersion,
+	)
+	if err != nil {
+		// Attempt to revoke the secret to save space.
+		_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
+		return nil, lntypes.Preimage{}, err
+	}
+
+	caveats := []lsat.Caveat{lsat.NewAdminCaveat()}
+	if !expiry.IsZero() {
+		caveats = append(caveats, NewExpiresAtCaveat(expiry))
+	}
+	err = lsat.AddFirstPartyCaveats(mac, caveats...)
+	if err != nil {
+		// Attempt to revoke the secret to save space.
+		_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
+		return nil, lntypes.Preimage{}, err
+	}
+
+	return mac, preimage, nil
+}
+
+// adminSecretKey returns the key the secret of an admin API LSAT with the
+// given identifier is stored under.
+func adminSecretKey(id []byte) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte("admin"), id...))
+}
+
 // maximumPrice determines the necessary price to use for a collection
 // of services.
 func maximumPrice(services []lsat.Service) int64 {
@@ -211,9 +425,15 @@ func (m *Mint) caveatsForServices(ctx context.Context,
 		return nil, err
 	}
 
+	custom, err := m.cfg.ServiceLimiter.ServiceCaveats(ctx, services...)
+	if err != nil {
+		return nil, err
+	}
+
 	caveats := []lsat.Caveat{servicesCaveat}
 	caveats = append(caveats, capabilities...)
 	caveats = append(caveats, constraints...)
+	caveats = append(caveats, custom...)
 	return caveats, nil
 }
 
@@ -229,6 +449,15 @@ type VerificationParams struct {
 	// TargetService is the target service a user of an LSAT is attempting
 	// to access.
 	TargetService string
+
+	// BlockHeight is the current block height of the chain. It is used to
+	// verify caveats that only make an LSAT valid after a certain block
+	// height.
+	BlockHeight uint32
+
+	// AdminAPI denotes whether the LSAT must grant access to the admin
+	// API.
+	AdminAPI bool
 }
 
 // VerifyLSAT attempts to verify an LSAT with the given parameters.
@@ -244,10 +473,13 @@ func (m *Mint) VerifyLSAT(ctx context.Context, params *VerificationParams) error
 			id.PaymentHash)
 	}
 
-	// If there was, then we'll ensure the LSAT was minted by us.
-	secret, err := m.cfg.Secrets.GetSecret(
-		ctx, sha256.Sum256(params.Macaroon.Id()),
-	)
+	// If there was, then we'll ensure the LSAT was minted by us. Admin
+	// API LSATs keep their secret under a different key.
+	secretKey := sha256.Sum256(params.Macaroon.Id())
+	if params.AdminAPI {
+		secretKey = adminSecretKey(params.Macaroon.Id())
+	}
+	secret, err := m.cfg.Secrets.GetSecret(ctx, secretKey)
 	if err != nil {
 		return err
 	}
@@ -268,7 +500,59 @@ func (m *Mint) VerifyLSAT(ctx context.Context, params *VerificationParams) error
 		}
 		caveats = append(caveats, caveat)
 	}
-	return lsat.VerifyCaveats(
-		caveats, lsat.NewServicesSatisfier(params.TargetService),
+
+	// An expired LSAT is rejected before any other caveat is looked at, so
+	// callers can reliably tell it apart from an invalid one and ask the
+	// client to pay for a new one.
+	err = lsat.VerifyCaveats(caveats, NewExpiresAtSatisfier(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	// The admin satisfier only checks admin caveats that are present, so
+	// we need to make sure there is one ourselves.
+	if params.AdminAPI {
+		if _, ok := lsat.HasCaveat(params.Macaroon, lsat.CondAdmin); !ok {
+			return errors.New("LSAT doesn't grant admin access")
+		}
+	}
+
+	satisfiers := append(
+		[]lsat.Satisfier{
+			lsat.NewServicesSatisfier(params.TargetService),
+			lsat.NewValidAfterBlockSatisfier(params.BlockHeight),
+			lsat.NewAdminSatisfier(), NewBudgetSatisfier(),
+		}, NewAssetSatisfiers()...,
 	)
+	err = lsat.VerifyCaveats(caveats, satisfiers...)
+	if err != nil || params.AdminAPI {
+		return err
+	}
+
+	// The pre-image proves the payment of an LSAT no matter whether its
+	// invoice was paid in satoshis or with an asset, but the asset must
+	// be recorded completely.
+	if _, err := AssetFromMacaroon(params.Macaroon); err != nil {
+		return err
+	}
+
+	// The budget of an LSAT is only used up once the request is about to
+	// be served, so LSATs whose budget we can't keep track of must be
+	// rejected now.
+	_, hasBudget := lsat.HasCaveat(params.Macaroon, CondBudget)
+	if hasBudget && m.cfg.Budgets == nil {
+		return errBudgetsUnsupported
+	}
+
+	// Finally, the LSAT must carry the custom caveats the target service
+	// requires.
+	required, err := m.cfg.ServiceLimiter.ServiceCaveats(ctx, lsat.Service{
+		Name: params.TargetService,
+		Tier: lsat.BaseTier,
+	})
+	if err != nil {
+		return err
+	}
+
+	return verifyRequiredCaveats(caveats, required)
 }
@@ -1,12 +1,17 @@
 package mint
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
 	"gopkg.in/macaroon.v2"
 )
 
@@ -118,6 +123,49 @@ func TestRevokedLSAT(t *testing.T) {
 	}
 }
 
+// TestRevokeLSAT ensures that minted LSATs are recorded in the token store and
+// can no longer be verified once revoked by their identifier.
+func TestRevokeLSAT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tokens := newMockTokenStore()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+		Tokens:         tokens,
+	})
+
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		t.Fatalf("unable to decode identifier: %v", err)
+	}
+	recorded, ok := tokens.tokens[id.TokenID]
+	if !ok {
+		t.Fatal("minted LSAT not recorded")
+	}
+
+	params := &VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	if err := mint.VerifyLSAT(ctx, params); err != nil {
+		t.Fatalf("unable to verify LSAT: %v", err)
+	}
+	if err := mint.RevokeLSAT(ctx, recorded); err != nil {
+		t.Fatalf("unable to revoke LSAT: %v", err)
+	}
+	if err := mint.VerifyLSAT(ctx, params); err != ErrSecretNotFound {
+		t.Fatalf("expected ErrSecretNotFound, got %v", err)
+	}
+}
+
 // TestTamperedLSAT ensures that an LSAT that has been tampered with by
 // modifying its signature results in its verification failing.
 func TestTamperedLSAT(t *testing.T) {
@@ -225,3 +273,570 @@ func TestDemotedServicesLSAT(t *testing.T) {
 		t.Fatal("expected macaroon to be invalid")
 	}
 }
+
+// TestValidAfterBlockLSAT ensures that an LSAT that only becomes valid at a
+// certain block height isn't accepted before that height and that the height
+// can't be lowered by adding another caveat.
+func TestValidAfterBlockLSAT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	limiter := newMockServiceLimiter()
+	limiter.constraints[testService] = []lsat.Caveat{
+		lsat.NewValidAfterBlockCaveat(1000),
+	}
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: limiter,
+	})
+
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+
+	// Before the block height is reached, the LSAT should be rejected.
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+		BlockHeight:   999,
+	}
+	err = mint.VerifyLSAT(ctx, &params)
+	if err == nil || !strings.Contains(err.Error(), "not valid before") {
+		t.Fatal("expected LSAT to not be valid yet")
+	}
+
+	// Once it is reached, the LSAT should be accepted.
+	params.BlockHeight = 1000
+	if err := mint.VerifyLSAT(ctx, &params); err != nil {
+		t.Fatalf("unable to verify LSAT: %v", err)
+	}
+
+	// Adding a caveat with a lower height must not make the LSAT valid
+	// any earlier.
+	err = lsat.AddFirstPartyCaveats(mac, lsat.NewValidAfterBlockCaveat(10))
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	err = mint.VerifyLSAT(ctx, &params)
+	if err == nil || !strings.Contains(err.Error(), "not previously") {
+		t.Fatal("expected LSAT with lowered block height to be invalid")
+	}
+}
+
+// TestExpiredLSAT ensures that an LSAT is rejected with ErrTokenExpired once
+// its expiry time has passed and that the expiry can only be shortened by
+// adding another caveat.
+func TestExpiredLSAT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	limiter := newMockServiceLimiter()
+	limiter.constraints[testService] = []lsat.Caveat{
+		NewExpiresAtCaveat(time.Now().Add(time.Hour)),
+	}
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: limiter,
+	})
+
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+
+	// The LSAT hasn't expired yet, so it should be accepted.
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	if err := mint.VerifyLSAT(ctx, &params); err != nil {
+		t.Fatalf("unable to verify LSAT: %v", err)
+	}
+
+	// Extending the expiry with another caveat must not be allowed.
+	extended := mac.Clone()
+	err = lsat.AddFirstPartyCaveats(
+		extended, NewExpiresAtCaveat(time.Now().Add(2*time.Hour)),
+	)
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	params.Macaroon = extended
+	err = mint.VerifyLSAT(ctx, &params)
+	if err == nil || !strings.Contains(err.Error(), "not previously") {
+		t.Fatal("expected LSAT with extended expiry to be invalid")
+	}
+
+	// Shortening it is, which makes the LSAT expire right away.
+	err = lsat.AddFirstPartyCaveats(
+		mac, NewExpiresAtCaveat(time.Now().Add(-time.Minute)),
+	)
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	params.Macaroon = mac
+	if err := mint.VerifyLSAT(ctx, &params); err != ErrTokenExpired {
+		t.Fatalf("expected ErrTokenExpired, got %v", err)
+	}
+}
+
+// TestRefreshLSAT ensures that a still valid LSAT can be refreshed as often as
+// its service allows and that the refreshed LSAT is valid for the old
+// pre-image.
+func TestRefreshLSAT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	limiter := newMockServiceLimiter()
+	limiter.constraints[testService] = []lsat.Caveat{
+		NewExpiresAtCaveat(time.Now().Add(time.Hour)),
+	}
+	limiter.refreshQuotas[testService] = 1
+	tokens := newMockTokenStore()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: limiter,
+		Quotas:         newMockQuotaStore(),
+		Tokens:         tokens,
+	})
+
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+
+	// An LSAT that wasn't paid for can't be refreshed.
+	_, err = mint.Refresh(ctx, mac, lntypes.Preimage{})
+	if err == nil || !strings.Contains(err.Error(), "invalid preimage") {
+		t.Fatal("expected LSAT without valid pre-image to be rejected")
+	}
+
+	// The refreshed LSAT expires later than the old one.
+	newExpiry := time.Unix(time.Now().Add(2*time.Hour).Unix(), 0)
+	limiter.constraints[testService] = []lsat.Caveat{
+		NewExpiresAtCaveat(newExpiry),
+	}
+	refreshed, err := mint.Refresh(ctx, mac, testPreimage)
+	if err != nil {
+		t.Fatalf("unable to refresh LSAT: %v", err)
+	}
+	if !bytes.Equal(refreshed.Id(), mac.Id()) {
+		t.Fatal("expected refreshed LSAT to keep its identifier")
+	}
+
+	// The record of the LSAT carries the expiry of the refreshed LSAT
+	// now.
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		t.Fatalf("unable to decode identifier: %v", err)
+	}
+	if !tokens.expiries[id.TokenID].Equal(newExpiry) {
+		t.Fatalf("expected recorded expiry %v, got %v", newExpiry,
+			tokens.expiries[id.TokenID])
+	}
+	params := VerificationParams{
+		Macaroon:      refreshed,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	if err := mint.VerifyLSAT(ctx, &params); err != nil {
+		t.Fatalf("unable to verify refreshed LSAT: %v", err)
+	}
+
+	// The quota of the service is used up now, neither the old nor the
+	// refreshed LSAT can be refreshed again.
+	_, err = mint.Refresh(ctx, refreshed, testPreimage)
+	if err != ErrQuotaExhausted {
+		t.Fatalf("expected ErrQuotaExhausted, got %v", err)
+	}
+	_, err = mint.Refresh(ctx, mac, testPreimage)
+	if err != ErrQuotaExhausted {
+		t.Fatalf("expected ErrQuotaExhausted, got %v", err)
+	}
+}
+
+// TestRefreshAttenuatedLSAT ensures the caveats a holder added to attenuate an
+// LSAT are kept when it is refreshed.
+func TestRefreshAttenuatedLSAT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	limiter := newMockServiceLimiter()
+	limiter.capabilities[testService] = lsat.NewCaveat(
+		testService.Name+lsat.CondCapabilitiesSuffix, "read,write",
+	)
+	limiter.constraints[testService] = []lsat.Caveat{
+		NewExpiresAtCaveat(time.Now().Add(time.Hour)),
+	}
+	limiter.refreshQuotas[testService] = 1
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: limiter,
+		Quotas:         newMockQuotaStore(),
+	})
+
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+
+	// The holder delegates an LSAT that can only read and expires soon.
+	shortExpiry := time.Now().Add(time.Minute)
+	err = lsat.AddFirstPartyCaveats(
+		mac, lsat.NewCaveat(
+			testService.Name+lsat.CondCapabilitiesSuffix, "read",
+		), NewExpiresAtCaveat(shortExpiry),
+	)
+	if err != nil {
+		t.Fatalf("unable to attenuate LSAT: %v", err)
+	}
+
+	newExpiry := time.Unix(time.Now().Add(2*time.Hour).Unix(), 0)
+	limiter.constraints[testService] = []lsat.Caveat{
+		NewExpiresAtCaveat(newExpiry),
+	}
+	refreshed, err := mint.Refresh(ctx, mac, testPreimage)
+	if err != nil {
+		t.Fatalf("unable to refresh LSAT: %v", err)
+	}
+
+	// The refreshed LSAT can still only read, but expires later.
+	capabilities, _ := lsat.HasCaveat(
+		refreshed, testService.Name+lsat.CondCapabilitiesSuffix,
+	)
+	if capabilities != "read" {
+		t.Fatalf("expected capabilities %q, got %q", "read",
+			capabilities)
+	}
+	expiry, _ := lsat.HasCaveat(refreshed, CondExpiresAt)
+	if expiry != strconv.FormatInt(newExpiry.Unix(), 10) {
+		t.Fatalf("expected expiry %v, got %v", newExpiry.Unix(),
+			expiry)
+	}
+	params := VerificationParams{
+		Macaroon:      refreshed,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	if err := mint.VerifyLSAT(ctx, &params); err != nil {
+		t.Fatalf("unable to verify refreshed LSAT: %v", err)
+	}
+}
+
+// TestBudgetLSAT ensures that an LSAT with a budget can only be used for as
+// many requests as its budget allows and that the budget can only be lowered by
+// adding another caveat.
+func TestBudgetLSAT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	limiter := newMockServiceLimiter()
+	limiter.constraints[testService] = []lsat.Caveat{NewBudgetCaveat(3)}
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: limiter,
+		Budgets:        newMockBudgetStore(),
+	})
+
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+
+	// Raising the budget with another caveat must not be allowed.
+	raised := mac.Clone()
+	err = lsat.AddFirstPartyCaveats(raised, NewBudgetCaveat(4))
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	params := VerificationParams{
+		Macaroon:      raised,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	err = mint.VerifyLSAT(ctx, &params)
+	if err == nil || !strings.Contains(err.Error(), "not previously") {
+		t.Fatal("expected LSAT with raised budget to be invalid")
+	}
+
+	// Lowering it is, and the lowest budget applies.
+	err = lsat.AddFirstPartyCaveats(mac, NewBudgetCaveat(2))
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	params.Macaroon = mac
+	if err := mint.VerifyLSAT(ctx, &params); err != nil {
+		t.Fatalf("unable to verify LSAT: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := mint.ConsumeBudget(ctx, mac); err != nil {
+			t.Fatalf("unable to consume budget: %v", err)
+		}
+	}
+	if err := mint.ConsumeBudget(ctx, mac); err != ErrBudgetExhausted {
+		t.Fatalf("expected ErrBudgetExhausted, got %v", err)
+	}
+
+	// LSATs with a budget are rejected if there is no budget store to
+	// keep track of it.
+	mint.cfg.Budgets = nil
+	if err := mint.VerifyLSAT(ctx, &params); err != errBudgetsUnsupported {
+		t.Fatalf("expected errBudgetsUnsupported, got %v", err)
+	}
+
+	// LSATs without a budget can be used for any number of requests, even
+	// without a budget store.
+	limiter.constraints[testService] = nil
+	unlimited, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+	if err := mint.ConsumeBudget(ctx, unlimited); err != nil {
+		t.Fatalf("unable to consume budget: %v", err)
+	}
+}
+
+// TestAssetLSAT ensures that LSATs paid with a Taproot Asset record the asset,
+// keep it when refreshed and can't have it changed by adding another caveat.
+func TestAssetLSAT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	limiter := newMockServiceLimiter()
+	limiter.refreshQuotas[testService] = 1
+	asset := &Asset{ID: [AssetIDSize]byte{1, 2, 3}, Amount: 100}
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: limiter,
+		Quotas:         newMockQuotaStore(),
+		Asset:          asset,
+	})
+
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	if err := mint.VerifyLSAT(ctx, &params); err != nil {
+		t.Fatalf("unable to verify LSAT: %v", err)
+	}
+
+	// The asset is kept when refreshing the LSAT, even if new LSATs are
+	// paid in satoshis by now.
+	mint.cfg.Asset = nil
+	refreshed, err := mint.Refresh(ctx, mac, testPreimage)
+	if err != nil {
+		t.Fatalf("unable to refresh LSAT: %v", err)
+	}
+	for _, m := range []*macaroon.Macaroon{mac, refreshed} {
+		recorded, err := AssetFromMacaroon(m)
+		if err != nil {
+			t.Fatalf("unable to get asset: %v", err)
+		}
+		if recorded == nil || *recorded != *asset {
+			t.Fatalf("expected asset %v, got %v", asset, recorded)
+		}
+	}
+
+	// Changing the amount of the asset with another caveat must not be
+	// allowed.
+	changed := mac.Clone()
+	err = lsat.AddFirstPartyCaveats(changed, lsat.Caveat{
+		Condition: CondAssetAmount,
+		Value:     "1",
+	})
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	params.Macaroon = changed
+	err = mint.VerifyLSAT(ctx, &params)
+	if err == nil || !strings.Contains(err.Error(), "not previously") {
+		t.Fatal("expected LSAT with changed asset amount to be invalid")
+	}
+
+	// LSATs paid in satoshis don't record any asset.
+	satsMac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+	recorded, err := AssetFromMacaroon(satsMac)
+	if err != nil || recorded != nil {
+		t.Fatalf("expected no asset, got %v: %v", recorded, err)
+	}
+
+	// An asset ID without an amount is rejected.
+	err = lsat.AddFirstPartyCaveats(satsMac, NewAssetCaveats(asset)[0])
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	params.Macaroon = satsMac
+	if err := mint.VerifyLSAT(ctx, &params); err == nil {
+		t.Fatal("expected LSAT with incomplete asset to be invalid")
+	}
+}
+
+// TestRequiredCaveatsLSAT ensures that the custom caveats of a service are
+// added to its LSATs and that LSATs without them or with different values are
+// rejected.
+func TestRequiredCaveatsLSAT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	limiter := newMockServiceLimiter()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: limiter,
+	})
+
+	// An LSAT minted before the service required the caveat doesn't
+	// carry it.
+	missing, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+
+	tier := lsat.NewCaveat("user_tier", "gold")
+	limiter.caveats[testService] = []lsat.Caveat{tier}
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+	if value, ok := lsat.HasCaveat(mac, tier.Condition); !ok ||
+		value != tier.Value {
+
+		t.Fatalf("expected LSAT to carry caveat %v", tier)
+	}
+
+	params := VerificationParams{
+		Macaroon:      mac,
+		Preimage:      testPreimage,
+		TargetService: testService.Name,
+	}
+	if err := mint.VerifyLSAT(ctx, &params); err != nil {
+		t.Fatalf("unable to verify LSAT: %v", err)
+	}
+
+	params.Macaroon = missing
+	err = mint.VerifyLSAT(ctx, &params)
+	if !errors.Is(err, ErrMissingCaveat) {
+		t.Fatalf("expected ErrMissingCaveat, got %v", err)
+	}
+
+	// The claim can't be changed by adding another caveat.
+	upgraded := mac.Clone()
+	err = lsat.AddFirstPartyCaveats(
+		upgraded, lsat.NewCaveat("user_tier", "platinum"),
+	)
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	params.Macaroon = upgraded
+	if err := mint.VerifyLSAT(ctx, &params); err == nil {
+		t.Fatal("expected LSAT with changed caveat to be invalid")
+	}
+}
+
+// TestAdminAPILSAT ensures that only LSATs minted for the admin API grant
+// access to it and that they can't be used to access any service.
+func TestAdminAPILSAT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+	})
+
+	adminMac, adminPreimage, err := mint.MintAdminAPILSAT(
+		ctx, time.Now().Add(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("unable to mint admin API LSAT: %v", err)
+	}
+	params := &VerificationParams{
+		Macaroon: adminMac,
+		Preimage: adminPreimage,
+		AdminAPI: true,
+	}
+	if err := mint.VerifyLSAT(ctx, params); err != nil {
+		t.Fatalf("unable to verify admin API LSAT: %v", err)
+	}
+
+	// Once it expires, it doesn't grant access anymore.
+	expiredMac, expiredPreimage, err := mint.MintAdminAPILSAT(
+		ctx, time.Now().Add(-time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unable to mint admin API LSAT: %v", err)
+	}
+	err = mint.VerifyLSAT(ctx, &VerificationParams{
+		Macaroon: expiredMac,
+		Preimage: expiredPreimage,
+		AdminAPI: true,
+	})
+	if err != ErrTokenExpired {
+		t.Fatalf("expected expired admin API LSAT to be rejected, "+
+			"got %v", err)
+	}
+
+	// It must not be accepted for a service.
+	params.AdminAPI = false
+	params.TargetService = testService.Name
+	if err := mint.VerifyLSAT(ctx, params); err != ErrSecretNotFound {
+		t.Fatalf("expected admin API LSAT to be rejected for service, "+
+			"got %v", err)
+	}
+
+	// A regular LSAT must not be accepted for the admin API, even if its
+	// holder added an admin caveat.
+	mac, _, err := mint.MintLSAT(ctx, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+	err = lsat.AddFirstPartyCaveats(mac, lsat.NewAdminCaveat())
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	params = &VerificationParams{
+		Macaroon: mac,
+		Preimage: testPreimage,
+		AdminAPI: true,
+	}
+	if err := mint.VerifyLSAT(ctx, params); err != ErrSecretNotFound {
+		t.Fatalf("expected LSAT to be rejected for admin API, got %v",
+			err)
+	}
+
+	// Revoking the admin access by adding another caveat must be
+	// respected.
+	err = lsat.AddFirstPartyCaveats(adminMac, lsat.Caveat{
+		Condition: lsat.CondAdmin,
+		Value:     "false",
+	})
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	params = &VerificationParams{
+		Macaroon: adminMac,
+		Preimage: adminPreimage,
+		AdminAPI: true,
+	}
+	if err := mint.VerifyLSAT(ctx, params); err == nil {
+		t.Fatal("expected LSAT with revoked admin access to be invalid")
+	}
+}
@@ -3,7 +3,9 @@ package mint
 import (
 	"context"
 	"crypto/sha256"
+	"math"
 	"math/rand"
+	"time"
 
 	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightningnetwork/lnd/lntypes"
@@ -26,7 +28,9 @@ func newMockChallenger() *mockChallenger {
 	return &mockChallenger{}
 }
 
-func (d *mockChallenger) NewChallenge(price int64) (string, lntypes.Hash, error) {
+func (d *mockChallenger) NewChallenge(_ context.Context,
+	price int64) (string, lntypes.Hash, error) {
+
 	return testPayReq, testHash, nil
 }
 
@@ -71,16 +75,20 @@ func newMockSecretStore() *mockSecretStore {
 }
 
 type mockServiceLimiter struct {
-	capabilities map[lsat.Service]lsat.Caveat
-	constraints  map[lsat.Service][]lsat.Caveat
+	capabilities  map[lsat.Service]lsat.Caveat
+	constraints   map[lsat.Service][]lsat.Caveat
+	caveats       map[lsat.Service][]lsat.Caveat
+	refreshQuotas map[lsat.Service]uint32
 }
 
 var _ ServiceLimiter = (*mockServiceLimiter)(nil)
 
 func newMockServiceLimiter() *mockServiceLimiter {
 	return &mockServiceLimiter{
-		capabilities: make(map[lsat.Service]lsat.Caveat),
-		constraints:  make(map[lsat.Service][]lsat.Caveat),
+		capabilities:  make(map[lsat.Service]lsat.Caveat),
+		constraints:   make(map[lsat.Service][]lsat.Caveat),
+		caveats:       make(map[lsat.Service][]lsat.Caveat),
+		refreshQuotas: make(map[lsat.Service]uint32),
 	}
 }
 
@@ -111,3 +119,100 @@ func (l *mockServiceLimiter) ServiceConstraints(ctx context.Context,
 	}
 	return res, nil
 }
+
+func (l *mockServiceLimiter) ServiceCaveats(ctx context.Context,
+	services ...lsat.Service) ([]lsat.Caveat, error) {
+
+	res := make([]lsat.Caveat, 0, len(services))
+	for _, service := range services {
+		res = append(res, l.caveats[service]...)
+	}
+	return res, nil
+}
+
+func (l *mockServiceLimiter) ServiceRefreshQuota(ctx context.Context,
+	services ...lsat.Service) (uint32, error) {
+
+	var quota uint32 = math.MaxUint32
+	for _, service := range services {
+		if l.refreshQuotas[service] < quota {
+			quota = l.refreshQuotas[service]
+		}
+	}
+	return quota, nil
+}
+
+type mockQuotaStore struct {
+	used map[lsat.TokenID]uint32
+}
+
+var _ QuotaStore = (*mockQuotaStore)(nil)
+
+func newMockQuotaStore() *mockQuotaStore {
+	return &mockQuotaStore{
+		used: make(map[lsat.TokenID]uint32),
+	}
+}
+
+func (s *mockQuotaStore) ConsumeQuota(_ context.Context, id lsat.TokenID,
+	quota uint32) error {
+
+	if s.used[id] >= quota {
+		return ErrQuotaExhausted
+	}
+	s.used[id]++
+	return nil
+}
+
+type mockBudgetStore struct {
+	used map[lsat.TokenID]uint32
+}
+
+var _ BudgetStore = (*mockBudgetStore)(nil)
+
+func newMockBudgetStore() *mockBudgetStore {
+	return &mockBudgetStore{
+		used: make(map[lsat.TokenID]uint32),
+	}
+}
+
+func (s *mockBudgetStore) ConsumeBudget(_ context.Context, id lsat.TokenID,
+	budget uint32) error {
+
+	if s.used[id] >= budget {
+		return ErrBudgetExhausted
+	}
+	s.used[id]++
+	return nil
+}
+
+type mockTokenStore struct {
+	tokens   map[lsat.TokenID]*lsat.Identifier
+	expiries map[lsat.TokenID]time.Time
+}
+
+var _ TokenStore = (*mockTokenStore)(nil)
+
+func newMockTokenStore() *mockTokenStore {
+	return &mockTokenStore{
+		tokens:   make(map[lsat.TokenID]*lsat.Identifier),
+		expiries: make(map[lsat.TokenID]time.Time),
+	}
+}
+
+func (s *mockTokenStore) AddToken(_ context.Context, id *lsat.Identifier,
+	_ []lsat.Service, expiry time.Time) error {
+
+	s.tokens[id.TokenID] = id
+	s.expiries[id.TokenID] = expiry
+	return nil
+}
+
+func (s *mockTokenStore) RenewToken(_ context.Context, id lsat.TokenID,
+	expiry time.Time) error {
+
+	if _, ok := s.tokens[id]; ok {
+		s.expiries[id] = expiry
+	}
+	return nil
+}
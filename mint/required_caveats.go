@@ -0,0 +1,42 @@
+package mint
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+var (
+	// ErrMissingCaveat is returned when verifying an LSAT that doesn't
+	// carry one of the custom caveats its service requires.
+	ErrMissingCaveat = errors.New("LSAT is missing a required caveat")
+)
+
+// verifyRequiredCaveats makes sure the given caveats of an LSAT include each
+// of the required ones. As anyone holding an LSAT can add caveats to it, all
+// caveats with the condition of a required one must carry its value, so the
+// claim can't be changed by adding another caveat.
+func verifyRequiredCaveats(caveats, required []lsat.Caveat) error {
+	for _, requiredCaveat := range required {
+		found := false
+		for _, caveat := range caveats {
+			if caveat.Condition != requiredCaveat.Condition {
+				continue
+			}
+			if caveat.Value != requiredCaveat.Value {
+				return fmt.Errorf("caveat %v doesn't match "+
+					"required caveat %v", caveat,
+					requiredCaveat)
+			}
+			found = true
+		}
+
+		if !found {
+			return fmt.Errorf("%w: %v", ErrMissingCaveat,
+				requiredCaveat)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package mint
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+// TokenStore is the store responsible for keeping a record of the minted
+// LSATs, so operators can list and revoke them.
+type TokenStore interface {
+	// AddToken records the LSAT with the given identifier that was minted
+	// for the given services. The expiry is the one the LSAT was issued
+	// with, or the zero time if it doesn't expire.
+	AddToken(ctx context.Context, id *lsat.Identifier,
+		services []lsat.Service, expiry time.Time) error
+
+	// RenewToken records the new expiry of the refreshed LSAT with the
+	// given token ID, or the zero time if it doesn't expire anymore. This
+	// acts as a NOP if there is no record of the LSAT.
+	RenewToken(ctx context.Context, id lsat.TokenID,
+		expiry time.Time) error
+}
+
+// recordToken adds the LSAT with the given encoded identifier to the token
+// store, if there is one.
+func (m *Mint) recordToken(ctx context.Context, id []byte,
+	services []lsat.Service, expiry time.Time) error {
+
+	if m.cfg.Tokens == nil {
+		return nil
+	}
+
+	identifier, err := lsat.DecodeIdentifier(bytes.NewReader(id))
+	if err != nil {
+		return err
+	}
+
+	return m.cfg.Tokens.AddToken(ctx, identifier, services, expiry)
+}
+
+// RevokeLSAT removes the secret of the LSAT with the given identifier, so it
+// can't be used anymore. This acts as a NOP if the LSAT was already revoked.
+func (m *Mint) RevokeLSAT(ctx context.Context, id *lsat.Identifier) error {
+	var buf bytes.Buffer
+	if err := lsat.EncodeIdentifier(&buf, id); err != nil {
+		return err
+	}
+
+	return m.cfg.Secrets.RevokeSecret(ctx, sha256.Sum256(buf.Bytes()))
+}
@@ -0,0 +1,136 @@
+package aperture
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// MockInvoicePrefix is the prefix of every payment request issued by
+	// the mock challenger. It is followed by the hex encoded pre-image of
+	// the invoice.
+	MockInvoicePrefix = "lnmock1"
+
+	// mockPreimageSeed is the seed the pre-images of the mock invoices are
+	// derived from, so they are the same on every start.
+	mockPreimageSeed = "aperture mock challenger"
+)
+
+// MockChallenger is a challenger that issues deterministic mock invoices
+// without ever contacting lnd. Each payment request contains the pre-image of
+// its invoice, so a client can "pay" it by simply extracting the pre-image.
+// The invoices are always reported as settled, unless the challenger is told
+// to simulate settlement failures, in which case they never are. It is only
+// meant for integration tests and CI pipelines that have no lnd node.
+type MockChallenger struct {
+	// failSettlements denotes whether the invoices are reported as never
+	// being settled.
+	failSettlements bool
+
+	mtx   sync.Mutex
+	count uint64
+}
+
+// A compile-time constraint to ensure MockChallenger can be used in place of
+// the LndChallenger.
+var _ mint.Challenger = (*MockChallenger)(nil)
+var _ auth.InvoiceChecker = (*MockChallenger)(nil)
+var _ InvoiceStateSubscriber = (*MockChallenger)(nil)
+
+// NewMockChallenger creates a new mock challenger. If failSettlements is set,
+// none of its invoices are ever reported as settled.
+func NewMockChallenger(failSettlements bool) *MockChallenger {
+	return &MockChallenger{
+		failSettlements: failSettlements,
+	}
+}
+
+// MockPreimage returns the pre-image of the n-th invoice issued by a mock
+// challenger, starting at zero.
+func MockPreimage(n uint64) lntypes.Preimage {
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], n)
+
+	return sha256.Sum256(append([]byte(mockPreimageSeed), index[:]...))
+}
+
+// MockInvoicePreimage extracts the pre-image from the given payment request
+// issued by a mock challenger.
+func MockInvoicePreimage(invoice string) (lntypes.Preimage, error) {
+	if !strings.HasPrefix(invoice, MockInvoicePrefix) {
+		return lntypes.Preimage{}, fmt.Errorf("not a mock invoice")
+	}
+
+	return lntypes.MakePreimageFromStr(
+		strings.TrimPrefix(invoice, MockInvoicePrefix),
+	)
+}
+
+// NewChallenge returns the next deterministic mock invoice and its payment
+// hash.
+//
+// NOTE: This is part of the mint.Challenger interface.
+func (m *MockChallenger) NewChallenge(_ context.Context,
+	price int64) (string, lntypes.Hash, error) {
+
+	m.mtx.Lock()
+	preimage := MockPreimage(m.count)
+	m.count++
+	m.mtx.Unlock()
+
+	hash := preimage.Hash()
+	log.Infof("Issuing mock challenge for %d satoshis with payment hash %v",
+		price, hash)
+
+	return MockInvoicePrefix + hex.EncodeToString(preimage[:]), hash, nil
+}
+
+// VerifyInvoiceStatus reports every invoice as settled, unless settlement
+// failures are simulated. No other state is ever reported.
+//
+// NOTE: This is part of the auth.InvoiceChecker interface.
+func (m *MockChallenger) VerifyInvoiceStatus(hash lntypes.Hash,
+	state lnrpc.Invoice_InvoiceState, _ time.Duration) error {
+
+	if state != lnrpc.Invoice_SETTLED || m.failSettlements {
+		return fmt.Errorf("mock invoice %v not in state %v", hash,
+			state)
+	}
+
+	return nil
+}
+
+// SubscribeInvoiceState immediately sends the final state of the invoice with
+// the given payment hash, which is settled unless settlement failures are
+// simulated.
+//
+// NOTE: This is part of the InvoiceStateSubscriber interface.
+func (m *MockChallenger) SubscribeInvoiceState(
+	_ lntypes.Hash) (<-chan lnrpc.Invoice_InvoiceState, func(), error) {
+
+	states := make(chan lnrpc.Invoice_InvoiceState, 1)
+	if m.failSettlements {
+		states <- lnrpc.Invoice_CANCELED
+	} else {
+		states <- lnrpc.Invoice_SETTLED
+	}
+
+	return states, func() {}, nil
+}
+
+// Available always returns true as the mock challenger never depends on an lnd
+// node.
+func (m *MockChallenger) Available() bool {
+	return true
+}
@@ -0,0 +1,172 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/lightningnetwork/lnd/lntest/wait"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// testMockApertureAddress is the address aperture listens on when
+	// running with mock invoices.
+	testMockApertureAddress = "localhost:8083"
+)
+
+// challengeRegex extracts the macaroon and invoice of an LSAT challenge.
+var challengeRegex = regexp.MustCompile(
+	"LSAT macaroon=\"(.*?)\", invoice=\"(.*?)\"",
+)
+
+// TestMockChallenger makes sure the mock invoices are deterministic and carry
+// their pre-image.
+func TestMockChallenger(t *testing.T) {
+	challenger := NewMockChallenger(false)
+	for i := uint64(0); i < 3; i++ {
+		invoice, hash, err := challenger.NewChallenge(
+			context.Background(), 10,
+		)
+		require.NoError(t, err)
+
+		preimage, err := MockInvoicePreimage(invoice)
+		require.NoError(t, err)
+		require.Equal(t, MockPreimage(i), preimage)
+		require.Equal(t, hash, preimage.Hash())
+	}
+
+	_, err := MockInvoicePreimage("lnbc1")
+	require.Error(t, err)
+}
+
+// TestMockChallengerIntegration runs aperture with mock invoices, which is how
+// it can be used in integration tests and CI pipelines without an lnd node. A
+// client is challenged, builds its LSAT from the pre-image in the mock invoice
+// and is let through, unless settlement failures are simulated and the invoice
+// is looked up to verify the payment.
+func TestMockChallengerIntegration(t *testing.T) {
+	client, cleanup := etcdSetup(t)
+	defer client.Close()
+	defer cleanup()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("paid content"))
+		},
+	))
+	defer backend.Close()
+
+	startAperture := func(failSettlements bool,
+		paymentVerification string) *Aperture {
+
+		cfg := NewConfig()
+		cfg.Insecure = true
+		cfg.ListenAddr = testMockApertureAddress
+		cfg.Authenticator = &AuthConfig{
+			Mock:                true,
+			MockFailSettlements: failSettlements,
+			PaymentVerification: paymentVerification,
+		}
+		cfg.Etcd = &EtcdConfig{Host: "127.0.0.1:9125"}
+		cfg.Services = []*proxy.Service{{
+			Name:       "paid",
+			HostRegexp: ".*",
+			PathRegexp: "^/paid.*$",
+			Address:    strings.TrimPrefix(backend.URL, "http://"),
+			Protocol:   "http",
+			Price:      10,
+		}}
+		require.NoError(t, cfg.validate())
+
+		a := NewAperture(cfg)
+		require.NoError(t, a.Start(make(chan error, 1)))
+
+		return a
+	}
+
+	url := fmt.Sprintf("http://%s/paid", testMockApertureAddress)
+	request := func(authHeader string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+
+		var resp *http.Response
+		err = wait.NoError(func() error {
+			resp, err = http.DefaultClient.Do(req)
+			return err
+		}, apertureStartTimeout)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	// challenge requests the paid content without an LSAT and returns the
+	// macaroon and the pre-image of the mock invoice it is challenged
+	// with.
+	challenge := func() (string, lntypes.Preimage) {
+		resp := request("")
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+
+		matches := challengeRegex.FindStringSubmatch(
+			resp.Header.Get("WWW-Authenticate"),
+		)
+		require.Len(t, matches, 3)
+
+		preimage, err := MockInvoicePreimage(matches[2])
+		require.NoError(t, err)
+
+		return matches[1], preimage
+	}
+
+	// payChallenge returns the LSAT that answers a new challenge.
+	payChallenge := func() string {
+		mac, preimage := challenge()
+		return fmt.Sprintf("LSAT %s:%s", mac, preimage)
+	}
+
+	// The content is served once the mock invoice is "paid".
+	a := startAperture(false, "")
+	resp := request(payChallenge())
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "paid content", string(body))
+	require.NoError(t, a.Stop())
+
+	// If settlement failures are simulated, the client is challenged
+	// again.
+	a = startAperture(true, PaymentVerificationInvoice)
+	resp = request(payChallenge())
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+	require.NoError(t, a.Stop())
+
+	// Unless the pre-image is accepted as the proof of payment without
+	// looking up the invoice.
+	a = startAperture(true, PaymentVerificationPreimage)
+	defer func() {
+		require.NoError(t, a.Stop())
+	}()
+	resp = request(payChallenge())
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A pre-image that doesn't match the payment hash of the LSAT is
+	// still rejected.
+	mac, _ := challenge()
+	resp = request(fmt.Sprintf("LSAT %s:%s", mac, MockPreimage(1000)))
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+}
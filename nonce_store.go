@@ -0,0 +1,101 @@
+package aperture
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// noncesPrefix is the key we'll use to prefix the nonces used with
+	// each LSAT with when storing them in an etcd cluster.
+	noncesPrefix = "nonces"
+
+	// defaultNonceWindow is the default time around its creation a nonce
+	// is accepted for.
+	defaultNonceWindow = 5 * time.Minute
+)
+
+// ReplayProtectionConfig is the configuration of the protection against
+// clients replaying requests with intercepted LSATs.
+type ReplayProtectionConfig struct {
+	// Enabled requires every request carrying an LSAT to also carry a
+	// nonce that was never used with that LSAT before.
+	Enabled bool `long:"enabled" description:"Require every request carrying an LSAT to also carry a unique nonce in the X-Request-Nonce header and reject requests that reuse one with a 400 error."`
+
+	// NonceWindow is the time around its creation a nonce is accepted
+	// for. Used nonces are remembered for as long.
+	NonceWindow time.Duration `long:"noncewindow" description:"The time before and after its creation a nonce is accepted for. Clients' clocks must not be off by more than that. Defaults to 5 minutes."`
+}
+
+// enabled returns true if replay protection is enabled.
+func (c *ReplayProtectionConfig) enabled() bool {
+	return c != nil && c.Enabled
+}
+
+// nonceKey returns the full key to store the given nonce used with the LSAT
+// with the given token ID under.
+//
+// The resulting path of the nonce 1600000000-ab12 used with the token ID
+// bff4ee83 within etcd would look like:
+//
+//	lsat/proxy/nonces/bff4ee83/1600000000-ab12
+func nonceKey(id lsat.TokenID, nonce string) string {
+	return strings.Join(
+		[]string{topLevelKey, noncesPrefix, id.String(), nonce},
+		etcdKeyDelimeter,
+	)
+}
+
+// nonceStore keeps track of the nonces used with each LSAT in an etcd cluster,
+// so they are shared by all aperture instances.
+type nonceStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure nonceStore implements auth.NonceStore.
+var _ auth.NonceStore = (*nonceStore)(nil)
+
+// newNonceStore instantiates a new nonce store backed by an etcd cluster.
+func newNonceStore(client *clientv3.Client) *nonceStore {
+	return &nonceStore{Client: client}
+}
+
+// UseNonce records the nonce as used with the LSAT with the given ID for the
+// given duration. If it was already used, auth.ErrNonceReused is returned.
+//
+// NOTE: This is part of the auth.NonceStore interface.
+func (s *nonceStore) UseNonce(ctx context.Context, id lsat.TokenID,
+	nonce string, ttl time.Duration) error {
+
+	// Leases can only be granted for whole seconds, so we'd rather
+	// remember a nonce a little longer than needed.
+	lease, err := s.Grant(ctx, int64(math.Ceil(ttl.Seconds())))
+	if err != nil {
+		return err
+	}
+
+	// The nonce is only stored if it doesn't exist yet, which happens
+	// atomically, so concurrent requests can't both use it.
+	key := nonceKey(id, nonce)
+	txnResp, err := s.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, "", clientv3.WithLease(lease.ID))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		// The lease isn't needed anymore, it expires on its own if
+		// revoking it fails.
+		_, _ = s.Revoke(ctx, lease.ID)
+		return auth.ErrNonceReused
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestNonceStore ensures a nonce can only be used once with each LSAT.
+func TestNonceStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	store := newNonceStore(etcdClient)
+
+	id := lsat.TokenID{1}
+	require.NoError(t, store.UseNonce(ctx, id, "1-aa", time.Minute))
+	require.Equal(
+		t, auth.ErrNonceReused,
+		store.UseNonce(ctx, id, "1-aa", time.Minute),
+	)
+	require.NoError(t, store.UseNonce(ctx, id, "1-bb", time.Minute))
+
+	// Another LSAT can use the same nonce. A store backed by the same
+	// etcd cluster, like another aperture instance, sees the used nonces.
+	otherID := lsat.TokenID{2}
+	require.NoError(t, store.UseNonce(ctx, otherID, "1-aa", time.Minute))
+	other := newNonceStore(etcdClient)
+	require.Equal(
+		t, auth.ErrNonceReused,
+		other.UseNonce(ctx, otherID, "1-aa", time.Minute),
+	)
+
+	// The nonce is stored with a lease that covers the TTL.
+	resp, err := etcdClient.Get(ctx, nonceKey(id, "1-aa"))
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	ttl, err := etcdClient.TimeToLive(
+		ctx, clientv3.LeaseID(resp.Kvs[0].Lease),
+	)
+	require.NoError(t, err)
+	require.InDelta(t, time.Minute.Seconds(), float64(ttl.TTL), 5)
+}
@@ -0,0 +1,253 @@
+package aperture
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lightningnetwork/lnd/tor"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// onionBackupVersion is the version of the onion key backup format.
+	onionBackupVersion = 1
+
+	// onionBackupEncryptionNone denotes an onion key backup whose private
+	// key is stored in plaintext.
+	onionBackupEncryptionNone = "none"
+
+	// onionBackupEncryption denotes an onion key backup whose private key
+	// is encrypted with NaCl secretbox using a key derived from a password
+	// with scrypt.
+	onionBackupEncryption = "scrypt-secretbox"
+
+	// The scrypt parameters used to derive the encryption key of a backup
+	// from its password.
+	onionBackupScryptN = 1 << 15
+	onionBackupScryptR = 8
+	onionBackupScryptP = 1
+
+	// onionBackupSaltSize is the size of the random scrypt salt.
+	onionBackupSaltSize = 16
+)
+
+var (
+	// ErrOnionBackupPassword is returned when an onion key backup can't be
+	// decrypted with the given password.
+	ErrOnionBackupPassword = errors.New("wrong password or corrupted " +
+		"onion key backup")
+)
+
+// onionBackup is the format onion service private keys are exported in.
+type onionBackup struct {
+	Version    int    `json:"version"`
+	OnionType  string `json:"onion_type"`
+	Encryption string `json:"encryption"`
+
+	// Salt is the scrypt salt the encryption key was derived with. It is
+	// empty if the backup isn't encrypted.
+	Salt []byte `json:"salt,omitempty"`
+
+	// Nonce is the secretbox nonce. It is empty if the backup isn't
+	// encrypted.
+	Nonce []byte `json:"nonce,omitempty"`
+
+	// PrivateKey is the private key, encrypted unless Encryption is none.
+	PrivateKey []byte `json:"private_key"`
+}
+
+// NewEtcdOnionStore connects to the etcd cluster described by the given config
+// and returns the onion store aperture keeps its onion service private keys in.
+// The returned function closes the connection.
+func NewEtcdOnionStore(cfg *EtcdConfig) (tor.OnionStore, func(), error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{cfg.Host},
+		DialTimeout: 5 * time.Second,
+		Username:    cfg.User,
+		Password:    cfg.Password,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to connect to etcd: %v",
+			err)
+	}
+
+	return newOnionStore(client), func() { _ = client.Close() }, nil
+}
+
+// ParseOnionType parses the name of an onion service version, either v2 or v3.
+func ParseOnionType(name string) (tor.OnionType, error) {
+	switch name {
+	case onionV2Dir:
+		return tor.V2, nil
+
+	case onionV3Dir:
+		return tor.V3, nil
+
+	default:
+		return 0, fmt.Errorf("unknown onion type %q", name)
+	}
+}
+
+// onionTypeName returns the name of the given onion service version.
+func onionTypeName(onionType tor.OnionType) (string, error) {
+	switch onionType {
+	case tor.V2:
+		return onionV2Dir, nil
+
+	case tor.V3:
+		return onionV3Dir, nil
+
+	default:
+		return "", fmt.Errorf("unknown onion type %v", onionType)
+	}
+}
+
+// onionBackupKey derives the secretbox key of a backup from its password.
+func onionBackupKey(password, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key(
+		password, salt, onionBackupScryptN, onionBackupScryptR,
+		onionBackupScryptP, 32,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [32]byte
+	copy(key[:], derived)
+
+	return &key, nil
+}
+
+// ExportOnionKey exports the private key of the onion service of the given type
+// from the store. The key is encrypted with the given password unless it is
+// empty.
+func ExportOnionKey(store tor.OnionStore, onionType tor.OnionType,
+	password []byte) ([]byte, error) {
+
+	typeName, err := onionTypeName(onionType)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := store.PrivateKey(onionType)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s onion private key: "+
+			"%v", typeName, err)
+	}
+
+	backup := &onionBackup{
+		Version:    onionBackupVersion,
+		OnionType:  typeName,
+		Encryption: onionBackupEncryptionNone,
+		PrivateKey: privateKey,
+	}
+	if len(password) > 0 {
+		backup.Encryption = onionBackupEncryption
+		backup.Salt = make([]byte, onionBackupSaltSize)
+		if _, err := rand.Read(backup.Salt); err != nil {
+			return nil, err
+		}
+
+		var nonce [24]byte
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return nil, err
+		}
+		backup.Nonce = nonce[:]
+
+		key, err := onionBackupKey(password, backup.Salt)
+		if err != nil {
+			return nil, err
+		}
+		backup.PrivateKey = secretbox.Seal(nil, privateKey, &nonce, key)
+	}
+
+	return json.MarshalIndent(backup, "", "  ")
+}
+
+// OnionBackupEncrypted returns true if the given onion key backup is
+// encrypted and therefore requires a password to be imported.
+func OnionBackupEncrypted(encoded []byte) (bool, error) {
+	var backup onionBackup
+	if err := json.Unmarshal(encoded, &backup); err != nil {
+		return false, fmt.Errorf("invalid onion key backup: %v", err)
+	}
+
+	return backup.Encryption != onionBackupEncryptionNone, nil
+}
+
+// ImportOnionKey decrypts the given onion key backup with the password and
+// stores the private key it contains. Unless overwrite is set, an existing
+// private key of the same onion type is never replaced. The type of the
+// imported onion service is returned.
+func ImportOnionKey(store tor.OnionStore, encoded, password []byte,
+	overwrite bool) (tor.OnionType, error) {
+
+	var backup onionBackup
+	if err := json.Unmarshal(encoded, &backup); err != nil {
+		return 0, fmt.Errorf("invalid onion key backup: %v", err)
+	}
+	if backup.Version != onionBackupVersion {
+		return 0, fmt.Errorf("unsupported onion key backup version %d",
+			backup.Version)
+	}
+
+	onionType, err := ParseOnionType(backup.OnionType)
+	if err != nil {
+		return 0, err
+	}
+
+	privateKey := backup.PrivateKey
+	switch backup.Encryption {
+	case onionBackupEncryptionNone:
+
+	case onionBackupEncryption:
+		if len(backup.Nonce) != 24 {
+			return 0, errors.New("invalid onion key backup nonce")
+		}
+		var nonce [24]byte
+		copy(nonce[:], backup.Nonce)
+
+		key, err := onionBackupKey(password, backup.Salt)
+		if err != nil {
+			return 0, err
+		}
+
+		var ok bool
+		privateKey, ok = secretbox.Open(
+			nil, backup.PrivateKey, &nonce, key,
+		)
+		if !ok {
+			return 0, ErrOnionBackupPassword
+		}
+
+	default:
+		return 0, fmt.Errorf("unsupported onion key backup "+
+			"encryption %q", backup.Encryption)
+	}
+
+	if len(privateKey) == 0 {
+		return 0, errors.New("onion key backup contains no private key")
+	}
+
+	_, err = store.PrivateKey(onionType)
+	switch {
+	case err == nil && !overwrite:
+		return 0, fmt.Errorf("a %s onion private key already exists",
+			backup.OnionType)
+
+	case err != nil && err != tor.ErrNoPrivateKey:
+		return 0, err
+	}
+
+	if err := store.StorePrivateKey(onionType, privateKey); err != nil {
+		return 0, fmt.Errorf("unable to store %s onion private key: %v",
+			backup.OnionType, err)
+	}
+
+	return onionType, nil
+}
@@ -0,0 +1,61 @@
+package aperture
+
+import (
+	"testing"
+
+	"github.com/lightningnetwork/lnd/tor"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOnionKeyBackup makes sure onion private keys can be exported and imported
+// again, with and without encryption.
+func TestOnionKeyBackup(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	store := newOnionStore(etcdClient)
+	privateKey := []byte("ED25519-V3:private-key")
+	require.NoError(t, store.StorePrivateKey(tor.V3, privateKey))
+
+	password := []byte("hunter2")
+	encrypted, err := ExportOnionKey(store, tor.V3, password)
+	require.NoError(t, err)
+	require.NotContains(t, string(encrypted), "private-key")
+
+	isEncrypted, err := OnionBackupEncrypted(encrypted)
+	require.NoError(t, err)
+	require.True(t, isEncrypted)
+
+	plain, err := ExportOnionKey(store, tor.V3, nil)
+	require.NoError(t, err)
+	isEncrypted, err = OnionBackupEncrypted(plain)
+	require.NoError(t, err)
+	require.False(t, isEncrypted)
+
+	// An existing key isn't replaced unless asked to.
+	_, err = ImportOnionKey(store, encrypted, password, false)
+	require.Error(t, err)
+
+	require.NoError(t, store.DeletePrivateKey(tor.V3))
+
+	// The wrong password must not be accepted.
+	_, err = ImportOnionKey(store, encrypted, []byte("wrong"), false)
+	require.Equal(t, ErrOnionBackupPassword, err)
+
+	onionType, err := ImportOnionKey(store, encrypted, password, false)
+	require.NoError(t, err)
+	require.Equal(t, tor.V3, onionType)
+
+	imported, err := store.PrivateKey(tor.V3)
+	require.NoError(t, err)
+	require.Equal(t, privateKey, imported)
+
+	// The unencrypted backup can replace the key when asked to.
+	_, err = ImportOnionKey(store, plain, nil, true)
+	require.NoError(t, err)
+
+	// Keys that don't exist can't be exported.
+	_, err = ExportOnionKey(store, tor.V2, nil)
+	require.Error(t, err)
+}
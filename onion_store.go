@@ -2,7 +2,6 @@ package aperture
 
 import (
 	"context"
-	"fmt"
 	"strings"
 
 	"github.com/lightningnetwork/lnd/tor"
@@ -26,14 +25,9 @@ const (
 // onionPath returns the full path to an onion service's private key of the
 // given type.
 func onionPath(onionType tor.OnionType) (string, error) {
-	var typeDir string
-	switch onionType {
-	case tor.V2:
-		typeDir = onionV2Dir
-	case tor.V3:
-		typeDir = onionV3Dir
-	default:
-		return "", fmt.Errorf("unknown onion type %v", onionType)
+	typeDir, err := onionTypeName(onionType)
+	if err != nil {
+		return "", err
 	}
 
 	return strings.Join(
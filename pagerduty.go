@@ -0,0 +1,300 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// pagerDutyEventsURL is the endpoint of the PagerDuty Events API v2.
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+	// pagerDutyQueueSize is the maximum number of events we queue for
+	// delivery before we start dropping new ones.
+	pagerDutyQueueSize = 100
+
+	// pagerDutyMaxAttempts is the maximum number of times we try to deliver
+	// a single event before giving up on it.
+	pagerDutyMaxAttempts = 5
+
+	// pagerDutyInitialBackoff is the time we wait before retrying to
+	// deliver an event for the first time. The backoff is doubled after
+	// each failed attempt.
+	pagerDutyInitialBackoff = time.Second
+
+	// pagerDutyRequestTimeout is the maximum time a single request to the
+	// PagerDuty API can take.
+	pagerDutyRequestTimeout = 10 * time.Second
+
+	// pagerDutyFlushTimeout is the maximum time we spend delivering queued
+	// events when shutting down.
+	pagerDutyFlushTimeout = 10 * time.Second
+
+	// pagerDutyActionTrigger is the event action that opens an incident.
+	pagerDutyActionTrigger = "trigger"
+
+	// pagerDutyActionResolve is the event action that resolves an incident.
+	pagerDutyActionResolve = "resolve"
+)
+
+// PagerDutyConfig is the configuration for sending critical operational events
+// to PagerDuty.
+type PagerDutyConfig struct {
+	// IntegrationKey is the integration (routing) key of the PagerDuty
+	// service events should be sent to. Alerting to PagerDuty is disabled
+	// if this is empty.
+	IntegrationKey string `long:"integrationkey" description:"The integration key of the PagerDuty Events API v2 integration to send critical events to. Leave empty to disable PagerDuty alerting."`
+}
+
+// pagerDutyPayload is the payload of a PagerDuty trigger event.
+type pagerDutyPayload struct {
+	Summary   string `json:"summary"`
+	Source    string `json:"source"`
+	Severity  string `json:"severity"`
+	Component string `json:"component"`
+	Timestamp string `json:"timestamp"`
+}
+
+// pagerDutyEvent is a single event as expected by the PagerDuty Events API v2.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+// pagerDutyAlerter is an alerter that sends events to the PagerDuty Events API
+// v2. Events are queued and delivered by a background goroutine that retries
+// failed deliveries.
+type pagerDutyAlerter struct {
+	cfg *PagerDutyConfig
+
+	url            string
+	source         string
+	initialBackoff time.Duration
+	client         *http.Client
+
+	queue chan *pagerDutyEvent
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// A compile-time constraint to ensure pagerDutyAlerter implements alerter.
+var _ alerter = (*pagerDutyAlerter)(nil)
+
+// newPagerDutyAlerter creates a new PagerDuty alerter from the given config.
+func newPagerDutyAlerter(cfg *PagerDutyConfig) *pagerDutyAlerter {
+	// We use the host name as the source of our events so the operator
+	// knows which instance is affected.
+	source, err := os.Hostname()
+	if err != nil {
+		source = "aperture"
+	}
+
+	return &pagerDutyAlerter{
+		cfg:            cfg,
+		url:            pagerDutyEventsURL,
+		source:         source,
+		initialBackoff: pagerDutyInitialBackoff,
+		client: &http.Client{
+			Timeout: pagerDutyRequestTimeout,
+		},
+		queue: make(chan *pagerDutyEvent, pagerDutyQueueSize),
+		quit:  make(chan struct{}),
+	}
+}
+
+// Start starts the goroutine that delivers the queued events.
+//
+// NOTE: This is part of the alerter interface.
+func (p *pagerDutyAlerter) Start() error {
+	p.wg.Add(1)
+	go p.deliverEvents()
+
+	return nil
+}
+
+// Stop shuts down the alerter. Events that are still queued are delivered on
+// a best effort basis until the flush timeout is reached.
+//
+// NOTE: This is part of the alerter interface.
+func (p *pagerDutyAlerter) Stop() {
+	close(p.quit)
+	p.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), pagerDutyFlushTimeout,
+	)
+	defer cancel()
+
+	for {
+		select {
+		case event := <-p.queue:
+			if err := p.send(ctx, event); err != nil {
+				log.Errorf("Unable to deliver PagerDuty event "+
+					"%s on shutdown: %v", event.DedupKey,
+					err)
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+// Trigger queues a trigger event for the given alert.
+//
+// NOTE: This is part of the alerter interface.
+func (p *pagerDutyAlerter) Trigger(al *alert) {
+	p.enqueue(&pagerDutyEvent{
+		RoutingKey:  p.cfg.IntegrationKey,
+		EventAction: pagerDutyActionTrigger,
+		DedupKey:    al.key,
+		Payload: &pagerDutyPayload{
+			Summary:   al.summary,
+			Source:    p.source,
+			Severity:  string(al.severity),
+			Component: "aperture",
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+}
+
+// Resolve queues a resolve event for the condition with the given key.
+//
+// NOTE: This is part of the alerter interface.
+func (p *pagerDutyAlerter) Resolve(key string) {
+	p.enqueue(&pagerDutyEvent{
+		RoutingKey:  p.cfg.IntegrationKey,
+		EventAction: pagerDutyActionResolve,
+		DedupKey:    key,
+	})
+}
+
+// enqueue adds an event to the delivery queue. If the queue is full, the event
+// is dropped as we don't want to block the caller.
+func (p *pagerDutyAlerter) enqueue(event *pagerDutyEvent) {
+	select {
+	case p.queue <- event:
+	default:
+		log.Errorf("PagerDuty event queue full, dropping %s event for "+
+			"%s", event.EventAction, event.DedupKey)
+	}
+}
+
+// deliverEvents delivers all queued events one by one, retrying each of them
+// with an exponential backoff.
+//
+// NOTE: This must be run as a goroutine.
+func (p *pagerDutyAlerter) deliverEvents() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case event := <-p.queue:
+			p.deliverWithRetry(event)
+
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// deliverWithRetry tries to deliver a single event until it either succeeds,
+// the maximum number of attempts is reached or the alerter is shutting down.
+func (p *pagerDutyAlerter) deliverWithRetry(event *pagerDutyEvent) {
+	backoff := p.initialBackoff
+	for attempt := 1; attempt <= pagerDutyMaxAttempts; attempt++ {
+		err := p.send(context.Background(), event)
+		if err == nil {
+			log.Debugf("Delivered PagerDuty %s event for %s",
+				event.EventAction, event.DedupKey)
+			return
+		}
+
+		log.Warnf("Unable to deliver PagerDuty event %s (attempt "+
+			"%d of %d): %v", event.DedupKey, attempt,
+			pagerDutyMaxAttempts, err)
+
+		// Permanent errors like an invalid integration key won't go
+		// away by retrying.
+		if _, ok := err.(*pagerDutyPermanentError); ok {
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+
+		case <-p.quit:
+			// Put the event back so it is retried once more when
+			// flushing the queue on shutdown.
+			p.enqueue(event)
+			return
+		}
+	}
+
+	log.Errorf("Giving up delivering PagerDuty event %s after %d attempts",
+		event.DedupKey, pagerDutyMaxAttempts)
+}
+
+// pagerDutyPermanentError is returned if the PagerDuty API rejected an event
+// in a way that retrying won't fix.
+type pagerDutyPermanentError struct {
+	status int
+}
+
+// Error returns the error as a human readable string.
+func (e *pagerDutyPermanentError) Error() string {
+	return fmt.Sprintf("event rejected by PagerDuty with status %d",
+		e.status)
+}
+
+// send does a single attempt at delivering an event to the PagerDuty API.
+func (p *pagerDutyAlerter) send(ctx context.Context,
+	event *pagerDutyEvent) error {
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, p.url, bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusAccepted,
+		resp.StatusCode == http.StatusOK:
+
+		return nil
+
+	// Rate limiting and server errors are temporary, everything else in
+	// the 4xx range means the event itself is faulty.
+	case resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= http.StatusInternalServerError:
+
+		return fmt.Errorf("PagerDuty returned status %d",
+			resp.StatusCode)
+
+	default:
+		return &pagerDutyPermanentError{status: resp.StatusCode}
+	}
+}
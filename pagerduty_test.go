@@ -0,0 +1,121 @@
+package aperture
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPagerDutyAlerter makes sure events are delivered to the PagerDuty API
+// and that failed deliveries are retried.
+func TestPagerDutyAlerter(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests int
+		events   = make(chan *pagerDutyEvent, 10)
+	)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			requests++
+			first := requests == 1
+			mtx.Unlock()
+
+			// Fail the very first request to trigger a retry.
+			if first {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			event := &pagerDutyEvent{}
+			err := json.NewDecoder(r.Body).Decode(event)
+			require.NoError(t, err)
+			events <- event
+
+			w.WriteHeader(http.StatusAccepted)
+		},
+	))
+	defer server.Close()
+
+	alerter := newPagerDutyAlerter(&PagerDutyConfig{
+		IntegrationKey: "foo",
+	})
+	alerter.url = server.URL
+	alerter.initialBackoff = time.Millisecond
+	require.NoError(t, alerter.Start())
+	defer alerter.Stop()
+
+	al := alertFromError(&lndConnectionError{err: errors.New("EOF")})
+	require.Equal(t, alertKeyLndConnection, al.key)
+	require.Equal(t, severityCritical, al.severity)
+
+	alerter.Trigger(al)
+	alerter.Resolve(alertKeyLndConnection)
+
+	select {
+	case event := <-events:
+		require.Equal(t, "foo", event.RoutingKey)
+		require.Equal(t, pagerDutyActionTrigger, event.EventAction)
+		require.Equal(t, alertKeyLndConnection, event.DedupKey)
+		require.NotNil(t, event.Payload)
+		require.Equal(t, "critical", event.Payload.Severity)
+		require.Contains(t, event.Payload.Summary, "EOF")
+
+	case <-time.After(defaultTimeout):
+		t.Fatalf("trigger event not received")
+	}
+
+	select {
+	case event := <-events:
+		require.Equal(t, pagerDutyActionResolve, event.EventAction)
+		require.Equal(t, alertKeyLndConnection, event.DedupKey)
+		require.Nil(t, event.Payload)
+
+	case <-time.After(defaultTimeout):
+		t.Fatalf("resolve event not received")
+	}
+
+	mtx.Lock()
+	require.Equal(t, 3, requests)
+	mtx.Unlock()
+}
+
+// TestPagerDutyPermanentError makes sure events rejected by the API aren't
+// retried.
+func TestPagerDutyPermanentError(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests int
+	)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			requests++
+			mtx.Unlock()
+
+			w.WriteHeader(http.StatusBadRequest)
+		},
+	))
+	defer server.Close()
+
+	alerter := newPagerDutyAlerter(&PagerDutyConfig{
+		IntegrationKey: "foo",
+	})
+	alerter.url = server.URL
+	alerter.initialBackoff = time.Millisecond
+
+	alerter.deliverWithRetry(&pagerDutyEvent{
+		EventAction: pagerDutyActionResolve,
+		DedupKey:    alertKeyGeneric,
+	})
+
+	mtx.Lock()
+	require.Equal(t, 1, requests)
+	mtx.Unlock()
+}
@@ -0,0 +1,263 @@
+package aperture
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// paymentStreamPath is the path of the WebSocket endpoint clients can
+	// connect to after receiving a payment challenge to be notified once
+	// the invoice settles.
+	paymentStreamPath = "/v1/payment/stream"
+
+	// defaultPaymentStreamTimeout is the default maximum time a client
+	// can wait for an invoice to settle. Clients that still want to wait
+	// afterwards need to connect again.
+	defaultPaymentStreamTimeout = 10 * time.Minute
+
+	// paymentStreamPingInterval is the interval at which we ping the
+	// client to keep the connection alive while waiting for the invoice.
+	paymentStreamPingInterval = 30 * time.Second
+
+	// paymentStreamWriteTimeout is the maximum time we wait for a message
+	// to be written to the client.
+	paymentStreamWriteTimeout = 10 * time.Second
+)
+
+var (
+	// ErrUnknownInvoice is returned when subscribing to the state of an
+	// invoice that doesn't exist or already failed.
+	ErrUnknownInvoice = errors.New("unknown invoice")
+
+	// ErrTooManySubscribers is returned when subscribing to the state of
+	// an invoice while too many subscribers are waiting already.
+	ErrTooManySubscribers = errors.New("too many subscribers")
+)
+
+// InvoiceStateSubscriber is an interface for subscribing to the final state of
+// an invoice.
+type InvoiceStateSubscriber interface {
+	// SubscribeInvoiceState subscribes to the final state of the invoice
+	// with the given payment hash. Exactly one state is sent on the
+	// returned channel once the invoice settled or failed. The channel is
+	// closed if no state will ever be sent. The returned function cancels
+	// the subscription. ErrUnknownInvoice is returned if the invoice
+	// doesn't exist or already failed, and ErrTooManySubscribers if no
+	// more subscribers are accepted.
+	SubscribeInvoiceState(hash lntypes.Hash) (
+		<-chan lnrpc.Invoice_InvoiceState, func(), error)
+}
+
+// A compile time flag to ensure the LndChallenger satisfies the
+// InvoiceStateSubscriber interface.
+var _ InvoiceStateSubscriber = (*LndChallenger)(nil)
+
+// paymentStreamMessage is the JSON message that is pushed to the client once
+// the invoice it waits for settled or failed.
+type paymentStreamMessage struct {
+	// PaymentHash is the hex encoded payment hash of the invoice.
+	PaymentHash string `json:"payment_hash"`
+
+	// State is the final state of the invoice, either SETTLED or
+	// CANCELED.
+	State string `json:"state"`
+
+	// Settled is true if the invoice was paid.
+	Settled bool `json:"settled"`
+}
+
+// paymentStreamServer serves the WebSocket endpoint that pushes the final
+// state of an invoice to the client.
+type paymentStreamServer struct {
+	subscriber InvoiceStateSubscriber
+	timeout    time.Duration
+	upgrader   websocket.Upgrader
+}
+
+// newPaymentStreamServer creates a new payment stream server that is notified
+// about invoice states by the given subscriber. Clients can wait for an
+// invoice to settle for up to the given timeout.
+func newPaymentStreamServer(subscriber InvoiceStateSubscriber,
+	timeout time.Duration) *paymentStreamServer {
+
+	return &paymentStreamServer{
+		subscriber: subscriber,
+		timeout:    timeout,
+		upgrader: websocket.Upgrader{
+			// The endpoint only reveals whether an invoice the
+			// client knows the payment hash of was paid, so wallets
+			// served from any origin may connect.
+			CheckOrigin: func(*http.Request) bool {
+				return true
+			},
+		},
+	}
+}
+
+// isHandling returns true if the given request is meant for the payment stream
+// endpoint.
+func (s *paymentStreamServer) isHandling(r *http.Request) bool {
+	return r.URL.Path == paymentStreamPath
+}
+
+// ServeHTTP upgrades the connection to a WebSocket, waits for the invoice with
+// the payment hash given in the query to settle or fail, sends a single JSON
+// message with the result and closes the connection. Plain GET requests are
+// told to upgrade.
+func (s *paymentStreamServer) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(
+			w, "method not allowed", http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	hash, err := lntypes.MakeHashFromStr(r.URL.Query().Get("payment_hash"))
+	if err != nil {
+		http.Error(w, "invalid payment_hash", http.StatusBadRequest)
+		return
+	}
+
+	if !websocket.IsWebSocketUpgrade(r) {
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(
+			w, "websocket upgrade required",
+			http.StatusUpgradeRequired,
+		)
+		return
+	}
+
+	// Subscribe before upgrading so we can't miss the invoice settling
+	// in between.
+	stateChan, cancel, err := s.subscriber.SubscribeInvoiceState(hash)
+	switch {
+	case errors.Is(err, ErrUnknownInvoice):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+
+	case errors.Is(err, ErrTooManySubscribers):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+
+	case err != nil:
+		log.Errorf("Unable to subscribe to invoice %v: %v", hash, err)
+		http.Error(
+			w, "internal server error",
+			http.StatusInternalServerError,
+		)
+		return
+	}
+	defer cancel()
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already responded with an error.
+		log.Debugf("Unable to upgrade payment stream connection: %v",
+			err)
+		return
+	}
+	defer conn.Close()
+
+	// We don't expect any messages from the client, but we need to read
+	// to process control frames and to notice the client going away.
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	pingTicker := time.NewTicker(paymentStreamPingInterval)
+	defer pingTicker.Stop()
+
+	timeout := time.NewTimer(s.timeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case state, ok := <-stateChan:
+			if !ok {
+				s.close(
+					conn, websocket.CloseGoingAway,
+					"server shutting down",
+				)
+				return
+			}
+
+			s.sendState(conn, hash, state)
+			return
+
+		case <-pingTicker.C:
+			err := conn.WriteControl(
+				websocket.PingMessage, nil,
+				time.Now().Add(paymentStreamWriteTimeout),
+			)
+			if err != nil {
+				log.Debugf("Unable to ping payment stream "+
+					"client: %v", err)
+				return
+			}
+
+		case <-timeout.C:
+			s.close(
+				conn, websocket.CloseNormalClosure,
+				"timed out waiting for payment",
+			)
+			return
+
+		case <-clientGone:
+			return
+		}
+	}
+}
+
+// sendState sends the final state of the invoice to the client and closes the
+// connection.
+func (s *paymentStreamServer) sendState(conn *websocket.Conn,
+	hash lntypes.Hash, state lnrpc.Invoice_InvoiceState) {
+
+	err := conn.SetWriteDeadline(time.Now().Add(paymentStreamWriteTimeout))
+	if err != nil {
+		log.Debugf("Unable to set payment stream deadline: %v", err)
+		return
+	}
+
+	err = conn.WriteJSON(&paymentStreamMessage{
+		PaymentHash: hash.String(),
+		State:       state.String(),
+		Settled:     state == lnrpc.Invoice_SETTLED,
+	})
+	if err != nil {
+		log.Debugf("Unable to send payment stream message: %v", err)
+		return
+	}
+
+	s.close(conn, websocket.CloseNormalClosure, "")
+}
+
+// close sends a close message with the given code and reason to the client.
+func (s *paymentStreamServer) close(conn *websocket.Conn, code int,
+	reason string) {
+
+	err := conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(paymentStreamWriteTimeout),
+	)
+	if err != nil {
+		log.Debugf("Unable to close payment stream: %v", err)
+	}
+}
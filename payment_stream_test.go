@@ -0,0 +1,115 @@
+package aperture
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// mockStateSubscriber is an invoice state subscriber that hands out the same
+// channel for every subscription, or rejects every subscription with err if it
+// is set.
+type mockStateSubscriber struct {
+	stateChan  chan lnrpc.Invoice_InvoiceState
+	subscribed chan lntypes.Hash
+	err        error
+}
+
+func (m *mockStateSubscriber) SubscribeInvoiceState(
+	hash lntypes.Hash) (<-chan lnrpc.Invoice_InvoiceState, func(), error) {
+
+	if m.err != nil {
+		return nil, nil, m.err
+	}
+
+	m.subscribed <- hash
+	return m.stateChan, func() {}, nil
+}
+
+// TestPaymentStream makes sure the final state of an invoice is pushed to the
+// client and the connection is closed afterwards.
+func TestPaymentStream(t *testing.T) {
+	t.Parallel()
+
+	subscriber := &mockStateSubscriber{
+		stateChan:  make(chan lnrpc.Invoice_InvoiceState, 1),
+		subscribed: make(chan lntypes.Hash, 1),
+	}
+	server := httptest.NewServer(newPaymentStreamServer(
+		subscriber, defaultPaymentStreamTimeout,
+	))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") +
+		paymentStreamPath + "?payment_hash="
+
+	// An invalid payment hash should be rejected before upgrading.
+	_, resp, err := websocket.DefaultDialer.Dial(url+"invalid", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// A plain GET request is told to upgrade.
+	hash := lntypes.Hash{1, 2, 3}
+	resp, err = http.Get(server.URL + paymentStreamPath +
+		"?payment_hash=" + hash.String())
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+	require.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+hash.String(), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.Equal(t, hash, <-subscriber.subscribed)
+	subscriber.stateChan <- lnrpc.Invoice_SETTLED
+
+	var msg paymentStreamMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, paymentStreamMessage{
+		PaymentHash: hash.String(),
+		State:       "SETTLED",
+		Settled:     true,
+	}, msg)
+
+	// The server should close the connection after the message.
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(
+		err, websocket.CloseNormalClosure,
+	))
+}
+
+// TestPaymentStreamRejected makes sure subscriptions the challenger refuses are
+// rejected before upgrading the connection.
+func TestPaymentStreamRejected(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{ErrUnknownInvoice, http.StatusNotFound},
+		{ErrTooManySubscribers, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		subscriber := &mockStateSubscriber{err: test.err}
+		server := httptest.NewServer(newPaymentStreamServer(
+			subscriber, defaultPaymentStreamTimeout,
+		))
+
+		hash := lntypes.Hash{1, 2, 3}
+		url := "ws" + strings.TrimPrefix(server.URL, "http") +
+			paymentStreamPath + "?payment_hash=" + hash.String()
+		_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		server.Close()
+
+		require.Error(t, err)
+		require.Equal(t, test.status, resp.StatusCode)
+	}
+}
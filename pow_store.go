@@ -0,0 +1,137 @@
+package aperture
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// powPrefix is the key we'll use to prefix the state of the
+	// proof-of-work fallback with when storing it in an etcd cluster.
+	powPrefix = "pow"
+
+	// powSecretSuffix is the suffix of the key the secret that
+	// authenticates proof-of-work challenges is stored under.
+	powSecretSuffix = "secret"
+
+	// powUsedPrefix is the prefix of the keys the used proof-of-work
+	// challenges are stored under.
+	powUsedPrefix = "used"
+)
+
+// powSecretKey returns the full key the secret that authenticates
+// proof-of-work challenges is stored under.
+//
+// The resulting path within etcd looks like:
+//
+//	lsat/proxy/pow/secret
+func powSecretKey() string {
+	return strings.Join(
+		[]string{topLevelKey, powPrefix, powSecretSuffix},
+		etcdKeyDelimeter,
+	)
+}
+
+// powUsedKey returns the full key to store the given proof-of-work challenge
+// under once its solution was used.
+//
+// The resulting path of the challenge AAAA within etcd would look like:
+//
+//	lsat/proxy/pow/used/AAAA
+func powUsedKey(challenge string) string {
+	return strings.Join(
+		[]string{topLevelKey, powPrefix, powUsedPrefix, challenge},
+		etcdKeyDelimeter,
+	)
+}
+
+// powStore keeps the state of the proof-of-work fallback in an etcd cluster,
+// so it is shared by all aperture instances.
+type powStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure powStore implements auth.PoWStore.
+var _ auth.PoWStore = (*powStore)(nil)
+
+// newPoWStore instantiates a new proof-of-work store backed by an etcd
+// cluster.
+func newPoWStore(client *clientv3.Client) *powStore {
+	return &powStore{Client: client}
+}
+
+// PoWSecret returns the secret that authenticates proof-of-work challenges,
+// creating it if there is none yet.
+//
+// NOTE: This is part of the auth.PoWStore interface.
+func (s *powStore) PoWSecret(ctx context.Context) ([32]byte, error) {
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return secret, err
+	}
+
+	// The secret is only stored if there is none yet, which happens
+	// atomically, so all instances that start at the same time end up
+	// with the same one.
+	key := powSecretKey()
+	txnResp, err := s.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(secret[:]))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return secret, err
+	}
+	if txnResp.Succeeded {
+		return secret, nil
+	}
+
+	kvs := txnResp.Responses[0].GetResponseRange().Kvs
+	if len(kvs) != 1 || len(kvs[0].Value) != len(secret) {
+		return secret, fmt.Errorf("invalid proof-of-work secret")
+	}
+	copy(secret[:], kvs[0].Value)
+
+	return secret, nil
+}
+
+// UsePoWChallenge records the solution of the given challenge as used for the
+// given duration. If it was already used, auth.ErrPoWReused is returned.
+//
+// NOTE: This is part of the auth.PoWStore interface.
+func (s *powStore) UsePoWChallenge(ctx context.Context, challenge string,
+	ttl time.Duration) error {
+
+	// Leases can only be granted for whole seconds, so we'd rather
+	// remember a challenge a little longer than needed.
+	lease, err := s.Grant(ctx, int64(math.Ceil(ttl.Seconds())))
+	if err != nil {
+		return err
+	}
+
+	// The challenge is only stored if it doesn't exist yet, which happens
+	// atomically, so concurrent requests can't both use its solution.
+	key := powUsedKey(challenge)
+	txnResp, err := s.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, "", clientv3.WithLease(lease.ID))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		// The lease isn't needed anymore, it expires on its own if
+		// revoking it fails.
+		_, _ = s.Revoke(ctx, lease.ID)
+		return auth.ErrPoWReused
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPoWStore ensures all instances sharing the store use the same secret for
+// proof-of-work challenges and that each solution can only be used once.
+func TestPoWStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	store := newPoWStore(etcdClient)
+	other := newPoWStore(etcdClient)
+
+	secret, err := store.PoWSecret(ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, [32]byte{}, secret)
+	otherSecret, err := other.PoWSecret(ctx)
+	require.NoError(t, err)
+	require.Equal(t, secret, otherSecret)
+
+	require.NoError(t, store.UsePoWChallenge(ctx, "AAAA", time.Minute))
+	require.Equal(
+		t, auth.ErrPoWReused,
+		other.UsePoWChallenge(ctx, "AAAA", time.Minute),
+	)
+	require.NoError(t, other.UsePoWChallenge(ctx, "BBBB", time.Minute))
+}
@@ -0,0 +1,60 @@
+package aperture
+
+import (
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// PaymentVerificationInvoice verifies the payment of an LSAT by
+	// looking up the settlement of its invoice in lnd.
+	PaymentVerificationInvoice = "invoice"
+
+	// PaymentVerificationPreimage verifies the payment of an LSAT by the
+	// pre-image in the Authorization header alone.
+	PaymentVerificationPreimage = "preimage"
+)
+
+// PreimageChallenger is a challenger that leaves the creation of invoices to
+// another challenger but accepts the pre-image an LSAT is sent with as the
+// proof of its payment, without looking up the invoice. The pre-image can only
+// be known to the client if the invoice was paid, so this works even if the
+// node aperture is connected to didn't create the invoice.
+//
+// NOTE: The pre-image is validated against the payment hash in the identifier
+// of the LSAT's macaroon by the mint before the invoice status is verified, so
+// only LSATs with a matching pre-image ever reach this challenger.
+type PreimageChallenger struct {
+	proxyChallenger
+}
+
+// NewPreimageChallenger creates a challenger that issues the invoices of the
+// given challenger but accepts pre-images as the proof of their payment.
+func NewPreimageChallenger(challenger proxyChallenger) *PreimageChallenger {
+	return &PreimageChallenger{
+		proxyChallenger: challenger,
+	}
+}
+
+// VerifyInvoiceStatus reports the invoice with the given payment hash as
+// settled, as the client already proved its payment with the pre-image the
+// hash was derived from. Any other state is verified with the challenger that
+// created the invoice.
+//
+// NOTE: This is part of the auth.InvoiceChecker interface.
+func (p *PreimageChallenger) VerifyInvoiceStatus(hash lntypes.Hash,
+	state lnrpc.Invoice_InvoiceState, timeout time.Duration) error {
+
+	if state != lnrpc.Invoice_SETTLED {
+		return p.proxyChallenger.VerifyInvoiceStatus(
+			hash, state, timeout,
+		)
+	}
+
+	log.Tracef("Accepting payment of invoice %v proven by its pre-image",
+		hash)
+
+	return nil
+}
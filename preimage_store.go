@@ -0,0 +1,115 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// preimageBatchSize is the maximum number of pre-image commitments we
+	// look up in a single etcd transaction. It matches etcd's default
+	// limit of operations per transaction.
+	preimageBatchSize = 128
+)
+
+var (
+	// preimagesPrefix is the key we'll use to prefix all payment hashes
+	// with when storing pre-image commitments in an etcd cluster.
+	preimagesPrefix = "preimages"
+)
+
+// preimageKey returns the full key to store in the database for the pre-image
+// of a payment hash.
+//
+// The resulting path of the payment hash bff4ee83 within etcd would look like:
+//
+//	lsat/proxy/preimages/bff4ee83
+func preimageKey(hash lntypes.Hash) string {
+	return strings.Join(
+		[]string{topLevelKey, preimagesPrefix, hash.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// preimageStore is a store of pre-image commitments backed by an etcd cluster.
+type preimageStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure preimageStore implements PreimageStore.
+var _ PreimageStore = (*preimageStore)(nil)
+
+// newPreimageStore instantiates a new pre-image store backed by an etcd
+// cluster.
+func newPreimageStore(client *clientv3.Client) *preimageStore {
+	return &preimageStore{Client: client}
+}
+
+// StorePreimage commits to the given pre-image, keyed by its hash.
+//
+// NOTE: This is part of the PreimageStore interface.
+func (s *preimageStore) StorePreimage(ctx context.Context,
+	preimage lntypes.Preimage) error {
+
+	_, err := s.Put(ctx, preimageKey(preimage.Hash()), string(preimage[:]))
+	return err
+}
+
+// GetPreimages returns the pre-images committed to for the given payment
+// hashes. They are looked up in batches, so a transaction only has to be sent
+// to etcd for every preimageBatchSize hashes. Hashes without a commitment are
+// missing from the returned map.
+//
+// NOTE: This is part of the PreimageStore interface.
+func (s *preimageStore) GetPreimages(ctx context.Context,
+	hashes []lntypes.Hash) (map[lntypes.Hash]lntypes.Preimage, error) {
+
+	preimages := make(map[lntypes.Hash]lntypes.Preimage, len(hashes))
+	for start := 0; start < len(hashes); start += preimageBatchSize {
+		end := start + preimageBatchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		batch := hashes[start:end]
+
+		ops := make([]clientv3.Op, 0, len(batch))
+		for _, hash := range batch {
+			ops = append(ops, clientv3.OpGet(preimageKey(hash)))
+		}
+		resp, err := s.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		for i, opResp := range resp.Responses {
+			kvs := opResp.GetResponseRange().Kvs
+			if len(kvs) == 0 {
+				continue
+			}
+
+			preimage, err := lntypes.MakePreimage(kvs[0].Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid preimage for "+
+					"hash %v: %v", batch[i], err)
+			}
+			preimages[batch[i]] = preimage
+		}
+	}
+
+	return preimages, nil
+}
+
+// DeletePreimage removes the pre-image commitment for the given payment hash.
+// This acts as a NOP if there is no commitment.
+//
+// NOTE: This is part of the PreimageStore interface.
+func (s *preimageStore) DeletePreimage(ctx context.Context,
+	hash lntypes.Hash) error {
+
+	_, err := s.Delete(ctx, preimageKey(hash))
+	return err
+}
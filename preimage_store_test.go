@@ -0,0 +1,41 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPreimageStore makes sure pre-image commitments are looked up across
+// several batches and hashes without a commitment are left out.
+func TestPreimageStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	store := newPreimageStore(etcdClient)
+
+	var hashes []lntypes.Hash
+	for i := 0; i < 2*preimageBatchSize+1; i++ {
+		preimage := lntypes.Preimage{byte(i), byte(i >> 8)}
+		require.NoError(t, store.StorePreimage(ctx, preimage))
+		hashes = append(hashes, preimage.Hash())
+	}
+	missingPreimage := lntypes.Preimage{0xff, 0xff}
+	missing := missingPreimage.Hash()
+	hashes = append(hashes, missing)
+
+	preimages, err := store.GetPreimages(ctx, hashes)
+	require.NoError(t, err)
+	require.Len(t, preimages, 2*preimageBatchSize+1)
+	require.Equal(t, lntypes.Preimage{1}, preimages[hashes[1]])
+	require.NotContains(t, preimages, missing)
+
+	require.NoError(t, store.DeletePreimage(ctx, hashes[1]))
+	preimages, err = store.GetPreimages(ctx, hashes[:2])
+	require.NoError(t, err)
+	require.Len(t, preimages, 1)
+}
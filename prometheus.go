@@ -3,12 +3,18 @@ package aperture
 import (
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/lightninglabs/aperture/metrics"
+	"github.com/lightninglabs/aperture/proxy"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-const streamIDLabel = "streamID"
+const (
+	streamIDLabel = "streamID"
+	pubKeyLabel   = "pubkey"
+)
 
 var (
 	// mailboxCount tracks the current number of active mailboxes.
@@ -30,8 +36,69 @@ var (
 			Name:      "mailbox_read_count",
 		}, []string{streamIDLabel},
 	)
+
+	// lndRemoteBalance tracks the total remote balance of all active
+	// channels of the lnd node backing the challenger.
+	lndRemoteBalance = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "lnd",
+		Name:      "remote_balance_sat",
+	})
+
+	// lndLowCapacityCount counts each capacity check that found the remote
+	// balance to be below the configured minimum.
+	lndLowCapacityCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "lnd",
+		Name:      "low_capacity_count",
+	})
+
+	// lndWatchtowerSessions tracks the number of watchtower sessions the
+	// lnd node backing the challenger can still back up channel states
+	// with.
+	lndWatchtowerSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "lnd",
+		Name:      "active_watchtower_sessions",
+	})
+
+	// lndWatchtowerPendingBackups tracks the number of channel state
+	// backups of the lnd node backing the challenger that no watchtower
+	// acknowledged yet.
+	lndWatchtowerPendingBackups = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "lnd",
+			Name:      "watchtower_pending_backups",
+		},
+	)
+
+	// lndActiveChannels tracks the number of active channels of each lnd
+	// node, labeled by its public key.
+	lndActiveChannels = newLndGaugeVec("active_channels")
+
+	// lndActivePeers tracks the number of connected peers of each lnd
+	// node.
+	lndActivePeers = newLndGaugeVec("active_peers")
+
+	// lndTotalCapacity tracks the total capacity of all channels of each
+	// lnd node.
+	lndTotalCapacity = newLndGaugeVec("total_capacity_sat")
+
+	// lndSyncedToChain is 1 if an lnd node is synced to the chain and 0
+	// otherwise.
+	lndSyncedToChain = newLndGaugeVec("synced_to_chain")
+
+	// lndBlockHeight tracks the best block height known to each lnd node.
+	lndBlockHeight = newLndGaugeVec("block_height")
 )
 
+// newLndGaugeVec creates a new gauge for a metric of an lnd node that is
+// labeled by the node's public key.
+func newLndGaugeVec(name string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "aperture",
+		Subsystem: "lnd",
+		Name:      name,
+	}, []string{pubKeyLabel})
+}
+
 // PrometheusConfig is the set of configuration data that specifies if
 // Prometheus metric exporting is activated, and if so the listening address of
 // the Prometheus server.
@@ -42,6 +109,10 @@ type PrometheusConfig struct {
 	// ListenAddr is the listening address that we should use to allow the
 	// main Prometheus server to scrape our metrics.
 	ListenAddr string `long:"listenaddr" description:"the interface we should listen on for prometheus"`
+
+	// LNDMetricsInterval is the interval at which the metrics of the lnd
+	// node backing the challenger are updated.
+	LNDMetricsInterval time.Duration `long:"lndmetricsinterval" description:"the interval at which lnd node metrics are updated, requires lnd's readonly.macaroon; set to 0 to disable"`
 }
 
 // StartPrometheusExporter registers all relevant metrics with the Prometheus
@@ -56,6 +127,21 @@ func StartPrometheusExporter(cfg *PrometheusConfig) error {
 	// Next, we'll register all our metrics.
 	prometheus.MustRegister(mailboxCount)
 	prometheus.MustRegister(mailboxReadCount)
+	prometheus.MustRegister(lndRemoteBalance)
+	prometheus.MustRegister(lndLowCapacityCount)
+	prometheus.MustRegister(lndWatchtowerSessions)
+	prometheus.MustRegister(lndWatchtowerPendingBackups)
+	prometheus.MustRegister(lndActiveChannels)
+	prometheus.MustRegister(lndActivePeers)
+	prometheus.MustRegister(lndTotalCapacity)
+	prometheus.MustRegister(lndSyncedToChain)
+	prometheus.MustRegister(lndBlockHeight)
+	prometheus.MustRegister(queueDepth)
+	prometheus.MustRegister(queueWait)
+	prometheus.MustRegister(tlsHandshakeDuration)
+	prometheus.MustRegister(tlsHandshakeErrors)
+	prometheus.MustRegister(proxy.PrometheusCollectors()...)
+	prometheus.MustRegister(metrics.Collectors()...)
 
 	// Finally, we'll launch the HTTP server that Prometheus will use to
 	// scape our metrics.
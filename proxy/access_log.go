@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// AccessLogTrace writes the access log at the trace level.
+	AccessLogTrace = "trace"
+
+	// AccessLogDebug writes the access log at the debug level.
+	AccessLogDebug = "debug"
+
+	// AccessLogInfo writes the access log at the info level.
+	AccessLogInfo = "info"
+)
+
+var (
+	// keyAccessLog is the key under which the access log entry of a
+	// request is stored in the request context.
+	keyAccessLog = lsat.ContextKey{Name: "access_log"}
+)
+
+// accessLogEntry is the access log entry of a single request, logged as a
+// line of JSON.
+type accessLogEntry struct {
+	Timestamp         time.Time `json:"timestamp"`
+	Method            string    `json:"method"`
+	Path              string    `json:"path"`
+	Status            int       `json:"status"`
+	DurationMs        int64     `json:"duration_ms"`
+	ServiceName       string    `json:"service_name,omitempty"`
+	ClientIP          string    `json:"client_ip"`
+	TokenID           string    `json:"token_id,omitempty"`
+	BackendAddress    string    `json:"backend_address,omitempty"`
+	RequestSizeBytes  int64     `json:"request_size_bytes"`
+	ResponseSizeBytes int64     `json:"response_size_bytes"`
+}
+
+// accessLog collects the details of a request that are only known to the
+// different stages handling it. It is safe for concurrent use, as the
+// backends of asynchronous jobs are called in the background.
+type accessLog struct {
+	mtx   sync.Mutex
+	entry accessLogEntry
+}
+
+// accessLogFromContext returns the access log of the request with the given
+// context or nil if the access log isn't enabled.
+func accessLogFromContext(ctx context.Context) *accessLog {
+	a, _ := lsat.FromContext(ctx, keyAccessLog).(*accessLog)
+	return a
+}
+
+// setService records the name of the service the request was matched to.
+func (a *accessLog) setService(name string) {
+	if a == nil {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.entry.ServiceName = name
+}
+
+// setToken records the ID of the LSAT the request was authenticated with.
+func (a *accessLog) setToken(header *http.Header) {
+	if a == nil {
+		return
+	}
+
+	mac, _, err := lsat.FromHeader(header)
+	if err != nil {
+		return
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.entry.TokenID = id.TokenID.String()
+}
+
+// setBackendAddress records the address of the backend the request was
+// forwarded to.
+func (a *accessLog) setBackendAddress(address string) {
+	if a == nil {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.entry.BackendAddress = address
+}
+
+// countingBody is a request body that counts the bytes read from it. It is
+// read by the transport of the reverse proxy, so the count is accessed
+// atomically.
+type countingBody struct {
+	io.ReadCloser
+
+	n int64
+}
+
+// Read reads from the body and counts the bytes read.
+//
+// NOTE: This is part of the io.Reader interface.
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+
+	return n, err
+}
+
+// accessLogResponseWriter is a response writer that records the status code
+// and the size of the body of the response.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+
+	status int
+	n      int64
+}
+
+// WriteHeader records the status code and writes the header.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (w *accessLogResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write counts the data and writes it to the body.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (w *accessLogResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+
+	return n, err
+}
+
+// Flush sends any buffered data to the client.
+//
+// NOTE: This is part of the http.Flusher interface.
+func (w *accessLogResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, which is needed to proxy
+// protocol upgrades.
+//
+// NOTE: This is part of the http.Hijacker interface.
+func (w *accessLogResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter,
+	error) {
+
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+
+	return hijacker.Hijack()
+}
+
+// accessLogger writes an access log entry for every request to the main log,
+// the audit log or both.
+type accessLogger struct {
+	// logf writes the entries to the main log. It is nil if they are only
+	// written to the audit log.
+	logf func(format string, params ...interface{})
+
+	// auditMtx makes sure the entries of concurrent requests aren't
+	// interleaved in the audit log.
+	auditMtx sync.Mutex
+
+	// audit is the audit log every entry is written to as a line of its
+	// own. It is nil if the audit log isn't enabled.
+	audit io.Writer
+}
+
+// newAccessLogger creates an access logger that writes at the given level.
+func newAccessLogger(level string) (*accessLogger, error) {
+	switch level {
+	case AccessLogTrace:
+		return &accessLogger{logf: log.Tracef}, nil
+
+	case AccessLogDebug:
+		return &accessLogger{logf: log.Debugf}, nil
+
+	case AccessLogInfo:
+		return &accessLogger{logf: log.Infof}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown access log level %q, must be "+
+			"%s, %s or %s", level, AccessLogTrace, AccessLogDebug,
+			AccessLogInfo)
+	}
+}
+
+// start stores the access log of the given request in its context. The
+// returned response writer and request must be used to handle the request,
+// and the returned function must be called once it was handled to log the
+// entry.
+func (l *accessLogger) start(w http.ResponseWriter, r *http.Request,
+	clientIP net.IP) (http.ResponseWriter, *http.Request, func()) {
+
+	a := &accessLog{
+		entry: accessLogEntry{
+			Timestamp:        time.Now(),
+			Method:           r.Method,
+			Path:             r.URL.Path,
+			ClientIP:         clientIP.String(),
+			RequestSizeBytes: requestHeaderSize(r),
+		},
+	}
+	r = r.WithContext(lsat.AddToContext(r.Context(), keyAccessLog, a))
+
+	body := &countingBody{}
+	if r.Body != nil && r.Body != http.NoBody {
+		body.ReadCloser = r.Body
+		r.Body = body
+	}
+	recorder := &accessLogResponseWriter{ResponseWriter: w}
+
+	return recorder, r, func() {
+		a.mtx.Lock()
+		entry := a.entry
+		a.mtx.Unlock()
+
+		entry.Status = recorder.status
+		entry.DurationMs = time.Since(entry.Timestamp).Milliseconds()
+		entry.RequestSizeBytes += atomic.LoadInt64(&body.n)
+		entry.ResponseSizeBytes = recorder.n
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Errorf("Unable to encode access log entry: %v", err)
+			return
+		}
+		if l.logf != nil {
+			l.logf("ACCESS: %s", line)
+		}
+		if l.audit != nil {
+			l.writeAudit(line)
+		}
+	}
+}
+
+// writeAudit writes the given entry to the audit log.
+func (l *accessLogger) writeAudit(line []byte) {
+	l.auditMtx.Lock()
+	defer l.auditMtx.Unlock()
+
+	_, err := l.audit.Write(append(line, '\n'))
+	if err != nil {
+		log.Errorf("Unable to write audit log entry: %v", err)
+	}
+}
+
+// EnableAccessLog writes an access log entry with the details of every request
+// to the main log at the given level, one of trace, debug or info.
+func (p *Proxy) EnableAccessLog(level string) error {
+	accessLog, err := newAccessLogger(level)
+	if err != nil {
+		return err
+	}
+	if p.accessLog != nil {
+		accessLog.audit = p.accessLog.audit
+	}
+	p.accessLog = accessLog
+
+	return nil
+}
+
+// EnableAuditLog writes the access log entry of every request to the given
+// audit log as a line of JSON, whether the access log is written to the main
+// log as well or not.
+func (p *Proxy) EnableAuditLog(audit io.Writer) {
+	if p.accessLog == nil {
+		p.accessLog = &accessLogger{}
+	}
+	p.accessLog.audit = audit
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAccessLog makes sure an access log entry with the details of the request
+// is written for every request.
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(ioutil.Discard, r.Body)
+			_, _ = w.Write([]byte("hello"))
+		},
+	))
+	defer backend.Close()
+	address := strings.TrimPrefix(backend.URL, "http://")
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "service",
+		Address:    address,
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "on",
+	}})
+	require.NoError(t, err)
+
+	var (
+		mtx     sync.Mutex
+		entries []accessLogEntry
+	)
+	p.accessLog = &accessLogger{
+		logf: func(format string, params ...interface{}) {
+			line := strings.TrimPrefix(
+				fmt.Sprintf(format, params...), "ACCESS: ",
+			)
+
+			var entry accessLogEntry
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+
+			mtx.Lock()
+			entries = append(entries, entry)
+			mtx.Unlock()
+		},
+	}
+
+	// An unauthenticated request is challenged.
+	req := httptest.NewRequest(http.MethodGet, "/path", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.Len(t, entries, 1)
+	require.Equal(t, http.MethodGet, entries[0].Method)
+	require.Equal(t, "/path", entries[0].Path)
+	require.Equal(t, http.StatusPaymentRequired, entries[0].Status)
+	require.Equal(t, "service", entries[0].ServiceName)
+	require.Equal(t, "10.0.0.1", entries[0].ClientIP)
+	require.Empty(t, entries[0].BackendAddress)
+	require.Empty(t, entries[0].TokenID)
+
+	// An authenticated request is forwarded to the backend. The mock
+	// authenticator accepts anything, so the request carries no LSAT we
+	// could get the token ID of.
+	req = httptest.NewRequest(
+		http.MethodPost, "/upload", strings.NewReader("0123456789"),
+	)
+	req.Header.Set("Authorization", "LSAT macaroon:preimage")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.Len(t, entries, 2)
+	require.Equal(t, http.StatusOK, entries[1].Status)
+	require.Equal(t, address, entries[1].BackendAddress)
+	require.Equal(t, int64(5), entries[1].ResponseSizeBytes)
+	require.Equal(
+		t, requestHeaderSize(req)+10, entries[1].RequestSizeBytes,
+	)
+
+	_, err = newAccessLogger("warn")
+	require.Error(t, err)
+	require.NoError(t, p.EnableAccessLog(AccessLogTrace))
+}
+
+// TestAuditLog makes sure the access log entry of every request is written to
+// the audit log as a line of its own, even if the access log isn't written to
+// the main log, and that enabling the latter keeps the audit log.
+func TestAuditLog(t *testing.T) {
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "service",
+		Address:    "127.0.0.1:1",
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "on",
+	}})
+	require.NoError(t, err)
+
+	var audit bytes.Buffer
+	p.EnableAuditLog(&audit)
+	require.Nil(t, p.accessLog.logf)
+
+	request := func() {
+		req := httptest.NewRequest(http.MethodGet, "/path", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	request()
+	require.NoError(t, p.EnableAccessLog(AccessLogTrace))
+	request()
+
+	lines := strings.Split(strings.TrimSuffix(audit.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		var entry accessLogEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		require.Equal(t, "/path", entry.Path)
+		require.Equal(t, "service", entry.ServiceName)
+		require.Equal(t, "10.0.0.1", entry.ClientIP)
+		require.Equal(t, http.StatusPaymentRequired, entry.Status)
+	}
+}
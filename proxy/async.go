@@ -0,0 +1,511 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AsyncJobPathPrefix is the prefix of the path clients can retrieve
+	// the response of an asynchronously processed request at. It is
+	// followed by the ID of the job.
+	AsyncJobPathPrefix = "/v1/async/"
+
+	// preferRespondAsync is the preference clients send in the Prefer
+	// header to ask for their request to be processed asynchronously.
+	preferRespondAsync = "respond-async"
+
+	// asyncWorkers is the number of asynchronous jobs that are processed
+	// concurrently.
+	asyncWorkers = 4
+
+	// asyncQueueSize is the number of asynchronous jobs that can wait to
+	// be processed. Requests arriving while the queue is full are
+	// rejected.
+	asyncQueueSize = 100
+
+	// maxAsyncBodySize is the maximum size of the body of a request that
+	// is processed asynchronously, as it needs to be stored until it is
+	// processed.
+	maxAsyncBodySize = 1024 * 1024
+
+	// asyncJobTimeout is the maximum time the backend request of an
+	// asynchronous job may take.
+	asyncJobTimeout = 10 * time.Minute
+
+	// asyncStoreTimeout is the maximum time storing the response of an
+	// asynchronous job may take.
+	asyncStoreTimeout = 10 * time.Second
+)
+
+var (
+	// ErrAsyncJobNotFound is returned by an AsyncJobStore if there is no
+	// job with the given ID.
+	ErrAsyncJobNotFound = errors.New("async job not found")
+)
+
+// AsyncResponse is the backend response of an asynchronously processed
+// request.
+type AsyncResponse struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int `json:"status_code"`
+
+	// Header holds the header fields of the response.
+	Header http.Header `json:"header"`
+
+	// Body is the body of the response.
+	Body []byte `json:"body"`
+}
+
+// AsyncJob is a request that is processed asynchronously.
+type AsyncJob struct {
+	// ID is the random hex encoded ID of the job. Knowing it is
+	// sufficient to retrieve the response, so it must only be given to the
+	// client that sent the request.
+	ID string `json:"id"`
+
+	// Service is the name of the service the request is sent to.
+	Service string `json:"service"`
+
+	// Created is the time the request was received.
+	Created time.Time `json:"created"`
+
+	// Method is the method of the request.
+	Method string `json:"method"`
+
+	// URL is the request URI the client sent the request to.
+	URL string `json:"url"`
+
+	// Host is the host the client sent the request to.
+	Host string `json:"host"`
+
+	// Header holds the header fields of the request as they are sent to
+	// the backend.
+	Header http.Header `json:"header,omitempty"`
+
+	// Body is the body of the request.
+	Body []byte `json:"body"`
+
+	// Response is the backend response. It is nil while the job is still
+	// pending.
+	Response *AsyncResponse `json:"response,omitempty"`
+}
+
+// AsyncJobStore is an interface for persisting asynchronous jobs until their
+// response was retrieved.
+type AsyncJobStore interface {
+	// AddAsyncJob stores a new pending job that is processed by this
+	// instance.
+	AddAsyncJob(ctx context.Context, job *AsyncJob) error
+
+	// ClaimPendingAsyncJobs returns the jobs that are still pending but
+	// aren't processed by any running instance anymore, so this instance
+	// can process them.
+	ClaimPendingAsyncJobs(ctx context.Context) ([]*AsyncJob, error)
+
+	// ReleaseAsyncJobs releases all jobs this instance didn't complete,
+	// so they can be resumed by the next instance that starts.
+	ReleaseAsyncJobs(ctx context.Context) error
+
+	// CompleteAsyncJob stores the response of the pending job with the
+	// given ID.
+	CompleteAsyncJob(ctx context.Context, id string,
+		resp *AsyncResponse) error
+
+	// AsyncJob returns the job with the given ID. If there is none,
+	// ErrAsyncJobNotFound is returned.
+	AsyncJob(ctx context.Context, id string) (*AsyncJob, error)
+}
+
+// asyncTask is a job waiting to be processed along with the request that needs
+// to be sent to the backend for it.
+type asyncTask struct {
+	job     *AsyncJob
+	req     *http.Request
+	service *Service
+	backend http.Handler
+}
+
+// asyncQueue processes the requests clients asked to be handled
+// asynchronously in the background and serves their responses once they are
+// available.
+type asyncQueue struct {
+	store AsyncJobStore
+	tasks chan *asyncTask
+
+	// pathPrefix is prepended to the locations clients are told to
+	// retrieve responses at.
+	pathPrefix string
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newAsyncQueue creates a new queue for asynchronous jobs that are persisted in
+// the given store.
+func newAsyncQueue(store AsyncJobStore) *asyncQueue {
+	return &asyncQueue{
+		store: store,
+		tasks: make(chan *asyncTask, asyncQueueSize),
+		quit:  make(chan struct{}),
+	}
+}
+
+// start starts the workers that process the queued jobs.
+func (q *asyncQueue) start() {
+	for i := 0; i < asyncWorkers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+}
+
+// resume queues the jobs that were still pending when the instance that
+// accepted them stopped. The services are looked up by name with the given
+// function, which returns the service and the handler that forwards requests
+// to its backend.
+func (q *asyncQueue) resume(lookup func(string) (*Service, http.Handler)) {
+	defer q.wg.Done()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), asyncStoreTimeout,
+	)
+	defer cancel()
+
+	jobs, err := q.store.ClaimPendingAsyncJobs(ctx)
+	if err != nil {
+		log.Errorf("Unable to resume pending async jobs: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		service, backend := lookup(job.Service)
+		if service == nil {
+			q.fail(
+				ctx, job.ID, http.StatusBadGateway,
+				"service not found",
+			)
+			continue
+		}
+
+		req, err := http.NewRequestWithContext(
+			context.Background(), job.Method, job.URL,
+			bytes.NewReader(job.Body),
+		)
+		if err != nil {
+			q.fail(
+				ctx, job.ID, http.StatusBadRequest,
+				"invalid request",
+			)
+			continue
+		}
+		req.Host = job.Host
+		req.Header = job.Header
+		if req.Header == nil {
+			req.Header = make(http.Header)
+		}
+
+		log.Infof("Resuming async job %s for service %s", job.ID,
+			service.Name)
+
+		select {
+		case q.tasks <- &asyncTask{
+			job:     job,
+			req:     req,
+			service: service,
+			backend: backend,
+		}:
+
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// stop stops all workers, cancelling the jobs that are being processed. Jobs
+// that are still queued remain pending and are resumed by the next instance
+// that starts.
+func (q *asyncQueue) stop() {
+	close(q.quit)
+	q.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), asyncStoreTimeout,
+	)
+	defer cancel()
+
+	if err := q.store.ReleaseAsyncJobs(ctx); err != nil {
+		log.Errorf("Unable to release pending async jobs: %v", err)
+	}
+}
+
+// worker processes queued jobs until the queue is stopped.
+func (q *asyncQueue) worker() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case task := <-q.tasks:
+			q.process(task)
+
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// process sends the request of the given task to the backend and stores the
+// response.
+func (q *asyncQueue) process(task *asyncTask) {
+	// The request isn't bound to the client connection anymore, but it
+	// must be canceled if we shut down.
+	ctx, cancel := context.WithTimeout(
+		detachedContext{task.req.Context()}, asyncJobTimeout,
+	)
+	defer cancel()
+	go func() {
+		select {
+		case <-q.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req := withBackendRequest(
+		task.req.WithContext(ctx), task.service,
+		task.service.chooseBackend(),
+	)
+	resp := newBufferedResponse()
+	task.backend.ServeHTTP(resp, req)
+
+	status := resp.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	storeCtx, storeCancel := context.WithTimeout(
+		context.Background(), asyncStoreTimeout,
+	)
+	defer storeCancel()
+
+	err := q.store.CompleteAsyncJob(storeCtx, task.job.ID, &AsyncResponse{
+		StatusCode: status,
+		Header:     resp.header,
+		Body:       resp.body.Bytes(),
+	})
+	if err != nil {
+		log.Errorf("Unable to store response of async job %s: %v",
+			task.job.ID, err)
+
+		// Let the client know something went wrong instead of leaving
+		// the job pending forever.
+		q.fail(
+			storeCtx, task.job.ID, http.StatusBadGateway,
+			"unable to store response",
+		)
+	}
+}
+
+// fail completes the job with the given ID with an error response.
+func (q *asyncQueue) fail(ctx context.Context, id string, status int,
+	msg string) {
+
+	err := q.store.CompleteAsyncJob(ctx, id, &AsyncResponse{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       []byte(msg),
+	})
+	if err != nil {
+		log.Errorf("Unable to fail async job %s: %v", id, err)
+	}
+}
+
+// preferAsync returns true if the client asked for the given request to be
+// processed asynchronously.
+func preferAsync(r *http.Request) bool {
+	for _, value := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(value, ",") {
+			preference = strings.TrimSpace(preference)
+			if strings.EqualFold(preference, preferRespondAsync) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// submit stores the given request as a new job, queues it to be sent to the
+// backend and responds with 202 Accepted and the location the response can be
+// retrieved at.
+func (q *asyncQueue) submit(w http.ResponseWriter, r *http.Request,
+	service *Service, backend http.Handler) {
+
+	body, err := ioutil.ReadAll(
+		http.MaxBytesReader(w, r.Body, maxAsyncBodySize),
+	)
+	if err != nil {
+		sendDirectResponse(
+			w, r, http.StatusRequestEntityTooLarge,
+			"request body too large for async processing",
+		)
+		return
+	}
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		sendDirectResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	// The backend receives the request as if the client sent it
+	// synchronously.
+	header := r.Header.Clone()
+	header.Del("Prefer")
+	job := &AsyncJob{
+		ID:      hex.EncodeToString(id[:]),
+		Service: service.Name,
+		Created: time.Now(),
+		Method:  r.Method,
+		URL:     r.URL.RequestURI(),
+		Host:    r.Host,
+		Header:  header,
+		Body:    body,
+	}
+	if err := q.store.AddAsyncJob(r.Context(), job); err != nil {
+		log.Errorf("Unable to store async job: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"unable to store job",
+		)
+		return
+	}
+
+	req := r.Clone(r.Context())
+	req.Header = header.Clone()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	select {
+	case q.tasks <- &asyncTask{
+		job:     job,
+		req:     req,
+		service: service,
+		backend: backend,
+	}:
+
+	default:
+		// Complete the job so the client doesn't poll for it forever.
+		q.fail(
+			r.Context(), job.ID, http.StatusServiceUnavailable,
+			"async queue full",
+		)
+		sendDirectResponse(
+			w, r, http.StatusServiceUnavailable, "async queue full",
+		)
+		return
+	}
+
+	log.Debugf("Queued async job %s for service %s", job.ID, service.Name)
+
+	w.Header().Set("Preference-Applied", preferRespondAsync)
+	w.Header().Set("Location", q.location(job.ID))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// location returns the location the response of the job with the given ID can
+// be retrieved at.
+func (q *asyncQueue) location(id string) string {
+	return q.pathPrefix + AsyncJobPathPrefix + id
+}
+
+// isHandling returns true if the given request asks for the response of an
+// asynchronous job.
+func (q *asyncQueue) isHandling(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, AsyncJobPathPrefix)
+}
+
+// ServeHTTP serves the response of the asynchronous job whose ID is given in
+// the path. While the job is still pending, 202 Accepted is returned.
+func (q *asyncQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendDirectResponse(
+			w, r, http.StatusMethodNotAllowed, "method not allowed",
+		)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, AsyncJobPathPrefix)
+	job, err := q.store.AsyncJob(r.Context(), id)
+	switch {
+	case err == ErrAsyncJobNotFound:
+		sendDirectResponse(w, r, http.StatusNotFound, err.Error())
+		return
+
+	case err != nil:
+		log.Errorf("Unable to look up async job %s: %v", id, err)
+		sendDirectResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	if job.Response == nil {
+		w.Header().Set("Location", q.location(job.ID))
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	for name, values := range job.Response.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(job.Response.StatusCode)
+	_, _ = w.Write(job.Response.Body)
+}
+
+// bufferedResponse is a response writer that buffers a complete response so it
+// can be stored.
+type bufferedResponse struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+// newBufferedResponse creates a new empty buffered response.
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{
+		header: make(http.Header),
+	}
+}
+
+// Header returns the header of the response.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+// Write appends to the body of the response.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.WriteHeader(http.StatusOK)
+	}
+
+	return b.body.Write(p)
+}
+
+// WriteHeader sets the status code of the response.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
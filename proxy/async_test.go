@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// mockAsyncJobStore is an in-memory AsyncJobStore. Jobs whose ID is in claimed
+// are processed by a running instance.
+type mockAsyncJobStore struct {
+	sync.Mutex
+	jobs    map[string]AsyncJob
+	claimed map[string]struct{}
+}
+
+func (s *mockAsyncJobStore) claim(id string) {
+	if s.claimed == nil {
+		s.claimed = make(map[string]struct{})
+	}
+	s.claimed[id] = struct{}{}
+}
+
+func (s *mockAsyncJobStore) AddAsyncJob(_ context.Context,
+	job *AsyncJob) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.jobs[job.ID] = *job
+	s.claim(job.ID)
+	return nil
+}
+
+func (s *mockAsyncJobStore) ClaimPendingAsyncJobs(
+	context.Context) ([]*AsyncJob, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	var jobs []*AsyncJob
+	for id, job := range s.jobs {
+		if _, ok := s.claimed[id]; ok || job.Response != nil {
+			continue
+		}
+
+		job := job
+		jobs = append(jobs, &job)
+		s.claim(id)
+	}
+	return jobs, nil
+}
+
+func (s *mockAsyncJobStore) ReleaseAsyncJobs(context.Context) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.claimed = nil
+	return nil
+}
+
+func (s *mockAsyncJobStore) CompleteAsyncJob(_ context.Context, id string,
+	resp *AsyncResponse) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return ErrAsyncJobNotFound
+	}
+	job.Response = resp
+	s.jobs[id] = job
+	return nil
+}
+
+func (s *mockAsyncJobStore) AsyncJob(_ context.Context,
+	id string) (*AsyncJob, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrAsyncJobNotFound
+	}
+	return &job, nil
+}
+
+// TestPreferAsync makes sure requests with the Prefer: respond-async header are
+// processed in the background and their response can be retrieved later.
+func TestPreferAsync(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Prefer") == "" {
+				<-release
+			}
+
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Processed", "true")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte("processed " + string(body)))
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:               "jobs",
+		Address:            strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:           "http",
+		HostRegexp:         ".*",
+		Auth:               "off",
+		SupportPreferAsync: true,
+	}})
+	require.NoError(t, err)
+
+	store := &mockAsyncJobStore{jobs: make(map[string]AsyncJob)}
+	p.EnableAsyncJobs(store)
+	defer p.Close()
+
+	send := func(method, target string,
+		header http.Header) *httptest.ResponseRecorder {
+
+		req := httptest.NewRequest(
+			method, target, strings.NewReader("job"),
+		)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send(http.MethodPost, "/jobs", http.Header{
+		"Prefer": []string{"wait=10, respond-async"},
+	})
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.Equal(
+		t, preferRespondAsync, rec.Header().Get("Preference-Applied"),
+	)
+	location := rec.Header().Get("Location")
+	require.True(t, strings.HasPrefix(location, AsyncJobPathPrefix))
+
+	// While the backend is processing the request, the job is pending.
+	rec = send(http.MethodGet, location, nil)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	close(release)
+	require.Eventually(t, func() bool {
+		rec = send(http.MethodGet, location, nil)
+		return rec.Code != http.StatusAccepted
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.Equal(t, "true", rec.Header().Get("X-Processed"))
+	require.Equal(t, "processed job", rec.Body.String())
+
+	// Unknown jobs aren't found.
+	rec = send(http.MethodGet, AsyncJobPathPrefix+"unknown", nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Without the preference, the request is processed synchronously.
+	rec = send(http.MethodPost, "/jobs", nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.Equal(t, "processed job", rec.Body.String())
+}
+
+// TestResumeAsyncJobs makes sure jobs that are still pending and not processed
+// by any other instance are processed once async jobs are enabled.
+func TestResumeAsyncJobs(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = fmt.Fprintf(
+				w, "%s %s %s %s", r.Method, r.URL.RequestURI(),
+				r.Header.Get("X-Job"), body,
+			)
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:               "jobs",
+		Address:            strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:           "http",
+		HostRegexp:         ".*",
+		Auth:               "off",
+		SupportPreferAsync: true,
+	}})
+	require.NoError(t, err)
+
+	pending := func(id, service string) AsyncJob {
+		return AsyncJob{
+			ID:      id,
+			Service: service,
+			Method:  http.MethodPost,
+			URL:     "/jobs?id=" + id,
+			Host:    "example.com",
+			Header:  http.Header{"X-Job": []string{id}},
+			Body:    []byte("job"),
+		}
+	}
+	store := &mockAsyncJobStore{jobs: map[string]AsyncJob{
+		"aa": pending("aa", "jobs"),
+		"bb": pending("bb", "removed"),
+		"cc": pending("cc", "jobs"),
+	}}
+	store.claim("cc")
+	p.EnableAsyncJobs(store)
+	defer p.Close()
+
+	job := func(id string) AsyncJob {
+		store.Lock()
+		defer store.Unlock()
+
+		return store.jobs[id]
+	}
+	require.Eventually(t, func() bool {
+		return job("aa").Response != nil && job("bb").Response != nil
+	}, time.Second, 10*time.Millisecond)
+
+	resp := job("aa").Response
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "POST /jobs?id=aa aa job", string(resp.Body))
+
+	// Jobs of services that don't exist anymore fail.
+	require.Equal(t, http.StatusBadGateway, job("bb").Response.StatusCode)
+
+	// Jobs processed by another instance are left alone.
+	require.Nil(t, job("cc").Response)
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// authBypasses counts all requests to each service whose
+	// authentication was skipped because they came from a trusted IP.
+	authBypasses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aperture",
+		Name:      "auth_bypass_total",
+	}, []string{serviceLabel})
+)
+
+// onionContextKey is the type of the key that marks requests which reached us
+// through an onion service in their context.
+type onionContextKey struct{}
+
+// OnionHandler returns a handler that marks all requests as having reached us
+// through an onion service before passing them to the given handler. Tor
+// forwards them from a local address, so their remote address must never be
+// trusted to skip authentication.
+func OnionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), onionContextKey{}, true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// isOnionRequest returns true if the given request reached us through an onion
+// service.
+func isOnionRequest(r *http.Request) bool {
+	onion, _ := r.Context().Value(onionContextKey{}).(bool)
+	return onion
+}
+
+// BypassAuthConfig is the configuration of the clients whose requests to a
+// service are forwarded without authentication, like monitoring systems.
+type BypassAuthConfig struct {
+	// TrustedIPs is the list of IP ranges in CIDR notation, or single IP
+	// addresses, requests from which skip authentication.
+	TrustedIPs []string `long:"trustedips" description:"List of IP ranges in CIDR notation or single IP addresses whose requests to the service are forwarded without authentication"`
+}
+
+// parseTrustedIPs parses the trusted IP ranges of the config.
+func (c *BypassAuthConfig) parseTrustedIPs() ([]*net.IPNet, error) {
+	trusted, err := parseIPRanges(c.TrustedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted IP range: %v", err)
+	}
+
+	return trusted, nil
+}
+
+// bypassesAuth returns true if the given request from the given IP address is
+// to skip authentication because the address is trusted by the service. The
+// bypass is logged as an audit event and counted.
+func (s *Service) bypassesAuth(r *http.Request, remoteIP net.IP,
+	prefixLog *PrefixLog) bool {
+
+	// Requests through an onion service come from the local Tor daemon,
+	// and the unspecified address stands for a remote address we couldn't
+	// parse, like the one of a unix socket peer. Neither tells us who the
+	// client is.
+	if isOnionRequest(r) || remoteIP.IsUnspecified() {
+		return false
+	}
+
+	for _, trusted := range s.trustedIPs {
+		if !trusted.Contains(remoteIP) {
+			continue
+		}
+
+		prefixLog.Infof("AUDIT: Bypassing authentication of %s %s to "+
+			"service %s for trusted IP range %s", r.Method,
+			r.URL.Path, s.Name, trusted)
+		authBypasses.WithLabelValues(s.Name).Inc()
+
+		return true
+	}
+
+	return false
+}
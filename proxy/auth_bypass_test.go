@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBypassAuth makes sure requests from trusted IPs are forwarded without
+// authentication and counted, while all others need to authenticate.
+func TestBypassAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "bypass",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "on",
+		BypassAuth: BypassAuthConfig{
+			TrustedIPs: []string{"10.0.0.0/8", "2001:db8::1"},
+		},
+	}})
+	require.NoError(t, err)
+
+	var handler http.Handler = p
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	bypasses := authBypasses.WithLabelValues("bypass")
+	before := testutil.ToFloat64(bypasses)
+
+	rec := send("10.1.2.3:1234")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "ok", rec.Body.String())
+
+	rec = send("[2001:db8::1]:1234")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, before+2, testutil.ToFloat64(bypasses))
+
+	// Everyone else needs to pay.
+	rec = send("192.168.1.1:1234")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	rec = send("[2001:db8::2]:1234")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.Equal(t, before+2, testutil.ToFloat64(bypasses))
+
+	// Remote addresses we can't parse, like the ones of unix socket
+	// peers, are never trusted, even by a range that contains them.
+	p, err = New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "bypass",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "on",
+		BypassAuth: BypassAuthConfig{
+			TrustedIPs: []string{"0.0.0.0/0", "127.0.0.1"},
+		},
+	}})
+	require.NoError(t, err)
+	handler = p
+
+	rec = send("@")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	rec = send("127.0.0.1:1234")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, before+3, testutil.ToFloat64(bypasses))
+
+	// Requests through an onion service come from the local Tor daemon,
+	// so they are never trusted either.
+	handler = OnionHandler(p)
+	rec = send("127.0.0.1:1234")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.Equal(t, before+3, testutil.ToFloat64(bypasses))
+
+	// Invalid ranges are rejected.
+	_, err = New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "invalid",
+		Address:    "localhost:1234",
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "on",
+		BypassAuth: BypassAuthConfig{
+			TrustedIPs: []string{"10.0.0.0/33"},
+		},
+	}})
+	require.Error(t, err)
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAuthCookieStripped makes sure the cookie carrying the LSAT is never
+// forwarded to the backend while all other cookies are.
+func TestAuthCookieStripped(t *testing.T) {
+	var forwarded []string
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			forwarded = r.Header.Values("Cookie")
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "browser",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "on",
+	}})
+	require.NoError(t, err)
+
+	send := func(cookies ...string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "LSAT foo:bar")
+		for _, cookie := range cookies {
+			req.Header.Add("Cookie", cookie)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// Without the auth cookie enabled, cookies are forwarded as sent.
+	send("lsat=mac:preimage; theme=dark")
+	require.Equal(t, []string{"lsat=mac:preimage; theme=dark"}, forwarded)
+
+	p.EnableAuthCookie("lsat")
+	send("theme=dark; lsat=mac:preimage;session=abc")
+	require.Equal(t, []string{"theme=dark; session=abc"}, forwarded)
+
+	// The Cookie header is dropped if it only carried the LSAT.
+	send("lsat=mac:preimage")
+	require.Empty(t, forwarded)
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// bearerAuthenticator is a mock authenticator that only accepts a single
+// bearer token.
+type bearerAuthenticator struct{}
+
+// Accept returns true if the header carries the valid bearer token.
+//
+// NOTE: This is part of the auth.Authenticator interface.
+func (bearerAuthenticator) Accept(header *http.Header, _ string) bool {
+	return header.Get("Authorization") == "Bearer valid"
+}
+
+// FreshChallengeHeader asks for a bearer token.
+//
+// NOTE: This is part of the auth.Authenticator interface.
+func (bearerAuthenticator) FreshChallengeHeader(*http.Request, string,
+	int64) (http.Header, error) {
+
+	header := make(http.Header)
+	header.Set("WWW-Authenticate", "Bearer")
+
+	return header, nil
+}
+
+// TestAuthMode makes sure the requests to each service are authenticated with
+// the authenticator of the service's auth mode.
+func TestAuthMode(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	newService := func(mode string) *Service {
+		return &Service{
+			Name:       mode,
+			Address:    address,
+			Protocol:   "http",
+			HostRegexp: ".*",
+			PathRegexp: "^/" + mode + "$",
+			Auth:       "on",
+			AuthMode:   mode,
+			Price:      1,
+		}
+	}
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{
+		newService(AuthModeLSAT), newService(AuthModeJWT),
+		newService(AuthModeNone),
+	})
+	require.NoError(t, err)
+
+	send := func(path, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Without JWT authentication enabled, no request to the JWT service
+	// is let through.
+	require.Equal(
+		t, http.StatusInternalServerError,
+		send("/jwt", "Bearer valid").Code,
+	)
+
+	p.EnableJWTAuth(bearerAuthenticator{})
+
+	// LSAT services are paid for.
+	require.Equal(t, http.StatusPaymentRequired, send("/lsat", "").Code)
+	require.Equal(t, http.StatusOK, send("/lsat", "LSAT foo:bar").Code)
+
+	// JWT services challenge clients to authenticate without offering an
+	// invoice.
+	rec := send("/jwt", "Bearer invalid")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+	require.Equal(t, http.StatusUnauthorized, send("/jwt", "").Code)
+	require.Equal(t, http.StatusOK, send("/jwt", "Bearer valid").Code)
+
+	// Services without authentication let all requests through.
+	require.Equal(t, http.StatusOK, send("/none", "").Code)
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultBackendDialTimeout is the default maximum time the TCP
+	// handshake with a backend may take.
+	DefaultBackendDialTimeout = 5 * time.Second
+
+	// HeaderRequestTimeout is the header field of 504 Gateway Timeout
+	// responses that tells the client the number of seconds the backend
+	// had to answer before its request was aborted.
+	HeaderRequestTimeout = "Request-Timeout"
+)
+
+// backendDialTimeout returns the maximum time the TCP handshake with the
+// backend of the given service may take.
+func backendDialTimeout(s *Service) time.Duration {
+	if s != nil && s.BackendDialTimeout > 0 {
+		return s.BackendDialTimeout
+	}
+
+	return DefaultBackendDialTimeout
+}
+
+// backendDialer returns the function the transport of the given service dials
+// its backend with.
+func backendDialer(s *Service) func(context.Context, string,
+	string) (net.Conn, error) {
+
+	dialer := &net.Dialer{Timeout: backendDialTimeout(s)}
+	return dialer.DialContext
+}
+
+// exceededTimeout returns the backend timeout of the given service that made
+// the request to its backend fail with the given error, if any. The service
+// is nil if it isn't known.
+func exceededTimeout(err error, s *Service) (time.Duration, bool) {
+	// The transport doesn't export the error it returns if the response
+	// header takes too long, so its message is matched. It needs to be
+	// checked first, as newer versions of Go report it as a context
+	// deadline error as well.
+	switch {
+	case strings.Contains(err.Error(), "timeout awaiting response headers"):
+		if s == nil {
+			return 0, true
+		}
+		return s.BackendResponseHeaderTimeout, true
+
+	case errors.Is(err, context.DeadlineExceeded):
+		if s == nil {
+			return 0, true
+		}
+		return s.BackendTimeout, true
+	}
+
+	// Any other timeout happened while dialing.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return backendDialTimeout(s), true
+	}
+
+	return 0, false
+}
+
+// sendGatewayTimeout answers a request whose backend didn't answer within the
+// given timeout with 504 Gateway Timeout. The timeout is sent to the client in
+// seconds if it is known.
+func sendGatewayTimeout(w http.ResponseWriter, timeout time.Duration) {
+	if timeout > 0 {
+		w.Header().Set(HeaderRequestTimeout, strconv.FormatFloat(
+			timeout.Seconds(), 'f', -1, 64,
+		))
+	}
+	w.WriteHeader(http.StatusGatewayTimeout)
+}
+
+// hasCustomTimeouts returns true if the service needs a transport of its own
+// to apply its backend timeouts.
+func (s *Service) hasCustomTimeouts() bool {
+	return s.BackendDialTimeout > 0 || s.BackendResponseHeaderTimeout > 0
+}
+
+// withBackendTimeout returns a copy of the request that is aborted once the
+// backend timeout of the given service passed. The returned function must be
+// called once the request was handled.
+func withBackendTimeout(r *http.Request, s *Service) (*http.Request, func()) {
+	if s.BackendTimeout == 0 {
+		return r, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.BackendTimeout)
+	return r.WithContext(ctx), cancel
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBackendTimeouts makes sure the backend timeouts of a service are
+// configured independently and that requests exceeding one of them are
+// answered with 504 Gateway Timeout, telling the client the timeout.
+func TestBackendTimeouts(t *testing.T) {
+	t.Parallel()
+
+	block := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+		},
+	))
+	defer backend.Close()
+	defer close(block)
+	address := strings.TrimPrefix(backend.URL, "http://")
+
+	services := []*Service{{
+		Name:       "default",
+		Address:    address,
+		Protocol:   "http",
+		HostRegexp: "^default$",
+		Auth:       "off",
+	}, {
+		Name:                         "header",
+		Address:                      address,
+		Protocol:                     "http",
+		HostRegexp:                   "^header$",
+		Auth:                         "off",
+		BackendDialTimeout:           time.Second,
+		BackendResponseHeaderTimeout: 2 * time.Second,
+	}, {
+		Name:           "request",
+		Address:        address,
+		Protocol:       "http",
+		HostRegexp:     "^request$",
+		Auth:           "off",
+		BackendTimeout: 50 * time.Millisecond,
+	}, {
+		Name:                         "slowheader",
+		Address:                      address,
+		Protocol:                     "http",
+		HostRegexp:                   "^slowheader$",
+		Auth:                         "off",
+		BackendResponseHeaderTimeout: 50 * time.Millisecond,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	// Only the service with custom transport timeouts gets a transport of
+	// its own. The request timeout doesn't need one.
+	transports := createServiceTransports(services, &http.Transport{
+		TLSClientConfig: &tls.Config{},
+	})
+	require.NotContains(t, transports, services[0])
+	require.NotContains(t, transports, services[2])
+
+	transport := transports[services[1]].(*http.Transport)
+	require.Equal(t, 2*time.Second, transport.ResponseHeaderTimeout)
+	require.NotNil(t, transport.DialContext)
+
+	send := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+
+		start := time.Now()
+		p.ServeHTTP(rec, req)
+		require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+		return rec
+	}
+
+	rec := send("request")
+	require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	require.Equal(t, "0.05", rec.Header().Get(HeaderRequestTimeout))
+
+	rec = send("slowheader")
+	require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	require.Equal(t, "0.05", rec.Header().Get(HeaderRequestTimeout))
+
+	// Negative timeouts are rejected.
+	_, err = New(auth.NewMockAuthenticator(), []*Service{{
+		Name:           "negative",
+		HostRegexp:     ".*",
+		BackendTimeout: -time.Second,
+	}})
+	require.Error(t, err)
+}
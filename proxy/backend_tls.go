@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// BackendConfig is the configuration of the TLS connections to the backend of
+// a service, for backends that only accept clients presenting a certificate
+// and whose certificate must be issued by a specific CA, and of the discovery
+// of the backend's endpoints.
+type BackendConfig struct {
+	// ClientCertFile is the path of the certificate presented to the
+	// backend during the TLS handshake.
+	ClientCertFile string `long:"clientcertfile" description:"Path of the client certificate presented to the backend during the TLS handshake"`
+
+	// ClientKeyFile is the path of the private key of the client
+	// certificate.
+	ClientKeyFile string `long:"clientkeyfile" description:"Path of the private key of the client certificate"`
+
+	// RootCAFile is the path of the CA certificates the certificate of the
+	// backend must be issued by. The certificate of the backend is fully
+	// verified, including its host name, if it is set.
+	RootCAFile string `long:"rootcafile" description:"Path of the CA certificates the backend's certificate must be issued by; the backend's certificate is fully verified if set"`
+
+	// SRVName is the name of the DNS SRV record the endpoints of the
+	// backend are discovered through. The requests are balanced across
+	// them in turn. The static address of the service is only used while
+	// no endpoints are known.
+	SRVName string `long:"srvname" description:"Name of a DNS SRV record to discover the endpoints of the backend through instead of using the static address, for example _http._tcp.service1.service.consul"`
+
+	// SRVRefreshInterval is the interval at which the SRV record is
+	// resolved again. It defaults to DefaultSRVRefreshInterval.
+	SRVRefreshInterval time.Duration `long:"srvrefreshinterval" description:"The interval at which the SRV record is resolved again. Defaults to 30 seconds."`
+}
+
+// validate makes sure the client certificate and its key are configured
+// together and the SRV refresh interval is sane.
+func (c *BackendConfig) validate() error {
+	if c.ClientCertFile != "" && c.ClientKeyFile == "" {
+		return invalidField("clientkeyfile", "required if "+
+			"clientcertfile is set")
+	}
+	if c.ClientKeyFile != "" && c.ClientCertFile == "" {
+		return invalidField("clientcertfile", "required if "+
+			"clientkeyfile is set")
+	}
+	if c.SRVRefreshInterval < 0 {
+		return invalidField("srvrefreshinterval", "cannot be negative")
+	}
+
+	return nil
+}
+
+// backendTLS is the loaded TLS configuration of the connections to the backend
+// of a service.
+type backendTLS struct {
+	clientCert *tls.Certificate
+	rootCAs    *x509.CertPool
+}
+
+// load reads the client certificate and CA certificates of the config. Nil is
+// returned if neither is configured.
+func (c *BackendConfig) load() (*backendTLS, error) {
+	if c.ClientCertFile == "" && c.RootCAFile == "" {
+		return nil, nil
+	}
+
+	var backend backendTLS
+	if c.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(
+			c.ClientCertFile, c.ClientKeyFile,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load backend client "+
+				"certificate: %v", err)
+		}
+		backend.clientCert = &cert
+	}
+
+	if c.RootCAFile != "" {
+		b, err := ioutil.ReadFile(c.RootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read backend root "+
+				"CAs: %v", err)
+		}
+
+		backend.rootCAs = x509.NewCertPool()
+		if !backend.rootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s",
+				c.RootCAFile)
+		}
+	}
+
+	return &backend, nil
+}
+
+// apply adds the client certificate to the given TLS config and makes it only
+// trust the configured CAs, if any.
+func (b *backendTLS) apply(tlsConfig *tls.Config) {
+	if b.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*b.clientCert}
+	}
+
+	if b.rootCAs != nil {
+		tlsConfig.RootCAs = b.rootCAs
+		tlsConfig.InsecureSkipVerify = false
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to the
+// given files.
+func writeClientCert(t *testing.T, certFile,
+	keyFile string) *x509.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageClientAuth,
+		},
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, template, template, &key.PublicKey, key,
+	)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	}), 0600)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: keyDer,
+	}), 0600)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
+
+// TestBackendMutualTLS makes sure the client certificate is presented to
+// backends requiring one and that the certificate of the backend is verified
+// against the configured CAs.
+func TestBackendMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	clientCertFile := filepath.Join(dir, "client.crt")
+	clientKeyFile := filepath.Join(dir, "client.key")
+	clientCert := writeClientCert(t, clientCertFile, clientKeyFile)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	backend.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	backendCAFile := filepath.Join(dir, "backend-ca.crt")
+	err := ioutil.WriteFile(backendCAFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: backend.Certificate().Raw,
+	}), 0600)
+	require.NoError(t, err)
+
+	send := func(backendCfg BackendConfig) int {
+		p, err := New(auth.NewMockAuthenticator(), []*Service{{
+			Name:       "mtls",
+			Address:    strings.TrimPrefix(backend.URL, "https://"),
+			Protocol:   "https",
+			HostRegexp: ".*",
+			Auth:       "off",
+			Backend:    backendCfg,
+		}})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+
+	// Without a client certificate the backend refuses the connection.
+	require.Equal(t, http.StatusBadGateway, send(BackendConfig{}))
+
+	require.Equal(t, http.StatusOK, send(BackendConfig{
+		ClientCertFile: clientCertFile,
+		ClientKeyFile:  clientKeyFile,
+		RootCAFile:     backendCAFile,
+	}))
+
+	// A backend certificate that isn't issued by the configured CAs is
+	// rejected.
+	require.Equal(t, http.StatusBadGateway, send(BackendConfig{
+		ClientCertFile: clientCertFile,
+		ClientKeyFile:  clientKeyFile,
+		RootCAFile:     clientCertFile,
+	}))
+
+	// The client certificate needs its key.
+	err = ValidateServices([]*Service{{
+		Name: "invalid",
+		Backend: BackendConfig{
+			ClientCertFile: clientCertFile,
+		},
+	}})
+	require.Error(t, err)
+}
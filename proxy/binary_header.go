@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// binaryHeaderSuffix is the suffix of the keys of gRPC metadata with
+	// binary values. Those values are base64 encoded on the wire.
+	binaryHeaderSuffix = "-bin"
+)
+
+// isBinaryHeader returns true if the given header field carries binary gRPC
+// metadata.
+func isBinaryHeader(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), binaryHeaderSuffix)
+}
+
+// decodeBinaryHeader decodes the value of a binary header field. gRPC
+// implementations must accept both padded and unpadded base64 values.
+func decodeBinaryHeader(value string) ([]byte, error) {
+	if len(value)%4 == 0 {
+		return base64.StdEncoding.DecodeString(value)
+	}
+
+	return base64.RawStdEncoding.DecodeString(value)
+}
+
+// normalizeBinaryHeaders makes sure every value of a binary header field in the
+// given header is forwarded as a separate base64 string. HTTP/1.1 clients and
+// intermediaries may fold multiple values of a field into a single
+// comma-separated one, which a gRPC backend would otherwise decode as a single
+// corrupted value. The values themselves are forwarded exactly as received,
+// padded or not, and values that aren't valid base64 aren't split at all.
+func normalizeBinaryHeaders(header http.Header) {
+	for name, values := range header {
+		if !isBinaryHeader(name) {
+			continue
+		}
+
+		normalized := make([]string, 0, len(values))
+		for _, value := range values {
+			normalized = append(
+				normalized, splitBinaryValue(value)...,
+			)
+		}
+		header[name] = normalized
+	}
+}
+
+// splitBinaryValue splits a possibly folded binary header value into its
+// elements. If any element can't be decoded, the value is returned unchanged.
+func splitBinaryValue(value string) []string {
+	if !strings.Contains(value, ",") {
+		return []string{value}
+	}
+
+	elements := strings.Split(value, ",")
+	for i, element := range elements {
+		element = strings.TrimSpace(element)
+		if _, err := decodeBinaryHeader(element); err != nil {
+			return []string{value}
+		}
+
+		elements[i] = element
+	}
+
+	return elements
+}
+
+// binaryTrailerBody is a response body that normalizes the binary fields of the
+// response's trailer once the body was read completely, which is when the
+// trailer becomes available.
+type binaryTrailerBody struct {
+	io.ReadCloser
+
+	resp *http.Response
+}
+
+// Read reads from the response body and normalizes the trailer after the last
+// byte was read.
+//
+// NOTE: This is part of the io.Reader interface.
+func (b *binaryTrailerBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		normalizeBinaryHeaders(b.resp.Trailer)
+	}
+
+	return n, err
+}
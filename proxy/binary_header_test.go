@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNormalizeBinaryHeaders makes sure folded binary header values are split
+// without changing their encoding.
+func TestNormalizeBinaryHeaders(t *testing.T) {
+	first := base64.StdEncoding.EncodeToString(
+		[]byte{0x00, 0xff, '\r', '\n', 0x80},
+	)
+	second := base64.RawStdEncoding.EncodeToString([]byte{0x01})
+
+	header := http.Header{
+		"Foo-Bin": []string{first + ", " + second},
+		"Bar-Bin": []string{"not base64!, AA=="},
+		"Qux-Bin": []string{first},
+		"Baz":     []string{"AA==, AQ=="},
+	}
+	normalizeBinaryHeaders(header)
+
+	require.Equal(t, []string{first, second}, header["Foo-Bin"])
+	require.Equal(t, []string{"not base64!, AA=="}, header["Bar-Bin"])
+	require.Equal(t, []string{first}, header["Qux-Bin"])
+	require.Equal(t, []string{"AA==, AQ=="}, header["Baz"])
+}
+
+// TestProxyBinaryHeaders makes sure binary metadata in request headers and
+// response trailers is forwarded byte for byte over HTTP/1.1 and HTTP/2, where
+// trailers don't need to be declared.
+func TestProxyBinaryHeaders(t *testing.T) {
+	value := []byte{0xde, 0xad, 0xbe, 0xef, 0x00}
+	padded := base64.StdEncoding.EncodeToString(value)
+	unpadded := base64.RawStdEncoding.EncodeToString(value)
+
+	for _, useHTTP2 := range []bool{false, true} {
+		var received []string
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				received = r.Header.Values("Request-Bin")
+
+				// HTTP/1.1 clients only see declared
+				// trailers, over HTTP/2 the trailer isn't
+				// declared upfront.
+				trailer := "Response-Bin"
+				if useHTTP2 {
+					trailer = http.TrailerPrefix + trailer
+				} else {
+					w.Header().Set("Trailer", trailer)
+				}
+				w.Header().Set("Header-Bin", padded)
+				_, _ = w.Write([]byte("ok"))
+				w.Header().Set(trailer, padded+","+unpadded)
+			},
+		))
+		backend.EnableHTTP2 = useHTTP2
+		backend.StartTLS()
+
+		p, err := New(auth.NewMockAuthenticator(), []*Service{{
+			Name: "grpc",
+			Address: strings.TrimPrefix(
+				backend.URL, "https://",
+			),
+			Protocol:   "https",
+			HostRegexp: ".*",
+			Auth:       "off",
+		}})
+		require.NoError(t, err)
+		server := httptest.NewUnstartedServer(p)
+		server.EnableHTTP2 = useHTTP2
+		server.StartTLS()
+
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Request-Bin", padded+", "+unpadded)
+
+		resp, err := server.Client().Do(req)
+		require.NoError(t, err)
+
+		_, err = ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		server.Close()
+		backend.Close()
+
+		if useHTTP2 {
+			require.Equal(t, 2, resp.ProtoMajor)
+		}
+		require.Equal(t, []string{padded, unpadded}, received)
+		require.Equal(t, padded, resp.Header.Get("Header-Bin"))
+		require.Equal(
+			t, []string{padded, unpadded},
+			resp.Trailer["Response-Bin"],
+		)
+	}
+}
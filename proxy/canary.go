@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"math/rand"
+)
+
+// validateCanary makes sure the canary settings of the given service are
+// sane.
+func validateCanary(service *Service) error {
+	if service.CanaryAddress == "" {
+		return nil
+	}
+
+	switch {
+	case service.CanaryWeight <= 0 || service.CanaryWeight > 1:
+		return invalidField("canaryweight", "must be greater than 0 "+
+			"and at most 1")
+
+	case service.CanaryErrorRateThreshold < 0 ||
+		service.CanaryErrorRateThreshold > 1:
+
+		return invalidField("canaryerrorratethreshold", "must be "+
+			"between 0 and 1")
+
+	case service.CanaryAnalysisDuration < 0:
+		return invalidField("canaryanalysisduration", "cannot be "+
+			"negative")
+	}
+
+	return nil
+}
+
+// chooseBackend returns which of the service's backends the next request
+// should be proxied to.
+func (s *Service) chooseBackend() string {
+	if s.CanaryAddress != "" && rand.Float64() < s.CanaryWeight {
+		return BackendCanary
+	}
+
+	return BackendPrimary
+}
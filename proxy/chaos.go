@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	// chaosTimeout is the time a request with an injected timeout is held
+	// before a gateway timeout is returned, unless the client gives up
+	// earlier.
+	chaosTimeout = 30 * time.Second
+)
+
+// ChaosConfig is the configuration of the chaos testing mode of a service. In
+// chaos mode, faults are randomly injected into the requests proxied to the
+// service to test how clients cope with them. Each kind of fault is applied
+// independently with its configured probability.
+type ChaosConfig struct {
+	// Enabled turns on chaos mode. It can only be enabled if aperture was
+	// built with the chaos build tag.
+	Enabled bool `long:"enabled" description:"Enable chaos mode for the service, requires aperture to be built with the chaos build tag"`
+
+	// FailureProbability is the probability of a request failing with an
+	// internal server error.
+	FailureProbability float64 `long:"failureprobability" description:"Probability between 0 and 1 of a request failing with a 500 error"`
+
+	// DelayProbability is the probability of a request being delayed by a
+	// random duration between DelayMin and DelayMax before it is proxied.
+	DelayProbability float64 `long:"delayprobability" description:"Probability between 0 and 1 of a request being delayed"`
+
+	// DelayMin is the minimum delay added to a delayed request.
+	DelayMin time.Duration `long:"delaymin" description:"Minimum delay of a delayed request"`
+
+	// DelayMax is the maximum delay added to a delayed request.
+	DelayMax time.Duration `long:"delaymax" description:"Maximum delay of a delayed request"`
+
+	// TimeoutProbability is the probability of a request never being
+	// proxied, simulating a backend that doesn't respond.
+	TimeoutProbability float64 `long:"timeoutprobability" description:"Probability between 0 and 1 of a request timing out"`
+}
+
+// validate makes sure the chaos mode settings are sane.
+func (c *ChaosConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if !chaosBuild {
+		return invalidField("enabled", "chaos mode requires "+
+			"aperture to be built with the chaos build tag")
+	}
+
+	probabilities := []struct {
+		field string
+		value float64
+	}{
+		{"failureprobability", c.FailureProbability},
+		{"delayprobability", c.DelayProbability},
+		{"timeoutprobability", c.TimeoutProbability},
+	}
+	for _, p := range probabilities {
+		if p.value < 0 || p.value > 1 {
+			return invalidField(p.field, "must be between 0 and 1")
+		}
+	}
+
+	if c.DelayMin < 0 {
+		return invalidField("delaymin", "cannot be negative")
+	}
+	if c.DelayMax < c.DelayMin {
+		return invalidField("delaymax", "must not be lower than "+
+			"delaymin")
+	}
+
+	return nil
+}
+
+// chaosMiddleware injects faults into requests before handing them to the
+// next handler.
+type chaosMiddleware struct {
+	cfg ChaosConfig
+
+	// random returns a random number in [0, 1). It can be replaced in
+	// tests.
+	random func() float64
+}
+
+// newChaosMiddleware creates a new middleware that injects the faults
+// configured in the given chaos mode settings.
+func newChaosMiddleware(cfg ChaosConfig) *chaosMiddleware {
+	return &chaosMiddleware{
+		cfg:    cfg,
+		random: rand.Float64,
+	}
+}
+
+// wrap returns a handler that randomly injects faults into requests before
+// passing them on to the given handler.
+func (c *chaosMiddleware) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.random() < c.cfg.FailureProbability {
+			log.Debugf("Chaos mode: injecting failure into request "+
+				"%s", r.URL.Path)
+			sendDirectResponse(
+				w, r, http.StatusInternalServerError,
+				"chaos mode: injected failure",
+			)
+			return
+		}
+
+		if c.random() < c.cfg.TimeoutProbability {
+			log.Debugf("Chaos mode: injecting timeout into request "+
+				"%s", r.URL.Path)
+			if !c.sleep(r, chaosTimeout) {
+				return
+			}
+			sendDirectResponse(
+				w, r, http.StatusGatewayTimeout,
+				"chaos mode: injected timeout",
+			)
+			return
+		}
+
+		if c.random() < c.cfg.DelayProbability {
+			delay := c.cfg.DelayMin + time.Duration(
+				c.random()*float64(c.cfg.DelayMax-c.cfg.DelayMin),
+			)
+			log.Debugf("Chaos mode: delaying request %s by %v",
+				r.URL.Path, delay)
+			if !c.sleep(r, delay) {
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sleep waits for the given duration. It returns false if the client gave up
+// on the request in the meantime.
+func (c *chaosMiddleware) sleep(r *http.Request, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+
+	case <-r.Context().Done():
+		return false
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !chaos
+// +build !chaos
+
+package proxy
+
+// chaosBuild is true if aperture was built with the chaos build tag. Chaos
+// mode can only be enabled for a service if it is. Regular builds can't inject
+// faults so chaos mode can't accidentally be activated in production.
+const chaosBuild = false
@@ -0,0 +1,8 @@
+//go:build chaos
+// +build chaos
+
+package proxy
+
+// chaosBuild is true if aperture was built with the chaos build tag. Chaos
+// mode can only be enabled for a service if it is.
+const chaosBuild = true
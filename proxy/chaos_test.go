@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestChaosMiddleware makes sure the configured faults are injected depending
+// on the random numbers drawn.
+func TestChaosMiddleware(t *testing.T) {
+	t.Parallel()
+
+	chaos := newChaosMiddleware(ChaosConfig{
+		Enabled:            true,
+		FailureProbability: 0.1,
+		TimeoutProbability: 0.1,
+		DelayProbability:   0.5,
+		DelayMin:           10 * time.Millisecond,
+		DelayMax:           20 * time.Millisecond,
+	})
+
+	var nextCalled bool
+	handler := chaos.wrap(http.HandlerFunc(
+		func(w http.ResponseWriter, _ *http.Request) {
+			nextCalled = true
+			w.WriteHeader(http.StatusOK)
+		},
+	))
+
+	// serve runs a request through the middleware with the given random
+	// numbers being drawn in order.
+	serve := func(randoms ...float64) (*httptest.ResponseRecorder,
+		time.Duration) {
+
+		chaos.random = func() float64 {
+			r := randoms[0]
+			randoms = randoms[1:]
+			return r
+		}
+		nextCalled = false
+
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		return rec, time.Since(start)
+	}
+
+	// Without any fault being drawn, the request passes right through.
+	rec, _ := serve(0.9, 0.9, 0.9)
+	require.True(t, nextCalled)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// An injected failure never reaches the backend.
+	rec, _ = serve(0.05)
+	require.False(t, nextCalled)
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	// A delayed request reaches the backend after the delay.
+	rec, elapsed := serve(0.9, 0.9, 0.1, 0)
+	require.True(t, nextCalled)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.GreaterOrEqual(t, int64(elapsed), int64(10*time.Millisecond))
+}
+
+// TestChaosConfigValidate makes sure chaos mode can't be enabled without the
+// chaos build tag and that invalid settings are rejected.
+func TestChaosConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, (&ChaosConfig{}).validate())
+
+	cfg := &ChaosConfig{
+		Enabled:            true,
+		FailureProbability: 0.1,
+	}
+	if !chaosBuild {
+		require.Error(t, cfg.validate())
+		return
+	}
+	require.NoError(t, cfg.validate())
+
+	cfg.DelayProbability = 2
+	require.Error(t, cfg.validate())
+
+	cfg.DelayProbability = 0.1
+	cfg.DelayMin = time.Second
+	require.Error(t, cfg.validate())
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+)
+
+var (
+	// hdrContentSHA256 is the trailer field the hex encoded SHA-256 hash of
+	// the response body is sent in. gRPC clients receive it as the
+	// x-content-sha256 trailing metadata.
+	hdrContentSHA256 = http.CanonicalHeaderKey("X-Content-SHA256")
+)
+
+// checksumBody is a response body that hashes the bytes read from it and sets
+// the checksum trailer of the response once the body was read completely.
+type checksumBody struct {
+	// Reader copies everything read from the body into the hash.
+	io.Reader
+
+	body io.ReadCloser
+	hash hash.Hash
+	resp *http.Response
+}
+
+// addChecksumTrailer announces the checksum trailer in the given response and
+// wraps its body so the trailer is set once the body was streamed to the
+// client. Responses without a body are left untouched.
+func addChecksumTrailer(resp *http.Response) {
+	if resp.Body == nil || resp.Body == http.NoBody ||
+		resp.StatusCode == http.StatusSwitchingProtocols ||
+		resp.Request.Method == http.MethodHead {
+
+		return
+	}
+
+	// Trailers can only be sent with chunked encoding, so the length of
+	// the body can't be announced anymore.
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+
+	if resp.Trailer == nil {
+		resp.Trailer = make(http.Header)
+	}
+	resp.Trailer[hdrContentSHA256] = nil
+
+	h := sha256.New()
+	resp.Body = &checksumBody{
+		Reader: io.TeeReader(resp.Body, h),
+		body:   resp.Body,
+		hash:   h,
+		resp:   resp,
+	}
+}
+
+// Read reads from the response body and sets the checksum trailer after the
+// last byte was read.
+//
+// NOTE: This is part of the io.Reader interface.
+func (b *checksumBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.resp.Trailer.Set(
+			hdrContentSHA256, hex.EncodeToString(b.hash.Sum(nil)),
+		)
+	}
+
+	return n, err
+}
+
+// Close closes the underlying response body.
+//
+// NOTE: This is part of the io.Closer interface.
+func (b *checksumBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestChecksumTrailer makes sure the SHA-256 hash of a response body is sent in
+// a trailer if enabled for the service.
+func TestChecksumTrailer(t *testing.T) {
+	body := strings.Repeat("binary download ", 100000)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(
+				"Content-Type", "application/octet-stream",
+			)
+			_, _ = w.Write([]byte(body))
+		},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	newService := func(name, host string, checksum bool) *Service {
+		return &Service{
+			Name:                   name,
+			Address:                address,
+			Protocol:               "http",
+			HostRegexp:             host,
+			Auth:                   "off",
+			EnableChecksumTrailers: checksum,
+		}
+	}
+	p, err := New(auth.NewMockAuthenticator(), []*Service{
+		newService("checksum", "^checksum.test$", true),
+		newService("plain", ".*", false),
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	get := func(host, method string) *http.Response {
+		req, err := http.NewRequest(method, server.URL, nil)
+		require.NoError(t, err)
+		req.Host = host
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		received, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		if method == http.MethodGet {
+			require.Equal(t, body, string(received))
+		}
+
+		return resp
+	}
+
+	hash := sha256.Sum256([]byte(body))
+	resp := get("checksum.test", http.MethodGet)
+	require.Equal(
+		t, hex.EncodeToString(hash[:]),
+		resp.Trailer.Get("X-Content-SHA256"),
+	)
+
+	// Responses without a body don't get a checksum.
+	resp = get("checksum.test", http.MethodHead)
+	require.Empty(t, resp.Trailer.Get("X-Content-SHA256"))
+
+	// Services without checksums enabled don't get one either.
+	resp = get("other.test", http.MethodGet)
+	require.Empty(t, resp.Trailer.Get("X-Content-SHA256"))
+}
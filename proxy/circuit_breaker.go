@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBreakerOpenDuration is the default time an open circuit
+	// breaker rejects all requests before probing the backend again.
+	defaultBreakerOpenDuration = 30 * time.Second
+
+	// defaultBreakerProbes is the default number of probe requests that
+	// must succeed to close a half-open circuit breaker.
+	defaultBreakerProbes = 1
+)
+
+// CircuitBreaker configures the circuit breaker of a service. Once the primary
+// backend of the service failed too many requests in a row, the breaker opens
+// and requests are rejected with 503 Service Unavailable without contacting
+// the backend. After a while, a few probe requests are let through again to
+// find out whether the backend recovered.
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failed requests after which
+	// the breaker opens. Requests fail if the backend can't be reached or
+	// responds with a server error.
+	Threshold int `long:"threshold" description:"The number of consecutive failed backend requests after which the breaker opens"`
+
+	// OpenDuration is the time the breaker stays open before probe
+	// requests are let through. It defaults to 30 seconds.
+	OpenDuration time.Duration `long:"openduration" description:"The time the breaker rejects all requests before probing the backend. Defaults to 30s."`
+
+	// HalfOpenProbes is the number of probe requests that must succeed
+	// to close the breaker. Only that many requests are let through at
+	// the same time while the breaker is half-open. It defaults to 1.
+	HalfOpenProbes int `long:"halfopenprobes" description:"The number of probe requests that must succeed to close the breaker again. Defaults to 1."`
+}
+
+// validate makes sure the circuit breaker settings are sane.
+func (c *CircuitBreaker) validate() error {
+	switch {
+	case c.Threshold <= 0:
+		return invalidField("threshold", "must be positive")
+
+	case c.OpenDuration < 0:
+		return invalidField("openduration", "cannot be negative")
+
+	case c.HalfOpenProbes < 0:
+		return invalidField("halfopenprobes", "cannot be negative")
+	}
+
+	return nil
+}
+
+// breakerState is the state of a circuit breaker.
+type breakerState uint8
+
+const (
+	// breakerClosed means requests are forwarded to the backend.
+	breakerClosed breakerState = iota
+
+	// breakerOpen means requests are rejected.
+	breakerOpen
+
+	// breakerHalfOpen means a limited number of probe requests are
+	// forwarded to find out whether the backend recovered.
+	breakerHalfOpen
+)
+
+// circuitBreaker keeps track of the failed requests to the primary backend of
+// a service and stops forwarding requests to it while it keeps failing.
+type circuitBreaker struct {
+	service string
+
+	threshold    int
+	openDuration time.Duration
+	probes       int
+
+	// now returns the current time. It can be replaced in tests.
+	now func() time.Time
+
+	mtx   sync.Mutex
+	state breakerState
+
+	// failures is the number of consecutive failed requests while the
+	// breaker is closed.
+	failures int
+
+	// openedAt is the time the breaker last opened.
+	openedAt time.Time
+
+	// inFlightProbes is the number of probe requests that are still
+	// being served while the breaker is half-open.
+	inFlightProbes int
+
+	// succeededProbes is the number of probe requests that succeeded
+	// since the breaker became half-open.
+	succeededProbes int
+}
+
+// newCircuitBreaker creates a new closed circuit breaker for the given
+// service.
+func newCircuitBreaker(service string, cfg *CircuitBreaker) *circuitBreaker {
+	openDuration := cfg.OpenDuration
+	if openDuration == 0 {
+		openDuration = defaultBreakerOpenDuration
+	}
+	probes := cfg.HalfOpenProbes
+	if probes == 0 {
+		probes = defaultBreakerProbes
+	}
+
+	return &circuitBreaker{
+		service:      service,
+		threshold:    cfg.Threshold,
+		openDuration: openDuration,
+		probes:       probes,
+		now:          time.Now,
+	}
+}
+
+// allow returns whether a request may be forwarded to the backend and whether
+// it is a probe request. Rejected requests are returned the time after which
+// they can be retried.
+func (b *circuitBreaker) allow() (bool, bool, time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := b.now()
+	if b.state == breakerOpen {
+		retryAfter := b.openedAt.Add(b.openDuration).Sub(now)
+		if retryAfter > 0 {
+			return false, false, retryAfter
+		}
+
+		log.Infof("Circuit breaker of service %s half-open, probing "+
+			"backend", b.service)
+
+		b.state = breakerHalfOpen
+		b.inFlightProbes = 0
+		b.succeededProbes = 0
+	}
+
+	if b.state == breakerClosed {
+		return true, false, 0
+	}
+
+	// Only let as many probes through at once as need to succeed.
+	if b.inFlightProbes+b.succeededProbes >= b.probes {
+		return false, false, time.Second
+	}
+	b.inFlightProbes++
+
+	return true, true, 0
+}
+
+// probeDone marks a probe request as served, no matter whether its outcome was
+// recorded. Probes of clients that went away don't tell us anything about the
+// backend, so another probe can take their place.
+func (b *circuitBreaker) probeDone() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.state == breakerHalfOpen && b.inFlightProbes > 0 {
+		b.inFlightProbes--
+	}
+}
+
+// record updates the breaker with the outcome of a request to the backend.
+func (b *circuitBreaker) record(failed bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	switch {
+	case b.state == breakerClosed && !failed:
+		b.failures = 0
+
+	case b.state == breakerClosed:
+		b.failures++
+		if b.failures >= b.threshold {
+			log.Warnf("Circuit breaker of service %s opened after "+
+				"%d consecutive failed requests", b.service,
+				b.failures)
+			b.trip()
+		}
+
+	case b.state == breakerHalfOpen && failed:
+		log.Warnf("Circuit breaker of service %s opened again, probe "+
+			"request failed", b.service)
+		b.trip()
+
+	case b.state == breakerHalfOpen:
+		b.succeededProbes++
+		if b.succeededProbes >= b.probes {
+			log.Warnf("Circuit breaker of service %s closed, "+
+				"backend recovered", b.service)
+
+			b.state = breakerClosed
+			b.failures = 0
+			breakerResets.WithLabelValues(b.service).Inc()
+		}
+	}
+}
+
+// trip opens the breaker.
+//
+// NOTE: The mutex must be held when calling this method.
+func (b *circuitBreaker) trip() {
+	b.state = breakerOpen
+	b.openedAt = b.now()
+	b.failures = 0
+	breakerTrips.WithLabelValues(b.service).Inc()
+}
+
+// filter sends a 503 Service Unavailable response and returns false if the
+// breaker is open. The Retry-After header tells the client in how many seconds
+// the backend is probed again. Otherwise it returns true along with a function
+// that must be called once the request was served.
+func (b *circuitBreaker) filter(w http.ResponseWriter,
+	r *http.Request) (bool, func()) {
+
+	ok, probe, delay := b.allow()
+	if !ok {
+		retryAfter := int64(math.Ceil(delay.Seconds()))
+		addCorsHeaders(w.Header())
+		w.Header().Set(
+			"Retry-After", strconv.FormatInt(retryAfter, 10),
+		)
+		sendDirectResponse(
+			w, r, http.StatusServiceUnavailable,
+			"service temporarily unavailable",
+		)
+		return false, nil
+	}
+
+	if probe {
+		return true, b.probeDone
+	}
+
+	return true, func() {}
+}
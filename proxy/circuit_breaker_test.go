@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCircuitBreaker makes sure the circuit breaker of a service opens after
+// the configured number of consecutive failures, rejects requests without
+// contacting the backend while open and closes again once the probe requests
+// succeed.
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		failing int32 = 1
+		hits    int32
+	)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			if atomic.LoadInt32(&failing) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "fragile",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "off",
+		CircuitBreaker: &CircuitBreaker{
+			Threshold:      3,
+			OpenDuration:   10 * time.Second,
+			HalfOpenProbes: 2,
+		},
+	}})
+	require.NoError(t, err)
+
+	now := time.Now()
+	breaker := p.Services()[0].breaker
+	breaker.now = func() time.Time {
+		return now
+	}
+
+	trips := breakerTrips.WithLabelValues("fragile")
+	resets := breakerResets.WithLabelValues("fragile")
+
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec
+	}
+
+	// The failures of the backend are passed on until the threshold is
+	// reached.
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusBadGateway, send().Code)
+	}
+	require.EqualValues(t, 3, atomic.LoadInt32(&hits))
+	require.EqualValues(t, 1, counterValue(trips))
+
+	// While open, requests are rejected without contacting the backend.
+	now = now.Add(2500 * time.Millisecond)
+	rec := send()
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "8", rec.Header().Get("Retry-After"))
+	require.EqualValues(t, 3, atomic.LoadInt32(&hits))
+
+	// A failed probe opens the breaker again.
+	now = now.Add(10 * time.Second)
+	require.Equal(t, http.StatusBadGateway, send().Code)
+	require.Equal(t, http.StatusServiceUnavailable, send().Code)
+	require.EqualValues(t, 4, atomic.LoadInt32(&hits))
+	require.EqualValues(t, 2, counterValue(trips))
+
+	// Once the backend recovered, the breaker closes after enough probes
+	// succeeded.
+	atomic.StoreInt32(&failing, 0)
+	now = now.Add(10 * time.Second)
+	require.Equal(t, http.StatusOK, send().Code)
+	require.Equal(t, http.StatusOK, send().Code)
+	require.EqualValues(t, 1, counterValue(resets))
+
+	// A single failure doesn't open the closed breaker.
+	atomic.StoreInt32(&failing, 1)
+	require.Equal(t, http.StatusBadGateway, send().Code)
+	atomic.StoreInt32(&failing, 0)
+	require.Equal(t, http.StatusOK, send().Code)
+	require.EqualValues(t, 2, counterValue(trips))
+}
+
+// TestCircuitBreakerProbes makes sure no more probe requests are let through
+// at the same time than need to succeed to close the breaker.
+func TestCircuitBreakerProbes(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	b := newCircuitBreaker("probes", &CircuitBreaker{Threshold: 1})
+	b.now = func() time.Time {
+		return now
+	}
+
+	b.record(true)
+	ok, _, delay := b.allow()
+	require.False(t, ok)
+	require.Equal(t, defaultBreakerOpenDuration, delay)
+
+	now = now.Add(defaultBreakerOpenDuration)
+	ok, probe, _ := b.allow()
+	require.True(t, ok)
+	require.True(t, probe)
+
+	ok, _, _ = b.allow()
+	require.False(t, ok)
+
+	// A probe that finished without an outcome, e.g. because the client
+	// went away, makes room for another one.
+	b.probeDone()
+	ok, probe, _ = b.allow()
+	require.True(t, ok)
+	require.True(t, probe)
+}
@@ -0,0 +1,502 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCoalescingWindow is the default time after a backend request
+	// was sent during which identical requests are served its response.
+	defaultCoalescingWindow = time.Second
+)
+
+// coalescer makes sure identical GET requests to a service that arrive within
+// its coalescing window only result in a single backend request. The response
+// of that request is streamed to its own client and to all other clients that
+// are waiting for it. Only responses the backend explicitly marks as cacheable
+// by shared caches are shared, as the clients may hold different LSATs and
+// would otherwise be served each other's responses.
+type coalescer struct {
+	window time.Duration
+
+	// now returns the current time. It can be replaced in tests.
+	now func() time.Time
+
+	mtx   sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is a backend request whose response is shared by all
+// identical requests.
+type coalescedCall struct {
+	// started is the time the backend request was sent.
+	started time.Time
+
+	// reqHeader is the header of the request that was sent to the
+	// backend. The response is only shared with requests that send the
+	// same values for the fields the response varies on.
+	reqHeader http.Header
+
+	// headerDone is closed once the header of the response is available.
+	headerDone chan struct{}
+
+	// The following fields are set before headerDone is closed and never
+	// change afterwards.
+	status     int
+	header     http.Header
+	shareable  bool
+	shareUntil time.Time
+
+	// The following fields are guarded by mtx. The body grows while the
+	// response is streamed, cond is signaled whenever it does and once
+	// the response is finished.
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	body     []byte
+	trailer  http.Header
+	finished bool
+}
+
+// newCoalescer creates a new coalescer that shares backend responses with
+// identical requests arriving within the given window.
+func newCoalescer(window time.Duration) *coalescer {
+	if window == 0 {
+		window = defaultCoalescingWindow
+	}
+
+	return &coalescer{
+		window: window,
+		now:    time.Now,
+		calls:  make(map[string]*coalescedCall),
+	}
+}
+
+// coalescingKey returns the key identical requests share, or false if the
+// request must not be coalesced.
+func coalescingKey(r *http.Request) (string, bool) {
+	// Upgraded connections can't share a response.
+	if r.Method != http.MethodGet || isUpgradeRequest(r) {
+		return "", false
+	}
+
+	// Clients can ask for a fresh response.
+	directives := parseCacheControl(r.Header)
+	if _, ok := directives["no-cache"]; ok {
+		return "", false
+	}
+	if _, ok := directives["no-store"]; ok {
+		return "", false
+	}
+
+	key := r.Method + " " + r.Host + r.URL.Path + "?" + r.URL.RawQuery
+
+	// Clients negotiating different content must not share a response.
+	for _, name := range negotiationHeaders {
+		key += " " + name + "=" + strings.Join(
+			r.Header.Values(name), ",",
+		)
+	}
+
+	return key, true
+}
+
+// wrap returns a handler that coalesces identical requests before passing them
+// on to the given handler.
+func (c *coalescer) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := coalescingKey(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		call, leader := c.join(key, r)
+		if leader {
+			c.lead(key, call, next, w, r)
+			return
+		}
+
+		select {
+		case <-call.headerDone:
+		case <-r.Context().Done():
+			return
+		}
+
+		// The backend didn't allow the response to be shared, or it
+		// depends on fields of the request that differ, so the request
+		// needs to be sent on its own.
+		if !call.shareable || !varyMatches(call, r.Header) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log.Debugf("Serving coalesced response to request %s", key)
+		call.streamTo(w)
+	})
+}
+
+// join returns the call whose response a request with the given key can be
+// served, and whether a new call was created that the caller must lead.
+func (c *coalescer) join(key string, r *http.Request) (*coalescedCall, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := c.now()
+	call, ok := c.calls[key]
+	if ok {
+		select {
+		case <-call.headerDone:
+			if call.shareable && now.Before(call.shareUntil) {
+				return call, false
+			}
+
+		default:
+			if now.Before(call.started.Add(c.window)) {
+				return call, false
+			}
+		}
+	}
+
+	call = &coalescedCall{
+		started:    now,
+		reqHeader:  r.Header.Clone(),
+		headerDone: make(chan struct{}),
+	}
+	call.cond = sync.NewCond(&call.mtx)
+	c.calls[key] = call
+
+	return call, true
+}
+
+// lead sends the backend request of the given call, streams its response to
+// the client of the request and makes it available to the requests waiting
+// for it.
+func (c *coalescer) lead(key string, call *coalescedCall, next http.Handler,
+	w http.ResponseWriter, r *http.Request) {
+
+	// Other clients depend on the response as well, so the backend request
+	// must not be canceled if the client of this one goes away.
+	writer := &coalescingWriter{
+		ResponseWriter: w,
+		coalescer:      c,
+		call:           call,
+	}
+	next.ServeHTTP(writer, r.WithContext(detachedContext{r.Context()}))
+	writer.finish()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// Once the response can't be shared anymore, the call is removed so
+	// the next request is sent to the backend again.
+	now := c.now()
+	if !call.shareable || !now.Before(call.shareUntil) {
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		return
+	}
+	time.AfterFunc(call.shareUntil.Sub(now), func() {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+	})
+}
+
+// shareUntil determines whether the given response header allows the response
+// to be shared with other clients and until when it may be served to identical
+// requests. Only responses marked as public or carrying an s-maxage may be
+// stored by shared caches when they answer authenticated requests, which is
+// what all requests to paid services are.
+func (c *coalescer) shareUntil(call *coalescedCall, header http.Header,
+	now time.Time) (bool, time.Time) {
+
+	directives := parseCacheControl(header)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return false, time.Time{}
+		}
+	}
+	_, public := directives["public"]
+	sMaxAge, shared := directives["s-maxage"]
+	if !public && !shared {
+		return false, time.Time{}
+	}
+
+	// Cookies set for one client must never reach another one.
+	if len(header.Values("Set-Cookie")) > 0 {
+		return false, time.Time{}
+	}
+	for _, name := range varyFields(header) {
+		if name == "*" {
+			return false, time.Time{}
+		}
+	}
+
+	shareUntil := call.started.Add(c.window)
+
+	// A shared cache must prefer s-maxage over max-age.
+	maxAge, ok := sMaxAge, shared
+	if !ok {
+		maxAge, ok = directives["max-age"]
+	}
+	if ok {
+		seconds, err := strconv.ParseInt(maxAge, 10, 64)
+		if err == nil {
+			expiry := now.Add(time.Duration(seconds) * time.Second)
+			if expiry.Before(shareUntil) {
+				shareUntil = expiry
+			}
+		}
+	}
+
+	return true, shareUntil
+}
+
+// varyFields returns the canonical names of the request header fields the
+// response with the given header varies on.
+func varyFields(header http.Header) []string {
+	var fields []string
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			fields = append(
+				fields, http.CanonicalHeaderKey(field),
+			)
+		}
+	}
+
+	return fields
+}
+
+// varyMatches returns true if the given request header has the same values as
+// the request of the given call for all fields the response varies on.
+func varyMatches(call *coalescedCall, header http.Header) bool {
+	for _, name := range varyFields(call.header) {
+		requested := strings.Join(header.Values(name), ",")
+		sent := strings.Join(call.reqHeader.Values(name), ",")
+		if requested != sent {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseCacheControl parses the directives of the Cache-Control fields of the
+// given header into a map of lower case directive names to their values.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+
+			parts := strings.SplitN(directive, "=", 2)
+			name := strings.ToLower(parts[0])
+			if len(parts) == 1 {
+				directives[name] = ""
+				continue
+			}
+			directives[name] = strings.Trim(parts[1], `"`)
+		}
+	}
+
+	return directives
+}
+
+// coalescingWriter is the response writer of the request whose response is
+// shared. It streams the response to its own client and records it for all
+// others. If its own client goes away, the response is still recorded.
+type coalescingWriter struct {
+	http.ResponseWriter
+
+	coalescer *coalescer
+	call      *coalescedCall
+
+	wroteHeader bool
+	clientGone  bool
+}
+
+// WriteHeader writes the header to the client and makes it available to the
+// requests waiting for the response.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (c *coalescingWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+
+	call := c.call
+	call.status = status
+	call.header = c.Header().Clone()
+	call.shareable, call.shareUntil = c.coalescer.shareUntil(
+		call, call.header, c.coalescer.now(),
+	)
+	close(call.headerDone)
+
+	c.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes to the client and appends to the shared body.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (c *coalescingWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.call.shareable {
+		c.call.mtx.Lock()
+		c.call.body = append(c.call.body, p...)
+		c.call.cond.Broadcast()
+		c.call.mtx.Unlock()
+	}
+
+	// An error would abort the backend request, which the other clients
+	// still wait for.
+	if !c.clientGone {
+		if _, err := c.ResponseWriter.Write(p); err != nil {
+			c.clientGone = true
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush sends any buffered data to the client.
+//
+// NOTE: This is part of the http.Flusher interface.
+func (c *coalescingWriter) Flush() {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok &&
+		!c.clientGone {
+
+		flusher.Flush()
+	}
+}
+
+// finish marks the response as complete and records its trailer.
+func (c *coalescingWriter) finish() {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	c.call.mtx.Lock()
+	defer c.call.mtx.Unlock()
+
+	c.call.trailer = responseTrailer(c.Header())
+	c.call.finished = true
+	c.call.cond.Broadcast()
+}
+
+// responseTrailer returns the trailer fields a handler set in the given
+// response header, declared ones as well as the ones using http.TrailerPrefix.
+func responseTrailer(header http.Header) http.Header {
+	trailer := make(http.Header)
+	for _, value := range header.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values, ok := header[name]; ok {
+				trailer[name] = append([]string(nil), values...)
+			}
+		}
+	}
+	for name, values := range header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			trailer[name] = append([]string(nil), values...)
+		}
+	}
+
+	return trailer
+}
+
+// streamTo writes the shared response to the given response writer as it
+// arrives, followed by its trailer.
+func (c *coalescedCall) streamTo(w http.ResponseWriter) {
+	for name, values := range c.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(c.status)
+
+	flusher, _ := w.(http.Flusher)
+	var offset int
+	for {
+		c.mtx.Lock()
+		for offset == len(c.body) && !c.finished {
+			c.cond.Wait()
+		}
+		chunk := c.body[offset:]
+		finished := c.finished && offset+len(chunk) == len(c.body)
+		trailer := c.trailer
+		c.mtx.Unlock()
+
+		if len(chunk) > 0 {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			offset += len(chunk)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if finished {
+			for name, values := range trailer {
+				w.Header()[name] = values
+			}
+			return
+		}
+	}
+}
+
+// detachedContext is a context that carries the values of its parent but is
+// never canceled.
+type detachedContext struct {
+	parent context.Context
+}
+
+// Deadline returns no deadline.
+//
+// NOTE: This is part of the context.Context interface.
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Done returns nil as the context is never canceled.
+//
+// NOTE: This is part of the context.Context interface.
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+// Err always returns nil as the context is never canceled.
+//
+// NOTE: This is part of the context.Context interface.
+func (detachedContext) Err() error {
+	return nil
+}
+
+// Value returns the value the parent context holds for the given key.
+//
+// NOTE: This is part of the context.Context interface.
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCoalescing makes sure identical GET requests within the coalescing window
+// only result in a single backend request, unless the backend forbids sharing
+// its response.
+func TestCoalescing(t *testing.T) {
+	var (
+		backendRequests int32
+		cacheControl    atomic.Value
+		release         = make(chan struct{})
+		entered         = make(chan struct{}, 20)
+	)
+	cacheControl.Store("public")
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&backendRequests, 1)
+			entered <- struct{}{}
+			<-release
+
+			w.Header().Set(
+				"Cache-Control", cacheControl.Load().(string),
+			)
+			w.Header().Set("Vary", "X-Client")
+			_, _ = fmt.Fprintf(w, "response %d", n)
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:             "feed",
+		Address:          strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:         "http",
+		HostRegexp:       ".*",
+		Auth:             "off",
+		EnableCoalescing: true,
+		CoalescingWindow: time.Minute,
+	}})
+	require.NoError(t, err)
+
+	now := time.Now()
+	var nowMtx sync.Mutex
+	coalescer := p.services[0].coalescer
+	coalescer.now = func() time.Time {
+		nowMtx.Lock()
+		defer nowMtx.Unlock()
+
+		return now
+	}
+	advance := func(d time.Duration) {
+		nowMtx.Lock()
+		defer nowMtx.Unlock()
+
+		now = now.Add(d)
+	}
+
+	client := ""
+	send := func(method, target string) string {
+		req := httptest.NewRequest(method, target, nil)
+		if client != "" {
+			req.Header.Set("X-Client", client)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		return rec.Body.String()
+	}
+	get := func(target string) string {
+		return send(http.MethodGet, target)
+	}
+
+	// Concurrent identical requests share a single backend request.
+	var (
+		wg        sync.WaitGroup
+		responses = make(chan string, 5)
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses <- get("/price?pair=btcusd")
+		}()
+	}
+	<-entered
+	close(release)
+	wg.Wait()
+	close(responses)
+	for response := range responses {
+		require.Equal(t, "response 1", response)
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(&backendRequests))
+
+	// Requests arriving within the window after the response was received
+	// are served the same response.
+	advance(30 * time.Second)
+	require.Equal(t, "response 1", get("/price?pair=btcusd"))
+
+	// Clients sending different values for the fields the response varies
+	// on aren't served the same response.
+	client = "other"
+	require.Equal(t, "response 2", get("/price?pair=btcusd"))
+	client = ""
+
+	// Different query strings and other methods aren't coalesced.
+	require.Equal(t, "response 3", get("/price?pair=btceur"))
+	require.Equal(
+		t, "response 4", send(http.MethodPost, "/price?pair=btceur"),
+	)
+
+	// Once the window passed, the backend is asked again.
+	advance(time.Minute)
+	require.Equal(t, "response 5", get("/price?pair=btcusd"))
+
+	// Responses the backend doesn't explicitly allow shared caches to
+	// store aren't reused, as they may depend on the client's LSAT.
+	cacheControl.Store("")
+	require.Equal(t, "response 6", get("/price?pair=xmr"))
+	require.Equal(t, "response 7", get("/price?pair=xmr"))
+
+	// Neither are responses the backend doesn't allow to be shared.
+	cacheControl.Store("no-store")
+	require.Equal(t, "response 8", get("/price?pair=ltc"))
+	require.Equal(t, "response 9", get("/price?pair=ltc"))
+
+	// A max-age shorter than the window limits the reuse.
+	cacheControl.Store("public, max-age=10")
+	require.Equal(t, "response 10", get("/price?pair=eth"))
+	advance(5 * time.Second)
+	require.Equal(t, "response 10", get("/price?pair=eth"))
+	advance(10 * time.Second)
+	require.Equal(t, "response 11", get("/price?pair=eth"))
+}
+
+// TestCoalescingStream makes sure a shared response is streamed to all clients
+// while the backend sends it, and its trailer reaches all of them.
+func TestCoalescingStream(t *testing.T) {
+	var (
+		backendRequests int32
+		entered         = make(chan struct{}, 2)
+		release         = make(chan struct{})
+	)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&backendRequests, 1)
+
+			w.Header().Set("Cache-Control", "public")
+			w.Header().Set("Trailer", "X-Checksum")
+			_, _ = w.Write([]byte("first"))
+			w.(http.Flusher).Flush()
+			entered <- struct{}{}
+
+			<-release
+			_, _ = w.Write([]byte("second"))
+			w.Header().Set("X-Checksum", "abc")
+			w.Header().Set(http.TrailerPrefix+"X-Undeclared", "def")
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:             "feed",
+		Address:          strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:         "http",
+		HostRegexp:       ".*",
+		Auth:             "off",
+		EnableCoalescing: true,
+		CoalescingWindow: time.Minute,
+	}})
+	require.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	get := func() *http.Response {
+		resp, err := http.Get(server.URL + "/feed")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		return resp
+	}
+	readFirst := func(resp *http.Response) {
+		buf := make([]byte, len("first"))
+		_, err := io.ReadFull(resp.Body, buf)
+		require.NoError(t, err)
+		require.Equal(t, "first", string(buf))
+	}
+
+	// Both clients receive the first part of the response before the
+	// backend sent the rest.
+	leader := get()
+	defer leader.Body.Close()
+	<-entered
+	readFirst(leader)
+
+	waiter := get()
+	defer waiter.Body.Close()
+	readFirst(waiter)
+
+	close(release)
+	for _, resp := range []*http.Response{leader, waiter} {
+		rest, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "second", string(rest))
+		require.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+		require.Equal(t, "def", resp.Trailer.Get("X-Undeclared"))
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(&backendRequests))
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// BusyRetryAfter is the time clients are told to wait in the
+	// Retry-After header before retrying a request that was rejected
+	// because too many requests were in flight.
+	BusyRetryAfter = time.Second
+)
+
+var (
+	// backendInFlight tracks the number of requests that are being
+	// proxied to the backends of each service.
+	backendInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "aperture",
+		Subsystem: "proxy",
+		Name:      "backend_in_flight_requests",
+	}, []string{serviceLabel})
+
+	// backendQueued tracks the number of requests waiting for one of the
+	// in-flight requests to the backends of each service to complete.
+	backendQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "aperture",
+		Subsystem: "proxy",
+		Name:      "backend_queued_requests",
+	}, []string{serviceLabel})
+)
+
+// concurrencyLimiter limits the number of requests that are proxied to the
+// backends of a service at the same time. Requests that arrive while the limit
+// is reached wait in a bounded queue until one of the in-flight requests
+// completes. They are rejected with 503 Service Unavailable if the queue is
+// full.
+type concurrencyLimiter struct {
+	service string
+
+	// slots holds a token for every in-flight request.
+	slots chan struct{}
+
+	maxQueued int
+
+	mtx    sync.Mutex
+	queued int
+}
+
+// newConcurrencyLimiter creates a new limiter that lets up to maxConcurrent
+// requests to the given service be in flight and up to maxQueued more wait.
+func newConcurrencyLimiter(service string, maxConcurrent,
+	maxQueued int) *concurrencyLimiter {
+
+	return &concurrencyLimiter{
+		service:   service,
+		slots:     make(chan struct{}, maxConcurrent),
+		maxQueued: maxQueued,
+	}
+}
+
+// wrap returns a handler that only passes requests on to the given handler
+// once fewer than the maximum number of requests are in flight.
+func (c *concurrencyLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.acquire(r) {
+			log.Debugf("Too many concurrent requests to service "+
+				"%s, rejecting request from %s", c.service,
+				r.RemoteAddr)
+			addCorsHeaders(w.Header())
+			SetBusyRetryAfter(w.Header())
+			sendDirectResponse(
+				w, r, http.StatusServiceUnavailable,
+				"service busy, please try again later",
+			)
+			return
+		}
+
+		// The slot must be released even if the backend request
+		// panics, which the reverse proxy does if the client goes
+		// away while the response is copied.
+		defer c.release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trackInFlight returns a handler that counts the requests the given handler
+// proxies to the backends of the given service while they are in flight.
+func trackInFlight(service string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Like the slot of the concurrency limiter, the request must
+		// not be counted anymore if the backend request panics.
+		inFlight := backendInFlight.WithLabelValues(service)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetBusyRetryAfter sets the Retry-After header of a response that rejects a
+// request because too many requests are in flight.
+func SetBusyRetryAfter(header http.Header) {
+	header.Set("Retry-After", strconv.Itoa(int(BusyRetryAfter.Seconds())))
+}
+
+// acquire reserves a slot for the given request, waiting in the queue if none
+// is available. It returns false if the queue is full or the client gave up
+// while waiting.
+func (c *concurrencyLimiter) acquire(r *http.Request) bool {
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	c.mtx.Lock()
+	if c.queued >= c.maxQueued {
+		c.mtx.Unlock()
+		return false
+	}
+	c.queued++
+	c.mtx.Unlock()
+
+	queued := backendQueued.WithLabelValues(c.service)
+	queued.Inc()
+	defer func() {
+		c.mtx.Lock()
+		c.queued--
+		c.mtx.Unlock()
+		queued.Dec()
+	}()
+
+	select {
+	case c.slots <- struct{}{}:
+		return true
+
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// release frees the slot of a request that completed.
+func (c *concurrencyLimiter) release() {
+	<-c.slots
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConcurrencyLimit makes sure only the configured number of requests are
+// proxied to a service at the same time, that a limited number wait and that
+// all others are rejected.
+func TestConcurrencyLimit(t *testing.T) {
+	var (
+		arrived = make(chan struct{}, 3)
+		release = make(chan struct{})
+	)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			arrived <- struct{}{}
+			<-release
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:          "limited",
+		Address:       strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:      "http",
+		HostRegexp:    ".*",
+		Auth:          "off",
+		MaxConcurrent: 1,
+		MaxQueueDepth: 1,
+	}})
+	require.NoError(t, err)
+
+	inFlight := backendInFlight.WithLabelValues("limited")
+	queued := backendQueued.WithLabelValues("limited")
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var (
+		wg   sync.WaitGroup
+		recs = make([]*httptest.ResponseRecorder, 2)
+	)
+	for i := range recs {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = send()
+		}()
+	}
+
+	// One request reaches the backend, the other one waits.
+	<-arrived
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(queued) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 1.0, testutil.ToFloat64(inFlight))
+
+	// With the queue full, further requests are rejected.
+	rec := send()
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	close(release)
+	wg.Wait()
+	for _, rec := range recs {
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	require.Equal(t, 0.0, testutil.ToFloat64(inFlight))
+	require.Equal(t, 0.0, testutil.ToFloat64(queued))
+
+	// A panicking backend request releases its slot as well.
+	limiter := newConcurrencyLimiter("panicking", 1, 0)
+	handler := limiter.wrap(trackInFlight("panicking", http.HandlerFunc(
+		func(http.ResponseWriter, *http.Request) {
+			panic(http.ErrAbortHandler)
+		},
+	)))
+	for i := 0; i < 2; i++ {
+		require.Panics(t, func() {
+			handler.ServeHTTP(
+				httptest.NewRecorder(),
+				httptest.NewRequest(http.MethodGet, "/", nil),
+			)
+		})
+	}
+	require.Equal(t, 0.0, testutil.ToFloat64(
+		backendInFlight.WithLabelValues("panicking"),
+	))
+}
+
+// TestInFlightRequests makes sure the requests in flight to the backends of a
+// service are counted even if its concurrency isn't limited.
+func TestInFlightRequests(t *testing.T) {
+	var (
+		arrived = make(chan struct{})
+		release = make(chan struct{})
+	)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			arrived <- struct{}{}
+			<-release
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "unlimited",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "off",
+	}})
+	require.NoError(t, err)
+
+	inFlight := backendInFlight.WithLabelValues("unlimited")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	<-arrived
+	require.Equal(t, 1.0, testutil.ToFloat64(inFlight))
+
+	close(release)
+	<-done
+	require.Equal(t, 0.0, testutil.ToFloat64(inFlight))
+}
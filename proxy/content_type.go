@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// contentTypeRule restricts the content types of requests to the paths that
+// match a regular expression.
+type contentTypeRule struct {
+	path *regexp.Regexp
+
+	// allowed is the set of lower case media types requests to matching
+	// paths can have. A media type can use a wildcard subtype like text/*.
+	allowed map[string]struct{}
+}
+
+// contentTypeFilter rejects requests whose content type isn't allowed for the
+// endpoint they're sent to, before they are authenticated or reach the
+// backend.
+type contentTypeFilter struct {
+	rules []*contentTypeRule
+}
+
+// newContentTypeFilter creates a filter that restricts the content types of
+// requests to the paths matching each regular expression to the given media
+// types.
+func newContentTypeFilter(
+	endpoints map[string][]string) (*contentTypeFilter, error) {
+
+	f := &contentTypeFilter{}
+	for pattern, mediaTypes := range endpoints {
+		path, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regexp %q: %v",
+				pattern, err)
+		}
+		if len(mediaTypes) == 0 {
+			return nil, fmt.Errorf("no content types allowed for "+
+				"path %q", pattern)
+		}
+
+		rule := &contentTypeRule{
+			path:    path,
+			allowed: make(map[string]struct{}, len(mediaTypes)),
+		}
+		for _, mediaType := range mediaTypes {
+			mediaType, _, err := mime.ParseMediaType(mediaType)
+			if err != nil {
+				return nil, fmt.Errorf("invalid content type "+
+					"for path %q: %v", pattern, err)
+			}
+			rule.allowed[mediaType] = struct{}{}
+		}
+		f.rules = append(f.rules, rule)
+	}
+
+	return f, nil
+}
+
+// allows returns true if the given rule allows the given lower case media
+// type.
+func (r *contentTypeRule) allows(mediaType string) bool {
+	if _, ok := r.allowed[mediaType]; ok {
+		return true
+	}
+
+	// The subtype can be left open by the rule.
+	parts := strings.SplitN(mediaType, "/", 2)
+	_, ok := r.allowed[parts[0]+"/*"]
+	return ok
+}
+
+// filter sends a 415 Unsupported Media Type response and returns false if the
+// content type of the given request isn't allowed for its path by all rules
+// that match it. Requests without a body of the GET, HEAD and OPTIONS methods
+// aren't checked. Otherwise it returns true and doesn't touch the response.
+func (f *contentTypeFilter) filter(w http.ResponseWriter,
+	r *http.Request) bool {
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	var rules []*contentTypeRule
+	for _, rule := range f.rules {
+		if rule.path.MatchString(r.URL.Path) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return true
+	}
+
+	// A request without a body doesn't need a content type, but one that
+	// has a body must declare it so the backend can't be confused about
+	// it.
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" && r.ContentLength == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	allowed := err == nil
+	for _, rule := range rules {
+		allowed = allowed && rule.allows(mediaType)
+	}
+	if allowed {
+		return true
+	}
+
+	addCorsHeaders(w.Header())
+	sendDirectResponse(
+		w, r, http.StatusUnsupportedMediaType,
+		"unsupported content type",
+	)
+	return false
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEndpointContentTypes makes sure requests with a content type that isn't
+// allowed for their endpoint are rejected before authentication.
+func TestEndpointContentTypes(t *testing.T) {
+	var backendRequests int
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "typed",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "on",
+		Price:      1,
+		EndpointContentTypes: map[string][]string{
+			"^/api/":       {"application/json"},
+			"^/api/notes$": {"application/json", "text/*"},
+			"^/upload$":    {"image/*"},
+		},
+	}})
+	require.NoError(t, err)
+
+	send := func(method, path, contentType,
+		body string) *httptest.ResponseRecorder {
+
+		req := httptest.NewRequest(
+			method, path, strings.NewReader(body),
+		)
+		req.Header.Set("Authorization", "LSAT foo:bar")
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	testCases := []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+	}{{
+		method:      http.MethodPost,
+		path:        "/api/users",
+		contentType: "application/json; charset=utf-8",
+		body:        "{}",
+		status:      http.StatusOK,
+	}, {
+		method:      http.MethodPost,
+		path:        "/api/users",
+		contentType: "text/plain",
+		body:        "{}",
+		status:      http.StatusUnsupportedMediaType,
+	}, {
+		// All matching rules must allow the content type.
+		method:      http.MethodPut,
+		path:        "/api/notes",
+		contentType: "text/plain",
+		body:        "note",
+		status:      http.StatusUnsupportedMediaType,
+	}, {
+		method:      http.MethodPost,
+		path:        "/upload",
+		contentType: "IMAGE/PNG",
+		body:        "png",
+		status:      http.StatusOK,
+	}, {
+		// A body without a content type is rejected.
+		method: http.MethodPost,
+		path:   "/upload",
+		body:   "png",
+		status: http.StatusUnsupportedMediaType,
+	}, {
+		// Requests without a body don't need one.
+		method: http.MethodDelete,
+		path:   "/api/users",
+		status: http.StatusOK,
+	}, {
+		method:      http.MethodGet,
+		path:        "/api/users",
+		contentType: "text/plain",
+		status:      http.StatusOK,
+	}, {
+		// Paths without a rule aren't checked.
+		method:      http.MethodPost,
+		path:        "/other",
+		contentType: "text/plain",
+		body:        "text",
+		status:      http.StatusOK,
+	}}
+	var forwarded int
+	for _, tc := range testCases {
+		rec := send(tc.method, tc.path, tc.contentType, tc.body)
+		require.Equal(
+			t, tc.status, rec.Code, "%s %s %s", tc.method, tc.path,
+			tc.contentType,
+		)
+		if tc.status == http.StatusOK {
+			forwarded++
+		}
+	}
+	require.Equal(t, forwarded, backendRequests)
+
+	// Invalid content types are rejected when preparing the services.
+	_, err = New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "invalid",
+		Address:    "127.0.0.1:1",
+		Protocol:   "http",
+		HostRegexp: ".*",
+		EndpointContentTypes: map[string][]string{
+			"^/api/": {"application/json;="},
+		},
+	}})
+	require.Error(t, err)
+}
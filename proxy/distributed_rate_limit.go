@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitStoreTimeout is the maximum time we wait for the rate limit
+	// store to decide whether a request may be proxied.
+	rateLimitStoreTimeout = time.Second
+
+	// rateLimitStoreBackoff is the time the rate limit store isn't asked
+	// again after it failed. All requests are let through in the
+	// meantime.
+	rateLimitStoreBackoff = 5 * time.Second
+)
+
+// RateLimitStore is an interface for the token buckets of rate limits that are
+// shared by multiple aperture instances.
+type RateLimitStore interface {
+	// TakeToken takes a token from the bucket with the given name. The
+	// bucket holds up to burst tokens and gets a new one every interval.
+	// If it is empty, false is returned along with the time until the
+	// next token is added.
+	TakeToken(ctx context.Context, bucket string, interval time.Duration,
+		burst int) (bool, time.Duration, error)
+}
+
+// distributedRateLimiter limits the rate of the requests proxied to the
+// services with a distributed rate limit, counting the requests proxied by all
+// aperture instances sharing its store. Rate limits are only meant to protect
+// the backends, so all requests are let through while the store can't be
+// reached rather than blocking all traffic.
+type distributedRateLimiter struct {
+	store RateLimitStore
+
+	// now returns the current time. It can be replaced in tests.
+	now func() time.Time
+
+	mtx sync.Mutex
+
+	// unavailableUntil is the time until which the store isn't asked
+	// again after it failed.
+	unavailableUntil time.Time
+}
+
+// newDistributedRateLimiter creates a new distributed rate limiter backed by
+// the given store.
+func newDistributedRateLimiter(store RateLimitStore) *distributedRateLimiter {
+	return &distributedRateLimiter{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+// available returns false if the store failed recently.
+func (d *distributedRateLimiter) available() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	return !d.now().Before(d.unavailableUntil)
+}
+
+// failed marks the store as unavailable for a while.
+func (d *distributedRateLimiter) failed() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.unavailableUntil = d.now().Add(rateLimitStoreBackoff)
+}
+
+// forService returns the limiter enforcing the rate limit of the given
+// service.
+func (d *distributedRateLimiter) forService(s *Service) requestLimiter {
+	burst := s.RateBurst
+	if burst == 0 {
+		burst = s.RateLimit
+	}
+
+	return &sharedBucket{
+		limiter:  d,
+		service:  s.Name,
+		interval: time.Second / time.Duration(s.RateLimit),
+		burst:    burst,
+	}
+}
+
+// sharedBucket is the token bucket of a single service in the rate limit
+// store.
+type sharedBucket struct {
+	limiter  *distributedRateLimiter
+	service  string
+	interval time.Duration
+	burst    int
+}
+
+// allow takes a token from the bucket of the service in the store and returns
+// true if there was one. If the store can't be reached, true is returned as
+// well.
+//
+// NOTE: This is part of the requestLimiter interface.
+func (b *sharedBucket) allow(ctx context.Context) (bool, time.Duration) {
+	if !b.limiter.available() {
+		return true, 0
+	}
+
+	storeCtx, cancel := context.WithTimeout(ctx, rateLimitStoreTimeout)
+	defer cancel()
+
+	ok, delay, err := b.limiter.store.TakeToken(
+		storeCtx, b.service, b.interval, b.burst,
+	)
+
+	// Clients going away don't tell us anything about the store.
+	if err != nil && ctx.Err() != nil {
+		return true, 0
+	}
+	if err != nil {
+		log.Warnf("Unable to check rate limit of service %s, letting "+
+			"requests through for %v: %v", b.service,
+			rateLimitStoreBackoff, err)
+
+		b.limiter.failed()
+		return true, 0
+	}
+
+	return ok, delay
+}
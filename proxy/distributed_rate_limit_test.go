@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// mockRateLimitStore is a rate limit store that lets a fixed number of
+// requests through.
+type mockRateLimitStore struct {
+	mtx       sync.Mutex
+	remaining int
+	err       error
+	calls     int
+}
+
+// TakeToken takes one of the remaining tokens.
+//
+// NOTE: This is part of the RateLimitStore interface.
+func (m *mockRateLimitStore) TakeToken(_ context.Context, _ string,
+	_ time.Duration, _ int) (bool, time.Duration, error) {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.calls++
+	if m.err != nil {
+		return false, 0, m.err
+	}
+	if m.remaining == 0 {
+		return false, 2 * time.Second, nil
+	}
+	m.remaining--
+
+	return true, 0, nil
+}
+
+// TestDistributedRateLimit makes sure services with a distributed rate limit
+// take their tokens from the shared store and that all requests are let
+// through while the store can't be reached.
+func TestDistributedRateLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	services := []*Service{{
+		Name:                 "limited",
+		Address:              address,
+		Protocol:             "http",
+		HostRegexp:           ".*",
+		Auth:                 "off",
+		RateLimit:            100,
+		RateLimitDistributed: true,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	store := &mockRateLimitStore{remaining: 1}
+	p.EnableDistributedRateLimits(store)
+
+	now := time.Now()
+	p.distributedRateLimiter.now = func() time.Time {
+		return now
+	}
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The local limit of the service would let all requests through, but
+	// the shared bucket is empty after the first one.
+	require.Equal(t, http.StatusOK, send().Code)
+	rec := send()
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.Equal(t, "2", rec.Header().Get("Retry-After"))
+
+	// Failing to reach the store lets the requests through without
+	// asking it again for a while.
+	store.err = errors.New("etcd unreachable")
+	require.Equal(t, http.StatusOK, send().Code)
+	require.Equal(t, http.StatusOK, send().Code)
+	require.Equal(t, 3, store.calls)
+
+	store.err = nil
+	now = now.Add(rateLimitStoreBackoff)
+	require.Equal(t, http.StatusTooManyRequests, send().Code)
+	require.Equal(t, 4, store.calls)
+
+	// A distributed rate limit requires a rate limit.
+	_, err = New(auth.NewMockAuthenticator(), []*Service{{
+		Name:                 "invalid",
+		HostRegexp:           ".*",
+		RateLimitDistributed: true,
+	}})
+	require.Error(t, err)
+}
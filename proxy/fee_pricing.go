@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// HeaderBuyerNode is the header a client can send the hex encoded
+	// public key of its Lightning node in. It is used as a hint to
+	// estimate the routing fees of services with dynamic fee pricing
+	// enabled.
+	HeaderBuyerNode = "Lsat-Buyer-Node"
+)
+
+var (
+	// KeyFeePricing is the key under which the fee pricing settings of a
+	// service are stored in the request context if dynamic fee pricing is
+	// enabled for it.
+	KeyFeePricing = lsat.ContextKey{Name: "feepricing"}
+)
+
+// FeePricing holds everything that is needed to add a routing fee buffer to
+// the price of a service.
+type FeePricing struct {
+	// BuyerNode is the public key of the buyer's node as sent by the
+	// client in the HeaderBuyerNode header. It is nil if the client
+	// didn't send a valid hint.
+	BuyerNode []byte
+
+	// BufferPercent is the buffer that is always added to the price, in
+	// percent of the base price.
+	BufferPercent uint32
+}
+
+// FeePricingFromContext returns the fee pricing settings stored in the given
+// request context, or nil if dynamic fee pricing isn't enabled.
+func FeePricingFromContext(ctx context.Context) *FeePricing {
+	pricing, ok := lsat.FromContext(ctx, KeyFeePricing).(*FeePricing)
+	if !ok {
+		return nil
+	}
+
+	return pricing
+}
+
+// withFeePricing returns a copy of the request that carries the fee pricing
+// settings of the given service in its context, if dynamic fee pricing is
+// enabled for it.
+func withFeePricing(r *http.Request, service *Service) *http.Request {
+	if !service.DynamicFeePricing {
+		return r
+	}
+
+	pricing := &FeePricing{
+		BufferPercent: service.FeeBufferPercent,
+	}
+
+	// The buyer node hint is optional. An invalid hint is ignored, we'll
+	// just not be able to estimate the routing fees.
+	hint := r.Header.Get(HeaderBuyerNode)
+	if hint != "" {
+		pubKey, err := hex.DecodeString(hint)
+		if err == nil {
+			_, err = btcec.ParsePubKey(pubKey)
+		}
+		if err != nil {
+			log.Debugf("Ignoring invalid buyer node hint %q: %v",
+				hint, err)
+		} else {
+			pricing.BuyerNode = pubKey
+		}
+	}
+
+	return r.WithContext(lsat.AddToContext(
+		r.Context(), KeyFeePricing, pricing,
+	))
+}
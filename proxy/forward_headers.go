@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// negotiationHeaders are the header fields of client requests that affect
+// content negotiation. The backend needs to see what the client asked for, so
+// they are forwarded as sent unless configured otherwise.
+var negotiationHeaders = []string{
+	"Accept", "Accept-Charset", "Accept-Encoding", "Accept-Language",
+}
+
+// parseForwardClientHeaders returns the set of canonical header names of the
+// given list, or of the default list if it is empty.
+func parseForwardClientHeaders(names []string) (map[string]struct{},
+	error) {
+
+	if len(names) == 0 {
+		names = negotiationHeaders
+	}
+
+	headers := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if err := validateHeaderName(name); err != nil {
+			return nil, err
+		}
+
+		headers[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+
+	return headers, nil
+}
+
+// forwardsClientHeader returns true if the given header field of client
+// requests is forwarded to the backend as sent.
+func (s *Service) forwardsClientHeader(name string) bool {
+	_, ok := s.forwardHeaders[http.CanonicalHeaderKey(name)]
+	return ok
+}
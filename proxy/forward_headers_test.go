@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestForwardClientHeaders makes sure the configured client header fields reach
+// the backend as sent and take precedence over the configured header fields.
+func TestForwardClientHeaders(t *testing.T) {
+	var received *http.Request
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			received = r
+		},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	newService := func(name, host string, forward []string) *Service {
+		return &Service{
+			Name:       name,
+			Address:    address,
+			Protocol:   "http",
+			HostRegexp: host,
+			Auth:       "off",
+			Headers: map[string]string{
+				"Accept-Language": "en",
+				"X-Custom":        "config",
+			},
+			ForwardClientHeaders: forward,
+		}
+	}
+	p, err := New(auth.NewMockAuthenticator(), []*Service{
+		newService("host", "^host.test$", []string{"host", "x-custom"}),
+		newService("default", ".*", nil),
+	})
+	require.NoError(t, err)
+
+	send := func(host string, header http.Header) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		req.Header = header
+		p.ServeHTTP(httptest.NewRecorder(), req)
+		require.NotNil(t, received)
+	}
+
+	// By default, the negotiation headers of the client are forwarded as
+	// sent, while other fields are added to.
+	send("other.test", http.Header{
+		"Accept-Language": []string{"de-CH, de;q=0.9"},
+		"Accept-Charset":  []string{"utf-8"},
+		"Accept-Encoding": []string{"br"},
+		"X-Custom":        []string{"client"},
+	})
+	require.Equal(
+		t, []string{"de-CH, de;q=0.9"},
+		received.Header.Values("Accept-Language"),
+	)
+	require.Equal(t, "utf-8", received.Header.Get("Accept-Charset"))
+	require.Equal(t, "br", received.Header.Get("Accept-Encoding"))
+	require.Equal(
+		t, []string{"client", "config"},
+		received.Header.Values("X-Custom"),
+	)
+	require.Equal(t, address, received.Host)
+
+	// Configured fields are still sent if the client didn't send them.
+	send("other.test", http.Header{})
+	require.Equal(t, "en", received.Header.Get("Accept-Language"))
+
+	// A custom list replaces the default one and can include the host.
+	send("host.test", http.Header{
+		"Accept-Language": []string{"de"},
+		"X-Custom":        []string{"client"},
+	})
+	require.Equal(
+		t, []string{"de", "en"},
+		received.Header.Values("Accept-Language"),
+	)
+	require.Equal(
+		t, []string{"client"}, received.Header.Values("X-Custom"),
+	)
+	require.Equal(t, "host.test", received.Host)
+
+	// Requests negotiating different content aren't coalesced.
+	german := httptest.NewRequest(http.MethodGet, "/", nil)
+	german.Header.Set("Accept-Language", "de")
+	english := httptest.NewRequest(http.MethodGet, "/", nil)
+	english.Header.Set("Accept-Language", "en")
+	germanKey, _ := coalescingKey(german)
+	englishKey, _ := coalescingKey(english)
+	require.NotEqual(t, germanKey, englishKey)
+
+	// Invalid header names are rejected.
+	err = prepareServices([]*Service{
+		newService("invalid", ".*", []string{"Bad Header"}),
+	}, nil)
+	require.Error(t, err)
+}
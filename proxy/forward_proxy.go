@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// ForwardProxyServiceName is the name of the service LSATs for using
+	// the forward proxy are issued for.
+	ForwardProxyServiceName = "forwardproxy"
+
+	// hdrProxyAuthorization is the header field clients of the forward
+	// proxy send their LSAT in, so the Authorization header field is left
+	// for the host they want to reach.
+	hdrProxyAuthorization = "Proxy-Authorization"
+
+	// forwardProxyDialTimeout is the maximum time we wait for a connection
+	// to a host requested through the forward proxy to be established.
+	forwardProxyDialTimeout = 10 * time.Second
+)
+
+// ForwardProxyConfig is the configuration of aperture acting as an HTTP
+// forward proxy, where clients name the host they want to reach in each
+// request, in addition to proxying for the configured services.
+type ForwardProxyConfig struct {
+	// Enabled makes the proxy forward requests with an absolute URL and
+	// tunnel CONNECT requests to the hosts they name.
+	Enabled bool `long:"enabled" description:"Forward requests with an absolute URL in the request line and tunnel CONNECT requests to the allowed hosts they name. Clients send their LSAT in the Proxy-Authorization header."`
+
+	// AllowedHosts is the list of hosts clients can reach through the
+	// forward proxy. An entry can restrict the port and a leading *.
+	// matches all subdomains of a domain.
+	AllowedHosts []string `long:"allowedhosts" description:"List of hosts clients may reach through the forward proxy, like example.com, example.com:443 to only allow a single port or *.example.com to allow all subdomains"`
+
+	// Price is the price in satoshis of an LSAT for using the forward
+	// proxy.
+	Price int64 `long:"price" description:"The price in satoshis of an LSAT for using the forward proxy. Defaults to 1 satoshi."`
+}
+
+// allowedHost is a host that can be reached through the forward proxy.
+type allowedHost struct {
+	// host is the lower case host name or IP address. If wildcard is set,
+	// it is the domain with a leading dot instead.
+	host string
+
+	// port is the only port that can be used. All ports can be used if it
+	// is empty.
+	port string
+
+	// wildcard is true if all subdomains of the domain can be reached.
+	wildcard bool
+}
+
+// matches returns true if the given host and port can be reached.
+func (a allowedHost) matches(host, port string) bool {
+	if a.port != "" && a.port != port {
+		return false
+	}
+
+	if a.wildcard {
+		return strings.HasSuffix(host, a.host)
+	}
+
+	return host == a.host
+}
+
+// parseAllowedHosts parses the allowed hosts of the forward proxy config.
+func parseAllowedHosts(hosts []string) ([]allowedHost, error) {
+	allowed := make([]allowedHost, 0, len(hosts))
+	for _, entry := range hosts {
+		host, port := strings.ToLower(entry), ""
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, port = h, p
+		}
+		host = strings.Trim(host, "[]")
+
+		wildcard := strings.HasPrefix(host, "*.")
+		if wildcard {
+			host = strings.TrimPrefix(host, "*")
+		}
+
+		if host == "" || strings.Contains(host, "*") ||
+			strings.Contains(host, "/") {
+
+			return nil, fmt.Errorf("invalid allowed host %q", entry)
+		}
+
+		allowed = append(allowed, allowedHost{
+			host:     host,
+			port:     port,
+			wildcard: wildcard,
+		})
+	}
+
+	return allowed, nil
+}
+
+// forwardProxy forwards requests to the hosts named by the clients.
+type forwardProxy struct {
+	allowedHosts []allowedHost
+	price        int64
+
+	// backend forwards requests with an absolute URL to their host.
+	backend http.Handler
+
+	// dial connects to the host of a CONNECT request.
+	dial func(network, address string) (net.Conn, error)
+}
+
+// EnableForwardProxy makes the proxy act as an HTTP forward proxy for the
+// allowed hosts of the given config. Requests with an absolute URL are
+// forwarded to the URL and CONNECT requests are tunneled to the host they
+// name, once the client paid for an LSAT of the ForwardProxyServiceName
+// service.
+func (p *Proxy) EnableForwardProxy(cfg *ForwardProxyConfig) error {
+	// An empty list doesn't mean all hosts, as that would turn us into an
+	// open proxy by accident.
+	if len(cfg.AllowedHosts) == 0 {
+		return errors.New("forward proxy requires at least one " +
+			"allowed host")
+	}
+	allowedHosts, err := parseAllowedHosts(cfg.AllowedHosts)
+	if err != nil {
+		return err
+	}
+
+	price := cfg.Price
+	switch {
+	case price == 0:
+		price = defaultServicePrice
+
+	case price < 0 || price > maxServicePrice:
+		return fmt.Errorf("forward proxy price must be between 0 and "+
+			"%d satoshis", int64(maxServicePrice))
+	}
+
+	dialer := &net.Dialer{Timeout: forwardProxyDialTimeout}
+	p.forwardProxy = &forwardProxy{
+		allowedHosts: allowedHosts,
+		price:        price,
+		backend: &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				// The URL already points to the requested
+				// host, so only the host header field needs
+				// to match it.
+				req.Host = req.URL.Host
+
+				// The hosts don't need to learn who is
+				// using the proxy.
+				req.Header["X-Forwarded-For"] = nil
+			},
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				ForceAttemptHTTP2:   true,
+				TLSHandshakeTimeout: forwardProxyDialTimeout,
+			},
+			ErrorHandler: func(w http.ResponseWriter,
+				r *http.Request, err error) {
+
+				log.Errorf("Error forwarding request to %s: %v",
+					r.URL.Host, err)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			FlushInterval: -1,
+		},
+		dial: dialer.Dial,
+	}
+
+	return nil
+}
+
+// isForwardProxyRequest returns true if the client wants the given request to
+// be forwarded to the host it names instead of being served by us.
+func isForwardProxyRequest(r *http.Request) bool {
+	return r.Method == http.MethodConnect || r.URL.IsAbs()
+}
+
+// forwardProxyTarget returns the host and port the given forward proxy request
+// is meant for. The port is derived from the scheme if the URL has none.
+func forwardProxyTarget(r *http.Request) (string, string, error) {
+	if r.Method == http.MethodConnect {
+		return net.SplitHostPort(r.Host)
+	}
+
+	host, port := r.URL.Hostname(), r.URL.Port()
+	if port == "" {
+		switch r.URL.Scheme {
+		case "http":
+			port = "80"
+
+		case "https":
+			port = "443"
+
+		default:
+			return "", "", fmt.Errorf("unsupported scheme %q",
+				r.URL.Scheme)
+		}
+	}
+
+	return host, port, nil
+}
+
+// allows returns true if the given host and port can be reached through the
+// forward proxy.
+func (f *forwardProxy) allows(host, port string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range f.allowedHosts {
+		if allowed.matches(host, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveForwardProxy forwards the given request to the host it names if the
+// host is allowed and the client is authenticated.
+func (p *Proxy) serveForwardProxy(w http.ResponseWriter, r *http.Request,
+	prefixLog *PrefixLog) {
+
+	host, port, err := forwardProxyTarget(r)
+	if err != nil {
+		prefixLog.Infof("Invalid forward proxy request: %v. Sending "+
+			"400.", err)
+		sendDirectResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !p.forwardProxy.allows(host, port) {
+		prefixLog.Infof("Forward proxy host %s not allowed. Sending "+
+			"403.", net.JoinHostPort(host, port))
+		sendDirectResponse(w, r, http.StatusForbidden,
+			"host not allowed")
+		return
+	}
+
+	if !p.authenticateForwardProxy(w, r, prefixLog) {
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.forwardProxy.tunnel(w, r, net.JoinHostPort(host, port),
+			prefixLog)
+		return
+	}
+
+	// The LSAT is only meant for us, the reverse proxy removes the
+	// Proxy-Authorization header field as it is hop-by-hop.
+	p.forwardProxy.backend.ServeHTTP(w, r)
+}
+
+// authenticateForwardProxy makes sure the client of the given forward proxy
+// request sent a valid LSAT in the Proxy-Authorization header field. If not,
+// a challenge is sent and false is returned.
+func (p *Proxy) authenticateForwardProxy(w http.ResponseWriter,
+	r *http.Request, prefixLog *PrefixLog) bool {
+
+	// The authenticator looks for the LSAT in the Authorization header
+	// field, which is meant for the requested host in this case.
+	authReq := r.WithContext(r.Context())
+	authReq.Header = make(http.Header)
+	if value := r.Header.Get(hdrProxyAuthorization); value != "" {
+		authReq.Header.Set("Authorization", value)
+	}
+	if nonce := r.Header.Get(lsat.HeaderNonce); nonce != "" {
+		authReq.Header.Set(lsat.HeaderNonce, nonce)
+	}
+
+	if !p.verifyNonce(w, authReq, p.authenticator,
+		ForwardProxyServiceName) {
+
+		return false
+	}
+
+	if p.authenticator.Accept(&authReq.Header, ForwardProxyServiceName) {
+		return true
+	}
+
+	prefixLog.Infof("Forward proxy authentication failed. Sending 402.")
+	p.handlePaymentRequired(
+		w, r, ForwardProxyServiceName, p.forwardProxy.price, nil,
+	)
+
+	return false
+}
+
+// tunnel connects the client of the given CONNECT request to the given
+// address and copies all data between them until either side closes the
+// connection.
+func (f *forwardProxy) tunnel(w http.ResponseWriter, r *http.Request,
+	address string, prefixLog *PrefixLog) {
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		prefixLog.Infof("Unable to tunnel %s request. Sending 505.",
+			r.Proto)
+		sendDirectResponse(
+			w, r, http.StatusHTTPVersionNotSupported,
+			"CONNECT is only supported with HTTP/1.1",
+		)
+		return
+	}
+
+	backendConn, err := f.dial("tcp", address)
+	if err != nil {
+		prefixLog.Errorf("Unable to connect to %s: %v", address, err)
+		sendDirectResponse(
+			w, r, http.StatusBadGateway,
+			"unable to connect to host",
+		)
+		return
+	}
+	defer backendConn.Close()
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		prefixLog.Errorf("Unable to take over connection: %v", err)
+		return
+	}
+	defer clientConn.Close()
+
+	// The deadlines of the server are meant for single requests, not for
+	// tunnels that are usually open much longer.
+	_ = clientConn.SetDeadline(time.Time{})
+
+	_, err = clientConn.Write(
+		[]byte("HTTP/1.1 200 Connection Established\r\n\r\n"),
+	)
+	if err != nil {
+		prefixLog.Errorf("Unable to confirm tunnel to %s: %v", address,
+			err)
+		return
+	}
+
+	// The client may have sent data right after the request that is
+	// already buffered, so we read from the buffer first.
+	done := make(chan struct{}, 2)
+	go copyAndCloseWrite(backendConn, clientBuf.Reader, done)
+	go copyAndCloseWrite(clientConn, backendConn, done)
+	<-done
+	<-done
+}
+
+// copyAndCloseWrite copies everything from the reader to the connection and
+// then closes the writing side of the connection, so the other side knows no
+// more data is coming.
+func copyAndCloseWrite(dst net.Conn, src io.Reader, done chan<- struct{}) {
+	defer func() {
+		done <- struct{}{}
+	}()
+
+	_, _ = io.Copy(dst, src)
+
+	if conn, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = conn.CloseWrite()
+		return
+	}
+	_ = dst.Close()
+}
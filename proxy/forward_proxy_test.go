@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestForwardProxyAllowedHosts makes sure only the allowed hosts can be
+// reached through the forward proxy.
+func TestForwardProxyAllowedHosts(t *testing.T) {
+	t.Parallel()
+
+	allowed, err := parseAllowedHosts([]string{
+		"Example.com", "api.example.org:443", "*.example.net",
+		"[::1]:8080",
+	})
+	require.NoError(t, err)
+	f := &forwardProxy{allowedHosts: allowed}
+
+	require.True(t, f.allows("example.com", "80"))
+	require.True(t, f.allows("EXAMPLE.com", "443"))
+	require.False(t, f.allows("www.example.com", "80"))
+	require.True(t, f.allows("api.example.org", "443"))
+	require.False(t, f.allows("api.example.org", "80"))
+	require.True(t, f.allows("a.b.example.net", "80"))
+	require.False(t, f.allows("example.net", "80"))
+	require.False(t, f.allows("badexample.net", "80"))
+	require.True(t, f.allows("::1", "8080"))
+	require.False(t, f.allows("::1", "8081"))
+
+	for _, invalid := range []string{"", "*", "a.*.com", "example.com/x"} {
+		_, err := parseAllowedHosts([]string{invalid})
+		require.Error(t, err, invalid)
+	}
+
+	p := &Proxy{}
+	require.Error(t, p.EnableForwardProxy(&ForwardProxyConfig{}))
+	require.Error(t, p.EnableForwardProxy(&ForwardProxyConfig{
+		AllowedHosts: []string{"example.com"},
+		Price:        -1,
+	}))
+}
+
+// TestForwardProxy makes sure requests with an absolute URL are forwarded to
+// the allowed hosts they name once the client is authenticated.
+func TestForwardProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The LSAT is only meant for the proxy.
+			if r.Header.Get(hdrProxyAuthorization) != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = fmt.Fprintf(w, "%s %s %s", r.Host, r.URL.Path,
+				r.Header.Get("Authorization"))
+		},
+	))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "service",
+		Address:    "127.0.0.1:1",
+		Protocol:   "http",
+		HostRegexp: "^service$",
+		Auth:       "on",
+	}})
+	require.NoError(t, err)
+	require.NoError(t, p.EnableForwardProxy(&ForwardProxyConfig{
+		Enabled:      true,
+		AllowedHosts: []string{backendURL.Hostname()},
+	}))
+
+	send := func(target, proxyAuth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		if proxyAuth != "" {
+			req.Header.Set(hdrProxyAuthorization, proxyAuth)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The Authorization header field is meant for the host, so it
+	// doesn't authenticate the client with the proxy.
+	rec := send(backend.URL+"/path", "")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	rec = send(backend.URL+"/path", "LSAT macaroon:preimage")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(
+		t, backendURL.Host+" /path Bearer secret", rec.Body.String(),
+	)
+
+	// Hosts that aren't allowed can't be reached, even when
+	// authenticated.
+	rec = send("http://example.com/path", "LSAT macaroon:preimage")
+	require.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+// TestForwardProxyConnect makes sure CONNECT requests are tunneled to the
+// allowed hosts they name once the client is authenticated.
+func TestForwardProxyConnect(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("tunneled"))
+		},
+	))
+	defer backend.Close()
+	backendAddr := backend.Listener.Addr().String()
+	backendHost, _, err := net.SplitHostPort(backendAddr)
+	require.NoError(t, err)
+
+	p, err := New(auth.NewMockAuthenticator(), nil)
+	require.NoError(t, err)
+	require.NoError(t, p.EnableForwardProxy(&ForwardProxyConfig{
+		Enabled:      true,
+		AllowedHosts: []string{backendHost},
+	}))
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	connect := func(address, proxyAuth string) (net.Conn, *bufio.Reader,
+		*http.Response) {
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		require.NoError(t, err)
+
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n"+
+			"Host: %s\r\nProxy-Authorization: %s\r\n\r\n",
+			address, address, proxyAuth)
+		require.NoError(t, err)
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+
+		return conn, reader, resp
+	}
+
+	conn, _, resp := connect(backendAddr, "")
+	require.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+	_ = conn.Close()
+
+	conn, _, resp = connect("example.com:443", "LSAT macaroon:preimage")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_ = conn.Close()
+
+	// Once the tunnel is established, we can talk to the backend through
+	// it.
+	conn, reader, resp := connect(backendAddr, "LSAT macaroon:preimage")
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n"+
+		"Connection: close\r\n\r\n", backendAddr)
+	require.NoError(t, err)
+
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "tunneled", string(body))
+}
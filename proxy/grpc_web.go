@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+)
+
+const (
+	// hdrTypeGrpcWeb is the content type prefix of gRPC-Web requests,
+	// covering both the binary and the base64 encoded text format.
+	hdrTypeGrpcWeb = "application/grpc-web"
+)
+
+// isGrpcWebRequest returns true if the given request is a gRPC-Web call, as
+// made by browsers that can't speak gRPC over HTTP/2 directly.
+func isGrpcWebRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasPrefix(
+		r.Header.Get(hdrContentType), hdrTypeGrpcWeb,
+	)
+}
+
+// grpcWebHandler wraps the given backend handler so gRPC-Web requests are
+// translated to standard gRPC requests before they are forwarded, and the
+// gRPC responses of the backend are translated back to gRPC-Web. The trailers
+// of the backend's response are sent in the response body, where gRPC-Web
+// clients expect them.
+//
+// NOTE: CORS headers are already added by the proxy itself, so the CORS
+// handling of the gRPC-Web wrapper is bypassed.
+func grpcWebHandler(backend http.Handler) http.Handler {
+	return http.HandlerFunc(
+		grpcweb.WrapHandler(backend).HandleGrpcWebRequest,
+	)
+}
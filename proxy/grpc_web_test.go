@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// grpcFrame returns the given message as a length-prefixed gRPC frame with
+// the given flags.
+func grpcFrame(flags byte, message []byte) []byte {
+	length := len(message)
+	frame := []byte{
+		flags, byte(length >> 24), byte(length >> 16),
+		byte(length >> 8), byte(length),
+	}
+	return append(frame, message...)
+}
+
+// TestGrpcWeb makes sure gRPC-Web requests are authenticated like any other
+// request and then translated to gRPC for the backend, and its responses back
+// to gRPC-Web.
+func TestGrpcWeb(t *testing.T) {
+	request := []byte("request")
+	reply := []byte("reply")
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The backend must only ever see plain gRPC calls.
+			if r.ProtoMajor != 2 || r.Header.Get(hdrContentType) !=
+				"application/grpc+proto" {
+
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			expected := grpcFrame(0, request)
+			if err != nil || !bytes.Equal(body, expected) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set(hdrContentType, "application/grpc+proto")
+			w.Header().Set("Trailer", hdrGrpcStatus)
+			_, _ = w.Write(grpcFrame(0, reply))
+			w.Header().Set(hdrGrpcStatus, "0")
+		},
+	))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Address:    strings.TrimPrefix(backend.URL, "https://"),
+		Protocol:   "https",
+		HostRegexp: ".*",
+		PathRegexp: "^/proxy_test\\.Greeter/.*$",
+		Auth:       "on",
+		Price:      1,
+	}})
+	require.NoError(t, err)
+
+	send := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			http.MethodPost, "/proxy_test.Greeter/SayHello",
+			bytes.NewReader(grpcFrame(0, request)),
+		)
+		req.Header.Set(hdrContentType, "application/grpc-web+proto")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Unauthenticated calls are challenged before anything is translated
+	// or sent to the backend.
+	rec := send("")
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+
+	// Authenticated calls reach the backend as gRPC, and the trailers of
+	// its response are sent to the client in a trailer frame.
+	rec = send("LSAT foo:bar")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(
+		t, "application/grpc-web+proto",
+		rec.Header().Get(hdrContentType),
+	)
+
+	body := rec.Body.Bytes()
+	require.True(t, bytes.HasPrefix(body, grpcFrame(0, reply)))
+	trailer := body[len(grpcFrame(0, reply)):]
+	require.NotEmpty(t, trailer)
+	require.Equal(t, byte(0x80), trailer[0])
+	require.Contains(t, string(trailer), "grpc-status: 0")
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// templateRemoteAddr is the template variable in configured header
+	// values that is replaced with the IP address of the client.
+	templateRemoteAddr = "$REMOTE_ADDR"
+
+	// templateTokenID is the template variable in configured header values
+	// that is replaced with the ID of the LSAT the request was
+	// authenticated with. It is replaced with an empty string if the
+	// request doesn't carry an LSAT.
+	templateTokenID = "$TOKEN_ID"
+)
+
+var (
+	// keyResponseHeaders is the key under which the header fields that
+	// are set on the response of the backend are stored in the request
+	// context.
+	keyResponseHeaders = lsat.ContextKey{Name: "responseheaders"}
+)
+
+// validateHeaderName makes sure the given string can be used as the name of a
+// header field.
+func validateHeaderName(name string) error {
+	if name == "" || strings.ContainsAny(name, " :\t\r\n") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+
+	return nil
+}
+
+// validateHeaderRules makes sure the names and values of the given header
+// fields can be sent.
+func validateHeaderRules(headers map[string]string) error {
+	for name, value := range headers {
+		if err := validateHeaderName(name); err != nil {
+			return err
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("value of header %s cannot contain "+
+				"line breaks", name)
+		}
+	}
+
+	return nil
+}
+
+// stripsRequestHeader returns true if the given header field of client
+// requests is removed before they are forwarded to the backend.
+func (s *Service) stripsRequestHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, stripped := range s.StripRequestHeaders {
+		if http.CanonicalHeaderKey(stripped) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tokenID returns the ID of the LSAT in the given header, or an empty string if
+// there is none.
+func tokenID(header http.Header) string {
+	mac, _, err := lsat.FromHeader(&header)
+	if err != nil {
+		return ""
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return ""
+	}
+
+	return id.TokenID.String()
+}
+
+// rewriteHeaders removes the request header fields the service strips and sets
+// the ones it adds, with their template variables expanded. The header fields
+// the service sets on the responses of its backend are expanded as well and
+// stored in the context of the returned request. It must only be called once
+// the request is authorized.
+func (s *Service) rewriteHeaders(r *http.Request,
+	remoteIP net.IP) *http.Request {
+
+	if len(s.StripRequestHeaders) == 0 && len(s.RequestHeaders) == 0 &&
+		len(s.ResponseHeaders) == 0 {
+
+		return r
+	}
+
+	// The template variables are expanded with the values of the original
+	// request, before any credentials are stripped.
+	replacer := strings.NewReplacer(
+		templateRemoteAddr, remoteIP.String(),
+		templateTokenID, tokenID(r.Header),
+	)
+
+	for _, name := range s.StripRequestHeaders {
+		r.Header.Del(name)
+	}
+	for name, value := range s.RequestHeaders {
+		r.Header.Set(name, replacer.Replace(value))
+	}
+
+	if len(s.ResponseHeaders) == 0 {
+		return r
+	}
+
+	responseHeaders := make(http.Header, len(s.ResponseHeaders))
+	for name, value := range s.ResponseHeaders {
+		responseHeaders.Set(name, replacer.Replace(value))
+	}
+
+	return r.WithContext(lsat.AddToContext(
+		r.Context(), keyResponseHeaders, responseHeaders,
+	))
+}
+
+// setResponseHeaders sets the header fields stored in the context of the
+// request of the given response on it, replacing the ones the backend sent.
+func setResponseHeaders(res *http.Response) {
+	headers, ok := lsat.FromContext(
+		res.Request.Context(), keyResponseHeaders,
+	).(http.Header)
+	if !ok {
+		return
+	}
+
+	for name, values := range headers {
+		res.Header[name] = values
+	}
+}
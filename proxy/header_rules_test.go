@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// TestHeaderRules makes sure the configured request header fields are set and
+// stripped once a request is authorized, that the configured response header
+// fields replace the backend's and that their template variables are expanded.
+func TestHeaderRules(t *testing.T) {
+	var backendHeader http.Header
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			backendHeader = r.Header.Clone()
+			w.Header().Set("Server", "backend")
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "rewritten",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "on",
+		RequestHeaders: map[string]string{
+			"X-Internal-Secret": "s3cret",
+			"X-Client":          "$REMOTE_ADDR/$TOKEN_ID",
+		},
+		StripRequestHeaders: []string{"authorization", "X-Debug"},
+		ResponseHeaders: map[string]string{
+			"Server":    "aperture",
+			"X-Token":   "$TOKEN_ID",
+			"X-Unknown": "$UNKNOWN",
+		},
+	}})
+	require.NoError(t, err)
+
+	id := &lsat.Identifier{
+		Version:     lsat.LatestVersion,
+		PaymentHash: lntypes.Hash{1},
+		TokenID:     lsat.TokenID{2},
+	}
+	var idBytes bytes.Buffer
+	require.NoError(t, lsat.EncodeIdentifier(&idBytes, id))
+	mac, err := macaroon.New(
+		[]byte("key"), idBytes.Bytes(), "lsat", macaroon.LatestVersion,
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	require.NoError(t, lsat.SetHeader(&req.Header, mac, lntypes.Preimage{}))
+	req.Header.Set("X-Internal-Secret", "forged")
+	req.Header.Set("X-Debug", "1")
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	tokenID := id.TokenID.String()
+	require.Equal(t, "s3cret", backendHeader.Get("X-Internal-Secret"))
+	require.Equal(t, "10.1.2.3/"+tokenID, backendHeader.Get("X-Client"))
+	require.Empty(t, backendHeader.Values("Authorization"))
+	require.Empty(t, backendHeader.Values("X-Debug"))
+
+	require.Equal(t, []string{"aperture"}, rec.Header().Values("Server"))
+	require.Equal(t, tokenID, rec.Header().Get("X-Token"))
+	require.Equal(t, "$UNKNOWN", rec.Header().Get("X-Unknown"))
+
+	// Unauthorized requests don't reach the backend, so their header
+	// fields aren't rewritten.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	require.Empty(t, rec.Header().Get("X-Token"))
+
+	// Header fields with line breaks are rejected.
+	err = ValidateServices([]*Service{{
+		Name: "invalid",
+		ResponseHeaders: map[string]string{
+			"X-Injected": "value\r\nSet-Cookie: a=b",
+		},
+	}})
+	require.Error(t, err)
+}
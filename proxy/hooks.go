@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// RequestHooks is an interface for running custom logic on the requests the
+// proxy forwards to service backends.
+type RequestHooks interface {
+	// PreRequest is called before the given request is forwarded to the
+	// backend of the service with the given name. If false is returned,
+	// the request is denied and the returned message is sent to the
+	// client.
+	PreRequest(ctx context.Context, service string,
+		r *http.Request) (bool, string, error)
+
+	// PostResponse is called with the backend's response to a request to
+	// the service with the given name before it is sent to the client. It
+	// can modify the header of the response.
+	PostResponse(ctx context.Context, service string,
+		res *http.Response) error
+}
+
+// runPreRequestHook calls the pre-request hook for the given request and
+// returns true if it may be forwarded to the backend. Otherwise the client is
+// sent an error response.
+func (p *Proxy) runPreRequestHook(w http.ResponseWriter, r *http.Request,
+	service *Service) bool {
+
+	allow, message, err := p.hooks.PreRequest(r.Context(), service.Name, r)
+	switch {
+	// We don't know whether the request should be allowed, so we don't
+	// forward it to be on the safe side.
+	case err != nil:
+		log.Errorf("Unable to run pre-request hook for service %s: %v",
+			service.Name, err)
+		addCorsHeaders(w.Header())
+		sendDirectResponse(
+			w, r, http.StatusServiceUnavailable,
+			"request hook unavailable",
+		)
+		return false
+
+	case !allow:
+		if message == "" {
+			message = http.StatusText(http.StatusForbidden)
+		}
+		addCorsHeaders(w.Header())
+		sendDirectResponse(w, r, http.StatusForbidden, message)
+		return false
+	}
+
+	return true
+}
+
+// runPostResponseHook calls the post-response hook for the given backend
+// response. If it fails, the response is sent to the client unmodified.
+func (p *Proxy) runPostResponseHook(res *http.Response, service *Service) {
+	err := p.hooks.PostResponse(res.Request.Context(), service.Name, res)
+	if err != nil {
+		log.Errorf("Unable to run post-response hook for service %s: "+
+			"%v", service.Name, err)
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// mockHooks is a RequestHooks implementation that denies requests with the
+// X-Deny header and adds a header to all responses.
+type mockHooks struct {
+	preErr error
+}
+
+// PreRequest denies requests with the X-Deny header.
+func (m *mockHooks) PreRequest(_ context.Context, _ string,
+	r *http.Request) (bool, string, error) {
+
+	if m.preErr != nil {
+		return false, "", m.preErr
+	}
+
+	if r.Header.Get("X-Deny") != "" {
+		return false, "denied by hook", nil
+	}
+
+	return true, "", nil
+}
+
+// PostResponse adds the name of the service to the response header.
+func (m *mockHooks) PostResponse(_ context.Context, service string,
+	res *http.Response) error {
+
+	res.Header.Set("X-Hook-Service", service)
+	res.Header.Del("X-Internal")
+
+	return nil
+}
+
+// TestRequestHooks makes sure requests denied by the pre-request hook aren't
+// forwarded and that the post-response hook can modify the response header.
+func TestRequestHooks(t *testing.T) {
+	var forwarded int
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			forwarded++
+			w.Header().Set("X-Internal", "secret")
+			_, _ = w.Write([]byte("backend"))
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "hooked",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "off",
+	}})
+	require.NoError(t, err)
+	hooks := &mockHooks{}
+	p.EnableRequestHooks(hooks)
+
+	send := func(deny bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if deny {
+			req.Header.Set("X-Deny", "1")
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send(false)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "hooked", rec.Header().Get("X-Hook-Service"))
+	require.Empty(t, rec.Header().Get("X-Internal"))
+	require.Equal(t, 1, forwarded)
+
+	rec = send(true)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	body, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "denied by hook")
+	require.Equal(t, 1, forwarded)
+
+	// If the pre-request hook fails, requests aren't forwarded either.
+	hooks.preErr = errors.New("unreachable")
+	rec = send(false)
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, 1, forwarded)
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// parseIPRanges parses the given IP ranges in CIDR notation. Single IP
+// addresses are ranges of just that address.
+func parseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, 0, len(ranges))
+	for _, cidr := range ranges {
+		// A single address is a range with a full mask.
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ipNets = append(ipNets, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q: %v", cidr,
+				err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+
+	return ipNets, nil
+}
+
+// ipFilter rejects requests from client IP addresses a service doesn't accept
+// requests from.
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newIPFilter creates a filter that only lets requests from the allowed IP
+// ranges through, or from all addresses if there are none, unless they are
+// from one of the denied ranges.
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	allowNets, err := parseIPRanges(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseIPRanges(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ipFilter{
+		allow: allowNets,
+		deny:  denyNets,
+	}, nil
+}
+
+// containsIP returns true if the given IP address is in any of the given
+// ranges. The range 0.0.0.0/0 contains all IPv4 and IPv6 addresses.
+func containsIP(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		ones, _ := ipNet.Mask.Size()
+		if ones == 0 || ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows returns true if requests from the given IP address are accepted.
+// Denied ranges take precedence over allowed ones.
+func (f *ipFilter) allows(ip net.IP) bool {
+	if containsIP(f.deny, ip) {
+		return false
+	}
+
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// filter responds with 403 Forbidden and returns false if the request from
+// the given IP address isn't accepted.
+func (f *ipFilter) filter(w http.ResponseWriter, r *http.Request,
+	remoteIP net.IP) bool {
+
+	if f.allows(remoteIP) {
+		return true
+	}
+
+	addCorsHeaders(w.Header())
+	sendDirectResponse(w, r, http.StatusForbidden, "forbidden")
+	return false
+}
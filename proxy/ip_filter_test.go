@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIPFilter makes sure requests from addresses outside of the allowed
+// ranges or inside of the denied ones are rejected before they are
+// authenticated.
+func TestIPFilter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	newProxy := func(allow, deny []string) *Proxy {
+		p, err := New(auth.NewMockAuthenticator(), []*Service{{
+			Name:       "filtered",
+			Address:    strings.TrimPrefix(backend.URL, "http://"),
+			Protocol:   "http",
+			HostRegexp: ".*",
+			Auth:       "on",
+			AllowCIDRs: allow,
+			DenyCIDRs:  deny,
+		}})
+		require.NoError(t, err)
+		return p
+	}
+	send := func(p *Proxy, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	p := newProxy(
+		[]string{"10.0.0.0/8", "2001:db8::/32"},
+		[]string{"10.0.66.0/24", "2001:db8::1"},
+	)
+
+	// Allowed clients still need to pay.
+	require.Equal(t, http.StatusPaymentRequired, send(p, "10.1.2.3:1234"))
+	require.Equal(
+		t, http.StatusPaymentRequired, send(p, "[2001:db8::2]:1234"),
+	)
+
+	// Denied ranges take precedence over allowed ones, and clients
+	// outside of the allowed ranges are rejected.
+	require.Equal(t, http.StatusForbidden, send(p, "10.0.66.1:1234"))
+	require.Equal(t, http.StatusForbidden, send(p, "[2001:db8::1]:1234"))
+	require.Equal(t, http.StatusForbidden, send(p, "192.168.1.1:1234"))
+	require.Equal(t, http.StatusForbidden, send(p, "[2001:db9::1]:1234"))
+
+	// The IPv4 wildcard matches IPv6 addresses as well.
+	p = newProxy([]string{"0.0.0.0/0"}, nil)
+	require.Equal(t, http.StatusPaymentRequired, send(p, "10.1.2.3:1234"))
+	require.Equal(
+		t, http.StatusPaymentRequired, send(p, "[2001:db8::2]:1234"),
+	)
+
+	p = newProxy(nil, []string{"0.0.0.0/0"})
+	require.Equal(t, http.StatusForbidden, send(p, "10.1.2.3:1234"))
+	require.Equal(t, http.StatusForbidden, send(p, "[2001:db8::2]:1234"))
+
+	// Invalid ranges are rejected.
+	err := ValidateServices([]*Service{{
+		Name:       "invalid",
+		AllowCIDRs: []string{"10.0.0.0/33"},
+	}})
+	require.Error(t, err)
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// LatencyInjection is the configuration of the artificial latency added to the
+// responses of a service. It allows client developers to test how their
+// timeout handling copes with a slow service. It is only applied if the proxy
+// runs in debug mode.
+type LatencyInjection struct {
+	// DelayMs is the delay in milliseconds that is added to every
+	// response.
+	DelayMs int `long:"delayms" description:"The delay in milliseconds added to every response"`
+
+	// JitterMs is the width of the range in milliseconds the delay is
+	// randomly chosen from, centered around DelayMs. The delay is constant
+	// if this is zero.
+	JitterMs int `long:"jitterms" description:"The width in milliseconds of the range around the delay the actual delay is uniformly chosen from"`
+}
+
+// validate makes sure the latency injection settings are sane.
+func (l *LatencyInjection) validate() error {
+	if l.DelayMs < 0 {
+		return invalidField("delayms", "cannot be negative")
+	}
+	if l.JitterMs < 0 {
+		return invalidField("jitterms", "cannot be negative")
+	}
+
+	if l.JitterMs/2 > l.DelayMs {
+		return invalidField("jitterms", "half the jitter cannot "+
+			"exceed delayms")
+	}
+
+	return nil
+}
+
+// latencyInjector delays requests before handing them to the next handler.
+type latencyInjector struct {
+	cfg LatencyInjection
+
+	// random returns a random number in [0, 1). It can be replaced in
+	// tests.
+	random func() float64
+}
+
+// newLatencyInjector creates a new middleware that delays requests as
+// configured in the given latency injection settings.
+func newLatencyInjector(cfg LatencyInjection) *latencyInjector {
+	return &latencyInjector{
+		cfg:    cfg,
+		random: rand.Float64,
+	}
+}
+
+// delay returns the duration the next request should be delayed by. With
+// jitter, it is uniformly distributed between DelayMs - JitterMs/2 and
+// DelayMs + JitterMs/2.
+func (l *latencyInjector) delay() time.Duration {
+	delay := float64(l.cfg.DelayMs)
+	if l.cfg.JitterMs > 0 {
+		delay += (l.random() - 0.5) * float64(l.cfg.JitterMs)
+	}
+
+	return time.Duration(delay * float64(time.Millisecond))
+}
+
+// wrap returns a handler that delays requests before passing them on to the
+// given handler. The request is dropped if the client gives up while waiting.
+func (l *latencyInjector) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delay := l.delay()
+		log.Debugf("Delaying request %s by %v", r.URL.Path, delay)
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			next.ServeHTTP(w, r)
+
+		case <-r.Context().Done():
+		}
+	})
+}
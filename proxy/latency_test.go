@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLatencyInjectionDelay makes sure the delay is spread evenly around the
+// configured delay when jitter is set.
+func TestLatencyInjectionDelay(t *testing.T) {
+	t.Parallel()
+
+	cfg := &LatencyInjection{DelayMs: -1}
+	require.Error(t, cfg.validate())
+	cfg = &LatencyInjection{DelayMs: 10, JitterMs: 30}
+	require.Error(t, cfg.validate())
+	cfg = &LatencyInjection{DelayMs: 10, JitterMs: 20}
+	require.NoError(t, cfg.validate())
+
+	injector := newLatencyInjector(LatencyInjection{DelayMs: 100})
+	require.Equal(t, 100*time.Millisecond, injector.delay())
+
+	injector = newLatencyInjector(LatencyInjection{
+		DelayMs:  100,
+		JitterMs: 50,
+	})
+	injector.random = func() float64 { return 0 }
+	require.Equal(t, 75*time.Millisecond, injector.delay())
+	injector.random = func() float64 { return 0.5 }
+	require.Equal(t, 100*time.Millisecond, injector.delay())
+	injector.random = func() float64 { return 0.999999 }
+	require.InDelta(t, 125*time.Millisecond, injector.delay(), 1000)
+}
+
+// TestLatencyInjectionWrap makes sure requests are delayed before they are
+// passed on and dropped if the client gives up while waiting.
+func TestLatencyInjectionWrap(t *testing.T) {
+	t.Parallel()
+
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := newLatencyInjector(LatencyInjection{DelayMs: 50}).wrap(next)
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	require.True(t, called)
+	require.Equal(t, http.StatusTeapot, rec.Code)
+	require.GreaterOrEqual(
+		t, int64(time.Since(start)), int64(50*time.Millisecond),
+	)
+
+	called = false
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	require.False(t, called)
+}
@@ -27,7 +27,19 @@ func UseLogger(logger btclog.Logger) {
 	log = logger
 }
 
-// PrefixLog logs with a given static string prefix.
+// FieldLogger is a logger that attaches structured fields to the lines it logs
+// instead of formatting them into the message, like a JSON logger. Loggers
+// passed to UseLogger can implement it to get the fields of request logs.
+type FieldLogger interface {
+	btclog.Logger
+
+	// WithField returns a logger that attaches the given field to every
+	// line it logs, in addition to the fields of this logger.
+	WithField(key, value string) FieldLogger
+}
+
+// PrefixLog logs with a given static string prefix. If the logger supports
+// structured fields, they are used instead of the prefix.
 type PrefixLog struct {
 	logger btclog.Logger
 	prefix string
@@ -46,44 +58,65 @@ func NewRemoteIPPrefixLog(logger btclog.Logger, remoteAddr string) (net.IP,
 	if remoteIP == nil {
 		remoteIP = net.IPv4zero
 	}
+
+	if fieldLogger, ok := logger.(FieldLogger); ok {
+		return remoteIP, &PrefixLog{
+			logger: fieldLogger.WithField(
+				"remote_ip", remoteIP.String(),
+			),
+		}
+	}
+
 	return remoteIP, &PrefixLog{
 		logger: logger,
 		prefix: remoteIP.String(),
 	}
 }
 
+// WithField returns a logger that attaches the given field to every line it
+// logs if the underlying logger supports structured fields. Otherwise the
+// logger itself is returned, so the text format stays unchanged.
+func (s *PrefixLog) WithField(key, value string) *PrefixLog {
+	fieldLogger, ok := s.logger.(FieldLogger)
+	if !ok {
+		return s
+	}
+
+	return &PrefixLog{
+		logger: fieldLogger.WithField(key, value),
+		prefix: s.prefix,
+	}
+}
+
+// format prepends the prefix to the given format specifier.
+func (s *PrefixLog) format(format string) string {
+	if s.prefix == "" {
+		return format
+	}
+
+	return fmt.Sprintf("%s %s", s.prefix, format)
+}
+
 // Debugf formats message according to format specifier and writes to
 // log with LevelDebug.
 func (s *PrefixLog) Debugf(format string, params ...interface{}) {
-	s.logger.Debugf(
-		fmt.Sprintf("%s %s", s.prefix, format),
-		params...,
-	)
+	s.logger.Debugf(s.format(format), params...)
 }
 
 // Infof formats message according to format specifier and writes to
 // log with LevelInfo.
 func (s *PrefixLog) Infof(format string, params ...interface{}) {
-	s.logger.Infof(
-		fmt.Sprintf("%s %s", s.prefix, format),
-		params...,
-	)
+	s.logger.Infof(s.format(format), params...)
 }
 
 // Warnf formats message according to format specifier and writes to
 // to log with LevelError.
 func (s *PrefixLog) Warnf(format string, params ...interface{}) {
-	s.logger.Warnf(
-		fmt.Sprintf("%s %s", s.prefix, format),
-		params...,
-	)
+	s.logger.Warnf(s.format(format), params...)
 }
 
 // Errorf formats message according to format specifier and writes to
 // to log with LevelError.
 func (s *PrefixLog) Errorf(format string, params ...interface{}) {
-	s.logger.Errorf(
-		fmt.Sprintf("%s %s", s.prefix, format),
-		params...,
-	)
+	s.logger.Errorf(s.format(format), params...)
 }
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// methodFilter rejects requests that use an HTTP method a service doesn't
+// allow, before they are authenticated or reach the backend.
+type methodFilter struct {
+	// allowed is the set of upper case methods that are forwarded.
+	allowed map[string]struct{}
+
+	// allowHeader is the value of the Allow header sent with rejections.
+	allowHeader string
+}
+
+// newMethodFilter creates a filter that only allows the given methods. The
+// OPTIONS method is always allowed so CORS preflight requests keep working.
+func newMethodFilter(methods []string) (*methodFilter, error) {
+	f := &methodFilter{
+		allowed: map[string]struct{}{
+			http.MethodOptions: {},
+		},
+	}
+	for _, method := range methods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" || strings.ContainsAny(method, " \t,") {
+			return nil, fmt.Errorf("invalid HTTP method %q", method)
+		}
+		f.allowed[method] = struct{}{}
+	}
+
+	allowed := make([]string, 0, len(f.allowed))
+	for method := range f.allowed {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	f.allowHeader = strings.Join(allowed, ", ")
+
+	return f, nil
+}
+
+// allows returns true if requests with the given method may be forwarded.
+func (f *methodFilter) allows(method string) bool {
+	_, ok := f.allowed[method]
+	return ok
+}
+
+// filter sends a 405 Method Not Allowed response and returns false if the
+// method of the given request isn't allowed. Otherwise it returns true and
+// doesn't touch the response.
+func (f *methodFilter) filter(w http.ResponseWriter, r *http.Request) bool {
+	if f.allows(r.Method) {
+		return true
+	}
+
+	addCorsHeaders(w.Header())
+	w.Header().Set("Allow", f.allowHeader)
+	sendDirectResponse(
+		w, r, http.StatusMethodNotAllowed, "method not allowed",
+	)
+	return false
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAllowedMethods makes sure requests with a method that isn't allowed are
+// rejected before authentication while CORS preflight requests still pass.
+func TestAllowedMethods(t *testing.T) {
+	var backendRequests int
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:           "readonly",
+		Address:        strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:       "http",
+		HostRegexp:     ".*",
+		Auth:           "on",
+		Price:          1,
+		AllowedMethods: []string{"get", "HEAD"},
+	}})
+	require.NoError(t, err)
+
+	send := func(method string,
+		header http.Header) *httptest.ResponseRecorder {
+
+		req := httptest.NewRequest(method, "/", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Allowed methods still need to be authenticated.
+	rec := send(http.MethodGet, nil)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+
+	rec = send(http.MethodGet, http.Header{
+		"Authorization": []string{"LSAT foo:bar"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, 1, backendRequests)
+
+	// Other methods are rejected before authentication, even if the
+	// request is authenticated.
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		rec = send(method, http.Header{
+			"Authorization": []string{"LSAT foo:bar"},
+		})
+		require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+		require.Equal(
+			t, "GET, HEAD, OPTIONS", rec.Header().Get("Allow"),
+		)
+	}
+	require.Equal(t, 1, backendRequests)
+
+	// CORS preflight requests are always answered.
+	rec = send(http.MethodOptions, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// Invalid methods are rejected when preparing the services.
+	_, err = New(auth.NewMockAuthenticator(), []*Service{{
+		Name:           "invalid",
+		Address:        "127.0.0.1:1",
+		Protocol:       "http",
+		HostRegexp:     ".*",
+		AllowedMethods: []string{""},
+	}})
+	require.Error(t, err)
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// BackendPrimary is the name of the primary backend of a service in
+	// the proxy metrics.
+	BackendPrimary = "primary"
+
+	// BackendCanary is the name of the canary backend of a service in the
+	// proxy metrics.
+	BackendCanary = "canary"
+
+	// serviceLabel is the label of the proxy metrics that holds the name
+	// of the service.
+	serviceLabel = "service"
+
+	// backendLabel is the label of the proxy metrics that holds which of
+	// the service's backends a request was proxied to.
+	backendLabel = "backend"
+)
+
+var (
+	// keyBackendRequest is the key under which the details of a request
+	// that is proxied to a backend are stored in the request context.
+	keyBackendRequest = lsat.ContextKey{Name: "backendrequest"}
+
+	// backendRequests counts all requests proxied to each backend.
+	backendRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aperture",
+		Subsystem: "proxy",
+		Name:      "backend_requests_total",
+	}, []string{serviceLabel, backendLabel})
+
+	// backendErrors counts all requests proxied to each backend that
+	// failed, either because the backend couldn't be reached or because it
+	// responded with a server error.
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aperture",
+		Subsystem: "proxy",
+		Name:      "backend_errors_total",
+	}, []string{serviceLabel, backendLabel})
+
+	// backendLatency tracks the time it takes each backend to respond.
+	backendLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "aperture",
+		Subsystem: "proxy",
+		Name:      "backend_latency_seconds",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{serviceLabel, backendLabel})
+
+	// breakerTrips counts each time the circuit breaker of a service
+	// opened.
+	breakerTrips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aperture",
+		Subsystem: "proxy",
+		Name:      "circuit_breaker_trips_total",
+	}, []string{serviceLabel})
+
+	// breakerResets counts each time the circuit breaker of a service
+	// closed again after the backend recovered.
+	breakerResets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aperture",
+		Subsystem: "proxy",
+		Name:      "circuit_breaker_resets_total",
+	}, []string{serviceLabel})
+)
+
+// PrometheusCollectors returns the Prometheus metrics of the proxy so they can
+// be registered with the exporter.
+func PrometheusCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		backendRequests, backendErrors, backendLatency, authBypasses,
+		backendInFlight, backendQueued, breakerTrips, breakerResets,
+	}
+}
+
+// BackendStats are the statistics of all requests proxied to a backend since
+// aperture was started.
+type BackendStats struct {
+	// Requests is the number of requests proxied to the backend.
+	Requests float64
+
+	// Errors is the number of those requests that failed.
+	Errors float64
+
+	// LatencySum is the sum of the time, in seconds, it took the backend
+	// to respond to the requests.
+	LatencySum float64
+}
+
+// ReadBackendStats returns the statistics of the given backend of the service
+// with the given name.
+func ReadBackendStats(service, backend string) BackendStats {
+	stats := BackendStats{
+		Requests: counterValue(
+			backendRequests.WithLabelValues(service, backend),
+		),
+		Errors: counterValue(
+			backendErrors.WithLabelValues(service, backend),
+		),
+	}
+
+	var metric dto.Metric
+	latency := backendLatency.WithLabelValues(service, backend)
+	if err := latency.(prometheus.Metric).Write(&metric); err == nil {
+		stats.LatencySum = metric.GetHistogram().GetSampleSum()
+	}
+
+	return stats
+}
+
+// counterValue returns the current value of the given counter.
+func counterValue(c prometheus.Counter) float64 {
+	var metric dto.Metric
+	if err := c.Write(&metric); err != nil {
+		return 0
+	}
+
+	return metric.GetCounter().GetValue()
+}
+
+// backendRequest holds the details of a request that is proxied to a backend.
+type backendRequest struct {
+	service *Service
+	backend string
+	start   time.Time
+}
+
+// withBackendRequest returns a copy of the request that carries the service
+// and backend it is proxied to in its context, so the outcome of the request
+// can be attributed to them.
+func withBackendRequest(r *http.Request, service *Service,
+	backend string) *http.Request {
+
+	return r.WithContext(lsat.AddToContext(
+		r.Context(), keyBackendRequest, &backendRequest{
+			service: service,
+			backend: backend,
+			start:   time.Now(),
+		},
+	))
+}
+
+// backendRequestFromContext returns the details of the proxied request stored
+// in the given request context, or nil if there are none.
+func backendRequestFromContext(ctx context.Context) *backendRequest {
+	req, ok := lsat.FromContext(ctx, keyBackendRequest).(*backendRequest)
+	if !ok {
+		return nil
+	}
+
+	return req
+}
+
+// recordBackendResult counts a request proxied to the backend stored in the
+// given request context. Transport errors and server errors returned by the
+// backend count as failed requests.
+func recordBackendResult(ctx context.Context, statusCode int) {
+	req := backendRequestFromContext(ctx)
+	if req == nil {
+		return
+	}
+
+	labels := []string{req.service.Name, req.backend}
+	backendRequests.WithLabelValues(labels...).Inc()
+	backendLatency.WithLabelValues(labels...).Observe(
+		time.Since(req.start).Seconds(),
+	)
+	failed := statusCode >= http.StatusInternalServerError
+	if failed {
+		backendErrors.WithLabelValues(labels...).Inc()
+	}
+
+	// Only the primary backend is guarded by the circuit breaker, the
+	// canary is judged by its own error rate.
+	breaker := req.service.breaker
+	if breaker != nil && req.backend == BackendPrimary {
+		breaker.record(failed)
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	hdrUpgrade    = "Upgrade"
+	hdrConnection = "Connection"
+)
+
+// Protocol is the protocol a client speaks on top of HTTP.
+type Protocol uint8
+
+const (
+	// ProtocolHTTP is a plain HTTP request, for example a REST call.
+	ProtocolHTTP Protocol = iota
+
+	// ProtocolGRPC is a gRPC call.
+	ProtocolGRPC
+
+	// ProtocolWebSocket is a request to upgrade the connection to a
+	// WebSocket.
+	ProtocolWebSocket
+)
+
+// String returns a human readable name of the protocol.
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolHTTP:
+		return "HTTP"
+
+	case ProtocolGRPC:
+		return "gRPC"
+
+	case ProtocolWebSocket:
+		return "WebSocket"
+
+	default:
+		return "unknown"
+	}
+}
+
+// RequestProtocol returns the protocol the client of the given request speaks.
+// Every gRPC request has the Content-Type header field set accordingly and
+// every WebSocket handshake asks for the connection to be upgraded. All other
+// requests are treated as plain HTTP.
+func RequestProtocol(r *http.Request) Protocol {
+	switch {
+	case strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpc):
+		return ProtocolGRPC
+
+	case headerHasToken(r.Header, hdrConnection, "upgrade") &&
+		headerHasToken(r.Header, hdrUpgrade, "websocket"):
+
+		return ProtocolWebSocket
+
+	default:
+		return ProtocolHTTP
+	}
+}
+
+// headerHasToken returns true if any of the comma separated values of the
+// given header field equals the token, ignoring case.
+func headerHasToken(header http.Header, field, token string) bool {
+	for _, value := range header.Values(field) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// MultiProtocolMux is a HTTP handler that dispatches requests to a different
+// handler depending on the protocol the client speaks. This allows gRPC,
+// WebSocket and plain HTTP clients to be served on the same port.
+type MultiProtocolMux struct {
+	grpc      http.Handler
+	websocket http.Handler
+	http      http.Handler
+}
+
+// NewMultiProtocolMux creates a new mux that dispatches gRPC calls, WebSocket
+// handshakes and all other HTTP requests to the given handlers. A handler can
+// be nil if the protocol isn't supported, requests of that protocol are then
+// rejected. A WebSocket handshake is a plain GET request, so it's dispatched to
+// the HTTP handler if there is no WebSocket handler.
+func NewMultiProtocolMux(grpc, websocket,
+	http http.Handler) *MultiProtocolMux {
+
+	return &MultiProtocolMux{
+		grpc:      grpc,
+		websocket: websocket,
+		http:      http,
+	}
+}
+
+// ServeHTTP dispatches the request to the handler of its protocol.
+//
+// NOTE: This is part of the http.Handler interface.
+func (m *MultiProtocolMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	protocol := RequestProtocol(r)
+
+	var handler http.Handler
+	switch protocol {
+	case ProtocolGRPC:
+		handler = m.grpc
+
+	case ProtocolWebSocket:
+		handler = m.websocket
+		if handler == nil {
+			handler = m.http
+		}
+
+	default:
+		handler = m.http
+	}
+
+	if handler == nil {
+		log.Debugf("Rejecting %v request to %s, protocol not supported",
+			protocol, r.URL.Path)
+		sendDirectResponse(
+			w, r, http.StatusBadRequest,
+			protocol.String()+" not supported",
+		)
+		return
+	}
+
+	handler.ServeHTTP(w, r)
+}
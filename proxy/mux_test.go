@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// protocolHandler is a mock handler that records the protocol it was called
+// for.
+type protocolHandler struct {
+	protocol Protocol
+	called   *[]Protocol
+}
+
+func (h *protocolHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	*h.called = append(*h.called, h.protocol)
+	w.WriteHeader(http.StatusOK)
+}
+
+// TestMultiProtocolMux makes sure requests are dispatched to the handler of
+// the protocol the client speaks.
+func TestMultiProtocolMux(t *testing.T) {
+	t.Parallel()
+
+	var called []Protocol
+	mux := NewMultiProtocolMux(
+		&protocolHandler{protocol: ProtocolGRPC, called: &called},
+		&protocolHandler{protocol: ProtocolWebSocket, called: &called},
+		&protocolHandler{protocol: ProtocolHTTP, called: &called},
+	)
+
+	testCases := []struct {
+		name     string
+		header   http.Header
+		protocol Protocol
+	}{{
+		name:     "plain http",
+		header:   http.Header{},
+		protocol: ProtocolHTTP,
+	}, {
+		name: "grpc",
+		header: http.Header{
+			hdrContentType: []string{"application/grpc+proto"},
+		},
+		protocol: ProtocolGRPC,
+	}, {
+		name: "websocket",
+		header: http.Header{
+			hdrConnection: []string{"keep-alive, Upgrade"},
+			hdrUpgrade:    []string{"WebSocket"},
+		},
+		protocol: ProtocolWebSocket,
+	}, {
+		name: "upgrade to other protocol",
+		header: http.Header{
+			hdrConnection: []string{"Upgrade"},
+			hdrUpgrade:    []string{"h2c"},
+		},
+		protocol: ProtocolHTTP,
+	}, {
+		name: "websocket without connection upgrade",
+		header: http.Header{
+			hdrUpgrade: []string{"websocket"},
+		},
+		protocol: ProtocolHTTP,
+	}}
+
+	for _, tc := range testCases {
+		called = nil
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header = tc.header
+		require.Equal(t, tc.protocol, RequestProtocol(req), tc.name)
+
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, tc.name)
+		require.Equal(t, []Protocol{tc.protocol}, called, tc.name)
+	}
+}
+
+// TestMultiProtocolMuxUnsupported makes sure requests of a protocol without a
+// handler are rejected.
+func TestMultiProtocolMuxUnsupported(t *testing.T) {
+	t.Parallel()
+
+	var called []Protocol
+	mux := NewMultiProtocolMux(
+		nil, &protocolHandler{protocol: ProtocolWebSocket, called: &called},
+		nil,
+	)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	req.Header.Set(hdrContentType, hdrTypeGrpc)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, "gRPC not supported", rec.Header().Get(hdrGrpcMessage))
+
+	require.Empty(t, called)
+}
+
+// TestMultiProtocolMuxWebSocketFallback makes sure WebSocket handshakes are
+// dispatched to the HTTP handler if there is no WebSocket handler, while plain
+// GET requests are always dispatched to the HTTP handler.
+func TestMultiProtocolMuxWebSocketFallback(t *testing.T) {
+	t.Parallel()
+
+	var called []Protocol
+	httpHandler := &protocolHandler{protocol: ProtocolHTTP, called: &called}
+	mux := NewMultiProtocolMux(nil, nil, httpHandler)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	req.Header.Set(hdrConnection, "Upgrade")
+	req.Header.Set(hdrUpgrade, "websocket")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	require.Equal(t, []Protocol{ProtocolHTTP, ProtocolHTTP}, called)
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pathPattern matches the paths of requests. Patterns starting with ^ are
+// regular expressions, all others are globs in the syntax of path.Match. A
+// glob also matches all paths below the ones it matches, so /admin matches
+// /admin/users as well.
+type pathPattern struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+// newPathPattern parses the given glob or regular expression.
+func newPathPattern(pattern string) (*pathPattern, error) {
+	if strings.HasPrefix(pattern, "^") {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regexp %q: %v",
+				pattern, err)
+		}
+		return &pathPattern{regexp: re}, nil
+	}
+
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("path glob %q must start with /",
+			pattern)
+	}
+	if _, err := path.Match(pattern, "/"); err != nil {
+		return nil, fmt.Errorf("invalid path glob %q: %v", pattern,
+			err)
+	}
+
+	return &pathPattern{glob: path.Clean(pattern)}, nil
+}
+
+// matches returns true if the given clean path matches the pattern.
+func (p *pathPattern) matches(urlPath string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(urlPath)
+	}
+
+	// The glob matches the path if it matches the path itself or any of
+	// its parents. The pattern was validated, so there are no errors.
+	for ; urlPath != "/"; urlPath = path.Dir(urlPath) {
+		if ok, _ := path.Match(p.glob, urlPath); ok {
+			return true
+		}
+	}
+	ok, _ := path.Match(p.glob, urlPath)
+	return ok
+}
+
+// pathFilter rejects requests to paths a service doesn't expose, before they
+// are authenticated or reach the backend.
+type pathFilter struct {
+	// allowed are the patterns of the paths that are forwarded. All paths
+	// that aren't blocked are forwarded if there are none.
+	allowed []*pathPattern
+
+	// blocked are the patterns of the paths that are never forwarded.
+	blocked []*pathPattern
+}
+
+// newPathFilter creates a filter that only allows paths matching any of the
+// allowed patterns, if there are any, and none of the blocked patterns.
+func newPathFilter(allowed, blocked []string) (*pathFilter, error) {
+	f := &pathFilter{}
+	for _, pattern := range allowed {
+		p, err := newPathPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.allowed = append(f.allowed, p)
+	}
+	for _, pattern := range blocked {
+		p, err := newPathPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.blocked = append(f.blocked, p)
+	}
+
+	return f, nil
+}
+
+// matchesAny returns true if the given path matches any of the given patterns.
+func matchesAny(patterns []*pathPattern, urlPath string) bool {
+	for _, pattern := range patterns {
+		if pattern.matches(urlPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows returns true if requests to the given path may be forwarded. The path
+// is cleaned first so dot segments can't be used to get around the patterns.
+func (f *pathFilter) allows(urlPath string) bool {
+	urlPath = path.Clean("/" + urlPath)
+	if matchesAny(f.blocked, urlPath) {
+		return false
+	}
+
+	return len(f.allowed) == 0 || matchesAny(f.allowed, urlPath)
+}
+
+// filter sends a 403 Forbidden response and returns false if the path of the
+// given request isn't allowed. Otherwise it returns true and doesn't touch the
+// response.
+func (f *pathFilter) filter(w http.ResponseWriter, r *http.Request) bool {
+	if f.allows(r.URL.Path) {
+		return true
+	}
+
+	addCorsHeaders(w.Header())
+	sendDirectResponse(w, r, http.StatusForbidden, "forbidden")
+	return false
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPathFilter makes sure requests to blocked paths and to paths that aren't
+// allowed are rejected before authentication.
+func TestPathFilter(t *testing.T) {
+	var backendRequests int
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:         "api",
+		Address:      strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:     "http",
+		HostRegexp:   ".*",
+		Auth:         "on",
+		AllowedPaths: []string{"/api/*", "^/v[0-9]+/"},
+		BlockedPaths: []string{"/api/admin", "^/v1/debug"},
+	}})
+	require.NoError(t, err)
+
+	send := func(path string, authenticated bool) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = path
+		if authenticated {
+			req.Header.Set("Authorization", "LSAT foo:bar")
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Allowed paths still need to be authenticated.
+	require.Equal(t, http.StatusPaymentRequired, send("/api/users", false))
+	require.Equal(t, http.StatusOK, send("/api/users/1", true))
+	require.Equal(t, http.StatusOK, send("/v2/status", true))
+	require.Equal(t, 2, backendRequests)
+
+	// Blocked paths and paths that aren't allowed are rejected before
+	// authentication, even if they are allowed or the request is
+	// authenticated.
+	forbidden := []string{
+		"/api/admin", "/api/admin/users", "/v1/debug/pprof", "/other",
+		"/api", "/api/../admin", "/api//admin",
+	}
+	for _, path := range forbidden {
+		require.Equal(t, http.StatusForbidden, send(path, false), path)
+		require.Equal(t, http.StatusForbidden, send(path, true), path)
+	}
+	require.Equal(t, 2, backendRequests)
+
+	// Invalid patterns are rejected when preparing the services.
+	for _, pattern := range []string{"^(", "/[", "admin"} {
+		_, err = New(auth.NewMockAuthenticator(), []*Service{{
+			Name:         "invalid",
+			Address:      "127.0.0.1:1",
+			Protocol:     "http",
+			HostRegexp:   ".*",
+			BlockedPaths: []string{pattern},
+		}})
+		require.Error(t, err, pattern)
+	}
+}
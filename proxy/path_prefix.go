@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// EnablePathPrefix makes the proxy work behind a reverse proxy that serves it
+// under the given path prefix, for example /aperture. The prefix is removed
+// from the paths of requests that still carry it before they are matched to a
+// service, and it is added to the URLs we tell clients about, like the
+// locations of asynchronous jobs and backend redirects.
+func (p *Proxy) EnablePathPrefix(prefix string) {
+	p.pathPrefix = strings.TrimSuffix(prefix, "/")
+	if p.asyncJobs != nil {
+		p.asyncJobs.pathPrefix = p.pathPrefix
+	}
+}
+
+// stripPathPrefix returns the given request with the path prefix removed from
+// its path. Requests whose path doesn't start with the prefix, because the
+// reverse proxy in front of us already removed it, are returned unchanged.
+func stripPathPrefix(r *http.Request, prefix string) *http.Request {
+	path := r.URL.Path
+	if prefix == "" || (path != prefix &&
+		!strings.HasPrefix(path, prefix+"/")) {
+
+		return r
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = "/" + strings.TrimPrefix(
+		strings.TrimPrefix(path, prefix), "/",
+	)
+	r2.URL.RawPath = ""
+
+	return r2
+}
+
+// prefixLocation adds the path prefix to the Location header field of the
+// given backend response if it redirects to a path on our host.
+func prefixLocation(header http.Header, prefix string) {
+	location := header.Get("Location")
+	if prefix == "" || !strings.HasPrefix(location, "/") ||
+		strings.HasPrefix(location, "//") {
+
+		return
+	}
+
+	header.Set("Location", prefix+location)
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPathPrefix makes sure requests are matched to services with and without
+// the path prefix and that the prefix is added to redirects of backends.
+func TestPathPrefix(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v1/redirect":
+				w.Header().Set("Location", "/v1/other")
+				w.WriteHeader(http.StatusFound)
+
+			case "/v1/external":
+				w.Header().Set(
+					"Location", "https://example.com/v1",
+				)
+				w.WriteHeader(http.StatusFound)
+
+			default:
+				_, _ = w.Write([]byte(r.URL.Path))
+			}
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "prefixed",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		PathRegexp: "^/v1/.*$",
+		Auth:       "off",
+	}})
+	require.NoError(t, err)
+	p.EnablePathPrefix("/aperture/")
+
+	send := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The prefix is removed if the reverse proxy in front of us didn't
+	// already do so.
+	rec := send("/aperture/v1/users")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "/v1/users", rec.Body.String())
+
+	rec = send("/v1/users")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "/v1/users", rec.Body.String())
+
+	// Paths merely starting with the same characters aren't prefixed.
+	req := httptest.NewRequest(http.MethodGet, "/aperturev1/users", nil)
+	require.Equal(t, "/aperturev1/users", stripPathPrefix(
+		req, p.pathPrefix,
+	).URL.Path)
+
+	// Redirects to paths of the backend are prefixed, those to other
+	// hosts aren't.
+	rec = send("/aperture/v1/redirect")
+	require.Equal(t, http.StatusFound, rec.Code)
+	require.Equal(t, "/aperture/v1/other", rec.Header().Get("Location"))
+
+	rec = send("/v1/external")
+	require.Equal(t, http.StatusFound, rec.Code)
+	require.Equal(
+		t, "https://example.com/v1", rec.Header().Get("Location"),
+	)
+
+	// The locations of asynchronous jobs are prefixed as well.
+	p.EnableAsyncJobs(&mockAsyncJobStore{jobs: make(map[string]AsyncJob)})
+	defer p.Close()
+	require.Equal(
+		t, "/aperture"+AsyncJobPathPrefix+"abcd",
+		p.asyncJobs.location("abcd"),
+	)
+}
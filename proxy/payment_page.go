@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+var (
+	// invoiceRegexp extracts the invoice from the WWW-Authenticate header
+	// field of an LSAT challenge.
+	invoiceRegexp = regexp.MustCompile(`invoice="([^"]+)"`)
+
+	// invoiceNetworks are the networks whose invoices we can decode.
+	invoiceNetworks = []*chaincfg.Params{
+		&chaincfg.MainNetParams, &chaincfg.TestNet3Params,
+		&chaincfg.RegressionNetParams, &chaincfg.SimNetParams,
+	}
+
+	// paymentPageFuncs are the functions available to the JSON payment
+	// page template.
+	paymentPageFuncs = texttemplate.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}
+)
+
+// PaymentPageData is the data the payment page templates of a service are
+// executed with.
+type PaymentPageData struct {
+	// Invoice is the BOLT11 invoice the client needs to pay.
+	Invoice string
+
+	// PaymentHash is the hex encoded payment hash of the invoice.
+	PaymentHash string
+
+	// AmountSat is the amount of the invoice in satoshis.
+	AmountSat int64
+
+	// ServiceName is the name of the service the client wants to access.
+	ServiceName string
+
+	// Memo is the description of the invoice.
+	Memo string
+}
+
+// paymentPage renders the body of the 402 responses of a service.
+type paymentPage struct {
+	serviceName string
+
+	html *htmltemplate.Template
+	json *texttemplate.Template
+}
+
+// newPaymentPage parses the payment page templates of the given service. It
+// returns nil if the service doesn't have any.
+func newPaymentPage(s *Service) (*paymentPage, error) {
+	if s.PaymentPageTemplate == "" && s.PaymentJSONTemplate == "" {
+		return nil, nil
+	}
+
+	page := &paymentPage{serviceName: s.Name}
+	if s.PaymentPageTemplate != "" {
+		tmpl, err := htmltemplate.ParseFiles(s.PaymentPageTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse payment page "+
+				"template of service %s: %v", s.Name, err)
+		}
+		page.html = tmpl
+	}
+
+	if s.PaymentJSONTemplate != "" {
+		tmpl, err := texttemplate.New(
+			filepath.Base(s.PaymentJSONTemplate),
+		).Funcs(paymentPageFuncs).ParseFiles(s.PaymentJSONTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse payment JSON "+
+				"template of service %s: %v", s.Name, err)
+		}
+		page.json = tmpl
+	}
+
+	return page, nil
+}
+
+// acceptsJSON returns true if the client lists JSON as one of the media types
+// it accepts.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaType)
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// render returns the content type and body of the payment page for the given
+// request and invoice. The JSON template is used if the client accepts JSON,
+// the HTML template otherwise. False is returned if there is no template for
+// the request.
+func (p *paymentPage) render(r *http.Request,
+	data *PaymentPageData) (string, []byte, bool) {
+
+	var (
+		contentType string
+		tmpl        interface {
+			Execute(io.Writer, interface{}) error
+		}
+	)
+	switch {
+	case p.json != nil && acceptsJSON(r):
+		contentType, tmpl = "application/json", p.json
+
+	case p.html != nil:
+		contentType, tmpl = "text/html; charset=utf-8", p.html
+
+	default:
+		return "", nil, false
+	}
+
+	data.ServiceName = p.serviceName
+
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		log.Errorf("Unable to render payment page of service %s: %v",
+			p.serviceName, err)
+		return "", nil, false
+	}
+
+	return contentType, body.Bytes(), true
+}
+
+// paymentPageData extracts the details of the invoice from the given LSAT
+// challenge header. False is returned if the challenge doesn't carry an
+// invoice we can decode.
+func paymentPageData(header http.Header) (*PaymentPageData, bool) {
+	matches := invoiceRegexp.FindStringSubmatch(
+		header.Get("WWW-Authenticate"),
+	)
+	if matches == nil {
+		return nil, false
+	}
+	invoice := matches[1]
+
+	// The invoice can only be decoded with the parameters of its
+	// network, so we try all of them.
+	for _, network := range invoiceNetworks {
+		payReq, err := zpay32.Decode(invoice, network)
+		if err != nil {
+			continue
+		}
+
+		data := &PaymentPageData{Invoice: invoice}
+		if payReq.PaymentHash != nil {
+			data.PaymentHash = hex.EncodeToString(
+				payReq.PaymentHash[:],
+			)
+		}
+		if payReq.MilliSat != nil {
+			data.AmountSat = int64(payReq.MilliSat.ToSatoshis())
+		}
+		if payReq.Description != nil {
+			data.Memo = *payReq.Description
+		}
+
+		return data, true
+	}
+
+	return nil, false
+}
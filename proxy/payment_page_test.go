@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPaymentPage makes sure the 402 responses of services with payment page
+// templates are rendered from the template matching the client's Accept
+// header.
+func TestPaymentPage(t *testing.T) {
+	dir := t.TempDir()
+	htmlPath := filepath.Join(dir, "payment.html")
+	jsonPath := filepath.Join(dir, "payment.json")
+	require.NoError(t, ioutil.WriteFile(
+		htmlPath, []byte(`<p>{{.ServiceName}}: {{.AmountSat}} sat, `+
+			`{{.Memo}}</p>`), 0600,
+	))
+	require.NoError(t, ioutil.WriteFile(
+		jsonPath, []byte(`{"invoice": {{json .Invoice}}, `+
+			`"payment_hash": {{json .PaymentHash}}, `+
+			`"amount_sat": {{.AmountSat}}, `+
+			`"memo": {{json .Memo}}}`), 0600,
+	))
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:                "both",
+		HostRegexp:          "^both$",
+		Auth:                "on",
+		PaymentPageTemplate: htmlPath,
+		PaymentJSONTemplate: jsonPath,
+	}, {
+		Name:                "html",
+		HostRegexp:          "^html$",
+		Auth:                "on",
+		PaymentPageTemplate: htmlPath,
+	}, {
+		Name:       "plain",
+		HostRegexp: "^plain$",
+		Auth:       "on",
+	}})
+	require.NoError(t, err)
+
+	send := func(host, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusPaymentRequired, rec.Code)
+		require.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+		return rec
+	}
+
+	rec := send("both", "text/html, application/json;q=0.9")
+	require.Equal(t, "application/json", rec.Header().Get(hdrContentType))
+
+	var page struct {
+		Invoice     string `json:"invoice"`
+		PaymentHash string `json:"payment_hash"`
+		AmountSat   int64  `json:"amount_sat"`
+		Memo        string `json:"memo"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Contains(t, rec.Header().Get("WWW-Authenticate"), page.Invoice)
+	require.Len(t, page.PaymentHash, 64)
+	require.Equal(t, int64(150), page.AmountSat)
+
+	rec = send("both", "")
+	require.Equal(
+		t, "text/html; charset=utf-8", rec.Header().Get(hdrContentType),
+	)
+	require.Contains(t, rec.Body.String(), "<p>both: 150 sat, ")
+
+	// Without a JSON template, the HTML template is used for all
+	// clients.
+	rec = send("html", "application/json")
+	require.Contains(t, rec.Body.String(), "<p>html: 150 sat, ")
+
+	rec = send("plain", "")
+	require.Equal(t, "payment required\n", rec.Body.String())
+
+	// Templates that can't be parsed are rejected.
+	require.NoError(t, ioutil.WriteFile(
+		htmlPath, []byte(`{{.Invoice`), 0600,
+	))
+	_, err = New(auth.NewMockAuthenticator(), []*Service{{
+		Name:                "broken",
+		HostRegexp:          ".*",
+		PaymentPageTemplate: htmlPath,
+	}})
+	require.Error(t, err)
+}
@@ -1,15 +1,19 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"regexp"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/lsat"
@@ -69,10 +73,66 @@ func (l *localService) IsHandling(r *http.Request) bool {
 // a challenge to the client or forwards the request to another server and
 // proxies the response back to the client.
 type Proxy struct {
-	proxyBackend  *httputil.ReverseProxy
 	localServices []LocalService
 	authenticator auth.Authenticator
-	services      []*Service
+
+	// mtx guards the services and the reverse proxy forwarding requests
+	// to their backends. Both are only ever replaced, never modified, so
+	// readers can keep using what they got after releasing the lock.
+	mtx          sync.RWMutex
+	proxyBackend *httputil.ReverseProxy
+	services     []*Service
+
+	// asyncJobs processes the requests clients asked to be handled
+	// asynchronously. It is nil if asynchronous processing isn't enabled.
+	asyncJobs *asyncQueue
+
+	// injectLatency is true if the latency injection configured for
+	// services should be applied.
+	injectLatency bool
+
+	// sampler logs the full details of a fraction of the requests. It is
+	// nil if request sampling isn't enabled.
+	sampler *requestSampler
+
+	// hooks runs custom logic on the requests forwarded to backends. It
+	// is nil if no hooks are configured.
+	hooks RequestHooks
+
+	// pathPrefix is the path prefix a reverse proxy in front of us serves
+	// us under. It is empty if we're served at the root.
+	pathPrefix string
+
+	// distributedRateLimiter enforces the rate limits of the services
+	// with RateLimitDistributed set across all aperture instances. It is
+	// nil if distributed rate limits aren't enabled, in which case they
+	// are enforced by each instance on its own.
+	distributedRateLimiter *distributedRateLimiter
+
+	// jwtAuthenticator authenticates the requests to the services with
+	// AuthModeJWT. It is nil if JWT authentication isn't enabled.
+	jwtAuthenticator auth.Authenticator
+
+	// authCookie is the name of the cookie browser clients send their
+	// LSAT in. It is empty if LSATs aren't accepted in cookies.
+	authCookie string
+
+	// accessLog writes an access log entry for every request. It is nil
+	// if the access log isn't enabled.
+	accessLog *accessLogger
+
+	// forwardProxy forwards requests to the hosts named by the clients.
+	// It is nil if we only act as a reverse proxy.
+	forwardProxy *forwardProxy
+
+	// backendTLSMinVersion is the minimum TLS version negotiated with the
+	// backends. The default of the TLS package is used if it is zero.
+	backendTLSMinVersion uint16
+
+	// maxResponseHeaderBytes is the maximum number of bytes of the
+	// response headers read from the backends. The default of the HTTP
+	// package is used if it is zero.
+	maxResponseHeaderBytes int64
 }
 
 // New returns a new Proxy instance that proxies between the services specified,
@@ -84,7 +144,6 @@ func New(auth auth.Authenticator, services []*Service,
 	proxy := &Proxy{
 		localServices: localServices,
 		authenticator: auth,
-		services:      services,
 	}
 	err := proxy.UpdateServices(services)
 	if err != nil {
@@ -94,18 +153,144 @@ func New(auth auth.Authenticator, services []*Service,
 	return proxy, nil
 }
 
+// EnableAsyncJobs allows clients of services with SupportPreferAsync set to ask
+// for their requests to be processed asynchronously. The jobs are persisted in
+// the given store until their response is retrieved. Jobs that are still
+// pending because the instance that accepted them stopped are resumed.
+func (p *Proxy) EnableAsyncJobs(store AsyncJobStore) {
+	p.asyncJobs = newAsyncQueue(store)
+	p.asyncJobs.pathPrefix = p.pathPrefix
+	p.asyncJobs.start()
+
+	p.asyncJobs.wg.Add(1)
+	go p.asyncJobs.resume(func(name string) (*Service, http.Handler) {
+		service := p.serviceByName(name)
+		if service == nil {
+			return nil, nil
+		}
+
+		return service, p.serviceBackend(service, false)
+	})
+}
+
+// EnableLatencyInjection applies the latency injection configured for services
+// to their responses. As it deliberately slows down the services, it must only
+// be enabled for debugging.
+func (p *Proxy) EnableLatencyInjection() {
+	p.injectLatency = true
+}
+
+// EnableRequestSampling logs the full details of the given fraction of
+// requests, between 0 and 1, to the given writer as lines of JSON. Header
+// fields carrying credentials are redacted and only the beginning of the
+// bodies is logged.
+func (p *Proxy) EnableRequestSampling(rate float64, log io.Writer) {
+	p.sampler = newRequestSampler(rate, log)
+}
+
+// SetBackendTLSMinVersion sets the minimum TLS version negotiated with the
+// backends of all services, like tls.VersionTLS13.
+func (p *Proxy) SetBackendTLSMinVersion(version uint16) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.backendTLSMinVersion = version
+
+	return p.createBackend(p.services)
+}
+
+// EnableAuthCookie removes the cookie with the given name, which browser
+// clients send their LSAT in, from the requests forwarded to the backends.
+func (p *Proxy) EnableAuthCookie(name string) {
+	p.authCookie = name
+}
+
+// EnableJWTAuth authenticates the requests to the services with AuthModeJWT
+// using the given authenticator.
+func (p *Proxy) EnableJWTAuth(authenticator auth.Authenticator) {
+	p.jwtAuthenticator = authenticator
+}
+
+// authenticatorFor returns the authenticator for the requests to the given
+// service. It is nil if the service uses JWT authentication but it isn't
+// enabled.
+func (p *Proxy) authenticatorFor(s *Service) auth.Authenticator {
+	if s.AuthMode == AuthModeJWT {
+		return p.jwtAuthenticator
+	}
+
+	return p.authenticator
+}
+
+// EnableDistributedRateLimits enforces the rate limits of the services with
+// RateLimitDistributed set using the token buckets in the given store, which
+// is shared with the other aperture instances.
+func (p *Proxy) EnableDistributedRateLimits(store RateLimitStore) {
+	p.distributedRateLimiter = newDistributedRateLimiter(store)
+}
+
+// rateLimiterFor returns the limiter enforcing the rate limit of the given
+// service. It is nil if the service has no rate limit.
+func (p *Proxy) rateLimiterFor(s *Service) requestLimiter {
+	switch {
+	case s.rateLimiter == nil:
+		return nil
+
+	case s.RateLimitDistributed && p.distributedRateLimiter != nil:
+		return p.distributedRateLimiter.forService(s)
+
+	default:
+		return s.rateLimiter
+	}
+}
+
+// EnableRequestHooks calls the given hooks before each request is forwarded to
+// its backend and before each backend response is sent to the client.
+func (p *Proxy) EnableRequestHooks(hooks RequestHooks) {
+	p.hooks = hooks
+}
+
 // ServeHTTP checks a client's headers for appropriate authorization and either
 // returns a challenge or forwards their request to the target backend service.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
 	// Parse and log the remote IP address. We also need the parsed IP
 	// address for the freebie count.
 	remoteIP, prefixLog := NewRemoteIPPrefixLog(log, r.RemoteAddr)
+	prefixLog = prefixLog.WithField("request_id", requestID(r))
 	logRequest := func() {
 		prefixLog.Infof(formatPattern, r.Method, r.RequestURI, r.Proto,
 			r.Referer(), r.UserAgent())
 	}
 	defer logRequest()
 
+	// Requests for hosts named by the client are never matched to a
+	// service. They are handled before sampling, as tunnels need the
+	// client connection itself.
+	if p.forwardProxy != nil && isForwardProxyRequest(r) {
+		p.serveForwardProxy(w, r, prefixLog)
+		return
+	}
+
+	if p.accessLog != nil {
+		var logAccess func()
+		w, r, logAccess = p.accessLog.start(w, r, remoteIP)
+		defer logAccess()
+	}
+
+	// The sampling decision is made once and stored in the request context
+	// so everything handling the request sees the same decision.
+	if p.sampler != nil {
+		var logSample func()
+		w, r, logSample = p.sampler.start(w, r)
+		defer logSample()
+	}
+
+	// Everything below works with the path as if we were served at the
+	// root.
+	r = stripPathPrefix(r, p.pathPrefix)
+
 	// For OPTIONS requests we only need to set the CORS headers, not serve
 	// any content;
 	if r.Method == "OPTIONS" {
@@ -114,11 +299,20 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The responses of asynchronous jobs are served before matching the
+	// request to a service so they can always be retrieved at the
+	// location we told the client.
+	if p.asyncJobs != nil && p.asyncJobs.isHandling(r) {
+		addCorsHeaders(w.Header())
+		p.asyncJobs.ServeHTTP(w, r)
+		return
+	}
+
 	// Requests that can't be matched to a service backend will be
 	// dispatched to the static file server. If the file exists in the
 	// static file folder it will be served, otherwise the static server
 	// will return a 404 for us.
-	target, ok := matchService(r, p.services)
+	target, ok := matchService(r, p.Services())
 	if !ok {
 		// This isn't a request for any configured remote backend that
 		// we are proxying for. So we give it to the local service that
@@ -140,12 +334,110 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		sendDirectResponse(w, r, http.StatusInternalServerError, "")
 		return
 	}
+	accessLogFromContext(r.Context()).setService(target.Name)
+	prefixLog = prefixLog.WithField("service", target.Name)
+
+	// From here on the request is attributed to the service, so we track
+	// how long it takes to respond to it.
+	var observeDuration func()
+	w, observeDuration = recordRequestDuration(w, target.Name, start)
+	defer observeDuration()
+
+	// Requests from addresses the service doesn't accept requests from
+	// are rejected first. Behind a load balancer that sends the PROXY
+	// protocol header, the remote address is already the client's.
+	if target.ipFilter != nil && !target.ipFilter.filter(w, r, remoteIP) {
+		prefixLog.Infof("Remote IP %s not allowed for service %s. "+
+			"Sending 403.", remoteIP, target.Name)
+		return
+	}
+
+	// Requests using a method the service doesn't allow are rejected
+	// before doing any other work for them.
+	if target.methodFilter != nil && !target.methodFilter.filter(w, r) {
+		prefixLog.Infof("Method %s not allowed for service %s. "+
+			"Sending 405.", r.Method, target.Name)
+		return
+	}
+
+	// Requests to paths the service doesn't expose are rejected before
+	// challenging clients for paths they can't access anyway.
+	if target.pathFilter != nil && !target.pathFilter.filter(w, r) {
+		prefixLog.Infof("Path %s not allowed for service %s. "+
+			"Sending 403.", r.URL.Path, target.Name)
+		return
+	}
+
+	// Requests whose content type the endpoint doesn't expect are
+	// rejected before they can confuse the backend.
+	if target.contentTypes != nil && !target.contentTypes.filter(w, r) {
+		prefixLog.Infof("Content type %q not allowed for service %s. "+
+			"Sending 415.", r.Header.Get("Content-Type"),
+			target.Name)
+		return
+	}
+
+	// Clients uploading large bodies can be informed about the progress.
+	// This needs to happen before the body is limited, as the limit is
+	// detected by looking at the outermost body.
+	if target.ProgressInterval > 0 {
+		w = reportUploadProgress(w, r, target.ProgressInterval)
+	}
+
+	// Requests exceeding the size budget of the service are rejected
+	// before doing any other work for them.
+	if target.MaxRequestSize > 0 &&
+		!limitRequestSize(w, r, target.MaxRequestSize) {
+
+		prefixLog.Infof("Request to service %s too large. Sending 413.",
+			target.Name)
+		return
+	}
+	if target.MaxBodyBytes > 0 &&
+		!limitBodySize(w, r, target.MaxBodyBytes) {
+
+		prefixLog.Infof("Request body to service %s too large. "+
+			"Sending 413.", target.Name)
+		return
+	}
+
+	// Services with a static response don't need authentication or a
+	// backend.
+	if target.StaticResponse != nil {
+		addCorsHeaders(w.Header())
+		target.StaticResponse.ServeHTTP(w, r)
+		return
+	}
 
 	resourceName := target.ResourceName(r.URL.Path)
 
 	// Determine auth level required to access service and dispatch request
 	// accordingly.
 	authLevel := target.AuthRequired(r)
+	if !authLevel.IsOff() && target.bypassesAuth(r, remoteIP, prefixLog) {
+		authLevel = auth.LevelOff
+	}
+
+	authenticator := p.authenticatorFor(target)
+	if !authLevel.IsOff() && authenticator == nil {
+		prefixLog.Errorf("Service %s uses %s authentication, but it "+
+			"isn't enabled", target.Name, target.AuthMode)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"authentication failure",
+		)
+		return
+	}
+
+	// Replayed requests are rejected before their LSAT is accepted, so
+	// they don't use up its budget.
+	if (authLevel.IsOn() || authLevel.IsFreebie()) &&
+		!p.verifyNonce(w, r, authenticator, resourceName) {
+
+		return
+	}
+
+	var authenticated bool
 	switch {
 	case authLevel.IsOn():
 		// Determine if the header contains the authentication
@@ -153,7 +445,15 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// called in each case body rather than outside the switch so
 		// as to avoid calling this possibly expensive call for static
 		// resources.
-		acceptAuth := p.authenticator.Accept(&r.Header, resourceName)
+		acceptAuth := authenticator.Accept(&r.Header, resourceName)
+
+		// Services that don't use LSATs can't be paid for, so there
+		// is no price to check.
+		if !acceptAuth && target.AuthMode == AuthModeJWT {
+			prefixLog.Infof("Authentication failed. Sending 401.")
+			p.handleUnauthorized(w, r, authenticator, target.Name)
+			return
+		}
 		if !acceptAuth {
 			price, err := target.pricer.GetPrice(
 				r.Context(), r.URL.Path,
@@ -176,14 +476,21 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 
 			prefixLog.Infof("Authentication failed. Sending 402.")
-			p.handlePaymentRequired(w, r, resourceName, price)
+			p.handlePaymentRequired(
+				w, withFeePricing(r, target), resourceName,
+				price, target.paymentPage,
+			)
 			return
 		}
+		if acceptAuth {
+			accessLogFromContext(r.Context()).setToken(&r.Header)
+			authenticated = true
+		}
 
 	case authLevel.IsFreebie():
 		// We only need to respect the freebie counter if the user
 		// is not authenticated at all.
-		acceptAuth := p.authenticator.Accept(&r.Header, resourceName)
+		acceptAuth := authenticator.Accept(&r.Header, resourceName)
 		if !acceptAuth {
 			ok, err := target.freebieDb.CanPass(r, remoteIP)
 			if err != nil {
@@ -218,7 +525,9 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}
 
 				p.handlePaymentRequired(
-					w, r, resourceName, target.Price,
+					w, withFeePricing(r, target),
+					resourceName, target.Price,
+					target.paymentPage,
 				)
 				return
 			}
@@ -232,21 +541,189 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				)
 				return
 			}
+		} else {
+			accessLogFromContext(r.Context()).setToken(&r.Header)
+			authenticated = true
+		}
+	}
+
+	// Upgraded connections, like WebSockets, outlive the request that
+	// opened them, so their credentials are verified again periodically.
+	if authenticated && isUpgradeRequest(r) {
+		var stopWatching func()
+		r, stopWatching = watchUpgradeAuth(
+			r, authenticator, resourceName,
+		)
+		defer stopWatching()
+	}
+
+	// Authenticated requests are still subject to the rate limit of the
+	// service.
+	limiter := p.rateLimiterFor(target)
+	if limiter != nil && !limitRate(w, r, limiter) {
+		prefixLog.Infof("Rate limit of service %s exceeded. Sending "+
+			"429.", target.Name)
+		return
+	}
+
+	// If the backend is degraded, serve the fallback response instead of
+	// adding to its load.
+	if target.slo != nil && !target.slo.allow() {
+		prefixLog.Debugf("Backend of service %s degraded, serving "+
+			"fallback response.", target.Name)
+		addCorsHeaders(w.Header())
+		sendDirectResponse(
+			w, r, http.StatusOK, target.SLOFallbackResponse,
+		)
+		return
+	}
+
+	// Don't even dial the backend while it keeps failing.
+	if target.breaker != nil {
+		ok, done := target.breaker.filter(w, r)
+		if !ok {
+			prefixLog.Debugf("Circuit breaker of service %s open. "+
+				"Sending 503.", target.Name)
+			return
 		}
+		defer done()
+	}
+
+	// Operators can deny requests with their own logic as the last
+	// check before the request is forwarded.
+	if p.hooks != nil && !p.runPreRequestHook(w, r, target) {
+		prefixLog.Infof("Request to service %s rejected by hook.",
+			target.Name)
+		return
 	}
 
+	// Now that the request is authorized, its header fields can be
+	// rewritten for the backend.
+	r = target.rewriteHeaders(r, remoteIP)
+
 	// If we got here, it means everything is OK to pass the request to the
 	// service backend via the reverse proxy.
-	p.proxyBackend.ServeHTTP(w, r)
+	backend := p.serviceBackend(target, isGrpcWebRequest(r))
+	if target.coalescer != nil {
+		backend = target.coalescer.wrap(backend)
+	}
+
+	// Clients can ask for long-running requests to be processed in the
+	// background. As this is only a preference, the request is processed
+	// synchronously if the service doesn't support it.
+	if target.SupportPreferAsync && p.asyncJobs != nil &&
+		RequestProtocol(r) != ProtocolGRPC && preferAsync(r) {
+
+		addCorsHeaders(w.Header())
+		p.asyncJobs.submit(w, r, target, backend)
+		return
+	}
+
+	r, cancel := withBackendTimeout(r, target)
+	defer cancel()
+
+	backend.ServeHTTP(
+		w, withBackendRequest(r, target, target.chooseBackend()),
+	)
 }
 
 // UpdateServices re-configures the proxy to use a new set of backend services.
+//
+// NOTE: This method is safe for concurrent use. The services passed in must
+// not be modified afterwards, as requests are served with them concurrently.
 func (p *Proxy) UpdateServices(services []*Service) error {
-	err := prepareServices(services)
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	err := prepareServices(services, p.services)
+	if err != nil {
+		return err
+	}
+
+	return p.createBackend(services)
+}
+
+// AddService starts proxying to the backend of the given service in addition
+// to the services already in use. No other service may have the same name.
+func (p *Proxy) AddService(service *Service) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	err := prepareServices([]*Service{service}, p.services)
 	if err != nil {
 		return err
 	}
 
+	if serviceIndex(p.services, service.Name) >= 0 {
+		return fmt.Errorf("service %s already exists", service.Name)
+	}
+
+	services := make([]*Service, 0, len(p.services)+1)
+	services = append(services, p.services...)
+	services = append(services, service)
+
+	return p.createBackend(services)
+}
+
+// RemoveService stops proxying to the backend of the service with the given
+// name. The other services are left untouched.
+func (p *Proxy) RemoveService(name string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	i := serviceIndex(p.services, name)
+	if i < 0 {
+		return fmt.Errorf("service %s not found", name)
+	}
+
+	services := make([]*Service, 0, len(p.services)-1)
+	services = append(services, p.services[:i]...)
+	services = append(services, p.services[i+1:]...)
+
+	return p.createBackend(services)
+}
+
+// UpdateService replaces the service with the same name as the given one. The
+// other services are left untouched and keep their state, like the freebie
+// counts of their clients.
+func (p *Proxy) UpdateService(service *Service) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	err := prepareServices([]*Service{service}, p.services)
+	if err != nil {
+		return err
+	}
+
+	i := serviceIndex(p.services, service.Name)
+	if i < 0 {
+		return fmt.Errorf("service %s not found", service.Name)
+	}
+
+	services := make([]*Service, len(p.services))
+	copy(services, p.services)
+	services[i] = service
+
+	return p.createBackend(services)
+}
+
+// serviceIndex returns the index of the service with the given name or -1 if
+// there is none.
+func serviceIndex(services []*Service, name string) int {
+	for i, service := range services {
+		if service.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// createBackend creates the reverse proxy that forwards requests to the
+// backends of the given, prepared services and starts using the services.
+//
+// NOTE: The caller must hold the write lock of mtx.
+func (p *Proxy) createBackend(services []*Service) error {
 	certPool, err := certPool(services)
 	if err != nil {
 		return err
@@ -256,29 +733,249 @@ func (p *Proxy) UpdateServices(services []*Service) error {
 		TLSClientConfig: &tls.Config{
 			RootCAs:            certPool,
 			InsecureSkipVerify: true,
+			MinVersion:         p.backendTLSMinVersion,
 		},
+		DialContext:            backendDialer(nil),
+		MaxResponseHeaderBytes: p.maxResponseHeaderBytes,
+	}
+	serviceTransports := createServiceTransports(services, transport)
+	maxHeaderBytes := p.maxResponseHeaderBytes
+
+	// The connections of the transports we replace would otherwise be
+	// kept open forever.
+	if p.proxyBackend != nil {
+		defer closeIdleConnections(p.proxyBackend.Transport)
 	}
 
 	p.proxyBackend = &httputil.ReverseProxy{
-		Director:  p.director,
-		Transport: &trailerFixingTransport{next: transport},
+		Director: p.director,
+		Transport: &trailerFixingTransport{
+			next: &serviceTransport{
+				shared:   transport,
+				services: serviceTransports,
+			},
+		},
 		ModifyResponse: func(res *http.Response) error {
+			recordBackendResult(res.Request.Context(), res.StatusCode)
 			addCorsHeaders(res.Header)
+
+			// Binary gRPC metadata must reach the client unaltered,
+			// no matter whether it's sent in the header or trailer.
+			normalizeBinaryHeaders(res.Header)
+
+			// Backends redirecting to their own paths don't know
+			// we're served under a prefix.
+			prefixLocation(res.Header, p.pathPrefix)
+
+			backendReq := backendRequestFromContext(
+				res.Request.Context(),
+			)
+			if backendReq != nil &&
+				backendReq.service.StripResponseCookies {
+
+				stripResponseCookies(res.Header)
+			}
+			setResponseHeaders(res)
+			if backendReq != nil &&
+				backendReq.service.EnableChecksumTrailers {
+
+				addChecksumTrailer(res)
+			}
+
+			if p.hooks != nil && backendReq != nil {
+				p.runPostResponseHook(res, backendReq.service)
+			}
+
+			// HTTP/2 backends can send trailers they didn't
+			// declare, which only show up once the body was read.
+			if len(res.Trailer) > 0 || res.ProtoMajor >= 2 {
+				res.Body = &binaryTrailerBody{
+					ReadCloser: res.Body,
+					resp:       res,
+				}
+			}
+
 			return nil
 		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request,
+			err error) {
+
+			// The client sent more than the service allows, which
+			// isn't the backend's fault.
+			if requestTooLarge(r) {
+				addCorsHeaders(w.Header())
+				sendDirectResponse(
+					w, r, http.StatusRequestEntityTooLarge,
+					errRequestTooLarge.Error(),
+				)
+				return
+			}
+
+			// A client going away isn't the backend's fault either.
+			if !errors.Is(err, context.Canceled) {
+				recordBackendResult(
+					r.Context(), http.StatusBadGateway,
+				)
+			}
+
+			var (
+				service *Service
+				name    = "unknown"
+			)
+			backendReq := backendRequestFromContext(r.Context())
+			if backendReq != nil {
+				service = backendReq.service
+				name = service.Name
+			}
+
+			// The backend didn't answer within one of the backend
+			// timeouts of the service.
+			timeout, ok := exceededTimeout(err, service)
+			if ok {
+				log.Errorf("Request to backend of service %s "+
+					"timed out: %v", name, err)
+				sendGatewayTimeout(w, timeout)
+				return
+			}
+			// A backend sending overly large headers might have
+			// been compromised, so it's worth pointing out.
+			if responseHeadersTooLarge(err) {
+				log.Warnf("Backend of service %s sent response "+
+					"headers exceeding the limit of %d "+
+					"bytes", name, maxHeaderBytes)
+			}
+			log.Errorf("Error proxying request to backend: %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
 
 		// A negative value means to flush immediately after each write
 		// to the client.
 		FlushInterval: -1,
 	}
+	p.invalidateChangedServices(services)
+	updateSRVEndpoints(services, p.services)
+	p.services = services
+
+	return nil
+}
+
+// invalidateChangedServices lets the authenticators drop the state they keep
+// for the services that are in use but were changed or are not among the given
+// ones anymore, so the LSATs they verified are checked against the new
+// definitions.
+//
+// NOTE: The caller must hold the write lock of mtx.
+func (p *Proxy) invalidateChangedServices(services []*Service) {
+	for _, s := range p.services {
+		idx := serviceIndex(services, s.Name)
+		if idx >= 0 && services[idx] == s {
+			continue
+		}
+
+		for _, a := range p.authenticators() {
+			invalidator, ok := a.(auth.ServiceInvalidator)
+			if ok {
+				invalidator.InvalidateService(s.Name)
+			}
+		}
+	}
+}
+
+// InvalidateToken lets the authenticators drop the state they keep for the
+// LSAT with the given token ID, which is needed once it is revoked.
+func (p *Proxy) InvalidateToken(id lsat.TokenID) {
+	for _, a := range p.authenticators() {
+		invalidator, ok := a.(auth.TokenInvalidator)
+		if ok {
+			invalidator.InvalidateToken(id)
+		}
+	}
+}
+
+// InvalidateTokens lets the authenticators drop the state they keep for all
+// LSATs, which is needed if revocations might have been missed.
+func (p *Proxy) InvalidateTokens() {
+	for _, a := range p.authenticators() {
+		invalidator, ok := a.(auth.TokenInvalidator)
+		if ok {
+			invalidator.InvalidateTokens()
+		}
+	}
+}
+
+// authenticators returns all authenticators of the proxy.
+func (p *Proxy) authenticators() []auth.Authenticator {
+	return []auth.Authenticator{p.authenticator, p.jwtAuthenticator}
+}
+
+// Services returns the backend services the proxy currently uses.
+func (p *Proxy) Services() []*Service {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	return p.services
+}
+
+// backend returns the reverse proxy that currently forwards requests to the
+// backends of the services.
+func (p *Proxy) backend() http.Handler {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	return p.proxyBackend
+}
+
+// serviceBackend returns the handler that forwards requests to the backend of
+// the given service through everything the service is configured with.
+func (p *Proxy) serviceBackend(target *Service, grpcWeb bool) http.Handler {
+	var backend http.Handler = p.backend()
+
+	// Browsers can't make gRPC calls directly, so their gRPC-Web calls
+	// are translated for the backend only now that they're authorized.
+	if grpcWeb {
+		backend = grpcWebHandler(backend)
+	}
+	backend = trackInFlight(target.Name, backend)
+	if target.concurrency != nil {
+		backend = target.concurrency.wrap(backend)
+	}
+	if target.chaos != nil {
+		backend = target.chaos.wrap(backend)
+	}
+	if target.latency != nil && p.injectLatency {
+		backend = target.latency.wrap(backend)
+	}
+
+	return backend
+}
+
+// serviceByName returns the service with the given name, or nil if there is
+// none.
+func (p *Proxy) serviceByName(name string) *Service {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	for _, service := range p.services {
+		if service.Name == name {
+			return service
+		}
+	}
 
 	return nil
 }
 
 // Close cleans up the Proxy by closing any remaining open connections.
 func (p *Proxy) Close() error {
+	if p.asyncJobs != nil {
+		p.asyncJobs.stop()
+	}
+
 	var returnErr error
-	for _, s := range p.services {
+	for _, s := range p.Services() {
+		if s.srv != nil {
+			s.srv.stop()
+		}
+
 		if err := s.pricer.Close(); err != nil {
 			log.Errorf("error while closing the pricer of "+
 				"service %s: %v", s.Name, err)
@@ -292,18 +989,31 @@ func (p *Proxy) Close() error {
 // director is a method that rewrites an incoming request to be forwarded to a
 // backend service.
 func (p *Proxy) director(req *http.Request) {
-	target, ok := matchService(req, p.services)
+	target, ok := matchService(req, p.Services())
 	if ok {
 		// Rewrite address and protocol in the request so the
 		// real service is called instead.
-		req.Host = target.Address
-		req.URL.Host = target.Address
+		address := target.backendAddress()
+		backendReq := backendRequestFromContext(req.Context())
+		if backendReq != nil && backendReq.backend == BackendCanary {
+			address = target.CanaryAddress
+		}
+		// The host the client requested is only kept if the
+		// service forwards it.
+		if !target.forwardsClientHeader("Host") {
+			req.Host = address
+		}
+		req.URL.Host = address
 		req.URL.Scheme = target.Protocol
+		accessLogFromContext(req.Context()).setBackendAddress(address)
 
 		// Make sure we always forward the authorization in the correct/
-		// default format so the backend knows what to do with it.
+		// default format so the backend knows what to do with it,
+		// unless the service strips it.
 		mac, preimage, err := lsat.FromHeader(&req.Header)
-		if err == nil {
+		if err == nil &&
+			!target.stripsRequestHeader(lsat.HeaderAuthorization) {
+
 			// It could be that there is no auth information because
 			// none is needed for this particular request. So we
 			// only continue if no error is set.
@@ -313,11 +1023,27 @@ func (p *Proxy) director(req *http.Request) {
 			}
 		}
 
+		// LSATs sent in a cookie are credentials the backend doesn't
+		// need to see.
+		if p.authCookie != "" {
+			lsat.RemoveCookie(&req.Header, p.authCookie)
+		}
+
 		// Now overwrite header fields of the client request
-		// with the fields from the configuration file.
+		// with the fields from the configuration file, unless the
+		// client's fields are forwarded as sent.
 		for name, value := range target.Headers {
+			if target.forwardsClientHeader(name) &&
+				len(req.Header.Values(name)) > 0 {
+
+				continue
+			}
 			req.Header.Add(name, value)
 		}
+
+		// Make sure the backend receives binary gRPC metadata values
+		// in a format it can decode.
+		normalizeBinaryHeaders(req.Header)
 	}
 }
 
@@ -388,17 +1114,80 @@ func addCorsHeaders(header http.Header) {
 
 	header.Add("Access-Control-Allow-Origin", "*")
 	header.Add("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	header.Add("Access-Control-Expose-Headers", "WWW-Authenticate")
+	header.Add(
+		"Access-Control-Expose-Headers",
+		"WWW-Authenticate, X-LSAT-Error, Grpc-Status, Grpc-Message",
+	)
 	header.Add(
 		"Access-Control-Allow-Headers",
-		"Authorization, Grpc-Metadata-macaroon, WWW-Authenticate",
+		"Authorization, Grpc-Metadata-macaroon, WWW-Authenticate, "+
+			"X-Request-Nonce, Content-Type, X-Grpc-Web, "+
+			"X-User-Agent, Grpc-Timeout",
 	)
 }
 
+// verifyNonce makes sure the nonce of the given request wasn't used with its
+// LSAT before, if the authenticator protects against replayed LSATs. If it
+// was, the request is rejected and false is returned.
+func (p *Proxy) verifyNonce(w http.ResponseWriter, r *http.Request,
+	authenticator auth.Authenticator, resourceName string) bool {
+
+	verifier, ok := authenticator.(auth.NonceVerifier)
+	if !ok {
+		return true
+	}
+
+	err := verifier.VerifyNonce(&r.Header, resourceName)
+	switch {
+	case err == auth.ErrNonceReused || err == auth.ErrInvalidNonce:
+		log.Infof("Nonce check failed: %v. Sending 400.", err)
+		sendDirectResponse(w, r, http.StatusBadRequest, err.Error())
+		return false
+
+	case err != nil:
+		log.Errorf("Unable to verify nonce: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"nonce verification failure",
+		)
+		return false
+	}
+
+	return true
+}
+
+// handleUnauthorized returns the challenge header fields of the given
+// authenticator and status code to the client signaling that it needs to
+// authenticate with credentials it can't get from us.
+func (p *Proxy) handleUnauthorized(w http.ResponseWriter, r *http.Request,
+	authenticator auth.Authenticator, serviceName string) {
+
+	addCorsHeaders(w.Header())
+
+	header, err := authenticator.FreshChallengeHeader(r, serviceName, 0)
+	if err != nil {
+		log.Errorf("Error creating new challenge header: %v", err)
+		sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"challenge failure",
+		)
+		return
+	}
+
+	for name, values := range header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+
+	sendDirectResponse(w, r, http.StatusUnauthorized, "unauthorized")
+}
+
 // handlePaymentRequired returns fresh challenge header fields and status code
 // to the client signaling that a payment is required to fulfil the request.
+// The body is rendered from the given payment page, if there is one.
 func (p *Proxy) handlePaymentRequired(w http.ResponseWriter, r *http.Request,
-	serviceName string, servicePrice int64) {
+	serviceName string, servicePrice int64, page *paymentPage) {
 
 	addCorsHeaders(r.Header)
 
@@ -419,6 +1208,20 @@ func (p *Proxy) handlePaymentRequired(w http.ResponseWriter, r *http.Request,
 		}
 	}
 
+	// gRPC clients can't make use of a payment page.
+	if page != nil && RequestProtocol(r) != ProtocolGRPC {
+		data, ok := paymentPageData(header)
+		if ok {
+			contentType, body, ok := page.render(r, data)
+			if ok {
+				w.Header().Set(hdrContentType, contentType)
+				w.WriteHeader(http.StatusPaymentRequired)
+				_, _ = w.Write(body)
+				return
+			}
+		}
+	}
+
 	sendDirectResponse(w, r, http.StatusPaymentRequired, "payment required")
 }
 
@@ -429,11 +1232,9 @@ func (p *Proxy) handlePaymentRequired(w http.ResponseWriter, r *http.Request,
 func sendDirectResponse(w http.ResponseWriter, r *http.Request,
 	statusCode int, errInfo string) {
 
-	// Find out if the client is a normal HTTP or a gRPC client. Every gRPC
-	// request should have the Content-Type header field set accordingly
-	// so we can use that.
-	switch {
-	case strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpc):
+	// Find out if the client is a normal HTTP or a gRPC client.
+	switch RequestProtocol(r) {
+	case ProtocolGRPC:
 		w.Header().Set(hdrGrpcStatus, strconv.Itoa(int(codes.Internal)))
 		w.Header().Set(hdrGrpcMessage, errInfo)
 
@@ -448,6 +1249,11 @@ type trailerFixingTransport struct {
 	next http.RoundTripper
 }
 
+// CloseIdleConnections closes the idle connections of the wrapped transport.
+func (l *trailerFixingTransport) CloseIdleConnections() {
+	closeIdleConnections(l.next)
+}
+
 // RoundTrip is a transport round tripper implementation that fixes an issue
 // in the official httputil.ReverseProxy implementation. Apparently the HTTP/2
 // trailers aren't properly forwarded in some cases. We fix this by always
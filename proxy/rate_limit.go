@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// requestLimiter decides whether a request may be proxied under the rate limit
+// of a service.
+type requestLimiter interface {
+	// allow returns true if the request may be proxied. Otherwise it
+	// returns false along with the time until the next request will be
+	// let through.
+	allow(ctx context.Context) (bool, time.Duration)
+}
+
+// rateLimiter limits the rate of the requests proxied to the backends of a
+// service with a token bucket. Requests arriving while the bucket is empty are
+// rejected with 429 Too Many Requests, even if they carry a valid LSAT.
+type rateLimiter struct {
+	service string
+	limiter *rate.Limiter
+
+	// now returns the current time. It can be replaced in tests.
+	now func() time.Time
+}
+
+// newRateLimiter creates a new limiter that lets requests to the given service
+// through at the given rate per second, with bursts of up to the given number
+// of requests. The burst defaults to the rate if it is zero.
+func newRateLimiter(service string, limit, burst int) *rateLimiter {
+	if burst == 0 {
+		burst = limit
+	}
+
+	return &rateLimiter{
+		service: service,
+		limiter: rate.NewLimiter(rate.Limit(limit), burst),
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from the bucket and returns true if there was one.
+// Otherwise it returns false along with the time until the next token is
+// added.
+//
+// NOTE: This is part of the requestLimiter interface.
+func (l *rateLimiter) allow(_ context.Context) (bool, time.Duration) {
+	now := l.now()
+	reservation := l.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return true, 0
+	}
+
+	// The request is rejected, so it mustn't use up the next token.
+	reservation.CancelAt(now)
+
+	return false, delay
+}
+
+// limitRate sends a 429 Too Many Requests response and returns false if the
+// given limiter doesn't let the request through. The Retry-After header tells
+// the client in how many seconds the next request will be let through.
+// Otherwise it returns true and doesn't touch the response.
+func limitRate(w http.ResponseWriter, r *http.Request,
+	limiter requestLimiter) bool {
+
+	ok, delay := limiter.allow(r.Context())
+	if ok {
+		return true
+	}
+
+	retryAfter := int64(math.Ceil(delay.Seconds()))
+	addCorsHeaders(w.Header())
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	sendDirectResponse(
+		w, r, http.StatusTooManyRequests, "rate limit exceeded",
+	)
+	return false
+}
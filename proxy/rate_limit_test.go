@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRateLimit makes sure authenticated requests are let through in a burst
+// and then throttled to the rate limit of the service.
+func TestRateLimit(t *testing.T) {
+	var backendRequests int
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "limited",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "on",
+		RateLimit:  2,
+		RateBurst:  3,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+
+	now := time.Now()
+	services[0].rateLimiter.now = func() time.Time {
+		return now
+	}
+
+	send := func(authenticated bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if authenticated {
+			req.Header.Set("Authorization", "LSAT foo:bar")
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Unauthenticated requests are challenged without using up the
+	// burst.
+	require.Equal(t, http.StatusPaymentRequired, send(false).Code)
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, send(true).Code)
+	}
+	require.Equal(t, 3, backendRequests)
+
+	// Once the burst is used up, requests are rejected even though they
+	// are authenticated.
+	rec := send(true)
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.Equal(t, "1", rec.Header().Get("Retry-After"))
+	require.Equal(t, 3, backendRequests)
+
+	// Rejected requests don't use up tokens, so a new one is available
+	// after half a second at two requests per second.
+	now = now.Add(500 * time.Millisecond)
+	require.Equal(t, http.StatusOK, send(true).Code)
+	require.Equal(t, http.StatusTooManyRequests, send(true).Code)
+	require.Equal(t, 4, backendRequests)
+
+	_, err = New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "invalid",
+		HostRegexp: ".*",
+		RateBurst:  1,
+	}})
+	require.Error(t, err)
+}
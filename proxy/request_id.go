@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	// hdrRequestID is the header field load balancers in front of us set
+	// to identify a request across the systems it passes through.
+	hdrRequestID = "X-Request-Id"
+
+	// maxRequestIDLength is the maximum length of a request ID taken from
+	// the client request.
+	maxRequestIDLength = 128
+)
+
+// requestID returns the ID the log lines of the given request are tagged with.
+// The ID set by a load balancer in front of us is used if there is one, so the
+// request can be followed through its logs as well. Otherwise a random one is
+// created.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(hdrRequestID)
+	if id != "" && len(id) <= maxRequestIDLength {
+		return id
+	}
+
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/lightninglabs/aperture/metrics"
+)
+
+// statusResponseWriter is a response writer that records the status code of
+// the response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+
+	status int
+}
+
+// WriteHeader records the status code and writes the header.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (w *statusResponseWriter) WriteHeader(statusCode int) {
+	// Informational responses like 100 Continue precede the final one.
+	if w.status == 0 && statusCode >= http.StatusOK {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write writes the data to the body.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client.
+//
+// NOTE: This is part of the http.Flusher interface.
+func (w *statusResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, which is needed to proxy
+// protocol upgrades.
+//
+// NOTE: This is part of the http.Hijacker interface.
+func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter,
+	error) {
+
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return conn, rw, err
+}
+
+// recordRequestDuration returns a response writer that records the status code
+// of the response and a function that observes the duration of the request to
+// the given service once it was answered.
+func recordRequestDuration(w http.ResponseWriter, service string,
+	start time.Time) (http.ResponseWriter, func()) {
+
+	sw := &statusResponseWriter{ResponseWriter: w}
+
+	return sw, func() {
+		// Handlers that don't write anything respond with 200 OK.
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		metrics.ObserveProxyRequest(service, status, start)
+	}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+// requestCount returns the number of requests to the given service answered
+// with the given status code that were recorded in the duration histogram.
+func requestCount(t *testing.T, service, statusCode string) uint64 {
+	var metric dto.Metric
+	histogram := metrics.ProxyRequestDuration.WithLabelValues(
+		service, statusCode,
+	)
+	require.NoError(t, histogram.(prometheus.Metric).Write(&metric))
+
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// TestRequestDurationMetrics makes sure the duration of the requests to each
+// service is recorded with the status code they were answered with.
+func TestRequestDurationMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/missing" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "measured",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "on",
+		Price:      1,
+	}})
+	require.NoError(t, err)
+
+	send := func(path string, authenticated bool) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if authenticated {
+			req.Header.Set("Authorization", "LSAT foo:bar")
+		}
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	send("/", false)
+	send("/", true)
+	send("/", true)
+	send("/missing", true)
+
+	require.EqualValues(t, 1, requestCount(t, "measured", "402"))
+	require.EqualValues(t, 2, requestCount(t, "measured", "200"))
+	require.EqualValues(t, 1, requestCount(t, "measured", "404"))
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// errRequestTooLarge is returned when reading the body of a request that
+// exceeds the size budget of its service.
+var errRequestTooLarge = errors.New("request too large")
+
+// requestHeaderSize returns the number of bytes the request line and header
+// fields of the given request take up on the wire in HTTP/1.1 format.
+func requestHeaderSize(r *http.Request) int64 {
+	// The request line is of the form "METHOD URI PROTO\r\n".
+	size := int64(len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4)
+
+	// The Host header is removed from the header map and stored in the
+	// request itself.
+	if r.Host != "" {
+		size += int64(len("Host: \r\n") + len(r.Host))
+	}
+
+	// Every header field is of the form "Name: value\r\n".
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += int64(len(name) + len(value) + 4)
+		}
+	}
+
+	return size
+}
+
+// limitedBody is a request body that fails with errRequestTooLarge once more
+// than a certain number of bytes are read from it.
+type limitedBody struct {
+	// LimitedReader allows reading one byte more than the limit so we can
+	// tell if the limit was exceeded.
+	io.LimitedReader
+
+	body io.ReadCloser
+
+	// exceeded is set to 1 once the limit was exceeded. The body is read
+	// by the transport of the reverse proxy, so it's accessed atomically.
+	exceeded int32
+}
+
+// newLimitedBody wraps the given body so no more than limit bytes can be read
+// from it.
+func newLimitedBody(body io.ReadCloser, limit int64) *limitedBody {
+	return &limitedBody{
+		LimitedReader: io.LimitedReader{R: body, N: limit + 1},
+		body:          body,
+	}
+}
+
+// Read reads from the body until the limit is exceeded.
+//
+// NOTE: This is part of the io.Reader interface.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.LimitedReader.Read(p)
+	if b.N > 0 {
+		return n, err
+	}
+
+	// The extra byte we allowed to be read is dropped. It's only part of
+	// the read that exceeded the limit, all later reads return nothing.
+	atomic.StoreInt32(&b.exceeded, 1)
+	if n > 0 {
+		n--
+	}
+	return n, errRequestTooLarge
+}
+
+// Close closes the underlying body.
+//
+// NOTE: This is part of the io.Closer interface.
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// isExceeded returns true if more bytes than allowed were read from the body.
+func (b *limitedBody) isExceeded() bool {
+	return atomic.LoadInt32(&b.exceeded) == 1
+}
+
+// limitRequestSize makes sure the combined size of the headers and body of the
+// request don't exceed the given limit. Requests whose headers or declared
+// content length already exceed it are rejected right away, the body of all
+// others is wrapped so reading it fails once the limit is exceeded. False is
+// returned if the request was rejected.
+func limitRequestSize(w http.ResponseWriter, r *http.Request,
+	limit int64) bool {
+
+	remaining := limit - requestHeaderSize(r)
+	if remaining < 0 {
+		addCorsHeaders(w.Header())
+		sendDirectResponse(
+			w, r, http.StatusRequestEntityTooLarge,
+			errRequestTooLarge.Error(),
+		)
+		return false
+	}
+
+	return limitBodySize(w, r, remaining)
+}
+
+// limitBodySize makes sure the body of the request doesn't exceed the given
+// limit. Requests declaring a larger content length are rejected right away.
+// As the length of chunked or otherwise streamed bodies isn't known upfront,
+// they are wrapped so reading them fails once the limit is exceeded, which
+// aborts the request to the backend. False is returned if the request was
+// rejected.
+func limitBodySize(w http.ResponseWriter, r *http.Request,
+	limit int64) bool {
+
+	if r.ContentLength > limit {
+		addCorsHeaders(w.Header())
+		sendDirectResponse(
+			w, r, http.StatusRequestEntityTooLarge,
+			errRequestTooLarge.Error(),
+		)
+		return false
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = newLimitedBody(r.Body, limit)
+	}
+
+	return true
+}
+
+// requestTooLarge returns true if the body of the given request exceeded one
+// of the size budgets of its service while it was read.
+func requestTooLarge(r *http.Request) bool {
+	body, ok := r.Body.(*limitedBody)
+	for ok {
+		if body.isExceeded() {
+			return true
+		}
+		body, ok = body.body.(*limitedBody)
+	}
+
+	return false
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMaxRequestSize makes sure requests whose headers and body exceed the
+// size budget of their service are rejected, no matter whether they declare
+// their size upfront or not.
+func TestMaxRequestSize(t *testing.T) {
+	var backendRequests int
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			backendRequests++
+			_, _ = io.Copy(ioutil.Discard, r.Body)
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:           "limited",
+		Address:        strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:       "http",
+		HostRegexp:     ".*",
+		Auth:           "off",
+		MaxRequestSize: 1000,
+	}})
+	require.NoError(t, err)
+
+	send := func(req *http.Request) int {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// A request within the budget is proxied.
+	req := httptest.NewRequest(
+		http.MethodPost, "/", bytes.NewReader(make([]byte, 100)),
+	)
+	require.Equal(t, http.StatusOK, send(req))
+	require.Equal(t, 1, backendRequests)
+
+	// A body that fits on its own doesn't fit together with large
+	// headers.
+	req = httptest.NewRequest(
+		http.MethodPost, "/", bytes.NewReader(make([]byte, 100)),
+	)
+	req.Header.Set("X-Large", strings.Repeat("a", 900))
+	require.Equal(t, http.StatusRequestEntityTooLarge, send(req))
+
+	// A declared content length that is too large is rejected before the
+	// backend is involved.
+	req = httptest.NewRequest(
+		http.MethodPost, "/", bytes.NewReader(make([]byte, 1000)),
+	)
+	require.Equal(t, http.StatusRequestEntityTooLarge, send(req))
+	require.Equal(t, 1, backendRequests)
+
+	// A body of unknown length is cut off once it exceeds the budget.
+	req = httptest.NewRequest(
+		http.MethodPost, "/", io.MultiReader(
+			bytes.NewReader(make([]byte, 1000)),
+		),
+	)
+	req.ContentLength = -1
+	require.Equal(t, http.StatusRequestEntityTooLarge, send(req))
+}
+
+// TestLimitedBody makes sure a limited body returns exactly the bytes up to its
+// limit and never a negative count, no matter how often it is read after the
+// limit was exceeded.
+func TestLimitedBody(t *testing.T) {
+	t.Parallel()
+
+	body := newLimitedBody(ioutil.NopCloser(
+		bytes.NewReader(make([]byte, 10)),
+	), 4)
+
+	buf := make([]byte, 3)
+	n, err := body.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.False(t, body.isExceeded())
+
+	n, err = body.Read(buf)
+	require.ErrorIs(t, err, errRequestTooLarge)
+	require.Equal(t, 1, n)
+	require.True(t, body.isExceeded())
+
+	for i := 0; i < 2; i++ {
+		n, err = body.Read(buf)
+		require.ErrorIs(t, err, errRequestTooLarge)
+		require.Equal(t, 0, n)
+	}
+
+	// A body that ends exactly at the limit isn't exceeded.
+	body = newLimitedBody(ioutil.NopCloser(
+		bytes.NewReader(make([]byte, 4)),
+	), 4)
+	data, err := ioutil.ReadAll(body)
+	require.NoError(t, err)
+	require.Len(t, data, 4)
+	require.False(t, body.isExceeded())
+}
+
+// TestMaxBodyBytes makes sure request bodies exceeding the limit of their
+// service are rejected before they are forwarded if their size is declared,
+// and cut off while they are streamed to the backend otherwise.
+func TestMaxBodyBytes(t *testing.T) {
+	var (
+		mtx            sync.Mutex
+		completeBodies []int
+	)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return
+			}
+
+			mtx.Lock()
+			completeBodies = append(completeBodies, len(body))
+			mtx.Unlock()
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:         "limited",
+		Address:      strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:     "http",
+		HostRegexp:   ".*",
+		Auth:         "off",
+		MaxBodyBytes: 1000,
+	}})
+	require.NoError(t, err)
+
+	// The proxy is served over a real connection so chunked bodies are
+	// sent as such.
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	send := func(body io.Reader, contentLength int64) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL, body)
+		require.NoError(t, err)
+		req.ContentLength = contentLength
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		return resp.StatusCode
+	}
+	backendBodies := func() []int {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		return append([]int(nil), completeBodies...)
+	}
+
+	// Bodies up to the limit are forwarded, the headers don't count.
+	require.Equal(
+		t, http.StatusOK,
+		send(bytes.NewReader(make([]byte, 1000)), 1000),
+	)
+
+	// A declared content length above the limit is rejected before the
+	// backend is involved.
+	require.Equal(
+		t, http.StatusRequestEntityTooLarge,
+		send(bytes.NewReader(make([]byte, 1001)), 1001),
+	)
+	require.Equal(t, []int{1000}, backendBodies())
+
+	// Chunked bodies within the limit are forwarded.
+	chunked := io.MultiReader(
+		bytes.NewReader(make([]byte, 600)),
+		bytes.NewReader(make([]byte, 400)),
+	)
+	require.Equal(t, http.StatusOK, send(chunked, -1))
+	require.Equal(t, []int{1000, 1000}, backendBodies())
+
+	// A streamed upload is cut off once it exceeds the limit, so the
+	// backend never receives the complete body.
+	reader, writer := io.Pipe()
+	go func() {
+		for i := 0; i < 10; i++ {
+			_, err := writer.Write(make([]byte, 200))
+			if err != nil {
+				return
+			}
+		}
+		_ = writer.Close()
+	}()
+	require.Equal(t, http.StatusRequestEntityTooLarge, send(reader, -1))
+	require.Equal(t, []int{1000, 1000}, backendBodies())
+
+	_, err = New(auth.NewMockAuthenticator(), []*Service{{
+		Name:         "invalid",
+		HostRegexp:   ".*",
+		MaxBodyBytes: -1,
+	}})
+	require.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	hdrSetCookie = "Set-Cookie"
+)
+
+// responseHeadersTooLarge returns true if the given error was returned by the
+// transport because the backend sent more response header bytes than allowed.
+// The HTTP packages don't export an error value for this, so the messages of
+// both the HTTP/1.1 and the HTTP/2 transport are matched.
+func responseHeadersTooLarge(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "server response headers exceeded") ||
+		strings.Contains(msg, "response header list larger than")
+}
+
+// SetMaxResponseHeaderBytes limits the number of bytes of the response headers
+// the proxy reads from the backends. Requests to backends that exceed the limit
+// are answered with 502 Bad Gateway. The default limit of the HTTP package is
+// used if the given number is zero.
+func (p *Proxy) SetMaxResponseHeaderBytes(maxBytes int64) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.maxResponseHeaderBytes = maxBytes
+	return p.createBackend(p.services)
+}
+
+// stripResponseCookies removes all cookies the backend wants the client to set
+// from the given response header, so a backend can't set cookies for other
+// services or domains.
+func stripResponseCookies(header http.Header) {
+	header.Del(hdrSetCookie)
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMaxResponseHeaderBytes makes sure responses of backends whose headers
+// exceed the configured limit are answered with 502 Bad Gateway.
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+			w.Header().Set("X-Large", strings.Repeat("a", size))
+		},
+	))
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "service",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "off",
+	}})
+	require.NoError(t, err)
+	require.NoError(t, p.SetMaxResponseHeaderBytes(2000))
+
+	send := func(target string) int {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, send("/?size=1000"))
+	require.Equal(t, http.StatusBadGateway, send("/?size=3000"))
+}
+
+// TestStripResponseCookies makes sure the cookies a backend sets are only
+// removed for services that strip them.
+func TestStripResponseCookies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add(hdrSetCookie, "a=b; Domain=example.com")
+			w.Header().Add(hdrSetCookie, "c=d")
+			w.Header().Set("X-Other", "kept")
+		},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:                 "stripped",
+		Address:              address,
+		Protocol:             "http",
+		HostRegexp:           "^stripped$",
+		Auth:                 "off",
+		StripResponseCookies: true,
+	}, {
+		Name:       "unstripped",
+		Address:    address,
+		Protocol:   "http",
+		HostRegexp: "^unstripped$",
+		Auth:       "off",
+	}})
+	require.NoError(t, err)
+
+	send := func(host string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header()
+	}
+
+	header := send("stripped")
+	require.Empty(t, header.Values(hdrSetCookie))
+	require.Equal(t, "kept", header.Get("X-Other"))
+
+	header = send("unstripped")
+	require.Len(t, header.Values(hdrSetCookie), 2)
+}
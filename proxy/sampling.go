@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// maxSampledBodySize is the maximum number of bytes of the request and
+	// response bodies that are logged for a sampled request.
+	maxSampledBodySize = 1024
+
+	// redactedHeaderValue replaces the values of header fields that carry
+	// credentials in the log of sampled requests.
+	redactedHeaderValue = "[REDACTED]"
+)
+
+var (
+	// keySampled is the key under which the decision whether a request is
+	// sampled is stored in the request context.
+	keySampled = lsat.ContextKey{Name: "sampled"}
+
+	// sensitiveHeaders are the header fields whose values are never
+	// logged for sampled requests.
+	sensitiveHeaders = []string{
+		lsat.HeaderAuthorization, lsat.HeaderMacaroonMD,
+		lsat.HeaderMacaroon, "Cookie", "Set-Cookie",
+	}
+)
+
+// IsSampled returns true if the request with the given context was selected
+// to have its full details logged.
+func IsSampled(ctx context.Context) bool {
+	sampled, _ := lsat.FromContext(ctx, keySampled).(bool)
+	return sampled
+}
+
+// sampledMessage holds the details of a sampled request or response.
+type sampledMessage struct {
+	Method        string      `json:"method,omitempty"`
+	URI           string      `json:"uri,omitempty"`
+	Proto         string      `json:"proto,omitempty"`
+	Host          string      `json:"host,omitempty"`
+	StatusCode    int         `json:"status_code,omitempty"`
+	Header        http.Header `json:"header"`
+	Body          string      `json:"body"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+}
+
+// sampledRequest is the log entry of a sampled request.
+type sampledRequest struct {
+	Time       time.Time      `json:"time"`
+	Duration   string         `json:"duration"`
+	RemoteAddr string         `json:"remote_addr"`
+	Request    sampledMessage `json:"request"`
+	Response   sampledMessage `json:"response"`
+}
+
+// snippet records the beginning of a body. It is safe for concurrent use as
+// request bodies are read by the transport of the reverse proxy.
+type snippet struct {
+	mtx       sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+// record appends as much of the given data as still fits into the snippet.
+func (s *snippet) record(p []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	remaining := maxSampledBodySize - s.buf.Len()
+	if len(p) > remaining {
+		p = p[:remaining]
+		s.truncated = true
+	}
+	s.buf.Write(p)
+}
+
+// get returns the recorded snippet and whether the body was longer.
+func (s *snippet) get() (string, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.buf.String(), s.truncated
+}
+
+// sampledBody is a request body that records the beginning of what is read
+// from it.
+type sampledBody struct {
+	io.ReadCloser
+
+	snippet *snippet
+}
+
+// Read reads from the body and records the data.
+//
+// NOTE: This is part of the io.Reader interface.
+func (b *sampledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.snippet.record(p[:n])
+
+	return n, err
+}
+
+// sampledResponseWriter is a response writer that records the status code and
+// the beginning of the body of the response.
+type sampledResponseWriter struct {
+	http.ResponseWriter
+
+	status  int
+	snippet snippet
+}
+
+// WriteHeader records the status code and writes the header.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (w *sampledResponseWriter) WriteHeader(statusCode int) {
+	// Informational responses like 100 Continue precede the final one.
+	if w.status == 0 && statusCode >= http.StatusOK {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records the data and writes it to the body.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (w *sampledResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.snippet.record(b)
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client.
+//
+// NOTE: This is part of the http.Flusher interface.
+func (w *sampledResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, which is needed to proxy
+// protocol upgrades.
+//
+// NOTE: This is part of the http.Hijacker interface.
+func (w *sampledResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter,
+	error) {
+
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return conn, rw, err
+}
+
+// requestSampler logs the full details of a random fraction of the requests.
+type requestSampler struct {
+	rate float64
+
+	// random returns a random number in [0, 1). It can be replaced in
+	// tests.
+	random func() float64
+
+	mtx sync.Mutex
+	log io.Writer
+}
+
+// newRequestSampler creates a new sampler that writes the details of the given
+// fraction of requests to the log.
+func newRequestSampler(rate float64, log io.Writer) *requestSampler {
+	return &requestSampler{
+		rate:   rate,
+		random: rand.Float64,
+		log:    log,
+	}
+}
+
+// start decides whether the given request is sampled and stores the decision
+// in its context. The returned response writer and request must be used to
+// handle the request, and the returned function must be called once it was
+// handled to log the details of a sampled request.
+func (s *requestSampler) start(w http.ResponseWriter,
+	r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+
+	sampled := s.random() < s.rate
+	r = r.WithContext(lsat.AddToContext(r.Context(), keySampled, sampled))
+	if !sampled {
+		return w, r, func() {}
+	}
+
+	entry := &sampledRequest{
+		Time:       time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		Request: sampledMessage{
+			Method: r.Method,
+			URI:    r.RequestURI,
+			Proto:  r.Proto,
+			Host:   r.Host,
+			Header: redactHeader(r.Header),
+		},
+	}
+
+	body := &snippet{}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &sampledBody{ReadCloser: r.Body, snippet: body}
+	}
+	recorder := &sampledResponseWriter{ResponseWriter: w}
+
+	return recorder, r, func() {
+		entry.Duration = time.Since(entry.Time).String()
+		entry.Request.Body, entry.Request.BodyTruncated = body.get()
+		entry.Response.StatusCode = recorder.status
+		entry.Response.Header = redactHeader(recorder.Header())
+		entry.Response.Body, entry.Response.BodyTruncated =
+			recorder.snippet.get()
+
+		s.write(entry)
+	}
+}
+
+// write appends the given entry to the log as a line of JSON.
+func (s *requestSampler) write(entry *sampledRequest) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Unable to encode sampled request: %v", err)
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, err := s.log.Write(append(line, '\n')); err != nil {
+		log.Errorf("Unable to log sampled request: %v", err)
+	}
+}
+
+// redactHeader returns a copy of the given header with the values of all
+// fields that carry credentials redacted.
+func redactHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range sensitiveHeaders {
+		if _, ok := redacted[http.CanonicalHeaderKey(name)]; ok {
+			redacted.Set(name, redactedHeaderValue)
+		}
+	}
+
+	return redacted
+}
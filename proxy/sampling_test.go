@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRequestSampling makes sure the details of sampled requests are logged
+// with their credentials redacted and that the sampling decision is available
+// to all handlers.
+func TestRequestSampling(t *testing.T) {
+	t.Parallel()
+
+	var samples bytes.Buffer
+	sampler := newRequestSampler(0.5, &samples)
+
+	var sampled bool
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		sampled = IsSampled(r.Context())
+
+		_, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("X-Backend", "test")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(bytes.Repeat([]byte("a"), maxSampledBodySize+1))
+	}
+	serve := func(random float64) {
+		sampler.random = func() float64 { return random }
+
+		req := httptest.NewRequest(
+			"POST", "/v1/upload?x=1", strings.NewReader("hello"),
+		)
+		req.Header.Set("Authorization", "LSAT mac:preimage")
+		req.Header.Set("X-Client", "test")
+
+		w, req, logSample := sampler.start(httptest.NewRecorder(), req)
+		handler(w, req)
+		logSample()
+	}
+
+	// Requests that aren't sampled aren't logged.
+	serve(0.5)
+	require.False(t, sampled)
+	require.Zero(t, samples.Len())
+
+	serve(0.4)
+	require.True(t, sampled)
+
+	var entry sampledRequest
+	require.NoError(t, json.Unmarshal(samples.Bytes(), &entry))
+	require.Equal(t, "POST", entry.Request.Method)
+	require.Equal(t, "/v1/upload?x=1", entry.Request.URI)
+	require.Equal(t, "hello", entry.Request.Body)
+	require.False(t, entry.Request.BodyTruncated)
+	require.Equal(t, "test", entry.Request.Header.Get("X-Client"))
+	require.Equal(
+		t, redactedHeaderValue,
+		entry.Request.Header.Get("Authorization"),
+	)
+
+	require.Equal(t, http.StatusCreated, entry.Response.StatusCode)
+	require.Equal(t, "test", entry.Response.Header.Get("X-Backend"))
+	require.Equal(
+		t, redactedHeaderValue, entry.Response.Header.Get("Set-Cookie"),
+	)
+	require.Len(t, entry.Response.Body, maxSampledBodySize)
+	require.True(t, entry.Response.BodyTruncated)
+}
+
+// TestRequestSamplingInformational makes sure informational responses sent
+// before the final one aren't logged as the status code of a sampled request.
+func TestRequestSamplingInformational(t *testing.T) {
+	t.Parallel()
+
+	var samples bytes.Buffer
+	sampler := newRequestSampler(1, &samples)
+
+	req := httptest.NewRequest("POST", "/v1/upload", nil)
+	w, _, logSample := sampler.start(httptest.NewRecorder(), req)
+	w.WriteHeader(http.StatusContinue)
+	w.WriteHeader(http.StatusAccepted)
+	logSample()
+
+	var entry sampledRequest
+	require.NoError(t, json.Unmarshal(samples.Bytes(), &entry))
+	require.Equal(t, http.StatusAccepted, entry.Response.StatusCode)
+}
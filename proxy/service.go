@@ -1,13 +1,16 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/lightninglabs/aperture/auth"
@@ -29,6 +32,18 @@ const (
 	// maxServicePrice is the maximum price in satoshis that can be used
 	// to create an invoice through lnd.
 	maxServicePrice = btcutil.SatoshiPerBitcoin * 100000
+
+	// AuthModeLSAT authenticates the requests to a service with LSATs
+	// that are paid for. It is the default.
+	AuthModeLSAT = "lsat"
+
+	// AuthModeJWT authenticates the requests to a service with JSON Web
+	// Tokens issued by an external identity provider.
+	AuthModeJWT = "jwt"
+
+	// AuthModeNone doesn't authenticate the requests to a service at
+	// all.
+	AuthModeNone = "none"
 )
 
 // Service generically specifies configuration data for backend services to the
@@ -40,7 +55,35 @@ type Service struct {
 	// TLSCertPath is the optional path to the service's TLS certificate.
 	TLSCertPath string `long:"tlscertpath" description:"Path to the service's TLS certificate"`
 
-	// Address is the service's IP address and port.
+	// BackendTLSRenegotiation controls whether the backend may renegotiate
+	// TLS, which some legacy backends require. It can be never, once or
+	// freely and defaults to never. Backends that may renegotiate are
+	// connected to with HTTP/1.1 and at most TLS 1.2.
+	BackendTLSRenegotiation string `long:"backendtlsrenegotiation" description:"Whether the backend may renegotiate TLS: never (default), once or freely"`
+
+	// Backend configures mutual TLS with the backend, presenting a client
+	// certificate and only trusting certificates issued by specific CAs,
+	// and how the endpoints of the backend are discovered.
+	Backend BackendConfig `long:"backend" description:"Configuration of the client certificate and root CAs used for TLS connections to the backend and the discovery of its endpoints"`
+
+	// BackendDialTimeout is the maximum time the TCP handshake with the
+	// backend may take. It defaults to DefaultBackendDialTimeout.
+	BackendDialTimeout time.Duration `long:"backenddialtimeout" description:"The maximum time the TCP handshake with the backend may take. Defaults to 5 seconds."`
+
+	// BackendResponseHeaderTimeout is the maximum time to wait for the
+	// response header of the backend after the request was sent. There
+	// is no limit if it is zero.
+	BackendResponseHeaderTimeout time.Duration `long:"backendresponseheadertimeout" description:"The maximum time to wait for the backend's response header after the request was sent; set to 0 to disable"`
+
+	// BackendTimeout is the maximum time a request to the backend may
+	// take, from dialing until the whole response was sent to the
+	// client. Requests taking longer are answered with 504 Gateway
+	// Timeout if no response was sent yet. There is no limit if it is
+	// zero.
+	BackendTimeout time.Duration `long:"backendtimeout" description:"The maximum time a whole request to the backend may take, including streaming the response; set to 0 to disable"`
+
+	// Address is the service's IP address and port. IPv6 addresses with a
+	// port must be enclosed in brackets, e.g. [::1]:8080.
 	Address string `long:"address" description:"service instance rpc address"`
 
 	// Protocol is the protocol that should be used to connect to the
@@ -53,6 +96,12 @@ type Service struct {
 	// or "off" for no authentication.
 	Auth auth.Level `long:"auth" description:"required authentication"`
 
+	// AuthMode is how the requests to the service are authenticated:
+	// "lsat" with paid LSATs, "jwt" with JSON Web Tokens or "none" to not
+	// authenticate them at all. It defaults to "lsat". In "jwt" mode, Auth
+	// only decides whether requests are authenticated, not freebies.
+	AuthMode string `long:"authmode" description:"How requests are authenticated: lsat (default) with paid LSATs, jwt with JSON Web Tokens or none"`
+
 	// HostRegexp is a regular expression that is tested against the 'Host'
 	// HTTP header field to find out if this service should be used.
 	HostRegexp string `long:"hostregexp" description:"Regular expression to match the host against"`
@@ -72,6 +121,31 @@ type Service struct {
 	// the file is sent encoded as base64.
 	Headers map[string]string `long:"headers" description:"Header fields to always pass to the service"`
 
+	// ForwardClientHeaders is the list of header fields of client requests
+	// that are forwarded to the backend exactly as the client sent them.
+	// They take precedence over the configured header fields of the same
+	// name. The host the client requested is only forwarded if Host is
+	// included, otherwise the address of the backend is sent. Defaults to
+	// Accept, Accept-Charset, Accept-Encoding and Accept-Language.
+	ForwardClientHeaders []string `long:"forwardclientheaders" description:"Header fields of client requests forwarded to the backend as sent, taking precedence over the configured headers. Include Host to forward the host the client requested. Defaults to Accept, Accept-Charset, Accept-Encoding and Accept-Language."`
+
+	// RequestHeaders are the header fields that are set on the requests
+	// to the backend once they are authorized, replacing the ones sent by
+	// the client. The variables $REMOTE_ADDR and $TOKEN_ID in their values
+	// are replaced with the IP address of the client and the ID of the
+	// LSAT the request carries.
+	RequestHeaders map[string]string `long:"requestheaders" description:"Header fields set on authorized requests to the backend, replacing the client's. $REMOTE_ADDR and $TOKEN_ID in their values are replaced with the client's IP address and the ID of the request's LSAT."`
+
+	// StripRequestHeaders are the header fields of client requests that
+	// are removed once the requests are authorized, so the backend never
+	// sees them.
+	StripRequestHeaders []string `long:"striprequestheaders" description:"Header fields of client requests removed once they are authorized, like Authorization"`
+
+	// ResponseHeaders are the header fields that are set on the responses
+	// of the backend, replacing the ones it sent. They support the same
+	// variables as RequestHeaders.
+	ResponseHeaders map[string]string `long:"responseheaders" description:"Header fields set on the responses of the backend, replacing the backend's. Supports the same variables as requestheaders."`
+
 	// Capabilities is the list of capabilities authorized for the service
 	// at the base tier.
 	Capabilities string `long:"capabilities" description:"A comma-separated list of the service capabilities authorized for the base tier"`
@@ -81,6 +155,32 @@ type Service struct {
 	// correspond to the caveat's condition.
 	Constraints map[string]string `long:"constraints" description:"The service constraints to enforce at the base tier"`
 
+	// Caveats is the list of custom claims, each in the form key=value,
+	// that are added as caveats to the LSATs issued for the service, like
+	// user_tier=gold or region=eu-west. LSATs that don't carry all of them
+	// with the same values aren't accepted for the service.
+	Caveats []string `long:"caveats" description:"Custom caveats in the form key=value added to the LSATs issued for the service. LSATs that don't carry all of them are rejected."`
+
+	// ValidAfterBlock is the block height from which on the LSATs issued
+	// for the service become valid. LSATs can be bought before, but they
+	// aren't accepted until the chain has reached that height.
+	ValidAfterBlock uint32 `long:"validafterblock" description:"Only accept LSATs for the service once the chain has reached this block height"`
+
+	// TokenExpiry is the time the LSATs issued for the service are valid
+	// for after they were minted. Once expired, clients need to pay for a
+	// new LSAT. LSATs don't expire if this is zero.
+	TokenExpiry time.Duration `long:"tokenexpiry" description:"The time LSATs issued for the service are valid for, after which clients need to pay again. Set to 0 for LSATs that don't expire."`
+
+	// RefreshQuota is the number of times an LSAT issued for the service
+	// can be refreshed to get a new expiry without paying again.
+	RefreshQuota uint32 `long:"refreshquota" description:"The number of times an LSAT for the service can be refreshed with a new expiry without paying again. Requires tokenexpiry to be set."`
+
+	// RequestBudget is the number of requests an LSAT issued for the
+	// service can be used for. Once they are used up, clients need to pay
+	// for a new LSAT. LSATs can be used for any number of requests if this
+	// is zero.
+	RequestBudget uint32 `long:"requestbudget" description:"The number of requests an LSAT for the service can be used for, after which clients need to pay again. Set to 0 for unlimited requests."`
+
 	// Price is the custom LSAT value in satoshis to be used for the
 	// service's endpoint.
 	Price int64 `long:"price" description:"Static LSAT value in satoshis to be used for this service"`
@@ -89,6 +189,16 @@ type Service struct {
 	// the pricer if a gPRC server is to be used for price data.
 	DynamicPrice pricer.Config `long:"dynamicprice" description:"Configuration for connecting to the gRPC server to use for the pricer backend"`
 
+	// DynamicFeePricing, if set, adds a buffer for the routing fees to the
+	// price of each invoice created for the service. If the client sends
+	// its node's public key in the Lsat-Buyer-Node header, the routing fee
+	// to that node is estimated and added to the price.
+	DynamicFeePricing bool `long:"dynamicfeepricing" description:"Add a buffer for Lightning routing fees to the price of the service"`
+
+	// FeeBufferPercent is the part of the base price, in percent, that is
+	// always added to the price if DynamicFeePricing is set.
+	FeeBufferPercent uint32 `long:"feebufferpercent" description:"Percentage of the base price to add as routing fee buffer if dynamicfeepricing is set"`
+
 	// AuthWhitelistPaths is an optional list of regular expressions that
 	// are matched against the path of the URL of a request. If the request
 	// URL matches any of those regular expressions, the call is treated as
@@ -97,8 +207,232 @@ type Service struct {
 	// /package_name.ServiceName/MethodName
 	AuthWhitelistPaths []string `long:"authwhitelistpaths" description:"List of regular expressions for paths that don't require authentication'"`
 
-	freebieDb freebie.DB
-	pricer    pricer.Pricer
+	// BypassAuth configures the clients whose requests skip
+	// authentication, like monitoring systems. Their requests are still
+	// subject to everything else configured for the service.
+	BypassAuth BypassAuthConfig `long:"bypassauth" description:"Configuration of the trusted clients whose requests skip authentication"`
+
+	// AllowCIDRs is an optional list of IP ranges in CIDR notation, or
+	// single IP addresses, the service accepts requests from. Requests
+	// from any other address are rejected with 403 Forbidden before they
+	// are authenticated. Requests from all addresses are accepted if the
+	// list is empty. The range 0.0.0.0/0 matches IPv6 addresses as well.
+	AllowCIDRs []string `long:"allowcidrs" description:"List of IP ranges in CIDR notation or single IP addresses the service accepts requests from; all addresses are accepted if empty"`
+
+	// DenyCIDRs is an optional list of IP ranges in CIDR notation, or
+	// single IP addresses, requests from which are rejected with 403
+	// Forbidden before they are authenticated, even if they are in one of
+	// the AllowCIDRs ranges.
+	DenyCIDRs []string `long:"denycidrs" description:"List of IP ranges in CIDR notation or single IP addresses requests from which are rejected, even if they are allowed by allowcidrs"`
+
+	// AllowedMethods is an optional list of HTTP methods the service
+	// accepts. Requests with any other method are rejected with 405 Method
+	// Not Allowed before they are authenticated. OPTIONS requests are
+	// always allowed for CORS preflight. All methods are allowed if the
+	// list is empty.
+	AllowedMethods []string `long:"allowedmethods" description:"List of HTTP methods that are forwarded to the service; all methods are allowed if empty"`
+
+	// AllowedPaths is an optional list of patterns of the request paths
+	// the service exposes. Requests to any other path are rejected with
+	// 403 Forbidden before they are authenticated. Patterns starting with
+	// ^ are regular expressions, all others are globs that also match the
+	// paths below the ones they match. All paths are allowed if the list
+	// is empty.
+	AllowedPaths []string `long:"allowedpaths" description:"List of globs or regular expressions (starting with ^) of the paths that are forwarded to the service; all paths are allowed if empty"`
+
+	// BlockedPaths is an optional list of patterns of request paths that
+	// are never forwarded to the backend, like administrative endpoints.
+	// Requests to them are rejected with 403 Forbidden before they are
+	// authenticated, even if they match AllowedPaths. The patterns use
+	// the same syntax as AllowedPaths.
+	BlockedPaths []string `long:"blockedpaths" description:"List of globs or regular expressions (starting with ^) of the paths that are never forwarded to the service"`
+
+	// EndpointContentTypes maps regular expressions of request paths to
+	// the content types requests to the matching paths may have. Requests
+	// with any other content type are rejected with 415 Unsupported Media
+	// Type before they are authenticated. A subtype can be left open, like
+	// in text/*. If several expressions match a path, a request has to
+	// satisfy all of them. GET, HEAD and OPTIONS requests aren't checked.
+	EndpointContentTypes map[string][]string `long:"endpointcontenttypes" description:"Map of path regular expressions to the content types requests to matching paths may have"`
+
+	// EnableCoalescing turns on request coalescing for the service.
+	// Identical GET requests that arrive within CoalescingWindow of each
+	// other are only sent to the backend once and its response is
+	// streamed to all of them. Only responses the backend marks as public
+	// or gives an s-maxage are shared, and only with requests that match
+	// on the fields listed in the response's Vary header.
+	EnableCoalescing bool `long:"enablecoalescing" description:"Send identical GET requests arriving within the coalescing window to the backend only once and share the response"`
+
+	// CoalescingWindow is the time after a backend request was sent
+	// during which identical requests are served its response. It
+	// defaults to one second.
+	CoalescingWindow time.Duration `long:"coalescingwindow" description:"The time after a backend request was sent during which identical requests are served its response"`
+
+	// EnableChecksumTrailers, if set, makes the proxy hash the body of
+	// every response of the service while streaming it to the client and
+	// send the hex encoded SHA-256 hash in the X-Content-SHA256 trailer.
+	// gRPC clients receive it as trailing metadata.
+	EnableChecksumTrailers bool `long:"enablechecksumtrailers" description:"Send the SHA-256 hash of each response body in the X-Content-SHA256 trailer"`
+
+	// MaxConcurrent is the maximum number of requests that are proxied to
+	// the backends of the service at the same time. Requests arriving
+	// while that many are in flight wait for one of them to complete. The
+	// number of requests isn't limited if this is zero.
+	MaxConcurrent int `long:"maxconcurrent" description:"The maximum number of requests proxied to the service's backends at the same time; set to 0 to disable the limit"`
+
+	// MaxQueueDepth is the number of requests that can wait for one of the
+	// MaxConcurrent in-flight requests to complete. Requests arriving
+	// while the queue is full are rejected with 503 Service Unavailable.
+	MaxQueueDepth int `long:"maxqueuedepth" description:"The maximum number of requests waiting for one of the maxconcurrent in-flight requests to complete; requests arriving while the queue is full receive a 503 error"`
+
+	// RateLimit is the number of requests per second that are proxied to
+	// the backends of the service, enforced with a token bucket. Requests
+	// exceeding it are rejected with 429 Too Many Requests, even if they
+	// are authenticated. The rate isn't limited if this is zero.
+	RateLimit int `long:"ratelimit" description:"The number of requests per second proxied to the service; requests exceeding it receive a 429 error. Set to 0 to disable the limit."`
+
+	// RateBurst is the number of requests that can be proxied at once
+	// before the rate limit kicks in. It defaults to RateLimit.
+	RateBurst int `long:"rateburst" description:"The number of requests that can be proxied in a burst before ratelimit applies. Defaults to ratelimit."`
+
+	// RateLimitDistributed, if set, enforces the rate limit across all
+	// aperture instances sharing the same etcd cluster instead of in each
+	// instance on its own. Requests are let through while etcd can't be
+	// reached.
+	RateLimitDistributed bool `long:"ratelimitdistributed" description:"Enforce ratelimit across all aperture instances sharing the etcd cluster instead of per instance. Requests are let through while etcd is unreachable."`
+
+	// SupportPreferAsync, if set, allows clients to ask for their requests
+	// to be processed asynchronously by sending the Prefer: respond-async
+	// header. Those requests are stored and answered with 202 Accepted
+	// right away. The backend response can be retrieved at the URL in the
+	// Location header once it is available.
+	SupportPreferAsync bool `long:"supportpreferasync" description:"Process requests with the Prefer: respond-async header in the background and answer them with 202 Accepted and the location of their response"`
+
+	// StaticResponse, if set, is returned to every request to the service
+	// without authenticating it or contacting any backend. This is useful
+	// for health checks, terms of service or testing LSAT clients.
+	StaticResponse *StaticResponse `long:"staticresponse" description:"A fixed response returned to every request without authentication or contacting a backend"`
+
+	// MaxRequestSize is the maximum combined size of the header fields and
+	// body of a request to the service in bytes. Larger requests are
+	// rejected with 413 Request Entity Too Large. The size isn't limited if
+	// this is zero.
+	MaxRequestSize int64 `long:"maxrequestsize" description:"The maximum combined size of a request's headers and body in bytes; set to 0 to disable"`
+
+	// MaxBodyBytes is the maximum size of the body of a request to the
+	// service in bytes. Requests declaring a larger body are rejected with
+	// 413 Request Entity Too Large before they are forwarded, streamed
+	// bodies of unknown length are cut off once they exceed it. The size
+	// isn't limited if this is zero.
+	MaxBodyBytes int64 `long:"maxbodybytes" description:"The maximum size of a request's body in bytes; set to 0 to disable"`
+
+	// StripResponseCookies, if set, removes all Set-Cookie header fields
+	// from the responses of the backend, so it can't set cookies for
+	// other services or domains.
+	StripResponseCookies bool `long:"stripresponsecookies" description:"Remove all Set-Cookie header fields from the responses of the backend"`
+
+	// ProgressInterval is the number of bytes of a request body after
+	// which HTTP/1.1 clients are sent another 100 Continue informational
+	// response with the number of bytes received so far in the
+	// X-Upload-Progress header, up to four times per request. Request bodies
+	// are always streamed to the backend. No progress is reported if this is
+	// zero.
+	ProgressInterval int64 `long:"progressinterval" description:"Report the upload progress of request bodies to HTTP/1.1 clients in an informational response every time this many bytes were received; set to 0 to disable"`
+
+	// SLOErrorRateThreshold is the share of failed requests within the
+	// last minute above which the backend is considered degraded and the
+	// SLOFallbackResponse is served instead of proxying to it. SLO mode is
+	// disabled if this is zero.
+	SLOErrorRateThreshold float64 `long:"sloerrorratethreshold" description:"Serve the SLO fallback response once the share of failed backend requests within the last minute exceeds this value between 0 and 1; set to 0 to disable"`
+
+	// SLORecoveryThreshold is the error rate the degraded backend must
+	// stay below for SLORecoveryDuration before requests are forwarded to
+	// it again. It defaults to SLOErrorRateThreshold.
+	SLORecoveryThreshold float64 `long:"slorecoverythreshold" description:"Forward requests to a degraded backend again once its error rate stays below this value for the SLO recovery duration"`
+
+	// SLORecoveryDuration is the time the error rate of the degraded
+	// backend must stay below SLORecoveryThreshold.
+	SLORecoveryDuration time.Duration `long:"slorecoveryduration" description:"The time the error rate of a degraded backend must stay below the SLO recovery threshold"`
+
+	// SLOFallbackResponse is the static response body served while the
+	// backend is degraded.
+	SLOFallbackResponse string `long:"slofallbackresponse" description:"The static response served while the backend is degraded"`
+
+	// CanaryAddress is the address of a new version of the service's
+	// backend that receives CanaryWeight of the requests for evaluation.
+	// The canary is either promoted to be the primary backend or removed
+	// depending on how its error rate compares to the primary's.
+	CanaryAddress string `long:"canaryaddress" description:"Address of a canary backend that receives a fraction of the requests for evaluation"`
+
+	// CanaryWeight is the fraction of requests, between 0 and 1, that are
+	// proxied to the canary backend.
+	CanaryWeight float64 `long:"canaryweight" description:"Fraction of requests between 0 and 1 that are proxied to the canary backend"`
+
+	// CanaryErrorRateThreshold is the amount by which the error rate of
+	// the canary may exceed the error rate of the primary backend.
+	CanaryErrorRateThreshold float64 `long:"canaryerrorratethreshold" description:"The amount by which the canary's error rate may exceed the primary's before it is removed"`
+
+	// CanaryAnalysisDuration is the time the canary is evaluated for. If
+	// its error rate exceeds the threshold for that long, it is removed.
+	// Otherwise it is promoted once the duration has passed.
+	CanaryAnalysisDuration time.Duration `long:"canaryanalysisduration" description:"The time the canary is evaluated for before it is promoted"`
+
+	// ChaosMode configures faults that are randomly injected into the
+	// requests proxied to the service for resilience testing.
+	ChaosMode ChaosConfig `long:"chaosmode" description:"Configuration for randomly injecting faults into requests to the service"`
+
+	// LatencyInjection, if set, adds a delay to every response of the
+	// service to test client timeout handling. It is ignored unless
+	// aperture runs in debug mode.
+	LatencyInjection *LatencyInjection `long:"latencyinjection" description:"Add a delay to every response of the service, only applied in debug mode"`
+
+	// CircuitBreaker, if set, stops forwarding requests to the backend
+	// while it keeps failing and rejects them with 503 Service
+	// Unavailable instead.
+	CircuitBreaker *CircuitBreaker `long:"circuitbreaker" description:"Reject requests with 503 while the backend keeps failing"`
+
+	// PaymentPageTemplate is the path of an HTML template that is
+	// rendered as the body of the 402 Payment Required responses of the
+	// service. It is executed with a PaymentPageData value.
+	PaymentPageTemplate string `long:"paymentpagetemplate" description:"Path of an HTML template rendered as the body of 402 responses, with the variables {{.Invoice}}, {{.PaymentHash}}, {{.AmountSat}}, {{.ServiceName}} and {{.Memo}}"`
+
+	// PaymentJSONTemplate is the path of a JSON template that is rendered
+	// as the body of the 402 Payment Required responses to clients
+	// accepting JSON. It is executed with a PaymentPageData value.
+	PaymentJSONTemplate string `long:"paymentjsontemplate" description:"Path of a JSON template rendered as the body of 402 responses to clients accepting application/json, with the same variables as paymentpagetemplate"`
+
+	freebieDb    freebie.DB
+	pricer       pricer.Pricer
+	ipFilter     *ipFilter
+	methodFilter *methodFilter
+	pathFilter   *pathFilter
+	paymentPage  *paymentPage
+	contentTypes *contentTypeFilter
+	coalescer    *coalescer
+	concurrency  *concurrencyLimiter
+	rateLimiter  *rateLimiter
+	slo          *sloTracker
+	chaos        *chaosMiddleware
+	latency      *latencyInjector
+	breaker      *circuitBreaker
+
+	// trustedIPs are the IP ranges requests from which skip
+	// authentication.
+	trustedIPs []*net.IPNet
+
+	// forwardHeaders is the set of canonical names of the header fields
+	// of client requests that are forwarded as sent.
+	forwardHeaders map[string]struct{}
+
+	tlsRenegotiation tls.RenegotiationSupport
+
+	// backendTLS is the loaded client certificate and CAs of the TLS
+	// connections to the backend, if configured.
+	backendTLS *backendTLS
+
+	// srv is the list of endpoints of the backend discovered through an
+	// SRV record, if configured.
+	srv *srvEndpoints
 }
 
 // ResourceName returns the string to be used to identify which resource a
@@ -126,105 +460,246 @@ func (s *Service) AuthRequired(r *http.Request) auth.Level {
 		}
 	}
 
+	if s.AuthMode == AuthModeNone {
+		return auth.LevelOff
+	}
+
 	// By default we always return the service level auth setting.
 	return s.Auth
 }
 
-// prepareServices prepares the backend service configurations to be used by the
-// proxy.
-func prepareServices(services []*Service) error {
+// prepareServices validates the backend service configurations and prepares
+// them to be used by the proxy. The services in use are left untouched, as
+// requests might be served with them concurrently.
+//
+// NOTE: The caller must hold the write lock of the proxy's mtx, so the same
+// service isn't prepared concurrently.
+func prepareServices(services, inUse []*Service) error {
+	if err := ValidateServices(services); err != nil {
+		return err
+	}
+
+	prepared := make(map[*Service]struct{}, len(inUse))
+	for _, service := range inUse {
+		prepared[service] = struct{}{}
+	}
+
 	for _, service := range services {
-		// Each freebie enabled service gets its own store.
-		if service.Auth.IsFreebie() {
-			service.freebieDb = freebie.NewMemIPMaskStore(
-				service.Auth.FreebieCount(),
-			)
+		if _, ok := prepared[service]; ok {
+			continue
 		}
 
-		// Replace placeholders/directives in the header fields with the
-		// actual desired values.
-		for key, value := range service.Headers {
-			if !strings.HasPrefix(value, filePrefix) {
-				continue
-			}
-
-			parts := strings.Split(value, ":")
-			if len(parts) != 2 {
-				return fmt.Errorf("invalid header config, " +
-					"must be '!file+hex:path'")
-			}
-			prefix, fileName := parts[0], parts[1]
-			bytes, err := ioutil.ReadFile(fileName)
-			if err != nil {
-				return err
-			}
-
-			// There are two supported formats to encode the file
-			// content in: hex and base64.
-			switch {
-			case prefix == filePrefixHex:
-				newValue := hex.EncodeToString(bytes)
-				service.Headers[key] = newValue
-
-			case prefix == filePrefixBase64:
-				newValue := base64.StdEncoding.EncodeToString(
-					bytes,
-				)
-				service.Headers[key] = newValue
-
-			default:
-				return fmt.Errorf("unsupported file prefix "+
-					"format %s", value)
-			}
+		if err := service.prepare(); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// prepare creates the helpers the proxy needs to serve the requests for the
+// service.
+func (s *Service) prepare() error {
+	// Each freebie enabled service gets its own store.
+	if s.Auth.IsFreebie() {
+		s.freebieDb = freebie.NewMemIPMaskStore(
+			s.Auth.FreebieCount(),
+		)
+	}
 
-		// Make sure all whitelist regular expression entries actually
-		// compile so we run into an eventual panic during startup and
-		// not only when the request happens.
-		for _, entry := range service.AuthWhitelistPaths {
-			_, err := regexp.Compile(entry)
-			if err != nil {
-				return fmt.Errorf("error validating auth "+
-					"whitelist: %v", err)
-			}
+	// Replace placeholders/directives in the header fields with the
+	// actual desired values. Their format was already validated.
+	for key, value := range s.Headers {
+		if !strings.HasPrefix(value, filePrefix) {
+			continue
+		}
+
+		parts := strings.Split(value, ":")
+		prefix, fileName := parts[0], parts[1]
+		bytes, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
 		}
 
-		// If dynamic prices are enabled then use the provided
-		// DynamicPrice options to initialise a gRPC backed
-		// pricer client.
-		if service.DynamicPrice.Enabled {
-			priceClient, err := pricer.NewGRPCPricer(
-				&service.DynamicPrice,
+		// There are two supported formats to encode the file
+		// content in: hex and base64.
+		switch {
+		case prefix == filePrefixHex:
+			newValue := hex.EncodeToString(bytes)
+			s.Headers[key] = newValue
+
+		case prefix == filePrefixBase64:
+			newValue := base64.StdEncoding.EncodeToString(
+				bytes,
 			)
-			if err != nil {
-				return fmt.Errorf("error initializing "+
-					"pricer: %v", err)
-			}
+			s.Headers[key] = newValue
+		}
+	}
 
-			service.pricer = priceClient
-			continue
+	// A bare IPv6 address needs to be enclosed in brackets to be
+	// used as the host of a URL.
+	s.Address = bracketIPv6(s.Address)
+	s.CanaryAddress = bracketIPv6(s.CanaryAddress)
+
+	if s.SLOErrorRateThreshold > 0 {
+		s.slo = newSLOTracker(s)
+	}
+
+	if len(s.AllowCIDRs) > 0 || len(s.DenyCIDRs) > 0 {
+		filter, err := newIPFilter(s.AllowCIDRs, s.DenyCIDRs)
+		if err != nil {
+			return err
 		}
+		s.ipFilter = filter
+	}
 
-		// Check that the price for the service is not negative and not
-		// more than the maximum amount allowed by lnd. If no price, or
-		// a price of zero satoshis, is set the then default price of 1
-		// satoshi is to be used.
-		switch {
-		case service.Price == 0:
-			log.Debugf("Using default LSAT price of %v satoshis for "+
-				"service %s.", defaultServicePrice, service.Name)
-			service.Price = defaultServicePrice
-		case service.Price < 0:
-			return fmt.Errorf("negative price set for "+
-				"service %s", service.Name)
-		case service.Price > maxServicePrice:
-			return fmt.Errorf("maximum price exceeded for "+
-				"service %s", service.Name)
+	if len(s.AllowedMethods) > 0 {
+		filter, err := newMethodFilter(s.AllowedMethods)
+		if err != nil {
+			return err
+		}
+		s.methodFilter = filter
+	}
+
+	if len(s.AllowedPaths) > 0 ||
+		len(s.BlockedPaths) > 0 {
+
+		filter, err := newPathFilter(
+			s.AllowedPaths, s.BlockedPaths,
+		)
+		if err != nil {
+			return err
+		}
+		s.pathFilter = filter
+	}
+
+	page, err := newPaymentPage(s)
+	if err != nil {
+		return err
+	}
+	s.paymentPage = page
+
+	if len(s.EndpointContentTypes) > 0 {
+		filter, err := newContentTypeFilter(
+			s.EndpointContentTypes,
+		)
+		if err != nil {
+			return err
+		}
+		s.contentTypes = filter
+	}
+
+	if s.EnableCoalescing {
+		s.coalescer = newCoalescer(
+			s.CoalescingWindow,
+		)
+	}
+
+	if s.RateLimit > 0 {
+		s.rateLimiter = newRateLimiter(
+			s.Name, s.RateLimit,
+			s.RateBurst,
+		)
+	}
+
+	if s.MaxConcurrent > 0 {
+		s.concurrency = newConcurrencyLimiter(
+			s.Name, s.MaxConcurrent,
+			s.MaxQueueDepth,
+		)
+	}
+
+	trustedIPs, err := s.BypassAuth.parseTrustedIPs()
+	if err != nil {
+		return err
+	}
+	s.trustedIPs = trustedIPs
+
+	forwardHeaders, err := parseForwardClientHeaders(
+		s.ForwardClientHeaders,
+	)
+	if err != nil {
+		return err
+	}
+	s.forwardHeaders = forwardHeaders
+
+	renegotiation, err := parseTLSRenegotiation(
+		s.BackendTLSRenegotiation,
+	)
+	if err != nil {
+		return err
+	}
+	s.tlsRenegotiation = renegotiation
+	if renegotiation != tls.RenegotiateNever {
+		log.Warnf("Allowing TLS renegotiation (%s) by the "+
+			"backend of service %s, this weakens the "+
+			"security of its connections",
+			s.BackendTLSRenegotiation, s.Name)
+	}
+
+	backendTLS, err := s.Backend.load()
+	if err != nil {
+		return err
+	}
+	s.backendTLS = backendTLS
+
+	if s.Backend.SRVName != "" {
+		s.srv = newSRVEndpoints(s)
+	}
+
+	if s.ChaosMode.Enabled {
+		log.Warnf("Chaos mode enabled for service %s, faults "+
+			"will be injected into its requests!",
+			s.Name)
+		s.chaos = newChaosMiddleware(s.ChaosMode)
+	}
+
+	if s.LatencyInjection != nil {
+		s.latency = newLatencyInjector(
+			*s.LatencyInjection,
+		)
+	}
+
+	if s.CircuitBreaker != nil {
+		s.breaker = newCircuitBreaker(s.Name, s.CircuitBreaker)
+	}
+
+	// If dynamic prices are enabled then use the provided
+	// DynamicPrice options to initialise a gRPC backed
+	// pricer client.
+	if s.DynamicPrice.Enabled {
+		priceClient, err := pricer.NewGRPCPricer(
+			&s.DynamicPrice,
+		)
+		if err != nil {
+			return fmt.Errorf("error initializing "+
+				"pricer: %v", err)
 		}
 
-		// Initialise a default pricer where all resources in a server
-		// are given the same price.
-		service.pricer = pricer.NewDefaultPricer(service.Price)
+		s.pricer = priceClient
+		return nil
+	}
+
+	// If no price, or a price of zero satoshis, is set the then
+	// default price of 1 satoshi is to be used.
+	if s.Price == 0 {
+		log.Debugf("Using default LSAT price of %v satoshis for "+
+			"service %s.", defaultServicePrice, s.Name)
+		s.Price = defaultServicePrice
 	}
+
+	// Initialise a default pricer where all resources in a server
+	// are given the same price.
+	s.pricer = pricer.NewDefaultPricer(s.Price)
 	return nil
 }
+
+// bracketIPv6 encloses the given address in brackets if it is a bare IPv6
+// address without a port. All other addresses are returned unchanged.
+func bracketIPv6(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.To4() != nil {
+		return address
+	}
+
+	return "[" + address + "]"
+}
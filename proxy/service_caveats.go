@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+)
+
+// reservedConditions are the conditions of the caveats aperture adds to LSATs
+// itself, which can't be used for the custom caveats of a service.
+var reservedConditions = map[string]struct{}{
+	lsat.PreimageKey:         {},
+	lsat.CondServices:        {},
+	lsat.CondAdmin:           {},
+	lsat.CondValidAfterBlock: {},
+	mint.CondExpiresAt:       {},
+	mint.CondBudget:          {},
+}
+
+// parseCaveat parses a custom caveat in the form key=value.
+func parseCaveat(caveat string) (lsat.Caveat, error) {
+	c, err := lsat.DecodeCaveat(caveat)
+	if err != nil {
+		return lsat.Caveat{}, errors.New("must be of the form " +
+			"key=value")
+	}
+
+	condition := strings.TrimSpace(c.Condition)
+	switch {
+	case condition == "":
+		return lsat.Caveat{}, errors.New("key cannot be empty")
+
+	case condition != c.Condition:
+		return lsat.Caveat{}, errors.New("key cannot start or end " +
+			"with whitespace")
+	}
+
+	_, reserved := reservedConditions[condition]
+	if reserved ||
+		strings.HasSuffix(condition, lsat.CondCapabilitiesSuffix) {
+
+		return lsat.Caveat{}, fmt.Errorf("key %s is reserved for "+
+			"caveats added by aperture", condition)
+	}
+
+	return c, nil
+}
+
+// RequiredCaveats returns the custom caveats that are added to the LSATs issued
+// for the service and that LSATs must carry to be accepted for it.
+func (s *Service) RequiredCaveats() ([]lsat.Caveat, error) {
+	caveats := make([]lsat.Caveat, 0, len(s.Caveats))
+	for _, caveat := range s.Caveats {
+		c, err := parseCaveat(caveat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid caveat %q: %v", caveat,
+				err)
+		}
+		caveats = append(caveats, c)
+	}
+
+	return caveats, nil
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBracketIPv6 makes sure bare IPv6 backend addresses are enclosed in
+// brackets while all other addresses are left alone.
+func TestBracketIPv6(t *testing.T) {
+	require.Equal(t, "[::1]", bracketIPv6("::1"))
+	require.Equal(t, "[fd00::2]", bracketIPv6("fd00::2"))
+	require.Equal(t, "[::1]:8080", bracketIPv6("[::1]:8080"))
+	require.Equal(t, "127.0.0.1", bracketIPv6("127.0.0.1"))
+	require.Equal(t, "localhost:8080", bracketIPv6("localhost:8080"))
+	require.Equal(t, "", bracketIPv6(""))
+}
+
+// TestIncrementalServiceUpdates makes sure single services can be added,
+// removed and replaced without affecting the others, even concurrently.
+func TestIncrementalServiceUpdates(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.URL.Path))
+		},
+	))
+	defer backend.Close()
+	address := strings.TrimPrefix(backend.URL, "http://")
+
+	newService := func(name, pathRegexp string) *Service {
+		return &Service{
+			Name:       name,
+			Address:    address,
+			Protocol:   "http",
+			HostRegexp: ".*",
+			PathRegexp: pathRegexp,
+			Auth:       "off",
+		}
+	}
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{
+		newService("a", "^/a"),
+	})
+	require.NoError(t, err)
+
+	send := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	require.Equal(t, http.StatusOK, send("/a"))
+	require.Equal(t, http.StatusInternalServerError, send("/b"))
+
+	require.NoError(t, p.AddService(newService("b", "^/b")))
+	require.Error(t, p.AddService(newService("b", "^/c")))
+	require.Error(t, p.AddService(newService("c", "(")))
+	require.Len(t, p.Services(), 2)
+	require.Equal(t, http.StatusOK, send("/b"))
+
+	// The replaced service matches other paths, the other one keeps
+	// working.
+	require.NoError(t, p.UpdateService(newService("b", "^/c")))
+	require.Error(t, p.UpdateService(newService("d", "^/d")))
+	require.Equal(t, http.StatusInternalServerError, send("/b"))
+	require.Equal(t, http.StatusOK, send("/c"))
+	require.Equal(t, http.StatusOK, send("/a"))
+
+	require.NoError(t, p.RemoveService("a"))
+	require.Error(t, p.RemoveService("a"))
+	require.Equal(t, http.StatusInternalServerError, send("/a"))
+	require.Equal(t, "b", p.Services()[0].Name)
+
+	// Concurrent modifications of different services don't get lost.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("svc%d", i)
+			require.NoError(t, p.AddService(newService(name, "^/x")))
+			send("/x")
+		}(i)
+	}
+	wg.Wait()
+	require.Len(t, p.Services(), 11)
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// sloWindow is the time window the error rate of a backend service is
+	// computed over.
+	sloWindow = time.Minute
+
+	// sloSampleInterval is the minimum time between two samples of the
+	// request and error counters of a backend service.
+	sloSampleInterval = time.Second
+
+	// sloMinRequests is the minimum number of requests a backend must
+	// have received within the SLO window before its error rate is
+	// considered meaningful. Without it, a single failed request would be
+	// enough to switch to the fallback response.
+	sloMinRequests = 10
+
+	// sloProbeInterval is the interval at which a request is still
+	// forwarded to a degraded backend. Without any requests reaching the
+	// backend we couldn't tell when it recovered.
+	sloProbeInterval = time.Second
+
+	// defaultSLORecoveryDuration is the default time the error rate of a
+	// degraded backend must stay below the recovery threshold before
+	// requests are forwarded to it again.
+	defaultSLORecoveryDuration = time.Minute
+)
+
+// counterSample is a snapshot of the request and error counters of a backend
+// service.
+type counterSample struct {
+	time     time.Time
+	requests float64
+	errors   float64
+}
+
+// sloTracker keeps track of the error rate of a backend service and decides
+// whether requests should be forwarded to it or be answered with the service's
+// fallback response instead.
+type sloTracker struct {
+	requests prometheus.Counter
+	errors   prometheus.Counter
+
+	errorThreshold    float64
+	recoveryThreshold float64
+	recoveryDuration  time.Duration
+
+	// now returns the current time. It can be replaced in tests.
+	now func() time.Time
+
+	mtx sync.Mutex
+
+	// samples are the counter snapshots within the SLO window, oldest
+	// first.
+	samples []counterSample
+
+	// degraded is true while the fallback response is served.
+	degraded bool
+
+	// recoveringSince is the time the error rate of the degraded backend
+	// dropped below the recovery threshold. It is zero if the backend
+	// isn't degraded or the error rate is still too high.
+	recoveringSince time.Time
+
+	// lastProbe is the last time a request was forwarded to the degraded
+	// backend.
+	lastProbe time.Time
+}
+
+// newSLOTracker creates a new SLO tracker for the given service.
+func newSLOTracker(service *Service) *sloTracker {
+	recoveryThreshold := service.SLORecoveryThreshold
+	if recoveryThreshold == 0 {
+		recoveryThreshold = service.SLOErrorRateThreshold
+	}
+	recoveryDuration := service.SLORecoveryDuration
+	if recoveryDuration == 0 {
+		recoveryDuration = defaultSLORecoveryDuration
+	}
+
+	return &sloTracker{
+		requests: backendRequests.WithLabelValues(
+			service.Name, BackendPrimary,
+		),
+		errors: backendErrors.WithLabelValues(
+			service.Name, BackendPrimary,
+		),
+		errorThreshold:    service.SLOErrorRateThreshold,
+		recoveryThreshold: recoveryThreshold,
+		recoveryDuration:  recoveryDuration,
+		now:               time.Now,
+	}
+}
+
+// validateSLO makes sure the SLO settings of the given service are sane.
+func validateSLO(service *Service) error {
+	if service.SLOErrorRateThreshold == 0 {
+		if service.SLOFallbackResponse != "" {
+			return invalidField("slofallbackresponse", "requires "+
+				"sloerrorratethreshold to be set")
+		}
+
+		return nil
+	}
+
+	switch {
+	case service.SLOErrorRateThreshold < 0 ||
+		service.SLOErrorRateThreshold > 1:
+
+		return invalidField("sloerrorratethreshold", "must be "+
+			"between 0 and 1")
+
+	case service.SLORecoveryThreshold < 0 ||
+		service.SLORecoveryThreshold > service.SLOErrorRateThreshold:
+
+		return invalidField("slorecoverythreshold", "must be between "+
+			"0 and sloerrorratethreshold")
+
+	case service.SLORecoveryDuration < 0:
+		return invalidField("slorecoveryduration", "cannot be "+
+			"negative")
+	}
+
+	return nil
+}
+
+// errorRate takes a new sample of the counters if the last one is old enough
+// and returns the error rate and the number of requests within the SLO
+// window.
+//
+// NOTE: The mutex must be held when calling this method.
+func (s *sloTracker) errorRate(now time.Time) (float64, float64) {
+	current := counterSample{
+		time:     now,
+		requests: counterValue(s.requests),
+		errors:   counterValue(s.errors),
+	}
+
+	numSamples := len(s.samples)
+	if numSamples == 0 ||
+		now.Sub(s.samples[numSamples-1].time) >= sloSampleInterval {
+
+		s.samples = append(s.samples, current)
+	}
+
+	// Drop all samples that are older than the window, but keep the
+	// youngest of those as the base to compute the rate from.
+	for len(s.samples) > 1 && now.Sub(s.samples[1].time) >= sloWindow {
+		s.samples = s.samples[1:]
+	}
+
+	base := s.samples[0]
+	requests := current.requests - base.requests
+	if requests <= 0 {
+		return 0, 0
+	}
+
+	return (current.errors - base.errors) / requests, requests
+}
+
+// allow returns true if the request should be forwarded to the backend or
+// false if the fallback response should be served instead.
+func (s *sloTracker) allow() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.now()
+	rate, requests := s.errorRate(now)
+
+	switch {
+	case !s.degraded && requests >= sloMinRequests &&
+		rate > s.errorThreshold:
+
+		log.Warnf("Backend error rate of %.2f exceeds SLO threshold "+
+			"of %.2f, serving fallback response", rate,
+			s.errorThreshold)
+
+		s.degraded = true
+		s.recoveringSince = time.Time{}
+		s.lastProbe = now
+
+	case s.degraded && rate >= s.recoveryThreshold:
+		s.recoveringSince = time.Time{}
+
+	case s.degraded && s.recoveringSince.IsZero():
+		s.recoveringSince = now
+
+	case s.degraded && now.Sub(s.recoveringSince) >= s.recoveryDuration:
+		log.Infof("Backend error rate of %.2f below SLO recovery "+
+			"threshold of %.2f for %v, forwarding requests again",
+			rate, s.recoveryThreshold, s.recoveryDuration)
+
+		s.degraded = false
+		s.recoveringSince = time.Time{}
+	}
+
+	if !s.degraded {
+		return true
+	}
+
+	// Let a request through every now and then so we learn about the
+	// backend recovering.
+	if now.Sub(s.lastProbe) >= sloProbeInterval {
+		s.lastProbe = now
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSLOTracker makes sure a backend is considered degraded once its error
+// rate exceeds the threshold and recovers once the error rate stays below the
+// recovery threshold for long enough.
+func TestSLOTracker(t *testing.T) {
+	t.Parallel()
+
+	tracker := newSLOTracker(&Service{
+		Name:                  "slo-test",
+		SLOErrorRateThreshold: 0.5,
+		SLORecoveryThreshold:  0.1,
+		SLORecoveryDuration:   30 * time.Second,
+	})
+
+	now := time.Unix(1000000, 0)
+	tracker.now = func() time.Time {
+		return now
+	}
+	record := func(requests, errors int) {
+		tracker.requests.Add(float64(requests))
+		tracker.errors.Add(float64(errors))
+		now = now.Add(sloSampleInterval)
+	}
+
+	// Take the first sample so there is a base to compute the rate from.
+	require.True(t, tracker.allow())
+
+	// A high error rate with too few requests isn't enough to consider
+	// the backend degraded.
+	record(sloMinRequests-1, sloMinRequests-1)
+	require.True(t, tracker.allow())
+
+	// With enough requests, it is. Requests are only forwarded as probes
+	// from then on.
+	record(10, 10)
+	require.False(t, tracker.allow())
+	require.True(t, tracker.degraded)
+
+	now = now.Add(sloProbeInterval)
+	require.True(t, tracker.allow())
+	require.False(t, tracker.allow())
+
+	// Once the failed requests have left the window and the probes
+	// succeed, the backend starts to recover but isn't trusted until the
+	// recovery duration has passed.
+	now = now.Add(sloWindow)
+	record(1, 0)
+	require.True(t, tracker.allow())
+	require.True(t, tracker.degraded)
+	require.False(t, tracker.recoveringSince.IsZero())
+
+	now = now.Add(tracker.recoveryDuration)
+	require.True(t, tracker.allow())
+	require.False(t, tracker.degraded)
+	require.True(t, tracker.allow())
+}
+
+// TestValidateSLO makes sure invalid SLO settings are rejected.
+func TestValidateSLO(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, validateSLO(&Service{}))
+	require.NoError(t, validateSLO(&Service{
+		SLOErrorRateThreshold: 0.2,
+		SLORecoveryThreshold:  0.1,
+	}))
+	require.Error(t, validateSLO(&Service{
+		SLOFallbackResponse: "fallback",
+	}))
+	require.Error(t, validateSLO(&Service{
+		SLOErrorRateThreshold: 1.5,
+	}))
+	require.Error(t, validateSLO(&Service{
+		SLOErrorRateThreshold: 0.2,
+		SLORecoveryThreshold:  0.3,
+	}))
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultSRVRefreshInterval is the default interval at which the SRV
+	// record of a service's backend is resolved again.
+	DefaultSRVRefreshInterval = 30 * time.Second
+
+	// srvLookupTimeout is the maximum time resolving an SRV record can
+	// take.
+	srvLookupTimeout = 5 * time.Second
+)
+
+// lookupSRV resolves the SRV record with the given name. It can be replaced in
+// tests.
+var lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return records, err
+}
+
+// srvEndpoints keeps the list of endpoints of a service's backend that are
+// discovered through a DNS SRV record, for example one maintained by Consul or
+// a Kubernetes headless service, and balances requests across them.
+type srvEndpoints struct {
+	name     string
+	interval time.Duration
+
+	mtx       sync.RWMutex
+	endpoints []string
+
+	// next is the number of endpoints picked so far, which determines
+	// the endpoint picked next.
+	next uint64
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	quit      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// newSRVEndpoints creates the endpoint list of the backend of the given
+// service and resolves its SRV record for the first time. If that fails, the
+// list stays empty until the record can be resolved.
+func newSRVEndpoints(s *Service) *srvEndpoints {
+	interval := s.Backend.SRVRefreshInterval
+	if interval == 0 {
+		interval = DefaultSRVRefreshInterval
+	}
+
+	e := &srvEndpoints{
+		name:     s.Backend.SRVName,
+		interval: interval,
+		quit:     make(chan struct{}),
+	}
+	if err := e.resolve(); err != nil {
+		log.Warnf("Unable to resolve SRV record of the backend of "+
+			"service %s: %v", s.Name, err)
+	}
+
+	return e
+}
+
+// start starts resolving the SRV record periodically.
+func (e *srvEndpoints) start() {
+	e.startOnce.Do(func() {
+		e.wg.Add(1)
+		go e.refreshEndpoints()
+	})
+}
+
+// stop stops resolving the SRV record.
+func (e *srvEndpoints) stop() {
+	e.stopOnce.Do(func() {
+		close(e.quit)
+		e.wg.Wait()
+	})
+}
+
+// refreshEndpoints resolves the SRV record every time the refresh interval
+// elapses.
+//
+// NOTE: This must be run as a goroutine.
+func (e *srvEndpoints) refreshEndpoints() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.quit:
+			return
+		}
+
+		if err := e.resolve(); err != nil {
+			log.Warnf("Unable to resolve SRV record %s, keeping "+
+				"the last known endpoints: %v", e.name, err)
+		}
+	}
+}
+
+// resolve resolves the SRV record and replaces the endpoints with the targets
+// of the records with the highest priority. The endpoints are kept if the
+// record can't be resolved or has no targets.
+func (e *srvEndpoints) resolve() error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), srvLookupTimeout,
+	)
+	defer cancel()
+
+	records, err := lookupSRV(ctx, e.name)
+	if err != nil {
+		return err
+	}
+
+	var endpoints []string
+	for _, record := range records {
+		// A lower value means a higher priority, the records of the
+		// lower priorities are only meant to be used as a fallback.
+		if record.Priority != records[0].Priority {
+			continue
+		}
+
+		target := strings.TrimSuffix(record.Target, ".")
+		if target == "" {
+			continue
+		}
+
+		endpoints = append(endpoints, net.JoinHostPort(
+			target, strconv.Itoa(int(record.Port)),
+		))
+	}
+	if len(endpoints) == 0 {
+		return fmt.Errorf("no targets found")
+	}
+
+	// The records are shuffled by their weight, so we sort them to pick
+	// every endpoint in turn.
+	sort.Strings(endpoints)
+
+	e.mtx.Lock()
+	e.endpoints = endpoints
+	e.mtx.Unlock()
+
+	return nil
+}
+
+// pick returns the endpoint the next request should be sent to, going through
+// all endpoints in turn. False is returned if no endpoints are known.
+func (e *srvEndpoints) pick() (string, bool) {
+	e.mtx.RLock()
+	defer e.mtx.RUnlock()
+
+	if len(e.endpoints) == 0 {
+		return "", false
+	}
+
+	n := atomic.AddUint64(&e.next, 1) - 1
+	return e.endpoints[n%uint64(len(e.endpoints))], true
+}
+
+// backendAddress returns the address the next request to the primary backend
+// of the service should be sent to. If the backend is discovered through an
+// SRV record, the endpoints are picked in turn, falling back to the static
+// address as long as none are known.
+func (s *Service) backendAddress() string {
+	if s.srv != nil {
+		if endpoint, ok := s.srv.pick(); ok {
+			return endpoint
+		}
+	}
+
+	return s.Address
+}
+
+// updateSRVEndpoints starts resolving the SRV records of the given services
+// that weren't in use yet and stops it for the services in use that aren't
+// among them anymore.
+func updateSRVEndpoints(services, inUse []*Service) {
+	used := make(map[*Service]struct{}, len(services))
+	for _, service := range services {
+		used[service] = struct{}{}
+		if service.srv != nil {
+			service.srv.start()
+		}
+	}
+
+	for _, service := range inUse {
+		if _, ok := used[service]; ok || service.srv == nil {
+			continue
+		}
+
+		service.srv.stop()
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSRVDiscovery makes sure requests are balanced across the endpoints
+// discovered through an SRV record in turn, that the last known endpoints are
+// kept if the record can't be resolved and that the record isn't resolved
+// anymore once the service is removed.
+func TestSRVDiscovery(t *testing.T) {
+	newBackend := func(name string) *net.SRV {
+		backend := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(name))
+			},
+		))
+		t.Cleanup(backend.Close)
+
+		addr := backend.Listener.Addr().(*net.TCPAddr)
+		return &net.SRV{
+			Target: "127.0.0.1.",
+			Port:   uint16(addr.Port),
+		}
+	}
+	record1 := newBackend("backend1")
+	record2 := newBackend("backend2")
+	record3 := newBackend("backend3")
+
+	// The third backend has a lower priority, so it is only a fallback.
+	record3.Priority = 1
+
+	var (
+		mtx       sync.Mutex
+		records   = []*net.SRV{record3, record2, record1}
+		lookupErr error
+		lookups   int
+	)
+	setRecords := func(newRecords []*net.SRV, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		records, lookupErr = newRecords, err
+	}
+	numLookups := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		return lookups
+	}
+
+	defaultLookup := lookupSRV
+	lookupSRV = func(_ context.Context, name string) ([]*net.SRV, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		require.Equal(t, "_http._tcp.backend.test", name)
+		lookups++
+
+		// Records are returned ordered by priority.
+		sorted := make([]*net.SRV, len(records))
+		copy(sorted, records)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].Priority < sorted[j].Priority
+		})
+		return sorted, lookupErr
+	}
+	defer func() {
+		lookupSRV = defaultLookup
+	}()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "discovered",
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "off",
+		Backend: BackendConfig{
+			SRVName:            "_http._tcp.backend.test",
+			SRVRefreshInterval: 10 * time.Millisecond,
+		},
+	}})
+	require.NoError(t, err)
+	defer p.Close()
+
+	request := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		body, err := ioutil.ReadAll(rec.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	requestAll := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			counts[request()]++
+		}
+		return counts
+	}
+
+	// The endpoints with the highest priority are picked in turn.
+	require.Equal(t, map[string]int{
+		"backend1": 2,
+		"backend2": 2,
+	}, requestAll())
+
+	// The last known endpoints are kept if the record can't be resolved.
+	setRecords(nil, errors.New("no such host"))
+	lookupsBefore := numLookups()
+	require.Eventually(t, func() bool {
+		return numLookups() > lookupsBefore+1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, map[string]int{
+		"backend1": 2,
+		"backend2": 2,
+	}, requestAll())
+
+	// Changes of the record are picked up.
+	setRecords([]*net.SRV{record2}, nil)
+	require.Eventually(t, func() bool {
+		return request() == "backend2" && request() == "backend2"
+	}, time.Second, 10*time.Millisecond)
+
+	// The record isn't resolved anymore once the service is removed.
+	require.NoError(t, p.UpdateServices(nil))
+	lookupsAfter := numLookups()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, lookupsAfter, numLookups())
+}
+
+// TestSRVEndpointsFormat makes sure the targets of SRV records are turned into
+// addresses the proxy can connect to.
+func TestSRVEndpointsFormat(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "b.example.com.", Port: 8080},
+		{Target: "a.example.com.", Port: 8080},
+		{Target: "2001:db8::1", Port: 443},
+		{Target: ".", Port: 80},
+	}
+
+	defaultLookup := lookupSRV
+	lookupSRV = func(context.Context, string) ([]*net.SRV, error) {
+		return records, nil
+	}
+	defer func() {
+		lookupSRV = defaultLookup
+	}()
+
+	e := newSRVEndpoints(&Service{
+		Backend: BackendConfig{SRVName: "_http._tcp.example.com"},
+	})
+
+	var picked []string
+	for i := 0; i < 4; i++ {
+		endpoint, ok := e.pick()
+		require.True(t, ok)
+		picked = append(picked, endpoint)
+	}
+	require.Equal(t, []string{
+		"[2001:db8::1]:443",
+		"a.example.com:8080",
+		"b.example.com:8080",
+		"[2001:db8::1]:443",
+	}, picked)
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// StaticResponse is a fixed response a service returns to every request
+// instead of proxying it to a backend.
+type StaticResponse struct {
+	// StatusCode is the HTTP status code of the response. It defaults to
+	// 200 OK.
+	StatusCode int `long:"statuscode" description:"The HTTP status code of the static response, defaults to 200"`
+
+	// Headers are the header fields of the response.
+	Headers map[string]string `long:"headers" description:"Header fields of the static response"`
+
+	// Body is the body of the response.
+	Body string `long:"body" description:"The body of the static response"`
+}
+
+// validate makes sure the static response is a valid HTTP response.
+func (s *StaticResponse) validate() error {
+	if s.StatusCode != 0 && (s.StatusCode < 200 || s.StatusCode > 599) {
+		return invalidField("statuscode", "%d is not a valid HTTP "+
+			"status code, must be between 200 and 599",
+			s.StatusCode)
+	}
+
+	return nil
+}
+
+// ServeHTTP writes the static response.
+func (s *StaticResponse) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	for name, value := range s.Headers {
+		w.Header().Set(name, value)
+	}
+
+	statusCode := s.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	w.WriteHeader(statusCode)
+	_, _ = w.Write([]byte(s.Body))
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStaticResponse makes sure services with a static response return it
+// without requiring authentication or contacting a backend.
+func TestStaticResponse(t *testing.T) {
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "tos",
+		HostRegexp: ".*",
+		PathRegexp: "^/tos$",
+		Auth:       "on",
+		Price:      1,
+		StaticResponse: &StaticResponse{
+			StatusCode: http.StatusTeapot,
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+			Body: "terms of service",
+		},
+	}, {
+		Name:           "health",
+		HostRegexp:     ".*",
+		PathRegexp:     "^/health$",
+		StaticResponse: &StaticResponse{},
+	}})
+	require.NoError(t, err)
+
+	send := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := send("/tos")
+	require.Equal(t, http.StatusTeapot, rec.Code)
+	require.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+	require.Equal(t, "terms of service", rec.Body.String())
+
+	rec = send("/health")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Body.String())
+
+	// Invalid status codes are rejected.
+	_, err = New(auth.NewMockAuthenticator(), []*Service{{
+		Name:           "invalid",
+		HostRegexp:     ".*",
+		StaticResponse: &StaticResponse{StatusCode: 42},
+	}})
+	require.Error(t, err)
+}
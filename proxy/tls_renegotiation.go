@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// RenegotiateNever disallows TLS renegotiation by the backend.
+	RenegotiateNever = "never"
+
+	// RenegotiateOnce allows the backend to renegotiate TLS once per
+	// connection.
+	RenegotiateOnce = "once"
+
+	// RenegotiateFreely allows the backend to renegotiate TLS any number of
+	// times.
+	RenegotiateFreely = "freely"
+)
+
+// parseTLSRenegotiation parses the TLS renegotiation setting of a backend. An
+// empty setting means renegotiation is never allowed.
+func parseTLSRenegotiation(setting string) (tls.RenegotiationSupport,
+	error) {
+
+	switch setting {
+	case "", RenegotiateNever:
+		return tls.RenegotiateNever, nil
+
+	case RenegotiateOnce:
+		return tls.RenegotiateOnceAsClient, nil
+
+	case RenegotiateFreely:
+		return tls.RenegotiateFreelyAsClient, nil
+
+	default:
+		return 0, fmt.Errorf("unknown TLS renegotiation setting %q, "+
+			"must be %s, %s or %s", setting, RenegotiateNever,
+			RenegotiateOnce, RenegotiateFreely)
+	}
+}
+
+// serviceTransport is a round tripper that sends requests to the backends of
+// services that need a custom TLS configuration through their own transport
+// and all others through the shared one.
+type serviceTransport struct {
+	shared http.RoundTripper
+
+	// services maps the services with a transport of their own to it.
+	// Services are shared between reverse proxies when they are updated
+	// one by one, so their transports aren't stored in them.
+	services map[*Service]http.RoundTripper
+}
+
+// disableHTTP2 makes sure the given transport only ever speaks HTTP/1.1 with
+// backends.
+func disableHTTP2(transport *http.Transport) {
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = make(
+		map[string]func(string, *tls.Conn) http.RoundTripper,
+	)
+	transport.TLSClientConfig.NextProtos = nil
+}
+
+// RoundTrip sends the request through the transport of the service it is
+// proxied to, if it has one.
+//
+// NOTE: This is part of the http.RoundTripper interface.
+func (t *serviceTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+
+	backendReq := backendRequestFromContext(req.Context())
+	if backendReq != nil {
+		transport, ok := t.services[backendReq.service]
+		if ok {
+			return transport.RoundTrip(req)
+		}
+	}
+
+	return t.shared.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the shared transport and
+// the transports of all services. Connections that are in use are closed once
+// their request completed.
+func (t *serviceTransport) CloseIdleConnections() {
+	closeIdleConnections(t.shared)
+	for _, transport := range t.services {
+		closeIdleConnections(transport)
+	}
+}
+
+// closeIdleConnections closes the idle connections of the given round tripper
+// if it keeps any.
+func closeIdleConnections(transport http.RoundTripper) {
+	type idleCloser interface {
+		CloseIdleConnections()
+	}
+	if closer, ok := transport.(idleCloser); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// createServiceTransports creates a transport of their own for the services
+// whose backends are allowed to renegotiate TLS, use mutual TLS or that have
+// custom backend timeouts, based on the given shared transport. Renegotiation
+// is only possible with TLS 1.2 and below and never with HTTP/2.
+func createServiceTransports(services []*Service,
+	shared *http.Transport) map[*Service]http.RoundTripper {
+
+	transports := make(map[*Service]http.RoundTripper)
+	for _, service := range services {
+		if service.tlsRenegotiation == tls.RenegotiateNever &&
+			service.backendTLS == nil &&
+			!service.hasCustomTimeouts() {
+
+			continue
+		}
+
+		transport := shared.Clone()
+		tlsConfig := transport.TLSClientConfig
+		tlsConfig.Renegotiation = service.tlsRenegotiation
+		if service.tlsRenegotiation != tls.RenegotiateNever {
+			disableHTTP2(transport)
+			tlsConfig.MaxVersion = tls.VersionTLS12
+		}
+		if service.backendTLS != nil {
+			service.backendTLS.apply(tlsConfig)
+		}
+		transport.DialContext = backendDialer(service)
+		transport.ResponseHeaderTimeout =
+			service.BackendResponseHeaderTimeout
+		transports[service] = transport
+	}
+
+	return transports
+}
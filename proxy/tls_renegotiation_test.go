@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTripperFunc is a round tripper that calls the function it is defined as.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls the function.
+//
+// NOTE: This is part of the http.RoundTripper interface.
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// TestTLSRenegotiation makes sure only services allowing TLS renegotiation get
+// a transport of their own and that their requests are sent through it.
+func TestTLSRenegotiation(t *testing.T) {
+	t.Parallel()
+
+	services := []*Service{{
+		Name:                    "default",
+		HostRegexp:              ".*",
+		BackendTLSRenegotiation: "",
+	}, {
+		Name:                    "once",
+		HostRegexp:              ".*",
+		BackendTLSRenegotiation: RenegotiateOnce,
+	}, {
+		Name:                    "freely",
+		HostRegexp:              ".*",
+		BackendTLSRenegotiation: RenegotiateFreely,
+	}}
+	require.NoError(t, prepareServices(services, nil))
+
+	shared := &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig: &tls.Config{
+			NextProtos: []string{"h2", "http/1.1"},
+		},
+	}
+	transports := createServiceTransports(services, shared)
+
+	renegotiation := func(s *Service) tls.RenegotiationSupport {
+		transport := transports[s].(*http.Transport)
+		return transport.TLSClientConfig.Renegotiation
+	}
+	require.NotContains(t, transports, services[0])
+	require.Equal(
+		t, tls.RenegotiateOnceAsClient, renegotiation(services[1]),
+	)
+	require.Equal(
+		t, tls.RenegotiateFreelyAsClient, renegotiation(services[2]),
+	)
+	require.Equal(
+		t, tls.RenegotiateNever, shared.TLSClientConfig.Renegotiation,
+	)
+
+	// Renegotiation only exists up to TLS 1.2 and not with HTTP/2.
+	for _, service := range services[1:] {
+		transport := transports[service].(*http.Transport)
+		require.False(t, transport.ForceAttemptHTTP2)
+		require.NotNil(t, transport.TLSNextProto)
+		require.Empty(t, transport.TLSNextProto)
+		require.Empty(t, transport.TLSClientConfig.NextProtos)
+		tlsConfig := transport.TLSClientConfig
+		require.EqualValues(t, tls.VersionTLS12, tlsConfig.MaxVersion)
+	}
+	require.True(t, shared.ForceAttemptHTTP2)
+	require.Zero(t, shared.TLSClientConfig.MaxVersion)
+	require.Equal(
+		t, []string{"h2", "http/1.1"},
+		shared.TLSClientConfig.NextProtos,
+	)
+
+	// Requests should be sent through the transport of their service.
+	var used string
+	transports[services[1]] = roundTripperFunc(
+		func(*http.Request) (*http.Response, error) {
+			used = "once"
+			return nil, nil
+		},
+	)
+	transport := &serviceTransport{
+		shared: roundTripperFunc(
+			func(*http.Request) (*http.Response, error) {
+				used = "shared"
+				return nil, nil
+			},
+		),
+		services: transports,
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	_, _ = transport.RoundTrip(withBackendRequest(req, services[1], ""))
+	require.Equal(t, "once", used)
+	_, _ = transport.RoundTrip(withBackendRequest(req, services[0], ""))
+	require.Equal(t, "shared", used)
+
+	invalid := []*Service{{
+		Name:                    "invalid",
+		BackendTLSRenegotiation: "sometimes",
+	}}
+	require.Error(t, prepareServices(invalid, nil))
+}
+
+// TestBackendTLSMinVersion makes sure backends are only connected to with the
+// configured minimum TLS version.
+func TestBackendTLSMinVersion(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	backend.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	backend.StartTLS()
+	defer backend.Close()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "tls12",
+		Address:    strings.TrimPrefix(backend.URL, "https://"),
+		Protocol:   "https",
+		HostRegexp: ".*",
+		Auth:       "off",
+	}})
+	require.NoError(t, err)
+
+	send := func() int {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+	require.Equal(t, http.StatusOK, send())
+
+	// A backend that doesn't support TLS 1.3 can't be reached once it's
+	// required.
+	require.NoError(t, p.SetBackendTLSMinVersion(tls.VersionTLS13))
+	require.Equal(t, http.StatusBadGateway, send())
+}
+
+// idleCountingTransport is a round tripper that counts how often its idle
+// connections were closed.
+type idleCountingTransport struct {
+	roundTripperFunc
+	closed int
+}
+
+// CloseIdleConnections counts the call.
+func (t *idleCountingTransport) CloseIdleConnections() {
+	t.closed++
+}
+
+// TestCloseIdleConnections makes sure the idle connections of the shared and
+// all service transports are closed once the transports are replaced.
+func TestCloseIdleConnections(t *testing.T) {
+	t.Parallel()
+
+	shared := &idleCountingTransport{}
+	service := &idleCountingTransport{}
+	transport := &trailerFixingTransport{
+		next: &serviceTransport{
+			shared: shared,
+			services: map[*Service]http.RoundTripper{
+				{Name: "service"}: service,
+			},
+		},
+	}
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:       "service",
+		HostRegexp: ".*",
+	}})
+	require.NoError(t, err)
+	p.proxyBackend.Transport = transport
+
+	require.NoError(t, p.UpdateServices([]*Service{{
+		Name:       "updated",
+		HostRegexp: ".*",
+	}}))
+	require.Equal(t, 1, shared.closed)
+	require.Equal(t, 1, service.closed)
+}
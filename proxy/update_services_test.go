@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConcurrentUpdateServices makes sure the services can be updated from
+// multiple goroutines while requests are being served. It is meant to be run
+// with the race detector.
+func TestConcurrentUpdateServices(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	newService := func(name string) *Service {
+		return &Service{
+			Name:          name,
+			Address:       address,
+			Protocol:      "http",
+			HostRegexp:    ".*",
+			PathRegexp:    fmt.Sprintf("^/%s$", name),
+			Auth:          "freebie 1000",
+			RateLimit:     1000,
+			MaxConcurrent: 10,
+		}
+	}
+
+	p, err := New(
+		auth.NewMockAuthenticator(), []*Service{newService("primary")},
+	)
+	require.NoError(t, err)
+
+	const (
+		numUpdaters = 10
+		numUpdates  = 20
+	)
+
+	var wg sync.WaitGroup
+	quit := make(chan struct{})
+
+	// Keep serving requests for the service that is always configured
+	// while the services are updated.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+
+			req := httptest.NewRequest(
+				http.MethodGet, "/primary", nil,
+			)
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("unexpected status %d", rec.Code)
+				return
+			}
+		}
+	}()
+
+	// Each updater keeps the services in use and adds its own, like a
+	// config reload or the canary controller would.
+	update := func(name string) error {
+		var services []*Service
+		for _, s := range p.Services() {
+			if !strings.HasPrefix(s.Name, "updater") {
+				services = append(services, s)
+			}
+		}
+		services = append(services, newService(name))
+
+		return p.UpdateServices(services)
+	}
+
+	var updaters sync.WaitGroup
+	for i := 0; i < numUpdaters; i++ {
+		updaters.Add(1)
+		go func(name string) {
+			defer updaters.Done()
+
+			for j := 0; j < numUpdates; j++ {
+				if err := update(name); err != nil {
+					t.Errorf("unable to update: %v", err)
+					return
+				}
+			}
+		}(fmt.Sprintf("updater%d", i))
+	}
+	updaters.Wait()
+
+	close(quit)
+	wg.Wait()
+
+	// The service of the last updater replaced the others.
+	services := p.Services()
+	require.Len(t, services, 2)
+	require.Equal(t, "primary", services[0].Name)
+}
+
+// invalidatingAuthenticator is a mock authenticator that records the
+// services it was told to invalidate.
+type invalidatingAuthenticator struct {
+	*auth.MockAuthenticator
+
+	invalidated []string
+}
+
+// InvalidateService records the invalidated service.
+func (a *invalidatingAuthenticator) InvalidateService(name string) {
+	a.invalidated = append(a.invalidated, name)
+}
+
+// TestUpdateServicesInvalidation makes sure the state the authenticator keeps
+// for a service is dropped when it's changed or removed, but not when it's
+// kept as is.
+func TestUpdateServicesInvalidation(t *testing.T) {
+	newService := func(name string, price int64) *Service {
+		return &Service{
+			Name:       name,
+			Address:    "127.0.0.1:8080",
+			Protocol:   "http",
+			HostRegexp: ".*",
+			PathRegexp: fmt.Sprintf("^/%s$", name),
+			Price:      price,
+		}
+	}
+
+	authenticator := &invalidatingAuthenticator{
+		MockAuthenticator: auth.NewMockAuthenticator(),
+	}
+	kept := newService("kept", 1)
+	changed := newService("changed", 1)
+	removed := newService("removed", 1)
+	p, err := New(authenticator, []*Service{kept, changed, removed})
+	require.NoError(t, err)
+
+	err = p.UpdateServices([]*Service{kept, newService("changed", 2)})
+	require.NoError(t, err)
+	require.Equal(
+		t, []string{"changed", "removed"}, authenticator.invalidated,
+	)
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	// hdrUploadProgress is the header field of the informational responses
+	// that report how many bytes of the request body were received.
+	hdrUploadProgress = "X-Upload-Progress"
+
+	// maxUploadProgressReports is the maximum number of informational
+	// responses sent for a single request. Go's HTTP client gives up on a
+	// request after receiving more than five of them, one of which may be
+	// the 100 Continue the server sends on its own if the client asked for
+	// it.
+	maxUploadProgressReports = 4
+)
+
+// progressWriter is a response writer that can send a limited number of 100
+// Continue informational responses reporting the upload progress until the
+// final response is written. The request body is read by the transport of the
+// reverse proxy while the final response is written by the handler, so all
+// access to the underlying response writer is synchronized until then.
+type progressWriter struct {
+	w http.ResponseWriter
+
+	mtx sync.Mutex
+
+	// header holds the header fields of the final response until it is
+	// written. They are kept separate so they aren't sent with the
+	// informational responses.
+	header http.Header
+
+	// reports is the number of informational responses sent so far.
+	reports int
+
+	// done is set once the final response is being written or the
+	// connection was hijacked. No progress is reported after that.
+	done bool
+}
+
+// newProgressWriter wraps the given response writer so the upload progress can
+// be reported through it.
+func newProgressWriter(w http.ResponseWriter) *progressWriter {
+	// Header fields that were already set belong to the final response.
+	header := make(http.Header)
+	for name, values := range w.Header() {
+		header[name] = values
+		delete(w.Header(), name)
+	}
+
+	return &progressWriter{
+		w:      w,
+		header: header,
+	}
+}
+
+// report sends an informational response with the number of bytes of the
+// request body that were received so far, unless the final response was
+// already written or the maximum number of reports was reached.
+func (p *progressWriter) report(received int64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.done || p.reports >= maxUploadProgressReports {
+		return
+	}
+
+	p.w.Header().Set(hdrUploadProgress, strconv.FormatInt(received, 10))
+	p.w.WriteHeader(http.StatusContinue)
+	p.w.Header().Del(hdrUploadProgress)
+	p.reports++
+}
+
+// finish stops reporting the progress and moves the header fields of the final
+// response to the underlying response writer.
+func (p *progressWriter) finish() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.done {
+		return
+	}
+
+	for name, values := range p.header {
+		p.w.Header()[name] = values
+	}
+	p.done = true
+}
+
+// Header returns the header fields of the final response.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (p *progressWriter) Header() http.Header {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.done {
+		return p.w.Header()
+	}
+
+	return p.header
+}
+
+// WriteHeader writes the header of the final response.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (p *progressWriter) WriteHeader(statusCode int) {
+	p.finish()
+	p.w.WriteHeader(statusCode)
+}
+
+// Write writes to the body of the final response.
+//
+// NOTE: This is part of the http.ResponseWriter interface.
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.finish()
+	return p.w.Write(b)
+}
+
+// Flush sends any buffered data of the final response to the client.
+//
+// NOTE: This is part of the http.Flusher interface.
+func (p *progressWriter) Flush() {
+	p.finish()
+	if flusher, ok := p.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack stops reporting the progress and lets the caller take over the
+// connection, which is needed to proxy protocol upgrades.
+//
+// NOTE: This is part of the http.Hijacker interface.
+func (p *progressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	p.finish()
+
+	hijacker, ok := p.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the underlying response writer, so an
+// http.ResponseController can reach its optional methods.
+func (p *progressWriter) Unwrap() http.ResponseWriter {
+	return p.w
+}
+
+// progressBody is a request body that reports the number of bytes read from
+// it every time another interval of bytes was read.
+type progressBody struct {
+	io.ReadCloser
+
+	interval int64
+	received int64
+	next     int64
+	report   func(int64)
+}
+
+// Read reads from the body and reports the progress if another interval was
+// completed.
+//
+// NOTE: This is part of the io.Reader interface.
+func (b *progressBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.received += int64(n)
+	if b.received >= b.next {
+		b.report(b.received)
+		b.next = (b.received/b.interval + 1) * b.interval
+	}
+
+	return n, err
+}
+
+// reportUploadProgress wraps the request body and response writer so that a
+// 100 Continue informational response with the X-Upload-Progress header is sent
+// every time another interval of bytes of the body was received, up to
+// maxUploadProgressReports times. The body is still streamed to the backend
+// without being buffered. Informational responses can't be sent to HTTP/1.0
+// clients and aren't supported by our HTTP/2 server, so the response writer is
+// returned unchanged for those.
+func reportUploadProgress(w http.ResponseWriter, r *http.Request,
+	interval int64) http.ResponseWriter {
+
+	if r.ProtoMajor != 1 || !r.ProtoAtLeast(1, 1) || r.Body == nil ||
+		r.Body == http.NoBody {
+
+		return w
+	}
+
+	progress := newProgressWriter(w)
+	r.Body = &progressBody{
+		ReadCloser: r.Body,
+		interval:   interval,
+		next:       interval,
+		report:     progress.report,
+	}
+
+	return progress
+}
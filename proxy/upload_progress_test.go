@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestUploadProgress makes sure the upload progress is reported in
+// informational responses while the body is read and that the final response
+// is unaffected.
+func TestUploadProgress(t *testing.T) {
+	t.Parallel()
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Early", "final")
+		w = reportUploadProgress(w, r, 1000)
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		w.Header().Set("X-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusCreated)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	var (
+		mtx      sync.Mutex
+		progress []int
+	)
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int,
+			header textproto.MIMEHeader) error {
+
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			require.Equal(t, http.StatusContinue, code)
+			require.Empty(t, header.Get("X-Early"))
+			received, err := strconv.Atoi(
+				header.Get(hdrUploadProgress),
+			)
+			require.NoError(t, err)
+			progress = append(progress, received)
+			return nil
+		},
+	}
+
+	body := bytes.Repeat([]byte{1}, 3500)
+	req, err := http.NewRequest("POST", server.URL, bytes.NewReader(body))
+	require.NoError(t, err)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "final", resp.Header.Get("X-Early"))
+	require.Equal(t, "3500", resp.Header.Get("X-Length"))
+	require.Empty(t, resp.Header.Get(hdrUploadProgress))
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	// Depending on how the body is read, a single read can complete
+	// multiple intervals, so there's at most one report per interval.
+	require.NotEmpty(t, progress)
+	require.LessOrEqual(t, len(progress), 3)
+	require.GreaterOrEqual(t, progress[len(progress)-1], 3000)
+	require.LessOrEqual(t, progress[len(progress)-1], 3500)
+}
+
+// TestUploadProgressLimit makes sure no more informational responses are sent
+// than Go's HTTP client accepts, no matter how large the body is.
+func TestUploadProgressLimit(t *testing.T) {
+	t.Parallel()
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w = reportUploadProgress(w, r, 100)
+
+		_, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		w.WriteHeader(http.StatusCreated)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	var (
+		mtx     sync.Mutex
+		reports int
+	)
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(int, textproto.MIMEHeader) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			reports++
+			return nil
+		},
+	}
+
+	// The body is sent in small chunks, so the server reads at most one
+	// interval at a time.
+	reader, writer := io.Pipe()
+	go func() {
+		chunk := bytes.Repeat([]byte{1}, 100)
+		for i := 0; i < 20; i++ {
+			if _, err := writer.Write(chunk); err != nil {
+				return
+			}
+		}
+		_ = writer.Close()
+	}()
+
+	req, err := http.NewRequest("POST", server.URL, reader)
+	require.NoError(t, err)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	require.Equal(t, maxUploadProgressReports, reports)
+}
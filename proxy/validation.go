@@ -0,0 +1,360 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ValidationError describes an invalid setting in the config of a service.
+type ValidationError struct {
+	// Service is the name of the service with the invalid setting.
+	Service string
+
+	// Index is the position of the service in the list of services,
+	// starting at zero.
+	Index int
+
+	// Field is the path of the invalid setting within the config of the
+	// service, using the keys of the config file, for example
+	// dynamicprice.grpcaddress or authwhitelistpaths[1].
+	Field string
+
+	// Reason describes what is wrong with the setting and what is
+	// expected instead.
+	Reason string
+
+	// Line and Column are the position of the setting in the config file.
+	// They are zero if the position is unknown, for example because the
+	// setting wasn't read from a file.
+	Line   int
+	Column int
+}
+
+// Error returns a description of the invalid setting, including where to find
+// it.
+//
+// NOTE: This is part of the error interface.
+func (e *ValidationError) Error() string {
+	service := fmt.Sprintf("service %q", e.Service)
+	if e.Service == "" {
+		service = fmt.Sprintf("service #%d", e.Index+1)
+	}
+
+	position := ""
+	if e.Line > 0 {
+		position = fmt.Sprintf(" (line %d, column %d)", e.Line,
+			e.Column)
+	}
+
+	return fmt.Sprintf("invalid config of %s, field %s%s: %s", service,
+		e.Field, position, e.Reason)
+}
+
+// fieldError is an error about a single setting of a service, identified by
+// its path relative to the struct that was validated.
+type fieldError struct {
+	field  string
+	reason string
+}
+
+// Error returns the reason the setting is invalid.
+//
+// NOTE: This is part of the error interface.
+func (e *fieldError) Error() string {
+	return e.reason
+}
+
+// invalidField returns an error about the setting with the given field path.
+func invalidField(field, format string, args ...interface{}) error {
+	return &fieldError{
+		field:  field,
+		reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// nestedField prefixes the field path of the given error with the key of the
+// struct it was found in.
+func nestedField(key string, err error) error {
+	var fieldErr *fieldError
+	if !errors.As(err, &fieldErr) {
+		return invalidField(key, "%v", err)
+	}
+
+	return invalidField(key+"."+fieldErr.field, "%s", fieldErr.reason)
+}
+
+// ValidateServices makes sure the configs of all given services are sane
+// without changing them. The first invalid setting found is returned as a
+// *ValidationError.
+func ValidateServices(services []*Service) error {
+	for i, service := range services {
+		err := service.validate()
+		if err == nil {
+			continue
+		}
+
+		validationErr := &ValidationError{
+			Service: service.Name,
+			Index:   i,
+			Reason:  err.Error(),
+		}
+		var fieldErr *fieldError
+		if errors.As(err, &fieldErr) {
+			validationErr.Field = fieldErr.field
+		}
+
+		return validationErr
+	}
+
+	return nil
+}
+
+// validate makes sure the config of the service is sane. Errors about single
+// settings are returned as *fieldError.
+func (s *Service) validate() error {
+	if _, err := regexp.Compile(s.HostRegexp); err != nil {
+		return invalidField("hostregexp", "not a valid regular "+
+			"expression: %v", err)
+	}
+	if _, err := regexp.Compile(s.PathRegexp); err != nil {
+		return invalidField("pathregexp", "not a valid regular "+
+			"expression: %v", err)
+	}
+
+	// Make sure all whitelist regular expression entries actually compile
+	// so we run into an eventual panic during startup and not only when
+	// the request happens.
+	for i, entry := range s.AuthWhitelistPaths {
+		if _, err := regexp.Compile(entry); err != nil {
+			return invalidField(
+				fmt.Sprintf("authwhitelistpaths[%d]", i),
+				"not a valid regular expression: %v", err,
+			)
+		}
+	}
+
+	for key, value := range s.Headers {
+		if !strings.HasPrefix(value, filePrefix) {
+			continue
+		}
+
+		parts := strings.Split(value, ":")
+		if len(parts) != 2 || (parts[0] != filePrefixHex &&
+			parts[0] != filePrefixBase64) {
+
+			return invalidField("headers."+key, "file directive "+
+				"%q must be either '%s:path' or '%s:path'",
+				value, filePrefixHex, filePrefixBase64)
+		}
+	}
+
+	if err := validateSLO(s); err != nil {
+		return err
+	}
+	if err := validateCanary(s); err != nil {
+		return err
+	}
+
+	if len(s.AllowedMethods) > 0 {
+		if _, err := newMethodFilter(s.AllowedMethods); err != nil {
+			return invalidField("allowedmethods", "%v", err)
+		}
+	}
+
+	for i, pattern := range s.AllowedPaths {
+		if _, err := newPathPattern(pattern); err != nil {
+			return invalidField(
+				fmt.Sprintf("allowedpaths[%d]", i), "%v", err,
+			)
+		}
+	}
+	for i, pattern := range s.BlockedPaths {
+		if _, err := newPathPattern(pattern); err != nil {
+			return invalidField(
+				fmt.Sprintf("blockedpaths[%d]", i), "%v", err,
+			)
+		}
+	}
+
+	if len(s.EndpointContentTypes) > 0 {
+		_, err := newContentTypeFilter(s.EndpointContentTypes)
+		if err != nil {
+			return invalidField("endpointcontenttypes", "%v", err)
+		}
+	}
+
+	if s.CoalescingWindow < 0 {
+		return invalidField("coalescingwindow", "cannot be negative")
+	}
+
+	switch {
+	case s.MaxConcurrent < 0:
+		return invalidField("maxconcurrent", "cannot be negative")
+
+	case s.MaxQueueDepth < 0:
+		return invalidField("maxqueuedepth", "cannot be negative")
+
+	case s.MaxQueueDepth > 0 && s.MaxConcurrent == 0:
+		return invalidField("maxqueuedepth", "requires maxconcurrent "+
+			"to be set")
+
+	case s.RateLimit < 0:
+		return invalidField("ratelimit", "cannot be negative")
+
+	case s.RateBurst < 0:
+		return invalidField("rateburst", "cannot be negative")
+
+	case s.RateBurst > 0 && s.RateLimit == 0:
+		return invalidField("rateburst", "requires ratelimit to be set")
+
+	case s.RateLimitDistributed && s.RateLimit == 0:
+		return invalidField("ratelimitdistributed", "requires "+
+			"ratelimit to be set")
+	}
+
+	for i, caveat := range s.Caveats {
+		if _, err := parseCaveat(caveat); err != nil {
+			return invalidField(
+				fmt.Sprintf("caveats[%d]", i), "%v", err,
+			)
+		}
+	}
+
+	if s.StaticResponse != nil {
+		if err := s.StaticResponse.validate(); err != nil {
+			return nestedField("staticresponse", err)
+		}
+	}
+
+	if _, err := parseIPRanges(s.AllowCIDRs); err != nil {
+		return invalidField("allowcidrs", "%v", err)
+	}
+	if _, err := parseIPRanges(s.DenyCIDRs); err != nil {
+		return invalidField("denycidrs", "%v", err)
+	}
+
+	if _, err := s.BypassAuth.parseTrustedIPs(); err != nil {
+		return invalidField("bypassauth.trustedips", "%v", err)
+	}
+
+	if err := validateHeaderRules(s.RequestHeaders); err != nil {
+		return invalidField("requestheaders", "%v", err)
+	}
+	for i, name := range s.StripRequestHeaders {
+		if err := validateHeaderName(name); err != nil {
+			return invalidField(
+				fmt.Sprintf("striprequestheaders[%d]", i),
+				"%v", err,
+			)
+		}
+	}
+	if err := validateHeaderRules(s.ResponseHeaders); err != nil {
+		return invalidField("responseheaders", "%v", err)
+	}
+
+	_, err := parseForwardClientHeaders(s.ForwardClientHeaders)
+	if err != nil {
+		return invalidField("forwardclientheaders", "%v", err)
+	}
+
+	_, err = parseTLSRenegotiation(s.BackendTLSRenegotiation)
+	if err != nil {
+		return invalidField("backendtlsrenegotiation", "%v", err)
+	}
+
+	if err := s.Backend.validate(); err != nil {
+		return nestedField("backend", err)
+	}
+
+	if s.BackendDialTimeout < 0 {
+		return invalidField("backenddialtimeout", "cannot be negative")
+	}
+
+	if s.BackendResponseHeaderTimeout < 0 {
+		return invalidField(
+			"backendresponseheadertimeout", "cannot be negative",
+		)
+	}
+
+	if s.BackendTimeout < 0 {
+		return invalidField("backendtimeout", "cannot be negative")
+	}
+
+	if s.ProgressInterval < 0 {
+		return invalidField("progressinterval", "cannot be negative")
+	}
+
+	if s.MaxRequestSize < 0 {
+		return invalidField("maxrequestsize", "cannot be negative")
+	}
+
+	if s.MaxBodyBytes < 0 {
+		return invalidField("maxbodybytes", "cannot be negative")
+	}
+
+	if err := s.ChaosMode.validate(); err != nil {
+		return nestedField("chaosmode", err)
+	}
+
+	if s.LatencyInjection != nil {
+		if err := s.LatencyInjection.validate(); err != nil {
+			return nestedField("latencyinjection", err)
+		}
+	}
+
+	switch s.AuthMode {
+	case "", AuthModeLSAT, AuthModeNone:
+
+	case AuthModeJWT:
+		if s.Auth.IsFreebie() {
+			return invalidField("auth", "freebies require authmode "+
+				"%s", AuthModeLSAT)
+		}
+
+	default:
+		return invalidField("authmode", "must be one of %s, %s or %s",
+			AuthModeLSAT, AuthModeJWT, AuthModeNone)
+	}
+
+	if s.CircuitBreaker != nil {
+		if err := s.CircuitBreaker.validate(); err != nil {
+			return nestedField("circuitbreaker", err)
+		}
+	}
+
+	if s.TokenExpiry < 0 {
+		return invalidField("tokenexpiry", "cannot be negative")
+	}
+
+	if s.RefreshQuota > 0 && s.TokenExpiry == 0 {
+		return invalidField("refreshquota", "requires tokenexpiry to "+
+			"be set")
+	}
+
+	if s.FeeBufferPercent > 0 && !s.DynamicFeePricing {
+		return invalidField("feebufferpercent", "requires "+
+			"dynamicfeepricing to be enabled")
+	}
+
+	if s.DynamicPrice.Enabled {
+		if s.DynamicPrice.GRPCAddress == "" {
+			return invalidField("dynamicprice.grpcaddress",
+				"required when dynamic prices are enabled")
+		}
+
+		return nil
+	}
+
+	switch {
+	case s.Price < 0:
+		return invalidField("price", "cannot be negative")
+
+	case s.Price > maxServicePrice:
+		return invalidField("price", "cannot exceed the maximum of "+
+			"%d satoshis", int64(maxServicePrice))
+	}
+
+	return nil
+}
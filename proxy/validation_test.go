@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/pricer"
+	"github.com/stretchr/testify/require"
+)
+
+// TestValidateServices makes sure invalid service settings are reported with
+// the service and the path of the field they were found in.
+func TestValidateServices(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		service Service
+		field   string
+	}{{
+		name:    "valid",
+		service: Service{HostRegexp: ".*", Price: 10},
+	}, {
+		name:    "invalid path regexp",
+		service: Service{PathRegexp: "^/api/("},
+		field:   "pathregexp",
+	}, {
+		name: "invalid whitelist entry",
+		service: Service{
+			AuthWhitelistPaths: []string{"^/ok$", "^/bad/("},
+		},
+		field: "authwhitelistpaths[1]",
+	}, {
+		name: "invalid header file directive",
+		service: Service{
+			Headers: map[string]string{"X-Key": "!file+gzip:key"},
+		},
+		field: "headers.X-Key",
+	}, {
+		name:    "queue without concurrency limit",
+		service: Service{MaxQueueDepth: 5},
+		field:   "maxqueuedepth",
+	}, {
+		name: "caveat without value",
+		service: Service{
+			Caveats: []string{"region=eu-west", "user_tier"},
+		},
+		field: "caveats[1]",
+	}, {
+		name:    "reserved caveat",
+		service: Service{Caveats: []string{"svc_capabilities=all"}},
+		field:   "caveats[0]",
+	}, {
+		name: "negative srv refresh interval",
+		service: Service{
+			Backend: BackendConfig{
+				SRVName:            "_http._tcp.example.com",
+				SRVRefreshInterval: -time.Second,
+			},
+		},
+		field: "backend.srvrefreshinterval",
+	}, {
+		name: "invalid static response status",
+		service: Service{
+			StaticResponse: &StaticResponse{StatusCode: 42},
+		},
+		field: "staticresponse.statuscode",
+	}, {
+		name: "invalid latency jitter",
+		service: Service{
+			LatencyInjection: &LatencyInjection{
+				DelayMs:  10,
+				JitterMs: 100,
+			},
+		},
+		field: "latencyinjection.jitterms",
+	}, {
+		name:    "unknown auth mode",
+		service: Service{AuthMode: "oauth"},
+		field:   "authmode",
+	}, {
+		name:    "freebies with jwt auth",
+		service: Service{Auth: "freebie 3", AuthMode: AuthModeJWT},
+		field:   "auth",
+	}, {
+		name: "circuit breaker without threshold",
+		service: Service{
+			CircuitBreaker: &CircuitBreaker{
+				OpenDuration: time.Second,
+			},
+		},
+		field: "circuitbreaker.threshold",
+	}, {
+		name:    "refresh quota without expiry",
+		service: Service{RefreshQuota: 3},
+		field:   "refreshquota",
+	}, {
+		name: "negative slo recovery duration",
+		service: Service{
+			SLOErrorRateThreshold: 0.5,
+			SLORecoveryDuration:   -time.Second,
+		},
+		field: "slorecoveryduration",
+	}, {
+		name: "dynamic price without address",
+		service: Service{
+			DynamicPrice: pricer.Config{Enabled: true},
+		},
+		field: "dynamicprice.grpcaddress",
+	}, {
+		name:    "negative price",
+		service: Service{Price: -1},
+		field:   "price",
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			service := tc.service
+			service.Name = "svc"
+			err := ValidateServices([]*Service{
+				{Name: "other"}, &service,
+			})
+			if tc.field == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			var validationErr *ValidationError
+			require.True(t, errors.As(err, &validationErr))
+			require.Equal(t, "svc", validationErr.Service)
+			require.Equal(t, 1, validationErr.Index)
+			require.Equal(t, tc.field, validationErr.Field)
+			require.NotEmpty(t, validationErr.Reason)
+			require.Contains(t, err.Error(), tc.field)
+		})
+	}
+}
+
+// TestValidationErrorMessage makes sure the error message points to the
+// invalid setting, including its position if known.
+func TestValidationErrorMessage(t *testing.T) {
+	t.Parallel()
+
+	err := &ValidationError{
+		Index:  2,
+		Field:  "price",
+		Reason: "cannot be negative",
+	}
+	require.Equal(
+		t, "invalid config of service #3, field price: cannot be "+
+			"negative", err.Error(),
+	)
+
+	err.Service = "svc"
+	err.Line, err.Column = 12, 5
+	require.Equal(
+		t, `invalid config of service "svc", field price (line 12, `+
+			`column 5): cannot be negative`, err.Error(),
+	)
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"golang.org/x/net/http/httpguts"
+)
+
+var (
+	// upgradeAuthInterval is the interval at which the credentials of
+	// upgraded connections are verified again.
+	upgradeAuthInterval = time.Minute
+)
+
+// isUpgradeRequest returns true if the client asks to switch the connection of
+// the request to another protocol, like WebSocket. The reverse proxy tunnels
+// upgraded connections to the backend once it agrees to the switch.
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" &&
+		httpguts.HeaderValuesContainsToken(
+			r.Header["Connection"], "Upgrade",
+		)
+}
+
+// watchUpgradeAuth returns a copy of the upgrade request whose context is
+// canceled once the credentials it carries no longer authenticate the client
+// to the given resource, if the authenticator can tell. Canceling the context
+// tears down the tunnel to the backend. The returned function stops watching
+// the credentials and must be called once the request is done.
+func watchUpgradeAuth(r *http.Request, authenticator auth.Authenticator,
+	resourceName string) (*http.Request, func()) {
+
+	verifier, ok := authenticator.(auth.SessionVerifier)
+	if !ok {
+		return r, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	header := r.Header.Clone()
+	ticker := time.NewTicker(upgradeAuthInterval)
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			err := verifier.VerifySession(&header, resourceName)
+			if err != nil {
+				log.Infof("Closing upgraded connection for "+
+					"%s, authentication failed: %v",
+					resourceName, err)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return r.WithContext(ctx), cancel
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+// revocableAuthenticator is a mock authenticator whose sessions can be
+// revoked.
+type revocableAuthenticator struct {
+	*auth.MockAuthenticator
+
+	revoked int32
+}
+
+// VerifySession returns an error once the sessions were revoked.
+//
+// NOTE: This is part of the auth.SessionVerifier interface.
+func (a *revocableAuthenticator) VerifySession(*http.Header, string) error {
+	if atomic.LoadInt32(&a.revoked) == 1 {
+		return errors.New("revoked")
+	}
+
+	return nil
+}
+
+// TestWebSocketProxy makes sure WebSocket connections are tunneled to the
+// backend once the client is authenticated, and that the tunnel is torn down
+// when the client's credentials become invalid or either side goes away.
+func TestWebSocketProxy(t *testing.T) {
+	defaultInterval := upgradeAuthInterval
+	upgradeAuthInterval = 10 * time.Millisecond
+	defer func() {
+		upgradeAuthInterval = defaultInterval
+	}()
+
+	// The backend echoes all messages and reports when a connection is
+	// closed.
+	closed := make(chan struct{}, 1)
+	backend := httptest.NewServer(websocket.Handler(
+		func(c *websocket.Conn) {
+			defer func() {
+				closed <- struct{}{}
+			}()
+
+			var msg string
+			for websocket.Message.Receive(c, &msg) == nil {
+				err := websocket.Message.Send(c, "echo "+msg)
+				if err != nil {
+					return
+				}
+			}
+		},
+	))
+	defer backend.Close()
+
+	authenticator := &revocableAuthenticator{
+		MockAuthenticator: auth.NewMockAuthenticator(),
+	}
+	p, err := New(authenticator, []*Service{{
+		Name:       "websocket",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		Protocol:   "http",
+		HostRegexp: ".*",
+		Auth:       "on",
+		Price:      1,
+
+		// The upgrade requests must not be coalesced.
+		EnableCoalescing: true,
+		CoalescingWindow: time.Second,
+	}})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	dial := func(authenticated bool) (*websocket.Conn, error) {
+		cfg, err := websocket.NewConfig(
+			"ws"+strings.TrimPrefix(server.URL, "http")+"/",
+			"http://localhost/",
+		)
+		require.NoError(t, err)
+		if authenticated {
+			cfg.Header.Set("Authorization", "LSAT foo:bar")
+		}
+
+		return websocket.DialConfig(cfg)
+	}
+
+	waitClosed := func() {
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("backend connection not closed")
+		}
+	}
+
+	// Unauthenticated clients are challenged instead of being connected
+	// to the backend.
+	_, err = dial(false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bad status")
+
+	// Authenticated clients can talk to the backend until they close the
+	// connection.
+	conn, err := dial(true)
+	require.NoError(t, err)
+
+	var msg string
+	for _, sent := range []string{"hello", "world"} {
+		require.NoError(t, websocket.Message.Send(conn, sent))
+		require.NoError(t, websocket.Message.Receive(conn, &msg))
+		require.Equal(t, "echo "+sent, msg)
+	}
+
+	require.NoError(t, conn.Close())
+	waitClosed()
+
+	// Once the client's credentials are no longer valid, the connection
+	// is closed on both sides.
+	conn, err = dial(true)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, websocket.Message.Send(conn, "hello"))
+	require.NoError(t, websocket.Message.Receive(conn, &msg))
+
+	atomic.StoreInt32(&authenticator.revoked, 1)
+	waitClosed()
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	err = websocket.Message.Receive(conn, &msg)
+	require.Error(t, err)
+	require.False(t, isTimeout(err))
+}
+
+// isTimeout returns true if the given error is a network timeout.
+func isTimeout(err error) bool {
+	var netErr interface{ Timeout() bool }
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
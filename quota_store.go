@@ -0,0 +1,90 @@
+package aperture
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// refreshesPrefix is the key we'll use to prefix all LSAT token IDs
+	// with when storing how often they were refreshed in an etcd cluster.
+	refreshesPrefix = "refreshes"
+)
+
+// refreshesKey returns the full key to store the number of refreshes of the
+// LSAT with the given token ID under.
+//
+// The resulting path of the token ID bff4ee83 within etcd would look like:
+//
+//	lsat/proxy/refreshes/bff4ee83
+func refreshesKey(id lsat.TokenID) string {
+	return strings.Join(
+		[]string{topLevelKey, refreshesPrefix, id.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// quotaStore keeps track of LSAT refreshes in an etcd cluster.
+type quotaStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure quotaStore implements mint.QuotaStore.
+var _ mint.QuotaStore = (*quotaStore)(nil)
+
+// newQuotaStore instantiates a new LSAT refresh quota store backed by an etcd
+// cluster.
+func newQuotaStore(client *clientv3.Client) *quotaStore {
+	return &quotaStore{Client: client}
+}
+
+// ConsumeQuota uses up one refresh of the LSAT with the given ID. If the LSAT
+// was already refreshed quota times, mint.ErrQuotaExhausted is returned.
+//
+// NOTE: This is part of the mint.QuotaStore interface.
+func (s *quotaStore) ConsumeQuota(ctx context.Context, id lsat.TokenID,
+	quota uint32) error {
+
+	key := refreshesKey(id)
+	for {
+		resp, err := s.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		var (
+			used     uint64
+			revision int64
+		)
+		if len(resp.Kvs) > 0 {
+			used, err = strconv.ParseUint(
+				string(resp.Kvs[0].Value), 10, 32,
+			)
+			if err != nil {
+				return err
+			}
+			revision = resp.Kvs[0].ModRevision
+		}
+		if used >= uint64(quota) {
+			return mint.ErrQuotaExhausted
+		}
+
+		// Only count the refresh if no concurrent one was counted since
+		// we looked, otherwise try again.
+		txnResp, err := s.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+			Then(clientv3.OpPut(key, strconv.FormatUint(used+1, 10))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txnResp.Succeeded {
+			return nil
+		}
+	}
+}
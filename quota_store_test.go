@@ -0,0 +1,36 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/stretchr/testify/require"
+)
+
+// TestQuotaStore ensures LSATs can only be refreshed as often as their quota
+// allows and that their refreshes are counted separately.
+func TestQuotaStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	store := newQuotaStore(etcdClient)
+
+	id := lsat.TokenID{1}
+	require.NoError(t, store.ConsumeQuota(ctx, id, 2))
+	require.NoError(t, store.ConsumeQuota(ctx, id, 2))
+	require.Equal(t, mint.ErrQuotaExhausted, store.ConsumeQuota(ctx, id, 2))
+
+	// A higher quota allows refreshing again.
+	require.NoError(t, store.ConsumeQuota(ctx, id, 3))
+
+	// Another LSAT has its own quota, which can also be zero.
+	otherID := lsat.TokenID{2}
+	require.Equal(
+		t, mint.ErrQuotaExhausted, store.ConsumeQuota(ctx, otherID, 0),
+	)
+	require.NoError(t, store.ConsumeQuota(ctx, otherID, 1))
+}
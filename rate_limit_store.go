@@ -0,0 +1,175 @@
+package aperture
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// rateLimitsPrefix is the key we'll use to prefix the token buckets of
+	// the services' rate limits with when storing them in an etcd cluster.
+	rateLimitsPrefix = "ratelimits"
+
+	// minRateLimitLeaseTTL is the minimum TTL of the leases the token
+	// buckets are stored with. Buckets are stored with the same lease
+	// until it's about to expire, so we don't need to grant one for every
+	// request.
+	minRateLimitLeaseTTL = time.Minute
+)
+
+// rateLimitKey returns the full key to store the token bucket with the given
+// name under.
+//
+// The resulting path of the bucket of the service service1 within etcd would
+// look like:
+//
+//	lsat/proxy/ratelimits/service1
+func rateLimitKey(bucket string) string {
+	return strings.Join(
+		[]string{topLevelKey, rateLimitsPrefix, bucket},
+		etcdKeyDelimeter,
+	)
+}
+
+// rateLimitStore keeps the token buckets of the services' rate limits in an
+// etcd cluster, so they are shared by all aperture instances.
+//
+// Instead of the number of tokens, each bucket stores the time at which it'll
+// be full again, as nanoseconds since the Unix epoch. A token can be taken if
+// the bucket is full again no later than burst intervals from now, which moves
+// that time one interval further into the future. Buckets are removed with
+// their lease once they're full again, as a missing bucket is a full one.
+type rateLimitStore struct {
+	*clientv3.Client
+
+	// now returns the current time. It can be replaced in tests.
+	now func() time.Time
+
+	mtx         sync.Mutex
+	lease       clientv3.LeaseID
+	leaseExpiry time.Time
+}
+
+// A compile-time constraint to ensure rateLimitStore implements
+// proxy.RateLimitStore.
+var _ proxy.RateLimitStore = (*rateLimitStore)(nil)
+
+// newRateLimitStore instantiates a new rate limit store backed by an etcd
+// cluster.
+func newRateLimitStore(client *clientv3.Client) *rateLimitStore {
+	return &rateLimitStore{
+		Client: client,
+		now:    time.Now,
+	}
+}
+
+// TakeToken takes a token from the bucket with the given name. The bucket
+// holds up to burst tokens and gets a new one every interval. If it is empty,
+// false is returned along with the time until the next token is added.
+//
+// NOTE: This is part of the proxy.RateLimitStore interface.
+func (s *rateLimitStore) TakeToken(ctx context.Context, bucket string,
+	interval time.Duration, burst int) (bool, time.Duration, error) {
+
+	key := rateLimitKey(bucket)
+	window := interval * time.Duration(burst)
+	for {
+		resp, err := s.Get(ctx, key)
+		if err != nil {
+			return false, 0, err
+		}
+
+		now := s.now()
+		fullAt := now
+		var revision int64
+		if len(resp.Kvs) > 0 {
+			nanos, err := strconv.ParseInt(
+				string(resp.Kvs[0].Value), 10, 64,
+			)
+			if err != nil {
+				return false, 0, err
+			}
+			if stored := time.Unix(0, nanos); stored.After(now) {
+				fullAt = stored
+			}
+			revision = resp.Kvs[0].ModRevision
+		}
+
+		fullAt = fullAt.Add(interval)
+		if delay := fullAt.Sub(now) - window; delay > 0 {
+			return false, delay, nil
+		}
+
+		lease, err := s.leaseUntil(ctx, fullAt)
+		if err != nil {
+			return false, 0, err
+		}
+
+		// Only take the token if no other instance took one since we
+		// looked, otherwise try again.
+		cmp := clientv3.Compare(
+			clientv3.ModRevision(key), "=", revision,
+		)
+		put := clientv3.OpPut(
+			key, strconv.FormatInt(fullAt.UnixNano(), 10),
+			clientv3.WithLease(lease),
+		)
+		txnResp, err := s.Txn(ctx).If(cmp).Then(put).Commit()
+		if err != nil {
+			// The lease might have been lost, so we grant a new
+			// one next time.
+			s.resetLease()
+			return false, 0, err
+		}
+		if txnResp.Succeeded {
+			return true, 0, nil
+		}
+	}
+}
+
+// leaseUntil returns a lease that doesn't expire before the given time,
+// granting a new one if the current one does.
+func (s *rateLimitStore) leaseUntil(ctx context.Context,
+	t time.Time) (clientv3.LeaseID, error) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.lease != clientv3.NoLease && s.leaseExpiry.After(t) {
+		return s.lease, nil
+	}
+
+	// Leases can only be granted for whole seconds, so we'd rather keep a
+	// bucket a little longer than needed.
+	ttl := t.Sub(s.now())
+	if ttl < minRateLimitLeaseTTL {
+		ttl = minRateLimitLeaseTTL
+	}
+	seconds := int64(math.Ceil(ttl.Seconds()))
+
+	start := s.now()
+	lease, err := s.Grant(ctx, seconds)
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+
+	s.lease = lease.ID
+	s.leaseExpiry = start.Add(time.Duration(seconds) * time.Second)
+
+	return s.lease, nil
+}
+
+// resetLease forgets the current lease.
+func (s *rateLimitStore) resetLease() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.lease = clientv3.NoLease
+}
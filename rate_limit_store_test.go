@@ -0,0 +1,67 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// TestRateLimitStore ensures the token buckets in etcd are shared by all stores
+// and refilled at their rate.
+func TestRateLimitStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	now := time.Now()
+	clock := func() time.Time {
+		return now
+	}
+
+	// Two stores backed by the same etcd cluster, like two aperture
+	// instances, take their tokens from the same bucket.
+	store := newRateLimitStore(etcdClient)
+	store.now = clock
+	other := newRateLimitStore(etcdClient)
+	other.now = clock
+
+	interval := 500 * time.Millisecond
+	for _, s := range []*rateLimitStore{store, other, store} {
+		ok, _, err := s.TakeToken(ctx, "service", interval, 3)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	ok, delay, err := other.TakeToken(ctx, "service", interval, 3)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, interval, delay)
+
+	// Other buckets are unaffected.
+	ok, _, err = store.TakeToken(ctx, "other", interval, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// A new token is added after an interval.
+	now = now.Add(interval)
+	ok, _, err = other.TakeToken(ctx, "service", interval, 3)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, _, err = store.TakeToken(ctx, "service", interval, 3)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// The bucket is stored with a lease, so it's removed eventually.
+	resp, err := etcdClient.Get(ctx, rateLimitKey("service"))
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	ttl, err := etcdClient.TimeToLive(
+		ctx, clientv3.LeaseID(resp.Kvs[0].Lease),
+	)
+	require.NoError(t, err)
+	require.InDelta(t, minRateLimitLeaseTTL.Seconds(), float64(ttl.TTL), 5)
+}
@@ -0,0 +1,411 @@
+package aperture
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/lndclient"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/wtclientrpc"
+	"github.com/redis/go-redis/v9"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// readinessPath is the path at which load balancers and orchestrators
+	// can find out whether aperture is ready to serve requests.
+	readinessPath = "/readyz"
+
+	// healthPath is the path at which liveness probes find out whether the
+	// aperture process is still alive. It is always answered with 200, so
+	// aperture isn't restarted just because a dependency is unavailable.
+	healthPath = "/healthz"
+
+	// readinessCheckInterval is the interval at which the readiness
+	// checks are repeated until all of them pass.
+	readinessCheckInterval = time.Second
+
+	// readinessRecheckInterval is the interval at which the readiness
+	// checks are repeated once aperture is ready, to stop receiving
+	// requests while a dependency is unavailable.
+	readinessRecheckInterval = 10 * time.Second
+
+	// readinessCheckTimeout is the maximum time a single readiness check
+	// may take.
+	readinessCheckTimeout = 5 * time.Second
+
+	// alertKeyDependencyPrefix is the prefix of the deduplication keys used
+	// for alerts about a dependency, like etcd or the secret store, that
+	// became unavailable. The name of the dependency is appended.
+	alertKeyDependencyPrefix = "aperture-dependency-"
+)
+
+// readinessCheck is a named check that must pass before aperture is ready to
+// serve requests.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+
+	// alertKey is the deduplication key of the alert that is triggered
+	// if the check starts failing once aperture is ready. No alert is
+	// triggered if it is empty, for example because the component the
+	// check is about already raises alerts of its own.
+	alertKey string
+}
+
+// readinessGate keeps track of whether aperture is ready to serve requests and
+// answers readiness and liveness probes accordingly.
+type readinessGate struct {
+	ready chan struct{}
+	once  sync.Once
+
+	// failure is the error of the last failed readiness check after
+	// aperture became ready, or nil if all of them passed.
+	failure error
+	mtx     sync.Mutex
+}
+
+// newReadinessGate creates a new gate that isn't ready yet.
+func newReadinessGate() *readinessGate {
+	return &readinessGate{
+		ready: make(chan struct{}),
+	}
+}
+
+// markReady signals that aperture is ready to serve requests.
+func (g *readinessGate) markReady() {
+	g.once.Do(func() {
+		close(g.ready)
+	})
+}
+
+// isReady returns true if aperture is ready to serve requests, which it is
+// once all readiness checks passed and as long as they keep passing.
+func (g *readinessGate) isReady() bool {
+	select {
+	case <-g.ready:
+	default:
+		return false
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	return g.failure == nil
+}
+
+// setFailure records the result of the last readiness checks, logging when it
+// changes whether aperture is ready.
+func (g *readinessGate) setFailure(err error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	switch {
+	case err != nil && g.failure == nil:
+		log.Warnf("Not ready to serve requests anymore: %v", err)
+
+	case err == nil && g.failure != nil:
+		log.Infof("Ready to serve requests again.")
+	}
+	g.failure = err
+}
+
+// wrap returns a handler that answers readiness and liveness probes and passes
+// all other requests on to the given handler. The probes are answered before
+// the requests are authenticated.
+func (g *readinessGate) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case healthPath:
+
+		case readinessPath:
+			if !g.isReady() {
+				http.Error(
+					w, "not ready",
+					http.StatusServiceUnavailable,
+				)
+				return
+			}
+
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+// wait runs the given checks at the readiness check interval until all of
+// them passed and marks the gate as ready. False is returned if the quit
+// channel was closed before.
+func (g *readinessGate) wait(checks []readinessCheck,
+	quit <-chan struct{}) bool {
+
+	ticker := time.NewTicker(readinessCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		err := runReadinessChecks(checks)
+		if err == nil {
+			g.markReady()
+			return true
+		}
+		log.Infof("Not ready to serve requests yet: %v", err)
+
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return false
+		}
+	}
+}
+
+// monitor repeats the given checks at the readiness recheck interval until the
+// quit channel is closed, so readiness probes fail while one of them does. An
+// alert is triggered for every check with an alert key that starts failing and
+// resolved once it passes again.
+func (g *readinessGate) monitor(checks []readinessCheck,
+	triggerAlert func(*alert), resolveAlert func(string),
+	quit <-chan struct{}) {
+
+	ticker := time.NewTicker(readinessRecheckInterval)
+	defer ticker.Stop()
+
+	failing := make(map[string]bool)
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		g.setFailure(recheckReadiness(
+			checks, failing, triggerAlert, resolveAlert,
+		))
+	}
+}
+
+// recheckReadiness runs all given checks and returns the error of the first one
+// that failed. The checks with an alert key that failed are tracked in the
+// given map, so their alert is only triggered when they start failing and
+// resolved when they pass again.
+func recheckReadiness(checks []readinessCheck, failing map[string]bool,
+	triggerAlert func(*alert), resolveAlert func(string)) error {
+
+	var firstErr error
+	for _, c := range checks {
+		err := runReadinessChecks([]readinessCheck{c})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		if c.alertKey == "" {
+			continue
+		}
+
+		switch {
+		case err != nil && !failing[c.alertKey]:
+			failing[c.alertKey] = true
+			triggerAlert(&alert{
+				key:      c.alertKey,
+				summary:  err.Error(),
+				severity: severityCritical,
+			})
+
+		case err == nil && failing[c.alertKey]:
+			delete(failing, c.alertKey)
+			resolveAlert(c.alertKey)
+		}
+	}
+
+	return firstErr
+}
+
+// runReadinessChecks runs all given checks and returns the error of the first
+// one that failed.
+func runReadinessChecks(checks []readinessCheck) error {
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), readinessCheckTimeout,
+		)
+		err := c.check(ctx)
+		cancel()
+
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.name, err)
+		}
+	}
+
+	return nil
+}
+
+// etcdReadinessCheck makes sure at least one etcd endpoint responds.
+func etcdReadinessCheck(client *clientv3.Client) readinessCheck {
+	return readinessCheck{
+		name:     "etcd",
+		alertKey: alertKeyDependencyPrefix + "etcd",
+		check: func(ctx context.Context) error {
+			var lastErr error
+			for _, endpoint := range client.Endpoints() {
+				_, lastErr = client.Status(ctx, endpoint)
+				if lastErr == nil {
+					return nil
+				}
+			}
+			if lastErr == nil {
+				lastErr = errors.New("no endpoints")
+			}
+
+			return lastErr
+		},
+	}
+}
+
+// secretStoreReadinessCheck makes sure the LSAT secrets can be read.
+func secretStoreReadinessCheck(client *clientv3.Client) readinessCheck {
+	prefix := strings.Join(
+		[]string{topLevelKey, secretsPrefix}, etcdKeyDelimeter,
+	)
+
+	return readinessCheck{
+		name:     "secret store",
+		alertKey: alertKeyDependencyPrefix + "secret-store",
+		check: func(ctx context.Context) error {
+			_, err := client.Get(
+				ctx, prefix, clientv3.WithPrefix(),
+				clientv3.WithCountOnly(),
+			)
+			return err
+		},
+	}
+}
+
+// redisReadinessCheck makes sure Redis, which stores the LSAT secrets if it is
+// configured, can be reached.
+func redisReadinessCheck(client *redis.Client) readinessCheck {
+	return readinessCheck{
+		name: "redis",
+		check: func(ctx context.Context) error {
+			return client.Ping(ctx).Err()
+		},
+		alertKey: alertKeyDependencyPrefix + "redis",
+	}
+}
+
+// sqliteReadinessCheck makes sure the SQLite database, which stores the LSAT
+// secrets if it is configured, can be used.
+func sqliteReadinessCheck(db *sql.DB) readinessCheck {
+	return readinessCheck{
+		name:     "sqlite",
+		check:    db.PingContext,
+		alertKey: alertKeyDependencyPrefix + "sqlite",
+	}
+}
+
+// lndReadinessCheck makes sure at least one of the lnd nodes the challenger
+// uses answers a GetInfo call and has the configured minimum of active
+// watchtower sessions. This requires the read-only macaroon, as the invoice
+// macaroon lacks the permission to do so. Nodes whose read-only macaroon can't
+// be loaded are instead queried for an invoice with the invoice macaroon the
+// challenger uses, which fails if that can't be loaded either. No alert is
+// triggered if the check fails, as the challenger alerts about every node it
+// loses the connection to.
+func lndReadinessCheck(cfgs []*AuthConfig) readinessCheck {
+	return readinessCheck{
+		name: "lnd",
+		check: func(ctx context.Context) error {
+			var lastErr error
+			for _, cfg := range cfgs {
+				lastErr = lndReady(ctx, cfg)
+				if lastErr == nil {
+					return nil
+				}
+			}
+
+			return lastErr
+		},
+	}
+}
+
+// lndReady calls GetInfo on the lnd node described by the given config and
+// makes sure it has enough active watchtower sessions, if required.
+func lndReady(ctx context.Context, cfg *AuthConfig) error {
+	conn, err := lndclient.NewBasicConn(
+		cfg.LndHost, cfg.TLSPath, cfg.MacDir, cfg.Network,
+		lndclient.MacFilename(readonlyMacaroonName),
+	)
+	if err != nil {
+		// The number of watchtower sessions can only be verified with
+		// the read-only macaroon.
+		if cfg.MinWatchtowerSessions > 0 {
+			return fmt.Errorf("unable to load read-only macaroon "+
+				"of lnd %s: %v", cfg.LndHost, err)
+		}
+
+		log.Debugf("Unable to load read-only macaroon of lnd %s, "+
+			"using invoice macaroon: %v", cfg.LndHost, err)
+
+		return lndInvoicesReady(ctx, cfg)
+	}
+	defer conn.Close()
+
+	client := lnrpc.NewLightningClient(conn)
+	_, err = client.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	if err != nil {
+		return fmt.Errorf("unable to get info of lnd %s: %v",
+			cfg.LndHost, err)
+	}
+
+	if cfg.MinWatchtowerSessions == 0 {
+		return nil
+	}
+
+	active, err := activeWatchtowerSessions(
+		ctx, wtclientrpc.NewWatchtowerClientClient(conn),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to list watchtowers of lnd %s: %v",
+			cfg.LndHost, err)
+	}
+	if active < cfg.MinWatchtowerSessions {
+		return fmt.Errorf("lnd %s has %d active watchtower sessions, "+
+			"need %d", cfg.LndHost, active,
+			cfg.MinWatchtowerSessions)
+	}
+
+	return nil
+}
+
+// lndInvoicesReady makes sure the lnd node described by the given config can
+// be queried for invoices with the invoice macaroon the challenger uses.
+func lndInvoicesReady(ctx context.Context, cfg *AuthConfig) error {
+	conn, err := lndclient.NewBasicConn(
+		cfg.LndHost, cfg.TLSPath, cfg.MacDir, cfg.Network,
+		lndclient.MacFilename(invoiceMacaroonName),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to connect to lnd %s: %v",
+			cfg.LndHost, err)
+	}
+	defer conn.Close()
+
+	client := lnrpc.NewLightningClient(conn)
+	_, err = client.ListInvoices(ctx, &lnrpc.ListInvoiceRequest{
+		NumMaxInvoices: 1,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list invoices of lnd %s: %v",
+			cfg.LndHost, err)
+	}
+
+	return nil
+}
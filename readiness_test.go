@@ -0,0 +1,148 @@
+package aperture
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestReadinessGate makes sure readiness probes are only answered with 200 once
+// all checks passed and that other requests are passed through.
+func TestReadinessGate(t *testing.T) {
+	t.Parallel()
+
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	gate := newReadinessGate()
+	handler := gate.wrap(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		},
+	))
+	probe := func(path string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusServiceUnavailable, probe(readinessPath))
+	require.Equal(t, http.StatusOK, probe(healthPath))
+	require.Equal(t, http.StatusTeapot, probe("/other"))
+
+	// A failing check keeps the gate closed.
+	lndDown := readinessCheck{
+		name: "lnd",
+		check: func(context.Context) error {
+			return errors.New("unreachable")
+		},
+	}
+	checks := []readinessCheck{
+		etcdReadinessCheck(etcdClient),
+		secretStoreReadinessCheck(etcdClient),
+	}
+	err := runReadinessChecks(append(checks, lndDown))
+	require.EqualError(t, err, "lnd: unreachable")
+
+	// Once all checks pass, the gate opens.
+	quit := make(chan struct{})
+	require.True(t, gate.wait(checks, quit))
+	require.Equal(t, http.StatusOK, probe(readinessPath))
+
+	select {
+	case <-gate.ready:
+	default:
+		t.Fatal("gate not marked as ready")
+	}
+
+	// A dependency becoming unavailable later on fails readiness probes
+	// until it is back, while the process is still considered alive.
+	gate.setFailure(errors.New("lnd: unreachable"))
+	require.Equal(t, http.StatusServiceUnavailable, probe(readinessPath))
+	require.Equal(t, http.StatusOK, probe(healthPath))
+	gate.setFailure(nil)
+	require.Equal(t, http.StatusOK, probe(readinessPath))
+
+	// Waiting is aborted when shutting down.
+	close(quit)
+	require.False(t, newReadinessGate().wait(
+		[]readinessCheck{lndDown}, quit,
+	))
+}
+
+// TestReadinessAlerts makes sure an alert is triggered once a dependency
+// becomes unavailable and resolved when it is back, but only for checks that
+// have an alert key.
+func TestReadinessAlerts(t *testing.T) {
+	t.Parallel()
+
+	var (
+		etcdErr   error
+		failing   = make(map[string]bool)
+		triggered []string
+		resolved  []string
+	)
+	checks := []readinessCheck{{
+		name: "etcd",
+		check: func(context.Context) error {
+			return etcdErr
+		},
+		alertKey: alertKeyDependencyPrefix + "etcd",
+	}, {
+		name: "lnd",
+		check: func(context.Context) error {
+			return errors.New("unreachable")
+		},
+	}}
+	recheck := func() error {
+		return recheckReadiness(
+			checks, failing, func(al *alert) {
+				triggered = append(triggered, al.key)
+			}, func(key string) {
+				resolved = append(resolved, key)
+			},
+		)
+	}
+
+	// The lnd check fails without an alert, as it has no alert key.
+	require.EqualError(t, recheck(), "lnd: unreachable")
+	require.Empty(t, triggered)
+
+	// A failing check only triggers its alert once.
+	etcdErr = errors.New("timeout")
+	require.EqualError(t, recheck(), "etcd: timeout")
+	require.EqualError(t, recheck(), "etcd: timeout")
+	require.Equal(t, []string{"aperture-dependency-etcd"}, triggered)
+	require.Empty(t, resolved)
+
+	// And the alert is resolved once when it passes again.
+	etcdErr = nil
+	require.EqualError(t, recheck(), "lnd: unreachable")
+	require.EqualError(t, recheck(), "lnd: unreachable")
+	require.Equal(t, []string{"aperture-dependency-etcd"}, resolved)
+}
+
+// TestLndReadinessUnloadableMacaroon makes sure an lnd node isn't considered
+// ready if none of its macaroons can be loaded.
+func TestLndReadinessUnloadableMacaroon(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	check := lndReadinessCheck([]*AuthConfig{{
+		LndHost: "localhost:10009",
+		TLSPath: filepath.Join(dir, "tls.cert"),
+		MacDir:  dir,
+		Network: "regtest",
+	}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	require.Error(t, check.check(ctx))
+}
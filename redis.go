@@ -0,0 +1,154 @@
+package aperture
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisDialTimeout is the maximum time establishing a connection to
+	// Redis may take.
+	redisDialTimeout = 5 * time.Second
+
+	// redisRPCTimeout is the maximum time reading the reply to or writing
+	// a command may take.
+	redisRPCTimeout = 10 * time.Second
+
+	// redisMaxIdleConns is the number of connections kept open for later
+	// commands.
+	redisMaxIdleConns = 8
+)
+
+// RedisConfig is the configuration of the Redis server used instead of etcd to
+// store LSAT secrets and onion service private keys. All other state is still
+// kept in etcd.
+type RedisConfig struct {
+	// Host is the host:port of the Redis server. Redis is only used if it
+	// is set.
+	Host string `long:"host" description:"host:port of a Redis server to store LSAT secrets and onion service keys in instead of etcd; all other state is still kept in etcd"`
+
+	// User is the ACL user to authenticate as. The default user is used
+	// if it is empty.
+	User string `long:"user" description:"ACL user to authenticate to Redis as, the default user is used if empty"`
+
+	// Password authenticates the client if it isn't empty.
+	Password string `long:"password" description:"Password to authenticate to Redis with"`
+
+	// DB is the number of the database to use.
+	DB int `long:"db" description:"Number of the Redis database to use"`
+
+	// TLS enables TLS for the connections to Redis.
+	TLS bool `long:"tls" description:"Connect to Redis over TLS"`
+
+	// TLSCAPath is the path of the CA certificate the certificate of the
+	// server is verified with instead of the system's CAs.
+	TLSCAPath string `long:"tlscapath" description:"Path of the CA certificate to verify the Redis server's certificate with instead of the system's CAs"`
+
+	// TLSCertPath and TLSKeyPath are the paths of the certificate and
+	// key aperture authenticates to Redis with.
+	TLSCertPath string `long:"tlscertpath" description:"Path of the client certificate to authenticate to Redis with"`
+	TLSKeyPath  string `long:"tlskeypath" description:"Path of the key of the client certificate"`
+
+	// SecretExpiry is the time after which LSAT secrets are removed from
+	// Redis. The LSATs using them become invalid once they are removed.
+	// Secrets are kept forever if it is zero.
+	SecretExpiry time.Duration `long:"secretexpiry" description:"The time after which LSAT secrets expire, invalidating their LSATs; set to 0 to keep them forever"`
+}
+
+// enabled returns true if Redis is used instead of etcd.
+func (c *RedisConfig) enabled() bool {
+	return c != nil && c.Host != ""
+}
+
+// validate makes sure the Redis configuration is sane.
+func (c *RedisConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+
+	if c.DB < 0 {
+		return fmt.Errorf("redis db cannot be negative")
+	}
+	if c.SecretExpiry < 0 {
+		return fmt.Errorf("redis secret expiry cannot be negative")
+	}
+	if (c.TLSCertPath == "") != (c.TLSKeyPath == "") {
+		return fmt.Errorf("redis TLS client certificate and key must " +
+			"be set together")
+	}
+
+	return nil
+}
+
+// tlsConfig returns the TLS configuration of the connections to Redis or nil
+// if TLS isn't used.
+func (c *RedisConfig) tlsConfig() (*tls.Config, error) {
+	if !c.TLS {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSCAPath != "" {
+		caCert, err := ioutil.ReadFile(c.TLSCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read redis CA "+
+				"certificate: %v", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s",
+				c.TLSCAPath)
+		}
+	}
+	if c.TLSCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertPath, c.TLSKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load redis client "+
+				"certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// newRedisClient creates a client for the Redis server described by the given
+// config and makes sure the server can be reached with it. The client keeps a
+// pool of connections and reconnects if Redis drops one.
+func newRedisClient(cfg *RedisConfig) (*redis.Client, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:         cfg.Host,
+		Username:     cfg.User,
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		TLSConfig:    tlsConfig,
+		DialTimeout:  redisDialTimeout,
+		ReadTimeout:  redisRPCTimeout,
+		WriteTimeout: redisRPCTimeout,
+		MaxIdleConns: redisMaxIdleConns,
+	})
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), redisDialTimeout,
+	)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("unable to connect to redis: %v", err)
+	}
+
+	return client, nil
+}
@@ -0,0 +1,141 @@
+package aperture
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/tor"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisSecretStore is a store of LSAT secrets backed by a Redis server. The
+// secrets are stored under the same keys as in etcd.
+type RedisSecretStore struct {
+	client *redis.Client
+
+	// expiry is the time after which a secret is removed. Secrets are
+	// kept forever if it is zero.
+	expiry time.Duration
+}
+
+// A compile-time constraint to ensure RedisSecretStore implements
+// mint.SecretStore.
+var _ mint.SecretStore = (*RedisSecretStore)(nil)
+
+// newRedisSecretStore instantiates a new LSAT secrets store backed by Redis
+// that removes secrets after the given expiry.
+func newRedisSecretStore(client *redis.Client,
+	expiry time.Duration) *RedisSecretStore {
+
+	return &RedisSecretStore{client: client, expiry: expiry}
+}
+
+// NewSecret creates a new cryptographically random secret which is keyed by the
+// given hash.
+func (s *RedisSecretStore) NewSecret(ctx context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	var secret [lsat.SecretSize]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return secret, err
+	}
+
+	err := s.client.Set(ctx, idKey(id), secret[:], s.expiry).Err()
+	return secret, err
+}
+
+// GetSecret returns the cryptographically random secret that corresponds to the
+// given hash. If there is no secret, because it was revoked or expired, then
+// mint.ErrSecretNotFound is returned.
+func (s *RedisSecretStore) GetSecret(ctx context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	value, err := s.client.Get(ctx, idKey(id)).Bytes()
+	switch {
+	case err == redis.Nil:
+		return [lsat.SecretSize]byte{}, mint.ErrSecretNotFound
+
+	case err != nil:
+		return [lsat.SecretSize]byte{}, err
+	}
+	if len(value) != lsat.SecretSize {
+		return [lsat.SecretSize]byte{}, fmt.Errorf("invalid secret "+
+			"size %v", len(value))
+	}
+
+	var secret [lsat.SecretSize]byte
+	copy(secret[:], value)
+	return secret, nil
+}
+
+// RevokeSecret removes the cryptographically random secret that corresponds to
+// the given hash. This acts as a NOP if the secret does not exist.
+func (s *RedisSecretStore) RevokeSecret(ctx context.Context,
+	id [sha256.Size]byte) error {
+
+	return s.client.Del(ctx, idKey(id)).Err()
+}
+
+// RedisOnionStore is a Redis-based implementation of tor.OnionStore. The
+// private keys are stored under the same keys as in etcd and never expire.
+type RedisOnionStore struct {
+	client *redis.Client
+}
+
+// A compile-time constraint to ensure RedisOnionStore implements
+// tor.OnionStore.
+var _ tor.OnionStore = (*RedisOnionStore)(nil)
+
+// newRedisOnionStore creates a Redis-based implementation of tor.OnionStore.
+func newRedisOnionStore(client *redis.Client) *RedisOnionStore {
+	return &RedisOnionStore{client: client}
+}
+
+// StorePrivateKey stores the given private key.
+func (s *RedisOnionStore) StorePrivateKey(onionType tor.OnionType,
+	privateKey []byte) error {
+
+	onionPath, err := onionPath(onionType)
+	if err != nil {
+		return err
+	}
+
+	return s.client.Set(
+		context.Background(), onionPath, privateKey, 0,
+	).Err()
+}
+
+// PrivateKey retrieves a stored private key. If it is not found, then
+// ErrNoPrivateKey should be returned.
+func (s *RedisOnionStore) PrivateKey(onionType tor.OnionType) ([]byte, error) {
+	onionPath, err := onionPath(onionType)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := s.client.Get(context.Background(), onionPath).Bytes()
+	switch {
+	case err == redis.Nil:
+		return nil, tor.ErrNoPrivateKey
+
+	case err != nil:
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// DeletePrivateKey securely removes the private key from the store.
+func (s *RedisOnionStore) DeletePrivateKey(onionType tor.OnionType) error {
+	onionPath, err := onionPath(onionType)
+	if err != nil {
+		return err
+	}
+
+	return s.client.Del(context.Background(), onionPath).Err()
+}
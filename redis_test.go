@@ -0,0 +1,120 @@
+package aperture
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/tor"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRedisSecretStore makes sure LSAT secrets can be stored in Redis, that
+// they expire and that the client reconnects if Redis drops its connections.
+func TestRedisSecretStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireUserAuth("aperture", "secret")
+	cfg := &RedisConfig{
+		Host:         server.Addr(),
+		User:         "aperture",
+		Password:     "secret",
+		DB:           2,
+		SecretExpiry: time.Minute,
+	}
+
+	// Clients with the wrong password are rejected.
+	_, err := newRedisClient(&RedisConfig{
+		Host:     cfg.Host,
+		User:     cfg.User,
+		Password: "wrong",
+	})
+	require.Error(t, err)
+
+	client, err := newRedisClient(cfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	a := &Aperture{cfg: &Config{Redis: cfg}, redisClient: client}
+	store := a.secretStore().(*RedisSecretStore)
+
+	ctx := context.Background()
+	id := sha256.Sum256([]byte("id"))
+	_, err = store.GetSecret(ctx, id)
+	require.Equal(t, mint.ErrSecretNotFound, err)
+
+	secret, err := store.NewSecret(ctx, id)
+	require.NoError(t, err)
+	stored, err := store.GetSecret(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, secret, stored)
+
+	// The secret is stored in the configured database with the configured
+	// expiry under the same key as in etcd.
+	server.Select(2)
+	require.Equal(t, time.Minute, server.TTL(idKey(id)))
+
+	// After Redis dropped all connections, the client reconnects,
+	// authenticating and selecting the database again.
+	server.Restart()
+	stored, err = store.GetSecret(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, secret, stored)
+
+	require.NoError(t, store.RevokeSecret(ctx, id))
+	_, err = store.GetSecret(ctx, id)
+	require.Equal(t, mint.ErrSecretNotFound, err)
+
+	// Expired secrets can't be found anymore.
+	_, err = store.NewSecret(ctx, id)
+	require.NoError(t, err)
+	server.FastForward(time.Minute)
+	_, err = store.GetSecret(ctx, id)
+	require.Equal(t, mint.ErrSecretNotFound, err)
+}
+
+// TestRedisOnionStore makes sure onion service private keys can be stored in
+// Redis.
+func TestRedisOnionStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	cfg := &RedisConfig{Host: server.Addr()}
+
+	client, err := newRedisClient(cfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	a := &Aperture{cfg: &Config{Redis: cfg}, redisClient: client}
+	store := a.onionStore()
+
+	_, err = store.PrivateKey(tor.V3)
+	require.Equal(t, tor.ErrNoPrivateKey, err)
+
+	privateKey := []byte("hide_me_plz_v3")
+	require.NoError(t, store.StorePrivateKey(tor.V3, privateKey))
+	stored, err := store.PrivateKey(tor.V3)
+	require.NoError(t, err)
+	require.Equal(t, privateKey, stored)
+
+	// Onion service keys never expire.
+	onionPath, err := onionPath(tor.V3)
+	require.NoError(t, err)
+	require.Zero(t, server.TTL(onionPath))
+
+	require.NoError(t, store.DeletePrivateKey(tor.V3))
+	_, err = store.PrivateKey(tor.V3)
+	require.Equal(t, tor.ErrNoPrivateKey, err)
+}
+
+// TestRedisConfigValidation makes sure invalid Redis configurations are
+// rejected.
+func TestRedisConfigValidation(t *testing.T) {
+	require.NoError(t, (*RedisConfig)(nil).validate())
+
+	cfg := &RedisConfig{Host: "localhost:6379", DB: -1}
+	require.Error(t, cfg.validate())
+
+	cfg = &RedisConfig{Host: "localhost:6379", TLSCertPath: "client.crt"}
+	require.Contains(t, cfg.validate().Error(), "together")
+}
@@ -0,0 +1,129 @@
+package aperture
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// refreshPath is the path of the endpoint clients can renew a still
+	// valid LSAT at without paying for it again.
+	refreshPath = "/v1/auth/refresh"
+)
+
+// TokenRefresher is an interface for issuing a new LSAT in place of a still
+// valid one without requiring another payment.
+type TokenRefresher interface {
+	// Refresh issues a new LSAT with a fresh expiry for the given LSAT,
+	// which must still be valid. If it can't be refreshed anymore,
+	// mint.ErrQuotaExhausted is returned.
+	Refresh(ctx context.Context, mac *macaroon.Macaroon,
+		preimage lntypes.Preimage) (*macaroon.Macaroon, error)
+}
+
+// A compile time flag to ensure the mint satisfies the TokenRefresher
+// interface.
+var _ TokenRefresher = (*mint.Mint)(nil)
+
+// refreshResponse is the body of a successful refresh request.
+type refreshResponse struct {
+	// Macaroon is the base64 encoded macaroon of the refreshed LSAT.
+	Macaroon string `json:"macaroon"`
+
+	// Authorization is the value of the Authorization header clients need
+	// to send to authenticate with the refreshed LSAT.
+	Authorization string `json:"authorization"`
+}
+
+// refreshServer serves the endpoint that refreshes LSATs.
+type refreshServer struct {
+	refresher TokenRefresher
+
+	// enabled returns true if the LSATs of any current service can be
+	// refreshed.
+	enabled func() bool
+}
+
+// newRefreshServer creates a new server for the refresh endpoint that issues
+// new LSATs with the given refresher. The endpoint is only served while the
+// given function returns true.
+func newRefreshServer(refresher TokenRefresher,
+	enabled func() bool) *refreshServer {
+
+	return &refreshServer{
+		refresher: refresher,
+		enabled:   enabled,
+	}
+}
+
+// isHandling returns true if the given request is meant for the refresh
+// endpoint. While no LSATs can be refreshed, the path is left to the backends
+// so the endpoint doesn't shadow any of them.
+func (s *refreshServer) isHandling(r *http.Request) bool {
+	return r.URL.Path == refreshPath && s.enabled()
+}
+
+// ServeHTTP refreshes the LSAT the request is authenticated with and responds
+// with the new LSAT. No new invoice is created, the pre-image of the old LSAT
+// remains valid for the new one.
+func (s *refreshServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(
+			w, "method not allowed", http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	mac, preimage, err := lsat.FromHeader(&r.Header)
+	if err != nil {
+		http.Error(w, "invalid LSAT", http.StatusUnauthorized)
+		return
+	}
+
+	refreshed, err := s.refresher.Refresh(r.Context(), mac, preimage)
+	switch {
+	case err == nil:
+
+	case errors.Is(err, mint.ErrQuotaExhausted):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+
+	case errors.Is(err, mint.ErrTokenExpired):
+		w.Header().Set(auth.HeaderLSATError, auth.LSATErrorExpiredToken)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+
+	default:
+		log.Debugf("Unable to refresh LSAT: %v", err)
+		http.Error(w, "invalid LSAT", http.StatusUnauthorized)
+		return
+	}
+
+	macBytes, err := refreshed.MarshalBinary()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	macBase64 := base64.StdEncoding.EncodeToString(macBytes)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&refreshResponse{
+		Macaroon: macBase64,
+		Authorization: fmt.Sprintf(
+			"LSAT %s:%s", macBase64, preimage,
+		),
+	})
+	if err != nil {
+		log.Errorf("Unable to write refresh response: %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+)
+
+const (
+	// defaultServicesRefreshInterval is the default interval at which the
+	// services are fetched from the remote URL again.
+	defaultServicesRefreshInterval = time.Minute
+
+	// servicesRequestTimeout is the maximum time a single request for the
+	// remote services can take.
+	servicesRequestTimeout = 30 * time.Second
+
+	// maxServicesSize is the maximum size of the remote service list we
+	// accept.
+	maxServicesSize = 10 * 1024 * 1024
+)
+
+// remoteServices fetches the service configuration from a remote URL, like a
+// Kubernetes ConfigMap served over HTTP, and periodically fetches it again to
+// apply any changes without a restart.
+type remoteServices struct {
+	url             string
+	user            string
+	password        string
+	token           string
+	refreshInterval time.Duration
+	client          *http.Client
+
+	// update is called with the new services whenever they changed.
+	update func([]*proxy.Service) error
+
+	// last is the service list we fetched last, as it was returned by the
+	// remote URL. We only update the services if it changes, so changes
+	// made through the admin API are kept until the remote list changes.
+	last []byte
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newRemoteServices creates a new fetcher of the services configured at the
+// remote URL of the given config.
+func newRemoteServices(cfg *Config) *remoteServices {
+	refreshInterval := cfg.ServicesRefreshInterval
+	if refreshInterval == 0 {
+		refreshInterval = defaultServicesRefreshInterval
+	}
+
+	return &remoteServices{
+		url:             cfg.ServicesURL,
+		user:            cfg.ServicesUser,
+		password:        cfg.ServicesPassword,
+		token:           cfg.ServicesToken,
+		refreshInterval: refreshInterval,
+		client: &http.Client{
+			Timeout: servicesRequestTimeout,
+		},
+		quit: make(chan struct{}),
+	}
+}
+
+// Start starts the goroutine that periodically fetches the services and calls
+// the given function with them if they changed.
+func (r *remoteServices) Start(update func([]*proxy.Service) error) error {
+	log.Infof("Refreshing services from %s every %v", r.url,
+		r.refreshInterval)
+
+	r.update = update
+
+	r.wg.Add(1)
+	go r.refreshServices()
+
+	return nil
+}
+
+// Stop shuts down the refresh of the services.
+func (r *remoteServices) Stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
+
+// refreshServices fetches the services every time the refresh interval
+// elapses.
+//
+// NOTE: This must be run as a goroutine.
+func (r *remoteServices) refreshServices() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.quit:
+			return
+		}
+
+		if err := r.refresh(); err != nil {
+			log.Errorf("Unable to refresh services from %s: %v",
+				r.url, err)
+		}
+	}
+}
+
+// refresh fetches the services and updates them if they changed since they
+// were fetched last. The current services are kept if the new ones are
+// invalid.
+func (r *remoteServices) refresh() error {
+	encoded, services, err := r.fetch()
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(encoded, r.last) {
+		return nil
+	}
+
+	log.Infof("Services at %s changed, updating %d services", r.url,
+		len(services))
+	if err := r.update(services); err != nil {
+		return fmt.Errorf("unable to update services: %v", err)
+	}
+	r.last = encoded
+
+	return nil
+}
+
+// load fetches the services for the initial configuration.
+func (r *remoteServices) load() ([]*proxy.Service, error) {
+	encoded, services, err := r.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load services from %s: %v",
+			r.url, err)
+	}
+	r.last = encoded
+
+	return services, nil
+}
+
+// fetch requests the services from the remote URL and decodes them from the
+// same YAML format used in the services section of the configuration file.
+// The raw response is returned along with them.
+func (r *remoteServices) fetch() ([]byte, []*proxy.Service, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), servicesRequestTimeout,
+	)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, r.url, nil,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case r.token != "":
+		req.Header.Set("Authorization", "Bearer "+r.token)
+
+	case r.user != "":
+		req.SetBasicAuth(r.user, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %d",
+			resp.StatusCode)
+	}
+
+	encoded, err := ioutil.ReadAll(
+		io.LimitReader(resp.Body, maxServicesSize+1),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(encoded) > maxServicesSize {
+		return nil, nil, fmt.Errorf("service list exceeds %d bytes",
+			maxServicesSize)
+	}
+
+	services, err := decodeServices(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid service list: %v", err)
+	}
+	if err := proxy.ValidateServices(services); err != nil {
+		return nil, nil, fmt.Errorf("invalid service list: %v", err)
+	}
+
+	return encoded, services, nil
+}
@@ -0,0 +1,86 @@
+package aperture
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRemoteServices makes sure the services are loaded from the remote URL
+// with the configured credentials and only updated if they changed and are
+// valid.
+func TestRemoteServices(t *testing.T) {
+	var (
+		body   = "- name: service1\n  hostregexp: '.*'\n"
+		status = http.StatusOK
+		auth   string
+	)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			auth = r.Header.Get("Authorization")
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+		},
+	))
+	defer server.Close()
+
+	cfg := &Config{
+		ServicesURL:      server.URL,
+		ServicesUser:     "user",
+		ServicesPassword: "pass",
+	}
+	require.NoError(t, cfg.validateServicesURL())
+
+	remote := newRemoteServices(cfg)
+	require.Equal(
+		t, defaultServicesRefreshInterval, remote.refreshInterval,
+	)
+
+	services, err := remote.load()
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	require.Equal(t, "service1", services[0].Name)
+	require.Equal(t, "Basic dXNlcjpwYXNz", auth)
+
+	var updates [][]*proxy.Service
+	remote.update = func(services []*proxy.Service) error {
+		updates = append(updates, services)
+		return nil
+	}
+
+	// The services aren't updated as long as they don't change.
+	require.NoError(t, remote.refresh())
+	require.Empty(t, updates)
+
+	// Invalid services and errors of the server leave the current
+	// services in place.
+	body = "- name: service1\n  hostregexp: '('\n"
+	require.Error(t, remote.refresh())
+	body = "not a service list"
+	require.Error(t, remote.refresh())
+	status = http.StatusUnauthorized
+	body = "- name: service2\n"
+	require.Error(t, remote.refresh())
+	require.Empty(t, updates)
+
+	// Changed services are applied.
+	status = http.StatusOK
+	require.NoError(t, remote.refresh())
+	require.Len(t, updates, 1)
+	require.Equal(t, "service2", updates[0][0].Name)
+
+	// A bearer token is sent instead of basic authentication credentials.
+	remote.user = ""
+	remote.token = "token"
+	require.NoError(t, remote.refresh())
+	require.Equal(t, "Bearer token", auth)
+	require.Len(t, updates, 1)
+
+	// The services can't be loaded from the configuration file and a URL
+	// at the same time.
+	cfg.Services = services
+	require.Error(t, cfg.validateServicesURL())
+}
@@ -0,0 +1,255 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/lightninglabs/aperture/aperturerpc"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// defaultHookTimeout is the default maximum time a hook call may take.
+	defaultHookTimeout = time.Second
+)
+
+var (
+	// hookStrippedHeaders are the header fields that carry credentials of
+	// the client or the backend. They are never sent to the hook services.
+	hookStrippedHeaders = []string{
+		lsat.HeaderAuthorization, lsat.HeaderMacaroonMD,
+		lsat.HeaderMacaroon, "Proxy-Authorization", "Cookie",
+		"Set-Cookie",
+	}
+)
+
+// HooksConfig is the configuration of the gRPC services that are called to run
+// custom logic on the requests aperture proxies.
+type HooksConfig struct {
+	// PreRequest is the address of the HookService that is called before
+	// each request is forwarded to its backend.
+	PreRequest string `long:"prerequest" description:"host:port of the gRPC HookService that is called before each request is forwarded to its backend and can deny it. Leave empty to disable."`
+
+	// PostResponse is the address of the HookService that is called with
+	// each backend response before it is sent to the client.
+	PostResponse string `long:"postresponse" description:"host:port of the gRPC HookService that is called with each backend response and can modify its header. Leave empty to disable."`
+
+	// TLSCertPath is the path of the certificate the hook services are
+	// verified with.
+	TLSCertPath string `long:"tlscertpath" description:"Path to the TLS certificate of the hook services, or of the CA that issued it. The system's root CAs are used if not set."`
+
+	// Insecure disables TLS on the connections to the hook services.
+	Insecure bool `long:"insecure" description:"Connect to the hook services without TLS. Only use this if they run on the same host."`
+
+	// Timeout is the maximum time a hook call may take.
+	Timeout time.Duration `long:"timeout" description:"The maximum time a hook call may take. Defaults to 1s."`
+}
+
+// enabled returns true if at least one hook is configured.
+func (c *HooksConfig) enabled() bool {
+	return c != nil && (c.PreRequest != "" || c.PostResponse != "")
+}
+
+// grpcRequestHooks calls the HookService gRPC endpoints configured by the
+// operator.
+type grpcRequestHooks struct {
+	preRequest   aperturerpc.HookServiceClient
+	postResponse aperturerpc.HookServiceClient
+	timeout      time.Duration
+	conns        []*grpc.ClientConn
+}
+
+// A compile-time check to make sure grpcRequestHooks implements the
+// proxy.RequestHooks interface.
+var _ proxy.RequestHooks = (*grpcRequestHooks)(nil)
+
+// newGRPCRequestHooks connects to the hook services of the given config. The
+// connections are encrypted with TLS unless the config disables it.
+func newGRPCRequestHooks(cfg *HooksConfig) (*grpcRequestHooks, error) {
+	hooks := &grpcRequestHooks{
+		timeout: cfg.Timeout,
+	}
+	if hooks.timeout == 0 {
+		hooks.timeout = defaultHookTimeout
+	}
+
+	opt, err := hookTransportOption(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both hooks can be served by the same endpoint, which only needs
+	// one connection.
+	clients := make(map[string]aperturerpc.HookServiceClient)
+	connect := func(addr string) (aperturerpc.HookServiceClient, error) {
+		if addr == "" {
+			return nil, nil
+		}
+		if client, ok := clients[addr]; ok {
+			return client, nil
+		}
+
+		conn, err := grpc.Dial(addr, opt)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to hook "+
+				"service %s: %v", addr, err)
+		}
+		hooks.conns = append(hooks.conns, conn)
+		clients[addr] = aperturerpc.NewHookServiceClient(conn)
+
+		return clients[addr], nil
+	}
+
+	hooks.preRequest, err = connect(cfg.PreRequest)
+	if err != nil {
+		hooks.close()
+		return nil, err
+	}
+	hooks.postResponse, err = connect(cfg.PostResponse)
+	if err != nil {
+		hooks.close()
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+// hookTransportOption returns the dial option that secures the connections to
+// the hook services of the given config.
+func hookTransportOption(cfg *HooksConfig) (grpc.DialOption, error) {
+	switch {
+	case cfg.Insecure:
+		return grpc.WithInsecure(), nil
+
+	case cfg.TLSCertPath != "":
+		creds, err := credentials.NewClientTLSFromFile(
+			cfg.TLSCertPath, "",
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load TLS cert %s: %v",
+				cfg.TLSCertPath, err)
+		}
+
+		return grpc.WithTransportCredentials(creds), nil
+
+	default:
+		return grpc.WithTransportCredentials(
+			credentials.NewClientTLSFromCert(nil, ""),
+		), nil
+	}
+}
+
+// PreRequest calls the pre-request hook, if configured, and returns whether
+// the request may be forwarded to its backend.
+func (h *grpcRequestHooks) PreRequest(ctx context.Context, service string,
+	r *http.Request) (bool, string, error) {
+
+	if h.preRequest == nil {
+		return true, "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	resp, err := h.preRequest.PreRequest(
+		ctx, &aperturerpc.PreRequestHookRequest{
+			Service:    service,
+			Method:     r.Method,
+			Host:       r.Host,
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+			Headers:    marshalHookHeader(r.Header),
+		},
+	)
+	if err != nil {
+		return false, "", err
+	}
+
+	switch resp.Action {
+	case aperturerpc.HookAction_ALLOW:
+		return true, "", nil
+
+	case aperturerpc.HookAction_DENY:
+		return false, resp.Message, nil
+
+	default:
+		return false, "", fmt.Errorf("unknown hook action %v",
+			resp.Action)
+	}
+}
+
+// PostResponse calls the post-response hook, if configured, and applies the
+// header changes it returns to the response.
+func (h *grpcRequestHooks) PostResponse(ctx context.Context, service string,
+	res *http.Response) error {
+
+	if h.postResponse == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	resp, err := h.postResponse.PostResponse(
+		ctx, &aperturerpc.PostResponseHookRequest{
+			Service:    service,
+			Method:     res.Request.Method,
+			Path:       res.Request.URL.Path,
+			StatusCode: int32(res.StatusCode),
+			Headers:    marshalHookHeader(res.Header),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range resp.RemoveHeaders {
+		res.Header.Del(name)
+	}
+	for _, header := range resp.SetHeaders {
+		res.Header.Del(header.Name)
+		for _, value := range header.Values {
+			res.Header.Add(header.Name, value)
+		}
+	}
+
+	return nil
+}
+
+// close closes the connections to all hook services.
+func (h *grpcRequestHooks) close() {
+	for _, conn := range h.conns {
+		_ = conn.Close()
+	}
+}
+
+// marshalHookHeader converts the given header into its gRPC representation,
+// sorted by name. Header fields carrying credentials are left out.
+func marshalHookHeader(header http.Header) []*aperturerpc.Header {
+	header = header.Clone()
+	for _, name := range hookStrippedHeaders {
+		header.Del(name)
+	}
+
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	headers := make([]*aperturerpc.Header, 0, len(header))
+	for _, name := range names {
+		headers = append(headers, &aperturerpc.Header{
+			Name:   name,
+			Values: header[name],
+		})
+	}
+
+	return headers
+}
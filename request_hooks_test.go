@@ -0,0 +1,152 @@
+package aperture
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/lightninglabs/aperture/aperturerpc"
+	"github.com/lightningnetwork/lnd/cert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// mockHookServer is a HookService that denies requests to the /admin path and
+// replaces the Server header of responses.
+type mockHookServer struct {
+	aperturerpc.UnimplementedHookServiceServer
+
+	preRequests chan *aperturerpc.PreRequestHookRequest
+}
+
+// PreRequest denies requests to the /admin path.
+func (m *mockHookServer) PreRequest(_ context.Context,
+	req *aperturerpc.PreRequestHookRequest) (
+	*aperturerpc.PreRequestHookResponse, error) {
+
+	m.preRequests <- req
+
+	if req.Path == "/admin" {
+		return &aperturerpc.PreRequestHookResponse{
+			Action:  aperturerpc.HookAction_DENY,
+			Message: "no admins",
+		}, nil
+	}
+
+	return &aperturerpc.PreRequestHookResponse{}, nil
+}
+
+// PostResponse replaces the Server header and removes the X-Debug header.
+func (m *mockHookServer) PostResponse(_ context.Context,
+	req *aperturerpc.PostResponseHookRequest) (
+	*aperturerpc.PostResponseHookResponse, error) {
+
+	return &aperturerpc.PostResponseHookResponse{
+		SetHeaders: []*aperturerpc.Header{{
+			Name:   "Server",
+			Values: []string{"hooked", req.Service},
+		}},
+		RemoveHeaders: []string{"X-Debug"},
+	}, nil
+}
+
+// TestGRPCRequestHooks makes sure the hook services are called over TLS with
+// the details of requests and responses, without their credentials, and that
+// their decisions are applied.
+func TestGRPCRequestHooks(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.cert")
+	keyFile := filepath.Join(dir, "tls.key")
+	require.NoError(t, cert.GenCertPair(
+		"test", certFile, keyFile, nil, nil, false,
+		selfSignedCertValidity,
+	))
+	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	hookServer := &mockHookServer{
+		preRequests: make(
+			chan *aperturerpc.PreRequestHookRequest, 2,
+		),
+	}
+	server := grpc.NewServer(grpc.Creds(creds))
+	aperturerpc.RegisterHookServiceServer(server, hookServer)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	hooks, err := newGRPCRequestHooks(&HooksConfig{
+		PreRequest:   listener.Addr().String(),
+		PostResponse: listener.Addr().String(),
+		TLSCertPath:  certFile,
+	})
+	require.NoError(t, err)
+	defer hooks.close()
+
+	// Both hooks are served by the same endpoint, so there should only be
+	// one connection.
+	require.Len(t, hooks.conns, 1)
+	require.Equal(t, defaultHookTimeout, hooks.timeout)
+
+	ctx := context.Background()
+	req := httptest.NewRequest(http.MethodGet, "/data", nil)
+	req.Header.Set("X-Client", "test")
+	req.Header.Set("Authorization", "LSAT mac:preimage")
+	req.Header.Set("Cookie", "session=secret")
+	allow, _, err := hooks.PreRequest(ctx, "service1", req)
+	require.NoError(t, err)
+	require.True(t, allow)
+
+	hookReq := <-hookServer.preRequests
+	require.Equal(t, "service1", hookReq.Service)
+	require.Equal(t, http.MethodGet, hookReq.Method)
+	require.Equal(t, "/data", hookReq.Path)
+	require.Len(t, hookReq.Headers, 1)
+	require.Equal(t, "X-Client", hookReq.Headers[0].Name)
+	require.Equal(t, []string{"test"}, hookReq.Headers[0].Values)
+
+	req = httptest.NewRequest(http.MethodGet, "/admin", nil)
+	allow, message, err := hooks.PreRequest(ctx, "service1", req)
+	require.NoError(t, err)
+	require.False(t, allow)
+	require.Equal(t, "no admins", message)
+	<-hookServer.preRequests
+
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Server":     []string{"backend"},
+			"X-Debug":    []string{"1"},
+			"Set-Cookie": []string{"session=secret"},
+		},
+		Request: req,
+	}
+	require.NoError(t, hooks.PostResponse(ctx, "service1", res))
+	require.Equal(t, http.Header{
+		"Server":     []string{"hooked", "service1"},
+		"Set-Cookie": []string{"session=secret"},
+	}, res.Header)
+	require.Empty(t, marshalHookHeader(http.Header{
+		"Set-Cookie": []string{"session=secret"},
+	}))
+
+	// Without the certificate, the hook service can't be verified.
+	untrusted, err := newGRPCRequestHooks(&HooksConfig{
+		PreRequest: listener.Addr().String(),
+	})
+	require.NoError(t, err)
+	defer untrusted.close()
+
+	_, _, err = untrusted.PreRequest(ctx, "service1", req)
+	require.Error(t, err)
+}
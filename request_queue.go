@@ -0,0 +1,141 @@
+package aperture
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultMaxQueueWait is the default maximum time a request waits in
+	// the request queue for a worker to become available.
+	defaultMaxQueueWait = 10 * time.Second
+)
+
+var (
+	// queueDepth tracks the number of requests waiting in the request
+	// queue.
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "aperture",
+		Name:      "queue_depth",
+	})
+
+	// queueWait tracks the time requests spent waiting in the request
+	// queue, including the ones that gave up or timed out.
+	queueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "aperture",
+		Name:      "queue_wait_seconds",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+// requestQueue limits the number of requests that are handled concurrently.
+// Requests that arrive while all workers are busy wait in a bounded queue for
+// one to become available. Requests are rejected with 503 Service Unavailable
+// if the queue is full or they waited for too long.
+type requestQueue struct {
+	// workers holds a token for every request that is being handled.
+	workers chan struct{}
+
+	maxPending int
+	maxWait    time.Duration
+
+	mtx     sync.Mutex
+	pending int
+}
+
+// newRequestQueue creates a new request queue that handles up to the given
+// number of requests concurrently and lets up to maxPending more wait for no
+// longer than maxWait.
+func newRequestQueue(workers, maxPending int,
+	maxWait time.Duration) *requestQueue {
+
+	if maxWait == 0 {
+		maxWait = defaultMaxQueueWait
+	}
+
+	return &requestQueue{
+		workers:    make(chan struct{}, workers),
+		maxPending: maxPending,
+		maxWait:    maxWait,
+	}
+}
+
+// wrap returns a handler that only passes requests on to the given handler
+// once a worker is available for them.
+func (q *requestQueue) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !q.acquire(r) {
+			log.Debugf("Request queue full or wait time exceeded, "+
+				"rejecting request from %s", r.RemoteAddr)
+			proxy.SetBusyRetryAfter(w.Header())
+			http.Error(
+				w, "server busy, please try again later",
+				http.StatusServiceUnavailable,
+			)
+			return
+		}
+		defer q.release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire reserves a worker for the given request, waiting in the queue if
+// none is available. It returns false if the queue is full, the request waited
+// longer than the maximum queue wait or the client gave up.
+func (q *requestQueue) acquire(r *http.Request) bool {
+	select {
+	case q.workers <- struct{}{}:
+		return true
+	default:
+	}
+
+	q.mtx.Lock()
+	if q.pending >= q.maxPending {
+		q.mtx.Unlock()
+		return false
+	}
+	q.pending++
+	queueDepth.Inc()
+	q.mtx.Unlock()
+
+	start := time.Now()
+	defer func() {
+		q.mtx.Lock()
+		q.pending--
+		queueDepth.Dec()
+		q.mtx.Unlock()
+
+		queueWait.Observe(time.Since(start).Seconds())
+	}()
+
+	timeout := time.NewTimer(q.maxWait)
+	defer timeout.Stop()
+
+	select {
+	case q.workers <- struct{}{}:
+		// A worker that became available at the same time the
+		// maximum wait time passed must not be used.
+		if time.Since(start) > q.maxWait {
+			q.release()
+			return false
+		}
+
+		return true
+
+	case <-timeout.C:
+		return false
+
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// release frees the worker of a request that was handled.
+func (q *requestQueue) release() {
+	<-q.workers
+}
@@ -0,0 +1,64 @@
+package aperture
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRequestQueue makes sure requests wait for a worker in the bounded queue
+// and are rejected if the queue is full or they waited for too long.
+func TestRequestQueue(t *testing.T) {
+	var (
+		entered = make(chan struct{}, 10)
+		release = make(chan struct{})
+	)
+	queue := newRequestQueue(1, 1, 100*time.Millisecond)
+	handler := queue.wrap(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			entered <- struct{}{}
+			<-release
+		},
+	))
+
+	send := func() chan int {
+		code := make(chan int, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			handler.ServeHTTP(rec, req)
+			code <- rec.Code
+		}()
+
+		return code
+	}
+
+	// The first request occupies the only worker.
+	first := send()
+	<-entered
+
+	// The second one waits in the queue, which makes it full.
+	second := send()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(queueDepth) == 1
+	}, time.Second, time.Millisecond)
+
+	// So the third one is rejected right away and told when to retry.
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	// The second one is rejected once it waited for too long.
+	require.Equal(t, http.StatusServiceUnavailable, <-second)
+	require.Equal(t, float64(0), testutil.ToFloat64(queueDepth))
+
+	// Once the worker is free again, requests are handled.
+	close(release)
+	require.Equal(t, http.StatusOK, <-first)
+	require.Equal(t, http.StatusOK, <-send())
+}
@@ -0,0 +1,122 @@
+package aperture
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lightninglabs/aperture/aperturerpc"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// apertureGRPCPrefix is the prefix a gRPC request URI has when it is
+	// meant for aperture's own gRPC server.
+	apertureGRPCPrefix = "/aperturerpc.ApertureService/"
+)
+
+// rpcServer is aperture's own gRPC server that serves the payment status of
+// LSAT challenges to gRPC clients.
+type rpcServer struct {
+	aperturerpc.UnimplementedApertureServiceServer
+
+	subscriber InvoiceStateSubscriber
+	timeout    time.Duration
+}
+
+// A compile time flag to ensure the rpcServer satisfies the
+// aperturerpc.ApertureServiceServer interface.
+var _ aperturerpc.ApertureServiceServer = (*rpcServer)(nil)
+
+// newRPCServer creates a new gRPC server that is notified about invoice states
+// by the given subscriber. Clients can wait for an invoice to settle for up to
+// the given timeout.
+func newRPCServer(subscriber InvoiceStateSubscriber,
+	timeout time.Duration) *rpcServer {
+
+	return &rpcServer{
+		subscriber: subscriber,
+		timeout:    timeout,
+	}
+}
+
+// StreamPaymentStatus streams the status of the invoice of an LSAT challenge.
+// Unless the invoice is already settled, a PENDING event is sent as soon as the
+// subscription is active. Once the invoice settles or fails, a final event is
+// sent and the stream ends.
+//
+// NOTE: This is part of the aperturerpc.ApertureServiceServer interface.
+func (s *rpcServer) StreamPaymentStatus(req *aperturerpc.PaymentStatusRequest,
+	stream aperturerpc.ApertureService_StreamPaymentStatusServer) error {
+
+	hash, err := lntypes.MakeHash(req.PaymentHash)
+	if err != nil {
+		return status.Errorf(
+			codes.InvalidArgument, "invalid payment hash: %v", err,
+		)
+	}
+
+	stateChan, cancel, err := s.subscriber.SubscribeInvoiceState(hash)
+	switch {
+	case errors.Is(err, ErrUnknownInvoice):
+		return status.Error(codes.NotFound, err.Error())
+
+	case errors.Is(err, ErrTooManySubscribers):
+		return status.Error(codes.ResourceExhausted, err.Error())
+
+	case err != nil:
+		return status.Errorf(
+			codes.Internal, "unable to subscribe: %v", err,
+		)
+	}
+	defer cancel()
+
+	sendState := func(state aperturerpc.PaymentState) error {
+		return stream.Send(&aperturerpc.PaymentStatusEvent{
+			PaymentHash: hash[:],
+			State:       state,
+		})
+	}
+
+	// An invoice that is already settled is reported right away, for all
+	// others we let the client know the subscription is active.
+	var (
+		state lnrpc.Invoice_InvoiceState
+		ok    bool
+	)
+	select {
+	case state, ok = <-stateChan:
+	default:
+		if err := sendState(aperturerpc.PaymentState_PENDING); err != nil {
+			return err
+		}
+
+		timeout := time.NewTimer(s.timeout)
+		defer timeout.Stop()
+
+		select {
+		case state, ok = <-stateChan:
+
+		case <-timeout.C:
+			return status.Error(
+				codes.DeadlineExceeded, "timed out waiting "+
+					"for payment",
+			)
+
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+
+	if !ok {
+		return status.Error(codes.Unavailable, "server shutting down")
+	}
+
+	if state == lnrpc.Invoice_SETTLED {
+		return sendState(aperturerpc.PaymentState_SETTLED)
+	}
+
+	return sendState(aperturerpc.PaymentState_FAILED)
+}
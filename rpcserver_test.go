@@ -0,0 +1,84 @@
+package aperture
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/lightninglabs/aperture/aperturerpc"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// TestStreamPaymentStatus makes sure a pending event is sent once the
+// subscription is active and the final state once the invoice settled.
+func TestStreamPaymentStatus(t *testing.T) {
+	t.Parallel()
+
+	subscriber := &mockStateSubscriber{
+		stateChan:  make(chan lnrpc.Invoice_InvoiceState, 1),
+		subscribed: make(chan lntypes.Hash, 1),
+	}
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	aperturerpc.RegisterApertureServiceServer(
+		server, newRPCServer(subscriber, defaultPaymentStreamTimeout),
+	)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	conn, err := grpc.Dial(
+		"bufnet", grpc.WithInsecure(), grpc.WithContextDialer(
+			func(context.Context, string) (net.Conn, error) {
+				return listener.Dial()
+			},
+		),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx := context.Background()
+	client := aperturerpc.NewApertureServiceClient(conn)
+
+	// An invalid payment hash should be rejected.
+	stream, err := client.StreamPaymentStatus(
+		ctx, &aperturerpc.PaymentStatusRequest{
+			PaymentHash: []byte{1, 2, 3},
+		},
+	)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	hash := lntypes.Hash{1, 2, 3}
+	stream, err = client.StreamPaymentStatus(
+		ctx, &aperturerpc.PaymentStatusRequest{
+			PaymentHash: hash[:],
+		},
+	)
+	require.NoError(t, err)
+
+	event, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, hash[:], event.PaymentHash)
+	require.Equal(t, aperturerpc.PaymentState_PENDING, event.State)
+	require.Equal(t, hash, <-subscriber.subscribed)
+
+	subscriber.stateChan <- lnrpc.Invoice_SETTLED
+	event, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, aperturerpc.PaymentState_SETTLED, event.State)
+
+	// The stream should end after the final event.
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
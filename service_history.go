@@ -0,0 +1,330 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// serviceHistoryPrefix is the key we'll use to prefix all service
+	// configuration revisions with when storing them in an etcd cluster.
+	serviceHistoryPrefix = "servicehistory"
+
+	// defaultServiceHistorySize is the default number of service
+	// configuration revisions we keep.
+	defaultServiceHistorySize = 10
+
+	// serviceHistoryConfigUser is the user recorded for the revision that
+	// holds the services loaded from the configuration file.
+	serviceHistoryConfigUser = "config"
+)
+
+var (
+	// errRevisionNotFound is returned if a service configuration revision
+	// doesn't exist, for example because it was pruned from the history.
+	errRevisionNotFound = errors.New("revision not found")
+
+	// errRevisionConflict is returned if another revision was added
+	// concurrently.
+	errRevisionConflict = errors.New("service configuration was changed " +
+		"concurrently")
+)
+
+// serviceRevision is a single revision of the service configuration.
+type serviceRevision struct {
+	// Revision is the number of the revision. It is increased by one with
+	// each change.
+	Revision uint64 `json:"revision"`
+
+	// Timestamp is the time the revision was created.
+	Timestamp time.Time `json:"timestamp"`
+
+	// User is the user that made the change, taken from the common name
+	// of the client certificate used to authenticate to the admin API.
+	User string `json:"user"`
+
+	// RollbackOf is the revision that was rolled back to, if this revision
+	// was created by a rollback.
+	RollbackOf uint64 `json:"rollback_of,omitempty"`
+
+	// Services is the YAML encoded service configuration, in the same
+	// format as the services section of the configuration file.
+	Services string `json:"services"`
+
+	// Diff lists the lines of the YAML encoded service configuration that
+	// were removed or added compared to the previous revision.
+	Diff string `json:"diff"`
+}
+
+// decodeServices decodes the services of the revision.
+func (r *serviceRevision) decodeServices() ([]*proxy.Service, error) {
+	return decodeServices([]byte(r.Services))
+}
+
+// encodeServices encodes the given services in the same YAML format used in
+// the configuration file.
+func encodeServices(services []*proxy.Service) (string, error) {
+	encoded, err := yaml.Marshal(services)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encoded), nil
+}
+
+// decodeServices decodes services from the YAML format used in the
+// configuration file.
+func decodeServices(encoded []byte) ([]*proxy.Service, error) {
+	var services []*proxy.Service
+	if err := yaml.UnmarshalStrict(encoded, &services); err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+// serviceRevisionKey returns the full key to store in the database for a
+// service configuration revision. The revision number is zero padded so the
+// keys sort in the order of the revisions.
+//
+// The resulting path of revision 3 within etcd would look like:
+//
+//	lsat/proxy/servicehistory/00000000000000000003
+func serviceRevisionKey(revision uint64) string {
+	return strings.Join(
+		[]string{
+			topLevelKey, serviceHistoryPrefix,
+			fmt.Sprintf("%020d", revision),
+		}, etcdKeyDelimeter,
+	)
+}
+
+// serviceHistoryKeyPrefix returns the prefix of all service configuration
+// revision keys.
+func serviceHistoryKeyPrefix() string {
+	return strings.Join(
+		[]string{topLevelKey, serviceHistoryPrefix, ""},
+		etcdKeyDelimeter,
+	)
+}
+
+// serviceHistory keeps the last revisions of the service configuration in an
+// etcd cluster.
+type serviceHistory struct {
+	*clientv3.Client
+
+	// size is the maximum number of revisions kept.
+	size int
+}
+
+// newServiceHistory instantiates a new service configuration history backed
+// by an etcd cluster that keeps the given number of revisions.
+func newServiceHistory(client *clientv3.Client, size int) *serviceHistory {
+	if size <= 0 {
+		size = defaultServiceHistorySize
+	}
+
+	return &serviceHistory{
+		Client: client,
+		size:   size,
+	}
+}
+
+// revisions returns all revisions in the history, oldest first.
+func (h *serviceHistory) revisions(
+	ctx context.Context) ([]*serviceRevision, error) {
+
+	resp, err := h.Get(
+		ctx, serviceHistoryKeyPrefix(), clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]*serviceRevision, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var revision serviceRevision
+		if err := json.Unmarshal(kv.Value, &revision); err != nil {
+			return nil, fmt.Errorf("invalid revision %s: %v",
+				kv.Key, err)
+		}
+		revisions = append(revisions, &revision)
+	}
+
+	return revisions, nil
+}
+
+// latest returns the latest revision in the history or nil if the history is
+// empty.
+func (h *serviceHistory) latest(ctx context.Context) (*serviceRevision,
+	error) {
+
+	resp, err := h.Get(
+		ctx, serviceHistoryKeyPrefix(), clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend),
+		clientv3.WithLimit(1),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	var revision serviceRevision
+	if err := json.Unmarshal(resp.Kvs[0].Value, &revision); err != nil {
+		return nil, fmt.Errorf("invalid revision %s: %v",
+			resp.Kvs[0].Key, err)
+	}
+
+	return &revision, nil
+}
+
+// revision returns the revision with the given number.
+func (h *serviceHistory) revision(ctx context.Context,
+	number uint64) (*serviceRevision, error) {
+
+	resp, err := h.Get(ctx, serviceRevisionKey(number))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, errRevisionNotFound
+	}
+
+	var revision serviceRevision
+	if err := json.Unmarshal(resp.Kvs[0].Value, &revision); err != nil {
+		return nil, fmt.Errorf("invalid revision %d: %v", number, err)
+	}
+
+	return &revision, nil
+}
+
+// add stores a new revision with the given services on top of the given
+// previous revision, which is nil if the history is empty. Revisions that
+// exceed the size of the history are pruned. If another revision was added in
+// the meantime, errRevisionConflict is returned.
+func (h *serviceHistory) add(ctx context.Context, prev *serviceRevision,
+	user string, services string, rollbackOf uint64) (*serviceRevision,
+	error) {
+
+	revision := &serviceRevision{
+		Revision:   1,
+		Timestamp:  time.Now().UTC(),
+		User:       user,
+		RollbackOf: rollbackOf,
+		Services:   services,
+		Diff:       diffLines("", services),
+	}
+	if prev != nil {
+		revision.Revision = prev.Revision + 1
+		revision.Diff = diffLines(prev.Services, services)
+	}
+
+	encoded, err := json.Marshal(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only add the revision if nobody else added the same one in the
+	// meantime and prune the oldest ones within the same transaction.
+	key := serviceRevisionKey(revision.Revision)
+	ops := []clientv3.Op{clientv3.OpPut(key, string(encoded))}
+	if revision.Revision > uint64(h.size) {
+		ops = append(ops, clientv3.OpDelete(
+			serviceRevisionKey(0), clientv3.WithRange(
+				serviceRevisionKey(
+					revision.Revision-uint64(h.size)+1,
+				),
+			),
+		))
+	}
+
+	resp, err := h.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, errRevisionConflict
+	}
+
+	return revision, nil
+}
+
+// diffLines returns the lines that were removed from the old text, prefixed
+// with "- ", and the lines that were added in the new text, prefixed with
+// "+ ", in the order they appear in.
+func diffLines(oldText, newText string) string {
+	oldLines := splitLines(oldText)
+	newLines := splitLines(newText)
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// oldLines[i:] and newLines[j:].
+	lcs := make([][]int, len(oldLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(newLines)+1)
+	}
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			switch {
+			case oldLines[i] == newLines[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var (
+		diff strings.Builder
+		i, j int
+	)
+	for i < len(oldLines) || j < len(newLines) {
+		switch {
+		case i < len(oldLines) && j < len(newLines) &&
+			oldLines[i] == newLines[j]:
+
+			i++
+			j++
+
+		case j == len(newLines) ||
+			(i < len(oldLines) && lcs[i+1][j] >= lcs[i][j+1]):
+
+			diff.WriteString("- " + oldLines[i] + "\n")
+			i++
+
+		default:
+			diff.WriteString("+ " + newLines[j] + "\n")
+			j++
+		}
+	}
+
+	return diff.String()
+}
+
+// splitLines splits the given text into its lines, ignoring a trailing line
+// break.
+func splitLines(text string) []string {
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return nil
+	}
+
+	return strings.Split(text, "\n")
+}
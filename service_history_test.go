@@ -0,0 +1,71 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+// TestServiceHistory makes sure revisions are numbered consecutively, pruned
+// once the history is full and can't be added concurrently.
+func TestServiceHistory(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	history := newServiceHistory(etcdClient, 2)
+
+	latest, err := history.latest(ctx)
+	require.NoError(t, err)
+	require.Nil(t, latest)
+
+	// Add three revisions with a different price each.
+	var prev *serviceRevision
+	for price := int64(1); price <= 3; price++ {
+		encoded, err := encodeServices([]*proxy.Service{{
+			Name:  "service",
+			Price: price,
+		}})
+		require.NoError(t, err)
+
+		prev, err = history.add(ctx, prev, "alice", encoded, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(price), prev.Revision)
+	}
+	require.Equal(t, "-   price: 2\n+   price: 3\n", prev.Diff)
+
+	// Only the last two revisions should have been kept.
+	revisions, err := history.revisions(ctx)
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+	require.Equal(t, uint64(2), revisions[0].Revision)
+	require.Equal(t, uint64(3), revisions[1].Revision)
+
+	_, err = history.revision(ctx, 1)
+	require.Equal(t, errRevisionNotFound, err)
+
+	revision, err := history.revision(ctx, 2)
+	require.NoError(t, err)
+	services, err := revision.decodeServices()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), services[0].Price)
+
+	// Adding another revision on top of an outdated one must fail.
+	_, err = history.add(ctx, revision, "bob", revision.Services, 2)
+	require.Equal(t, errRevisionConflict, err)
+}
+
+// TestDiffLines makes sure only removed and added lines are listed, in order.
+func TestDiffLines(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "", diffLines("a\nb\n", "a\nb\n"))
+	require.Equal(t, "+ a\n", diffLines("", "a\n"))
+	require.Equal(
+		t, "- b\n+ x\n+ y\n",
+		diffLines("a\nb\nc\n", "a\nx\ny\nc\n"),
+	)
+}
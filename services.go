@@ -2,35 +2,48 @@ package aperture
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightninglabs/aperture/proxy"
 )
 
-// staticServiceLimiter provides static restrictions for services.
-//
-// TODO(wilmer): use etcd instead.
-type staticServiceLimiter struct {
+// serviceRestrictions are the restrictions of the LSATs of a set of services.
+type serviceRestrictions struct {
 	capabilities map[lsat.Service]lsat.Caveat
 	constraints  map[lsat.Service][]lsat.Caveat
+
+	// caveats are the custom caveats the LSATs of each service must carry.
+	caveats map[lsat.Service][]lsat.Caveat
+
+	// expiries is the time the LSATs of each service are valid for after
+	// being minted. Services whose LSATs don't expire aren't included.
+	expiries map[lsat.Service]time.Duration
+
+	// refreshQuotas is the number of times the LSATs of each service can be
+	// refreshed. Services whose LSATs can't be refreshed aren't included.
+	refreshQuotas map[lsat.Service]uint32
 }
 
-// A compile-time constraint to ensure staticServiceLimiter implements
-// mint.ServiceLimiter.
-var _ mint.ServiceLimiter = (*staticServiceLimiter)(nil)
+// newServiceRestrictions creates the restrictions of the LSATs of the given
+// services.
+func newServiceRestrictions(
+	proxyServices []*proxy.Service) (*serviceRestrictions, error) {
 
-// newStaticServiceLimiter instantiates a new static service limiter backed by
-// the given restrictions.
-func newStaticServiceLimiter(proxyServices []*proxy.Service) *staticServiceLimiter {
 	capabilities := make(map[lsat.Service]lsat.Caveat)
 	constraints := make(map[lsat.Service][]lsat.Caveat)
+	caveats := make(map[lsat.Service][]lsat.Caveat)
+	expiries := make(map[lsat.Service]time.Duration)
+	refreshQuotas := make(map[lsat.Service]uint32)
 
 	for _, proxyService := range proxyServices {
 		s := lsat.Service{
-			Name:  proxyService.Name,
-			Tier:  lsat.BaseTier,
-			Price: proxyService.Price,
+			Name: proxyService.Name,
+			Tier: lsat.BaseTier,
 		}
 		capabilities[s] = lsat.NewCapabilitiesCaveat(
 			proxyService.Name, proxyService.Capabilities,
@@ -39,22 +52,111 @@ func newStaticServiceLimiter(proxyServices []*proxy.Service) *staticServiceLimit
 			caveat := lsat.Caveat{Condition: cond, Value: value}
 			constraints[s] = append(constraints[s], caveat)
 		}
+		if proxyService.ValidAfterBlock > 0 {
+			constraints[s] = append(
+				constraints[s], lsat.NewValidAfterBlockCaveat(
+					proxyService.ValidAfterBlock,
+				),
+			)
+		}
+		if proxyService.RequestBudget > 0 {
+			constraints[s] = append(
+				constraints[s], mint.NewBudgetCaveat(
+					proxyService.RequestBudget,
+				),
+			)
+		}
+		required, err := proxyService.RequiredCaveats()
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v",
+				proxyService.Name, err)
+		}
+		if len(required) > 0 {
+			caveats[s] = required
+		}
+		if proxyService.TokenExpiry > 0 {
+			expiries[s] = proxyService.TokenExpiry
+		}
+		if proxyService.RefreshQuota > 0 {
+			refreshQuotas[s] = proxyService.RefreshQuota
+		}
+	}
+
+	return &serviceRestrictions{
+		capabilities:  capabilities,
+		constraints:   constraints,
+		caveats:       caveats,
+		expiries:      expiries,
+		refreshQuotas: refreshQuotas,
+	}, nil
+}
+
+// serviceLimiter provides the restrictions of the current services. They are
+// replaced whenever the services change, so LSATs are always minted and
+// verified with the restrictions of the services in use.
+type serviceLimiter struct {
+	mtx          sync.RWMutex
+	restrictions *serviceRestrictions
+}
+
+// A compile-time constraint to ensure serviceLimiter implements
+// mint.ServiceLimiter.
+var _ mint.ServiceLimiter = (*serviceLimiter)(nil)
+
+// newServiceLimiter instantiates a new service limiter with the restrictions of
+// the given services.
+func newServiceLimiter(proxyServices []*proxy.Service) (*serviceLimiter,
+	error) {
+
+	restrictions, err := newServiceRestrictions(proxyServices)
+	if err != nil {
+		return nil, err
 	}
 
-	return &staticServiceLimiter{
-		capabilities: capabilities,
-		constraints:  constraints,
+	return &serviceLimiter{restrictions: restrictions}, nil
+}
+
+// setRestrictions replaces the restrictions of the limiter.
+func (l *serviceLimiter) setRestrictions(restrictions *serviceRestrictions) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.restrictions = restrictions
+}
+
+// current returns the restrictions of the current services.
+func (l *serviceLimiter) current() *serviceRestrictions {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	return l.restrictions
+}
+
+// limiterKey returns the key the restrictions of the given service are stored
+// under. The price of a service isn't part of it, since it isn't encoded in an
+// LSAT and can change with dynamic pricing.
+func limiterKey(service lsat.Service) lsat.Service {
+	return lsat.Service{
+		Name: service.Name,
+		Tier: service.Tier,
 	}
 }
 
+// refreshable returns true if the LSATs of any current service can be
+// refreshed.
+func (l *serviceLimiter) refreshable() bool {
+	return len(l.current().refreshQuotas) > 0
+}
+
 // ServiceCapabilities returns the capabilities caveats for each service. This
 // determines which capabilities of each service can be accessed.
-func (l *staticServiceLimiter) ServiceCapabilities(ctx context.Context,
+func (l *serviceLimiter) ServiceCapabilities(ctx context.Context,
 	services ...lsat.Service) ([]lsat.Caveat, error) {
 
+	restrictions := l.current()
 	res := make([]lsat.Caveat, 0, len(services))
 	for _, service := range services {
-		capabilities, ok := l.capabilities[service]
+		capabilities, ok := restrictions.capabilities[limiterKey(service)]
 		if !ok {
 			continue
 		}
@@ -65,13 +167,22 @@ func (l *staticServiceLimiter) ServiceCapabilities(ctx context.Context,
 }
 
 // ServiceConstraints returns the constraints for each service. This enforces
-// additional constraints on a particular service/service capability.
-func (l *staticServiceLimiter) ServiceConstraints(ctx context.Context,
+// additional constraints on a particular service/service capability. The
+// expiry of an LSAT is relative to the time it is minted, so its caveat is
+// created with each call.
+func (l *serviceLimiter) ServiceConstraints(ctx context.Context,
 	services ...lsat.Service) ([]lsat.Caveat, error) {
 
+	restrictions := l.current()
 	res := make([]lsat.Caveat, 0, len(services))
 	for _, service := range services {
-		constraints, ok := l.constraints[service]
+		if expiry, ok := restrictions.expiries[limiterKey(service)]; ok {
+			res = append(res, mint.NewExpiresAtCaveat(
+				time.Now().Add(expiry),
+			))
+		}
+
+		constraints, ok := restrictions.constraints[limiterKey(service)]
 		if !ok {
 			continue
 		}
@@ -80,3 +191,38 @@ func (l *staticServiceLimiter) ServiceConstraints(ctx context.Context,
 
 	return res, nil
 }
+
+// ServiceCaveats returns the custom caveats the LSATs of each service must
+// carry.
+func (l *serviceLimiter) ServiceCaveats(ctx context.Context,
+	services ...lsat.Service) ([]lsat.Caveat, error) {
+
+	restrictions := l.current()
+	var res []lsat.Caveat
+	for _, service := range services {
+		res = append(res, restrictions.caveats[limiterKey(service)]...)
+	}
+
+	return res, nil
+}
+
+// ServiceRefreshQuota returns the number of times an LSAT for all of the given
+// services can be refreshed, which is the smallest quota of any of them.
+func (l *serviceLimiter) ServiceRefreshQuota(ctx context.Context,
+	services ...lsat.Service) (uint32, error) {
+
+	if len(services) == 0 {
+		return 0, nil
+	}
+
+	restrictions := l.current()
+	var quota uint32 = math.MaxUint32
+	for _, service := range services {
+		serviceQuota := restrictions.refreshQuotas[limiterKey(service)]
+		if serviceQuota < quota {
+			quota = serviceQuota
+		}
+	}
+
+	return quota, nil
+}
@@ -0,0 +1,154 @@
+package aperture
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightninglabs/aperture/proxy"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/macaroon.v2"
+)
+
+// TestUpdateServicesRestrictions ensures the restrictions of the LSATs of the
+// services, like their required caveats, change with the services.
+func TestUpdateServicesRestrictions(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	newService := func(name string, caveats ...string) *proxy.Service {
+		return &proxy.Service{
+			Name:       name,
+			Address:    "127.0.0.1:10009",
+			Protocol:   "http",
+			HostRegexp: "^" + name + "$",
+			Caveats:    caveats,
+		}
+	}
+	services := []*proxy.Service{newService("service")}
+	prxy, err := proxy.New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+	limiter, err := newServiceLimiter(services)
+	require.NoError(t, err)
+	a := &Aperture{proxy: prxy, limiter: limiter}
+
+	ctx := context.Background()
+	minter := mint.New(&mint.Config{
+		Secrets:        newSecretStore(etcdClient),
+		Challenger:     NewMockChallenger(false),
+		ServiceLimiter: limiter,
+	})
+	mintLSAT := func(name string) (*macaroon.Macaroon,
+		*mint.VerificationParams) {
+
+		mac, invoice, err := minter.MintLSAT(ctx, lsat.Service{
+			Name: name,
+			Tier: lsat.BaseTier,
+		})
+		require.NoError(t, err)
+		preimage, err := MockInvoicePreimage(invoice)
+		require.NoError(t, err)
+
+		return mac, &mint.VerificationParams{
+			Macaroon:      mac,
+			Preimage:      preimage,
+			TargetService: name,
+		}
+	}
+
+	_, oldParams := mintLSAT("service")
+	require.NoError(t, minter.VerifyLSAT(ctx, oldParams))
+
+	// Once the service requires a caveat, LSATs without it are rejected
+	// and new LSATs carry it.
+	err = a.UpdateServices([]*proxy.Service{
+		newService("service", "region=eu-west"),
+		newService("added", "tier=gold"),
+	})
+	require.NoError(t, err)
+	require.Error(t, minter.VerifyLSAT(ctx, oldParams))
+
+	mac, params := mintLSAT("service")
+	region, ok := lsat.HasCaveat(mac, "region")
+	require.True(t, ok)
+	require.Equal(t, "eu-west", region)
+	require.NoError(t, minter.VerifyLSAT(ctx, params))
+
+	// A service added at runtime has its caveats as well.
+	mac, _ = mintLSAT("added")
+	tier, ok := lsat.HasCaveat(mac, "tier")
+	require.True(t, ok)
+	require.Equal(t, "gold", tier)
+
+	// Invalid caveats leave both the proxy and the restrictions as they
+	// are.
+	err = a.UpdateServices([]*proxy.Service{newService("service", "x")})
+	require.Error(t, err)
+	require.Len(t, prxy.Services(), 2)
+	require.NoError(t, minter.VerifyLSAT(ctx, params))
+}
+
+// TestUpdateServicesLSATSettings ensures the expiry, budget and refresh quota
+// of services added at runtime apply to the LSATs issued for them and that the
+// refresh endpoint is only served while any service has a refresh quota.
+func TestUpdateServicesLSATSettings(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	services := []*proxy.Service{{
+		Name:       "service",
+		Address:    "127.0.0.1:10009",
+		Protocol:   "http",
+		HostRegexp: "^service$",
+	}}
+	prxy, err := proxy.New(auth.NewMockAuthenticator(), services)
+	require.NoError(t, err)
+	limiter, err := newServiceLimiter(services)
+	require.NoError(t, err)
+	a := &Aperture{proxy: prxy, limiter: limiter}
+
+	ctx := context.Background()
+	minter := mint.New(&mint.Config{
+		Secrets:        newSecretStore(etcdClient),
+		Challenger:     NewMockChallenger(false),
+		ServiceLimiter: limiter,
+	})
+	refreshServer := newRefreshServer(minter, limiter.refreshable)
+	req := httptest.NewRequest(http.MethodPost, refreshPath, nil)
+	require.False(t, refreshServer.isHandling(req))
+
+	err = a.UpdateServices([]*proxy.Service{services[0], {
+		Name:          "added",
+		Address:       "127.0.0.1:10009",
+		Protocol:      "http",
+		HostRegexp:    "^added$",
+		TokenExpiry:   time.Hour,
+		RefreshQuota:  2,
+		RequestBudget: 10,
+	}})
+	require.NoError(t, err)
+	require.True(t, refreshServer.isHandling(req))
+
+	mac, _, err := minter.MintLSAT(ctx, lsat.Service{
+		Name: "added",
+		Tier: lsat.BaseTier,
+	})
+	require.NoError(t, err)
+	_, ok := lsat.HasCaveat(mac, mint.CondExpiresAt)
+	require.True(t, ok)
+	budget, ok := lsat.HasCaveat(mac, mint.CondBudget)
+	require.True(t, ok)
+	require.Equal(t, "10", budget)
+
+	// Once the service is removed again, the refresh endpoint leaves its
+	// path to the backends.
+	require.NoError(t, a.UpdateServices(services))
+	require.False(t, refreshServer.isHandling(req))
+}
@@ -0,0 +1,68 @@
+package aperture
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// settlementsPrefix is the key we'll use to prefix the payment hashes
+	// of settled invoices with when storing them in an etcd cluster.
+	settlementsPrefix = "settlements"
+)
+
+// settlementKey returns the full key to store the settlement of the invoice
+// with the given payment hash under.
+//
+// The resulting path of the payment hash bff4ee83 within etcd would look like:
+//
+//	lsat/proxy/settlements/bff4ee83
+func settlementKey(hash lntypes.Hash) string {
+	return strings.Join(
+		[]string{topLevelKey, settlementsPrefix, hash.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// settlementStore records the settled invoices in an etcd cluster.
+type settlementStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure settlementStore implements
+// SettlementStore.
+var _ SettlementStore = (*settlementStore)(nil)
+
+// newSettlementStore instantiates a new settlement store backed by an etcd
+// cluster.
+func newSettlementStore(client *clientv3.Client) *settlementStore {
+	return &settlementStore{Client: client}
+}
+
+// MarkSettled records the invoice with the given payment hash as settled at the
+// given time. It returns true if the invoice wasn't recorded as settled before.
+//
+// NOTE: This is part of the SettlementStore interface.
+func (s *settlementStore) MarkSettled(ctx context.Context, hash lntypes.Hash,
+	settleDate time.Time) (bool, error) {
+
+	// The settlement is only written if it doesn't exist yet, so we can
+	// tell whether it was missing.
+	key := settlementKey(hash)
+	txnResp, err := s.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(
+			key, strconv.FormatInt(settleDate.Unix(), 10),
+		)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+
+	return txnResp.Succeeded, nil
+}
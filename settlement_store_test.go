@@ -0,0 +1,36 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSettlementStore ensures a settled invoice is only reported as newly
+// recorded the first time.
+func TestSettlementStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	store := newSettlementStore(etcdClient)
+	settleDate := time.Unix(1600000000, 0)
+
+	hash := lntypes.Hash{1}
+	added, err := store.MarkSettled(ctx, hash, settleDate)
+	require.NoError(t, err)
+	require.True(t, added)
+
+	added, err = store.MarkSettled(ctx, hash, settleDate)
+	require.NoError(t, err)
+	require.False(t, added)
+
+	resp, err := etcdClient.Get(ctx, settlementKey(hash))
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	require.Equal(t, "1600000000", string(resp.Kvs[0].Value))
+}
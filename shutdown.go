@@ -0,0 +1,98 @@
+package aperture
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	// defaultShutdownTimeout is the default maximum time we wait for
+	// in-flight requests to complete when shutting down.
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// shutdownServer stops the given server from accepting new connections and
+// waits for its in-flight requests to complete. If they don't complete before
+// the context is done, their connections are closed forcefully.
+func shutdownServer(ctx context.Context, server *http.Server) error {
+	err := server.Shutdown(ctx)
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+
+	log.Warnf("Timed out waiting for requests to %s to complete, closing "+
+		"their connections", server.Addr)
+
+	return server.Close()
+}
+
+// grpcDrainer serves a gRPC server through an HTTP server and keeps track of
+// the RPCs in flight, so it can be stopped gracefully. The gRPC server can't
+// do so itself, as it is unable to drain RPCs it serves through ServeHTTP.
+type grpcDrainer struct {
+	server *grpc.Server
+
+	mu       sync.Mutex
+	stopping bool
+	inFlight sync.WaitGroup
+}
+
+// A compile time flag to ensure the grpcDrainer satisfies the http.Handler
+// interface.
+var _ http.Handler = (*grpcDrainer)(nil)
+
+// newGRPCDrainer creates a new drainer for the given gRPC server.
+func newGRPCDrainer(server *grpc.Server) *grpcDrainer {
+	return &grpcDrainer{
+		server: server,
+	}
+}
+
+// ServeHTTP passes the request on to the gRPC server, unless it is being
+// stopped.
+//
+// NOTE: This is part of the http.Handler interface.
+func (d *grpcDrainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	if d.stopping {
+		d.mu.Unlock()
+		http.Error(
+			w, "server shutting down", http.StatusServiceUnavailable,
+		)
+		return
+	}
+	d.inFlight.Add(1)
+	d.mu.Unlock()
+
+	defer d.inFlight.Done()
+	d.server.ServeHTTP(w, r)
+}
+
+// GracefulStop rejects new RPCs and waits for the ones in flight to complete
+// before stopping the gRPC server. If they don't complete before the context
+// is done, the server is stopped forcefully, which cancels them.
+func (d *grpcDrainer) GracefulStop(ctx context.Context) {
+	d.mu.Lock()
+	d.stopping = true
+	d.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		d.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		d.server.GracefulStop()
+
+	case <-ctx.Done():
+		log.Warnf("Timed out waiting for gRPC calls to complete, " +
+			"canceling them")
+		d.server.Stop()
+	}
+}
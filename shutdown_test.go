@@ -0,0 +1,92 @@
+package aperture
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/aperturerpc"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// TestGRPCDrainer makes sure RPCs served through an HTTP server are given time
+// to complete when the gRPC server is stopped, are canceled once the timeout
+// expires and that no new RPCs are accepted in the meantime.
+func TestGRPCDrainer(t *testing.T) {
+	subscriber := &mockStateSubscriber{
+		stateChan:  make(chan lnrpc.Invoice_InvoiceState, 1),
+		subscribed: make(chan lntypes.Hash, 2),
+	}
+	server := grpc.NewServer()
+	aperturerpc.RegisterApertureServiceServer(
+		server, newRPCServer(subscriber, defaultPaymentStreamTimeout),
+	)
+	drainer := newGRPCDrainer(server)
+
+	httpServer := httptest.NewUnstartedServer(drainer)
+	httpServer.EnableHTTP2 = true
+	httpServer.StartTLS()
+	defer httpServer.Close()
+
+	conn, err := grpc.Dial(
+		httpServer.Listener.Addr().String(),
+		grpc.WithTransportCredentials(credentials.NewTLS(
+			&tls.Config{InsecureSkipVerify: true},
+		)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := aperturerpc.NewApertureServiceClient(conn)
+
+	// Start a call that waits for an invoice and stop the server while
+	// it's in flight.
+	ctx := context.Background()
+	hash := lntypes.Hash{1}
+	stream, err := client.StreamPaymentStatus(
+		ctx, &aperturerpc.PaymentStatusRequest{PaymentHash: hash[:]},
+	)
+	require.NoError(t, err)
+	event, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, aperturerpc.PaymentState_PENDING, event.State)
+
+	stopCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		drainer.GracefulStop(stopCtx)
+		close(stopped)
+	}()
+
+	// New calls must be rejected while we're waiting.
+	require.Eventually(t, func() bool {
+		newStream, err := client.StreamPaymentStatus(
+			ctx, &aperturerpc.PaymentStatusRequest{
+				PaymentHash: hash[:],
+			},
+		)
+		if err != nil {
+			return false
+		}
+		_, err = newStream.Recv()
+		return status.Code(err) == codes.Unavailable
+	}, time.Second, 10*time.Millisecond)
+
+	// The call in flight isn't completed, so it is canceled once the
+	// timeout expires.
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("gRPC server wasn't stopped")
+	}
+	_, err = stream.Recv()
+	require.Error(t, err)
+}
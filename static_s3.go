@@ -0,0 +1,349 @@
+package aperture
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// s3ETagCacheSize is the maximum number of ETags of static files in
+	// an S3 bucket we keep, to answer conditional requests without
+	// contacting the object store.
+	s3ETagCacheSize = 10000
+
+	// s3ETagCacheTTL is the time we trust the ETag of a static file for.
+	// A file changed in the bucket in the meantime isn't sent to clients
+	// that already have an older version until then.
+	s3ETagCacheTTL = time.Minute
+
+	// s3IndexFile is the file that is served for requests to a directory,
+	// like the index.html of the local file server.
+	s3IndexFile = "index.html"
+)
+
+// s3ObjectGetter is the part of the S3 client we need to serve static files.
+type s3ObjectGetter interface {
+	// GetObject retrieves an object from a bucket.
+	GetObject(ctx context.Context, params *s3.GetObjectInput,
+		optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// s3ETag is the cached ETag of a static file.
+type s3ETag struct {
+	key    string
+	etag   string
+	expiry time.Time
+}
+
+// s3StaticServer serves static files from a bucket of an S3-compatible object
+// store, streaming every file from the store. The ETags of the files are
+// cached, so clients that already have the current version of a file are
+// answered without contacting the store.
+type s3StaticServer struct {
+	client s3ObjectGetter
+	bucket string
+
+	// now returns the current time. It can be replaced in tests.
+	now func() time.Time
+
+	mtx   sync.Mutex
+	order *list.List
+	etags map[string]*list.Element
+}
+
+// A compile-time constraint to ensure s3StaticServer is an http.Handler.
+var _ http.Handler = (*s3StaticServer)(nil)
+
+// newS3StaticServer creates a static file server for the configured bucket.
+// The credentials are loaded from the default locations of the AWS SDK, like
+// the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables, the
+// shared credentials file or the IAM role of the instance.
+func newS3StaticServer(cfg *StaticConfig) (*s3StaticServer, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.S3Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.S3Region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(
+		context.Background(), opts...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load AWS config: %v", err)
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		// Other S3-compatible object stores usually don't support
+		// the bucket being part of the host name.
+		if cfg.S3Endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(
+				cfg.S3Endpoint,
+			)
+			o.UsePathStyle = true
+		}
+	})
+
+	return newS3StaticServerWithClient(client, cfg.S3Bucket), nil
+}
+
+// newS3StaticServerWithClient creates a static file server for the given
+// bucket that uses the given client.
+func newS3StaticServerWithClient(client s3ObjectGetter,
+	bucket string) *s3StaticServer {
+
+	return &s3StaticServer{
+		client: client,
+		bucket: bucket,
+		now:    time.Now,
+		order:  list.New(),
+		etags:  make(map[string]*list.Element),
+	}
+}
+
+// ServeHTTP serves the static file at the path of the request from the bucket.
+//
+// NOTE: This is part of the http.Handler interface.
+func (s *s3StaticServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := s3ObjectKey(r.URL.Path)
+
+	// A client that already has the current version of the file doesn't
+	// need it again.
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if etag, ok := s.cachedETag(key); ok && etagMatches(ifNoneMatch, etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
+	}
+	if byteRange := r.Header.Get("Range"); byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+
+	object, err := s.client.GetObject(r.Context(), input)
+	switch {
+	case err == nil:
+
+	case s3ErrorStatus(err) == http.StatusNotModified:
+		w.WriteHeader(http.StatusNotModified)
+		return
+
+	case isS3NotFound(err):
+		s.dropETag(key)
+		http.NotFound(w, r)
+		return
+
+	default:
+		log.Errorf("Unable to get static file %s from S3 bucket %s: %v",
+			key, s.bucket, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway),
+			http.StatusBadGateway)
+		return
+	}
+	defer object.Body.Close()
+
+	header := w.Header()
+	if object.ETag != nil {
+		s.cacheETag(key, *object.ETag)
+		header.Set("ETag", *object.ETag)
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if object.ContentType != nil {
+		contentType = *object.ContentType
+	}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if object.CacheControl != nil {
+		header.Set("Cache-Control", *object.CacheControl)
+	}
+	if object.LastModified != nil {
+		header.Set("Last-Modified",
+			object.LastModified.UTC().Format(http.TimeFormat))
+	}
+	header.Set("Accept-Ranges", "bytes")
+	header.Set(
+		"Content-Length", strconv.FormatInt(object.ContentLength, 10),
+	)
+
+	status := http.StatusOK
+	if object.ContentRange != nil {
+		header.Set("Content-Range", *object.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, object.Body); err != nil {
+		log.Debugf("Unable to stream static file %s: %v", key, err)
+	}
+}
+
+// cachedETag returns the ETag of the file with the given key if we know it and
+// it didn't expire yet.
+func (s *s3StaticServer) cachedETag(key string) (string, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	elem, ok := s.etags[key]
+	if !ok {
+		return "", false
+	}
+
+	entry := elem.Value.(*s3ETag)
+	if !s.now().Before(entry.expiry) {
+		s.order.Remove(elem)
+		delete(s.etags, key)
+		return "", false
+	}
+
+	return entry.etag, true
+}
+
+// cacheETag stores the ETag of the file with the given key, evicting the least
+// recently stored one if the cache is full.
+func (s *s3StaticServer) cacheETag(key, etag string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	entry := &s3ETag{
+		key:    key,
+		etag:   etag,
+		expiry: s.now().Add(s3ETagCacheTTL),
+	}
+	if elem, ok := s.etags[key]; ok {
+		elem.Value = entry
+		s.order.MoveToFront(elem)
+		return
+	}
+
+	s.etags[key] = s.order.PushFront(entry)
+	if s.order.Len() > s3ETagCacheSize {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.etags, oldest.Value.(*s3ETag).key)
+	}
+}
+
+// dropETag removes the ETag of the file with the given key from the cache.
+func (s *s3StaticServer) dropETag(key string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if elem, ok := s.etags[key]; ok {
+		s.order.Remove(elem)
+		delete(s.etags, key)
+	}
+}
+
+// s3ObjectKey returns the key of the object that is served for the given
+// request path. Requests for a directory are served its index file.
+func s3ObjectKey(requestPath string) string {
+	key := strings.TrimPrefix(path.Clean("/"+requestPath), "/")
+	if key == "" {
+		return s3IndexFile
+	}
+	if strings.HasSuffix(requestPath, "/") {
+		return key + "/" + s3IndexFile
+	}
+
+	return key
+}
+
+// etagMatches returns true if the value of an If-None-Match header matches the
+// given ETag. Weak ETags are compared like strong ones.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" ||
+			strings.TrimPrefix(candidate, "W/") ==
+				strings.TrimPrefix(etag, "W/") {
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// s3ErrorStatus returns the HTTP status code of the response the given error
+// of the S3 client was caused by, or zero if it wasn't caused by a response.
+func s3ErrorStatus(err error) int {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode()
+	}
+
+	return 0
+}
+
+// isS3NotFound returns true if the given error of the S3 client means the
+// object doesn't exist.
+func isS3NotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return true
+	}
+
+	return s3ErrorStatus(err) == http.StatusNotFound
+}
+
+// validateStaticS3 makes sure the configuration of the S3 bucket static files
+// are served from is sane.
+func validateStaticS3(cfg *StaticConfig) error {
+	if cfg == nil {
+		return nil
+	}
+
+	if cfg.S3Bucket == "" {
+		if cfg.S3Region != "" || cfg.S3Endpoint != "" {
+			return fmt.Errorf("static.s3bucket must be set to " +
+				"serve static files from S3")
+		}
+
+		return nil
+	}
+
+	if cfg.S3Endpoint != "" {
+		u, err := url.Parse(cfg.S3Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" {
+
+			return fmt.Errorf("static.s3endpoint must be an "+
+				"http or https URL, got %q", cfg.S3Endpoint)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package aperture
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestS3StaticServer makes sure static files are streamed from an
+// S3-compatible object store and conditional requests for files whose ETag is
+// known are answered without contacting the store.
+func TestS3StaticServer(t *testing.T) {
+	objects := map[string]struct {
+		etag string
+		body string
+	}{
+		"/static/index.html": {`"etag-index"`, "<h1>hello</h1>"},
+		"/static/style.css":  {`"etag-style"`, "body {}"},
+	}
+
+	var requests int32
+	store := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+
+			object, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte("<Error><Code>NoSuchKey" +
+					"</Code></Error>"))
+				return
+			}
+
+			w.Header().Set("ETag", object.etag)
+			if r.Header.Get("If-None-Match") == object.etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			_, _ = w.Write([]byte(object.body))
+		},
+	))
+	defer store.Close()
+
+	// Make sure no credentials or settings of the machine running the
+	// test are picked up.
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "creds"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_ACCESS_KEY_ID", "access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+
+	cfg := &StaticConfig{
+		Enabled:    true,
+		S3Bucket:   "static",
+		S3Region:   "us-east-1",
+		S3Endpoint: store.URL,
+	}
+	require.NoError(t, validateStaticS3(cfg))
+
+	server, err := newS3StaticServer(cfg)
+	require.NoError(t, err)
+
+	get := func(method, path, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	// Requests for the root are served the index file.
+	rec := get(http.MethodGet, "/", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	body, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+	require.Equal(t, "<h1>hello</h1>", string(body))
+	require.Equal(t, `"etag-index"`, rec.Header().Get("ETag"))
+	require.True(t, strings.HasPrefix(
+		rec.Header().Get("Content-Type"), "text/html",
+	))
+	require.EqualValues(t, 1, atomic.LoadInt32(&requests))
+
+	// The ETag is known now, so a client that has the file is answered
+	// right away.
+	rec = get(http.MethodGet, "/index.html", `W/"etag-index"`)
+	require.Equal(t, http.StatusNotModified, rec.Code)
+	require.EqualValues(t, 1, atomic.LoadInt32(&requests))
+
+	// If we don't know the ETag yet, the store decides.
+	rec = get(http.MethodGet, "/style.css", `"etag-style"`)
+	require.Equal(t, http.StatusNotModified, rec.Code)
+	require.EqualValues(t, 2, atomic.LoadInt32(&requests))
+
+	// An outdated version is replaced.
+	rec = get(http.MethodGet, "/style.css", `"etag-old"`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "body {}", rec.Body.String())
+
+	rec = get(http.MethodGet, "/missing.js", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = get(http.MethodPost, "/index.html", "")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// The bucket must be set for the other options to be used.
+	cfg.S3Bucket = ""
+	require.Error(t, validateStaticS3(cfg))
+}
@@ -0,0 +1,218 @@
+// Package sqlite implements the stores of LSAT secrets and onion service
+// private keys on top of a SQLite database. These are the only stores backed
+// by SQLite, all other state of aperture is still kept in etcd.
+package sqlite
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/tor"
+
+	// Register the pure Go SQLite driver, so no cgo is needed.
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// busyTimeout is the time SQLite waits for a lock on the database
+	// file to be released before giving up.
+	busyTimeout = 5 * time.Second
+)
+
+// schema creates the tables of the store if they don't exist yet.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS secrets (
+		token_id BLOB PRIMARY KEY,
+		secret BLOB NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS onion_keys (
+		onion_type TEXT PRIMARY KEY,
+		private_key BLOB NOT NULL
+	)`,
+}
+
+// Open opens the SQLite database at the given path, creating it and its tables
+// if they don't exist yet.
+func Open(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open sqlite database: %v",
+			err)
+	}
+
+	// SQLite only allows a single writer at a time, so we serialize all
+	// queries over one connection instead of failing with busy errors.
+	db.SetMaxOpenConns(1)
+
+	pragmas := []string{
+		"PRAGMA journal_mode = WAL",
+		fmt.Sprintf("PRAGMA busy_timeout = %d",
+			busyTimeout.Milliseconds()),
+	}
+	for _, stmt := range append(pragmas, schema...) {
+		if _, err := db.Exec(stmt); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("unable to initialize sqlite "+
+				"database: %v", err)
+		}
+	}
+
+	return db, nil
+}
+
+// SQLiteSecretStore is a store of LSAT secrets backed by a SQLite database.
+// The secrets are keyed by the hash of the LSAT identifier they belong to.
+type SQLiteSecretStore struct {
+	db *sql.DB
+}
+
+// A compile-time constraint to ensure SQLiteSecretStore implements
+// mint.SecretStore.
+var _ mint.SecretStore = (*SQLiteSecretStore)(nil)
+
+// NewSQLiteSecretStore instantiates a new LSAT secrets store backed by the
+// given SQLite database.
+func NewSQLiteSecretStore(db *sql.DB) *SQLiteSecretStore {
+	return &SQLiteSecretStore{db: db}
+}
+
+// NewSecret creates a new cryptographically random secret which is keyed by the
+// given hash.
+func (s *SQLiteSecretStore) NewSecret(ctx context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	var secret [lsat.SecretSize]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return secret, err
+	}
+
+	_, err := s.db.ExecContext(
+		ctx, `INSERT OR REPLACE INTO secrets (token_id, secret,
+		created_at) VALUES (?, ?, ?)`, id[:], secret[:],
+		time.Now().UTC(),
+	)
+	return secret, err
+}
+
+// GetSecret returns the cryptographically random secret that corresponds to the
+// given hash. If there is no secret, then mint.ErrSecretNotFound is returned.
+func (s *SQLiteSecretStore) GetSecret(ctx context.Context,
+	id [sha256.Size]byte) ([lsat.SecretSize]byte, error) {
+
+	var value []byte
+	err := s.db.QueryRowContext(
+		ctx, "SELECT secret FROM secrets WHERE token_id = ?", id[:],
+	).Scan(&value)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return [lsat.SecretSize]byte{}, mint.ErrSecretNotFound
+
+	case err != nil:
+		return [lsat.SecretSize]byte{}, err
+
+	case len(value) != lsat.SecretSize:
+		return [lsat.SecretSize]byte{}, fmt.Errorf("invalid secret "+
+			"size %v", len(value))
+	}
+
+	var secret [lsat.SecretSize]byte
+	copy(secret[:], value)
+	return secret, nil
+}
+
+// RevokeSecret removes the cryptographically random secret that corresponds to
+// the given hash. This acts as a NOP if the secret does not exist.
+func (s *SQLiteSecretStore) RevokeSecret(ctx context.Context,
+	id [sha256.Size]byte) error {
+
+	_, err := s.db.ExecContext(
+		ctx, "DELETE FROM secrets WHERE token_id = ?", id[:],
+	)
+	return err
+}
+
+// SQLiteOnionStore is a SQLite-based implementation of tor.OnionStore.
+type SQLiteOnionStore struct {
+	db *sql.DB
+}
+
+// A compile-time constraint to ensure SQLiteOnionStore implements
+// tor.OnionStore.
+var _ tor.OnionStore = (*SQLiteOnionStore)(nil)
+
+// NewSQLiteOnionStore creates a SQLite-based implementation of tor.OnionStore.
+func NewSQLiteOnionStore(db *sql.DB) *SQLiteOnionStore {
+	return &SQLiteOnionStore{db: db}
+}
+
+// onionTypeName returns the name an onion service's private key of the given
+// type is stored under.
+func onionTypeName(onionType tor.OnionType) (string, error) {
+	switch onionType {
+	case tor.V2:
+		return "v2", nil
+
+	case tor.V3:
+		return "v3", nil
+
+	default:
+		return "", fmt.Errorf("unknown onion type %v", onionType)
+	}
+}
+
+// StorePrivateKey stores the given private key.
+func (s *SQLiteOnionStore) StorePrivateKey(onionType tor.OnionType,
+	privateKey []byte) error {
+
+	typeName, err := onionTypeName(onionType)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		`INSERT OR REPLACE INTO onion_keys (onion_type, private_key)
+		VALUES (?, ?)`, typeName, privateKey,
+	)
+	return err
+}
+
+// PrivateKey retrieves a stored private key. If it is not found, then
+// ErrNoPrivateKey should be returned.
+func (s *SQLiteOnionStore) PrivateKey(onionType tor.OnionType) ([]byte, error) {
+	typeName, err := onionTypeName(onionType)
+	if err != nil {
+		return nil, err
+	}
+
+	var privateKey []byte
+	err = s.db.QueryRow(
+		"SELECT private_key FROM onion_keys WHERE onion_type = ?",
+		typeName,
+	).Scan(&privateKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, tor.ErrNoPrivateKey
+	}
+
+	return privateKey, err
+}
+
+// DeletePrivateKey securely removes the private key from the store.
+func (s *SQLiteOnionStore) DeletePrivateKey(onionType tor.OnionType) error {
+	typeName, err := onionTypeName(onionType)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"DELETE FROM onion_keys WHERE onion_type = ?", typeName,
+	)
+	return err
+}
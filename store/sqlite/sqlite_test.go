@@ -0,0 +1,78 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/tor"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSQLiteSecretStore makes sure LSAT secrets can be stored in SQLite and
+// survive the database being reopened.
+func TestSQLiteSecretStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aperture.db")
+	db, err := Open(path)
+	require.NoError(t, err)
+
+	store := NewSQLiteSecretStore(db)
+	ctx := context.Background()
+	id := sha256.Sum256([]byte("id"))
+
+	_, err = store.GetSecret(ctx, id)
+	require.Equal(t, mint.ErrSecretNotFound, err)
+
+	secret, err := store.NewSecret(ctx, id)
+	require.NoError(t, err)
+	stored, err := store.GetSecret(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, secret, stored)
+
+	// The secret is still there after reopening the database.
+	require.NoError(t, db.Close())
+	db, err = Open(path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	store = NewSQLiteSecretStore(db)
+	stored, err = store.GetSecret(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, secret, stored)
+
+	require.NoError(t, store.RevokeSecret(ctx, id))
+	_, err = store.GetSecret(ctx, id)
+	require.Equal(t, mint.ErrSecretNotFound, err)
+
+	// Revoking a secret that doesn't exist is not an error.
+	require.NoError(t, store.RevokeSecret(ctx, id))
+}
+
+// TestSQLiteOnionStore makes sure onion service private keys can be stored in
+// SQLite.
+func TestSQLiteOnionStore(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "aperture.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := NewSQLiteOnionStore(db)
+
+	_, err = store.PrivateKey(tor.V3)
+	require.Equal(t, tor.ErrNoPrivateKey, err)
+
+	privateKey := []byte("hide_me_plz_v3")
+	require.NoError(t, store.StorePrivateKey(tor.V3, privateKey))
+	stored, err := store.PrivateKey(tor.V3)
+	require.NoError(t, err)
+	require.Equal(t, privateKey, stored)
+
+	// Keys of the other type are stored separately.
+	_, err = store.PrivateKey(tor.V2)
+	require.Equal(t, tor.ErrNoPrivateKey, err)
+
+	require.NoError(t, store.DeletePrivateKey(tor.V3))
+	_, err = store.PrivateKey(tor.V3)
+	require.Equal(t, tor.ErrNoPrivateKey, err)
+}
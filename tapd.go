@@ -0,0 +1,180 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// tapdAddInvoicePath is the path of tapd's REST endpoint that creates
+	// invoices paid with a Taproot Asset over asset channels.
+	tapdAddInvoicePath = "/v1/taproot-assets/channels/invoice"
+
+	// tapdMacaroonHeader is the header tapd's REST API expects the hex
+	// encoded macaroon in.
+	tapdMacaroonHeader = "Grpc-Metadata-macaroon"
+
+	// tapdRequestTimeout is the maximum time we wait for tapd to create
+	// an invoice, which includes getting a price quote from a peer.
+	tapdRequestTimeout = 30 * time.Second
+
+	// maxTapdResponseSize is the maximum size of a response of tapd we
+	// read.
+	maxTapdResponseSize = 1 << 20
+)
+
+// tapdClient creates invoices that are paid with Taproot Assets through the
+// REST API of tapd.
+type tapdClient struct {
+	url      string
+	macaroon string
+	client   *http.Client
+}
+
+// A compile-time constraint to ensure tapdClient implements
+// AssetInvoiceClient.
+var _ AssetInvoiceClient = (*tapdClient)(nil)
+
+// newTapdClient creates a new client for the tapd instance described by the
+// given config.
+func newTapdClient(cfg *AuthConfig) (*tapdClient, error) {
+	tlsCert, err := ioutil.ReadFile(cfg.TapdTLSPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read tapd TLS certificate: "+
+			"%v", err)
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(tlsCert) {
+		return nil, fmt.Errorf("no certificates found in %s",
+			cfg.TapdTLSPath)
+	}
+
+	mac, err := ioutil.ReadFile(cfg.TapdMacaroonPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read tapd macaroon: %v", err)
+	}
+
+	return &tapdClient{
+		url:      "https://" + cfg.TapdHost + tapdAddInvoicePath,
+		macaroon: hex.EncodeToString(mac),
+		client: &http.Client{
+			Timeout: tapdRequestTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:    rootCAs,
+					MinVersion: tls.VersionTLS12,
+				},
+			},
+		},
+	}, nil
+}
+
+// tapdAddInvoiceRequest is the body of a request to tapd's AddInvoice
+// endpoint.
+type tapdAddInvoiceRequest struct {
+	AssetID        string          `json:"asset_id"`
+	AssetAmount    string          `json:"asset_amount"`
+	InvoiceRequest json.RawMessage `json:"invoice_request"`
+}
+
+// tapdAddInvoiceResponse is the body of a response of tapd's AddInvoice
+// endpoint. We're only interested in the invoice that was created.
+type tapdAddInvoiceResponse struct {
+	InvoiceResult json.RawMessage `json:"invoice_result"`
+}
+
+// tapdError is the body of an error response of tapd's REST API.
+type tapdError struct {
+	Message string `json:"message"`
+}
+
+// AddAssetInvoice adds a new invoice for the given amount of the asset with
+// the given ID to the lnd node tapd is connected to. Tapd determines the value
+// of the invoice in satoshis from a price quote of its asset channel peer.
+//
+// NOTE: This is part of the AssetInvoiceClient interface.
+func (c *tapdClient) AddAssetInvoice(ctx context.Context, assetID []byte,
+	assetAmount uint64,
+	invoice *lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error) {
+
+	invoiceReq, err := protojson.MarshalOptions{
+		UseProtoNames: true,
+	}.Marshal(invoice)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(&tapdAddInvoiceRequest{
+		AssetID:        base64.StdEncoding.EncodeToString(assetID),
+		AssetAmount:    strconv.FormatUint(assetAmount, 10),
+		InvoiceRequest: invoiceReq,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, c.url, bytes.NewReader(body),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(tapdMacaroonHeader, c.macaroon)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to add asset invoice: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(
+		io.LimitReader(resp.Body, maxTapdResponseSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var tapdErr tapdError
+		if json.Unmarshal(respBody, &tapdErr) == nil &&
+			tapdErr.Message != "" {
+
+			return nil, fmt.Errorf("unable to add asset invoice: "+
+				"%s", tapdErr.Message)
+		}
+
+		return nil, fmt.Errorf("unable to add asset invoice: tapd "+
+			"responded with %s", resp.Status)
+	}
+
+	var result tapdAddInvoiceResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("invalid tapd response: %v", err)
+	}
+	if len(result.InvoiceResult) == 0 {
+		return nil, fmt.Errorf("tapd response contains no invoice")
+	}
+
+	response := &lnrpc.AddInvoiceResponse{}
+	err = protojson.UnmarshalOptions{
+		DiscardUnknown: true,
+	}.Unmarshal(result.InvoiceResult, response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tapd invoice: %v", err)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,101 @@
+package aperture
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTapdClientAddAssetInvoice makes sure asset invoices are requested from
+// tapd's REST API and the invoice it created is returned.
+func TestTapdClientAddAssetInvoice(t *testing.T) {
+	t.Parallel()
+
+	mac := []byte("tapd macaroon")
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, tapdAddInvoicePath, r.URL.Path)
+			require.Equal(
+				t, hex.EncodeToString(mac),
+				r.Header.Get(tapdMacaroonHeader),
+			)
+
+			var req map[string]interface{}
+			err := json.NewDecoder(r.Body).Decode(&req)
+			require.NoError(t, err)
+
+			// No price quote can be found for a single unit.
+			if req["asset_amount"] == "1" {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(
+					`{"code":2,"message":"no quote"}`,
+				))
+				return
+			}
+
+			require.Equal(
+				t, base64.StdEncoding.EncodeToString(
+					[]byte{1, 2, 3},
+				), req["asset_id"],
+			)
+			require.Equal(t, "100", req["asset_amount"])
+			require.Equal(
+				t, map[string]interface{}{"memo": "LSAT"},
+				req["invoice_request"],
+			)
+
+			_, _ = w.Write([]byte(`{
+				"accepted_buy_quote": {"id": "cXVvdGU="},
+				"invoice_result": {
+					"r_hash": "BAUG",
+					"payment_request": "lnbc1",
+					"add_index": "7"
+				}
+			}`))
+		},
+	))
+	defer server.Close()
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.cert")
+	certPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})
+	require.NoError(t, ioutil.WriteFile(certPath, certPEM, 0600))
+	macPath := filepath.Join(dir, "admin.macaroon")
+	require.NoError(t, ioutil.WriteFile(macPath, mac, 0600))
+
+	client, err := newTapdClient(&AuthConfig{
+		TapdHost:         strings.TrimPrefix(server.URL, "https://"),
+		TapdTLSPath:      certPath,
+		TapdMacaroonPath: macPath,
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	resp, err := client.AddAssetInvoice(
+		ctx, []byte{1, 2, 3}, 100, &lnrpc.Invoice{Memo: "LSAT"},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []byte{4, 5, 6}, resp.RHash)
+	require.Equal(t, "lnbc1", resp.PaymentRequest)
+	require.Equal(t, uint64(7), resp.AddIndex)
+
+	// Errors of tapd are passed on.
+	_, err = client.AddAssetInvoice(
+		ctx, []byte{1, 2, 3}, 1, &lnrpc.Invoice{Memo: "LSAT"},
+	)
+	require.EqualError(t, err, "unable to add asset invoice: no quote")
+}
@@ -0,0 +1,263 @@
+package aperture
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// tlsHandshakeTimeout is the maximum time a client has to complete the
+	// TLS handshake after connecting.
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	// tlsHandshakeDuration tracks the time successful TLS handshakes took.
+	tlsHandshakeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "aperture",
+		Name:      "tls_handshake_duration_seconds",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// tlsHandshakeErrors counts the failed TLS handshakes by the alert
+	// that caused them.
+	tlsHandshakeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "aperture",
+			Name:      "tls_handshake_errors_total",
+		}, []string{"alert"},
+	)
+
+	// tlsAlertNames are the names of the TLS alerts as defined in RFC 8446
+	// by their code.
+	tlsAlertNames = map[uint8]string{
+		0:   "close_notify",
+		10:  "unexpected_message",
+		20:  "bad_record_mac",
+		21:  "decryption_failed",
+		22:  "record_overflow",
+		40:  "handshake_failure",
+		42:  "bad_certificate",
+		43:  "unsupported_certificate",
+		44:  "certificate_revoked",
+		45:  "certificate_expired",
+		46:  "certificate_unknown",
+		47:  "illegal_parameter",
+		48:  "unknown_ca",
+		49:  "access_denied",
+		50:  "decode_error",
+		51:  "decrypt_error",
+		70:  "protocol_version",
+		71:  "insufficient_security",
+		80:  "internal_error",
+		86:  "inappropriate_fallback",
+		90:  "user_canceled",
+		100: "no_renegotiation",
+		109: "missing_extension",
+		110: "unsupported_extension",
+		112: "unrecognized_name",
+		113: "bad_certificate_status_response",
+		115: "unknown_psk_identity",
+		116: "certificate_required",
+		120: "no_application_protocol",
+	}
+
+	// tlsAlertNamesByText maps the error messages of the TLS alerts to
+	// their names. The crypto/tls package doesn't export the type of the
+	// alerts sent and received over TCP connections, so they can only be
+	// told apart by their message.
+	tlsAlertNamesByText = func() map[string]string {
+		names := make(map[string]string, len(tlsAlertNames))
+		for code, name := range tlsAlertNames {
+			names[tls.AlertError(code).Error()] = name
+		}
+
+		return names
+	}()
+)
+
+// tlsAlertLabel returns the label of the TLS alert that caused the given
+// handshake error. If the error doesn't tell, the alert we sent is used, if
+// any. Errors not caused by an alert are labeled timeout, eof or other.
+func tlsAlertLabel(err error, sentAlert *uint8) string {
+	var alertErr tls.AlertError
+	if errors.As(err, &alertErr) {
+		if name, ok := tlsAlertNames[uint8(alertErr)]; ok {
+			return name
+		}
+	}
+
+	// Alerts received from the client are wrapped in an OpError.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Err != nil {
+		if name, ok := tlsAlertNamesByText[opErr.Err.Error()]; ok {
+			return name
+		}
+	}
+
+	if sentAlert != nil {
+		if name, ok := tlsAlertNames[*sentAlert]; ok {
+			return name
+		}
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+
+	case errors.Is(err, io.EOF):
+		return "eof"
+
+	default:
+		return "other"
+	}
+}
+
+// alertRecordingConn is a connection that records the last unencrypted TLS
+// alert written to it during the handshake. The crypto/tls package returns a
+// descriptive error instead of the alert it sent to the client when a
+// handshake fails, so this is the only way to find out which one it was.
+type alertRecordingConn struct {
+	net.Conn
+
+	// handshakeDone is set once the handshake completed, after which no
+	// alerts are recorded anymore.
+	handshakeDone bool
+
+	// sentAlert is the description of the last alert that was sent.
+	sentAlert *uint8
+}
+
+// Write writes to the connection and records the alert if the data is an
+// unencrypted alert record.
+//
+// NOTE: This is part of the net.Conn interface.
+func (c *alertRecordingConn) Write(b []byte) (int, error) {
+	// An alert record consists of the record type 21, the protocol
+	// version, the length of 2 and the level and description of the alert.
+	if !c.handshakeDone && len(b) >= 7 && b[0] == 21 {
+		description := b[6]
+		c.sentAlert = &description
+	}
+
+	return c.Conn.Write(b)
+}
+
+// tlsMetricsListener is a TLS listener that completes the handshake of every
+// connection before it is returned by Accept, so the duration and failures of
+// the handshakes can be recorded. The handshakes are done concurrently so slow
+// clients don't hold up others.
+type tlsMetricsListener struct {
+	net.Listener
+
+	config *tls.Config
+
+	conns chan net.Conn
+	errs  chan error
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// newTLSMetricsListener wraps the given listener so TLS is served on the
+// connections it accepts with the given config.
+func newTLSMetricsListener(listener net.Listener,
+	config *tls.Config) *tlsMetricsListener {
+
+	l := &tlsMetricsListener{
+		Listener: listener,
+		config:   config,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		quit:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+
+	return l
+}
+
+// acceptLoop accepts connections until the listener is closed and starts their
+// handshake.
+func (l *tlsMetricsListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.quit:
+				return
+			}
+
+			// Errors other than closing the listener are usually
+			// temporary, the HTTP server retries after those.
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go l.handshake(conn)
+	}
+}
+
+// handshake completes the TLS handshake of the given connection, records its
+// outcome and passes the connection on to Accept if it succeeded.
+func (l *tlsMetricsListener) handshake(conn net.Conn) {
+	recordingConn := &alertRecordingConn{Conn: conn}
+	tlsConn := tls.Server(recordingConn, l.config)
+
+	start := time.Now()
+	_ = tlsConn.SetDeadline(start.Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Debugf("TLS handshake with %v failed: %v",
+			conn.RemoteAddr(), err)
+
+		label := tlsAlertLabel(err, recordingConn.sentAlert)
+		tlsHandshakeErrors.WithLabelValues(label).Inc()
+		_ = tlsConn.Close()
+		return
+	}
+	tlsHandshakeDuration.Observe(time.Since(start).Seconds())
+	_ = tlsConn.SetDeadline(time.Time{})
+	recordingConn.handshakeDone = true
+
+	select {
+	case l.conns <- tlsConn:
+	case <-l.quit:
+		_ = tlsConn.Close()
+	}
+}
+
+// Accept returns the next connection that completed the TLS handshake.
+//
+// NOTE: This is part of the net.Listener interface.
+func (l *tlsMetricsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+
+	case err := <-l.errs:
+		return nil, err
+
+	case <-l.quit:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections.
+//
+// NOTE: This is part of the net.Listener interface.
+func (l *tlsMetricsListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.quit)
+	})
+
+	return l.Listener.Close()
+}
@@ -0,0 +1,101 @@
+package aperture
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntest/wait"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTLSMetricsListener makes sure connections are served after their TLS
+// handshake completed and that failed handshakes are counted by their alert.
+func TestTLSMetricsListener(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "aperture")
+	require.NoError(t, err)
+	defer os.RemoveAll(baseDir)
+
+	certDir := filepath.Join(baseDir, "certs")
+	require.NoError(t, os.MkdirAll(certDir, 0700))
+
+	certManager, err := NewCertManager("localhost", baseDir, certDir, false)
+	require.NoError(t, err)
+	tlsConfig, err := certManager.TLSConfig(nil)
+	require.NoError(t, err)
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			_ *http.Request) {
+
+			w.WriteHeader(http.StatusTeapot)
+		}),
+		TLSConfig: tlsConfig,
+	}
+	go func() {
+		_ = server.Serve(newTLSMetricsListener(listener, tlsConfig))
+	}()
+	defer server.Close()
+
+	addr := listener.Addr().String()
+
+	// A successful handshake should allow HTTP/2 to be negotiated.
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	resp, err := client.Get("https://" + addr)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTeapot, resp.StatusCode)
+	require.Equal(t, 2, resp.ProtoMajor)
+
+	errorCount := func(alert string) func() bool {
+		return func() bool {
+			counter := tlsHandshakeErrors.WithLabelValues(alert)
+			return testutil.ToFloat64(counter) == 1
+		}
+	}
+
+	// A client not trusting our certificate sends an alert.
+	_, err = tls.Dial("tcp", addr, &tls.Config{})
+	require.Error(t, err)
+	require.NoError(t, wait.Predicate(
+		errorCount("bad_certificate"), time.Second,
+	))
+
+	// If there's no cipher suite in common, we send an alert.
+	_, err = tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		},
+	})
+	require.Error(t, err)
+	require.NoError(t, wait.Predicate(
+		errorCount("handshake_failure"), time.Second,
+	))
+
+	// Clients not speaking TLS at all don't cause an alert.
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, wait.Predicate(errorCount("other"), time.Second))
+	require.NoError(t, conn.Close())
+}
@@ -0,0 +1,99 @@
+package aperture
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// tlsVersions maps the TLS versions that can be configured to their
+// identifiers.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig is the configuration of the TLS connections aperture accepts and
+// makes. Each kind of connection is configured independently.
+type TLSConfig struct {
+	// Listener are the TLS settings of the connections clients make to
+	// the proxy.
+	Listener *TLSSettings `group:"listener" namespace:"listener" description:"TLS settings of the proxy listener."`
+
+	// Admin are the TLS settings of the connections made to the admin
+	// API.
+	Admin *TLSSettings `group:"admin" namespace:"admin" description:"TLS settings of the admin API listener."`
+
+	// Backend are the TLS settings of the connections the proxy makes to
+	// the backends of the services.
+	Backend *TLSSettings `group:"backend" namespace:"backend" description:"TLS settings of the connections to the service backends."`
+}
+
+// listener returns the TLS settings of the proxy listener, if there are any.
+func (c *TLSConfig) listener() *TLSSettings {
+	if c == nil {
+		return nil
+	}
+
+	return c.Listener
+}
+
+// admin returns the TLS settings of the admin API, if there are any.
+func (c *TLSConfig) admin() *TLSSettings {
+	if c == nil {
+		return nil
+	}
+
+	return c.Admin
+}
+
+// backend returns the TLS settings of the connections to the backends, if
+// there are any.
+func (c *TLSConfig) backend() *TLSSettings {
+	if c == nil {
+		return nil
+	}
+
+	return c.Backend
+}
+
+// validate makes sure all TLS settings are valid.
+func (c *TLSConfig) validate() error {
+	settings := map[string]*TLSSettings{
+		"listener": c.listener(),
+		"admin":    c.admin(),
+		"backend":  c.backend(),
+	}
+	for name, s := range settings {
+		if _, err := s.minVersion(0); err != nil {
+			return fmt.Errorf("invalid %s TLS settings: %v", name,
+				err)
+		}
+	}
+
+	return nil
+}
+
+// TLSSettings are the TLS settings of a single kind of connection.
+type TLSSettings struct {
+	// TLSMinVersion is the minimum TLS version that is negotiated, like
+	// 1.2.
+	TLSMinVersion string `long:"tlsminversion" description:"The minimum TLS version to negotiate, one of 1.0, 1.1, 1.2 or 1.3"`
+}
+
+// minVersion returns the identifier of the configured minimum TLS version or
+// the given default if none is configured.
+func (s *TLSSettings) minVersion(defaultVersion uint16) (uint16, error) {
+	if s == nil || s.TLSMinVersion == "" {
+		return defaultVersion, nil
+	}
+
+	version, ok := tlsVersions[s.TLSMinVersion]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, must be one of "+
+			"1.0, 1.1, 1.2 or 1.3", s.TLSMinVersion)
+	}
+
+	return version, nil
+}
@@ -0,0 +1,48 @@
+package aperture
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTLSSettings makes sure the minimum TLS version of each kind of
+// connection can be configured independently.
+func TestTLSSettings(t *testing.T) {
+	t.Parallel()
+
+	var unset *TLSSettings
+	version, err := unset.minVersion(tls.VersionTLS10)
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS10), version)
+
+	cfg := &TLSConfig{
+		Listener: &TLSSettings{TLSMinVersion: "1.3"},
+		Backend:  &TLSSettings{TLSMinVersion: "1.1"},
+	}
+	require.NoError(t, cfg.validate())
+
+	// The admin API uses the version of the proxy listener unless it is
+	// configured separately.
+	proxyTLSConfig := &tls.Config{MinVersion: tls.VersionTLS13}
+	adminTLSConfig, err := newAdminTLSConfig(
+		&AdminConfig{}, cfg.admin(), proxyTLSConfig,
+	)
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), adminTLSConfig.MinVersion)
+
+	cfg.Admin = &TLSSettings{TLSMinVersion: "1.2"}
+	adminTLSConfig, err = newAdminTLSConfig(
+		&AdminConfig{}, cfg.admin(), proxyTLSConfig,
+	)
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), adminTLSConfig.MinVersion)
+	require.Equal(t, uint16(tls.VersionTLS13), proxyTLSConfig.MinVersion)
+
+	cfg.Backend.TLSMinVersion = "1.4"
+	require.Error(t, cfg.validate())
+
+	var nilCfg *TLSConfig
+	require.NoError(t, nilCfg.validate())
+}
@@ -0,0 +1,291 @@
+package aperture
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/lightningnetwork/lnd/lntypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// tokensPrefix is the key we'll use to prefix all LSAT token IDs with
+	// when storing the records of minted LSATs in an etcd cluster.
+	tokensPrefix = "tokens"
+
+	// tokensWatchRetryInterval is the time we wait before watching the
+	// records of the LSATs again after the watch failed.
+	tokensWatchRetryInterval = 5 * time.Second
+)
+
+var (
+	// errTokenNotFound is returned if there is no record of an LSAT.
+	errTokenNotFound = errors.New("token not found")
+)
+
+// tokensKey returns the full key to store the record of the LSAT with the given
+// token ID under.
+//
+// The resulting path of the token ID bff4ee83 within etcd would look like:
+//
+//	lsat/proxy/tokens/bff4ee83
+func tokensKey(id lsat.TokenID) string {
+	return strings.Join(
+		[]string{topLevelKey, tokensPrefix, id.String()},
+		etcdKeyDelimeter,
+	)
+}
+
+// tokensKeyPrefix returns the prefix of the keys the records of all LSATs are
+// stored under.
+func tokensKeyPrefix() string {
+	return strings.Join(
+		[]string{topLevelKey, tokensPrefix, ""}, etcdKeyDelimeter,
+	)
+}
+
+// tokenRecord is the record of a minted LSAT.
+type tokenRecord struct {
+	// TokenID is the hex encoded ID of the LSAT.
+	TokenID string `json:"token_id"`
+
+	// Version is the version of the LSAT's identifier.
+	Version uint16 `json:"version"`
+
+	// PaymentHash is the hex encoded payment hash of the LSAT's invoice.
+	PaymentHash string `json:"payment_hash"`
+
+	// Services are the names of the services the LSAT was minted for.
+	Services []string `json:"services"`
+
+	// CreatedAt is the time the LSAT was minted.
+	CreatedAt time.Time `json:"created_at"`
+
+	// ExpiresAt is the time the LSAT expires at as issued by the mint. It
+	// is nil if the LSAT doesn't expire.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// identifier returns the identifier of the recorded LSAT.
+func (r *tokenRecord) identifier() (*lsat.Identifier, error) {
+	tokenID, err := lsat.MakeIDFromString(r.TokenID)
+	if err != nil {
+		return nil, err
+	}
+	paymentHash, err := lntypes.MakeHashFromStr(r.PaymentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lsat.Identifier{
+		Version:     r.Version,
+		PaymentHash: paymentHash,
+		TokenID:     tokenID,
+	}, nil
+}
+
+// tokenStore keeps a record of the minted LSATs in an etcd cluster, so
+// operators can list and revoke them.
+type tokenStore struct {
+	*clientv3.Client
+}
+
+// A compile-time constraint to ensure tokenStore implements mint.TokenStore.
+var _ mint.TokenStore = (*tokenStore)(nil)
+
+// newTokenStore instantiates a new LSAT record store backed by an etcd
+// cluster.
+func newTokenStore(client *clientv3.Client) *tokenStore {
+	return &tokenStore{Client: client}
+}
+
+// AddToken records the LSAT with the given identifier that was minted for the
+// given services and expires at the given time, unless it is zero.
+//
+// NOTE: This is part of the mint.TokenStore interface.
+func (s *tokenStore) AddToken(ctx context.Context, id *lsat.Identifier,
+	services []lsat.Service, expiry time.Time) error {
+
+	record := &tokenRecord{
+		TokenID:     id.TokenID.String(),
+		Version:     id.Version,
+		PaymentHash: id.PaymentHash.String(),
+		Services:    make([]string, 0, len(services)),
+		CreatedAt:   time.Now().UTC(),
+	}
+	for _, service := range services {
+		record.Services = append(record.Services, service.Name)
+	}
+	if !expiry.IsZero() {
+		expiresAt := expiry.UTC()
+		record.ExpiresAt = &expiresAt
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Put(ctx, tokensKey(id.TokenID), string(value))
+	return err
+}
+
+// RenewToken records the new expiry of the refreshed LSAT with the given token
+// ID, or the zero time if it doesn't expire anymore. This acts as a NOP if
+// there is no record of the LSAT.
+//
+// NOTE: This is part of the mint.TokenStore interface.
+func (s *tokenStore) RenewToken(ctx context.Context, id lsat.TokenID,
+	expiry time.Time) error {
+
+	key := tokensKey(id)
+	for {
+		resp, err := s.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return nil
+		}
+
+		var record tokenRecord
+		if err := json.Unmarshal(resp.Kvs[0].Value, &record); err != nil {
+			return err
+		}
+		record.ExpiresAt = nil
+		if !expiry.IsZero() {
+			expiresAt := expiry.UTC()
+			record.ExpiresAt = &expiresAt
+		}
+
+		value, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+
+		// Only update the record if it wasn't changed or removed
+		// since we looked, otherwise try again.
+		revision := resp.Kvs[0].ModRevision
+		txnResp, err := s.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+			Then(clientv3.OpPut(key, string(value))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txnResp.Succeeded {
+			return nil
+		}
+	}
+}
+
+// Token returns the record of the LSAT with the given token ID. If there is
+// none, errTokenNotFound is returned.
+func (s *tokenStore) Token(ctx context.Context,
+	id lsat.TokenID) (*tokenRecord, error) {
+
+	resp, err := s.Get(ctx, tokensKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, errTokenNotFound
+	}
+
+	var record tokenRecord
+	if err := json.Unmarshal(resp.Kvs[0].Value, &record); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// Tokens returns the records of all LSATs that weren't revoked.
+func (s *tokenStore) Tokens(ctx context.Context) ([]*tokenRecord, error) {
+	resp, err := s.Get(ctx, tokensKeyPrefix(), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*tokenRecord, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var record tokenRecord
+		if err := json.Unmarshal(kv.Value, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, &record)
+	}
+
+	return records, nil
+}
+
+// RemoveToken removes the record of the LSAT with the given token ID. This acts
+// as a NOP if there is none.
+func (s *tokenStore) RemoveToken(ctx context.Context, id lsat.TokenID) error {
+	_, err := s.Delete(ctx, tokensKey(id))
+	return err
+}
+
+// watchRemovedTokens calls removed with the token ID of every LSAT whose record
+// is removed, which happens once it is revoked by any aperture instance, until
+// the quit channel is closed. If the watch fails, missed is called as LSATs
+// might have been removed in the meantime.
+func (s *tokenStore) watchRemovedTokens(quit <-chan struct{},
+	removed func(lsat.TokenID), missed func()) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watch := func() clientv3.WatchChan {
+		return s.Watch(
+			ctx, tokensKeyPrefix(), clientv3.WithPrefix(),
+			clientv3.WithFilterPut(),
+		)
+	}
+	watchChan := watch()
+
+	for {
+		select {
+		case resp, ok := <-watchChan:
+			if !ok || resp.Err() != nil {
+				err := resp.Err()
+				if !ok {
+					err = errors.New("watch closed")
+				}
+				log.Warnf("Watch of LSAT records in etcd failed, "+
+					"restarting: %v", err)
+
+				select {
+				case <-time.After(tokensWatchRetryInterval):
+				case <-quit:
+					return
+				}
+
+				missed()
+				watchChan = watch()
+				continue
+			}
+
+			for _, event := range resp.Events {
+				id, err := lsat.MakeIDFromString(strings.TrimPrefix(
+					string(event.Kv.Key), tokensKeyPrefix(),
+				))
+				if err != nil {
+					log.Warnf("Invalid LSAT record key %s "+
+						"removed: %v", event.Kv.Key, err)
+					continue
+				}
+
+				removed(id)
+			}
+
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAdminTokens makes sure the minted LSATs are listed by the admin API and
+// can be revoked through it.
+func TestAdminTokens(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	a := &Aperture{
+		cfg:        &Config{},
+		etcdClient: etcdClient,
+	}
+	s := newAdminServer(&AdminConfig{Secret: "secret"}, a, nil)
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(adminSecretHeader, "secret")
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+	listTokens := func() []*tokenInfo {
+		rec := request(http.MethodGet, adminPathPrefix+"/tokens")
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var tokens []*tokenInfo
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&tokens))
+		return tokens
+	}
+
+	// Mint an LSAT the way the proxy does, with a record of it.
+	ctx := context.Background()
+	secrets := newSecretStore(etcdClient)
+	id := &lsat.Identifier{
+		Version:     lsat.LatestVersion,
+		PaymentHash: sha256.Sum256([]byte("preimage")),
+		TokenID:     lsat.TokenID{1},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, lsat.EncodeIdentifier(&buf, id))
+	idHash := sha256.Sum256(buf.Bytes())
+	_, err := secrets.NewSecret(ctx, idHash)
+	require.NoError(t, err)
+	err = newTokenStore(etcdClient).AddToken(
+		ctx, id, []lsat.Service{{Name: "service"}}, time.Time{},
+	)
+	require.NoError(t, err)
+
+	// LSATs that were only used with a budget are listed as well.
+	legacyID := lsat.TokenID{2}
+	budgets := newBudgetStore(etcdClient)
+	require.NoError(t, budgets.ConsumeBudget(ctx, legacyID, 3))
+
+	tokens := listTokens()
+	require.Len(t, tokens, 2)
+	require.Equal(t, id.TokenID.String(), tokens[0].TokenID)
+	require.Equal(t, id.PaymentHash.String(), tokens[0].PaymentHash)
+	require.Equal(t, []string{"service"}, tokens[0].Services)
+	require.Nil(t, tokens[0].Budget)
+	require.Equal(t, legacyID.String(), tokens[1].TokenID)
+	require.Equal(t, uint32(2), *tokens[1].Remaining)
+
+	// Revoking the LSAT removes its secret, so it can't be used anymore.
+	tokenPath := adminTokensPath + id.TokenID.String()
+	rec := request(http.MethodDelete, tokenPath)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	_, err = secrets.GetSecret(ctx, idHash)
+	require.Equal(t, mint.ErrSecretNotFound, err)
+	tokens = listTokens()
+	require.Len(t, tokens, 1)
+	require.Equal(t, legacyID.String(), tokens[0].TokenID)
+
+	rec = request(http.MethodDelete, tokenPath)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = request(http.MethodDelete, adminTokensPath+"invalid")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = request(http.MethodGet, tokenPath)
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+// TestWatchRemovedTokens makes sure the removal of the record of an LSAT is
+// noticed, so it can be dropped from the token cache.
+func TestWatchRemovedTokens(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	tokens := newTokenStore(etcdClient)
+	id := &lsat.Identifier{
+		Version: lsat.LatestVersion,
+		TokenID: lsat.TokenID{1},
+	}
+	err := tokens.AddToken(
+		ctx, id, []lsat.Service{{Name: "service"}}, time.Time{},
+	)
+	require.NoError(t, err)
+
+	removed := make(chan lsat.TokenID, 1)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		tokens.watchRemovedTokens(quit, func(id lsat.TokenID) {
+			removed <- id
+		}, func() {})
+	}()
+
+	// The watch is established in the background, so we keep adding and
+	// removing the record until its removal is reported.
+	require.Eventually(t, func() bool {
+		require.NoError(t, tokens.RemoveToken(ctx, id.TokenID))
+
+		select {
+		case removedID := <-removed:
+			require.Equal(t, id.TokenID, removedID)
+			return true
+
+		case <-time.After(50 * time.Millisecond):
+			err := tokens.AddToken(
+				ctx, id, []lsat.Service{{Name: "service"}},
+				time.Time{},
+			)
+			require.NoError(t, err)
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(quit)
+	<-done
+}
@@ -0,0 +1,282 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+const (
+	// TokenEventIssued is the event that is posted when a new LSAT is
+	// issued in a payment challenge.
+	TokenEventIssued = "token.issued"
+
+	// TokenEventSettled is the event that is posted when the invoice of
+	// an LSAT is settled.
+	TokenEventSettled = "token.settled"
+
+	// HeaderWebhookSignature is the header field that carries the hex
+	// encoded HMAC-SHA256 of the body of a token webhook request, keyed
+	// with the webhook secret.
+	HeaderWebhookSignature = "X-Aperture-Signature"
+
+	// tokenWebhookAttempts is the maximum number of attempts at
+	// delivering a token event.
+	tokenWebhookAttempts = 3
+
+	// defaultTokenWebhookBackoff is the time we wait before retrying to
+	// deliver a token event for the first time. It is doubled after every
+	// failed attempt.
+	defaultTokenWebhookBackoff = time.Second
+)
+
+// WebhookConfig is the configuration of the webhook the events in the life of
+// an LSAT are posted to.
+type WebhookConfig struct {
+	// URL is the URL the events are posted to. No events are posted if
+	// this is empty.
+	URL string `long:"url" description:"URL to post events in the life of an LSAT, like it being issued or its invoice being settled, to as JSON. Leave empty to disable."`
+
+	// Secret is the key the body of every request is signed with.
+	Secret string `long:"secret" description:"Secret to sign the body of every webhook request with using HMAC-SHA256. The hex encoded signature is sent in the X-Aperture-Signature header. Leave empty to not sign requests."`
+
+	// Events are the events that are posted. All events are posted if
+	// this is empty.
+	Events []string `long:"events" description:"An event to post to the webhook, either token.issued or token.settled. Can be specified multiple times. All events are posted if none is specified."`
+}
+
+// enabled returns true if token events should be posted.
+func (w *WebhookConfig) enabled() bool {
+	return w != nil && w.URL != ""
+}
+
+// validate makes sure the webhook configuration is sane.
+func (w *WebhookConfig) validate() error {
+	if w == nil {
+		return nil
+	}
+
+	if w.URL == "" {
+		if w.Secret != "" || len(w.Events) > 0 {
+			return fmt.Errorf("webhook url must be set to post " +
+				"token events")
+		}
+
+		return nil
+	}
+
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook url must be an http or https URL")
+	}
+
+	for _, event := range w.Events {
+		if event != TokenEventIssued && event != TokenEventSettled {
+			return fmt.Errorf("unknown webhook event %q", event)
+		}
+	}
+
+	return nil
+}
+
+// tokenEvent is the JSON payload we post to the token webhook.
+type tokenEvent struct {
+	Event       string `json:"event"`
+	TokenID     string `json:"token_id,omitempty"`
+	PaymentHash string `json:"payment_hash"`
+	Service     string `json:"service,omitempty"`
+	AmountSat   int64  `json:"amount_sat"`
+	Timestamp   string `json:"timestamp"`
+}
+
+// tokenWebhook posts the events in the life of an LSAT to a configured URL.
+// Failed deliveries are retried with an exponential backoff.
+type tokenWebhook struct {
+	url    string
+	secret []byte
+	events map[string]bool
+	client *http.Client
+
+	// backoff is the time we wait before the first retry.
+	backoff time.Duration
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// A compile-time constraint to ensure tokenWebhook is notified about issued
+// LSATs and settled invoices.
+var _ auth.TokenNotifier = (*tokenWebhook)(nil)
+var _ SettlementNotifier = (*tokenWebhook)(nil)
+
+// newTokenWebhook creates a new webhook that posts the configured token events.
+func newTokenWebhook(cfg *WebhookConfig) *tokenWebhook {
+	events := make(map[string]bool)
+	for _, event := range cfg.Events {
+		events[event] = true
+	}
+	if len(events) == 0 {
+		events[TokenEventIssued] = true
+		events[TokenEventSettled] = true
+	}
+
+	return &tokenWebhook{
+		url:    cfg.URL,
+		secret: []byte(cfg.Secret),
+		events: events,
+		client: &http.Client{
+			Timeout: webhookRequestTimeout,
+		},
+		backoff: defaultTokenWebhookBackoff,
+		quit:    make(chan struct{}),
+	}
+}
+
+// wants returns true if the given event is posted to the webhook.
+func (w *tokenWebhook) wants(event string) bool {
+	return w.events[event]
+}
+
+// Stop waits for all pending webhook requests to complete. Deliveries that
+// failed aren't retried anymore.
+func (w *tokenWebhook) Stop() {
+	close(w.quit)
+	w.wg.Wait()
+}
+
+// TokenIssued posts an event for the LSAT that was issued.
+//
+// NOTE: This is part of the auth.TokenNotifier interface.
+func (w *tokenWebhook) TokenIssued(id *lsat.Identifier,
+	service lsat.Service) {
+
+	if !w.wants(TokenEventIssued) {
+		return
+	}
+
+	w.post(&tokenEvent{
+		Event:       TokenEventIssued,
+		TokenID:     id.TokenID.String(),
+		PaymentHash: id.PaymentHash.String(),
+		Service:     service.Name,
+		AmountSat:   service.Price,
+	})
+}
+
+// TokenSettled posts an event for the settled invoice of an LSAT.
+//
+// NOTE: This is part of the SettlementNotifier interface.
+func (w *tokenWebhook) TokenSettled(hash lntypes.Hash,
+	invoice *lnrpc.Invoice) {
+
+	if !w.wants(TokenEventSettled) {
+		return
+	}
+
+	w.post(&tokenEvent{
+		Event:       TokenEventSettled,
+		PaymentHash: hash.String(),
+		AmountSat:   invoice.AmtPaidSat,
+	})
+}
+
+// post delivers the given event in the background so the caller isn't
+// blocked.
+func (w *tokenWebhook) post(event *tokenEvent) {
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339)
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		if err := w.deliver(event); err != nil {
+			log.Errorf("Unable to deliver %s webhook event for "+
+				"%s: %v", event.Event, event.PaymentHash, err)
+		}
+	}()
+}
+
+// deliver tries to deliver the given event until it succeeds, the maximum
+// number of attempts is reached or the webhook is stopped.
+func (w *tokenWebhook) deliver(event *tokenEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		err = w.send(body)
+		if err == nil || attempt == tokenWebhookAttempts {
+			return err
+		}
+
+		log.Debugf("Attempt %d at delivering %s webhook event "+
+			"failed, retrying in %v: %v", attempt, event.Event,
+			backoff, err)
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+
+		case <-w.quit:
+			return fmt.Errorf("shutting down after %d attempts: "+
+				"%v", attempt, err)
+		}
+	}
+}
+
+// send does a single attempt at delivering the given body to the webhook URL.
+func (w *tokenWebhook) send(body []byte) error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), webhookRequestTimeout,
+	)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, w.url, bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		req.Header.Set(HeaderWebhookSignature, w.sign(body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the given body.
+func (w *tokenWebhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	_, _ = mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
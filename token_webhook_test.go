@@ -0,0 +1,163 @@
+package aperture
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookRequest is a request received by the test webhook server.
+type webhookRequest struct {
+	body      []byte
+	signature string
+}
+
+// newWebhookServer starts a server that answers the given number of requests
+// with an error before accepting them and passes all requests it receives to
+// the returned channel.
+func newWebhookServer(t *testing.T, failures int32) (*httptest.Server,
+	chan *webhookRequest) {
+
+	requests := make(chan *webhookRequest, 10)
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			requests <- &webhookRequest{
+				body:      body,
+				signature: r.Header.Get(HeaderWebhookSignature),
+			}
+
+			if atomic.AddInt32(&received, 1) <= failures {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		},
+	))
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+// receiveEvent returns the next request received by the webhook server.
+func receiveEvent(t *testing.T, requests chan *webhookRequest) *webhookRequest {
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(defaultTimeout):
+		t.Fatal("no webhook request received")
+		return nil
+	}
+}
+
+// TestTokenWebhook makes sure settled invoices are posted to the webhook once
+// with a valid signature, that failed deliveries are retried up to the maximum
+// number of attempts and that only the configured events are posted.
+func TestTokenWebhook(t *testing.T) {
+	t.Parallel()
+
+	server, requests := newWebhookServer(t, 2)
+	webhook := newTokenWebhook(&WebhookConfig{
+		URL:    server.URL,
+		Secret: "secret",
+		Events: []string{TokenEventSettled},
+	})
+	webhook.backoff = time.Millisecond
+
+	store := &mockSettlementStore{
+		settled: make(map[lntypes.Hash]time.Time),
+	}
+	c, invoiceMock, _ := newChallenger()
+	RecordSettlements(store)(c)
+	NotifySettlements(webhook)(c)
+	require.NoError(t, c.Start())
+	defer func() {
+		invoiceMock.stop()
+		c.Stop()
+	}()
+
+	// The settlement is delivered on the third attempt, and an update of
+	// the same invoice isn't posted again.
+	hash := lntypes.Hash{1}
+	invoice := newInvoice(hash, 1, lnrpc.Invoice_SETTLED)
+	invoice.AmtPaidSat = 1000
+	invoiceMock.updateChan <- invoice
+	invoiceMock.updateChan <- invoice
+
+	var req *webhookRequest
+	for i := 0; i < tokenWebhookAttempts; i++ {
+		req = receiveEvent(t, requests)
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	_, _ = mac.Write(req.body)
+	require.Equal(t, hex.EncodeToString(mac.Sum(nil)), req.signature)
+
+	var event tokenEvent
+	require.NoError(t, json.Unmarshal(req.body, &event))
+	require.Equal(t, TokenEventSettled, event.Event)
+	require.Equal(t, hash.String(), event.PaymentHash)
+	require.EqualValues(t, 1000, event.AmountSat)
+	require.NotEmpty(t, event.Timestamp)
+
+	// Issued LSATs aren't posted since only settlements were configured.
+	webhook.TokenIssued(&lsat.Identifier{}, lsat.Service{Name: "test"})
+	webhook.Stop()
+	select {
+	case req := <-requests:
+		t.Fatalf("unexpected webhook request: %s", req.body)
+	default:
+	}
+
+	// Deliveries are given up after the maximum number of attempts.
+	server, requests = newWebhookServer(t, tokenWebhookAttempts+1)
+	webhook = newTokenWebhook(&WebhookConfig{URL: server.URL})
+	webhook.backoff = time.Millisecond
+	tokenID := lsat.TokenID{2}
+	webhook.TokenIssued(&lsat.Identifier{
+		PaymentHash: hash,
+		TokenID:     tokenID,
+	}, lsat.Service{Name: "test", Price: 10})
+	for i := 0; i < tokenWebhookAttempts; i++ {
+		req = receiveEvent(t, requests)
+	}
+	webhook.Stop()
+	require.Empty(t, requests)
+
+	require.Empty(t, req.signature)
+	require.NoError(t, json.Unmarshal(req.body, &event))
+	require.Equal(t, TokenEventIssued, event.Event)
+	require.Equal(t, tokenID.String(), event.TokenID)
+	require.Equal(t, "test", event.Service)
+	require.EqualValues(t, 10, event.AmountSat)
+}
+
+// TestWebhookConfigValidate makes sure invalid webhook configurations are
+// rejected.
+func TestWebhookConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, (&WebhookConfig{}).validate())
+	require.NoError(t, (&WebhookConfig{
+		URL:    "https://hooks.example.com",
+		Events: []string{TokenEventIssued},
+	}).validate())
+	require.Error(t, (&WebhookConfig{Secret: "secret"}).validate())
+	require.Error(t, (&WebhookConfig{URL: "ftp://example.com"}).validate())
+	require.Error(t, (&WebhookConfig{
+		URL:    "https://hooks.example.com",
+		Events: []string{"token.revoked"},
+	}).validate())
+}
@@ -0,0 +1,179 @@
+package aperture
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookRequestTimeout is the maximum time a single webhook request
+	// can take.
+	webhookRequestTimeout = 10 * time.Second
+
+	// webhookActionTrigger is the action of an event that reports a new
+	// problem.
+	webhookActionTrigger = "trigger"
+
+	// webhookActionResolve is the action of an event that reports a
+	// problem has cleared.
+	webhookActionResolve = "resolve"
+)
+
+// webhookEvent is the JSON payload we post to the configured webhook URL.
+type webhookEvent struct {
+	Action    string `json:"action"`
+	Key       string `json:"key"`
+	Severity  string `json:"severity,omitempty"`
+	Summary   string `json:"summary,omitempty"`
+	Source    string `json:"source"`
+	Timestamp string `json:"timestamp"`
+}
+
+// webhookAlerter is an alerter that posts every event as JSON to a
+// configured URL.
+type webhookAlerter struct {
+	url    string
+	source string
+	client *http.Client
+
+	// active holds the keys of the alerts that were triggered and not
+	// resolved yet. Unlike PagerDuty, webhook receivers don't deduplicate
+	// the events they receive, so an alert that is already active isn't
+	// posted again.
+	active    map[string]struct{}
+	activeMtx sync.Mutex
+
+	wg sync.WaitGroup
+}
+
+// A compile-time constraint to ensure webhookAlerter implements alerter.
+var _ alerter = (*webhookAlerter)(nil)
+
+// newWebhookAlerter creates a new alerter that posts events to the given URL.
+func newWebhookAlerter(url string) *webhookAlerter {
+	source, err := os.Hostname()
+	if err != nil {
+		source = "aperture"
+	}
+
+	return &webhookAlerter{
+		url:    url,
+		source: source,
+		client: &http.Client{
+			Timeout: webhookRequestTimeout,
+		},
+		active: make(map[string]struct{}),
+	}
+}
+
+// Start starts the alerter.
+//
+// NOTE: This is part of the alerter interface.
+func (w *webhookAlerter) Start() error {
+	return nil
+}
+
+// Stop waits for all pending webhook requests to complete.
+//
+// NOTE: This is part of the alerter interface.
+func (w *webhookAlerter) Stop() {
+	w.wg.Wait()
+}
+
+// Trigger posts a trigger event for the given alert, unless an alert with the
+// same key is still active.
+//
+// NOTE: This is part of the alerter interface.
+func (w *webhookAlerter) Trigger(al *alert) {
+	w.activeMtx.Lock()
+	_, ok := w.active[al.key]
+	w.active[al.key] = struct{}{}
+	w.activeMtx.Unlock()
+
+	if ok {
+		log.Debugf("Not posting webhook event for active alert %s",
+			al.key)
+		return
+	}
+
+	w.post(&webhookEvent{
+		Action:   webhookActionTrigger,
+		Key:      al.key,
+		Severity: string(al.severity),
+		Summary:  al.summary,
+	})
+}
+
+// Resolve posts a resolve event for the condition with the given key. The
+// event is posted even if we didn't trigger the alert, as it might have been
+// triggered before a restart.
+//
+// NOTE: This is part of the alerter interface.
+func (w *webhookAlerter) Resolve(key string) {
+	w.activeMtx.Lock()
+	delete(w.active, key)
+	w.activeMtx.Unlock()
+
+	w.post(&webhookEvent{
+		Action: webhookActionResolve,
+		Key:    key,
+	})
+}
+
+// post delivers the given event in the background so the caller isn't
+// blocked.
+func (w *webhookAlerter) post(event *webhookEvent) {
+	event.Source = w.source
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339)
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		// Requests that are still in flight on shutdown are canceled
+		// once the request timeout is reached at the latest.
+		ctx, cancel := context.WithTimeout(
+			context.Background(), webhookRequestTimeout,
+		)
+		defer cancel()
+
+		if err := w.send(ctx, event); err != nil {
+			log.Errorf("Unable to deliver %s webhook event for %s: "+
+				"%v", event.Action, event.Key, err)
+		}
+	}()
+}
+
+// send does a single attempt at delivering an event to the webhook URL.
+func (w *webhookAlerter) send(ctx context.Context, event *webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, w.url, bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package aperture
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestWebhookAlerter makes sure alerts are posted to the webhook as JSON and
+// that an alert that is still active isn't posted again.
+func TestWebhookAlerter(t *testing.T) {
+	events := make(chan *webhookEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(
+				t, "application/json",
+				r.Header.Get("Content-Type"),
+			)
+
+			event := &webhookEvent{}
+			err := json.NewDecoder(r.Body).Decode(event)
+			require.NoError(t, err)
+			events <- event
+		},
+	))
+	defer server.Close()
+
+	alerter := newWebhookAlerter(server.URL)
+	require.NoError(t, alerter.Start())
+
+	receive := func() *webhookEvent {
+		select {
+		case event := <-events:
+			return event
+
+		case <-time.After(defaultTimeout):
+			t.Fatalf("webhook event not received")
+			return nil
+		}
+	}
+
+	al := alertFromError(&lndConnectionError{err: errors.New("EOF")})
+	alerter.Trigger(al)
+	event := receive()
+	require.Equal(t, webhookActionTrigger, event.Action)
+	require.Equal(t, alertKeyLndConnection, event.Key)
+	require.Equal(t, "critical", event.Severity)
+	require.Contains(t, event.Summary, "EOF")
+	require.NotEmpty(t, event.Source)
+	require.NotEmpty(t, event.Timestamp)
+
+	// Triggering the same alert again while it's active posts nothing,
+	// the next event we receive is the resolve event.
+	alerter.Trigger(al)
+	alerter.Resolve(alertKeyLndConnection)
+	event = receive()
+	require.Equal(t, webhookActionResolve, event.Action)
+	require.Equal(t, alertKeyLndConnection, event.Key)
+	require.Empty(t, event.Severity)
+
+	// Once resolved, the alert is posted again if triggered.
+	alerter.Trigger(al)
+	event = receive()
+	require.Equal(t, webhookActionTrigger, event.Action)
+
+	alerter.Stop()
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %s event", event.Action)
+	default:
+	}
+}